@@ -0,0 +1,287 @@
+// Package analysis finds likely mistakes in Monkey programs without running
+// them, such as variables that are never used or code that can never run.
+package analysis
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/evaluator"
+	"monkey/object"
+	"sort"
+)
+
+// A likely mistake in a program, found by a check, at the position of the
+// code it is about.
+type Finding struct {
+	Line    int
+	Column  int
+	Check   string // the name of the check that found it
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%d:%d: %s (%s)", f.Line, f.Column, f.Message, f.Check)
+}
+
+// A kind of mistake Lint looks for.
+type Check struct {
+	Name string
+	Doc  string
+	Run  func(program *ast.Program) []Finding
+}
+
+// The checks Lint runs, by default all of them.
+var Checks = []*Check{
+	{
+		Name: "unused",
+		Doc:  "variables declared within a function or block that are never used",
+		Run:  checkUnused,
+	},
+	{
+		Name: "unreachable",
+		Doc:  "statements after a return or throw, which can never run",
+		Run:  checkUnreachable,
+	},
+	{
+		Name: "shadow",
+		Doc:  "declarations that hide a variable of an enclosing scope",
+		Run:  checkShadow,
+	},
+	{
+		Name: "condition",
+		Doc:  "conditions of ifs, loops and ?: whose value is always the same",
+		Run:  checkConditions,
+	},
+	{
+		Name: "call",
+		Doc:  "calls of values that aren't functions, such as numbers and strings",
+		Run:  checkCalls,
+	},
+}
+
+// Returns the check with the given name, or nil if there is none.
+func LookupCheck(name string) *Check {
+	for _, check := range Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	return nil
+}
+
+// Runs checks over program, or all of Checks if none are given, returning
+// what they find in the order it appears in the source. Macros are checked
+// as they are written, before they are expanded, and the code within their
+// definitions isn't checked at all.
+func Lint(program *ast.Program, checks ...*Check) []Finding {
+	if len(checks) == 0 {
+		checks = Checks
+	}
+
+	findings := []Finding{}
+	for _, check := range checks {
+		findings = append(findings, check.Run(program)...)
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return findings
+}
+
+// Returns a finding of check about node.
+func finding(check string, node ast.Node, format string, args ...interface{}) Finding {
+	tok := ast.StartOf(node)
+	return Finding{
+		Line:    tok.Line,
+		Column:  tok.Column,
+		Check:   check,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Traverses program like ast.Inspect, but without going into the
+// definitions of macros, whose code is only a template.
+func inspect(program *ast.Program, f func(ast.Node)) {
+	ast.Inspect(program, func(node ast.Node) bool {
+		if node == nil {
+			return true
+		}
+		f(node)
+		_, isMacro := node.(*ast.MacroLiteral)
+		return !isMacro
+	})
+}
+
+func checkUnreachable(program *ast.Program) []Finding {
+	var findings []Finding
+	report := func(stmts []ast.Statement) {
+		for i := 0; i < len(stmts)-1; i++ {
+			switch stmts[i].(type) {
+			case *ast.ReturnStatement, *ast.ThrowStatement:
+				// Only the first statement that can't run is reported.
+				findings = append(findings, finding("unreachable", stmts[i+1], "unreachable code"))
+				return
+			}
+		}
+	}
+
+	inspect(program, func(node ast.Node) {
+		switch node := node.(type) {
+		case *ast.Program:
+			report(node.Statements)
+		case *ast.BlockStatement:
+			report(node.Statements)
+		}
+	})
+	return findings
+}
+
+func checkConditions(program *ast.Program) []Finding {
+	var findings []Finding
+	inspect(program, func(node ast.Node) {
+		switch node := node.(type) {
+		case *ast.IfExpression:
+			if truthy, ok := constantTruth(node.Condition); ok {
+				findings = append(findings, finding("condition", node.Condition,
+					"condition is always %t", truthy))
+			}
+		case *ast.ConditionalExpression:
+			if truthy, ok := constantTruth(node.Condition); ok {
+				findings = append(findings, finding("condition", node.Condition,
+					"condition is always %t", truthy))
+			}
+		case *ast.WhileExpression:
+			// `while (true)` is how a loop that only ends by returning or
+			// throwing is written.
+			if truthy, ok := constantTruth(node.Condition); ok && !truthy {
+				findings = append(findings, finding("condition", node.Condition,
+					"condition is always false, so the loop never runs"))
+			}
+		}
+	})
+	return findings
+}
+
+// Reports whether expr, if made only of literals and operators, is always
+// truthy or always falsy, by evaluating it. Only false and null are falsy.
+func constantTruth(expr ast.Expression) (truthy, ok bool) {
+	if !isConstant(expr) {
+		return false, false
+	}
+
+	switch value := evaluator.Eval(expr, object.NewEnvironment()).(type) {
+	case *object.Error:
+		return false, false
+	case *object.Boolean:
+		return value.Value, true
+	case *object.NULL:
+		return false, true
+	default:
+		return true, true
+	}
+}
+
+// Reports whether expr is made only of literals and operators, so that it
+// has the same value every time.
+func isConstant(expr ast.Expression) bool {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean, *ast.NullLiteral:
+		return true
+	case *ast.PrefixExpression:
+		return isConstant(expr.Right)
+	case *ast.InfixExpression:
+		return isConstant(expr.Left) && isConstant(expr.Right)
+	case *ast.ArrayLiteral:
+		for _, element := range expr.Elements {
+			if !isConstant(element) {
+				return false
+			}
+		}
+		return true
+	case *ast.HashLiteral:
+		for key, value := range expr.Pairs {
+			if !isConstant(key) || !isConstant(value) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func checkCalls(program *ast.Program) []Finding {
+	var findings []Finding
+	inspect(program, func(node ast.Node) {
+		call, ok := node.(*ast.CallExpression)
+		if !ok {
+			return
+		}
+		if kind := literalKind(call.Function); kind != "" {
+			findings = append(findings, finding("call", call.Function,
+				"calling %s, which is not a function", kind))
+		}
+	})
+
+	// Calls of variables bound to such values are found as the variables
+	// are resolved.
+	for _, b := range resolve(program).bindings {
+		if b.assigned {
+			continue
+		}
+		if kind := literalKind(b.value); kind != "" {
+			for _, call := range b.calls {
+				findings = append(findings, finding("call", call.Function,
+					"calling %s, which is %s, not a function", b.ident.Value, kind))
+			}
+		}
+	}
+	return findings
+}
+
+// Returns what kind of value expr is, as in "an integer", if it is a literal
+// of a value that can't be called, or else "".
+func literalKind(expr ast.Expression) string {
+	switch expr.(type) {
+	case *ast.IntegerLiteral:
+		return "an integer"
+	case *ast.FloatLiteral:
+		return "a float"
+	case *ast.StringLiteral:
+		return "a string"
+	case *ast.Boolean:
+		return "a boolean"
+	case *ast.NullLiteral:
+		return "null"
+	case *ast.ArrayLiteral:
+		return "an array"
+	case *ast.HashLiteral:
+		return "a hash"
+	default:
+		return ""
+	}
+}
+
+func checkUnused(program *ast.Program) []Finding {
+	var findings []Finding
+	for _, b := range resolve(program).bindings {
+		if b.kind == declared && !b.topLevel && !b.used && !ignored(b.ident.Value) {
+			findings = append(findings, finding("unused", b.ident,
+				"%s is declared but never used", b.ident.Value))
+		}
+	}
+	return findings
+}
+
+func checkShadow(program *ast.Program) []Finding {
+	var findings []Finding
+	for _, b := range resolve(program).bindings {
+		if b.shadows != nil && !ignored(b.ident.Value) {
+			outer := ast.StartOf(b.shadows.ident)
+			findings = append(findings, finding("shadow", b.ident,
+				"%s shadows the declaration at %d:%d", b.ident.Value, outer.Line, outer.Column))
+		}
+	}
+	return findings
+}
@@ -0,0 +1,170 @@
+package analysis
+
+import (
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"reflect"
+	"testing"
+)
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
+
+func lint(t *testing.T, input string, checks ...*Check) []string {
+	t.Helper()
+
+	findings := []string{}
+	for _, f := range Lint(parse(t, input), checks...) {
+		findings = append(findings, f.String())
+	}
+	return findings
+}
+
+func testCheck(t *testing.T, name string, tests []struct {
+	input    string
+	expected []string
+}) {
+	t.Helper()
+
+	check := LookupCheck(name)
+	if check == nil {
+		t.Fatalf("no check named %q", name)
+	}
+	for _, tt := range tests {
+		findings := lint(t, tt.input, check)
+		if !reflect.DeepEqual(findings, tt.expected) {
+			t.Errorf("wrong findings for %q.\nwant=%q\ngot= %q", tt.input, tt.expected, findings)
+		}
+	}
+}
+
+func TestUnused(t *testing.T) {
+	testCheck(t, "unused", []struct {
+		input    string
+		expected []string
+	}{
+		// Top-level variables are what a module exports.
+		{"let a = 1;", []string{}},
+		{"fn() { let a = 1; 2 }", []string{"1:12: a is declared but never used (unused)"}},
+		{"fn() { let a = 1; a }", []string{}},
+		{"fn(x) { 1 }", []string{}},
+		{"fn() { let _a = 1; 2 }", []string{}},
+		{"if (true) { let [a, b] = [1, 2]; b }", []string{"1:18: a is declared but never used (unused)"}},
+		// Assigning to a variable isn't using it.
+		{"fn() { let a = 1; a = 2; }", []string{"1:12: a is declared but never used (unused)"}},
+		{"fn() { let a = 1; a = a + 1; }", []string{}},
+		// Nor is calling a function from within itself.
+		{
+			"fn() { let f = fn(n) { f(n - 1) }; 1 }",
+			[]string{"1:12: f is declared but never used (unused)"},
+		},
+		{"fn() { let f = fn(n) { f(n - 1) }; f(1) }", []string{}},
+		// The value is resolved before the name is declared.
+		{
+			"fn(a) { let a = a + 1; 2 }",
+			[]string{"1:13: a is declared but never used (unused)"},
+		},
+		{"fn() { let a = 1; { \"k\": a } }", []string{}},
+		{"fn() { let a = 1; b.a }", []string{"1:12: a is declared but never used (unused)"}},
+		{"fn() { let m = macro(x) { quote(y) }; 1 }", []string{"1:12: m is declared but never used (unused)"}},
+	})
+}
+
+func TestUnreachable(t *testing.T) {
+	testCheck(t, "unreachable", []struct {
+		input    string
+		expected []string
+	}{
+		{"fn() { return 1; }", []string{}},
+		{"fn() {\n  return 1;\n  puts(2);\n  3\n}", []string{"3:3: unreachable code (unreachable)"}},
+		{"fn() { throw \"x\"; 1 }", []string{"1:19: unreachable code (unreachable)"}},
+		{"fn() { if (a) { return 1; } 2 }", []string{}},
+		{"let m = macro() { quote(fn() { return 1; 2 }) };", []string{}},
+	})
+}
+
+func TestShadow(t *testing.T) {
+	testCheck(t, "shadow", []struct {
+		input    string
+		expected []string
+	}{
+		{"let x = 1; fn(x) { x }", []string{"1:15: x shadows the declaration at 1:5 (shadow)"}},
+		{"let x = 1;\nif (x) { let x = 2; x }", []string{"2:14: x shadows the declaration at 1:5 (shadow)"}},
+		{
+			"let f = fn() { try { 1 } catch (f) { f } }",
+			[]string{"1:33: f shadows the declaration at 1:5 (shadow)"},
+		},
+		// Declaring a variable again in the same scope replaces it.
+		{"let x = 1; let x = 2;", []string{}},
+		{"let f = fn(f) { f };", []string{}},
+		// Variables declared later can't be hidden.
+		{"let g = fn(x) { x }; let x = 1;", []string{}},
+		{"let _ = 1; fn(_) { 1 }", []string{}},
+	})
+}
+
+func TestConditions(t *testing.T) {
+	testCheck(t, "condition", []struct {
+		input    string
+		expected []string
+	}{
+		{"if (x) { 1 }", []string{}},
+		{"if (true) { 1 }", []string{"1:5: condition is always true (condition)"}},
+		{"if (1 > 2) { 1 }", []string{"1:5: condition is always false (condition)"}},
+		// Every value but false and null is truthy.
+		{"if (0) { 1 }", []string{"1:5: condition is always true (condition)"}},
+		{"if (!null) { 1 }", []string{"1:5: condition is always true (condition)"}},
+		{"[1, 2] == [1, 2] ? 1 : 2", []string{"1:1: condition is always true (condition)"}},
+		{"while (true) { return 1; }", []string{}},
+		{"while (1 == 2) { 1 }", []string{"1:8: condition is always false, so the loop never runs (condition)"}},
+		// An error isn't a value the condition always has.
+		{"if (1 / 0) { 1 }", []string{}},
+		{"if (fn() { true }) { 1 }", []string{}},
+	})
+}
+
+func TestCalls(t *testing.T) {
+	testCheck(t, "call", []struct {
+		input    string
+		expected []string
+	}{
+		{"f(1)", []string{}},
+		{"5(1)", []string{"1:1: calling an integer, which is not a function (call)"}},
+		{"\"a\"()", []string{"1:1: calling a string, which is not a function (call)"}},
+		{"[1][0](1)", []string{}},
+		{"let x = {\"a\": 1};\nx(1)", []string{"2:1: calling x, which is a hash, not a function (call)"}},
+		// The variable may be a function by the time it is called.
+		{"let x = null; x = fn() { 1 }; x()", []string{}},
+		{"let x = fn() { 1 }; x()", []string{}},
+		{"let x = 1; fn(x) { x() }", []string{}},
+	})
+}
+
+func TestLint(t *testing.T) {
+	input := `let f = fn(x) {
+  let y = 1;
+  if (false) { return 2; }
+  return x;
+  x(1)
+};
+3(f)`
+
+	expected := []string{
+		"2:7: y is declared but never used (unused)",
+		"3:7: condition is always false (condition)",
+		"5:3: unreachable code (unreachable)",
+		"7:1: calling an integer, which is not a function (call)",
+	}
+	if findings := lint(t, input); !reflect.DeepEqual(findings, expected) {
+		t.Errorf("wrong findings.\nwant=%q\ngot= %q", expected, findings)
+	}
+}
@@ -0,0 +1,226 @@
+package analysis
+
+import (
+	"monkey/ast"
+	"strings"
+)
+
+// How a variable came to be declared.
+type bindingKind int
+
+const (
+	declared  bindingKind = iota // by let, const or import
+	parameter                    // as a parameter of a function, or of a catch
+	self                         // as the name a function is bound to, within it
+)
+
+// A variable, which the identifiers that refer to it are resolved to.
+type binding struct {
+	ident    *ast.Identifier // where it is declared
+	kind     bindingKind
+	value    ast.Expression // what it is declared as, if a single value
+	topLevel bool           // declared at the top level of the program
+	used     bool
+	assigned bool // assigned to after it is declared
+
+	shadows *binding              // the variable of an enclosing scope it hides
+	calls   []*ast.CallExpression // the calls of it by name
+}
+
+// A function, block or program, whose declarations are only visible within
+// it.
+type scope struct {
+	outer *scope
+	names map[string]*binding
+}
+
+func (s *scope) lookup(name string) *binding {
+	for ; s != nil; s = s.outer {
+		if b, ok := s.names[name]; ok {
+			return b
+		}
+	}
+	return nil
+}
+
+// The variables of a program, in the order they are declared.
+type resolution struct {
+	bindings []*binding
+}
+
+// Resolves the identifiers of program to the variables they refer to, with
+// the same scopes as the compiler: a function's parameters and body share a
+// scope, and every other block has one of its own. Identifiers that refer to
+// no variable, such as those of builtins, are left alone, as are those
+// within the definitions of macros.
+func resolve(program *ast.Program) *resolution {
+	r := &resolver{res: &resolution{}, scope: &scope{names: map[string]*binding{}}}
+	r.statements(program.Statements)
+	return r.res
+}
+
+// Walks the tree like an ast.Visitor, taking over from ast.Walk at the
+// nodes that declare or assign to variables, or open scopes.
+type resolver struct {
+	res   *resolution
+	scope *scope
+}
+
+func (r *resolver) Visit(node ast.Node) ast.Visitor {
+	switch node := node.(type) {
+	case *ast.Identifier:
+		if b := r.scope.lookup(node.Value); b != nil {
+			b.used = true
+		}
+
+	case *ast.LetStatement:
+		r.let(node.Name, node.Value)
+		return nil
+
+	case *ast.DestructuringLetStatement:
+		if node.Hash {
+			r.expressions(node.Keys)
+		}
+		r.expression(node.Value)
+		for _, name := range node.Names {
+			r.declare(name, declared, nil)
+		}
+		return nil
+
+	case *ast.ImportStatement:
+		r.declare(node.Name, declared, nil)
+		return nil
+
+	case *ast.AssignExpression:
+		r.expression(node.Value)
+		if b := r.scope.lookup(node.Name.Value); b != nil {
+			b.assigned = true
+		}
+		return nil
+
+	case *ast.MemberExpression:
+		// The member is a name within the value, not a variable.
+		r.expression(node.Left)
+		return nil
+
+	case *ast.CallExpression:
+		if ident, ok := node.Function.(*ast.Identifier); ok {
+			if b := r.scope.lookup(ident.Value); b != nil {
+				b.calls = append(b.calls, node)
+			}
+		}
+
+	case *ast.BlockStatement:
+		r.open()
+		r.statements(node.Statements)
+		r.close()
+		return nil
+
+	case *ast.FunctionLiteral:
+		r.function(node, nil)
+		return nil
+
+	case *ast.TryExpression:
+		r.block(node.Body)
+		if node.Catch != nil {
+			// The parameter is only visible within the catch.
+			r.open()
+			r.declare(node.Param, parameter, nil)
+			r.statements(node.Catch.Statements)
+			r.close()
+		}
+		r.block(node.Finally)
+		return nil
+
+	case *ast.MacroLiteral:
+		return nil
+	}
+
+	return r
+}
+
+// Declares name as a variable of the innermost scope. It hides any variable
+// of an enclosing scope with the same name, but replaces one of the same
+// scope.
+func (r *resolver) declare(name *ast.Identifier, kind bindingKind, value ast.Expression) {
+	if name == nil {
+		return
+	}
+
+	b := &binding{ident: name, kind: kind, value: value, topLevel: r.scope.outer == nil}
+	if _, ok := r.scope.names[name.Value]; !ok && r.scope.outer != nil {
+		b.shadows = r.scope.outer.lookup(name.Value)
+	}
+	r.scope.names[name.Value] = b
+	if kind != self {
+		r.res.bindings = append(r.res.bindings, b)
+	}
+}
+
+// Declares name as value, which is resolved first, as it can't refer to
+// name, unless it is a function, which can call itself by it.
+func (r *resolver) let(name *ast.Identifier, value ast.Expression) {
+	if fn, ok := value.(*ast.FunctionLiteral); ok && fn.Name == name.Value {
+		r.function(fn, name)
+	} else {
+		r.expression(value)
+	}
+	r.declare(name, declared, value)
+}
+
+// Resolves a function literal, bound to name if it is the value of a let
+// statement. Calls of the function within itself aren't uses of name.
+func (r *resolver) function(fn *ast.FunctionLiteral, name *ast.Identifier) {
+	r.open()
+	r.declare(name, self, fn)
+	for _, param := range fn.Parameters {
+		r.declare(param, parameter, nil)
+	}
+	r.declare(fn.Rest, parameter, nil)
+	r.expressions(fn.Defaults)
+	if fn.Body != nil {
+		r.statements(fn.Body.Statements)
+	}
+	r.close()
+}
+
+func (r *resolver) open() {
+	r.scope = &scope{outer: r.scope, names: map[string]*binding{}}
+}
+
+func (r *resolver) close() {
+	r.scope = r.scope.outer
+}
+
+func (r *resolver) expression(expr ast.Expression) {
+	if expr != nil {
+		ast.Walk(expr, r)
+	}
+}
+
+func (r *resolver) expressions(exprs []ast.Expression) {
+	for _, expr := range exprs {
+		r.expression(expr)
+	}
+}
+
+func (r *resolver) statements(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		if stmt != nil {
+			ast.Walk(stmt, r)
+		}
+	}
+}
+
+func (r *resolver) block(block *ast.BlockStatement) {
+	if block != nil {
+		ast.Walk(block, r)
+	}
+}
+
+// Reports whether findings about the variable name are left out, as they
+// are for names starting with an underscore, which say that the variable is
+// meant to go unused.
+func ignored(name string) bool {
+	return strings.HasPrefix(name, "_")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/ast"
+	"os"
+)
+
+// The extension of the files `monkey ast` writes programs to as JSON, which
+// the other commands can read in place of scripts.
+const astExt = ".json"
+
+const astUsage = "usage: monkey ast [-expand=false] script.monkey"
+
+// Implements `monkey ast`, which prints the syntax tree of a script as JSON,
+// for other tools to read.
+func astCommand(args []string) int {
+	flags := flag.NewFlagSet("ast", flag.ContinueOnError)
+	expand := flags.Bool("expand", true, "expand the script's macros")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), astUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	path := flags.Arg(0)
+	read := readProgram
+	if *expand {
+		read = parseScript
+	}
+	program, ok := read(path)
+	if !ok {
+		return 1
+	}
+
+	data, err := ast.MarshalIndentJSON(program, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+
+	fmt.Println(string(data))
+	return 0
+}
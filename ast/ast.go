@@ -2,6 +2,7 @@ package ast
 
 import (
 	"bytes"
+	"fmt"
 	"monkey/token"
 	"strings"
 )
@@ -23,6 +24,8 @@ type Expression interface {
 
 type Program struct {
 	Statements []Statement
+	BlankLines []int      // lines of the source with nothing on them, which Format keeps
+	Comments   []*Comment // in the order they appear in the source
 }
 
 func (p *Program) TokenLiteral() string {
@@ -42,6 +45,19 @@ func (p *Program) String() string {
 	return out.String()
 }
 
+// A comment, from `//` to the end of the line. Comments aren't part of the
+// tree of a program, but are kept alongside it, by their positions, for
+// tools such as the formatter.
+type Comment struct {
+	Token token.Token // the COMMENT token, whose literal is the whole comment
+}
+
+// Returns the text of the comment without the `//`, or the space after it.
+func (c *Comment) Text() string {
+	text := strings.TrimPrefix(c.Token.Literal, "//")
+	return strings.TrimPrefix(text, " ")
+}
+
 type Identifier struct {
 	Token token.Token // the 'ident' token
 	Value string
@@ -51,19 +67,39 @@ func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
 func (i *Identifier) String() string       { return i.Value }
 
+// The type a variable, parameter or function result is declared to have, as
+// in `let x: int = 5;`. Annotations don't change how a program runs; they
+// are only checked, by package types.
+type TypeAnnotation struct {
+	Token token.Token // the 'ident' token of the type's name
+	Name  string
+}
+
+func (ta *TypeAnnotation) TokenLiteral() string { return ta.Token.Literal }
+func (ta *TypeAnnotation) String() string       { return ta.Name }
+
 type LetStatement struct {
-	Token token.Token // the 'let' token
-	Name  *Identifier
-	Value Expression
+	Token      token.Token // the 'let' or 'const' token
+	Name       *Identifier
+	Annotation *TypeAnnotation // nil unless the type is declared
+	Value      Expression
 }
 
 func (ls *LetStatement) statementNode()       {}
 func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
+
+// Reports whether the statement declares a constant, which can't be
+// assigned to.
+func (ls *LetStatement) IsConst() bool { return ls.Token.Type == token.CONST }
+
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
 	out.WriteString(ls.TokenLiteral() + " ")
 	out.WriteString(ls.Name.String())
+	if ls.Annotation != nil {
+		out.WriteString(": " + ls.Annotation.String())
+	}
 	out.WriteString(" = ")
 	if ls.Value != nil {
 		out.WriteString(ls.Value.String())
@@ -73,6 +109,82 @@ func (ls *LetStatement) String() string {
 	return out.String()
 }
 
+// Binds the elements of an array, as in `let [a, b] = value;`, or the values
+// a hash maps keys to, as in `let {"x": x, "y": y} = value;`.
+type DestructuringLetStatement struct {
+	Token token.Token // the 'let' or 'const' token
+	Hash  bool
+	Keys  []Expression // the key of each name, for a hash pattern
+	Names []*Identifier
+	Value Expression
+}
+
+func (ds *DestructuringLetStatement) statementNode()       {}
+func (ds *DestructuringLetStatement) TokenLiteral() string { return ds.Token.Literal }
+func (ds *DestructuringLetStatement) IsConst() bool        { return ds.Token.Type == token.CONST }
+func (ds *DestructuringLetStatement) String() string {
+	var out bytes.Buffer
+
+	names := []string{}
+	for i, name := range ds.Names {
+		if ds.Hash {
+			names = append(names, ds.Keys[i].String()+":"+name.String())
+		} else {
+			names = append(names, name.String())
+		}
+	}
+
+	out.WriteString(ds.TokenLiteral() + " ")
+	if ds.Hash {
+		out.WriteString("{" + strings.Join(names, ", ") + "}")
+	} else {
+		out.WriteString("[" + strings.Join(names, ", ") + "]")
+	}
+	out.WriteString(" = ")
+	if ds.Value != nil {
+		out.WriteString(ds.Value.String())
+	}
+	out.WriteString(";")
+
+	return out.String()
+}
+
+// Binds the top-level bindings of another file, or of a module of the
+// standard library, as in `import "./util.monkey";` or
+// `import "std/strings" as s;`. Name is the name given after `as`, or else
+// the last element of the path without its extension.
+type ImportStatement struct {
+	Token token.Token // the 'import' token
+	Path  string
+	Name  *Identifier
+}
+
+func (is *ImportStatement) statementNode()       {}
+func (is *ImportStatement) TokenLiteral() string { return is.Token.Literal }
+func (is *ImportStatement) String() string {
+	return fmt.Sprintf("import %q as %s;", is.Path, is.Name.String())
+}
+
+type AssignExpression struct {
+	Token token.Token // the '=' token
+	Name  *Identifier
+	Value Expression
+}
+
+func (ae *AssignExpression) expressionNode()      {}
+func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(ae.Name.String())
+	out.WriteString(" = ")
+	out.WriteString(ae.Value.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
 type ReturnStatement struct {
 	Token       token.Token // the 'return' token
 	ReturnValue Expression
@@ -92,6 +204,27 @@ func (rs *ReturnStatement) String() string {
 	return out.String()
 }
 
+// The statement `throw Value;`, which unwinds to the nearest enclosing
+// try expression.
+type ThrowStatement struct {
+	Token token.Token // the 'throw' token
+	Value Expression
+}
+
+func (ts *ThrowStatement) statementNode()       {}
+func (ts *ThrowStatement) TokenLiteral() string { return ts.Token.Literal }
+func (ts *ThrowStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ts.TokenLiteral() + " ")
+	if ts.Value != nil {
+		out.WriteString(ts.Value.String())
+	}
+	out.WriteString(";")
+
+	return out.String()
+}
+
 type ExpressionStatement struct {
 	Token      token.Token // the first token of the expression
 	Expression Expression
@@ -109,6 +242,7 @@ func (es *ExpressionStatement) String() string {
 type BlockStatement struct {
 	Token      token.Token // the { token
 	Statements []Statement
+	Close      token.Token // the } token
 }
 
 func (bs *BlockStatement) statementNode()       {}
@@ -127,7 +261,7 @@ type IfExpression struct {
 	Token       token.Token // The 'if' token
 	Condition   Expression
 	Consequence *BlockStatement
-	Alternative *BlockStatement
+	Alternative *BlockStatement // For `else if`, a block whose token is the second 'if'
 }
 
 func (ie *IfExpression) expressionNode()      {}
@@ -147,6 +281,85 @@ func (ie *IfExpression) String() string {
 	return out.String()
 }
 
+// The conditional expression `Condition ? Consequence : Alternative`, which
+// is like an if expression with an alternative, but takes expressions
+// rather than blocks.
+type ConditionalExpression struct {
+	Token       token.Token // The '?' token
+	Condition   Expression
+	Consequence Expression
+	Alternative Expression
+}
+
+func (ce *ConditionalExpression) expressionNode()      {}
+func (ce *ConditionalExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *ConditionalExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(ce.Condition.String())
+	out.WriteString(" ? ")
+	out.WriteString(ce.Consequence.String())
+	out.WriteString(" : ")
+	out.WriteString(ce.Alternative.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
+type WhileExpression struct {
+	Token     token.Token // The 'while' token
+	Condition Expression
+	Body      *BlockStatement
+}
+
+func (we *WhileExpression) expressionNode()      {}
+func (we *WhileExpression) TokenLiteral() string { return we.Token.Literal }
+func (we *WhileExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("while")
+	out.WriteString(we.Condition.String())
+	out.WriteString(" ")
+	out.WriteString(we.Body.String())
+
+	return out.String()
+}
+
+// The expression `try Body catch (Param) Catch finally Finally`, which has
+// the value of Body, or of Catch if Body throws. It has a catch, a finally or
+// both; the parameter of the catch is optional.
+type TryExpression struct {
+	Token   token.Token // The 'try' token
+	Body    *BlockStatement
+	Param   *Identifier // nil if the catch has no parameter
+	Catch   *BlockStatement
+	Finally *BlockStatement
+}
+
+func (te *TryExpression) expressionNode()      {}
+func (te *TryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TryExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("try ")
+	out.WriteString(te.Body.String())
+	if te.Catch != nil {
+		out.WriteString("catch")
+		if te.Param != nil {
+			out.WriteString("(" + te.Param.String() + ")")
+		}
+		out.WriteString(" ")
+		out.WriteString(te.Catch.String())
+	}
+	if te.Finally != nil {
+		out.WriteString("finally ")
+		out.WriteString(te.Finally.String())
+	}
+
+	return out.String()
+}
+
 type InfixExpression struct {
 	Token    token.Token // The operator token; e.g. +
 	Left     Expression
@@ -196,6 +409,15 @@ func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode()      {}
+func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
+
 type StringLiteral struct {
 	Token token.Token
 	Value string
@@ -214,6 +436,14 @@ func (bl *Boolean) expressionNode()      {}
 func (bl *Boolean) TokenLiteral() string { return bl.Token.Literal }
 func (bl *Boolean) String() string       { return bl.Token.Literal }
 
+type NullLiteral struct {
+	Token token.Token
+}
+
+func (nl *NullLiteral) expressionNode()      {}
+func (nl *NullLiteral) TokenLiteral() string { return nl.Token.Literal }
+func (nl *NullLiteral) String() string       { return nl.Token.Literal }
+
 type ArrayLiteral struct {
 	Token    token.Token // the '[' token
 	Elements []Expression
@@ -256,10 +486,66 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// Looks up a member of a hash or module, as in `strings.upper`, which is
+// short for `strings["upper"]`.
+type MemberExpression struct {
+	Token  token.Token // The '.' token
+	Left   Expression
+	Member *Identifier
+}
+
+func (me *MemberExpression) expressionNode()      {}
+func (me *MemberExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *MemberExpression) String() string {
+	return "(" + me.Left.String() + "." + me.Member.String() + ")"
+}
+
+type SliceExpression struct {
+	Token token.Token // The '[' token
+	Left  Expression
+	Start Expression // nil when omitted, i.e. the start of Left
+	End   Expression // nil when omitted, i.e. the end of Left
+}
+
+func (se *SliceExpression) expressionNode()      {}
+func (se *SliceExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SliceExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(se.Left.String())
+	out.WriteString("[")
+	if se.Start != nil {
+		out.WriteString(se.Start.String())
+	}
+	out.WriteString(":")
+	if se.End != nil {
+		out.WriteString(se.End.String())
+	}
+	out.WriteString("])")
+
+	return out.String()
+}
+
 type FunctionLiteral struct {
 	Token      token.Token // the 'fn' token
 	Parameters []*Identifier
-	Body       *BlockStatement
+	Defaults   []Expression // default values of the last len(Defaults) parameters
+	Rest       *Identifier  // collects the arguments after the parameters, if set
+	// The declared type of each parameter, nil for those without one, or
+	// nil if none have one.
+	ParameterTypes []*TypeAnnotation
+	ReturnType     *TypeAnnotation // nil unless declared
+	Body           *BlockStatement
+	Name           string // name of the binding the function is assigned to, if any
+}
+
+// Returns the declared type of the i'th parameter, or nil if it has none.
+func (fl *FunctionLiteral) ParameterType(i int) *TypeAnnotation {
+	if i < len(fl.ParameterTypes) {
+		return fl.ParameterTypes[i]
+	}
+	return nil
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
@@ -268,19 +554,61 @@ func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 
 	params := []string{}
-	for _, p := range fl.Parameters {
-		params = append(params, p.String())
+	firstDefault := len(fl.Parameters) - len(fl.Defaults)
+	for i, p := range fl.Parameters {
+		param := p.String()
+		if t := fl.ParameterType(i); t != nil {
+			param += ": " + t.String()
+		}
+		if i >= firstDefault {
+			param += " = " + fl.Defaults[i-firstDefault].String()
+		}
+		params = append(params, param)
+	}
+	if fl.Rest != nil {
+		params = append(params, "..."+fl.Rest.String())
 	}
 
 	out.WriteString(fl.TokenLiteral())
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(") ")
+	if fl.ReturnType != nil {
+		out.WriteString("-> " + fl.ReturnType.String() + " ")
+	}
 	out.WriteString(fl.Body.String())
 
 	return out.String()
 }
 
+// A macro, as in `macro(a, b) { quote(unquote(b) - unquote(a)) }`. Macros
+// are bound with let statements at the top level of a program, and their
+// calls are expanded before it runs.
+type MacroLiteral struct {
+	Token      token.Token // the 'macro' token
+	Parameters []*Identifier
+	Body       *BlockStatement
+}
+
+func (ml *MacroLiteral) expressionNode()      {}
+func (ml *MacroLiteral) TokenLiteral() string { return ml.Token.Literal }
+func (ml *MacroLiteral) String() string {
+	var out bytes.Buffer
+
+	params := []string{}
+	for _, p := range ml.Parameters {
+		params = append(params, p.String())
+	}
+
+	out.WriteString(ml.TokenLiteral())
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") ")
+	out.WriteString(ml.Body.String())
+
+	return out.String()
+}
+
 type CallExpression struct {
 	Token     token.Token // The '(' token
 	Function  Expression  // `Identifier` or `FunctionLiteral`
@@ -326,3 +654,93 @@ func (hl *HashLiteral) String() string {
 
 	return out.String()
 }
+
+// Returns the first token of node, which gives its position in the source.
+// It differs from the node's own token where that isn't first, as the
+// operator of an infix expression isn't.
+func StartOf(node Node) token.Token {
+	switch node := node.(type) {
+	case *InfixExpression:
+		return StartOf(node.Left)
+	case *ConditionalExpression:
+		return StartOf(node.Condition)
+	case *AssignExpression:
+		return StartOf(node.Name)
+	case *CallExpression:
+		return StartOf(node.Function)
+	case *IndexExpression:
+		return StartOf(node.Left)
+	case *SliceExpression:
+		return StartOf(node.Left)
+	case *MemberExpression:
+		return StartOf(node.Left)
+	default:
+		return tokenOf(node)
+	}
+}
+
+// Returns the token node was parsed from, or the zero token for a program.
+func tokenOf(node Node) token.Token {
+	switch node := node.(type) {
+	case *Identifier:
+		return node.Token
+	case *TypeAnnotation:
+		return node.Token
+	case *LetStatement:
+		return node.Token
+	case *DestructuringLetStatement:
+		return node.Token
+	case *ImportStatement:
+		return node.Token
+	case *ReturnStatement:
+		return node.Token
+	case *ThrowStatement:
+		return node.Token
+	case *ExpressionStatement:
+		return node.Token
+	case *BlockStatement:
+		return node.Token
+	case *AssignExpression:
+		return node.Token
+	case *IfExpression:
+		return node.Token
+	case *ConditionalExpression:
+		return node.Token
+	case *WhileExpression:
+		return node.Token
+	case *TryExpression:
+		return node.Token
+	case *InfixExpression:
+		return node.Token
+	case *PrefixExpression:
+		return node.Token
+	case *IntegerLiteral:
+		return node.Token
+	case *FloatLiteral:
+		return node.Token
+	case *StringLiteral:
+		return node.Token
+	case *Boolean:
+		return node.Token
+	case *NullLiteral:
+		return node.Token
+	case *ArrayLiteral:
+		return node.Token
+	case *IndexExpression:
+		return node.Token
+	case *MemberExpression:
+		return node.Token
+	case *SliceExpression:
+		return node.Token
+	case *FunctionLiteral:
+		return node.Token
+	case *MacroLiteral:
+		return node.Token
+	case *CallExpression:
+		return node.Token
+	case *HashLiteral:
+		return node.Token
+	default:
+		return token.Token{}
+	}
+}
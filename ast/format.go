@@ -0,0 +1,672 @@
+package ast
+
+import (
+	"math"
+	"monkey/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What each level of blocks, and of lists split over several lines, is
+// indented with.
+const formatIndent = "  "
+
+// How tightly the operators of expressions bind, as the parser parses them.
+// Calls, indexes, slices and members all bind tightest of the operators,
+// and chain from left to right.
+const (
+	_ int = iota
+	precLowest
+	precAssign
+	precConditional
+	precOr
+	precAnd
+	precEquals
+	precCompare
+	precBitOr
+	precBitXor
+	precBitAnd
+	precShift
+	precSum
+	precProduct
+	precPrefix
+	precPower
+	precPostfix
+	precPrimary
+)
+
+var infixPrecedences = map[string]int{
+	"||": precOr,
+	"&&": precAnd,
+	"==": precEquals,
+	"!=": precEquals,
+	"<":  precCompare,
+	">":  precCompare,
+	"<=": precCompare,
+	">=": precCompare,
+	"|":  precBitOr,
+	"^":  precBitXor,
+	"&":  precBitAnd,
+	"<<": precShift,
+	">>": precShift,
+	"+":  precSum,
+	"-":  precSum,
+	"*":  precProduct,
+	"/":  precProduct,
+	"%":  precProduct,
+	"**": precPower,
+}
+
+// Returns the program as source code in the canonical format, unlike
+// String, whose output is only meant for reading. Each statement is on a
+// line of its own, blocks are indented by two spaces, and operators are
+// surrounded by spaces, with only the parentheses needed to keep the
+// meaning of the program. Statements end in semicolons where needsSemicolon
+// says they need them.
+//
+// Some of the layout of the source is kept: single blank lines between
+// statements, raw strings, blocks written on one line, and arrays, hashes
+// and arguments whose first element is on a line of its own, which are
+// written one element per line.
+//
+// Comments are kept too, by their positions. Those on the line a statement,
+// or an element of a list written one per line, ends on follow it there,
+// and the others are written on lines of their own, before whatever came
+// after them in the source.
+func (p *Program) Format() string {
+	f := &formatter{blankLines: map[int]bool{}, comments: p.Comments}
+	for _, line := range p.BlankLines {
+		f.blankLines[line] = true
+	}
+
+	f.statements(p.Statements, false, math.MaxInt)
+	if f.out.Len() == 0 {
+		return ""
+	}
+	return f.out.String() + "\n"
+}
+
+type formatter struct {
+	out        strings.Builder
+	indent     int
+	blankLines map[int]bool
+	comments   []*Comment // those yet to be written, in the order of the source
+	reached    int        // the last line of the source written so far
+}
+
+func (f *formatter) write(s string) {
+	f.out.WriteString(s)
+}
+
+func (f *formatter) newline() {
+	f.out.WriteString("\n" + strings.Repeat(formatIndent, f.indent))
+}
+
+// Marks the source up to the line of tok as written.
+func (f *formatter) reach(tok token.Token) {
+	if tok.Line > f.reached {
+		f.reached = tok.Line
+	}
+}
+
+// Formats the statements of a program or block, one per line, with the
+// comments before end, the line the block closes on, or all on the same
+// line if inline is set.
+func (f *formatter) statements(stmts []Statement, inline bool, end int) {
+	prev := -1 // the line the last statement or comment written starts on
+	separate := func(line int) {
+		if prev >= 0 {
+			if f.blankLines[line-1] && prev < line-1 {
+				f.write("\n")
+			}
+			f.newline()
+		}
+		prev = line
+	}
+
+	for i, stmt := range stmts {
+		start := tokenOf(stmt).Line
+		for _, comment := range f.commentsBefore(start) {
+			separate(comment.Token.Line)
+			f.write(comment.Token.Literal)
+		}
+		if inline && i > 0 {
+			f.write(" ")
+		} else if !inline {
+			separate(start)
+		}
+
+		var next Statement
+		nextStart := end
+		if i < len(stmts)-1 {
+			next = stmts[i+1]
+			nextStart = tokenOf(next).Line
+		}
+		f.statement(stmt, f.needsSemicolon(stmt, next))
+		f.trailingComments(nextStart)
+	}
+
+	for _, comment := range f.commentsBefore(end) {
+		separate(comment.Token.Line)
+		f.write(comment.Token.Literal)
+	}
+}
+
+// Reports whether a comment yet to be written is from before line.
+func (f *formatter) commentBefore(line int) bool {
+	return len(f.comments) > 0 && f.comments[0].Token.Line < line
+}
+
+// Takes the comments yet to be written from before line.
+func (f *formatter) commentsBefore(line int) []*Comment {
+	n := 0
+	for n < len(f.comments) && f.comments[n].Token.Line < line {
+		n++
+	}
+	comments := f.comments[:n]
+	f.comments = f.comments[n:]
+	return comments
+}
+
+// Writes the comments from the lines already written, before line, where
+// what comes next starts. One on the last line written follows it there,
+// and the others, from the middle of what was written, are put on lines of
+// their own after it.
+func (f *formatter) trailingComments(line int) {
+	if f.reached+1 < line {
+		line = f.reached + 1
+	}
+	for i, comment := range f.commentsBefore(line) {
+		if i == 0 && comment.Token.Line == f.reached {
+			f.write(" ")
+		} else {
+			f.newline()
+		}
+		f.write(comment.Token.Literal)
+	}
+}
+
+// Reports whether stmt needs a semicolon after it, when next follows it.
+// An expression statement ending a block needs none, since it gives the
+// block its value. Nor does one ending in a closing brace, as an if
+// expression does, unless next begins with something that could continue
+// the expression, such as a parenthesis.
+func (f *formatter) needsSemicolon(stmt, next Statement) bool {
+	exprStmt, ok := stmt.(*ExpressionStatement)
+	if !ok {
+		return true
+	}
+	if next == nil {
+		return false
+	}
+
+	switch exprStmt.Expression.(type) {
+	case *IfExpression, *WhileExpression, *TryExpression:
+		line := &formatter{blankLines: f.blankLines}
+		line.statement(next, false)
+		s := line.out.String()
+		return s != "" && strings.ContainsRune("([.+-*/%<>=&|^?", rune(s[0]))
+	default:
+		return true
+	}
+}
+
+func (f *formatter) statement(stmt Statement, semicolon bool) {
+	f.reach(tokenOf(stmt))
+	switch stmt := stmt.(type) {
+	case *LetStatement:
+		f.write(declaration(stmt.IsConst()))
+		f.expression(stmt.Name)
+		if stmt.Annotation != nil {
+			f.write(": " + stmt.Annotation.Name)
+		}
+		f.write(" = ")
+		f.expression(stmt.Value)
+
+	case *DestructuringLetStatement:
+		f.write(declaration(stmt.IsConst()))
+		if stmt.Hash {
+			f.write("{")
+			for i, name := range stmt.Names {
+				if i > 0 {
+					f.write(", ")
+				}
+				if i < len(stmt.Keys) {
+					f.expression(stmt.Keys[i])
+					f.write(": ")
+				}
+				f.expression(name)
+			}
+			f.write("}")
+		} else {
+			f.write("[")
+			for i, name := range stmt.Names {
+				if i > 0 {
+					f.write(", ")
+				}
+				f.expression(name)
+			}
+			f.write("]")
+		}
+		f.write(" = ")
+		f.expression(stmt.Value)
+
+	case *ImportStatement:
+		f.write("import " + quote(stmt.Path))
+		// The name is left out where it would be given to the module anyway.
+		if stmt.Name != nil && stmt.Name.Value != strings.TrimSuffix(path.Base(stmt.Path), ".monkey") {
+			f.write(" as " + stmt.Name.Value)
+		}
+
+	case *ReturnStatement:
+		f.write("return ")
+		f.expression(stmt.ReturnValue)
+
+	case *ThrowStatement:
+		f.write("throw ")
+		f.expression(stmt.Value)
+
+	case *ExpressionStatement:
+		f.expression(stmt.Expression)
+
+	case *BlockStatement:
+		f.block(stmt)
+		return
+	}
+
+	if semicolon {
+		f.write(";")
+	}
+}
+
+func declaration(isConst bool) string {
+	if isConst {
+		return "const "
+	}
+	return "let "
+}
+
+// Formats a block on one line if it was written on one line and fits on
+// one, or else with its statements indented on the lines between its
+// braces.
+func (f *formatter) block(block *BlockStatement) {
+	if block == nil {
+		f.write("{}")
+		return
+	}
+	f.reach(block.Token)
+	defer f.reach(block.Close)
+
+	if len(block.Statements) == 0 && !f.commentBefore(block.Close.Line) {
+		f.write("{}")
+		return
+	}
+	// A block written on one line can't hold comments, which run to the end
+	// of their line.
+	if onOneLine(block) {
+		line := &formatter{blankLines: f.blankLines}
+		line.statements(block.Statements, true, 0)
+		if s := line.out.String(); !strings.Contains(s, "\n") {
+			f.write("{ " + s + " }")
+			return
+		}
+	}
+
+	f.write("{")
+	// A comment after the opening brace stays there.
+	first := block.Token.Line + 1
+	if len(block.Statements) > 0 && tokenOf(block.Statements[0]).Line < first {
+		first = tokenOf(block.Statements[0]).Line
+	}
+	f.trailingComments(first)
+	if len(block.Statements) > 0 || f.commentBefore(block.Close.Line) {
+		f.indent++
+		f.newline()
+		f.statements(block.Statements, false, block.Close.Line)
+		f.indent--
+	}
+	f.newline()
+	f.write("}")
+}
+
+// Reports whether block, its statements and closing brace, is on the line
+// of its opening brace. Where the closing brace isn't known, as in trees
+// made by hand, only the starts of the statements are checked.
+func onOneLine(block *BlockStatement) bool {
+	if block.Close.Line > 0 && block.Close.Line != block.Token.Line {
+		return false
+	}
+	for _, stmt := range block.Statements {
+		if tokenOf(stmt).Line != block.Token.Line {
+			return false
+		}
+	}
+	return true
+}
+
+// Formats expr, in parentheses if it has to be to be parsed back as it is.
+func (f *formatter) operand(expr Expression, parenthesize bool) {
+	if parenthesize {
+		f.write("(")
+		f.expression(expr)
+		f.write(")")
+	} else {
+		f.expression(expr)
+	}
+}
+
+func (f *formatter) expression(expr Expression) {
+	f.reach(tokenOf(expr))
+	switch expr := expr.(type) {
+	case *Identifier:
+		f.write(expr.Value)
+
+	case *IntegerLiteral:
+		literal := expr.Token.Literal
+		if expr.Token.Type != token.INT || literal == "" {
+			literal = strconv.FormatInt(expr.Value, 10)
+		}
+		f.write(literal)
+
+	case *FloatLiteral:
+		literal := expr.Token.Literal
+		if expr.Token.Type != token.FLOAT || !strings.Contains(literal, ".") {
+			literal = strconv.FormatFloat(expr.Value, 'f', -1, 64)
+			if !strings.Contains(literal, ".") {
+				literal += ".0"
+			}
+		}
+		f.write(literal)
+
+	case *StringLiteral:
+		if expr.Token.Type == token.RAW_STRING && !strings.ContainsAny(expr.Value, "`\r") {
+			f.write("`" + expr.Value + "`")
+		} else {
+			f.write(quote(expr.Value))
+		}
+
+	case *Boolean:
+		f.write(strconv.FormatBool(expr.Value))
+
+	case *NullLiteral:
+		f.write("null")
+
+	case *AssignExpression:
+		f.expression(expr.Name)
+		f.write(" = ")
+		f.expression(expr.Value)
+
+	case *ConditionalExpression:
+		f.operand(expr.Condition, precedence(expr.Condition) <= precConditional)
+		f.write(" ? ")
+		f.expression(expr.Consequence)
+		f.write(" : ")
+		f.operand(expr.Alternative, precedence(expr.Alternative) < precConditional)
+
+	case *InfixExpression:
+		prec := precedence(expr)
+		left, right := precedence(expr.Left) < prec, precedence(expr.Right) <= prec
+		if expr.Operator == "**" {
+			// Right-associative.
+			left, right = precedence(expr.Left) <= prec, precedence(expr.Right) < prec
+		}
+		if precedence(expr.Right) == precPrefix {
+			// Nothing can come between a prefix operator and its operand.
+			right = false
+		}
+		f.operand(expr.Left, left)
+		f.write(" " + expr.Operator + " ")
+		f.operand(expr.Right, right)
+
+	case *PrefixExpression:
+		f.write(expr.Operator)
+		f.operand(expr.Right, precedence(expr.Right) < precPrefix)
+
+	case *ArrayLiteral:
+		f.list("[", "]", expr.Token, len(expr.Elements), func(i int) Expression {
+			return expr.Elements[i]
+		}, f.expression)
+
+	case *HashLiteral:
+		keys := sortedByPosition(expr)
+		f.list("{", "}", expr.Token, len(keys), func(i int) Expression {
+			return keys[i]
+		}, func(key Expression) {
+			f.expression(key)
+			f.write(": ")
+			f.expression(expr.Pairs[key])
+		})
+
+	case *IndexExpression:
+		f.operand(expr.Left, precedence(expr.Left) < precPostfix)
+		f.write("[")
+		f.expression(expr.Index)
+		f.write("]")
+
+	case *SliceExpression:
+		f.operand(expr.Left, precedence(expr.Left) < precPostfix)
+		f.write("[")
+		if expr.Start != nil {
+			f.expression(expr.Start)
+		}
+		f.write(":")
+		if expr.End != nil {
+			f.expression(expr.End)
+		}
+		f.write("]")
+
+	case *MemberExpression:
+		f.operand(expr.Left, precedence(expr.Left) < precPostfix)
+		f.write(".")
+		f.expression(expr.Member)
+
+	case *CallExpression:
+		f.operand(expr.Function, precedence(expr.Function) < precPostfix)
+		f.list("(", ")", expr.Token, len(expr.Arguments), func(i int) Expression {
+			return expr.Arguments[i]
+		}, f.expression)
+
+	case *FunctionLiteral:
+		f.write("fn(")
+		firstDefault := len(expr.Parameters) - len(expr.Defaults)
+		for i, param := range expr.Parameters {
+			if i > 0 {
+				f.write(", ")
+			}
+			f.expression(param)
+			if typ := expr.ParameterType(i); typ != nil {
+				f.write(": " + typ.Name)
+			}
+			if i >= firstDefault {
+				f.write(" = ")
+				f.expression(expr.Defaults[i-firstDefault])
+			}
+		}
+		if expr.Rest != nil {
+			if len(expr.Parameters) > 0 {
+				f.write(", ")
+			}
+			f.write("..." + expr.Rest.Value)
+		}
+		f.write(") ")
+		if expr.ReturnType != nil {
+			f.write("-> " + expr.ReturnType.Name + " ")
+		}
+		f.block(expr.Body)
+
+	case *MacroLiteral:
+		f.write("macro(")
+		for i, param := range expr.Parameters {
+			if i > 0 {
+				f.write(", ")
+			}
+			f.expression(param)
+		}
+		f.write(") ")
+		f.block(expr.Body)
+
+	case *IfExpression:
+		f.write("if (")
+		f.expression(expr.Condition)
+		f.write(") ")
+		f.block(expr.Consequence)
+		if expr.Alternative != nil {
+			f.write(" else ")
+			if elseIf := onlyIf(expr.Alternative); elseIf != nil {
+				f.expression(elseIf)
+			} else {
+				f.block(expr.Alternative)
+			}
+		}
+
+	case *WhileExpression:
+		f.write("while (")
+		f.expression(expr.Condition)
+		f.write(") ")
+		f.block(expr.Body)
+
+	case *TryExpression:
+		f.write("try ")
+		f.block(expr.Body)
+		if expr.Catch != nil {
+			f.write(" catch ")
+			if expr.Param != nil {
+				f.write("(" + expr.Param.Value + ") ")
+			}
+			f.block(expr.Catch)
+		}
+		if expr.Finally != nil {
+			f.write(" finally ")
+			f.block(expr.Finally)
+		}
+	}
+}
+
+// Formats the n elements of a list between open and close, separated by
+// commas. If the first element is on a later line than the token opening
+// the list, each element is put on a line of its own, with the comments
+// around it.
+func (f *formatter) list(
+	open, close string,
+	tok token.Token,
+	n int,
+	element func(i int) Expression,
+	format func(Expression),
+) {
+	f.write(open)
+	if n == 0 {
+		f.write(close)
+		return
+	}
+
+	if StartOf(element(0)).Line <= tok.Line {
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				f.write(", ")
+			}
+			format(element(i))
+		}
+		f.write(close)
+		return
+	}
+
+	f.indent++
+	for i := 0; i < n; i++ {
+		start := StartOf(element(i)).Line
+		for _, comment := range f.commentsBefore(start) {
+			f.newline()
+			f.write(comment.Token.Literal)
+		}
+		f.newline()
+		format(element(i))
+
+		next := math.MaxInt
+		if i < n-1 {
+			f.write(",")
+			next = StartOf(element(i + 1)).Line
+		}
+		f.trailingComments(next)
+	}
+	f.indent--
+	f.newline()
+	f.write(close)
+}
+
+// Returns the if expression an else block holds on its own, which can be
+// written as `else if`.
+func onlyIf(block *BlockStatement) *IfExpression {
+	if len(block.Statements) != 1 {
+		return nil
+	}
+	stmt, ok := block.Statements[0].(*ExpressionStatement)
+	if !ok {
+		return nil
+	}
+	ifExpr, _ := stmt.Expression.(*IfExpression)
+	return ifExpr
+}
+
+// Returns the keys of a hash literal in the order they appear in the source,
+// or sorted like SortedKeys for those without a position.
+func sortedByPosition(hl *HashLiteral) []Expression {
+	keys := SortedKeys(hl)
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := StartOf(keys[i]), StartOf(keys[j])
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return keys
+}
+
+func precedence(expr Expression) int {
+	switch expr := expr.(type) {
+	case *AssignExpression:
+		return precAssign
+	case *ConditionalExpression:
+		return precConditional
+	case *InfixExpression:
+		if prec, ok := infixPrecedences[expr.Operator]; ok {
+			return prec
+		}
+		return precLowest
+	case *PrefixExpression:
+		return precPrefix
+	case *IntegerLiteral:
+		// As made by macros, which may return negative numbers.
+		if expr.Value < 0 {
+			return precPrefix
+		}
+	case *FloatLiteral:
+		if expr.Value < 0 {
+			return precPrefix
+		}
+	case *CallExpression, *IndexExpression, *SliceExpression, *MemberExpression:
+		return precPostfix
+	}
+	return precPrimary
+}
+
+// Quotes s as a string literal, escaping the characters that have to be.
+func quote(s string) string {
+	var out strings.Builder
+	out.WriteByte('"')
+	for _, ch := range s {
+		switch ch {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\t':
+			out.WriteString(`\t`)
+		case '\r':
+			out.WriteString(`\r`)
+		default:
+			out.WriteRune(ch)
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
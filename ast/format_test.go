@@ -0,0 +1,70 @@
+package ast
+
+import (
+	"monkey/token"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	ident := func(name string) *Identifier { return &Identifier{Value: name} }
+	integer := func(value int64) *IntegerLiteral { return &IntegerLiteral{Value: value} }
+	infix := func(left Expression, op string, right Expression) *InfixExpression {
+		return &InfixExpression{Left: left, Operator: op, Right: right}
+	}
+	stmt := func(expr Expression) *ExpressionStatement { return &ExpressionStatement{Expression: expr} }
+
+	// Trees such as macros or other rewrites of the tree may build, which
+	// the parser couldn't have made without parentheses.
+	tests := []struct {
+		expr     Expression
+		expected string
+	}{
+		{infix(infix(ident("a"), "+", ident("b")), "*", ident("c")), "(a + b) * c"},
+		{infix(ident("a"), "-", infix(ident("b"), "-", ident("c"))), "a - (b - c)"},
+		{infix(infix(ident("a"), "-", ident("b")), "-", ident("c")), "a - b - c"},
+		{infix(infix(ident("a"), "**", ident("b")), "**", ident("c")), "(a ** b) ** c"},
+		{infix(ident("a"), "**", infix(ident("b"), "**", ident("c"))), "a ** b ** c"},
+		{infix(&PrefixExpression{Operator: "-", Right: ident("a")}, "**", integer(2)), "(-a) ** 2"},
+		{&PrefixExpression{Operator: "-", Right: infix(ident("a"), "**", integer(2))}, "-a ** 2"},
+		{&PrefixExpression{Operator: "!", Right: infix(ident("a"), "&&", ident("b"))}, "!(a && b)"},
+		{infix(ident("a"), "-", integer(-1)), "a - -1"},
+		{&IndexExpression{Left: integer(-1), Index: integer(0)}, "(-1)[0]"},
+		{&CallExpression{Function: infix(ident("f"), "||", ident("g")), Arguments: []Expression{}}, "(f || g)()"},
+		{&MemberExpression{Left: &CallExpression{Function: ident("f"), Arguments: []Expression{}}, Member: ident("m")}, "f().m"},
+		{
+			&ConditionalExpression{
+				Condition:   &ConditionalExpression{Condition: ident("a"), Consequence: ident("b"), Alternative: ident("c")},
+				Consequence: &AssignExpression{Name: ident("x"), Value: integer(1)},
+				Alternative: &AssignExpression{Name: ident("y"), Value: integer(2)},
+			},
+			"(a ? b : c) ? x = 1 : (y = 2)",
+		},
+		{infix(&AssignExpression{Name: ident("x"), Value: integer(1)}, "+", integer(1)), "(x = 1) + 1"},
+		{&FloatLiteral{Value: 2}, "2.0"},
+		{&StringLiteral{Value: "say \"hi\"\n\\"}, `"say \"hi\"\n\\"`},
+		{&StringLiteral{Token: token.Token{Type: token.RAW_STRING}, Value: "a\n\\b"}, "`a\n\\b`"},
+		{&StringLiteral{Token: token.Token{Type: token.RAW_STRING}, Value: "`"}, "\"`\""},
+		{
+			&IfExpression{
+				Condition:   ident("a"),
+				Consequence: &BlockStatement{Statements: []Statement{stmt(integer(1))}},
+				Alternative: &BlockStatement{Statements: []Statement{stmt(&IfExpression{
+					Condition:   ident("b"),
+					Consequence: &BlockStatement{Statements: []Statement{stmt(integer(2))}},
+				})}},
+			},
+			"if (a) { 1 } else if (b) { 2 }",
+		},
+	}
+
+	for _, tt := range tests {
+		program := &Program{Statements: []Statement{stmt(tt.expr)}}
+		if formatted := program.Format(); formatted != tt.expected+"\n" {
+			t.Errorf("wrong format. want=%q, got=%q", tt.expected+"\n", formatted)
+		}
+	}
+
+	if formatted := (&Program{}).Format(); formatted != "" {
+		t.Errorf("wrong format of an empty program. got=%q", formatted)
+	}
+}
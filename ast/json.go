@@ -0,0 +1,669 @@
+package ast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"monkey/token"
+	"strings"
+)
+
+// The AST is encoded as JSON with a stable schema, so that other tools can
+// read and write Monkey programs. Each node is an object whose "type" is the
+// name of its Go type, such as "InfixExpression", and whose "token" is the
+// token it was parsed from, with its position:
+//
+//	{"type": "Identifier", "token": {"type": "IDENT", "literal": "x",
+//	 "line": 1, "column": 5}, "value": "x"}
+//
+// The other fields of a node are named after its Go fields in lower camel
+// case, such as "returnValue" or the "blankLines" of a program, and
+// children that are left out, such as the alternative of an if expression
+// without an else, are null. The "comments" of a program, and the "close"
+// of a block, its closing brace, are tokens too. The pairs of a hash literal are an array of
+// objects with a "key" and a "value", sorted like SortedKeys sorts them, so
+// that a tree is always encoded the same way.
+
+type jsonToken struct {
+	Type    token.TokenType `json:"type"`
+	Literal string          `json:"literal"`
+	Line    int             `json:"line"`
+	Column  int             `json:"column"`
+}
+
+func encodeToken(tok token.Token) jsonToken {
+	return jsonToken{tok.Type, tok.Literal, tok.Line, tok.Column}
+}
+
+func (tok jsonToken) decode() token.Token {
+	return token.Token{Type: tok.Type, Literal: tok.Literal, Line: tok.Line, Column: tok.Column}
+}
+
+// Encodes the tree rooted at node as JSON.
+func MarshalJSON(node Node) ([]byte, error) {
+	return json.Marshal(encodeChild(node))
+}
+
+// Encodes the tree rooted at node as JSON, indenting it like
+// json.MarshalIndent.
+func MarshalIndentJSON(node Node, prefix, indent string) ([]byte, error) {
+	return json.MarshalIndent(encodeChild(node), prefix, indent)
+}
+
+// Decodes a tree encoded by MarshalJSON, returning its root. It fails if a
+// node has an unknown type, or a child of the wrong kind, such as a
+// statement in place of an expression.
+func UnmarshalJSON(data []byte) (Node, error) {
+	return decodeNode(data)
+}
+
+func encodeNode(node Node) interface{} {
+	obj := map[string]interface{}{"type": nodeType(node)}
+	setToken := func(tok token.Token) {
+		obj["token"] = encodeToken(tok)
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		obj["statements"] = encodeStatements(node.Statements)
+		obj["blankLines"] = append([]int{}, node.BlankLines...)
+		comments := []jsonToken{}
+		for _, comment := range node.Comments {
+			comments = append(comments, encodeToken(comment.Token))
+		}
+		obj["comments"] = comments
+
+	case *Identifier:
+		setToken(node.Token)
+		obj["value"] = node.Value
+
+	case *TypeAnnotation:
+		setToken(node.Token)
+		obj["name"] = node.Name
+
+	case *LetStatement:
+		setToken(node.Token)
+		obj["name"] = encodeChild(node.Name)
+		obj["annotation"] = encodeChild(node.Annotation)
+		obj["value"] = encodeChild(node.Value)
+
+	case *DestructuringLetStatement:
+		setToken(node.Token)
+		obj["hash"] = node.Hash
+		obj["keys"] = encodeExpressions(node.Keys)
+		obj["names"] = encodeIdentifiers(node.Names)
+		obj["value"] = encodeChild(node.Value)
+
+	case *ImportStatement:
+		setToken(node.Token)
+		obj["path"] = node.Path
+		obj["name"] = encodeChild(node.Name)
+
+	case *AssignExpression:
+		setToken(node.Token)
+		obj["name"] = encodeChild(node.Name)
+		obj["value"] = encodeChild(node.Value)
+
+	case *ReturnStatement:
+		setToken(node.Token)
+		obj["returnValue"] = encodeChild(node.ReturnValue)
+
+	case *ThrowStatement:
+		setToken(node.Token)
+		obj["value"] = encodeChild(node.Value)
+
+	case *ExpressionStatement:
+		setToken(node.Token)
+		obj["expression"] = encodeChild(node.Expression)
+
+	case *BlockStatement:
+		setToken(node.Token)
+		obj["statements"] = encodeStatements(node.Statements)
+		obj["close"] = encodeToken(node.Close)
+
+	case *IfExpression:
+		setToken(node.Token)
+		obj["condition"] = encodeChild(node.Condition)
+		obj["consequence"] = encodeChild(node.Consequence)
+		obj["alternative"] = encodeChild(node.Alternative)
+
+	case *ConditionalExpression:
+		setToken(node.Token)
+		obj["condition"] = encodeChild(node.Condition)
+		obj["consequence"] = encodeChild(node.Consequence)
+		obj["alternative"] = encodeChild(node.Alternative)
+
+	case *WhileExpression:
+		setToken(node.Token)
+		obj["condition"] = encodeChild(node.Condition)
+		obj["body"] = encodeChild(node.Body)
+
+	case *TryExpression:
+		setToken(node.Token)
+		obj["body"] = encodeChild(node.Body)
+		obj["param"] = encodeChild(node.Param)
+		obj["catch"] = encodeChild(node.Catch)
+		obj["finally"] = encodeChild(node.Finally)
+
+	case *InfixExpression:
+		setToken(node.Token)
+		obj["left"] = encodeChild(node.Left)
+		obj["operator"] = node.Operator
+		obj["right"] = encodeChild(node.Right)
+
+	case *PrefixExpression:
+		setToken(node.Token)
+		obj["operator"] = node.Operator
+		obj["right"] = encodeChild(node.Right)
+
+	case *IntegerLiteral:
+		setToken(node.Token)
+		obj["value"] = node.Value
+
+	case *FloatLiteral:
+		setToken(node.Token)
+		obj["value"] = node.Value
+
+	case *StringLiteral:
+		setToken(node.Token)
+		obj["value"] = node.Value
+
+	case *Boolean:
+		setToken(node.Token)
+		obj["value"] = node.Value
+
+	case *NullLiteral:
+		setToken(node.Token)
+
+	case *ArrayLiteral:
+		setToken(node.Token)
+		obj["elements"] = encodeExpressions(node.Elements)
+
+	case *IndexExpression:
+		setToken(node.Token)
+		obj["left"] = encodeChild(node.Left)
+		obj["index"] = encodeChild(node.Index)
+
+	case *MemberExpression:
+		setToken(node.Token)
+		obj["left"] = encodeChild(node.Left)
+		obj["member"] = encodeChild(node.Member)
+
+	case *SliceExpression:
+		setToken(node.Token)
+		obj["left"] = encodeChild(node.Left)
+		obj["start"] = encodeChild(node.Start)
+		obj["end"] = encodeChild(node.End)
+
+	case *FunctionLiteral:
+		setToken(node.Token)
+		obj["parameters"] = encodeIdentifiers(node.Parameters)
+		obj["defaults"] = encodeExpressions(node.Defaults)
+		obj["rest"] = encodeChild(node.Rest)
+		parameterTypes := []interface{}{}
+		for _, annotation := range node.ParameterTypes {
+			parameterTypes = append(parameterTypes, encodeChild(annotation))
+		}
+		obj["parameterTypes"] = parameterTypes
+		obj["returnType"] = encodeChild(node.ReturnType)
+		obj["body"] = encodeChild(node.Body)
+		obj["name"] = node.Name
+
+	case *MacroLiteral:
+		setToken(node.Token)
+		obj["parameters"] = encodeIdentifiers(node.Parameters)
+		obj["body"] = encodeChild(node.Body)
+
+	case *CallExpression:
+		setToken(node.Token)
+		obj["function"] = encodeChild(node.Function)
+		obj["arguments"] = encodeExpressions(node.Arguments)
+
+	case *HashLiteral:
+		setToken(node.Token)
+		pairs := []interface{}{}
+		for _, key := range SortedKeys(node) {
+			pairs = append(pairs, map[string]interface{}{
+				"key":   encodeChild(key),
+				"value": encodeChild(node.Pairs[key]),
+			})
+		}
+		obj["pairs"] = pairs
+	}
+
+	return obj
+}
+
+// Encodes a child of a node, as null if it is missing. A nil pointer to a
+// node isn't a nil Node, so it is checked for too.
+func encodeChild(node Node) interface{} {
+	switch node := node.(type) {
+	case nil:
+		return nil
+	case *Identifier:
+		if node == nil {
+			return nil
+		}
+	case *TypeAnnotation:
+		if node == nil {
+			return nil
+		}
+	case *BlockStatement:
+		if node == nil {
+			return nil
+		}
+	}
+	return encodeNode(node)
+}
+
+func encodeStatements(stmts []Statement) []interface{} {
+	encoded := []interface{}{}
+	for _, stmt := range stmts {
+		encoded = append(encoded, encodeChild(stmt))
+	}
+	return encoded
+}
+
+func encodeExpressions(exprs []Expression) []interface{} {
+	encoded := []interface{}{}
+	for _, expr := range exprs {
+		encoded = append(encoded, encodeChild(expr))
+	}
+	return encoded
+}
+
+func encodeIdentifiers(idents []*Identifier) []interface{} {
+	encoded := []interface{}{}
+	for _, ident := range idents {
+		encoded = append(encoded, encodeChild(ident))
+	}
+	return encoded
+}
+
+// Returns the name of the type of node, without its package.
+func nodeType(node Node) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+}
+
+// Decodes the fields of a node, keeping the first error it comes across, so
+// that a node can be decoded field by field and the error checked once.
+type decoder struct {
+	typ    string
+	fields map[string]json.RawMessage
+	err    error
+}
+
+func decodeNode(data []byte) (Node, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, nil
+	}
+
+	d := &decoder{fields: fields}
+	if _, ok := fields["type"]; !ok {
+		return nil, errors.New("node has no type")
+	}
+	if err := json.Unmarshal(fields["type"], &d.typ); err != nil {
+		return nil, fmt.Errorf("type of node: %w", err)
+	}
+
+	var node Node
+	switch d.typ {
+	case "Program":
+		program := &Program{Statements: d.statements("statements")}
+		d.value("blankLines", &program.BlankLines)
+		var comments []jsonToken
+		d.value("comments", &comments)
+		for _, comment := range comments {
+			program.Comments = append(program.Comments, &Comment{Token: comment.decode()})
+		}
+		node = program
+
+	case "Identifier":
+		ident := &Identifier{Token: d.token()}
+		d.value("value", &ident.Value)
+		node = ident
+
+	case "TypeAnnotation":
+		annotation := &TypeAnnotation{Token: d.token()}
+		d.value("name", &annotation.Name)
+		node = annotation
+
+	case "LetStatement":
+		node = &LetStatement{
+			Token:      d.token(),
+			Name:       d.identifier("name"),
+			Annotation: d.annotation("annotation"),
+			Value:      d.expression("value"),
+		}
+
+	case "DestructuringLetStatement":
+		stmt := &DestructuringLetStatement{
+			Token: d.token(),
+			Keys:  d.expressions("keys"),
+			Names: d.identifiers("names"),
+			Value: d.expression("value"),
+		}
+		d.value("hash", &stmt.Hash)
+		node = stmt
+
+	case "ImportStatement":
+		stmt := &ImportStatement{Token: d.token(), Name: d.identifier("name")}
+		d.value("path", &stmt.Path)
+		node = stmt
+
+	case "AssignExpression":
+		node = &AssignExpression{
+			Token: d.token(),
+			Name:  d.identifier("name"),
+			Value: d.expression("value"),
+		}
+
+	case "ReturnStatement":
+		node = &ReturnStatement{Token: d.token(), ReturnValue: d.expression("returnValue")}
+
+	case "ThrowStatement":
+		node = &ThrowStatement{Token: d.token(), Value: d.expression("value")}
+
+	case "ExpressionStatement":
+		node = &ExpressionStatement{Token: d.token(), Expression: d.expression("expression")}
+
+	case "BlockStatement":
+		block := &BlockStatement{Token: d.token(), Statements: d.statements("statements")}
+		var close jsonToken
+		d.value("close", &close)
+		block.Close = close.decode()
+		node = block
+
+	case "IfExpression":
+		node = &IfExpression{
+			Token:       d.token(),
+			Condition:   d.expression("condition"),
+			Consequence: d.block("consequence"),
+			Alternative: d.block("alternative"),
+		}
+
+	case "ConditionalExpression":
+		node = &ConditionalExpression{
+			Token:       d.token(),
+			Condition:   d.expression("condition"),
+			Consequence: d.expression("consequence"),
+			Alternative: d.expression("alternative"),
+		}
+
+	case "WhileExpression":
+		node = &WhileExpression{
+			Token:     d.token(),
+			Condition: d.expression("condition"),
+			Body:      d.block("body"),
+		}
+
+	case "TryExpression":
+		node = &TryExpression{
+			Token:   d.token(),
+			Body:    d.block("body"),
+			Param:   d.identifier("param"),
+			Catch:   d.block("catch"),
+			Finally: d.block("finally"),
+		}
+
+	case "InfixExpression":
+		expr := &InfixExpression{
+			Token: d.token(),
+			Left:  d.expression("left"),
+			Right: d.expression("right"),
+		}
+		d.value("operator", &expr.Operator)
+		node = expr
+
+	case "PrefixExpression":
+		expr := &PrefixExpression{Token: d.token(), Right: d.expression("right")}
+		d.value("operator", &expr.Operator)
+		node = expr
+
+	case "IntegerLiteral":
+		lit := &IntegerLiteral{Token: d.token()}
+		d.value("value", &lit.Value)
+		node = lit
+
+	case "FloatLiteral":
+		lit := &FloatLiteral{Token: d.token()}
+		d.value("value", &lit.Value)
+		node = lit
+
+	case "StringLiteral":
+		lit := &StringLiteral{Token: d.token()}
+		d.value("value", &lit.Value)
+		node = lit
+
+	case "Boolean":
+		lit := &Boolean{Token: d.token()}
+		d.value("value", &lit.Value)
+		node = lit
+
+	case "NullLiteral":
+		node = &NullLiteral{Token: d.token()}
+
+	case "ArrayLiteral":
+		node = &ArrayLiteral{Token: d.token(), Elements: d.expressions("elements")}
+
+	case "IndexExpression":
+		node = &IndexExpression{
+			Token: d.token(),
+			Left:  d.expression("left"),
+			Index: d.expression("index"),
+		}
+
+	case "MemberExpression":
+		node = &MemberExpression{
+			Token:  d.token(),
+			Left:   d.expression("left"),
+			Member: d.identifier("member"),
+		}
+
+	case "SliceExpression":
+		node = &SliceExpression{
+			Token: d.token(),
+			Left:  d.expression("left"),
+			Start: d.expression("start"),
+			End:   d.expression("end"),
+		}
+
+	case "FunctionLiteral":
+		lit := &FunctionLiteral{
+			Token:      d.token(),
+			Parameters: d.identifiers("parameters"),
+			Defaults:   d.expressions("defaults"),
+			Rest:       d.identifier("rest"),
+			ReturnType: d.annotation("returnType"),
+			Body:       d.block("body"),
+		}
+		for _, data := range d.array("parameterTypes") {
+			lit.ParameterTypes = append(lit.ParameterTypes, d.toAnnotation("parameterTypes", d.child("parameterTypes", data)))
+		}
+		d.value("name", &lit.Name)
+		node = lit
+
+	case "MacroLiteral":
+		node = &MacroLiteral{
+			Token:      d.token(),
+			Parameters: d.identifiers("parameters"),
+			Body:       d.block("body"),
+		}
+
+	case "CallExpression":
+		node = &CallExpression{
+			Token:     d.token(),
+			Function:  d.expression("function"),
+			Arguments: d.expressions("arguments"),
+		}
+
+	case "HashLiteral":
+		node = &HashLiteral{Token: d.token(), Pairs: d.pairs("pairs")}
+
+	default:
+		return nil, fmt.Errorf("unknown node type %q", d.typ)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return node, nil
+}
+
+// Decodes the field named key into v, leaving v as it is if the field is
+// missing.
+func (d *decoder) value(key string, v interface{}) {
+	data, ok := d.fields[key]
+	if !ok || d.err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		d.fail(key, err)
+	}
+}
+
+func (d *decoder) fail(key string, err error) {
+	if d.err == nil {
+		d.err = fmt.Errorf("field %q of %s: %w", key, d.typ, err)
+	}
+}
+
+func (d *decoder) token() token.Token {
+	var tok jsonToken
+	d.value("token", &tok)
+	return tok.decode()
+}
+
+// Decodes the child in the field named key, which is nil if the field is
+// null or missing.
+func (d *decoder) child(key string, data json.RawMessage) Node {
+	if data == nil || d.err != nil {
+		return nil
+	}
+	node, err := decodeNode(data)
+	if err != nil {
+		d.fail(key, err)
+	}
+	return node
+}
+
+// Decodes the array in the field named key.
+func (d *decoder) array(key string) []json.RawMessage {
+	var elements []json.RawMessage
+	d.value(key, &elements)
+	return elements
+}
+
+func (d *decoder) expression(key string) Expression {
+	return d.toExpression(key, d.child(key, d.fields[key]))
+}
+
+func (d *decoder) toExpression(key string, node Node) Expression {
+	if node == nil {
+		return nil
+	}
+	expr, ok := node.(Expression)
+	if !ok {
+		d.fail(key, fmt.Errorf("%s is not an expression", nodeType(node)))
+	}
+	return expr
+}
+
+func (d *decoder) expressions(key string) []Expression {
+	exprs := []Expression{}
+	for _, data := range d.array(key) {
+		exprs = append(exprs, d.toExpression(key, d.child(key, data)))
+	}
+	return exprs
+}
+
+func (d *decoder) statements(key string) []Statement {
+	stmts := []Statement{}
+	for _, data := range d.array(key) {
+		node := d.child(key, data)
+		if node == nil {
+			stmts = append(stmts, nil)
+			continue
+		}
+		stmt, ok := node.(Statement)
+		if !ok {
+			d.fail(key, fmt.Errorf("%s is not a statement", nodeType(node)))
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+func (d *decoder) toIdentifier(key string, node Node) *Identifier {
+	if node == nil {
+		return nil
+	}
+	ident, ok := node.(*Identifier)
+	if !ok {
+		d.fail(key, fmt.Errorf("%s is not an identifier", nodeType(node)))
+	}
+	return ident
+}
+
+func (d *decoder) identifier(key string) *Identifier {
+	return d.toIdentifier(key, d.child(key, d.fields[key]))
+}
+
+func (d *decoder) identifiers(key string) []*Identifier {
+	idents := []*Identifier{}
+	for _, data := range d.array(key) {
+		idents = append(idents, d.toIdentifier(key, d.child(key, data)))
+	}
+	return idents
+}
+
+func (d *decoder) toAnnotation(key string, node Node) *TypeAnnotation {
+	if node == nil {
+		return nil
+	}
+	annotation, ok := node.(*TypeAnnotation)
+	if !ok {
+		d.fail(key, fmt.Errorf("%s is not a type annotation", nodeType(node)))
+	}
+	return annotation
+}
+
+func (d *decoder) annotation(key string) *TypeAnnotation {
+	return d.toAnnotation(key, d.child(key, d.fields[key]))
+}
+
+func (d *decoder) block(key string) *BlockStatement {
+	node := d.child(key, d.fields[key])
+	if node == nil {
+		return nil
+	}
+	block, ok := node.(*BlockStatement)
+	if !ok {
+		d.fail(key, fmt.Errorf("%s is not a block", nodeType(node)))
+	}
+	return block
+}
+
+func (d *decoder) pairs(key string) map[Expression]Expression {
+	pairs := map[Expression]Expression{}
+	for _, data := range d.array(key) {
+		var pair struct {
+			Key   json.RawMessage `json:"key"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(data, &pair); err != nil {
+			d.fail(key, err)
+			break
+		}
+		k := d.toExpression(key, d.child(key, pair.Key))
+		v := d.toExpression(key, d.child(key, pair.Value))
+		if k != nil {
+			pairs[k] = v
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,105 @@
+package ast
+
+import (
+	"monkey/token"
+	"strings"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	stmt := &ReturnStatement{
+		Token: token.Token{Type: token.RETURN, Literal: "return", Line: 2, Column: 3},
+		ReturnValue: &Identifier{
+			Token: token.Token{Type: token.IDENT, Literal: "x", Line: 2, Column: 10},
+			Value: "x",
+		},
+	}
+
+	data, err := MarshalJSON(stmt)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %s", err)
+	}
+
+	expected := `{"returnValue":{"token":{"type":"IDENT","literal":"x","line":2,"column":10},` +
+		`"type":"Identifier","value":"x"},` +
+		`"token":{"type":"RETURN","literal":"return","line":2,"column":3},"type":"ReturnStatement"}`
+	if string(data) != expected {
+		t.Errorf("wrong JSON.\nwant=%s\ngot= %s", expected, data)
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	program := walkTestProgram()
+	program.Comments = []*Comment{
+		{Token: token.Token{Type: token.COMMENT, Literal: "// f", Line: 1, Column: 1}},
+	}
+
+	data, err := MarshalJSON(program)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %s", err)
+	}
+	decoded, err := UnmarshalJSON(data)
+	if err != nil {
+		t.Fatalf("UnmarshalJSON failed: %s", err)
+	}
+
+	if decoded.String() != program.String() {
+		t.Errorf("wrong program. want=%q, got=%q", program.String(), decoded.String())
+	}
+	if comments := decoded.(*Program).Comments; len(comments) != 1 || comments[0].Text() != "f" {
+		t.Errorf("wrong comments. got=%v", comments)
+	}
+
+	// The tree decoded is encoded the same way again, positions and
+	// missing children included.
+	again, err := MarshalJSON(decoded)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %s", err)
+	}
+	if string(again) != string(data) {
+		t.Errorf("wrong JSON.\nwant=%s\ngot= %s", data, again)
+	}
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`[]`, "cannot unmarshal array"},
+		{`{"type": "Loop"}`, `unknown node type "Loop"`},
+		{`{"value": 1}`, "node has no type"},
+		{`{"type": 1}`, "type of node: json: cannot unmarshal number"},
+		{
+			`{"type": "ExpressionStatement", "expression": {"type": "Program"}}`,
+			`field "expression" of ExpressionStatement: Program is not an expression`,
+		},
+		{
+			`{"type": "Program", "statements": [{"type": "IntegerLiteral", "value": 1}]}`,
+			`field "statements" of Program: IntegerLiteral is not a statement`,
+		},
+		{
+			`{"type": "Program", "statements": [{"type": "LetStatement", "name": {"type": "Boolean"}}]}`,
+			`field "statements" of Program: field "name" of LetStatement: Boolean is not an identifier`,
+		},
+		{
+			`{"type": "WhileExpression", "body": {"type": "ReturnStatement"}}`,
+			`field "body" of WhileExpression: ReturnStatement is not a block`,
+		},
+		{
+			`{"type": "IntegerLiteral", "value": "1"}`,
+			`field "value" of IntegerLiteral: json: cannot unmarshal string`,
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := UnmarshalJSON([]byte(tt.input))
+		if err == nil {
+			t.Errorf("expected an error for %s", tt.input)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong error for %s. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
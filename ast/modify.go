@@ -0,0 +1,220 @@
+package ast
+
+type ModifierFunc func(Node) Node
+
+// Rebuilds the tree rooted at node, replacing each node, from the leaves up,
+// with what modifier returns for it. Every node is passed to modifier,
+// names such as those of parameters included, after its children. A child
+// is left out, as nil, if modifier replaces it with a node of the wrong
+// kind, such as a statement in place of an expression. The nodes with
+// children are copied rather than changed, so that node is left as it was,
+// as long as modifier doesn't change the nodes it is passed either. It
+// returns the new root.
+func Modify(node Node, modifier ModifierFunc) Node {
+	switch node := node.(type) {
+	case *Program:
+		copied := *node
+		copied.Statements = modifyStatements(node.Statements, modifier)
+		return modifier(&copied)
+
+	case *LetStatement:
+		copied := *node
+		copied.Name = modifyIdentifier(node.Name, modifier)
+		copied.Value = modifyExpression(node.Value, modifier)
+		return modifier(&copied)
+
+	case *DestructuringLetStatement:
+		copied := *node
+		copied.Keys = modifyExpressions(node.Keys, modifier)
+		copied.Names = modifyIdentifiers(node.Names, modifier)
+		copied.Value = modifyExpression(node.Value, modifier)
+		return modifier(&copied)
+
+	case *ImportStatement:
+		copied := *node
+		copied.Name = modifyIdentifier(node.Name, modifier)
+		return modifier(&copied)
+
+	case *ReturnStatement:
+		copied := *node
+		copied.ReturnValue = modifyExpression(node.ReturnValue, modifier)
+		return modifier(&copied)
+
+	case *ThrowStatement:
+		copied := *node
+		copied.Value = modifyExpression(node.Value, modifier)
+		return modifier(&copied)
+
+	case *ExpressionStatement:
+		copied := *node
+		copied.Expression = modifyExpression(node.Expression, modifier)
+		return modifier(&copied)
+
+	case *BlockStatement:
+		copied := *node
+		copied.Statements = modifyStatements(node.Statements, modifier)
+		return modifier(&copied)
+
+	case *AssignExpression:
+		copied := *node
+		copied.Name = modifyIdentifier(node.Name, modifier)
+		copied.Value = modifyExpression(node.Value, modifier)
+		return modifier(&copied)
+
+	case *IfExpression:
+		copied := *node
+		copied.Condition = modifyExpression(node.Condition, modifier)
+		copied.Consequence = modifyBlock(node.Consequence, modifier)
+		copied.Alternative = modifyBlock(node.Alternative, modifier)
+		return modifier(&copied)
+
+	case *ConditionalExpression:
+		copied := *node
+		copied.Condition = modifyExpression(node.Condition, modifier)
+		copied.Consequence = modifyExpression(node.Consequence, modifier)
+		copied.Alternative = modifyExpression(node.Alternative, modifier)
+		return modifier(&copied)
+
+	case *WhileExpression:
+		copied := *node
+		copied.Condition = modifyExpression(node.Condition, modifier)
+		copied.Body = modifyBlock(node.Body, modifier)
+		return modifier(&copied)
+
+	case *TryExpression:
+		copied := *node
+		copied.Body = modifyBlock(node.Body, modifier)
+		copied.Param = modifyIdentifier(node.Param, modifier)
+		copied.Catch = modifyBlock(node.Catch, modifier)
+		copied.Finally = modifyBlock(node.Finally, modifier)
+		return modifier(&copied)
+
+	case *InfixExpression:
+		copied := *node
+		copied.Left = modifyExpression(node.Left, modifier)
+		copied.Right = modifyExpression(node.Right, modifier)
+		return modifier(&copied)
+
+	case *PrefixExpression:
+		copied := *node
+		copied.Right = modifyExpression(node.Right, modifier)
+		return modifier(&copied)
+
+	case *ArrayLiteral:
+		copied := *node
+		copied.Elements = modifyExpressions(node.Elements, modifier)
+		return modifier(&copied)
+
+	case *IndexExpression:
+		copied := *node
+		copied.Left = modifyExpression(node.Left, modifier)
+		copied.Index = modifyExpression(node.Index, modifier)
+		return modifier(&copied)
+
+	case *MemberExpression:
+		copied := *node
+		copied.Left = modifyExpression(node.Left, modifier)
+		copied.Member = modifyIdentifier(node.Member, modifier)
+		return modifier(&copied)
+
+	case *SliceExpression:
+		copied := *node
+		copied.Left = modifyExpression(node.Left, modifier)
+		copied.Start = modifyExpression(node.Start, modifier)
+		copied.End = modifyExpression(node.End, modifier)
+		return modifier(&copied)
+
+	case *FunctionLiteral:
+		copied := *node
+		copied.Parameters = modifyIdentifiers(node.Parameters, modifier)
+		copied.Defaults = modifyExpressions(node.Defaults, modifier)
+		copied.Rest = modifyIdentifier(node.Rest, modifier)
+		copied.Body = modifyBlock(node.Body, modifier)
+		return modifier(&copied)
+
+	case *MacroLiteral:
+		copied := *node
+		copied.Parameters = modifyIdentifiers(node.Parameters, modifier)
+		copied.Body = modifyBlock(node.Body, modifier)
+		return modifier(&copied)
+
+	case *CallExpression:
+		copied := *node
+		copied.Function = modifyExpression(node.Function, modifier)
+		copied.Arguments = modifyExpressions(node.Arguments, modifier)
+		return modifier(&copied)
+
+	case *HashLiteral:
+		copied := *node
+		copied.Pairs = make(map[Expression]Expression, len(node.Pairs))
+		for _, key := range SortedKeys(node) {
+			copied.Pairs[modifyExpression(key, modifier)] = modifyExpression(node.Pairs[key], modifier)
+		}
+		return modifier(&copied)
+
+	default:
+		// Identifiers and literals have no children.
+		return modifier(node)
+	}
+}
+
+// Modifies a child of a node, which may be missing, such as the end of a
+// slice like `a[1:]`.
+func modifyExpression(expr Expression, modifier ModifierFunc) Expression {
+	if expr == nil {
+		return nil
+	}
+	modified, _ := Modify(expr, modifier).(Expression)
+	return modified
+}
+
+func modifyExpressions(exprs []Expression, modifier ModifierFunc) []Expression {
+	if exprs == nil {
+		return nil
+	}
+	modified := make([]Expression, len(exprs))
+	for i, expr := range exprs {
+		modified[i] = modifyExpression(expr, modifier)
+	}
+	return modified
+}
+
+func modifyStatements(stmts []Statement, modifier ModifierFunc) []Statement {
+	if stmts == nil {
+		return nil
+	}
+	modified := make([]Statement, len(stmts))
+	for i, stmt := range stmts {
+		if stmt != nil {
+			modified[i], _ = Modify(stmt, modifier).(Statement)
+		}
+	}
+	return modified
+}
+
+func modifyIdentifier(ident *Identifier, modifier ModifierFunc) *Identifier {
+	if ident == nil {
+		return nil
+	}
+	modified, _ := Modify(ident, modifier).(*Identifier)
+	return modified
+}
+
+func modifyIdentifiers(idents []*Identifier, modifier ModifierFunc) []*Identifier {
+	if idents == nil {
+		return nil
+	}
+	modified := make([]*Identifier, len(idents))
+	for i, ident := range idents {
+		modified[i] = modifyIdentifier(ident, modifier)
+	}
+	return modified
+}
+
+func modifyBlock(block *BlockStatement, modifier ModifierFunc) *BlockStatement {
+	if block == nil {
+		return nil
+	}
+	modified, _ := Modify(block, modifier).(*BlockStatement)
+	return modified
+}
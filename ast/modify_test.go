@@ -0,0 +1,258 @@
+package ast
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestModify(t *testing.T) {
+	one := func() Expression { return &IntegerLiteral{Value: 1} }
+	two := func() Expression { return &IntegerLiteral{Value: 2} }
+
+	turnOneIntoTwo := func(node Node) Node {
+		integer, ok := node.(*IntegerLiteral)
+		if !ok {
+			return node
+		}
+
+		if integer.Value != 1 {
+			return node
+		}
+
+		return &IntegerLiteral{Value: 2}
+	}
+
+	tests := []struct {
+		input    Node
+		expected Node
+	}{
+		{one(), two()},
+		{
+			&Program{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+			&Program{Statements: []Statement{&ExpressionStatement{Expression: two()}}},
+		},
+		{
+			&InfixExpression{Left: one(), Operator: "+", Right: two()},
+			&InfixExpression{Left: two(), Operator: "+", Right: two()},
+		},
+		{
+			&InfixExpression{Left: two(), Operator: "+", Right: one()},
+			&InfixExpression{Left: two(), Operator: "+", Right: two()},
+		},
+		{
+			&PrefixExpression{Operator: "-", Right: one()},
+			&PrefixExpression{Operator: "-", Right: two()},
+		},
+		{
+			&IndexExpression{Left: one(), Index: one()},
+			&IndexExpression{Left: two(), Index: two()},
+		},
+		{
+			&IfExpression{
+				Condition: one(),
+				Consequence: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: one()},
+				}},
+				Alternative: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: one()},
+				}},
+			},
+			&IfExpression{
+				Condition: two(),
+				Consequence: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: two()},
+				}},
+				Alternative: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: two()},
+				}},
+			},
+		},
+		{
+			&ReturnStatement{ReturnValue: one()},
+			&ReturnStatement{ReturnValue: two()},
+		},
+		{
+			&LetStatement{Value: one()},
+			&LetStatement{Value: two()},
+		},
+		{
+			&FunctionLiteral{
+				Parameters: []*Identifier{},
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: one()},
+				}},
+			},
+			&FunctionLiteral{
+				Parameters: []*Identifier{},
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: two()},
+				}},
+			},
+		},
+		{
+			&CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{one(), one()}},
+			&CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{two(), two()}},
+		},
+		{
+			&ArrayLiteral{Elements: []Expression{one(), one()}},
+			&ArrayLiteral{Elements: []Expression{two(), two()}},
+		},
+		{
+			&DestructuringLetStatement{Hash: true, Keys: []Expression{one()}, Value: one()},
+			&DestructuringLetStatement{Hash: true, Keys: []Expression{two()}, Value: two()},
+		},
+		{
+			&ThrowStatement{Value: one()},
+			&ThrowStatement{Value: two()},
+		},
+		{
+			&AssignExpression{Value: one()},
+			&AssignExpression{Value: two()},
+		},
+		{
+			&ConditionalExpression{Condition: one(), Consequence: one(), Alternative: one()},
+			&ConditionalExpression{Condition: two(), Consequence: two(), Alternative: two()},
+		},
+		{
+			&WhileExpression{
+				Condition: one(),
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: one()},
+				}},
+			},
+			&WhileExpression{
+				Condition: two(),
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: two()},
+				}},
+			},
+		},
+		{
+			&TryExpression{
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: one()},
+				}},
+				Catch: &BlockStatement{Statements: []Statement{
+					&ThrowStatement{Value: one()},
+				}},
+				Finally: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: one()},
+				}},
+			},
+			&TryExpression{
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: two()},
+				}},
+				Catch: &BlockStatement{Statements: []Statement{
+					&ThrowStatement{Value: two()},
+				}},
+				Finally: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: two()},
+				}},
+			},
+		},
+		{
+			&MemberExpression{Left: &ArrayLiteral{Elements: []Expression{one()}}, Member: &Identifier{Value: "m"}},
+			&MemberExpression{Left: &ArrayLiteral{Elements: []Expression{two()}}, Member: &Identifier{Value: "m"}},
+		},
+		{
+			&SliceExpression{Left: one(), Start: one()},
+			&SliceExpression{Left: two(), Start: two()},
+		},
+		{
+			&FunctionLiteral{
+				Parameters: []*Identifier{{Value: "a"}},
+				Defaults:   []Expression{one()},
+				Body:       &BlockStatement{Statements: []Statement{}},
+			},
+			&FunctionLiteral{
+				Parameters: []*Identifier{{Value: "a"}},
+				Defaults:   []Expression{two()},
+				Body:       &BlockStatement{Statements: []Statement{}},
+			},
+		},
+		{
+			&MacroLiteral{
+				Parameters: []*Identifier{},
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: one()},
+				}},
+			},
+			&MacroLiteral{
+				Parameters: []*Identifier{},
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: two()},
+				}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		modified := Modify(tt.input, turnOneIntoTwo)
+
+		if !reflect.DeepEqual(modified, tt.expected) {
+			t.Errorf("not equal. got=%#v, want=%#v", modified, tt.expected)
+		}
+	}
+
+	// The tree modified is left as it was.
+	program := &Program{Statements: []Statement{&ExpressionStatement{Expression: &InfixExpression{
+		Left: one(), Operator: "+", Right: &CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{one()}},
+	}}}}
+	before := program.String()
+	Modify(program, turnOneIntoTwo)
+	if program.String() != before {
+		t.Errorf("tree was changed. got=%q, want=%q", program.String(), before)
+	}
+
+	// Names are modified too.
+	rename := func(node Node) Node {
+		if ident, ok := node.(*Identifier); ok {
+			return &Identifier{Value: ident.Value + "2"}
+		}
+		return node
+	}
+	renamed := Modify(&FunctionLiteral{
+		Parameters: []*Identifier{{Value: "a"}},
+		Rest:       &Identifier{Value: "r"},
+		Body: &BlockStatement{Statements: []Statement{
+			&ExpressionStatement{Expression: &InfixExpression{
+				Left: &Identifier{Value: "a"}, Operator: "+", Right: &Identifier{Value: "r"},
+			}},
+		}},
+	}, rename)
+	if renamed.String() != "(a2, ...r2) (a2 + r2)" {
+		t.Errorf("wrong names. got=%q", renamed.String())
+	}
+
+	// A child replaced with a node of the wrong kind is left out.
+	dropped := Modify(&ReturnStatement{ReturnValue: one()}, func(node Node) Node {
+		if _, ok := node.(*IntegerLiteral); ok {
+			return &ExpressionStatement{}
+		}
+		return node
+	}).(*ReturnStatement)
+	if dropped.ReturnValue != nil {
+		t.Errorf("return value not left out. got=%#v", dropped.ReturnValue)
+	}
+
+	hashLiteral := &HashLiteral{
+		Pairs: map[Expression]Expression{
+			one(): one(),
+			one(): one(),
+		},
+	}
+
+	modified := Modify(hashLiteral, turnOneIntoTwo).(*HashLiteral)
+
+	for key, val := range modified.Pairs {
+		key, _ := key.(*IntegerLiteral)
+		if key.Value != 2 {
+			t.Errorf("value is not %d, got=%d", 2, key.Value)
+		}
+		val, _ := val.(*IntegerLiteral)
+		if val.Value != 2 {
+			t.Errorf("value is not %d, got=%d", 2, val.Value)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package ast
+
+import "sort"
+
+// Visits the nodes Walk comes across. If Visit returns a visitor w for a
+// node, Walk visits each of the node's children with w, followed by a call
+// of w.Visit(nil); if it returns nil, the children are skipped.
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Traverses the tree rooted at node depth-first, in the order the nodes
+// appear in the source, starting with v.Visit(node). Children left out,
+// such as the alternative of an if expression without an else, are
+// skipped.
+func Walk(node Node, v Visitor) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		walkStatements(n.Statements, v)
+
+	case *LetStatement:
+		walkIdentifier(n.Name, v)
+		walkAnnotation(n.Annotation, v)
+		walkExpression(n.Value, v)
+
+	case *DestructuringLetStatement:
+		for i, name := range n.Names {
+			if n.Hash && i < len(n.Keys) {
+				walkExpression(n.Keys[i], v)
+			}
+			walkIdentifier(name, v)
+		}
+		walkExpression(n.Value, v)
+
+	case *ImportStatement:
+		walkIdentifier(n.Name, v)
+
+	case *ReturnStatement:
+		walkExpression(n.ReturnValue, v)
+
+	case *ThrowStatement:
+		walkExpression(n.Value, v)
+
+	case *ExpressionStatement:
+		walkExpression(n.Expression, v)
+
+	case *BlockStatement:
+		walkStatements(n.Statements, v)
+
+	case *AssignExpression:
+		walkIdentifier(n.Name, v)
+		walkExpression(n.Value, v)
+
+	case *IfExpression:
+		walkExpression(n.Condition, v)
+		walkBlock(n.Consequence, v)
+		walkBlock(n.Alternative, v)
+
+	case *ConditionalExpression:
+		walkExpression(n.Condition, v)
+		walkExpression(n.Consequence, v)
+		walkExpression(n.Alternative, v)
+
+	case *WhileExpression:
+		walkExpression(n.Condition, v)
+		walkBlock(n.Body, v)
+
+	case *TryExpression:
+		walkBlock(n.Body, v)
+		walkIdentifier(n.Param, v)
+		walkBlock(n.Catch, v)
+		walkBlock(n.Finally, v)
+
+	case *InfixExpression:
+		walkExpression(n.Left, v)
+		walkExpression(n.Right, v)
+
+	case *PrefixExpression:
+		walkExpression(n.Right, v)
+
+	case *ArrayLiteral:
+		walkExpressions(n.Elements, v)
+
+	case *IndexExpression:
+		walkExpression(n.Left, v)
+		walkExpression(n.Index, v)
+
+	case *MemberExpression:
+		walkExpression(n.Left, v)
+		walkIdentifier(n.Member, v)
+
+	case *SliceExpression:
+		walkExpression(n.Left, v)
+		walkExpression(n.Start, v)
+		walkExpression(n.End, v)
+
+	case *FunctionLiteral:
+		// Each default value follows its parameter.
+		firstDefault := len(n.Parameters) - len(n.Defaults)
+		for i, param := range n.Parameters {
+			walkIdentifier(param, v)
+			walkAnnotation(n.ParameterType(i), v)
+			if i >= firstDefault {
+				walkExpression(n.Defaults[i-firstDefault], v)
+			}
+		}
+		walkIdentifier(n.Rest, v)
+		walkAnnotation(n.ReturnType, v)
+		walkBlock(n.Body, v)
+
+	case *MacroLiteral:
+		for _, param := range n.Parameters {
+			walkIdentifier(param, v)
+		}
+		walkBlock(n.Body, v)
+
+	case *CallExpression:
+		walkExpression(n.Function, v)
+		walkExpressions(n.Arguments, v)
+
+	case *HashLiteral:
+		// The order of the pairs isn't kept, so they are walked in the
+		// order of their keys, as the compiler compiles them.
+		for _, key := range SortedKeys(n) {
+			walkExpression(key, v)
+			walkExpression(n.Pairs[key], v)
+		}
+	}
+
+	v.Visit(nil)
+}
+
+// Returns the keys of a hash literal sorted by their source text, which
+// gives its pairs an order that is the same on every run.
+func SortedKeys(hl *HashLiteral) []Expression {
+	keys := make([]Expression, 0, len(hl.Pairs))
+	for key := range hl.Pairs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+// The children of a node are checked for nil before they are walked, since
+// a nil pointer to a node isn't a nil Node.
+
+func walkExpression(expr Expression, v Visitor) {
+	if expr != nil {
+		Walk(expr, v)
+	}
+}
+
+func walkExpressions(exprs []Expression, v Visitor) {
+	for _, expr := range exprs {
+		walkExpression(expr, v)
+	}
+}
+
+func walkStatements(stmts []Statement, v Visitor) {
+	for _, stmt := range stmts {
+		if stmt != nil {
+			Walk(stmt, v)
+		}
+	}
+}
+
+func walkIdentifier(ident *Identifier, v Visitor) {
+	if ident != nil {
+		Walk(ident, v)
+	}
+}
+
+func walkAnnotation(annotation *TypeAnnotation, v Visitor) {
+	if annotation != nil {
+		Walk(annotation, v)
+	}
+}
+
+func walkBlock(block *BlockStatement, v Visitor) {
+	if block != nil {
+		Walk(block, v)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Traverses the tree rooted at node like Walk, calling f for each node. If f
+// returns false for a node, its children are skipped. After the children of
+// a node, f is called with nil.
+func Inspect(node Node, f func(Node) bool) {
+	Walk(node, inspector(f))
+}
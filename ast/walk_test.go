@@ -0,0 +1,175 @@
+package ast
+
+import (
+	"reflect"
+	"testing"
+)
+
+// let f: fn = fn(a: int, b = 1, ...r) -> int { if (a < b) { return g(a); } };
+// try { {"k": [x[0:]]} } catch (e) { throw e.m; }
+func walkTestProgram() *Program {
+	ident := func(name string) *Identifier { return &Identifier{Value: name} }
+
+	return &Program{Statements: []Statement{
+		&LetStatement{
+			Name:       ident("f"),
+			Annotation: &TypeAnnotation{Name: "fn"},
+			Value: &FunctionLiteral{
+				Parameters:     []*Identifier{ident("a"), ident("b")},
+				Defaults:       []Expression{&IntegerLiteral{Value: 1}},
+				Rest:           ident("r"),
+				ParameterTypes: []*TypeAnnotation{{Name: "int"}, nil},
+				ReturnType:     &TypeAnnotation{Name: "int"},
+				Body: &BlockStatement{Statements: []Statement{
+					&ExpressionStatement{Expression: &IfExpression{
+						Condition: &InfixExpression{Left: ident("a"), Operator: "<", Right: ident("b")},
+						Consequence: &BlockStatement{Statements: []Statement{
+							&ReturnStatement{ReturnValue: &CallExpression{
+								Function:  ident("g"),
+								Arguments: []Expression{ident("a")},
+							}},
+						}},
+					}},
+				}},
+			},
+		},
+		&ExpressionStatement{Expression: &TryExpression{
+			Body: &BlockStatement{Statements: []Statement{
+				&ExpressionStatement{Expression: &HashLiteral{Pairs: map[Expression]Expression{
+					&StringLiteral{Value: "k"}: &ArrayLiteral{Elements: []Expression{
+						&SliceExpression{Left: ident("x"), Start: &IntegerLiteral{Value: 0}},
+					}},
+				}}},
+			}},
+			Param: ident("e"),
+			Catch: &BlockStatement{Statements: []Statement{
+				&ThrowStatement{Value: &MemberExpression{Left: ident("e"), Member: ident("m")}},
+			}},
+		}},
+	}}
+}
+
+// Describes a node by its type and, for identifiers, its name.
+func describe(node Node) string {
+	if ident, ok := node.(*Identifier); ok {
+		return "Identifier " + ident.Value
+	}
+	return nodeType(node)
+}
+
+func TestInspect(t *testing.T) {
+	var visited []string
+	Inspect(walkTestProgram(), func(node Node) bool {
+		if node != nil {
+			visited = append(visited, describe(node))
+		}
+		return true
+	})
+
+	expected := []string{
+		"Program",
+		"LetStatement",
+		"Identifier f",
+		"TypeAnnotation",
+		"FunctionLiteral",
+		"Identifier a",
+		"TypeAnnotation",
+		"Identifier b",
+		"IntegerLiteral",
+		"Identifier r",
+		"TypeAnnotation",
+		"BlockStatement",
+		"ExpressionStatement",
+		"IfExpression",
+		"InfixExpression",
+		"Identifier a",
+		"Identifier b",
+		"BlockStatement",
+		"ReturnStatement",
+		"CallExpression",
+		"Identifier g",
+		"Identifier a",
+		"ExpressionStatement",
+		"TryExpression",
+		"BlockStatement",
+		"ExpressionStatement",
+		"HashLiteral",
+		"StringLiteral",
+		"ArrayLiteral",
+		"SliceExpression",
+		"Identifier x",
+		"IntegerLiteral",
+		"Identifier e",
+		"BlockStatement",
+		"ThrowStatement",
+		"MemberExpression",
+		"Identifier e",
+		"Identifier m",
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("wrong nodes visited.\nwant=%v\ngot= %v", expected, visited)
+	}
+}
+
+func TestInspectSkipsChildren(t *testing.T) {
+	var visited []string
+	nils := 0
+	Inspect(walkTestProgram(), func(node Node) bool {
+		if node == nil {
+			nils++
+			return true
+		}
+		visited = append(visited, describe(node))
+		_, isFunction := node.(*FunctionLiteral)
+		_, isTry := node.(*TryExpression)
+		return !isFunction && !isTry
+	})
+
+	expected := []string{
+		"Program",
+		"LetStatement",
+		"Identifier f",
+		"TypeAnnotation",
+		"FunctionLiteral",
+		"ExpressionStatement",
+		"TryExpression",
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("wrong nodes visited.\nwant=%v\ngot= %v", expected, visited)
+	}
+
+	// Every node whose children were walked is followed by a nil.
+	if nils != len(expected)-2 {
+		t.Errorf("wrong number of nils. want=%d, got=%d", len(expected)-2, nils)
+	}
+}
+
+// Counts the identifiers within the nodes it is walked over, by the depth
+// of the node they are in.
+type depthCounter struct {
+	depth  int
+	counts map[int]int
+}
+
+func (d *depthCounter) Visit(node Node) Visitor {
+	if node == nil {
+		return nil
+	}
+	if _, ok := node.(*Identifier); ok {
+		d.counts[d.depth]++
+	}
+	return &depthCounter{depth: d.depth + 1, counts: d.counts}
+}
+
+func TestWalk(t *testing.T) {
+	counter := &depthCounter{counts: map[int]int{}}
+	Walk(walkTestProgram(), counter)
+
+	// f is at depth 2, the parameters and the catch's at 3, the names in
+	// the condition of the if at 7 and in the call at 9, the member
+	// expression's at 6 and the slice's at 8.
+	expected := map[int]int{2: 1, 3: 4, 6: 2, 7: 2, 8: 1, 9: 2}
+	if !reflect.DeepEqual(counter.counts, expected) {
+		t.Errorf("wrong identifier counts by depth. want=%v, got=%v", expected, counter.counts)
+	}
+}
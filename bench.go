@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/repl"
+	"monkey/vm"
+	"os"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+	"time"
+)
+
+const benchUsage = "usage: monkey bench [script.monkey]"
+
+// Run by `monkey bench` when no script is given.
+const fibonacciBenchmark = `
+let fibonacci = fn(x) {
+	if (x == 0) {
+		0
+	} else {
+		if (x == 1) {
+			return 1;
+		} else {
+			fibonacci(x - 1) + fibonacci(x - 2);
+		}
+	}
+};
+fibonacci(25);
+`
+
+type benchResult struct {
+	result       object.Object
+	elapsed      time.Duration
+	instructions uint64 // Only counted by the VM.
+	allocs       uint64
+	bytes        uint64
+}
+
+// Implements `monkey bench`, which runs a script, or a fibonacci benchmark,
+// under both engines and reports how long each took and how much it
+// allocated. Anything the script prints is discarded.
+func benchCommand(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), benchUsage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var program *ast.Program
+	var importDir string
+	switch flags.NArg() {
+	case 0:
+		program = parser.New(lexer.New(fibonacciBenchmark)).ParseProgram()
+	case 1:
+		var ok bool
+		program, ok = parseScript(flags.Arg(0))
+		if !ok {
+			return 1
+		}
+		importDir = filepath.Dir(flags.Arg(0))
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	evaluated := measure(func() (object.Object, uint64) {
+		env := object.NewEnvironment()
+		env.SetImportDir(importDir)
+		env.SetStdout(io.Discard)
+		return evaluator.Eval(program, env), 0
+	})
+	executed := measure(func() (object.Object, uint64) {
+		comp := compiler.New()
+		comp.SetImportDir(importDir)
+		if err := comp.Compile(program); err != nil {
+			return &object.Error{Message: err.Error()}, 0
+		}
+
+		machine := vm.New(comp.Bytecode())
+		machine.SetStdout(io.Discard)
+		if err := machine.Run(); err != nil {
+			return &object.Error{Message: err.Error()}, machine.InstructionsExecuted()
+		}
+		return machine.LastPoppedStackElem(), machine.InstructionsExecuted()
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "engine\tresult\ttime\tinstructions\tallocs\tbytes")
+	for _, row := range []struct {
+		engine string
+		res    benchResult
+	}{
+		{repl.EngineEvaluator, evaluated},
+		{repl.EngineVM, executed},
+	} {
+		instructions := "-"
+		if row.res.instructions > 0 {
+			instructions = fmt.Sprint(row.res.instructions)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", row.engine, inspect(row.res.result),
+			row.res.elapsed, instructions, row.res.allocs, row.res.bytes)
+	}
+	w.Flush()
+
+	fmt.Printf("speedup: %.2fx\n", float64(evaluated.elapsed)/float64(executed.elapsed))
+	return 0
+}
+
+// Times run, and counts the heap allocations it makes.
+func measure(run func() (object.Object, uint64)) benchResult {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	result, instructions := run()
+	elapsed := time.Since(start)
+
+	runtime.ReadMemStats(&after)
+
+	return benchResult{
+		result:       result,
+		elapsed:      elapsed,
+		instructions: instructions,
+		allocs:       after.Mallocs - before.Mallocs,
+		bytes:        after.TotalAlloc - before.TotalAlloc,
+	}
+}
+
+// Renders a result on a single line, dropping the stack trace of errors.
+func inspect(obj object.Object) string {
+	switch obj := obj.(type) {
+	case nil:
+		return "null"
+	case *object.Error:
+		return "Error: " + obj.Message
+	default:
+		return obj.Inspect()
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/compiler"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The extension of bytecode files written by `monkey build`.
+const bytecodeExt = ".mbc"
+
+const buildUsage = "usage: monkey build [-o out.mbc] script.monkey"
+
+// Implements `monkey build`, which compiles a script to a bytecode file that
+// `monkey exec` can run later without parsing or compiling it again.
+func buildCommand(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	out := flags.String("o", "", "the file to write the bytecode to (default: the script's name with a "+bytecodeExt+" extension)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), buildUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	path := flags.Arg(0)
+	program, ok := parseScript(path)
+	if !ok {
+		return 1
+	}
+
+	comp := compiler.New()
+	comp.SetImportDir(filepath.Dir(path))
+	if err := comp.Compile(program); err != nil {
+		reportCompileError(path, err)
+		return 1
+	}
+
+	data, err := comp.Bytecode().Serialize()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+
+	if *out == "" {
+		*out = strings.TrimSuffix(path, filepath.Ext(path)) + bytecodeExt
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "monkey: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+const execUsage = "usage: monkey exec [-checked] [-trace] [-profile] program.mbc"
+
+// Implements `monkey exec`, which runs a bytecode file written by
+// `monkey build` on the VM. Exit codes are the same as for `monkey run`.
+func execCommand(args []string) int {
+	flags := flag.NewFlagSet("exec", flag.ContinueOnError)
+	checked := flags.Bool("checked", false, checkedUsage)
+	var observe vmFlags
+	observe.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), execUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	path := flags.Arg(0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "monkey: %s\n", err)
+		return 1
+	}
+
+	bytecode, err := compiler.Deserialize(data)
+	if err == nil {
+		err = bytecode.Verify()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+
+	return exitCode(path, runCompiled(bytecode, *checked, observe))
+}
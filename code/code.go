@@ -16,18 +16,20 @@ func (i Instructions) String() string {
 		def, err := Lookup(i[offset])
 		if err != nil {
 			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			offset++
 			continue
 		}
 
 		operands, read := ReadOperands(def, i[offset+1:])
-		fmt.Fprintf(&out, "%04d %s\n", offset, i.fmtInstruction(def, operands))
+		fmt.Fprintf(&out, "%04d %s\n", offset, FormatInstruction(def, operands))
 		offset += 1 + read
 	}
 
 	return out.String()
 }
 
-func (i Instructions) fmtInstruction(def *Definition, operands []int) string {
+// Formats an instruction as its opcode's name followed by its operands.
+func FormatInstruction(def *Definition, operands []int) string {
 	operandCount := len(def.OperandWidths)
 	if len(operands) != operandCount {
 		return fmt.Sprintf("ERROR: operand len %d does not match defined %d\n",
@@ -48,6 +50,8 @@ func (i Instructions) fmtInstruction(def *Definition, operands []int) string {
 
 type Opcode byte
 
+// Opcodes are numbered by their position here, and that numbering is part of
+// the bytecode file format. Bump compiler.BytecodeVersion when it changes.
 const (
 	OpConstant Opcode = iota
 	OpAdd
@@ -55,11 +59,19 @@ const (
 	OpSub
 	OpMul
 	OpDiv
+	OpMod
+	OpPow
+	OpBitAnd
+	OpBitOr
+	OpBitXor
+	OpShiftLeft
+	OpShiftRight
 	OpTrue
 	OpFalse
 	OpEqual
 	OpNotEqual
 	OpGreaterThan
+	OpGreaterThanOrEqual
 	OpMinus
 	OpBang
 	OpJumpNotTruthy
@@ -70,6 +82,9 @@ const (
 	OpArray
 	OpHash
 	OpIndex
+	OpSlice
+	OpDestructureArray
+	OpDestructureHash
 	OpCall
 	OpReturnValue
 	OpReturn // Return with no value. I.e., Null.
@@ -78,6 +93,25 @@ const (
 	OpGetBuiltin
 	OpClosure
 	OpGetFree
+	OpCurrentClosure
+	OpJumpArgPassed
+	OpTry
+	OpEndTry
+	OpThrow
+	OpHalt // Ends the main program, with the value on top of the stack as its result.
+	OpAssignLocal
+	OpCaptureLocal
+	OpCaptureFree
+	OpSetFree
+	OpAssignGlobal
+	OpCaptureGlobal
+
+	// Superinstructions, which do the work of a common sequence of the
+	// instructions above in a single dispatch. The compiler selects them.
+	OpGetLocalAdd // OpGetLocal, OpAdd
+	OpConstantAdd // OpConstant, OpAdd
+	OpConstantSub // OpConstant, OpSub
+	OpCompareJump // OpEqual, OpNotEqual, OpGreaterThan or OpGreaterThanOrEqual, OpJumpNotTruthy
 )
 
 type Definition struct {
@@ -86,35 +120,62 @@ type Definition struct {
 }
 
 var definitions = map[Opcode]*Definition{
-	OpConstant:      {"OpConstant", []int{2}}, // operand: index of constant
-	OpAdd:           {"OpAdd", []int{}},
-	OpPop:           {"OpPop", []int{}},
-	OpSub:           {"OpSub", []int{}},
-	OpMul:           {"OpMul", []int{}},
-	OpDiv:           {"OpDiv", []int{}},
-	OpTrue:          {"OpTrue", []int{}},
-	OpFalse:         {"OpFalse", []int{}},
-	OpEqual:         {"OpEqual", []int{}},
-	OpNotEqual:      {"OpNotEqual", []int{}},
-	OpGreaterThan:   {"OpGreaterThan", []int{}},
-	OpMinus:         {"OpMinus", []int{}},
-	OpBang:          {"OpBang", []int{}},
-	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}}, // operand: position to jump to
-	OpJump:          {"OpJump", []int{2}},          // operand: position to jump to
-	OpNull:          {"OpNull", []int{}},
-	OpGetGlobal:     {"OpGetGlobal", []int{2}}, // operand: index of global
-	OpSetGlobal:     {"OpSetGlobal", []int{2}}, // operand: index of global
-	OpArray:         {"OpArray", []int{2}},     // operand: number of elements in array
-	OpHash:          {"OpHash", []int{2}},      // operand: number of key AND values on the stack
-	OpIndex:         {"OpIndex", []int{}},
-	OpCall:          {"OpCall", []int{1}}, // operand: number of arguments
-	OpReturnValue:   {"OpReturnValue", []int{}},
-	OpReturn:        {"OpReturn", []int{}},
-	OpGetLocal:      {"OpGetLocal", []int{1}},
-	OpSetLocal:      {"OpSetLocal", []int{1}},
-	OpGetBuiltin:    {"OpGetBuiltin", []int{1}},
-	OpClosure:       {"OpClosure", []int{2, 1}}, // operands: index of underlying function in the constant pool & how many free variables are needed
-	OpGetFree:       {"OpGetFree", []int{1}},
+	OpConstant:           {"OpConstant", []int{2}}, // operand: index of constant
+	OpAdd:                {"OpAdd", []int{}},
+	OpPop:                {"OpPop", []int{}},
+	OpSub:                {"OpSub", []int{}},
+	OpMul:                {"OpMul", []int{}},
+	OpDiv:                {"OpDiv", []int{}},
+	OpMod:                {"OpMod", []int{}},
+	OpPow:                {"OpPow", []int{}},
+	OpBitAnd:             {"OpBitAnd", []int{}},
+	OpBitOr:              {"OpBitOr", []int{}},
+	OpBitXor:             {"OpBitXor", []int{}},
+	OpShiftLeft:          {"OpShiftLeft", []int{}},
+	OpShiftRight:         {"OpShiftRight", []int{}},
+	OpTrue:               {"OpTrue", []int{}},
+	OpFalse:              {"OpFalse", []int{}},
+	OpEqual:              {"OpEqual", []int{}},
+	OpNotEqual:           {"OpNotEqual", []int{}},
+	OpGreaterThan:        {"OpGreaterThan", []int{}},
+	OpGreaterThanOrEqual: {"OpGreaterThanOrEqual", []int{}},
+	OpMinus:              {"OpMinus", []int{}},
+	OpBang:               {"OpBang", []int{}},
+	OpJumpNotTruthy:      {"OpJumpNotTruthy", []int{2}}, // operand: position to jump to
+	OpJump:               {"OpJump", []int{2}},          // operand: position to jump to
+	OpNull:               {"OpNull", []int{}},
+	OpGetGlobal:          {"OpGetGlobal", []int{2}}, // operand: index of global
+	OpSetGlobal:          {"OpSetGlobal", []int{2}}, // operand: index of global
+	OpArray:              {"OpArray", []int{2}},     // operand: number of elements in array
+	OpHash:               {"OpHash", []int{2}},      // operand: number of key AND values on the stack
+	OpIndex:              {"OpIndex", []int{}},
+	OpSlice:              {"OpSlice", []int{}},
+	OpDestructureArray:   {"OpDestructureArray", []int{2}}, // operand: number of elements to push
+	OpDestructureHash:    {"OpDestructureHash", []int{2}},  // operand: number of keys on the stack
+	OpCall:               {"OpCall", []int{1}},             // operand: number of arguments
+	OpReturnValue:        {"OpReturnValue", []int{}},
+	OpReturn:             {"OpReturn", []int{}},
+	OpGetLocal:           {"OpGetLocal", []int{1}},
+	OpSetLocal:           {"OpSetLocal", []int{1}},
+	OpGetBuiltin:         {"OpGetBuiltin", []int{1}},
+	OpClosure:            {"OpClosure", []int{2, 1}}, // operands: index of underlying function in the constant pool & how many free variables are needed
+	OpGetFree:            {"OpGetFree", []int{1}},
+	OpCurrentClosure:     {"OpCurrentClosure", []int{}},
+	OpJumpArgPassed:      {"OpJumpArgPassed", []int{1, 2}}, // operands: index of parameter & position to jump to if it was passed an argument
+	OpTry:                {"OpTry", []int{2, 1}},           // operands: position of the handler & whether it catches the exception, rather than running a finally before rethrowing it
+	OpEndTry:             {"OpEndTry", []int{}},            // removes the handler of the last OpTry
+	OpThrow:              {"OpThrow", []int{}},             // throws the value on top of the stack
+	OpHalt:               {"OpHalt", []int{}},              // ends main, returning the value on top of the stack
+	OpAssignLocal:        {"OpAssignLocal", []int{1}},      // operand: index of local, which is set through its cell if a closure captured it
+	OpCaptureLocal:       {"OpCaptureLocal", []int{1}},     // operand: index of local, which is turned into a cell if it isn't one yet
+	OpCaptureFree:        {"OpCaptureFree", []int{1}},      // operand: index of free variable, whose cell is pushed rather than its value
+	OpSetFree:            {"OpSetFree", []int{1}},          // operand: index of free variable
+	OpAssignGlobal:       {"OpAssignGlobal", []int{2}},     // operand: index of global, which is set through its cell if a closure captured it
+	OpCaptureGlobal:      {"OpCaptureGlobal", []int{2}},    // operand: index of global, which is turned into a cell if it isn't one yet
+	OpGetLocalAdd:        {"OpGetLocalAdd", []int{1}},      // operand: index of local
+	OpConstantAdd:        {"OpConstantAdd", []int{2}},      // operand: index of constant
+	OpConstantSub:        {"OpConstantSub", []int{2}},      // operand: index of constant
+	OpCompareJump:        {"OpCompareJump", []int{1, 2}},   // operands: comparison opcode & position to jump to if it is false
 }
 
 func Lookup(op byte) (*Definition, error) {
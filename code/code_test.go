@@ -38,12 +38,14 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
 		Make(OpClosure, 65535, 255),
+		Make(OpCurrentClosure),
 	}
 	expected := `0000 OpAdd
 0001 OpGetLocal 1
 0003 OpConstant 2
 0006 OpConstant 65535
 0009 OpClosure 65535 255
+0013 OpCurrentClosure
 `
 
 	concatted := Instructions{}
@@ -0,0 +1,45 @@
+package code
+
+import "sort"
+
+// Where in the source the instructions from Offset on come from, up to the
+// next position's offset.
+type SourcePosition struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+// Maps instruction offsets to the source they were compiled from, as
+// positions ordered by offset.
+type SourceMap []SourcePosition
+
+// Returns the source position of the instruction at offset, or 0, 0 if it
+// isn't known.
+func (m SourceMap) Lookup(offset int) (line, column int) {
+	i := sort.Search(len(m), func(i int) bool { return m[i].Offset > offset })
+	if i == 0 {
+		return 0, 0
+	}
+	return m[i-1].Line, m[i-1].Column
+}
+
+// Adds the position of the instruction at offset, which must come after
+// those already in the map. Nothing is added if the position is the same as
+// the one before, or unknown.
+func (m SourceMap) Add(offset, line, column int) SourceMap {
+	if line == 0 {
+		return m
+	}
+	if last := len(m) - 1; last >= 0 && m[last].Line == line && m[last].Column == column {
+		return m
+	}
+	return append(m, SourcePosition{Offset: offset, Line: line, Column: column})
+}
+
+// Drops the positions of instructions from offset on, for when they are
+// removed.
+func (m SourceMap) Truncate(offset int) SourceMap {
+	i := sort.Search(len(m), func(i int) bool { return m[i].Offset >= offset })
+	return m[:i]
+}
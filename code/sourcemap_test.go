@@ -0,0 +1,42 @@
+package code
+
+import "testing"
+
+func TestSourceMap(t *testing.T) {
+	var m SourceMap
+	m = m.Add(0, 1, 1)
+	m = m.Add(3, 1, 1) // The same position as before.
+	m = m.Add(5, 0, 0) // Unknown.
+	m = m.Add(6, 2, 4)
+	m = m.Add(9, 3, 1)
+
+	if len(m) != 3 {
+		t.Fatalf("wrong number of positions. want=3, got=%d (%v)", len(m), m)
+	}
+
+	tests := []struct {
+		offset         int
+		expectedLine   int
+		expectedColumn int
+	}{
+		{-1, 0, 0},
+		{0, 1, 1},
+		{5, 1, 1},
+		{6, 2, 4},
+		{8, 2, 4},
+		{100, 3, 1},
+	}
+
+	for _, test := range tests {
+		line, column := m.Lookup(test.offset)
+		if line != test.expectedLine || column != test.expectedColumn {
+			t.Errorf("wrong position for offset %d. want=%d:%d, got=%d:%d",
+				test.offset, test.expectedLine, test.expectedColumn, line, column)
+		}
+	}
+
+	m = m.Truncate(6)
+	if line, column := m.Lookup(8); line != 1 || column != 1 {
+		t.Errorf("wrong position after truncating. want=1:1, got=%d:%d", line, column)
+	}
+}
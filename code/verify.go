@@ -0,0 +1,365 @@
+package code
+
+import "fmt"
+
+// What the verifier needs to know about a constant in the pool. The code
+// package can't refer to the objects themselves, so the caller describes
+// them.
+type Constant struct {
+	// Whether the constant is a compiled function. The other fields are
+	// only set for functions.
+	IsFunction    bool
+	Instructions  Instructions
+	NumParameters int
+	NumDefaults   int
+	Variadic      bool
+	NumLocals     int
+}
+
+// A decoded instruction, as the verifier works on them.
+type verifiedInstruction struct {
+	op       Opcode
+	operands []int
+	next     int // Offset of the instruction after this one.
+}
+
+// Checks that bytecode is safe to run: that every instruction is defined
+// and whole, that jumps land on instructions, that constant, local, free
+// variable and builtin indices are in range, and that every path through
+// the instructions leaves the stack at the same height and never pops more
+// than was pushed, nor removes a handler that wasn't installed. It checks the main instructions and those of every
+// function in constants, and the functions must always end by returning.
+//
+// Global indices aren't checked, as every index fits in the VM's default
+// store of globals; a VM with fewer checks them as it runs.
+func Verify(ins Instructions, constants []Constant, numBuiltins int) error {
+	main, err := decodeForVerify(ins)
+	if err != nil {
+		return fmt.Errorf("main: %w", err)
+	}
+
+	functions := make(map[int]map[int]verifiedInstruction)
+	for i, constant := range constants {
+		if !constant.IsFunction {
+			continue
+		}
+		numParameters := constant.NumParameters
+		if constant.Variadic {
+			numParameters++
+		}
+		if numParameters > constant.NumLocals {
+			return fmt.Errorf("constant %d: %d parameters, but only %d locals",
+				i, numParameters, constant.NumLocals)
+		}
+		if constant.NumDefaults > constant.NumParameters {
+			return fmt.Errorf("constant %d: %d default values, but only %d parameters",
+				i, constant.NumDefaults, constant.NumParameters)
+		}
+		decoded, err := decodeForVerify(constant.Instructions)
+		if err != nil {
+			return fmt.Errorf("constant %d: %w", i, err)
+		}
+		functions[i] = decoded
+	}
+
+	// A function only learns how many free variables it has from the
+	// OpClosure instructions that make closures of it, so it can only rely
+	// on the fewest any of them provide.
+	numFree := map[int]int{}
+	collectClosures := func(decoded map[int]verifiedInstruction) {
+		for _, in := range decoded {
+			if in.op != OpClosure {
+				continue
+			}
+			idx, n := in.operands[0], in.operands[1]
+			if have, ok := numFree[idx]; !ok || n < have {
+				numFree[idx] = n
+			}
+		}
+	}
+	collectClosures(main)
+	for _, decoded := range functions {
+		collectClosures(decoded)
+	}
+
+	v := verifier{constants: constants, numBuiltins: numBuiltins}
+
+	if err := v.verify(ins, main, 0, 0, false); err != nil {
+		return fmt.Errorf("main: %w", err)
+	}
+	for i, constant := range constants {
+		if !constant.IsFunction {
+			continue
+		}
+		err := v.verify(constant.Instructions, functions[i], constant.NumLocals, numFree[i], true)
+		if err != nil {
+			return fmt.Errorf("constant %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Decodes instructions by their offsets, failing on undefined opcodes and on
+// operands cut off by the end of the instructions.
+func decodeForVerify(ins Instructions) (map[int]verifiedInstruction, error) {
+	decoded := map[int]verifiedInstruction{}
+
+	offset := 0
+	for offset < len(ins) {
+		def, err := Lookup(ins[offset])
+		if err != nil {
+			return nil, fmt.Errorf("%04d: %w", offset, err)
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if offset+1+width > len(ins) {
+			return nil, fmt.Errorf("%04d: %s is missing operands", offset, def.Name)
+		}
+
+		operands, read := ReadOperands(def, ins[offset+1:])
+		decoded[offset] = verifiedInstruction{
+			op:       Opcode(ins[offset]),
+			operands: operands,
+			next:     offset + 1 + read,
+		}
+		offset += 1 + read
+	}
+
+	return decoded, nil
+}
+
+type verifier struct {
+	constants   []Constant
+	numBuiltins int
+}
+
+// Verifies the decoded instructions of main or of a function.
+func (v *verifier) verify(
+	ins Instructions,
+	decoded map[int]verifiedInstruction,
+	numLocals, numFree int,
+	isFunction bool,
+) error {
+	for offset := 0; offset < len(ins); offset = decoded[offset].next {
+		in := decoded[offset]
+		err := v.verifyOperands(in, len(ins), decoded, numLocals, numFree)
+		if err != nil {
+			return fmt.Errorf("%04d: %s: %w", offset, definitions[in.op].Name, err)
+		}
+	}
+
+	return verifyStack(decoded, len(ins), isFunction)
+}
+
+func (v *verifier) verifyOperands(
+	in verifiedInstruction,
+	length int,
+	decoded map[int]verifiedInstruction,
+	numLocals, numFree int,
+) error {
+	switch in.op {
+	case OpConstant, OpConstantAdd, OpConstantSub:
+		if idx := in.operands[0]; idx >= len(v.constants) {
+			return fmt.Errorf("constant %d out of range, have %d", idx, len(v.constants))
+		}
+
+	case OpClosure:
+		idx := in.operands[0]
+		if idx >= len(v.constants) {
+			return fmt.Errorf("constant %d out of range, have %d", idx, len(v.constants))
+		}
+		if !v.constants[idx].IsFunction {
+			return fmt.Errorf("constant %d is not a function", idx)
+		}
+
+	case OpGetLocal, OpSetLocal, OpAssignLocal, OpCaptureLocal, OpGetLocalAdd, OpJumpArgPassed:
+		if idx := in.operands[0]; idx >= numLocals {
+			return fmt.Errorf("local %d out of range, have %d", idx, numLocals)
+		}
+
+	case OpGetFree, OpCaptureFree, OpSetFree:
+		if idx := in.operands[0]; idx >= numFree {
+			return fmt.Errorf("free variable %d out of range, have %d", idx, numFree)
+		}
+
+	case OpGetBuiltin:
+		if idx := in.operands[0]; idx >= v.numBuiltins {
+			return fmt.Errorf("builtin %d out of range, have %d", idx, v.numBuiltins)
+		}
+
+	case OpCompareJump:
+		switch Opcode(in.operands[0]) {
+		case OpEqual, OpNotEqual, OpGreaterThan, OpGreaterThanOrEqual:
+		default:
+			return fmt.Errorf("opcode %d is not a comparison", in.operands[0])
+		}
+
+	case OpTry:
+		if catches := in.operands[1]; catches > 1 {
+			return fmt.Errorf("catches is %d, not 0 or 1", catches)
+		}
+	}
+
+	if target, ok := jumpTarget(in); ok {
+		if _, ok := decoded[target]; !ok && target != length {
+			return fmt.Errorf("jump to %04d, which is not an instruction", target)
+		}
+	}
+
+	return nil
+}
+
+// Where an instruction is reached: how high the stack is, and how many
+// handlers OpTry has installed.
+type verifiedState struct {
+	height   int
+	handlers int
+}
+
+// Follows every path through the instructions, keeping track of the height
+// of the stack and of the handlers installed, which have to be the same
+// however an instruction is reached. OpEndTry needs a handler to remove.
+func verifyStack(decoded map[int]verifiedInstruction, length int, isFunction bool) error {
+	if length == 0 {
+		if isFunction {
+			return fmt.Errorf("function has no instructions")
+		}
+		return nil
+	}
+
+	states := map[int]verifiedState{0: {}}
+	work := []int{0}
+
+	reach := func(from, to int, state verifiedState) error {
+		if to == length {
+			if isFunction {
+				return fmt.Errorf("%04d: function can end without returning", from)
+			}
+			return nil
+		}
+		if have, ok := states[to]; ok {
+			if have.height != state.height {
+				return fmt.Errorf("%04d: stack height is %d from %04d, but %d from elsewhere",
+					to, state.height, from, have.height)
+			}
+			if have.handlers != state.handlers {
+				return fmt.Errorf("%04d: %d handlers are installed from %04d, but %d from elsewhere",
+					to, state.handlers, from, have.handlers)
+			}
+			return nil
+		}
+		states[to] = state
+		work = append(work, to)
+		return nil
+	}
+
+	for len(work) > 0 {
+		offset := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		in := decoded[offset]
+		pops, pushes := stackEffect(in)
+		state := states[offset]
+		if pops > state.height {
+			return fmt.Errorf("%04d: %s pops %d values, but the stack holds %d",
+				offset, definitions[in.op].Name, pops, state.height)
+		}
+		state.height += pushes - pops
+
+		switch in.op {
+		case OpTry:
+			// The handler is reached with the handler removed and the
+			// exception pushed.
+			handler := verifiedState{height: state.height + 1, handlers: state.handlers}
+			if err := reach(offset, in.operands[0], handler); err != nil {
+				return err
+			}
+			state.handlers++
+		case OpEndTry:
+			if state.handlers == 0 {
+				return fmt.Errorf("%04d: OpEndTry without a handler installed", offset)
+			}
+			state.handlers--
+		default:
+			if target, ok := jumpTarget(in); ok {
+				if err := reach(offset, target, state); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Main has no caller to return to, and functions can't end it.
+		switch {
+		case in.op == OpHalt && isFunction:
+			return fmt.Errorf("%04d: OpHalt in a function", offset)
+		case (in.op == OpReturnValue || in.op == OpReturn) && !isFunction:
+			return fmt.Errorf("%04d: %s outside a function", offset, definitions[in.op].Name)
+		}
+
+		switch in.op {
+		case OpJump, OpReturnValue, OpReturn, OpThrow, OpHalt:
+			// Execution doesn't continue with the next instruction.
+		default:
+			if err := reach(offset, in.next, state); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns where an instruction jumps to, if it jumps.
+func jumpTarget(in verifiedInstruction) (int, bool) {
+	switch in.op {
+	case OpJump, OpJumpNotTruthy:
+		return in.operands[0], true
+	case OpCompareJump, OpJumpArgPassed:
+		return in.operands[1], true
+	case OpTry:
+		return in.operands[0], true
+	default:
+		return 0, false
+	}
+}
+
+// Returns how many values an instruction pops off the stack, and how many it
+// then pushes.
+func stackEffect(in verifiedInstruction) (pops, pushes int) {
+	switch in.op {
+	case OpConstant, OpTrue, OpFalse, OpNull, OpGetGlobal, OpGetLocal,
+		OpGetBuiltin, OpGetFree, OpCurrentClosure, OpCaptureLocal, OpCaptureFree,
+		OpCaptureGlobal:
+		return 0, 1
+	case OpPop, OpSetGlobal, OpSetLocal, OpAssignLocal, OpSetFree, OpAssignGlobal,
+		OpJumpNotTruthy, OpReturnValue, OpThrow, OpHalt:
+		return 1, 0
+	case OpMinus, OpBang, OpGetLocalAdd, OpConstantAdd, OpConstantSub:
+		return 1, 1
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpPow, OpBitAnd, OpBitOr,
+		OpBitXor, OpShiftLeft, OpShiftRight, OpEqual, OpNotEqual,
+		OpGreaterThan, OpGreaterThanOrEqual, OpIndex:
+		return 2, 1
+	case OpCompareJump:
+		return 2, 0
+	case OpSlice:
+		return 3, 1
+	case OpArray, OpHash:
+		return in.operands[0], 1
+	case OpDestructureArray:
+		return 1, in.operands[0]
+	case OpDestructureHash:
+		return in.operands[0] + 1, in.operands[0]
+	case OpCall:
+		return in.operands[0] + 1, 1
+	case OpClosure:
+		return in.operands[1], 1
+	default:
+		// OpJump, OpJumpArgPassed, OpReturn, OpTry and OpEndTry.
+		return 0, 0
+	}
+}
@@ -0,0 +1,274 @@
+package code
+
+import "testing"
+
+func concat(ins ...[]byte) Instructions {
+	out := Instructions{}
+	for _, in := range ins {
+		out = append(out, in...)
+	}
+	return out
+}
+
+func TestVerify(t *testing.T) {
+	function := func(numLocals int, ins ...[]byte) Constant {
+		return Constant{IsFunction: true, Instructions: concat(ins...), NumLocals: numLocals}
+	}
+	integer := Constant{}
+
+	valid := []struct {
+		ins       Instructions
+		constants []Constant
+	}{
+		{Instructions{}, nil},
+		{
+			concat(Make(OpClosure, 0, 0), Make(OpPop)),
+			[]Constant{function(1,
+				Make(OpJumpArgPassed, 0, 9), // 0000
+				Make(OpNull),                // 0004
+				Make(OpSetLocal, 0),         // 0005
+				Make(OpNull),                // 0007
+				Make(OpReturnValue),         // 0008
+				Make(OpReturn),              // 0009
+			)},
+		},
+		{concat(Make(OpConstant, 0), Make(OpPop)), []Constant{integer}},
+		{concat(Make(OpConstant, 0), Make(OpHalt)), []Constant{integer}},
+		{
+			// if (true) { 1 } else { 2 }, with the jump to the end.
+			concat(
+				Make(OpTrue),              // 0000
+				Make(OpJumpNotTruthy, 10), // 0001
+				Make(OpConstant, 0),       // 0004
+				Make(OpJump, 13),          // 0007
+				Make(OpConstant, 0),       // 0010
+			),
+			[]Constant{integer},
+		},
+		{
+			concat(Make(OpConstant, 0), Make(OpClosure, 1, 1), Make(OpPop)),
+			[]Constant{integer, function(1,
+				Make(OpGetFree, 0),
+				Make(OpGetLocalAdd, 0),
+				Make(OpReturnValue),
+			)},
+		},
+		{
+			// fn() { let a = 1; let f = fn() { a = 1; fn() { a } }; a = 1; a }
+			Make(OpClosure, 3, 0),
+			[]Constant{integer, function(0,
+				Make(OpGetFree, 0),
+				Make(OpReturnValue),
+			), function(0,
+				Make(OpConstant, 0),
+				Make(OpSetFree, 0),
+				Make(OpCaptureFree, 0),
+				Make(OpClosure, 1, 1),
+				Make(OpReturnValue),
+			), function(2,
+				Make(OpConstant, 0),
+				Make(OpSetLocal, 0),
+				Make(OpCaptureLocal, 0),
+				Make(OpClosure, 2, 1),
+				Make(OpSetLocal, 1),
+				Make(OpConstant, 0),
+				Make(OpAssignLocal, 0),
+				Make(OpGetLocal, 0),
+				Make(OpReturnValue),
+			)},
+		},
+		{
+			// while (i > 0) { }, in a function.
+			Make(OpClosure, 0, 0),
+			[]Constant{function(1,
+				Make(OpGetLocal, 0),                         // 0000
+				Make(OpConstant, 1),                         // 0002
+				Make(OpCompareJump, int(OpGreaterThan), 12), // 0005
+				Make(OpJump, 0),                             // 0009
+				Make(OpReturn),                              // 0012
+			), integer},
+		},
+		{
+			// try { 1 } catch { 2 }, with the exception popped.
+			concat(
+				Make(OpTry, 11, 1),  // 0000
+				Make(OpConstant, 0), // 0004
+				Make(OpEndTry),      // 0007
+				Make(OpJump, 15),    // 0008
+				Make(OpPop),         // 0011
+				Make(OpConstant, 0), // 0012
+				Make(OpPop),         // 0015
+			),
+			[]Constant{integer},
+		},
+	}
+
+	for _, test := range valid {
+		if err := Verify(test.ins, test.constants, 1); err != nil {
+			t.Errorf("error for valid instructions\n%s: %s", test.ins, err)
+		}
+	}
+
+	invalid := []struct {
+		ins       Instructions
+		constants []Constant
+		expected  string
+	}{
+		{
+			Instructions{255},
+			nil,
+			"main: 0000: opcode 255 undefined",
+		},
+		{
+			Make(OpConstant, 0)[:2],
+			[]Constant{integer},
+			"main: 0000: OpConstant is missing operands",
+		},
+		{
+			concat(Make(OpTrue), Make(OpJump, 2)),
+			nil,
+			"main: 0001: OpJump: jump to 0002, which is not an instruction",
+		},
+		{
+			Make(OpJump, 100),
+			nil,
+			"main: 0000: OpJump: jump to 0100, which is not an instruction",
+		},
+		{
+			concat(Make(OpConstant, 1), Make(OpPop)),
+			[]Constant{integer},
+			"main: 0000: OpConstant: constant 1 out of range, have 1",
+		},
+		{
+			concat(Make(OpClosure, 0, 0), Make(OpPop)),
+			[]Constant{integer},
+			"main: 0000: OpClosure: constant 0 is not a function",
+		},
+		{
+			concat(Make(OpGetLocal, 0), Make(OpPop)),
+			nil,
+			"main: 0000: OpGetLocal: local 0 out of range, have 0",
+		},
+		{
+			concat(Make(OpGetBuiltin, 1), Make(OpPop)),
+			nil,
+			"main: 0000: OpGetBuiltin: builtin 1 out of range, have 1",
+		},
+		{
+			concat(Make(OpTrue), Make(OpTrue), Make(OpCompareJump, int(OpAdd), 0)),
+			nil,
+			"main: 0002: OpCompareJump: opcode 1 is not a comparison",
+		},
+		{
+			Make(OpPop),
+			nil,
+			"main: 0000: OpPop pops 1 values, but the stack holds 0",
+		},
+		{
+			concat(
+				Make(OpTrue),             // 0000
+				Make(OpJumpNotTruthy, 5), // 0001
+				Make(OpTrue),             // 0004
+				Make(OpPop),              // 0005
+			),
+			nil,
+			"main: 0005: stack height is 1 from 0004, but 0 from elsewhere",
+		},
+		{
+			Make(OpClosure, 0, 0),
+			[]Constant{function(0, Make(OpNull))},
+			"constant 0: 0000: function can end without returning",
+		},
+		{
+			concat(Make(OpNull), Make(OpClosure, 0, 1)),
+			[]Constant{function(0, Make(OpGetFree, 1), Make(OpReturnValue))},
+			"constant 0: 0000: OpGetFree: free variable 1 out of range, have 1",
+		},
+		{
+			concat(Make(OpNull), Make(OpClosure, 0, 1)),
+			[]Constant{function(0, Make(OpNull), Make(OpSetFree, 1), Make(OpReturn))},
+			"constant 0: 0001: OpSetFree: free variable 1 out of range, have 1",
+		},
+		{
+			nil,
+			[]Constant{{IsFunction: true, NumParameters: 2, NumLocals: 1}},
+			"constant 0: 2 parameters, but only 1 locals",
+		},
+		{
+			nil,
+			[]Constant{{IsFunction: true, NumParameters: 1, Variadic: true, NumLocals: 1}},
+			"constant 0: 2 parameters, but only 1 locals",
+		},
+		{
+			nil,
+			[]Constant{{IsFunction: true, NumParameters: 1, NumDefaults: 2, NumLocals: 1}},
+			"constant 0: 2 default values, but only 1 parameters",
+		},
+		{
+			concat(Make(OpNull), Make(OpClosure, 0, 0), Make(OpPop)),
+			[]Constant{function(1, Make(OpJumpArgPassed, 1, 0), Make(OpReturn))},
+			"constant 0: 0000: OpJumpArgPassed: local 1 out of range, have 1",
+		},
+		{
+			Make(OpEndTry),
+			nil,
+			"main: 0000: OpEndTry without a handler installed",
+		},
+		{
+			concat(Make(OpClosure, 0, 0), Make(OpPop)),
+			[]Constant{function(0, Make(OpNull), Make(OpHalt))},
+			"constant 0: 0001: OpHalt in a function",
+		},
+		{
+			concat(Make(OpConstant, 0), Make(OpReturnValue)),
+			[]Constant{integer},
+			"main: 0003: OpReturnValue outside a function",
+		},
+		{
+			concat(Make(OpTrue), Make(OpJumpNotTruthy, 5), Make(OpReturn)),
+			nil,
+			"main: 0004: OpReturn outside a function",
+		},
+		{
+			concat(Make(OpTry, 5, 2), Make(OpEndTry), Make(OpPop)),
+			nil,
+			"main: 0000: OpTry: catches is 2, not 0 or 1",
+		},
+		{
+			// The handler is reached with the exception pushed, which it
+			// has to pop.
+			concat(
+				Make(OpTry, 8, 1), // 0000
+				Make(OpEndTry),    // 0004
+				Make(OpJump, 8),   // 0005
+				Make(OpNull),      // 0008
+			),
+			nil,
+			"main: 0008: stack height is 0 from 0005, but 1 from elsewhere",
+		},
+		{
+			// The jump leaves the handler installed.
+			concat(
+				Make(OpTry, 8, 1), // 0000
+				Make(OpJump, 9),   // 0004
+				Make(OpEndTry),    // 0007
+				Make(OpPop),       // 0008
+				Make(OpNull),      // 0009
+				Make(OpPop),       // 0010
+			),
+			nil,
+			"main: 0009: 0 handlers are installed from 0008, but 1 from elsewhere",
+		},
+	}
+
+	for _, test := range invalid {
+		err := Verify(test.ins, test.constants, 1)
+		if err == nil {
+			t.Errorf("no error for invalid instructions, want %q", test.expected)
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Errorf("wrong error. want=%q, got=%q", test.expected, err)
+		}
+	}
+}
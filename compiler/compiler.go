@@ -4,8 +4,9 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/code"
+	"monkey/module"
 	"monkey/object"
-	"sort"
+	"monkey/token"
 )
 
 type EmittedInstruction struct {
@@ -17,19 +18,70 @@ type CompilationScope struct {
 	instructions        code.Instructions  // generated bytecode instructions
 	lastInstruction     EmittedInstruction // the very last instruction emitted
 	previousInstruction EmittedInstruction // instruction emitted before `lastInstruction`
+	sourceMap           code.SourceMap     // where in the source the instructions come from
+
+	// The handlers installed where the instructions being emitted run,
+	// innermost last: the finally block of each that runs one before
+	// rethrowing, and nil for each that catches.
+	handlers []*ast.BlockStatement
 }
 
 type Compiler struct {
 	constants []object.Object
+	interned  *object.InternTable // The strings among the constants.
+
+	// Where each integer and string constant is, so that it is only added
+	// once however often it appears.
+	constantIndexes map[object.HashKey]int
+
+	// Whether constant expressions are evaluated at compile time.
+	folding bool
+	// Whether finished instructions are rewritten by the peephole optimizer.
+	peephole bool
+	// Whether common pairs of instructions are fused into superinstructions.
+	superinstructions bool
 
 	symbolTable *SymbolTable
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	// The directory imported files are relative to.
+	importDir string
+	// The capabilities denied to the program, which importing a module
+	// may need.
+	denied map[object.Capability]bool
+	// Where the function running each imported module is among the
+	// constants, by key, so that each module is only compiled once.
+	modules map[string]int
+	// The keys of the modules being compiled, to catch import cycles.
+	importing map[string]bool
+	// The scope of the top level of the module being compiled, or -1.
+	moduleScope int
+	// The key of the module being compiled, or "" for the program.
+	moduleKey string
+
+	// The identifiers found not to be defined so far, which Compile reports
+	// together once it has compiled the whole node it was given.
+	undefined []UndefinedIdentifier
+	// The first operand found too large for the bytes it has in its
+	// instruction, which Compile reports once it has compiled the node it
+	// was given, rather than let it wrap around.
+	tooLarge error
+	// How deeply calls of Compile are nested.
+	depth int
+	// The names assigned to anywhere in the code being compiled, whose
+	// values can't be known from how they are declared.
+	assigned map[string]bool
+
+	// Where the node being compiled starts in the source, which the
+	// instructions emitted for it are mapped to.
+	line, column int
 }
 
 type Bytecode struct {
 	Instructions code.Instructions
+	SourceMap    code.SourceMap // Of the main program's instructions.
 	Constants    []object.Object
 }
 
@@ -46,10 +98,21 @@ func New() *Compiler {
 	}
 
 	return &Compiler{
-		constants:   []object.Object{},
-		symbolTable: SymbolTable,
-		scopes:      []CompilationScope{mainScope},
-		scopeIndex:  0,
+		constants: []object.Object{},
+		interned:  object.NewInternTable(),
+
+		constantIndexes: map[object.HashKey]int{},
+
+		modules:     map[string]int{},
+		importing:   map[string]bool{},
+		moduleScope: -1,
+
+		folding:           true,
+		peephole:          true,
+		superinstructions: true,
+		symbolTable:       SymbolTable,
+		scopes:            []CompilationScope{mainScope},
+		scopeIndex:        0,
 	}
 }
 
@@ -57,12 +120,69 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	compiler := New()
 	compiler.symbolTable = s
 	compiler.constants = constants
+	for i, constant := range constants {
+		if str, ok := constant.(*object.String); ok {
+			compiler.interned.Add(str)
+		}
+		if key, ok := constantKey(constant); ok {
+			if _, seen := compiler.constantIndexes[key]; !seen {
+				compiler.constantIndexes[key] = i
+			}
+		}
+	}
 	return compiler
 }
 
+// Turns constant folding on or off. It is on by default; turning it off
+// makes the bytecode follow the source more closely, for debugging.
+func (c *Compiler) SetFolding(enabled bool) {
+	c.folding = enabled
+}
+
+// Turns the peephole optimizer on or off. It is on by default.
+func (c *Compiler) SetPeephole(enabled bool) {
+	c.peephole = enabled
+}
+
+// Turns the selection of superinstructions on or off. It is on by default.
+func (c *Compiler) SetSuperinstructions(enabled bool) {
+	c.superinstructions = enabled
+}
+
+// Sets the directory that the files the program imports are relative to.
+// It is the working directory by default.
+func (c *Compiler) SetImportDir(dir string) {
+	c.importDir = dir
+}
+
+// Denies a capability to the program, so that modules needing it can't be
+// imported. The VM that runs the bytecode is told separately.
+func (c *Compiler) Deny(capability object.Capability) {
+	if c.denied == nil {
+		c.denied = make(map[object.Capability]bool)
+	}
+	c.denied[capability] = true
+}
+
+// Returns the table the compiler interns string literals in, so that each
+// distinct string is a single object however often it appears.
+func (c *Compiler) InternTable() *object.InternTable {
+	return c.interned
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
+	instructions := c.currentInstructions()
+	sourceMap := c.scopes[c.scopeIndex].sourceMap
+	if c.peephole {
+		instructions, sourceMap = peepholeOptimize(instructions, sourceMap, true)
+	}
+	if c.superinstructions {
+		instructions, sourceMap = selectSuperinstructions(instructions, sourceMap)
+	}
+
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: instructions,
+		SourceMap:    sourceMap,
 		Constants:    c.constants,
 	}
 }
@@ -79,6 +199,10 @@ func (c *Compiler) loadSymbol(s Symbol) error {
 		c.emit(code.OpGetLocal, s.Index)
 	case BuiltinScope:
 		c.emit(code.OpGetBuiltin, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
 	default:
 		return fmt.Errorf("unknown symbol scope: %s", s.Scope)
 	}
@@ -98,34 +222,57 @@ func (c *Compiler) enterScope() {
 	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
 }
 
-func (c *Compiler) leaveScope() code.Instructions {
+func (c *Compiler) leaveScope() (code.Instructions, code.SourceMap) {
 	prevInstructions := c.currentInstructions()
+	prevSourceMap := c.scopes[c.scopeIndex].sourceMap
 
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIndex--
 
 	c.symbolTable = c.symbolTable.Outer
 
-	return prevInstructions
+	return prevInstructions, prevSourceMap
 }
 
+// Compiles node into the instructions of the current scope. If identifiers
+// in it aren't defined, compiling carries on past them, and the error
+// returned is an *UndefinedError that lists all of them.
 func (c *Compiler) Compile(node ast.Node) error {
+	if c.depth == 0 {
+		c.undefined = nil
+		c.tooLarge = nil
+		c.assigned = assignedNames(node)
+	}
+	c.depth++
+	err := c.compile(node)
+	c.depth--
+
+	if err == nil && c.depth == 0 && c.tooLarge != nil {
+		return c.tooLarge
+	}
+	if err == nil && c.depth == 0 && len(c.undefined) > 0 {
+		return &UndefinedError{Identifiers: c.undefined}
+	}
+	return err
+}
+
+func (c *Compiler) compile(node ast.Node) error {
+	if pos, ok := nodeToken(node); ok && pos.Line > 0 {
+		line, column := c.line, c.column
+		c.line, c.column = pos.Line, pos.Column
+		defer func() { c.line, c.column = line, column }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
-		for _, s := range node.Statements {
-			err := c.Compile(s)
-			if err != nil {
-				return err
-			}
-		}
+		return c.compileStatements(node.Statements)
 
 	case *ast.BlockStatement:
-		for _, s := range node.Statements {
-			err := c.Compile(s)
-			if err != nil {
-				return err
-			}
-		}
+		// The names a block defines are only visible within it.
+		c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+		err := c.compileStatements(node.Statements)
+		c.symbolTable = c.symbolTable.Outer
+		return err
 
 	case *ast.LetStatement:
 		err := c.Compile(node.Value)
@@ -133,20 +280,76 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 
-		symbol := c.symbolTable.Define(node.Name.Value)
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
+		symbol := c.define(node.Name.Value, node.IsConst())
+		if fn, ok := node.Value.(*ast.FunctionLiteral); ok && (node.IsConst() || !c.assigned[node.Name.Value]) {
+			symbol = c.symbolTable.setArity(node.Name.Value, functionArity(fn))
+		}
+		c.storeSymbol(symbol)
+
+	case *ast.DestructuringLetStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		if node.Hash {
+			for _, key := range node.Keys {
+				err := c.Compile(key)
+				if err != nil {
+					return err
+				}
+			}
+			c.emit(code.OpDestructureHash, len(node.Keys))
 		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
+			c.emit(code.OpDestructureArray, len(node.Names))
 		}
 
+		symbols := make([]Symbol, len(node.Names))
+		for i, name := range node.Names {
+			symbols[i] = c.define(name.Value, node.IsConst())
+		}
+
+		// The last name's value is on top of the stack.
+		for i := len(symbols) - 1; i >= 0; i-- {
+			c.storeSymbol(symbols[i])
+		}
+
+	case *ast.ImportStatement:
+		err := c.compileImport(node.Path)
+		if err != nil {
+			return err
+		}
+
+		symbol := c.define(node.Name.Value, false)
+		c.storeSymbol(symbol)
+
 	case *ast.ReturnStatement:
+		if c.scopeIndex == c.moduleScope {
+			return fmt.Errorf("cannot return from the top level of a module")
+		}
+
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
 
-		c.emit(code.OpReturnValue)
+		if err := c.removeHandlers(); err != nil {
+			return err
+		}
+		// Returning from the main program ends it, with the value as its
+		// result, as it does on the evaluator.
+		if c.scopeIndex == 0 {
+			c.emit(code.OpHalt)
+		} else {
+			c.emit(code.OpReturnValue)
+		}
+
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
 
 	case *ast.ExpressionStatement:
 		err := c.Compile(node.Expression)
@@ -156,6 +359,13 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpPop)
 
 	case *ast.PrefixExpression:
+		if c.folding {
+			if obj, ok := foldConstant(node); ok {
+				c.emitConstant(obj)
+				return nil
+			}
+		}
+
 		err := c.Compile(node.Right)
 		if err != nil {
 			return err
@@ -171,8 +381,19 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.InfixExpression:
-		// Reorder operands for for "<" so that we don't need a separate opcode for it.
-		if node.Operator == "<" {
+		if c.folding {
+			if obj, ok := foldConstant(node); ok {
+				c.emitConstant(obj)
+				return nil
+			}
+		}
+
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
+		}
+
+		// Reorder operands for for "<" and "<=" so that we don't need separate opcodes for them.
+		if node.Operator == "<" || node.Operator == "<=" {
 			err := c.Compile(node.Right)
 			if err != nil {
 				return err
@@ -183,7 +404,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 
-			c.emit(code.OpGreaterThan)
+			if node.Operator == "<" {
+				c.emit(code.OpGreaterThan)
+			} else {
+				c.emit(code.OpGreaterThanOrEqual)
+			}
 			return nil
 		}
 
@@ -206,8 +431,24 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
+		case "**":
+			c.emit(code.OpPow)
+		case "&":
+			c.emit(code.OpBitAnd)
+		case "|":
+			c.emit(code.OpBitOr)
+		case "^":
+			c.emit(code.OpBitXor)
+		case "<<":
+			c.emit(code.OpShiftLeft)
+		case ">>":
+			c.emit(code.OpShiftRight)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case ">=":
+			c.emit(code.OpGreaterThanOrEqual)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
@@ -217,6 +458,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.IfExpression:
+		if c.folding {
+			if condition, ok := foldConstant(node.Condition); ok {
+				return c.compileConstantIf(node, object.IsTruthy(condition))
+			}
+		}
+
 		err := c.Compile(node.Condition)
 		if err != nil {
 			return err
@@ -230,12 +477,14 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
+		c.keepBlockValue()
 
-		// Emit an `OpJump` with a placeholder value.
-		jumpPos := c.emit(code.OpJump, 9999)
+		// Emit an `OpJump` with a placeholder value, unless the consequence
+		// returned or threw, so that the jump could never be reached.
+		jumpPos := -1
+		if !c.lastInstructionLeaves() {
+			jumpPos = c.emit(code.OpJump, 9999)
+		}
 
 		afterConsequencePos := len(c.currentInstructions())
 		c.changeInstructionOperand(jumpNotTruthyPos, afterConsequencePos)
@@ -248,18 +497,132 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
+			c.keepBlockValue()
+		}
+
+		if jumpPos != -1 {
+			afterAlternativePos := len(c.currentInstructions())
+			c.changeInstructionOperand(jumpPos, afterAlternativePos)
+		}
+
+	case *ast.ConditionalExpression:
+		if c.folding {
+			if condition, ok := foldConstant(node.Condition); ok {
+				return c.compileConstantConditional(node, object.IsTruthy(condition))
+			}
+		}
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		err = c.Compile(node.Consequence)
+		if err != nil {
+			return err
+		}
+
+		jumpPos := c.emit(code.OpJump, 9999)
+		c.changeInstructionOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+
+		err = c.Compile(node.Alternative)
+		if err != nil {
+			return err
+		}
+
+		c.changeInstructionOperand(jumpPos, len(c.currentInstructions()))
+
+	case *ast.WhileExpression:
+		if c.folding {
+			if condition, ok := foldConstant(node.Condition); ok && !object.IsTruthy(condition) {
+				if err := c.compileUnreachable(node.Body); err != nil {
+					return err
+				}
+				c.emit(code.OpNull)
+				return nil
 			}
 		}
 
-		afterAlternativePos := len(c.currentInstructions())
-		c.changeInstructionOperand(jumpPos, afterAlternativePos)
+		loopStartPos := len(c.currentInstructions())
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		// Emit an `OpJumpNotTruthy` with a placeholder value.
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		// The body's expression statements pop their own values, so nothing
+		// is left on the stack between iterations.
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpJump, loopStartPos)
+
+		afterBodyPos := len(c.currentInstructions())
+		c.changeInstructionOperand(jumpNotTruthyPos, afterBodyPos)
+
+		// A while loop always evaluates to null.
+		c.emit(code.OpNull)
+
+	case *ast.TryExpression:
+		if node.Finally != nil {
+			return c.compileTryFinally(node)
+		}
+		return c.compileTryCatch(node)
+
+	case *ast.AssignExpression:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		symbol, ok := c.symbolTable.Resolve(node.Name.Value)
+		if !ok {
+			// The value is left as the value of the assignment.
+			c.undefinedIdentifier(node.Name, true)
+			return nil
+		}
+		if symbol.Const {
+			return fmt.Errorf("cannot assign to constant: %s", node.Name.Value)
+		}
+		// Whatever function the variable held, it may hold another now, as
+		// in the REPL, where later lines aren't known in advance.
+		c.symbolTable.forgetArity(node.Name.Value)
+
+		// Store the value, then load it again since an assignment is an
+		// expression that evaluates to the assigned value.
+		switch {
+		case symbol.Scope == GlobalScope && symbol.Block:
+			c.emit(code.OpAssignGlobal, symbol.Index)
+		case symbol.Scope == GlobalScope:
+			c.emit(code.OpSetGlobal, symbol.Index)
+		case symbol.Scope == LocalScope:
+			c.emit(code.OpAssignLocal, symbol.Index)
+		case symbol.Scope == BuiltinScope:
+			return fmt.Errorf("cannot assign to builtin: %s", node.Name.Value)
+		case symbol.Scope == FunctionScope || c.symbolTable.capturesFunctionName(symbol):
+			return fmt.Errorf("cannot assign to function name: %s", node.Name.Value)
+		default:
+			c.emit(code.OpSetFree, symbol.Index)
+		}
+
+		err = c.loadSymbol(symbol)
+		if err != nil {
+			return err
+		}
 
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+			c.undefinedIdentifier(node, false)
+			c.emit(code.OpNull)
+			return nil
 		}
 
 		err := c.loadSymbol(symbol)
@@ -267,7 +630,21 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 
+	case *ast.MacroLiteral:
+		return fmt.Errorf("macros can only be defined by let statements at the top level")
+
 	case *ast.CallExpression:
+		// Macros are expanded before programs are compiled, so what is left
+		// of quoting is outside of them, where only the evaluator allows it.
+		if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "quote" {
+			if _, ok := c.symbolTable.Resolve(ident.Value); !ok {
+				return fmt.Errorf("quote can only be used in macros on the vm")
+			}
+		}
+		if err := c.checkArity(node); err != nil {
+			return err
+		}
+
 		err := c.Compile(node.Function)
 		if err != nil {
 			return err
@@ -295,6 +672,36 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpIndex)
 
+	case *ast.MemberExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+
+		c.emitConstant(&object.String{Value: node.Member.Value})
+
+		c.emit(code.OpIndex)
+
+	case *ast.SliceExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+
+		for _, bound := range []ast.Expression{node.Start, node.End} {
+			if bound == nil {
+				c.emit(code.OpNull)
+				continue
+			}
+
+			err = c.Compile(bound)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpSlice)
+
 	case *ast.ArrayLiteral:
 		for _, el := range node.Elements {
 			err := c.Compile(el)
@@ -305,17 +712,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpArray, len(node.Elements))
 
 	case *ast.HashLiteral:
-		keys := []ast.Expression{}
-		for k := range node.Pairs {
-			keys = append(keys, k)
-		}
 		// Golang does not gurantee a consistent ordering when iterating through a map.
 		// Therefore, sort them so that consistency is ensured (for testing purposes).
-		sort.Slice(keys, func(i, j int) bool {
-			return keys[i].String() < keys[j].String()
-		})
-
-		for _, k := range keys {
+		for _, k := range ast.SortedKeys(node) {
 			err := c.Compile(k)
 			if err != nil {
 				return err
@@ -332,11 +731,39 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.FunctionLiteral:
 		c.enterScope()
 
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+			if !c.assigned[node.Name] {
+				c.symbolTable.setArity(node.Name, functionArity(node))
+			}
+		}
+
 		for _, p := range node.Parameters {
 			c.symbolTable.Define(p.Value)
 		}
+		if node.Rest != nil {
+			c.symbolTable.Define(node.Rest.Value)
+		}
 
-		err := c.Compile(node.Body)
+		// Parameters left without an argument are set to their default
+		// values before the body runs.
+		firstDefault := len(node.Parameters) - len(node.Defaults)
+		for i, def := range node.Defaults {
+			param := firstDefault + i
+			jumpPos := c.emit(code.OpJumpArgPassed, param, 9999)
+
+			err := c.Compile(def)
+			if err != nil {
+				return err
+			}
+			c.emit(code.OpSetLocal, param)
+
+			afterDefaultPos := len(c.currentInstructions())
+			c.replaceInstruction(jumpPos, c.makeInstruction(code.OpJumpArgPassed, param, afterDefaultPos))
+		}
+
+		// The body shares the function's scope with the parameters.
+		err := c.compileStatements(node.Body.Statements)
 		if err != nil {
 			return err
 		}
@@ -344,26 +771,55 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if c.lastInstructionIs(code.OpPop) {
 			c.replaceLastPopWithReturn()
 		}
-		if !c.lastInstructionIs(code.OpReturnValue) {
+		if !c.lastInstructionIs(code.OpReturnValue) && !c.lastInstructionIs(code.OpThrow) {
 			c.emit(code.OpReturn)
 		}
 
+		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
+		localNames := c.symbolTable.Names()
+		instructions, sourceMap := c.leaveScope()
+		if c.peephole {
+			instructions, sourceMap = peepholeOptimize(instructions, sourceMap, false)
+		}
+		if c.superinstructions {
+			instructions, sourceMap = selectSuperinstructions(instructions, sourceMap)
+		}
+
+		// Push what is captured so OpClosure can move it into the closure.
+		for _, s := range freeSymbols {
+			err := c.captureSymbol(s)
+			if err != nil {
+				return err
+			}
+		}
 
 		compiledFn := &object.CompiledFunction{
 			Instructions:  instructions,
+			SourceMap:     sourceMap,
 			NumParameters: len(node.Parameters),
+			NumDefaults:   len(node.Defaults),
+			Variadic:      node.Rest != nil,
 			NumLocals:     numLocals,
+			Name:          node.Name,
+			Literal:       node,
+			LocalNames:    localNames,
+			Module:        c.moduleKey,
+		}
+		for _, s := range freeSymbols {
+			compiledFn.FreeNames = append(compiledFn.FreeNames, s.Name)
 		}
 
 		fnIdx := c.addConstant(compiledFn)
-		c.emit(code.OpClosure, fnIdx, 0)
+		c.emit(code.OpClosure, fnIdx, len(freeSymbols))
 
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
-		constIdx := c.addConstant(integer)
-		c.emit(code.OpConstant, constIdx)
+		c.emitConstant(integer)
+
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emitConstant(float)
 
 	case *ast.Boolean:
 		if node.Value {
@@ -372,21 +828,390 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpFalse)
 		}
 
+	case *ast.NullLiteral:
+		c.emit(code.OpNull)
+
 	case *ast.StringLiteral:
-		str := &object.String{Value: node.Value}
-		c.emit(code.OpConstant, c.addConstant(str))
+		c.emitConstant(c.interned.Intern(node.Value))
 	}
 
 	return nil
 }
 
+// Fails if node calls a function by a name that is only ever bound to it,
+// or a builtin, with a number of arguments the function doesn't take.
+func (c *Compiler) checkArity(node *ast.CallExpression) error {
+	ident, ok := node.Function.(*ast.Identifier)
+	if !ok {
+		return nil
+	}
+	symbol, ok := c.symbolTable.Resolve(ident.Value)
+	if !ok {
+		return nil
+	}
+
+	arity, builtin := symbol.Arity, false
+	if symbol.Scope == BuiltinScope {
+		arity, builtin = object.Builtins[symbol.Index].Builtin.Arity, true
+	}
+	if arity == nil || arity.Allows(len(node.Arguments)) {
+		return nil
+	}
+	return &ArityError{
+		Function: ident.Value,
+		Builtin:  builtin,
+		Want:     *arity,
+		Got:      len(node.Arguments),
+		Line:     ident.Token.Line,
+		Column:   ident.Token.Column,
+		Module:   c.moduleKey,
+	}
+}
+
+// Returns how many arguments fn takes.
+func functionArity(fn *ast.FunctionLiteral) *object.Arity {
+	arity := &object.Arity{Min: len(fn.Parameters) - len(fn.Defaults), Max: len(fn.Parameters)}
+	if fn.Rest != nil {
+		arity.Max = -1
+	}
+	return arity
+}
+
+// Returns the names node assigns to anywhere within it.
+func assignedNames(node ast.Node) map[string]bool {
+	names := map[string]bool{}
+	ast.Inspect(node, func(node ast.Node) bool {
+		if assign, ok := node.(*ast.AssignExpression); ok && assign.Name != nil {
+			names[assign.Name.Value] = true
+		}
+		return true
+	})
+	return names
+}
+
+// Records that ident isn't defined, so that compiling can carry on and find
+// any others. The bytecode is never run, as Compile fails.
+func (c *Compiler) undefinedIdentifier(ident *ast.Identifier, assigned bool) {
+	c.undefined = append(c.undefined, UndefinedIdentifier{
+		Name:     ident.Value,
+		Line:     ident.Token.Line,
+		Column:   ident.Token.Column,
+		Assigned: assigned,
+		Module:   c.moduleKey,
+	})
+}
+
+// Leaves the top-level bindings of a module on the stack, as a hash. The
+// module runs the first time one of its imports does, and its bindings are
+// kept in a global for the imports after.
+func (c *Compiler) compileImport(path string) error {
+	key, err := module.Resolve(path, c.importDir)
+	if err != nil {
+		return err
+	}
+	if c.importing[key] {
+		return fmt.Errorf("import cycle: %q imports itself", path)
+	}
+	err = module.RequireCapability(key, func(capability object.Capability) bool { return !c.denied[capability] })
+	if err != nil {
+		return err
+	}
+
+	fnIdx, ok := c.modules[key]
+	if !ok {
+		fnIdx, err = c.compileModule(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	cache := c.symbolTable.DefineModule(key)
+
+	c.emit(code.OpGetGlobal, cache.Index)
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+	c.emit(code.OpGetGlobal, cache.Index)
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	c.changeInstructionOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+	c.emit(code.OpClosure, fnIdx, 0)
+	c.emit(code.OpCall, 0)
+	c.emit(code.OpSetGlobal, cache.Index)
+	c.emit(code.OpGetGlobal, cache.Index)
+
+	c.changeInstructionOperand(jumpPos, len(c.currentInstructions()))
+	return nil
+}
+
+// Compiles a module into a function that runs it and returns its top-level
+// bindings as a hash. The bindings are globals, numbered among those of the
+// program, so that the module's functions can refer to them as the
+// program's functions refer to its globals.
+func (c *Compiler) compileModule(key string) (int, error) {
+	mod, err := module.Load(key)
+	if err != nil {
+		return 0, err
+	}
+
+	c.importing[key] = true
+	defer delete(c.importing, key)
+
+	importDir, moduleScope, moduleKey := c.importDir, c.moduleScope, c.moduleKey
+	defer func() { c.importDir, c.moduleScope, c.moduleKey = importDir, moduleScope, moduleKey }()
+
+	importer := c.symbolTable
+	c.enterScope()
+	c.symbolTable = NewModuleSymbolTable(importer)
+	c.importDir, c.moduleScope, c.moduleKey = mod.Dir, c.scopeIndex, key
+	assigned := c.assigned
+	defer func() { c.assigned = assigned }()
+	c.assigned = assignedNames(mod.Program)
+
+	err = c.compileStatements(mod.Program.Statements)
+	if err != nil {
+		return 0, err
+	}
+
+	exports := 0
+	for _, symbol := range c.symbolTable.Symbols() {
+		if symbol.Scope != GlobalScope {
+			continue
+		}
+		c.emitConstant(&object.String{Value: symbol.Name})
+		c.emit(code.OpGetGlobal, symbol.Index)
+		exports++
+	}
+	c.emit(code.OpHash, exports*2)
+	c.emit(code.OpReturnValue)
+
+	instructions, sourceMap := c.leaveScope()
+	c.symbolTable = importer
+	if c.peephole {
+		instructions, sourceMap = peepholeOptimize(instructions, sourceMap, false)
+	}
+	if c.superinstructions {
+		instructions, sourceMap = selectSuperinstructions(instructions, sourceMap)
+	}
+
+	fnIdx := c.addConstant(&object.CompiledFunction{
+		Instructions: instructions,
+		SourceMap:    sourceMap,
+		Name:         key,
+		Module:       key,
+	})
+	c.modules[key] = fnIdx
+	return fnIdx, nil
+}
+
+// Compiles `&&` and `||` with conditional jumps so the right operand is only
+// evaluated when needed. Both operators produce a boolean:
+//
+//	a && b  =>  if (a) { !!b } else { false }
+//	a || b  =>  if (a) { true } else { !!b }
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	// Emit an `OpJumpNotTruthy` with a placeholder value.
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	if node.Operator == "&&" {
+		err = c.compileTruthiness(node.Right)
+		if err != nil {
+			return err
+		}
+	} else {
+		c.emit(code.OpTrue)
+	}
+
+	// Emit an `OpJump` with a placeholder value.
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	afterLeftTruthyPos := len(c.currentInstructions())
+	c.changeInstructionOperand(jumpNotTruthyPos, afterLeftTruthyPos)
+
+	if node.Operator == "&&" {
+		c.emit(code.OpFalse)
+	} else {
+		err = c.compileTruthiness(node.Right)
+		if err != nil {
+			return err
+		}
+	}
+
+	afterRightPos := len(c.currentInstructions())
+	c.changeInstructionOperand(jumpPos, afterRightPos)
+
+	return nil
+}
+
+// Compiles an expression and converts its value into a boolean.
+func (c *Compiler) compileTruthiness(node ast.Expression) error {
+	err := c.Compile(node)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpBang)
+	c.emit(code.OpBang)
+
+	return nil
+}
+
+// Emits the instruction that pushes a value known at compile time.
+func (c *Compiler) emitConstant(obj object.Object) {
+	switch constant := obj.(type) {
+	case *object.Boolean:
+		if constant.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+	case *object.NULL:
+		c.emit(code.OpNull)
+	case *object.String:
+		c.emit(code.OpConstant, c.addConstant(c.interned.Intern(constant.Value)))
+	default:
+		c.emit(code.OpConstant, c.addConstant(obj))
+	}
+}
+
+// Adds obj to the constants and returns its index, or the index of an equal
+// integer or string added before.
 func (c *Compiler) addConstant(obj object.Object) int {
+	key, dedup := constantKey(obj)
+	if dedup {
+		if idx, ok := c.constantIndexes[key]; ok {
+			return idx
+		}
+	}
+
 	c.constants = append(c.constants, obj)
-	return len(c.constants) - 1
+	idx := len(c.constants) - 1
+	if dedup {
+		c.constantIndexes[key] = idx
+	}
+	return idx
+}
+
+// Returns the key that identifies an integer or string constant by its
+// value. Other constants, such as functions, are never shared.
+func constantKey(obj object.Object) (object.HashKey, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return obj.HashKey(), true
+	case *object.String:
+		return obj.HashKey(), true
+	default:
+		return object.HashKey{}, false
+	}
+}
+
+// Defines a variable, or a constant, in the current scope.
+func (c *Compiler) define(name string, isConst bool) Symbol {
+	if isConst {
+		return c.symbolTable.DefineConst(name)
+	}
+	return c.symbolTable.Define(name)
+}
+
+// Pushes what a closure captures of a variable of the current scope: the
+// cell that every function referring to a local or free variable shares, or
+// the closure itself for the name of the function being compiled.
+func (c *Compiler) captureSymbol(s Symbol) error {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpCaptureGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpCaptureLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, s.Index)
+	default:
+		return c.loadSymbol(s)
+	}
+	return nil
+}
+
+// Pops the value on top of the stack into a variable of the current scope.
+func (c *Compiler) storeSymbol(symbol Symbol) {
+	if symbol.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, symbol.Index)
+	} else {
+		c.emit(code.OpSetLocal, symbol.Index)
+	}
+}
+
+// Returns the token that stands for a node in the source, such as an infix
+// expression's operator or a call's parenthesis, which is where the
+// instructions compiled from the node are mapped to. Programs have none.
+func nodeToken(node ast.Node) (token.Token, bool) {
+	switch node := node.(type) {
+	case *ast.Identifier:
+		return node.Token, true
+	case *ast.LetStatement:
+		return node.Token, true
+	case *ast.DestructuringLetStatement:
+		return node.Token, true
+	case *ast.ImportStatement:
+		return node.Token, true
+	case *ast.AssignExpression:
+		return node.Token, true
+	case *ast.ReturnStatement:
+		return node.Token, true
+	case *ast.ExpressionStatement:
+		return node.Token, true
+	case *ast.BlockStatement:
+		return node.Token, true
+	case *ast.IfExpression:
+		return node.Token, true
+	case *ast.ConditionalExpression:
+		return node.Token, true
+	case *ast.WhileExpression:
+		return node.Token, true
+	case *ast.TryExpression:
+		return node.Token, true
+	case *ast.ThrowStatement:
+		return node.Token, true
+	case *ast.InfixExpression:
+		return node.Token, true
+	case *ast.PrefixExpression:
+		return node.Token, true
+	case *ast.IntegerLiteral:
+		return node.Token, true
+	case *ast.FloatLiteral:
+		return node.Token, true
+	case *ast.StringLiteral:
+		return node.Token, true
+	case *ast.Boolean:
+		return node.Token, true
+	case *ast.NullLiteral:
+		return node.Token, true
+	case *ast.ArrayLiteral:
+		return node.Token, true
+	case *ast.IndexExpression:
+		return node.Token, true
+	case *ast.MemberExpression:
+		return node.Token, true
+	case *ast.SliceExpression:
+		return node.Token, true
+	case *ast.FunctionLiteral:
+		return node.Token, true
+	case *ast.CallExpression:
+		return node.Token, true
+	case *ast.MacroLiteral:
+		return node.Token, true
+	case *ast.HashLiteral:
+		return node.Token, true
+	default:
+		return token.Token{}, false
+	}
 }
 
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
-	ins := code.Make(op, operands...)
+	ins := c.makeInstruction(op, operands...)
+	scope := &c.scopes[c.scopeIndex]
+	scope.sourceMap = scope.sourceMap.Add(len(scope.instructions), c.line, c.column)
 	pos := c.addInstruction(ins)
 
 	c.setLastInstruction(op, pos)
@@ -394,6 +1219,55 @@ func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	return pos
 }
 
+// Makes an instruction like code.Make, recording an error for the first
+// operand that doesn't fit in the bytes the instruction has for it.
+func (c *Compiler) makeInstruction(op code.Opcode, operands ...int) []byte {
+	if def, err := code.Lookup(byte(op)); err == nil && c.tooLarge == nil {
+		for i, width := range def.OperandWidths {
+			if limit := 1 << (8 * width); i < len(operands) && operands[i] >= limit {
+				c.tooLarge = operandError(op, i, limit)
+				break
+			}
+		}
+	}
+	return code.Make(op, operands...)
+}
+
+// Returns the error for operand i of op being too large for an instruction
+// that can only hold operands below limit.
+func operandError(op code.Opcode, i, limit int) error {
+	switch {
+	case op == code.OpConstant, op == code.OpConstantAdd, op == code.OpConstantSub,
+		op == code.OpClosure && i == 0:
+		return fmt.Errorf("too many constants: a program can have at most %d", limit)
+	case op == code.OpGetGlobal, op == code.OpSetGlobal, op == code.OpAssignGlobal,
+		op == code.OpCaptureGlobal:
+		return fmt.Errorf("too many globals: a program can have at most %d", limit)
+	case op == code.OpGetLocal, op == code.OpSetLocal, op == code.OpAssignLocal,
+		op == code.OpCaptureLocal, op == code.OpGetLocalAdd, op == code.OpJumpArgPassed && i == 0:
+		return fmt.Errorf("too many local variables: a function can have at most %d", limit)
+	case op == code.OpGetFree, op == code.OpSetFree, op == code.OpCaptureFree,
+		op == code.OpClosure && i == 1:
+		return fmt.Errorf("too many free variables: a function can capture at most %d", limit)
+	case op == code.OpGetBuiltin:
+		return fmt.Errorf("too many builtins: there can be at most %d", limit)
+	case op == code.OpJump, op == code.OpJumpNotTruthy, op == code.OpJumpArgPassed,
+		op == code.OpTry, op == code.OpCompareJump:
+		return fmt.Errorf("too much code: jumps can only reach the first %d bytes of a function's instructions", limit)
+	case op == code.OpArray:
+		return fmt.Errorf("too many elements: an array literal can have at most %d", limit-1)
+	case op == code.OpHash:
+		return fmt.Errorf("too many pairs: a hash literal can have at most %d", (limit-1)/2)
+	case op == code.OpCall:
+		return fmt.Errorf("too many arguments: a call can pass at most %d", limit-1)
+	case op == code.OpDestructureArray, op == code.OpDestructureHash:
+		return fmt.Errorf("too many names: a destructuring let can bind at most %d", limit-1)
+	default:
+		def, _ := code.Lookup(byte(op))
+		return fmt.Errorf("operand %d of %s is too large: it must be below %d", i, def.Name, limit)
+	}
+}
+
 func (c *Compiler) addInstruction(ins []byte) int {
 	// posNewInstruction := len(c.instructions)
 	// c.instructions = append(c.instructions, ins...)
@@ -423,6 +1297,13 @@ func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
 	return c.scopes[c.scopeIndex].lastInstruction.OpCode == op
 }
 
+// Reports whether the last instruction returns, throws or halts, so that
+// execution never continues past it.
+func (c *Compiler) lastInstructionLeaves() bool {
+	return c.lastInstructionIs(code.OpReturnValue) || c.lastInstructionIs(code.OpThrow) ||
+		c.lastInstructionIs(code.OpHalt)
+}
+
 func (c *Compiler) removeLastPop() {
 	last := c.scopes[c.scopeIndex].lastInstruction
 	prev := c.scopes[c.scopeIndex].previousInstruction
@@ -431,9 +1312,227 @@ func (c *Compiler) removeLastPop() {
 	new := old[:last.Position]
 
 	c.scopes[c.scopeIndex].instructions = new
+	c.scopes[c.scopeIndex].sourceMap = c.scopes[c.scopeIndex].sourceMap.Truncate(last.Position)
 	c.scopes[c.scopeIndex].lastInstruction = prev
 }
 
+// Leaves the value of a just compiled block on the stack. Blocks that don't
+// end in an expression statement, such as empty ones, evaluate to null,
+// and blocks that end by returning or throwing have no value.
+func (c *Compiler) keepBlockValue() {
+	switch {
+	case c.lastInstructionIs(code.OpPop):
+		c.removeLastPop()
+	case c.lastInstructionLeaves():
+	default:
+		c.emit(code.OpNull)
+	}
+}
+
+// Compiles the statements of a program or block, dropping those after a
+// return or throw statement, which can never run.
+func (c *Compiler) compileStatements(statements []ast.Statement) error {
+	for i, s := range statements {
+		err := c.Compile(s)
+		if err != nil {
+			return err
+		}
+
+		switch s.(type) {
+		case *ast.ReturnStatement, *ast.ThrowStatement:
+			return c.compileUnreachable(statements[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// Compiles a try expression without a finally. `OpTry` installs a handler
+// for the instructions up to the matching `OpEndTry`. Should one of them
+// fail, or a function they call fail without handling it, the VM removes
+// the handler and continues at the catch with the stack as it was at
+// `OpTry` and the value caught pushed.
+func (c *Compiler) compileTryCatch(node *ast.TryExpression) error {
+	tryPos := c.emit(code.OpTry, 9999, 1)
+
+	err := c.withHandler(nil, func() error { return c.Compile(node.Body) })
+	if err != nil {
+		return err
+	}
+	c.keepBlockValue()
+	c.emit(code.OpEndTry)
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	c.replaceInstruction(tryPos, c.makeInstruction(code.OpTry, len(c.currentInstructions()), 1))
+
+	// The parameter is only visible within the catch, like the names the
+	// catch defines.
+	c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+	defer func() { c.symbolTable = c.symbolTable.Outer }()
+
+	if node.Param != nil {
+		symbol := c.define(node.Param.Value, false)
+		c.storeSymbol(symbol)
+	} else {
+		c.emit(code.OpPop)
+	}
+
+	err = c.compileStatements(node.Catch.Statements)
+	if err != nil {
+		return err
+	}
+	// Without statements, the last pop is that of the value caught.
+	if len(node.Catch.Statements) == 0 {
+		c.emit(code.OpNull)
+	} else {
+		c.keepBlockValue()
+	}
+
+	c.changeInstructionOperand(jumpPos, len(c.currentInstructions()))
+	return nil
+}
+
+// Compiles a try expression with a finally, as a handler around the try and
+// its catch, if any, that runs the finally and throws what it caught again.
+// The finally is repeated wherever else they are left: after them, and
+// before each return within them.
+func (c *Compiler) compileTryFinally(node *ast.TryExpression) error {
+	tryPos := c.emit(code.OpTry, 9999, 0)
+
+	err := c.withHandler(node.Finally, func() error {
+		if node.Catch != nil {
+			return c.compileTryCatch(node)
+		}
+		if err := c.Compile(node.Body); err != nil {
+			return err
+		}
+		c.keepBlockValue()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpEndTry)
+
+	// The finally's expression statements pop their own values, leaving
+	// the try's value on top of the stack.
+	if err := c.Compile(node.Finally); err != nil {
+		return err
+	}
+	jumpPos := c.emit(code.OpJump, 9999)
+
+	c.replaceInstruction(tryPos, c.makeInstruction(code.OpTry, len(c.currentInstructions()), 0))
+	if err := c.Compile(node.Finally); err != nil {
+		return err
+	}
+	c.emit(code.OpThrow)
+
+	c.changeInstructionOperand(jumpPos, len(c.currentInstructions()))
+	return nil
+}
+
+// Compiles what compile emits with a handler installed, which runs finally
+// before rethrowing, or catches if finally is nil.
+func (c *Compiler) withHandler(finally *ast.BlockStatement, compile func() error) error {
+	scope := &c.scopes[c.scopeIndex]
+	scope.handlers = append(scope.handlers, finally)
+	err := compile()
+	scope = &c.scopes[c.scopeIndex]
+	scope.handlers = scope.handlers[:len(scope.handlers)-1]
+	return err
+}
+
+// Removes the handlers installed in the current function before a return
+// leaves it, innermost first, running the finally blocks among them. A
+// return within one of those only has the handlers around it to remove.
+func (c *Compiler) removeHandlers() error {
+	handlers := c.scopes[c.scopeIndex].handlers
+	defer func() { c.scopes[c.scopeIndex].handlers = handlers }()
+
+	for i := len(handlers) - 1; i >= 0; i-- {
+		c.emit(code.OpEndTry)
+		if handlers[i] == nil {
+			continue
+		}
+		c.scopes[c.scopeIndex].handlers = handlers[:i:i]
+		if err := c.Compile(handlers[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compiles an if expression whose condition is known at compile time to
+// just the branch that is taken.
+func (c *Compiler) compileConstantIf(node *ast.IfExpression, taken bool) error {
+	if !taken {
+		if err := c.compileUnreachable(node.Consequence); err != nil {
+			return err
+		}
+		if node.Alternative == nil {
+			c.emit(code.OpNull)
+			return nil
+		}
+		if err := c.Compile(node.Alternative); err != nil {
+			return err
+		}
+		c.keepBlockValue()
+		return nil
+	}
+
+	if err := c.Compile(node.Consequence); err != nil {
+		return err
+	}
+	c.keepBlockValue()
+	if node.Alternative != nil {
+		return c.compileUnreachable(node.Alternative)
+	}
+	return nil
+}
+
+// Like compileConstantIf, for a conditional expression.
+func (c *Compiler) compileConstantConditional(node *ast.ConditionalExpression, taken bool) error {
+	if !taken {
+		if err := c.compileUnreachableExpression(node.Consequence); err != nil {
+			return err
+		}
+		return c.Compile(node.Alternative)
+	}
+
+	if err := c.Compile(node.Consequence); err != nil {
+		return err
+	}
+	return c.compileUnreachableExpression(node.Alternative)
+}
+
+// Like compileUnreachable, for an expression.
+func (c *Compiler) compileUnreachableExpression(expr ast.Expression) error {
+	scope := c.scopes[c.scopeIndex]
+
+	if err := c.Compile(expr); err != nil {
+		return err
+	}
+
+	c.scopes[c.scopeIndex] = scope
+	return nil
+}
+
+// Compiles statements that can never run and throws their instructions
+// away. They are still compiled, so that the names they define stay defined
+// and mistakes in them are still reported.
+func (c *Compiler) compileUnreachable(statements ...ast.Statement) error {
+	scope := c.scopes[c.scopeIndex]
+
+	for _, s := range statements {
+		err := c.Compile(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.scopes[c.scopeIndex] = scope
+	return nil
+}
+
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
 	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
@@ -452,7 +1551,7 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 
 func (c *Compiler) changeInstructionOperand(opPos int, operand int) {
 	op := code.Opcode(c.currentInstructions()[opPos])
-	newInstruction := code.Make(op, operand)
+	newInstruction := c.makeInstruction(op, operand)
 
 	c.replaceInstruction(opPos, newInstruction)
 }
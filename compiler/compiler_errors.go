@@ -0,0 +1,76 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey/object"
+	"strings"
+)
+
+// An identifier the compiler couldn't resolve to a variable, which would
+// only fail when the code it is in runs.
+type UndefinedIdentifier struct {
+	Name     string
+	Line     int
+	Column   int
+	Assigned bool   // assigned to, rather than read
+	Module   string // the key of the module it is in, as module.Resolve returns it, or "" for the program
+}
+
+// Returns what is wrong with the identifier, without its position, as the
+// evaluator reports it when it runs into the identifier.
+func (u UndefinedIdentifier) Message() string {
+	if u.Assigned {
+		return "identifier not declared: " + u.Name
+	}
+	return "identifier not found: " + u.Name
+}
+
+func (u UndefinedIdentifier) String() string {
+	if u.Module != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", u.Module, u.Line, u.Column, u.Message())
+	}
+	return fmt.Sprintf("%d:%d: %s", u.Line, u.Column, u.Message())
+}
+
+// The error Compile returns for code with identifiers that aren't defined.
+// It lists all of them, in the order they are compiled, one per line.
+type UndefinedError struct {
+	Identifiers []UndefinedIdentifier
+}
+
+func (e *UndefinedError) Error() string {
+	lines := make([]string, len(e.Identifiers))
+	for i, ident := range e.Identifiers {
+		lines[i] = ident.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The error Compile returns for a call, by name, of a builtin or of a
+// function only ever bound to that name, with a number of arguments the
+// function doesn't take.
+type ArityError struct {
+	Function string // the name it is called by
+	Builtin  bool
+	Want     object.Arity
+	Got      int
+	Line     int
+	Column   int
+	Module   string // the key of the module it is in, or "" for the program
+}
+
+// Returns what is wrong with the call, without its position, as the
+// function reports it when the call runs.
+func (e *ArityError) Message() string {
+	if e.Builtin {
+		return fmt.Sprintf("wrong number of arguments. got=%d, want=%s", e.Got, e.Want)
+	}
+	return fmt.Sprintf("wrong number of arguments: want=%s, got=%d", e.Want, e.Got)
+}
+
+func (e *ArityError) Error() string {
+	if e.Module != "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.Module, e.Line, e.Column, e.Message())
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message())
+}
@@ -7,6 +7,10 @@ import (
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -64,6 +68,12 @@ func testConstants(
 				return fmt.Errorf("constant %d - testIntegerObject failed: %s",
 					i, err)
 			}
+		case float64:
+			err := testFloatObject(constant, actual[i])
+			if err != nil {
+				return fmt.Errorf("constant %d - testFloatObject failed: %s",
+					i, err)
+			}
 		case string:
 			err := testStringObject(constant, actual[i])
 			if err != nil {
@@ -103,6 +113,21 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	res, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)",
+			actual, actual)
+	}
+
+	if res.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%f, want=%f",
+			res.Value, expected)
+	}
+
+	return nil
+}
+
 func testStringObject(expected string, actual object.Object) error {
 	res, ok := actual.(*object.String)
 	if !ok {
@@ -124,13 +149,26 @@ type compilerTestCase struct {
 	expectedInstructions []code.Instructions
 }
 
+// Compiles without optimizations, which would take away most of the
+// instructions the tests are about. The optimizations have tests of their
+// own.
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
+	runCompilerTestsWith(t, tests, func(c *Compiler) {
+		c.SetFolding(false)
+		c.SetPeephole(false)
+		c.SetSuperinstructions(false)
+	})
+}
+
+func runCompilerTestsWith(t *testing.T, tests []compilerTestCase, configure func(*Compiler)) {
+	t.Helper()
 
 	for _, test := range tests {
 		program := parse(test.input)
 
 		compiler := New()
+		configure(compiler)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
@@ -202,6 +240,44 @@ func TestIntegerArithmetic(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "5 % 2",
+			expectedConstants: []interface{}{5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "2 ** 3",
+			expectedConstants: []interface{}{2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPow),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 & 2 | 3 ^ 4 << 5 >> 6",
+			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpBitAnd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpShiftLeft),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpShiftRight),
+				code.Make(code.OpBitXor),
+				code.Make(code.OpBitOr),
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:             "-1",
 			expectedConstants: []interface{}{1},
@@ -216,8 +292,42 @@ func TestIntegerArithmetic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestFloatArithmetic(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1.5 + 2",
+			expectedConstants: []interface{}{1.5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-0.5",
+			expectedConstants: []interface{}{0.5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []compilerTestCase{
+		{
+			input:             "null",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:             "true",
 			expectedConstants: []interface{}{},
@@ -254,6 +364,26 @@ func TestBooleanExpressions(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "1 >= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterThanOrEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 <= 2",
+			expectedConstants: []interface{}{2, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterThanOrEqual),
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:             "1 == 2",
 			expectedConstants: []interface{}{1, 2},
@@ -358,76 +488,100 @@ func TestConditionals(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
-	}
-
-	runCompilerTests(t, tests)
-}
-
-func TestGlobalLetStatements(t *testing.T) {
-	tests := []compilerTestCase{
-		{
-			input: `
-			let one = 1;
-			let two = 2;
-			`,
-			expectedConstants: []interface{}{1, 2},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpSetGlobal, 1),
-			},
-		},
 		{
 			input: `
-			let one = 1;
-			one;
+			if (true) { } else { let x = 1; };
 			`,
 			expectedConstants: []interface{}{1},
 			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 8),
+				// 0004
+				code.Make(code.OpNull),
+				// 0005
+				code.Make(code.OpJump, 15),
+				// 0008
 				code.Make(code.OpConstant, 0),
+				// 0011
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
+				// 0014
+				code.Make(code.OpNull),
+				// 0015
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input: `
-			let one = 1;
-			let two = one;
-			two;
-			`,
-			expectedConstants: []interface{}{1},
+			input:             "true ? 10 : 20; 3333;",
+			expectedConstants: []interface{}{10, 20, 3333},
 			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpSetGlobal, 1),
-				code.Make(code.OpGetGlobal, 1),
+				// 0007
+				code.Make(code.OpJump, 13),
+				// 0010
+				code.Make(code.OpConstant, 1),
+				// 0013
+				code.Make(code.OpPop),
+				// 0014
+				code.Make(code.OpConstant, 2),
+				// 0017
 				code.Make(code.OpPop),
 			},
 		},
 	}
+
 	runCompilerTests(t, tests)
 }
 
-func TestStringExpressions(t *testing.T) {
+func TestLogicalOperators(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             `"monkey"`,
-			expectedConstants: []interface{}{"monkey"},
+			input:             "true && false",
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
+				code.Make(code.OpFalse),
+				// 0005
+				code.Make(code.OpBang),
+				// 0006
+				code.Make(code.OpBang),
+				// 0007
+				code.Make(code.OpJump, 11),
+				// 0010
+				code.Make(code.OpFalse),
+				// 0011
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             `"mon" + "key"`,
-			expectedConstants: []interface{}{"mon", "key"},
+			input:             "false || true",
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
+				// 0000
+				code.Make(code.OpFalse),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 8),
+				// 0004
+				code.Make(code.OpTrue),
+				// 0005
+				code.Make(code.OpJump, 11),
+				// 0008
+				code.Make(code.OpTrue),
+				// 0009
+				code.Make(code.OpBang),
+				// 0010
+				code.Make(code.OpBang),
+				// 0011
 				code.Make(code.OpPop),
 			},
 		},
@@ -436,41 +590,31 @@ func TestStringExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestArrayLiterals(t *testing.T) {
+func TestWhileExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "[]",
-			expectedConstants: []interface{}{},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpArray, 0),
-				code.Make(code.OpPop),
-			},
-		},
-		{
-			input:             "[1, 2, 3]",
-			expectedConstants: []interface{}{1, 2, 3},
+			input: `
+			while (true) { 10 }; 3333;
+			`,
+			expectedConstants: []interface{}{10, 3333},
 			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 11),
+				// 0004
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpArray, 3),
+				// 0007
 				code.Make(code.OpPop),
-			},
-		},
-		{
-			input:             "[1 + 2, 3 - 4, 5 * 6]",
-			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
-			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
+				// 0008
+				code.Make(code.OpJump, 0),
+				// 0011
+				code.Make(code.OpNull),
+				// 0012
+				code.Make(code.OpPop),
+				// 0013
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpSub),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMul),
-				code.Make(code.OpArray, 3),
+				// 0016
 				code.Make(code.OpPop),
 			},
 		},
@@ -479,43 +623,1230 @@ func TestArrayLiterals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
-func TestHashLiterals(t *testing.T) {
+func TestTryExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
-			input:             "{}",
-			expectedConstants: []interface{}{},
+			input:             `try { 1 } catch (e) { e }; 2`,
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpHash, 0),
+				// 0000
+				code.Make(code.OpTry, 11, 1),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpEndTry),
+				// 0008
+				code.Make(code.OpJump, 17),
+				// 0011
+				code.Make(code.OpSetGlobal, 0),
+				// 0014
+				code.Make(code.OpGetGlobal, 0),
+				// 0017
+				code.Make(code.OpPop),
+				// 0018
+				code.Make(code.OpConstant, 1),
+				// 0021
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "{1: 2, 3: 4, 5: 6}",
-			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			input:             `try { throw 1 } catch { 2 }`,
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTry, 12, 1),
+				// 0004
 				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpThrow),
+				// 0008
+				code.Make(code.OpEndTry),
+				// 0009
+				code.Make(code.OpJump, 16),
+				// 0012
+				code.Make(code.OpPop),
+				// 0013
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpHash, 6),
+				// 0016
 				code.Make(code.OpPop),
 			},
 		},
 		{
-			input:             "{1: 2 + 3, 4: 5 * 6}",
-			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			// The finally runs before the return, after the try, and before
+			// rethrowing what the try throws.
+			input: `fn() { try { return 1 } finally { puts() } }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpTry, 23, 0),
+					// 0004
+					code.Make(code.OpConstant, 0),
+					// 0007
+					code.Make(code.OpEndTry),
+					// 0008
+					code.Make(code.OpGetBuiltin, 1),
+					// 0010
+					code.Make(code.OpCall, 0),
+					// 0012
+					code.Make(code.OpPop),
+					// 0013
+					code.Make(code.OpReturnValue),
+					// 0014
+					code.Make(code.OpEndTry),
+					// 0015
+					code.Make(code.OpGetBuiltin, 1),
+					// 0017
+					code.Make(code.OpCall, 0),
+					// 0019
+					code.Make(code.OpPop),
+					// 0020
+					code.Make(code.OpJump, 29),
+					// 0023
+					code.Make(code.OpGetBuiltin, 1),
+					// 0025
+					code.Make(code.OpCall, 0),
+					// 0027
+					code.Make(code.OpPop),
+					// 0028
+					code.Make(code.OpThrow),
+					// 0029
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { throw 1; 2 }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpThrow),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let one = 1;
+			let two = 2;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 1),
+			},
+		},
+		{
+			input: `
+			let one = 1;
+			one;
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let one = 1;
+			let two = one;
+			two;
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let [a, b] = [1, 2];",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpDestructureArray, 2),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input:             `let h = {}; let {"x": x, "y": y} = h; y;`,
+			expectedConstants: []interface{}{"x", "y"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDestructureHash, 2),
+				code.Make(code.OpSetGlobal, 2),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(p) { let [a, b] = p; b }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpDestructureArray, 2),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let one = 1;
+			one = 2;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			fn() {
+				let one = 1;
+				one = 2;
+			}
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAssignLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// A captured variable is assigned through the cell it shares
+			// with the function that defined it.
+			input: "fn() { let a = 1; fn() { a = 2; } }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
+					code.Make(code.OpClosure, 2, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// The globals of blocks are captured like locals, and assigned
+			// through their cells.
+			input: "if (true) { let a = 1; a = 2; fn() { a } }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 30),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				code.Make(code.OpConstant, 1),
+				// 0013
+				code.Make(code.OpAssignGlobal, 0),
+				// 0016
+				code.Make(code.OpGetGlobal, 0),
+				// 0019
+				code.Make(code.OpPop),
+				// 0020
+				code.Make(code.OpCaptureGlobal, 0),
+				// 0023
+				code.Make(code.OpClosure, 2, 1),
+				// 0027
+				code.Make(code.OpJump, 31),
+				// 0030
+				code.Make(code.OpNull),
+				// 0031
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConstStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "const a = 1; let b = a; const c = b;",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpSetGlobal, 2),
+			},
+		},
+		{
+			// Declaring the name again makes a new binding, not an assignment.
+			input:             "const a = 1; let a = 2; a = 3;",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssignExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"one = 1;", "1:1: identifier not declared: one"},
+		{"fn() { one = 1; }", "1:8: identifier not declared: one"},
+		{"len = 1;", "cannot assign to builtin: len"},
+		{"let f = fn() { f = 1; }", "cannot assign to function name: f"},
+		{"let f = fn() { fn() { f = 1; } }", "cannot assign to function name: f"},
+		{"const a = 1; a = 2;", "cannot assign to constant: a"},
+		{"const a = 1; fn() { a = 2; }", "cannot assign to constant: a"},
+		{"fn() { const a = 1; fn() { a = 2; } }", "cannot assign to constant: a"},
+		{"const [a, b] = [1, 2]; b = 3;", "cannot assign to constant: b"},
+	}
+
+	for _, test := range tests {
+		program := parse(test.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none.")
+		}
+
+		if err.Error() != test.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", test.expected, err)
+		}
+	}
+}
+
+func TestUndefinedIdentifiers(t *testing.T) {
+	input := "let a = b + 1;\nlet f = fn(x) { c = x; d };\nif (false) { e }"
+
+	err := New().Compile(parse(input))
+	undefined, ok := err.(*UndefinedError)
+	if !ok {
+		t.Fatalf("wrong error. want=*UndefinedError, got=%T (%v)", err, err)
+	}
+
+	// Every one is found, dead code included, not just the first.
+	expected := []UndefinedIdentifier{
+		{Name: "b", Line: 1, Column: 9},
+		{Name: "c", Line: 2, Column: 17, Assigned: true},
+		{Name: "d", Line: 2, Column: 24},
+		{Name: "e", Line: 3, Column: 14},
+	}
+	if !reflect.DeepEqual(undefined.Identifiers, expected) {
+		t.Errorf("wrong identifiers.\nwant=%+v\ngot= %+v", expected, undefined.Identifiers)
+	}
+
+	message := "1:9: identifier not found: b\n2:17: identifier not declared: c\n" +
+		"2:24: identifier not found: d\n3:14: identifier not found: e"
+	if err.Error() != message {
+		t.Errorf("wrong message.\nwant=%q\ngot= %q", message, err.Error())
+	}
+}
+
+func TestArityErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string // "" if the calls are left to be checked as they run
+	}{
+		{"let f = fn(a, b) { a };\nf(1)", "2:1: wrong number of arguments: want=2, got=1"},
+		{"const f = fn() { 1 }; f(1)", "1:23: wrong number of arguments: want=0, got=1"},
+		{"let f = fn(a, b = 2) { a }; f(1); f(1, 2); f()", "1:44: wrong number of arguments: want=1 or 2, got=0"},
+		{"let f = fn(a, ...b) { a }; f(1, 2, 3); f()", "1:40: wrong number of arguments: want=at least 1, got=0"},
+		{`len("a", "b")`, "1:1: wrong number of arguments. got=2, want=1"},
+		{"fn() { first() }", "1:8: wrong number of arguments. got=0, want=1"},
+		// Within the function, by the name it is bound to.
+		{"let f = fn(n) { f(n, 1) };", "1:17: wrong number of arguments: want=1, got=2"},
+		{"let f = fn(a) { a }; fn() { f() }", "1:29: wrong number of arguments: want=1, got=0"},
+		// Variables that are assigned to may hold another function by then.
+		{"let f = fn(a) { a }; f = fn() { 1 }; f()", ""},
+		{"let f = fn(a) { a }; let g = fn() { f = len; }; f()", ""},
+		{"let f = fn(a) { a }; fn(f) { f() }", ""},
+		{"let f = len; f()", ""},
+		{"fn(a) { a }()", ""},
+		// A builtin's name can be declared again.
+		{"let len = fn() { 1 }; len()", ""},
+	}
+
+	for _, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("unexpected compiler error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		if _, ok := err.(*ArityError); !ok {
+			t.Errorf("wrong error for %q. want=*ArityError, got=%T (%v)", tt.input, err, err)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error for %q. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+// In the REPL, a variable can be assigned another function on a later line,
+// after calls of it have been checked.
+func TestArityAfterAssignment(t *testing.T) {
+	symbolTable := NewSymbolTable()
+	for i, line := range []string{"let f = fn(a) { a };", "f = fn() { 1 };", "f()"} {
+		comp := NewWithState(symbolTable, []object.Object{})
+		if err := comp.Compile(parse(line)); err != nil {
+			t.Fatalf("compiler error on line %d: %s", i+1, err)
+		}
+	}
+}
+
+func TestStringExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `"monkey"`,
+			expectedConstants: []interface{}{"monkey"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"mon" + "key"`,
+			expectedConstants: []interface{}{"mon", "key"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestConstantDeduplication(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "5 + 5 + 5",
+			expectedConstants: []interface{}{5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"a" + "b" + "a"`,
+			expectedConstants: []interface{}{"a", "b"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { 1 }; fn() { 1 }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	// Constants from earlier compilations are reused too.
+	comp := New()
+	if err := comp.Compile(parse(`1; "a"`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	comp = NewWithState(comp.symbolTable, comp.Bytecode().Constants)
+	if err := comp.Compile(parse(`"a"; 1; 2`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if len(comp.Bytecode().Constants) != 3 {
+		t.Errorf("wrong number of constants. got=%d, want=3", len(comp.Bytecode().Constants))
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "2 * 3 + 4",
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "2 ** 3 ** 2",
+			expectedConstants: []interface{}{512},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "0xF0 | 0x0F ^ 1 << 2 & 0xFF",
+			expectedConstants: []interface{}{0xFB},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "2 ** 64",
+			expectedConstants: []interface{}{2, 64},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPow),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"a" + "b"`,
+			expectedConstants: []interface{}{"ab"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 < 2 ? 10 : 20",
+			expectedConstants: []interface{}{10, 20},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "null ? 10 : 20",
+			expectedConstants: []interface{}{10, 20},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "null == null",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "!null",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "!true",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-(1 + 1.5) < 0 && 1 != 2",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "7 % 2 + 1",
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Only the constant part of an expression is folded.
+			input:             "let x = 1; x + 2 * 3",
+			expectedConstants: []interface{}{1, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Expressions that fail are left for the VM to report.
+			input:             "1 % 0",
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Whether overflow wraps around is up to the VM.
+			input:             "9223372036854775807 + 1",
+			expectedConstants: []interface{}{9223372036854775807, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `1 + "a"`,
+			expectedConstants: []interface{}{1, "a"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWith(t, tests, func(c *Compiler) {
+		c.SetPeephole(false)
+		c.SetSuperinstructions(false)
+	})
+}
+
+func TestDeadCodeElimination(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn() { return 1; 2; 3 }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				3,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(x) { if (x) { return 1 } else { 2 } }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					// 0000
+					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpJumpNotTruthy, 9),
+					// 0005
+					code.Make(code.OpConstant, 0),
+					// 0008
+					code.Make(code.OpReturnValue),
+					// 0009
+					code.Make(code.OpConstant, 1),
+					// 0012
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `if (1 > 2) { 10 } else { 20 }; 3333;`,
+			expectedConstants: []interface{}{10, 20, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `if (true) { 10 }; if (false) { 20 }`,
+			expectedConstants: []interface{}{10, 20},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `while (false) { 10 }`,
+			expectedConstants: []interface{}{10},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// Names defined in dead code still take up their slots.
+			input:             `if (false) { let x = 1; }; let y = 2; y`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWith(t, tests, func(c *Compiler) {
+		c.SetPeephole(false)
+		c.SetSuperinstructions(false)
+	})
+
+	comp := New()
+	err := comp.Compile(parse(`if (false) { undefined }`))
+	if err == nil || err.Error() != "1:14: identifier not found: undefined" {
+		t.Errorf("wrong error for dead code. got=%v", err)
+	}
+}
+
+func TestPeepholeOptimizer(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// The last value popped is the program's result, so it stays.
+			input:             "1; 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { 1; 2 }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; x; x",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "!!(1 == 2)",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// `!!` turns x into a boolean, which isn't one already.
+			input:             "let x = 1; !!x",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpBang),
+				code.Make(code.OpBang),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; if (!!x) { 1 }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpJumpNotTruthy, 18),
+				// 0012
+				code.Make(code.OpConstant, 0),
+				// 0015
+				code.Make(code.OpJump, 19),
+				// 0018
+				code.Make(code.OpNull),
+				// 0019
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// The inner if jumps straight past the outer one.
+			input:             "let x = 1; if (x) { if (x) { 1 } else { 2 } } else { 3 }",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpJumpNotTruthy, 30),
+				// 0012
+				code.Make(code.OpGetGlobal, 0),
+				// 0015
+				code.Make(code.OpJumpNotTruthy, 24),
+				// 0018
+				code.Make(code.OpConstant, 0),
+				// 0021
+				code.Make(code.OpJump, 33),
+				// 0024
+				code.Make(code.OpConstant, 1),
+				// 0027
+				code.Make(code.OpJump, 33),
+				// 0030
+				code.Make(code.OpConstant, 2),
+				// 0033
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// A pop that jumps land on stays.
+			input:             "let x = 1; if (x) { 1 }; 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpJumpNotTruthy, 18),
+				// 0012
+				code.Make(code.OpConstant, 0),
+				// 0015
+				code.Make(code.OpJump, 19),
+				// 0018
+				code.Make(code.OpNull),
+				// 0019
+				code.Make(code.OpPop),
+				// 0020
+				code.Make(code.OpConstant, 1),
+				// 0023
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; x && x == 1",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0012
+				code.Make(code.OpGetGlobal, 0),
+				// 0015
+				code.Make(code.OpConstant, 0),
+				// 0018
+				code.Make(code.OpEqual),
+				// 0019
+				code.Make(code.OpJump, 23),
+				// 0022
+				code.Make(code.OpFalse),
+				// 0023
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWith(t, tests, func(c *Compiler) {
+		c.SetFolding(false)
+		c.SetSuperinstructions(false)
+	})
+}
+
+func TestSuperinstructions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: "fn(a, b) { a + b }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocalAdd, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn(a) { a + 1 - 2 }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstantAdd, 0),
+					code.Make(code.OpConstantSub, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let x = 1; if (x > 2) { 3 }",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpCompareJump, int(code.OpGreaterThan), 22),
+				// 0016
+				code.Make(code.OpConstant, 2),
+				// 0019
+				code.Make(code.OpJump, 23),
+				// 0022
+				code.Make(code.OpNull),
+				// 0023
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWith(t, tests, func(c *Compiler) {
+		c.SetFolding(false)
+		c.SetPeephole(false)
+	})
+
+	// A jump lands on the OpAdd, so it can't be fused with the OpGetLocal.
+	ins := concatInstructions([]code.Instructions{
+		code.Make(code.OpJump, 5),
+		code.Make(code.OpGetLocal, 0),
+		code.Make(code.OpAdd),
+		code.Make(code.OpReturnValue),
+	})
+	if got, _ := selectSuperinstructions(ins, nil); got.String() != ins.String() {
+		t.Errorf("instructions fused across a jump target.\nwant=%s\ngot=%s", ins, got)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	comp := New()
+	err := comp.Compile(parse("let x = 1;\nlet y = x - 2;\nlet f = fn() { x; 3 };"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	tests := []struct {
+		sourceMap code.SourceMap
+		expected  code.SourceMap
+	}{
+		{
+			bytecode.SourceMap,
+			code.SourceMap{
+				{Offset: 0, Line: 1, Column: 9},  // OpConstant 1
+				{Offset: 3, Line: 1, Column: 1},  // OpSetGlobal x
+				{Offset: 6, Line: 2, Column: 9},  // OpGetGlobal x
+				{Offset: 9, Line: 2, Column: 11}, // OpConstantSub 2, at the `-`
+				{Offset: 12, Line: 2, Column: 1}, // OpSetGlobal y
+				{Offset: 15, Line: 3, Column: 9}, // OpClosure f
+				{Offset: 19, Line: 3, Column: 1}, // OpSetGlobal f
+			},
+		},
+		{
+			// `x;` is left out by the peephole optimizer.
+			bytecode.Constants[3].(*object.CompiledFunction).SourceMap,
+			code.SourceMap{
+				{Offset: 0, Line: 3, Column: 19}, // OpConstant 3 and OpReturnValue
+			},
+		},
+	}
+
+	for i, test := range tests {
+		if fmt.Sprint(test.sourceMap) != fmt.Sprint(test.expected) {
+			t.Errorf("wrong source map %d.\nwant=%v\ngot=%v", i, test.expected, test.sourceMap)
+		}
+	}
+}
+
+func TestStringInterning(t *testing.T) {
+	comp := New()
+	err := comp.Compile(parse(`"monkey"; "banana"`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	constants := comp.Bytecode().Constants
+	if comp.InternTable().Intern("monkey") != constants[0] {
+		t.Errorf("string literal is not the interned string")
+	}
+	if comp.InternTable().Len() != 2 {
+		t.Errorf("wrong number of interned strings. got=%d", comp.InternTable().Len())
+	}
+
+	// Later compilations intern into the same strings.
+	comp = NewWithState(comp.symbolTable, constants)
+	if comp.InternTable().Intern("banana") != constants[1] {
+		t.Errorf("string literal is not shared with an earlier compilation")
+	}
+}
+
+func TestArrayLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "[]",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1, 2, 3]",
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1 + 2, 3 - 4, 5 * 6]",
+			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpSub),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpMul),
+				code.Make(code.OpArray, 3),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestHashLiterals(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "{}",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "{1: 2, 3: 4, 5: 6}",
+			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpHash, 6),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "{1: 2 + 3, 4: 5 * 6}",
+			expectedConstants: []interface{}{1, 2, 3, 4, 5, 6},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 5),
+				code.Make(code.OpMul),
+				code.Make(code.OpHash, 4),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestMemberExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `{"a": 1}.a`,
+			expectedConstants: []interface{}{"a", 1},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpAdd),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
-				code.Make(code.OpConstant, 5),
-				code.Make(code.OpMul),
-				code.Make(code.OpHash, 4),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
 			},
 		},
@@ -524,18 +1855,102 @@ func TestHashLiterals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestImports(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"util.monkey":      "let x = 1; let y = fn() { x };",
+		"cycle.monkey":     `import "./cycle.monkey";`,
+		"returns.monkey":   "if (true) { return 1; }",
+		"undefined.monkey": "let z = fn() {\n  w\n};",
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	comp := New()
+	comp.SetImportDir(dir)
+	err := comp.Compile(parse(`import "./util.monkey"; import "./util.monkey" as u; let z = 3;`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// The module is compiled once, to a function setting its bindings as
+	// globals, which its own functions refer to.
+	var modules []*object.CompiledFunction
+	for _, constant := range comp.constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok && fn.Name == filepath.Join(dir, "util.monkey") {
+			modules = append(modules, fn)
+		}
+	}
+	if len(modules) != 1 {
+		t.Fatalf("module compiled %d times", len(modules))
+	}
+	if modules[0].Module != modules[0].Name {
+		t.Errorf("module's function has module %q", modules[0].Module)
+	}
+
+	globals := map[string]Symbol{}
+	for _, symbol := range comp.symbolTable.Symbols() {
+		if symbol.Scope == GlobalScope {
+			globals[symbol.Name] = symbol
+		}
+	}
+	// x and y of the module come first, then the global holding it.
+	expected := map[string]int{"util": 3, "u": 4, "z": 5}
+	for name, index := range expected {
+		if globals[name].Index != index {
+			t.Errorf("global %s has index %d, want=%d", name, globals[name].Index, index)
+		}
+	}
+	if _, ok := globals["x"]; ok {
+		t.Errorf("the module's bindings are visible to the program")
+	}
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{`import "./cycle.monkey"`, `import cycle: "./cycle.monkey" imports itself`},
+		{`import "./returns.monkey"`, "cannot return from the top level of a module"},
+		{`import "./missing.monkey"`,
+			fmt.Sprintf(`cannot import "%s": no such file or directory`, filepath.Join(dir, "missing.monkey"))},
+		{`let x = 1; import "std/strings"; strings.upper(x); let y = x;`, ""},
+		{`import "std/strings"; upper`, ""},
+		{`import "std/strings"; startsWith`, "1:23: identifier not found: startsWith"},
+		{`import "./undefined.monkey"; v`, filepath.Join(dir, "undefined.monkey") +
+			":2:3: identifier not found: w\n1:30: identifier not found: v"},
+	}
+
+	for _, test := range errorTests {
+		comp := New()
+		comp.SetImportDir(dir)
+		err := comp.Compile(parse(test.input))
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("compiler error for %q: %s", test.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%v", test.input, test.expected, err)
+		}
+	}
+}
+
 func TestIndexExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
 			input:             "[1, 2, 3][1 + 1]",
-			expectedConstants: []interface{}{1, 2, 3, 1, 1},
+			expectedConstants: []interface{}{1, 2, 3},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpConstant, 2),
 				code.Make(code.OpArray, 3),
-				code.Make(code.OpConstant, 3),
-				code.Make(code.OpConstant, 4),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpAdd),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
@@ -543,18 +1958,41 @@ func TestIndexExpressions(t *testing.T) {
 		},
 		{
 			input:             "{1: 2}[2 - 1]",
-			expectedConstants: []interface{}{1, 2, 2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpHash, 2),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSub),
 				code.Make(code.OpIndex),
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             `"hello"[1:3]`,
+			expectedConstants: []interface{}{"hello", 1, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "[1][:1]",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpNull),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 	runCompilerTests(t, tests)
 }
@@ -682,6 +2120,75 @@ func TestCompilerScopes(t *testing.T) {
 	}
 }
 
+func TestFunctionDefaults(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(x, y = 10) { x + y }`,
+			expectedConstants: []interface{}{
+				10,
+				[]code.Instructions{
+					code.Make(code.OpJumpArgPassed, 1, 9),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(a = 1, b = a) { b }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpJumpArgPassed, 0, 9),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpJumpArgPassed, 1, 17),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestFunctionRestParameter(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(a, ...rest) { let b = 1; rest }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestFunctionsWithoutReturnValue(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -867,6 +2374,58 @@ func TestLetStatementScopes(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestBlockScopes(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// Each block's names get their own slots among the locals.
+			input: `
+			fn(x) {
+				if (x) { let y = 1; y } else { let y = 2; y }
+			}
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 15),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpJump, 22),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"if (true) { let a = 1; }; a", "1:27: identifier not found: a"},
+		{"let f = fn() { while (false) { let a = 1; } a };", "1:45: identifier not found: a"},
+		{"if (true) { if (true) { let a = 1; } a }", "1:38: identifier not found: a"},
+	}
+
+	for _, test := range errorTests {
+		comp := New()
+		err := comp.Compile(parse(test.input))
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%v", test.input, test.expected, err)
+		}
+	}
+}
+
 func TestBuiltins(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -925,7 +2484,7 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -955,13 +2514,13 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 1, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -1005,15 +2564,15 @@ func TestClosures(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpConstant, 2),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 4, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
 					code.Make(code.OpConstant, 1),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 5, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -1029,3 +2588,179 @@ func TestClosures(t *testing.T) {
 
 	runCompilerTests(t, tests)
 }
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			let countDown = fn(x) { countDown(x - 1); };
+			countDown(1);
+			`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			let wrapper = fn() {
+				let countDown = fn(x) { countDown(x - 1); };
+				countDown(1);
+			};
+			wrapper();
+			`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpClosure, 1, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpCall, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+// Compiled functions carry the names of their locals and free variables,
+// by index, for debuggers.
+func TestFunctionVariableNames(t *testing.T) {
+	comp := New()
+	err := comp.Compile(parse(`
+	let a = 1;
+	let f = fn(b, ...rest) {
+		let c = 2;
+		if (c) { let d = a + b; }
+		fn() { b + c }
+	};
+	`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var fns []*object.CompiledFunction
+	for _, constant := range comp.constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			fns = append(fns, fn)
+		}
+	}
+	if len(fns) != 2 {
+		t.Fatalf("wrong number of functions. got=%d", len(fns))
+	}
+
+	inner, outer := fns[0], fns[1]
+	if !reflect.DeepEqual(outer.LocalNames, []string{"b", "rest", "c", "d"}) {
+		t.Errorf("wrong local names. got=%q", outer.LocalNames)
+	}
+	if outer.FreeNames != nil {
+		t.Errorf("wrong free names. got=%q", outer.FreeNames)
+	}
+	if !reflect.DeepEqual(inner.FreeNames, []string{"b", "c"}) {
+		t.Errorf("wrong free names. got=%q", inner.FreeNames)
+	}
+	if outer.Module != "" || inner.Module != "" {
+		t.Errorf("functions of the program have a module")
+	}
+}
+
+// Operands that don't fit in the bytes their instructions have for them
+// fail compilation, rather than wrap around.
+func TestOperandsTooLarge(t *testing.T) {
+	var constants strings.Builder
+	for i := 0; i <= 1<<16; i++ {
+		fmt.Fprintf(&constants, "%d;\n", i)
+	}
+
+	// Identifiers can't have digits in them.
+	locals := make([]string, 257)
+	names := make([]string, 257)
+	for i := range locals {
+		names[i] = fmt.Sprintf("v%c%c", 'a'+i/26, 'a'+i%26)
+		locals[i] = "let " + names[i] + " = 0;"
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{constants.String(), "too many constants: a program can have at most 65536"},
+		{strings.Repeat("let x = 1;\n", 1<<16+1), "too many globals: a program can have at most 65536"},
+		{"fn() { " + strings.Join(locals, " ") + " }", "too many local variables: a function can have at most 256"},
+		{
+			"if (true) { " + strings.Join(locals, " ") + " fn() { " + strings.Join(names, " + ") + " } }",
+			"too many free variables: a function can capture at most 256",
+		},
+		{"[" + strings.Repeat("0, ", 1<<16) + "0]", "too many elements: an array literal can have at most 65535"},
+		{"{" + strings.Repeat("0: 0, ", 1<<15-1) + "0: 0}", "too many pairs: a hash literal can have at most 32767"},
+		{"puts(" + strings.Repeat("0, ", 255) + "0)", "too many arguments: a call can pass at most 255"},
+		{
+			"let x = true; if (x) { " + strings.Repeat("puts(x);", 10000) + " }",
+			"too much code: jumps can only reach the first 65536 bytes of a function's instructions",
+		},
+	}
+
+	for _, test := range tests {
+		err := New().Compile(parse(test.input))
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("wrong error. want=%q, got=%v", test.expected, err)
+		}
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let m = macro(x) { x };", "macros can only be defined by let statements at the top level"},
+		{"quote(1)", "quote can only be used in macros on the vm"},
+	}
+
+	for _, test := range tests {
+		comp := New()
+		err := comp.Compile(parse(test.input))
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%v", test.input, test.expected, err)
+		}
+	}
+
+	// A function of the program's own may be called quote.
+	comp := New()
+	if err := comp.Compile(parse("let quote = fn(x) { x }; quote(1)")); err != nil {
+		t.Errorf("unexpected error calling a function named quote: %s", err)
+	}
+}
@@ -0,0 +1,168 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey/code"
+	"monkey/object"
+	"strings"
+)
+
+// A decoded instruction, or the reason the instructions at offset couldn't
+// be decoded.
+type disassembledInstruction struct {
+	offset   int
+	op       code.Opcode
+	def      *code.Definition
+	operands []int
+	err      error
+}
+
+// Returns a listing of the bytecode: the main instructions, the constant
+// pool, and the instructions of every compiled function in the pool.
+// Instructions are annotated with the constants, functions and builtins they
+// refer to and with where they jump to, and the targets of jumps are marked
+// with ">". Where the source position the instructions come from changes,
+// a "-- line:column" line marks the new position.
+func (b *Bytecode) Disassemble() string {
+	var out strings.Builder
+
+	out.WriteString("== main ==\n")
+	b.disassembleInstructions(&out, b.Instructions, b.SourceMap)
+
+	if len(b.Constants) > 0 {
+		out.WriteString("\n== constants ==\n")
+		for i, constant := range b.Constants {
+			fmt.Fprintf(&out, "%04d %s\n", i, describeConstant(constant))
+		}
+	}
+
+	for i, constant := range b.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			fmt.Fprintf(&out, "\n== constant %d: %s ==\n", i, fn.Inspect())
+			b.disassembleInstructions(&out, fn.Instructions, fn.SourceMap)
+		}
+	}
+
+	return out.String()
+}
+
+func (b *Bytecode) disassembleInstructions(out *strings.Builder, ins code.Instructions, sourceMap code.SourceMap) {
+	decoded := decodeInstructions(ins)
+
+	targets := map[int]bool{}
+	for _, instruction := range decoded {
+		if i := jumpOperand(instruction.op); instruction.err == nil && i >= 0 {
+			targets[instruction.operands[i]] = true
+		}
+	}
+
+	var lastLine, lastColumn int
+	for _, instruction := range decoded {
+		sourceLine, sourceColumn := sourceMap.Lookup(instruction.offset)
+		if sourceLine != lastLine || sourceColumn != lastColumn {
+			fmt.Fprintf(out, "-- %d:%d\n", sourceLine, sourceColumn)
+			lastLine, lastColumn = sourceLine, sourceColumn
+		}
+
+		if instruction.err != nil {
+			fmt.Fprintf(out, "%04d ERROR: %s\n", instruction.offset, instruction.err)
+			continue
+		}
+
+		marker := " "
+		if targets[instruction.offset] {
+			marker = ">"
+		}
+
+		line := fmt.Sprintf("%04d %s %s", instruction.offset, marker,
+			code.FormatInstruction(instruction.def, instruction.operands))
+		if note := b.annotate(instruction); note != "" {
+			line = fmt.Sprintf("%-32s ; %s", line, note)
+		}
+		out.WriteString(line + "\n")
+	}
+}
+
+// Decodes instructions up to the end, or up to the first one that can't be
+// decoded, which is returned with its error.
+func decodeInstructions(ins code.Instructions) []disassembledInstruction {
+	var decoded []disassembledInstruction
+
+	for offset := 0; offset < len(ins); {
+		def, err := code.Lookup(ins[offset])
+		if err != nil {
+			return append(decoded, disassembledInstruction{offset: offset, err: err})
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if offset+1+width > len(ins) {
+			return append(decoded, disassembledInstruction{
+				offset: offset,
+				err:    fmt.Errorf("%s is missing operands", def.Name),
+			})
+		}
+
+		operands, read := code.ReadOperands(def, ins[offset+1:])
+		decoded = append(decoded, disassembledInstruction{
+			offset:   offset,
+			op:       code.Opcode(ins[offset]),
+			def:      def,
+			operands: operands,
+		})
+		offset += 1 + read
+	}
+
+	return decoded
+}
+
+// Describes what an instruction's operands refer to, if anything.
+func (b *Bytecode) annotate(instruction disassembledInstruction) string {
+	switch instruction.op {
+	case code.OpConstant, code.OpClosure, code.OpConstantAdd, code.OpConstantSub:
+		idx := instruction.operands[0]
+		if idx >= len(b.Constants) {
+			return "invalid constant"
+		}
+		if fn, ok := b.Constants[idx].(*object.CompiledFunction); ok {
+			return object.FunctionName(fn.Name)
+		}
+		return describeConstant(b.Constants[idx])
+	case code.OpJump, code.OpJumpNotTruthy:
+		return fmt.Sprintf("-> %04d", instruction.operands[0])
+	case code.OpCompareJump:
+		comparison, err := code.Lookup(byte(instruction.operands[0]))
+		if err != nil || !comparisonOpcodes[code.Opcode(instruction.operands[0])] {
+			return "invalid comparison"
+		}
+		return fmt.Sprintf("%s, -> %04d", comparison.Name, instruction.operands[1])
+	case code.OpJumpArgPassed:
+		return fmt.Sprintf("-> %04d", instruction.operands[1])
+	case code.OpTry:
+		if instruction.operands[1] == 0 {
+			return fmt.Sprintf("finally -> %04d", instruction.operands[0])
+		}
+		return fmt.Sprintf("catch -> %04d", instruction.operands[0])
+	case code.OpGetBuiltin:
+		idx := instruction.operands[0]
+		if idx >= len(object.Builtins) {
+			return "invalid builtin"
+		}
+		return object.Builtins[idx].Name
+	default:
+		return ""
+	}
+}
+
+func describeConstant(constant object.Object) string {
+	switch constant := constant.(type) {
+	case *object.String:
+		return fmt.Sprintf("STRING %q", constant.Value)
+	case *object.CompiledFunction:
+		return constant.Inspect()
+	default:
+		return fmt.Sprintf("%s %s", constant.Type(), constant.Inspect())
+	}
+}
@@ -0,0 +1,82 @@
+package compiler
+
+import (
+	"monkey/code"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse(`let f = fn(x) { if (x > 1) { "big" } else { len(x) } }; f(2.5)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := `== main ==
+-- 1:9
+0000   OpClosure 2 0             ; f
+-- 1:1
+0004   OpSetGlobal 0
+-- 1:57
+0007   OpGetGlobal 0
+-- 1:59
+0010   OpConstant 3              ; FLOAT 2.5
+-- 1:58
+0013   OpCall 1
+-- 1:57
+0015   OpPop
+
+== constants ==
+0000 INTEGER 1
+0001 STRING "big"
+0002 CompiledFunction[f, params=1, locals=1]
+0003 FLOAT 2.5
+
+== constant 2: CompiledFunction[f, params=1, locals=1] ==
+-- 1:21
+0000   OpGetLocal 0
+-- 1:25
+0002   OpConstant 0              ; INTEGER 1
+-- 1:23
+0005   OpCompareJump 17 15       ; OpGreaterThan, -> 0015
+-- 1:30
+0009   OpConstant 1              ; STRING "big"
+-- 1:17
+0012   OpJump 21                 ; -> 0021
+-- 1:45
+0015 > OpGetBuiltin 0            ; len
+-- 1:49
+0017   OpGetLocal 0
+-- 1:48
+0019   OpCall 1
+-- 1:17
+0021 > OpReturnValue
+`
+
+	if got := compiler.Bytecode().Disassemble(); got != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, got)
+	}
+}
+
+func TestDisassembleInvalidInstructions(t *testing.T) {
+	tests := []struct {
+		instructions code.Instructions
+		expected     string
+	}{
+		{
+			append(code.Make(code.OpConstant, 7), 255),
+			"== main ==\n0000   OpConstant 7              ; invalid constant\n0003 ERROR: opcode 255 undefined\n",
+		},
+		{
+			code.Make(code.OpConstant, 7)[:2],
+			"== main ==\n0000 ERROR: OpConstant is missing operands\n",
+		},
+	}
+
+	for _, test := range tests {
+		bytecode := &Bytecode{Instructions: test.instructions}
+		if got := bytecode.Disassemble(); got != test.expected {
+			t.Errorf("wrong disassembly.\nwant=%q\ngot=%q", test.expected, got)
+		}
+	}
+}
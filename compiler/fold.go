@@ -0,0 +1,231 @@
+package compiler
+
+import (
+	"math"
+	"monkey/ast"
+	"monkey/object"
+)
+
+// Evaluates an expression made up only of literals and operators at compile
+// time, e.g. `2 * 3 + 4` or `"a" + "b"`, following the same rules as the VM.
+// It reports false if the expression isn't constant, or if evaluating it
+// would fail, such as on a type mismatch or a modulo by zero, so that the
+// error is still raised when the program runs.
+func foldConstant(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}, true
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}, true
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}, true
+	case *ast.Boolean:
+		return nativeBool(node.Value), true
+	case *ast.NullLiteral:
+		return object.Null, true
+	case *ast.PrefixExpression:
+		right, ok := foldConstant(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldPrefix(node.Operator, right)
+	case *ast.InfixExpression:
+		left, ok := foldConstant(node.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := foldConstant(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldInfix(node.Operator, left, right)
+	default:
+		return nil, false
+	}
+}
+
+func foldPrefix(op string, right object.Object) (object.Object, bool) {
+	switch op {
+	case "!":
+		return nativeBool(!object.IsTruthy(right)), true
+	case "-":
+		switch right := right.(type) {
+		case *object.Integer:
+			if object.NegationOverflows(right.Value) {
+				return nil, false
+			}
+			return &object.Integer{Value: -right.Value}, true
+		case *object.Float:
+			return &object.Float{Value: -right.Value}, true
+		}
+	}
+	return nil, false
+}
+
+func foldInfix(op string, left, right object.Object) (object.Object, bool) {
+	switch op {
+	case "&&":
+		return nativeBool(object.IsTruthy(left) && object.IsTruthy(right)), true
+	case "||":
+		return nativeBool(object.IsTruthy(left) || object.IsTruthy(right)), true
+	}
+
+	switch left := left.(type) {
+	case *object.Integer:
+		if right, ok := right.(*object.Integer); ok {
+			return foldIntegerInfix(op, left.Value, right.Value)
+		}
+		if right, ok := right.(*object.Float); ok {
+			return foldFloatInfix(op, float64(left.Value), right.Value)
+		}
+	case *object.Float:
+		switch right := right.(type) {
+		case *object.Integer:
+			return foldFloatInfix(op, left.Value, float64(right.Value))
+		case *object.Float:
+			return foldFloatInfix(op, left.Value, right.Value)
+		}
+	case *object.String:
+		if right, ok := right.(*object.String); ok {
+			return foldStringInfix(op, left.Value, right.Value)
+		}
+	case *object.Boolean, *object.NULL:
+		if right.Type() == left.Type() {
+			switch op {
+			case "==":
+				return nativeBool(left == right), true
+			case "!=":
+				return nativeBool(left != right), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func foldIntegerInfix(op string, left, right int64) (object.Object, bool) {
+	// Whether overflow wraps around or fails is up to the VM running the
+	// program.
+	if object.IntegerOverflows(op, left, right) {
+		return nil, false
+	}
+
+	switch op {
+	case "+":
+		return &object.Integer{Value: left + right}, true
+	case "-":
+		return &object.Integer{Value: left - right}, true
+	case "*":
+		return &object.Integer{Value: left * right}, true
+	case "/":
+		if right == 0 {
+			return nil, false
+		}
+		return &object.Integer{Value: left / right}, true
+	case "%":
+		if right == 0 {
+			return nil, false
+		}
+		return &object.Integer{Value: left % right}, true
+	case "**":
+		if right < 0 {
+			return &object.Float{Value: math.Pow(float64(left), float64(right))}, true
+		}
+		res, ok := object.PowerInts(left, right)
+		if !ok {
+			return nil, false
+		}
+		return &object.Integer{Value: res}, true
+	case "&":
+		return &object.Integer{Value: left & right}, true
+	case "|":
+		return &object.Integer{Value: left | right}, true
+	case "^":
+		return &object.Integer{Value: left ^ right}, true
+	case "<<":
+		if right < 0 {
+			return nil, false
+		}
+		return &object.Integer{Value: left << right}, true
+	case ">>":
+		if right < 0 {
+			return nil, false
+		}
+		return &object.Integer{Value: left >> right}, true
+	case "<":
+		return nativeBool(left < right), true
+	case "<=":
+		return nativeBool(left <= right), true
+	case ">":
+		return nativeBool(left > right), true
+	case ">=":
+		return nativeBool(left >= right), true
+	case "==":
+		return nativeBool(left == right), true
+	case "!=":
+		return nativeBool(left != right), true
+	default:
+		return nil, false
+	}
+}
+
+func foldFloatInfix(op string, left, right float64) (object.Object, bool) {
+	switch op {
+	case "+":
+		return &object.Float{Value: left + right}, true
+	case "-":
+		return &object.Float{Value: left - right}, true
+	case "*":
+		return &object.Float{Value: left * right}, true
+	case "/":
+		return &object.Float{Value: left / right}, true
+	case "%":
+		if right == 0 {
+			return nil, false
+		}
+		return &object.Float{Value: math.Mod(left, right)}, true
+	case "**":
+		return &object.Float{Value: math.Pow(left, right)}, true
+	case "<":
+		return nativeBool(left < right), true
+	case "<=":
+		return nativeBool(left <= right), true
+	case ">":
+		return nativeBool(left > right), true
+	case ">=":
+		return nativeBool(left >= right), true
+	case "==":
+		return nativeBool(left == right), true
+	case "!=":
+		return nativeBool(left != right), true
+	default:
+		return nil, false
+	}
+}
+
+func foldStringInfix(op string, left, right string) (object.Object, bool) {
+	switch op {
+	case "+":
+		return &object.String{Value: left + right}, true
+	case "==":
+		return nativeBool(left == right), true
+	case "!=":
+		return nativeBool(left != right), true
+	case "<":
+		return nativeBool(left < right), true
+	case "<=":
+		return nativeBool(left <= right), true
+	case ">":
+		return nativeBool(left > right), true
+	case ">=":
+		return nativeBool(left >= right), true
+	default:
+		return nil, false
+	}
+}
+
+func nativeBool(b bool) *object.Boolean {
+	if b {
+		return object.TRUE
+	}
+	return object.FALSE
+}
@@ -0,0 +1,251 @@
+package compiler
+
+import "monkey/code"
+
+// A decoded instruction, as the peephole optimizer works on them.
+type peepholeInstruction struct {
+	op       code.Opcode
+	operands []int
+	pos      int // In the original instructions.
+	removed  bool
+
+	// The instruction in the original instructions whose source position
+	// this one keeps.
+	source int
+}
+
+// Opcodes that push a value without any other effect, so that pushing the
+// value only to pop it again can be left out.
+var pureOpcodes = map[code.Opcode]bool{
+	code.OpConstant:       true,
+	code.OpTrue:           true,
+	code.OpFalse:          true,
+	code.OpNull:           true,
+	code.OpGetGlobal:      true,
+	code.OpGetLocal:       true,
+	code.OpGetFree:        true,
+	code.OpGetBuiltin:     true,
+	code.OpCurrentClosure: true,
+}
+
+// Opcodes that always push a boolean, so that negating it twice does nothing.
+var booleanOpcodes = map[code.Opcode]bool{
+	code.OpTrue:               true,
+	code.OpFalse:              true,
+	code.OpBang:               true,
+	code.OpEqual:              true,
+	code.OpNotEqual:           true,
+	code.OpGreaterThan:        true,
+	code.OpGreaterThanOrEqual: true,
+}
+
+// Rewrites finished instructions to do the same with less work:
+//
+//   - a value pushed only to be popped, e.g. `OpConstant x; OpPop`, is left
+//     out, unless keepLastPop is set and the pop is the last instruction,
+//     whose value the VM reports as the program's result
+//   - `OpBang OpBang` is left out where only the truthiness of the value
+//     matters, before `OpJumpNotTruthy`, or where the value is a boolean
+//   - jumps to jumps go straight to where the chain of jumps ends
+//
+// Instructions that jumps land on are never merged with the instructions
+// before them, and jumps are moved to follow the instructions they target,
+// as are the offsets in the instructions' source map.
+func peepholeOptimize(ins code.Instructions, sourceMap code.SourceMap, keepLastPop bool) (code.Instructions, code.SourceMap) {
+	decoded, ok := decodePeephole(ins)
+	if !ok {
+		return ins, sourceMap
+	}
+
+	threadJumps(decoded)
+
+	targets := map[int]bool{}
+	for _, in := range decoded {
+		if i := jumpOperand(in.op); i >= 0 {
+			targets[in.operands[i]] = true
+		}
+	}
+
+	var prev *peepholeInstruction // The last instruction that is kept.
+	for i := 0; i < len(decoded); i++ {
+		in := &decoded[i]
+		if i+1 >= len(decoded) {
+			break
+		}
+		next := &decoded[i+1]
+
+		switch {
+		case pureOpcodes[in.op] && next.op == code.OpPop && !targets[next.pos]:
+			if keepLastPop && i+2 == len(decoded) {
+				break
+			}
+			in.removed = true
+			next.removed = true
+			i++
+			continue
+
+		case in.op == code.OpBang && next.op == code.OpBang && !targets[next.pos]:
+			beforeJump := i+2 < len(decoded) && decoded[i+2].op == code.OpJumpNotTruthy
+			ofBoolean := prev != nil && booleanOpcodes[prev.op] && !targets[in.pos]
+			if beforeJump || ofBoolean {
+				in.removed = true
+				next.removed = true
+				i++
+				continue
+			}
+		}
+
+		prev = in
+	}
+
+	return encodeInstructions(decoded, len(ins), sourceMap)
+}
+
+// Fuses common pairs of instructions into the superinstruction that does the
+// same, saving the VM a dispatch:
+//
+//   - `OpGetLocal n; OpAdd` becomes `OpGetLocalAdd n`
+//   - `OpConstant c; OpAdd` becomes `OpConstantAdd c`, likewise for OpSub
+//   - a comparison followed by `OpJumpNotTruthy t` becomes
+//     `OpCompareJump <comparison> t`
+//
+// A pair isn't fused if a jump lands on its second instruction. Fused
+// arithmetic is mapped to the operator in the source, where it can fail.
+func selectSuperinstructions(ins code.Instructions, sourceMap code.SourceMap) (code.Instructions, code.SourceMap) {
+	decoded, ok := decodePeephole(ins)
+	if !ok {
+		return ins, sourceMap
+	}
+
+	targets := map[int]bool{}
+	for _, in := range decoded {
+		if i := jumpOperand(in.op); i >= 0 {
+			targets[in.operands[i]] = true
+		}
+	}
+
+	for i := 0; i+1 < len(decoded); i++ {
+		in, next := &decoded[i], &decoded[i+1]
+		if targets[next.pos] {
+			continue
+		}
+
+		switch {
+		case in.op == code.OpGetLocal && next.op == code.OpAdd:
+			in.op = code.OpGetLocalAdd
+			in.source = next.source
+		case in.op == code.OpConstant && next.op == code.OpAdd:
+			in.op = code.OpConstantAdd
+			in.source = next.source
+		case in.op == code.OpConstant && next.op == code.OpSub:
+			in.op = code.OpConstantSub
+			in.source = next.source
+		case comparisonOpcodes[in.op] && next.op == code.OpJumpNotTruthy:
+			in.operands = []int{int(in.op), next.operands[0]}
+			in.op = code.OpCompareJump
+		default:
+			continue
+		}
+
+		next.removed = true
+		i++
+	}
+
+	return encodeInstructions(decoded, len(ins), sourceMap)
+}
+
+var comparisonOpcodes = map[code.Opcode]bool{
+	code.OpEqual:              true,
+	code.OpNotEqual:           true,
+	code.OpGreaterThan:        true,
+	code.OpGreaterThanOrEqual: true,
+}
+
+// Returns which operand of an instruction is the position it jumps to, or -1
+// if it doesn't jump.
+func jumpOperand(op code.Opcode) int {
+	switch op {
+	case code.OpJump, code.OpJumpNotTruthy, code.OpTry:
+		return 0
+	case code.OpCompareJump, code.OpJumpArgPassed:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// Decodes instructions for the peephole optimizer, reporting false if some
+// can't be decoded.
+func decodePeephole(ins code.Instructions) ([]peepholeInstruction, bool) {
+	var decoded []peepholeInstruction
+	for _, in := range decodeInstructions(ins) {
+		if in.err != nil {
+			return nil, false
+		}
+		decoded = append(decoded, peepholeInstruction{
+			op:       in.op,
+			operands: in.operands,
+			pos:      in.offset,
+			source:   in.offset,
+		})
+	}
+	return decoded, true
+}
+
+// Points jumps that land on an unconditional jump to where it goes instead.
+func threadJumps(decoded []peepholeInstruction) {
+	byPos := make(map[int]*peepholeInstruction, len(decoded))
+	for i := range decoded {
+		byPos[decoded[i].pos] = &decoded[i]
+	}
+
+	for i := range decoded {
+		in := &decoded[i]
+		if in.op != code.OpJump && in.op != code.OpJumpNotTruthy {
+			continue
+		}
+
+		// A chain can't be longer than the number of jumps, unless it loops.
+		target := in.operands[0]
+		for n := 0; n < len(decoded); n++ {
+			next, ok := byPos[target]
+			if !ok || next.op != code.OpJump || next.operands[0] == target {
+				break
+			}
+			target = next.operands[0]
+		}
+		in.operands[0] = target
+	}
+}
+
+// Encodes the instructions that weren't removed, moving jump targets along.
+// A jump to a removed instruction goes to the next one that is kept. The
+// source map of the original instructions is turned into one of the new.
+func encodeInstructions(decoded []peepholeInstruction, length int, sourceMap code.SourceMap) (code.Instructions, code.SourceMap) {
+	newPos := make(map[int]int, len(decoded)+1)
+	pos := 0
+	for _, in := range decoded {
+		newPos[in.pos] = pos
+		if !in.removed {
+			pos += len(code.Make(in.op, in.operands...))
+		}
+	}
+	newPos[length] = pos
+
+	// Removed instructions map to the position of the next kept one, which
+	// their position is already set to above, as nothing was added for them.
+	var out code.Instructions
+	var outMap code.SourceMap
+	for _, in := range decoded {
+		if in.removed {
+			continue
+		}
+		if i := jumpOperand(in.op); i >= 0 {
+			in.operands[i] = newPos[in.operands[i]]
+		}
+		line, column := sourceMap.Lookup(in.source)
+		outMap = outMap.Add(len(out), line, column)
+		out = append(out, code.Make(in.op, in.operands...)...)
+	}
+	return out, outMap
+}
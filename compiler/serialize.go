@@ -0,0 +1,273 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"monkey/code"
+	"monkey/object"
+)
+
+// Bytecode files start with this magic string, followed by the format version.
+const bytecodeMagic = "MNKY"
+
+// The version of the bytecode format. It must be bumped whenever the
+// encoding, or the numbering of opcodes, changes.
+const BytecodeVersion = 12
+
+// Tags identifying the type of each constant in the constant pool.
+const (
+	integerConstant byte = iota + 1
+	floatConstant
+	stringConstant
+	functionConstant
+)
+
+// Encodes the bytecode in a versioned binary format, which Deserialize turns
+// back into bytecode. Builtins are referenced by index, so the names of the
+// builtins are recorded too, letting Deserialize reject bytecode built
+// against a different set of builtins.
+//
+// All integers are big endian. The format is:
+//
+//	magic "MNKY", version uint16
+//	builtin count uint16, then each builtin's name
+//	main instructions and source map
+//	constant count uint32, then each constant as a tag byte and its value
+//
+// Strings and instructions are encoded as a uint32 length followed by their
+// bytes, and source maps as a uint32 count of positions followed by each
+// position's offset, line and column as uint32s. Functions' instructions are
+// followed by their source map too.
+func (b *Bytecode) Serialize() ([]byte, error) {
+	var out bytes.Buffer
+
+	out.WriteString(bytecodeMagic)
+	binary.Write(&out, binary.BigEndian, uint16(BytecodeVersion))
+
+	binary.Write(&out, binary.BigEndian, uint16(len(object.Builtins)))
+	for _, def := range object.Builtins {
+		writeBytes(&out, []byte(def.Name))
+	}
+
+	writeBytes(&out, b.Instructions)
+	writeSourceMap(&out, b.SourceMap)
+
+	binary.Write(&out, binary.BigEndian, uint32(len(b.Constants)))
+	for i, constant := range b.Constants {
+		switch constant := constant.(type) {
+		case *object.Integer:
+			out.WriteByte(integerConstant)
+			binary.Write(&out, binary.BigEndian, constant.Value)
+		case *object.Float:
+			out.WriteByte(floatConstant)
+			binary.Write(&out, binary.BigEndian, math.Float64bits(constant.Value))
+		case *object.String:
+			out.WriteByte(stringConstant)
+			writeBytes(&out, []byte(constant.Value))
+		case *object.CompiledFunction:
+			out.WriteByte(functionConstant)
+			binary.Write(&out, binary.BigEndian, uint32(constant.NumParameters))
+			binary.Write(&out, binary.BigEndian, uint32(constant.NumDefaults))
+			binary.Write(&out, binary.BigEndian, constant.Variadic)
+			binary.Write(&out, binary.BigEndian, uint32(constant.NumLocals))
+			writeBytes(&out, []byte(constant.Name))
+			writeBytes(&out, constant.Instructions)
+			writeSourceMap(&out, constant.SourceMap)
+		default:
+			return nil, fmt.Errorf("cannot serialize constant %d of type %s",
+				i, constant.Type())
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+func writeBytes(out *bytes.Buffer, b []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(b)))
+	out.Write(b)
+}
+
+func writeSourceMap(out *bytes.Buffer, m code.SourceMap) {
+	binary.Write(out, binary.BigEndian, uint32(len(m)))
+	for _, pos := range m {
+		binary.Write(out, binary.BigEndian, uint32(pos.Offset))
+		binary.Write(out, binary.BigEndian, uint32(pos.Line))
+		binary.Write(out, binary.BigEndian, uint32(pos.Column))
+	}
+}
+
+var errTruncatedBytecode = errors.New("bytecode is truncated")
+
+// Decodes bytecode encoded by Bytecode.Serialize.
+func Deserialize(data []byte) (*Bytecode, error) {
+	r := &bytecodeReader{data: data}
+
+	if string(r.bytes(len(bytecodeMagic))) != bytecodeMagic {
+		return nil, errors.New("not a Monkey bytecode file")
+	}
+	if version := r.uint16(); r.err == nil && version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d, want %d",
+			version, BytecodeVersion)
+	}
+
+	numBuiltins := int(r.uint16())
+	if r.err == nil && numBuiltins != len(object.Builtins) {
+		return nil, fmt.Errorf("bytecode was built with %d builtins, have %d",
+			numBuiltins, len(object.Builtins))
+	}
+	for i := 0; i < numBuiltins && r.err == nil; i++ {
+		name := r.string()
+		if r.err == nil && name != object.Builtins[i].Name {
+			return nil, fmt.Errorf("bytecode was built with builtin %q at index %d, have %q",
+				name, i, object.Builtins[i].Name)
+		}
+	}
+
+	bytecode := &Bytecode{Instructions: code.Instructions(r.lengthPrefixed())}
+	bytecode.SourceMap = r.sourceMap()
+	interned := object.NewInternTable()
+
+	numConstants := r.uint32()
+	for i := uint32(0); i < numConstants && r.err == nil; i++ {
+		switch tag := r.byte(); tag {
+		case integerConstant:
+			value := int64(r.uint64())
+			bytecode.Constants = append(bytecode.Constants, &object.Integer{Value: value})
+		case floatConstant:
+			value := math.Float64frombits(r.uint64())
+			bytecode.Constants = append(bytecode.Constants, &object.Float{Value: value})
+		case stringConstant:
+			bytecode.Constants = append(bytecode.Constants, interned.Intern(r.string()))
+		case functionConstant:
+			fn := &object.CompiledFunction{
+				NumParameters: int(r.uint32()),
+				NumDefaults:   int(r.uint32()),
+				Variadic:      r.byte() != 0,
+				NumLocals:     int(r.uint32()),
+				Name:          r.string(),
+			}
+			fn.Instructions = code.Instructions(r.lengthPrefixed())
+			fn.SourceMap = r.sourceMap()
+			bytecode.Constants = append(bytecode.Constants, fn)
+		default:
+			if r.err == nil {
+				return nil, fmt.Errorf("unknown constant tag %d at constant %d", tag, i)
+			}
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) != 0 {
+		return nil, errors.New("unexpected data after bytecode")
+	}
+
+	return bytecode, nil
+}
+
+// Checks with code.Verify that the bytecode is safe to run, which
+// deserialized bytecode may not be.
+func (b *Bytecode) Verify() error {
+	constants := make([]code.Constant, len(b.Constants))
+	for i, constant := range b.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			constants[i] = code.Constant{
+				IsFunction:    true,
+				Instructions:  fn.Instructions,
+				NumParameters: fn.NumParameters,
+				NumDefaults:   fn.NumDefaults,
+				Variadic:      fn.Variadic,
+				NumLocals:     fn.NumLocals,
+			}
+		}
+	}
+
+	if err := code.Verify(b.Instructions, constants, len(object.Builtins)); err != nil {
+		return fmt.Errorf("invalid bytecode: %w", err)
+	}
+	return nil
+}
+
+// Reads values off the front of data. Once a read runs past the end of the
+// data, err is set and every further read returns a zero value.
+type bytecodeReader struct {
+	data []byte
+	err  error
+}
+
+func (r *bytecodeReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errTruncatedBytecode
+		return nil
+	}
+
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *bytecodeReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *bytecodeReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *bytecodeReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *bytecodeReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *bytecodeReader) lengthPrefixed() []byte {
+	n := r.uint32()
+	if uint64(n) > uint64(len(r.data)) {
+		r.bytes(len(r.data) + 1)
+		return nil
+	}
+	return r.bytes(int(n))
+}
+
+func (r *bytecodeReader) string() string {
+	return string(r.lengthPrefixed())
+}
+
+func (r *bytecodeReader) sourceMap() code.SourceMap {
+	n := r.uint32()
+	if uint64(n)*12 > uint64(len(r.data)) {
+		r.bytes(len(r.data) + 1)
+		return nil
+	}
+
+	var m code.SourceMap
+	for i := uint32(0); i < n; i++ {
+		m = append(m, code.SourcePosition{
+			Offset: int(r.uint32()),
+			Line:   int(r.uint32()),
+			Column: int(r.uint32()),
+		})
+	}
+	return m
+}
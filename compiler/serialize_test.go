@@ -0,0 +1,155 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"monkey/code"
+	"monkey/object"
+	"strings"
+	"testing"
+)
+
+func compileForSerialization(t *testing.T, input string) *Bytecode {
+	t.Helper()
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	return compiler.Bytecode()
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	bytecode := compileForSerialization(t, `
+	let add = fn(a, b) { let sum = a + b; sum };
+	let greet = fn(name) { "hello " + name };
+	let adder = fn(x) { fn(y) { x + y } };
+	let scale = fn(x, by = 2) { x * by };
+	let count = fn(...xs) { len(xs) };
+	[add(-1, 9223372036854775807), 2.5, greet("bob"), adder(1)(2), len("abc"), scale(3), count(1, 2)]
+	`)
+
+	data, err := bytecode.Serialize()
+	if err != nil {
+		t.Fatalf("serialize error: %s", err)
+	}
+
+	decoded, err := Deserialize(data)
+	if err != nil {
+		t.Fatalf("deserialize error: %s", err)
+	}
+
+	err = testInstructions([]code.Instructions{bytecode.Instructions}, decoded.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+
+	if fmt.Sprint(decoded.SourceMap) != fmt.Sprint(bytecode.SourceMap) {
+		t.Errorf("wrong source map.\ngot=%v\nwant=%v", decoded.SourceMap, bytecode.SourceMap)
+	}
+
+	if len(decoded.Constants) != len(bytecode.Constants) {
+		t.Fatalf("wrong number of constants. got=%d, want=%d",
+			len(decoded.Constants), len(bytecode.Constants))
+	}
+	for i, want := range bytecode.Constants {
+		got := decoded.Constants[i]
+		if got.Type() != want.Type() || got.Inspect() != want.Inspect() {
+			t.Errorf("constant %d wrong. got=%s (%s), want=%s (%s)",
+				i, got.Inspect(), got.Type(), want.Inspect(), want.Type())
+			continue
+		}
+
+		fn, ok := want.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		gotFn := got.(*object.CompiledFunction)
+		if gotFn.NumParameters != fn.NumParameters || gotFn.NumDefaults != fn.NumDefaults ||
+			gotFn.Variadic != fn.Variadic || gotFn.NumLocals != fn.NumLocals || gotFn.Name != fn.Name {
+			t.Errorf("constant %d wrong. got=%+v, want=%+v", i, gotFn, fn)
+		}
+		if !bytes.Equal(gotFn.Instructions, fn.Instructions) {
+			t.Errorf("constant %d has wrong instructions.\ngot=%s\nwant=%s",
+				i, gotFn.Instructions, fn.Instructions)
+		}
+		if fmt.Sprint(gotFn.SourceMap) != fmt.Sprint(fn.SourceMap) {
+			t.Errorf("constant %d has wrong source map.\ngot=%v\nwant=%v",
+				i, gotFn.SourceMap, fn.SourceMap)
+		}
+	}
+}
+
+func TestDeserializeErrors(t *testing.T) {
+	data, err := compileForSerialization(t, `let f = fn(x) { x + "a" }; f(1.5)`).Serialize()
+	if err != nil {
+		t.Fatalf("serialize error: %s", err)
+	}
+
+	for n := 0; n < len(data); n++ {
+		if _, err := Deserialize(data[:n]); err == nil {
+			t.Errorf("no error for bytecode truncated to %d bytes", n)
+		}
+	}
+
+	wrongVersion := bytes.Clone(data)
+	binary.BigEndian.PutUint16(wrongVersion[len(bytecodeMagic):], BytecodeVersion+1)
+
+	// The name of the first builtin starts after the magic, the version, the
+	// builtin count and the length of the name.
+	wrongBuiltin := bytes.Clone(data)
+	wrongBuiltin[len(bytecodeMagic)+2+2+4] = 'x'
+
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte("#!/bin/monkey"), "not a Monkey bytecode file"},
+		{wrongVersion, "unsupported bytecode version"},
+		{wrongBuiltin, `bytecode was built with builtin "xen" at index 0, have "len"`},
+		{append(bytes.Clone(data), 0), "unexpected data after bytecode"},
+		{data[:len(data)-1], "bytecode is truncated"},
+	}
+
+	for _, test := range tests {
+		_, err := Deserialize(test.data)
+		if err == nil {
+			t.Errorf("expected error containing %q, got none", test.expected)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("wrong error. got=%q, want it to contain %q", err, test.expected)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	bytecode := compileForSerialization(t, `
+	let adder = fn(x) { fn(y) { x + y } };
+	let i = 0;
+	while (i < 3) { i = adder(i)(1) };
+	[i, len("abc")]
+	`)
+	if err := bytecode.Verify(); err != nil {
+		t.Fatalf("error for compiled bytecode: %s", err)
+	}
+
+	bytecode = &Bytecode{
+		Instructions: concatInstructions([]code.Instructions{
+			code.Make(code.OpClosure, 0, 0),
+			code.Make(code.OpPop),
+		}),
+		Constants: []object.Object{&object.CompiledFunction{
+			Instructions: code.Make(code.OpGetLocal, 1),
+			NumLocals:    1,
+		}},
+	}
+	err := bytecode.Verify()
+	expected := "invalid bytecode: constant 0: 0000: OpGetLocal: local 1 out of range, have 1"
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%v", expected, err)
+	}
+}
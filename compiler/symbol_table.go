@@ -1,18 +1,33 @@
 package compiler
 
+import (
+	"monkey/object"
+	"sort"
+)
+
 type SymbolScope string
 
 const (
-	GlobalScope  SymbolScope = "GLOBAL"
-	LocalScope   SymbolScope = "LOCAL"
-	BuiltinScope SymbolScope = "BUILTIN"
-	FreeScope    SymbolScope = "FREE"
+	GlobalScope   SymbolScope = "GLOBAL"
+	LocalScope    SymbolScope = "LOCAL"
+	BuiltinScope  SymbolScope = "BUILTIN"
+	FreeScope     SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
 )
 
 type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+	Const bool // Declared with `const`, so it can't be assigned to.
+	// Defined as a global within a block, like the body of a loop at the
+	// top level. Closures capture it rather than refer to the global, so
+	// that each time the block runs gives them a new variable, as it does
+	// for the locals of a function.
+	Block bool
+	// How many arguments the function it holds takes, if it is only ever
+	// bound to a function literal, or nil.
+	Arity *object.Arity
 }
 
 type SymbolTable struct {
@@ -20,7 +35,21 @@ type SymbolTable struct {
 
 	store          map[string]Symbol
 	numDefinitions int
+	names          []string // of the definitions numbered among this table's, by index
 	FreeSymbols    []Symbol
+
+	// Whether the table is for a block within a function, or within the
+	// main program, rather than for the function or program itself.
+	block bool
+
+	// For the table of an imported module, the table of the program that
+	// imports it, whose globals the module's are numbered among. The
+	// module can't see the program's names, though.
+	importer *SymbolTable
+
+	// The globals that hold the top-level bindings of each module the
+	// program has imported, by key. Only set in the program's table.
+	modules map[string]Symbol
 }
 
 func NewSymbolTable() *SymbolTable {
@@ -34,16 +63,163 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	return s
 }
 
+// Returns a table for the names defined in a block, like the body of an if
+// or of a while loop, which are only visible within it. Their values are
+// kept with the locals of the enclosing function, or with the globals.
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewEnclosedSymbolTable(outer)
+	s.block = true
+	return s
+}
+
+// Returns a table for the top level of a module imported by code whose
+// names are in importer. It has only the builtins defined.
+func NewModuleSymbolTable(importer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.importer = importer.globals()
+	for i, b := range object.Builtins {
+		s.DefineBuiltin(i, b.Name)
+	}
+	return s
+}
+
+// Returns a copy of the table that can be defined into without affecting the
+// original. Enclosing tables are shared, not copied.
+func (s *SymbolTable) Copy() *SymbolTable {
+	store := make(map[string]Symbol, len(s.store))
+	for name, symbol := range s.store {
+		store[name] = symbol
+	}
+	var modules map[string]Symbol
+	if s.modules != nil {
+		modules = make(map[string]Symbol, len(s.modules))
+		for key, symbol := range s.modules {
+			modules[key] = symbol
+		}
+	}
+
+	return &SymbolTable{
+		Outer:          s.Outer,
+		store:          store,
+		numDefinitions: s.numDefinitions,
+		names:          append([]string{}, s.names...),
+		FreeSymbols:    append([]Symbol{}, s.FreeSymbols...),
+		block:          s.block,
+		importer:       s.importer,
+		modules:        modules,
+	}
+}
+
+// Undoes the definitions made in the table since it was copied from prev
+// whose symbols isSet reports were never given a value, as happens to those
+// after where a program failed or ended. Their names resolve as they do in
+// prev again. The indices of their symbols aren't used again.
+func (s *SymbolTable) Forget(prev *SymbolTable, isSet func(Symbol) bool) {
+	for name, symbol := range s.store {
+		if old, ok := prev.store[name]; ok && old == symbol {
+			continue
+		}
+		if isSet(symbol) {
+			continue
+		}
+		if old, ok := prev.store[name]; ok {
+			s.store[name] = old
+		} else {
+			delete(s.store, name)
+		}
+	}
+}
+
+// Returns the symbols defined in this table, without those of enclosing
+// tables, ordered by name.
+func (s *SymbolTable) Symbols() []Symbol {
+	symbols := make([]Symbol, 0, len(s.store))
+	for _, symbol := range s.store {
+		symbols = append(symbols, symbol)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].Name < symbols[j].Name
+	})
+	return symbols
+}
+
 func (s *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Index: s.numDefinitions}
-	if s.Outer == nil {
+	owner := s.owner()
+	symbol := Symbol{Name: name, Index: owner.numDefinitions}
+	if owner.Outer == nil {
 		symbol.Scope = GlobalScope
+		symbol.Block = s.block
 	} else {
 		symbol.Scope = LocalScope
 	}
 
 	s.store[name] = symbol
-	s.numDefinitions++
+	owner.numDefinitions++
+	owner.names = append(owner.names, name)
+	return symbol
+}
+
+// Returns the names of the variables numbered among this table's, by index:
+// the locals of a function, those of its blocks included, or the globals of
+// the program, with those of imported modules. The globals that hold the
+// modules themselves have no name, and a name defined more than once has an
+// index for each definition.
+func (s *SymbolTable) Names() []string {
+	return append([]string{}, s.owner().names...)
+}
+
+// Returns the table of the function, or of the main program, whose
+// variables the names defined in this table are numbered among.
+func (s *SymbolTable) owner() *SymbolTable {
+	for {
+		switch {
+		case s.block:
+			s = s.Outer
+		case s.importer != nil:
+			s = s.importer
+		default:
+			return s
+		}
+	}
+}
+
+// Returns the global that holds the top-level bindings of the module with
+// the key once it has been imported, defining it the first time.
+func (s *SymbolTable) DefineModule(key string) Symbol {
+	globals := s.globals()
+	if symbol, ok := globals.modules[key]; ok {
+		return symbol
+	}
+
+	symbol := Symbol{Name: key, Scope: GlobalScope, Index: globals.numDefinitions}
+	if globals.modules == nil {
+		globals.modules = make(map[string]Symbol)
+	}
+	globals.modules[key] = symbol
+	globals.numDefinitions++
+	globals.names = append(globals.names, "")
+	return symbol
+}
+
+// Returns the table of the main program.
+func (s *SymbolTable) globals() *SymbolTable {
+	for {
+		switch {
+		case s.Outer != nil:
+			s = s.Outer
+		case s.importer != nil:
+			s = s.importer
+		default:
+			return s
+		}
+	}
+}
+
+// Defines a symbol like Define, but as a constant.
+func (s *SymbolTable) DefineConst(name string) Symbol {
+	symbol := s.Define(name)
+	symbol.Const = true
+	s.store[name] = symbol
 	return symbol
 }
 
@@ -53,10 +229,86 @@ func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	return symbol
 }
 
+// Defines the name of the function currently being compiled, so that the
+// function can refer to itself from within its body.
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+// Records a symbol from an enclosing scope as a free variable of this scope.
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{
+		Name:  original.Name,
+		Index: len(s.FreeSymbols) - 1,
+		Const: original.Const,
+		Arity: original.Arity,
+	}
+	symbol.Scope = FreeScope
+
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+// Records the arity of the function the symbol defined as name in this
+// table is bound to, returning the symbol.
+func (s *SymbolTable) setArity(name string, arity *object.Arity) Symbol {
+	symbol := s.store[name]
+	symbol.Arity = arity
+	s.store[name] = symbol
+	return symbol
+}
+
+// Forgets the arity of the symbol name resolves to from this table, once it
+// is assigned another value. A free variable is the variable of the scope
+// that defined it, so that one forgets it too.
+func (s *SymbolTable) forgetArity(name string) {
+	for ; s != nil; s = s.Outer {
+		if symbol, ok := s.store[name]; ok {
+			symbol.Arity = nil
+			s.store[name] = symbol
+			if symbol.Scope != FreeScope {
+				return
+			}
+		}
+	}
+}
+
+// Reports whether a free variable resolved from this table is the name that
+// an enclosing function refers to itself by, which can't be assigned to.
+func (s *SymbolTable) capturesFunctionName(symbol Symbol) bool {
+	for symbol.Scope == FreeScope {
+		s = s.owner()
+		symbol = s.FreeSymbols[symbol.Index]
+		s = s.Outer
+	}
+	return symbol.Scope == FunctionScope
+}
+
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
+	if !ok && s.block {
+		// A block belongs to the same function as its enclosing table, so
+		// nothing needs to be captured.
+		return s.Outer.Resolve(name)
+	}
 	if !ok && s.Outer != nil {
 		obj, ok = s.Outer.Resolve(name)
+		if !ok {
+			return obj, ok
+		}
+
+		// Globals and builtins are reachable from anywhere, so only locals
+		// (and free variables) of enclosing scopes need to be captured,
+		// along with the globals of blocks.
+		if (obj.Scope == GlobalScope && !obj.Block) || obj.Scope == BuiltinScope {
+			return obj, ok
+		}
+
+		return s.defineFree(obj), true
 	}
 	return obj, ok
 }
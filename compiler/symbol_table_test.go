@@ -1,6 +1,9 @@
 package compiler
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestDefine(t *testing.T) {
 	expected := map[string]Symbol{
@@ -103,6 +106,114 @@ func TestResolveLocal(t *testing.T) {
 	}
 }
 
+func TestDefineAndResolveBlock(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	globalBlock := NewBlockSymbolTable(global)
+	globalBlock.Define("b")
+
+	local := NewEnclosedSymbolTable(globalBlock)
+	local.Define("c")
+
+	localBlock := NewBlockSymbolTable(local)
+	localBlock.Define("d")
+	localBlock.Define("c")
+
+	innerBlock := NewBlockSymbolTable(localBlock)
+	innerBlock.Define("e")
+
+	inner := NewEnclosedSymbolTable(innerBlock)
+
+	tests := []struct {
+		table    *SymbolTable
+		expected Symbol
+	}{
+		{globalBlock, Symbol{Name: "a", Scope: GlobalScope, Index: 0}},
+		{globalBlock, Symbol{Name: "b", Scope: GlobalScope, Index: 1, Block: true}},
+		// Functions capture the globals of blocks, rather than share them.
+		{local, Symbol{Name: "b", Scope: FreeScope, Index: 0}},
+		{local, Symbol{Name: "c", Scope: LocalScope, Index: 0}},
+		{localBlock, Symbol{Name: "c", Scope: LocalScope, Index: 2}},
+		{localBlock, Symbol{Name: "d", Scope: LocalScope, Index: 1}},
+		{innerBlock, Symbol{Name: "c", Scope: LocalScope, Index: 2}},
+		{innerBlock, Symbol{Name: "e", Scope: LocalScope, Index: 3}},
+		{inner, Symbol{Name: "e", Scope: FreeScope, Index: 0}},
+		{inner, Symbol{Name: "b", Scope: FreeScope, Index: 1}},
+	}
+
+	for _, test := range tests {
+		res, ok := test.table.Resolve(test.expected.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", test.expected.Name)
+			continue
+		}
+		if res != test.expected {
+			t.Errorf("expected %s to resolve to %+v, got=%+v",
+				test.expected.Name, test.expected, res)
+		}
+	}
+
+	// Names defined in a block aren't visible outside of it.
+	for _, name := range []string{"b", "d", "e"} {
+		if _, ok := global.Resolve(name); ok {
+			t.Errorf("name %s resolvable in the global table", name)
+		}
+	}
+	if _, ok := localBlock.Resolve("e"); ok {
+		t.Errorf("name e resolvable outside its block")
+	}
+
+	if local.numDefinitions != 4 {
+		t.Errorf("locals of the function wrong. want=4, got=%d", local.numDefinitions)
+	}
+	if global.numDefinitions != 2 {
+		t.Errorf("globals wrong. want=2, got=%d", global.numDefinitions)
+	}
+
+	// The names are those of the function or program, by index.
+	if names := innerBlock.Names(); !reflect.DeepEqual(names, []string{"c", "d", "c", "e"}) {
+		t.Errorf("wrong names of locals. got=%q", names)
+	}
+	if names := globalBlock.Names(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("wrong names of globals. got=%q", names)
+	}
+}
+
+func TestDefineAndResolveModule(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	local := NewEnclosedSymbolTable(global)
+	local.Define("b")
+
+	module := NewModuleSymbolTable(local)
+	if res := module.Define("c"); res != (Symbol{Name: "c", Scope: GlobalScope, Index: 1}) {
+		t.Errorf("module binding not numbered among the globals. got=%+v", res)
+	}
+	for _, name := range []string{"a", "b"} {
+		if _, ok := module.Resolve(name); ok {
+			t.Errorf("name %s of the importer resolvable in the module", name)
+		}
+	}
+	if res, ok := module.Resolve("len"); !ok || res.Scope != BuiltinScope {
+		t.Errorf("builtin not resolvable in the module. got=%+v", res)
+	}
+
+	first := local.DefineModule("std/strings")
+	if first != (Symbol{Name: "std/strings", Scope: GlobalScope, Index: 2}) {
+		t.Errorf("wrong symbol for module. got=%+v", first)
+	}
+	if again := module.DefineModule("std/strings"); again != first {
+		t.Errorf("module defined twice. got=%+v and %+v", first, again)
+	}
+	if _, ok := global.Resolve("std/strings"); ok {
+		t.Errorf("module's global resolvable by name")
+	}
+	if names := module.Names(); !reflect.DeepEqual(names, []string{"a", "c", ""}) {
+		t.Errorf("wrong names of globals. got=%q", names)
+	}
+}
+
 func TestResolveNestedLocal(t *testing.T) {
 	global := NewSymbolTable()
 	global.Define("a")
@@ -301,3 +412,121 @@ func TestResolveUnresolvableFree(t *testing.T) {
 		}
 	}
 }
+
+func TestDefineConst(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineConst("a")
+	global.Define("b")
+
+	local := NewEnclosedSymbolTable(global)
+	local.DefineConst("c")
+
+	inner := NewEnclosedSymbolTable(local)
+
+	expected := []struct {
+		table  *SymbolTable
+		symbol Symbol
+	}{
+		{global, Symbol{Name: "a", Scope: GlobalScope, Index: 0, Const: true}},
+		{global, Symbol{Name: "b", Scope: GlobalScope, Index: 1}},
+		{local, Symbol{Name: "c", Scope: LocalScope, Index: 0, Const: true}},
+		{inner, Symbol{Name: "c", Scope: FreeScope, Index: 0, Const: true}},
+	}
+
+	for _, e := range expected {
+		res, ok := e.table.Resolve(e.symbol.Name)
+		if !ok {
+			t.Errorf("name %s not resolvable", e.symbol.Name)
+			continue
+		}
+		if res != e.symbol {
+			t.Errorf("expected %s to resolve to %+v, got=%+v",
+				e.symbol.Name, e.symbol, res)
+		}
+	}
+}
+
+func TestDefineAndResolveFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineFunctionName("a")
+
+	expected := Symbol{Name: "a", Scope: FunctionScope, Index: 0}
+
+	res, ok := global.Resolve(expected.Name)
+	if !ok {
+		t.Fatalf("function name %s not resolvable", expected.Name)
+	}
+
+	if res != expected {
+		t.Errorf("expected %s to resolve to %+v, got=%+v",
+			expected.Name, expected, res)
+	}
+}
+
+func TestShadowingFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineFunctionName("a")
+	global.Define("a")
+
+	expected := Symbol{Name: "a", Scope: GlobalScope, Index: 0}
+
+	res, ok := global.Resolve(expected.Name)
+	if !ok {
+		t.Fatalf("function name %s not resolvable", expected.Name)
+	}
+
+	if res != expected {
+		t.Errorf("expected %s to resolve to %+v, got=%+v",
+			expected.Name, expected, res)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	copied := global.Copy()
+	b := copied.Define("b")
+	if b != (Symbol{Name: "b", Scope: GlobalScope, Index: 1}) {
+		t.Errorf("wrong symbol defined in copy. got=%+v", b)
+	}
+	if _, ok := copied.Resolve("a"); !ok {
+		t.Errorf("a not resolvable in copy")
+	}
+
+	if _, ok := global.Resolve("b"); ok {
+		t.Errorf("b defined in copy is resolvable in original")
+	}
+	if c := global.Define("c"); c.Index != 1 {
+		t.Errorf("wrong index for symbol defined in original. got=%d, want=1", c.Index)
+	}
+}
+
+func TestForget(t *testing.T) {
+	global := NewSymbolTable()
+	a := global.Define("a")
+	global.Define("b")
+
+	copied := global.Copy()
+	copied.Define("a")
+	c := copied.Define("c")
+	copied.Define("d")
+
+	copied.Forget(global, func(symbol Symbol) bool { return symbol == c })
+
+	if got, _ := copied.Resolve("a"); got != a {
+		t.Errorf("a not restored. got=%+v, want=%+v", got, a)
+	}
+	if _, ok := copied.Resolve("b"); !ok {
+		t.Errorf("b defined before the copy was forgotten")
+	}
+	if got, _ := copied.Resolve("c"); got != c {
+		t.Errorf("c forgotten though it was set. got=%+v", got)
+	}
+	if _, ok := copied.Resolve("d"); ok {
+		t.Errorf("d not forgotten")
+	}
+	if e := copied.Define("e"); e.Index != 5 {
+		t.Errorf("wrong index for symbol defined after forgetting. got=%d, want=5", e.Index)
+	}
+}
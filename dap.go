@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/dap"
+	"os"
+)
+
+const dapUsage = "usage: monkey dap"
+
+// Implements `monkey dap`, which serves the Debug Adapter Protocol on the
+// standard streams, for an editor to debug scripts with.
+func dapCommand(args []string) int {
+	flags := flag.NewFlagSet("dap", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), dapUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	if err := dap.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "monkey: %s\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,206 @@
+package dap
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/types"
+	"monkey/vm"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A script compiled for debugging, with what the debugger needs to know
+// about it that the bytecode alone doesn't say.
+type program struct {
+	path     string // absolute
+	bytecode *compiler.Bytecode
+	// The names of the globals, by index, as the symbol table numbers
+	// them. Globals without a name, like those holding modules, are "".
+	globals []string
+}
+
+// A place in the bytecode: the offset of an instruction in a function.
+type location struct {
+	function int // its index in the constant pool, or vm.MainFunction
+	ip       int
+}
+
+// Reads, checks and compiles the script at path as `monkey run` does, but
+// without optimizing the bytecode, so that it follows the source closely.
+// The error lists every problem found, one per line, each with its position
+// prefixed by the file it is in.
+func load(path string) (*program, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+
+	p := parser.New(lexer.New(string(src)))
+	parsed := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		lines := make([]string, len(p.Errors()))
+		for i, err := range p.Errors() {
+			lines[i] = path + ":" + err.Error()
+		}
+		return nil, fmt.Errorf("%s", strings.Join(lines, "\n"))
+	}
+
+	env := object.NewEnvironment()
+	env.SetImportDir(dir)
+	evaluator.DefineMacros(parsed, env)
+	expanded, expandErr := evaluator.ExpandMacros(parsed, env)
+	if expandErr != nil {
+		if expandErr.Line != 0 {
+			return nil, fmt.Errorf("%s:%d:%d: %s", path, expandErr.Line, expandErr.Column, expandErr.Inspect())
+		}
+		return nil, fmt.Errorf("%s: %s", path, expandErr.Inspect())
+	}
+	script := expanded.(*ast.Program)
+
+	if errs := types.Check(script); len(errs) > 0 {
+		lines := make([]string, len(errs))
+		for i, err := range errs {
+			lines[i] = path + ":" + err.Error()
+		}
+		return nil, fmt.Errorf("%s", strings.Join(lines, "\n"))
+	}
+
+	// The symbol table is kept for the names of the globals.
+	symbols := compiler.NewSymbolTable()
+	for i, b := range object.Builtins {
+		symbols.DefineBuiltin(i, b.Name)
+	}
+	comp := compiler.NewWithState(symbols, []object.Object{})
+	comp.SetImportDir(dir)
+	comp.SetFolding(false)
+	comp.SetPeephole(false)
+	comp.SetSuperinstructions(false)
+	if err := comp.Compile(script); err != nil {
+		return nil, compileError(path, err)
+	}
+
+	return &program{
+		path:     path,
+		bytecode: comp.Bytecode(),
+		globals:  symbols.Names(),
+	}, nil
+}
+
+// Prefixes the positions in an error compiling the script at path with the
+// file they are in, as `monkey run` reports them. Errors in imported modules
+// are already prefixed with the module they are in.
+func compileError(path string, err error) error {
+	switch err := err.(type) {
+	case *compiler.ArityError:
+		if err.Module == "" {
+			return fmt.Errorf("%s:%s", path, err)
+		}
+		return err
+	case *compiler.UndefinedError:
+		lines := make([]string, len(err.Identifiers))
+		for i, ident := range err.Identifiers {
+			lines[i] = ident.String()
+			if ident.Module == "" {
+				lines[i] = path + ":" + lines[i]
+			}
+		}
+		return fmt.Errorf("%s", strings.Join(lines, "\n"))
+	default:
+		return fmt.Errorf("%s: %s", path, err)
+	}
+}
+
+// Returns the function at index fn in the constant pool, or the main
+// program as a function if fn is vm.MainFunction.
+func (p *program) function(fn int) *object.CompiledFunction {
+	if fn == vm.MainFunction {
+		return &object.CompiledFunction{
+			Instructions: p.bytecode.Instructions,
+			SourceMap:    p.bytecode.SourceMap,
+		}
+	}
+	compiled, _ := p.bytecode.Constants[fn].(*object.CompiledFunction)
+	return compiled
+}
+
+// Returns the indices of the main program and of the functions in the
+// constant pool.
+func (p *program) functions() []int {
+	fns := []int{vm.MainFunction}
+	for i, constant := range p.bytecode.Constants {
+		if _, ok := constant.(*object.CompiledFunction); ok {
+			fns = append(fns, i)
+		}
+	}
+	return fns
+}
+
+// Returns the path of the file the function at index fn was compiled from,
+// or "" for a module of the standard library, which isn't a file.
+func (p *program) sourcePath(fn int) string {
+	module := p.function(fn).Module
+	switch {
+	case module == "":
+		return p.path
+	case filepath.IsAbs(module):
+		return module
+	default:
+		return ""
+	}
+}
+
+// Returns where execution reaches line of the file at path: the first
+// instruction compiled from the line in each function that has any. A line
+// may be in several functions, as in `let f = fn() { 1 };`, which creates
+// the function in one and returns 1 in the other.
+func (p *program) locations(path string, line int) []location {
+	var locations []location
+	for _, fn := range p.functions() {
+		if !samePath(p.sourcePath(fn), path) {
+			continue
+		}
+		for _, pos := range p.function(fn).SourceMap {
+			if pos.Line == line {
+				locations = append(locations, location{function: fn, ip: pos.Offset})
+				break
+			}
+		}
+	}
+	return locations
+}
+
+// Reports whether the instruction at offset ip of the function at index fn
+// is the first compiled from its position in the source.
+func (p *program) startsPosition(fn, ip int) bool {
+	for _, pos := range p.function(fn).SourceMap {
+		if pos.Offset == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the program includes the file at path.
+func (p *program) includes(path string) bool {
+	for _, fn := range p.functions() {
+		if samePath(p.sourcePath(fn), path) {
+			return true
+		}
+	}
+	return false
+}
+
+func samePath(a, b string) bool {
+	return a != "" && b != "" && filepath.Clean(a) == filepath.Clean(b)
+}
@@ -0,0 +1,730 @@
+// Package dap implements the Debug Adapter Protocol for Monkey scripts, so
+// that editors like VS Code can debug them: set breakpoints, step through
+// the code and inspect the variables of each call as the VM runs it.
+//
+// A Server talks to a single client, usually over the standard streams of
+// `monkey dap`, and debugs the script its launch request names. Output of
+// the script is sent to the client as output events, and the script's
+// standard input is empty.
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"monkey/object"
+	"monkey/vm"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The script runs as the only thread.
+const threadID = 1
+
+type Server struct {
+	in *bufio.Reader
+
+	// Guards out, which the script's output is written to as well.
+	writeMu sync.Mutex
+	out     io.Writer
+	seq     int
+
+	// Guards the state below, which the script changes as it runs in the
+	// background.
+	mu sync.Mutex
+
+	linesStartAt1   bool
+	columnsStartAt1 bool
+
+	program     *program
+	machine     *vm.VM
+	noDebug     bool
+	stopOnEntry bool
+
+	// The breakpoints set by the client, by the path of their file. Those
+	// set while the script runs are only set in the VM once it stops.
+	breakpoints map[string][]location
+	stops       map[location]bool // all of them, to stop at when stepping
+	pending     bool              // they have changed since the script last stopped
+
+	running bool
+	done    chan struct{} // closed once the script stops running, if it is
+	failed  error         // the error the script stopped with, which ends it once it resumes
+	ended   bool
+
+	// What the client inspects at a stop: the calls in progress, innermost
+	// first, and the variables it can expand, by reference minus one.
+	frames     []vm.FrameInfo
+	references []func() []variable
+
+	// Done once the client disconnects, which stops the script.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// What to do once the response to the request being handled is sent,
+	// like sending the events that follow from it.
+	after []func()
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		in:              bufio.NewReader(in),
+		out:             out,
+		linesStartAt1:   true,
+		columnsStartAt1: true,
+		breakpoints:     map[string][]location{},
+		stops:           map[location]bool{},
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+}
+
+// Handles requests until the client disconnects or closes its stream, which
+// stops the script.
+func (s *Server) Serve() error {
+	defer s.stop()
+
+	for {
+		req, err := readMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+
+		body, err := s.handle(req)
+		s.respond(req, body, err)
+		for _, f := range s.after {
+			f()
+		}
+		s.after = nil
+		if req.Command == "disconnect" {
+			return nil
+		}
+	}
+}
+
+var errRunning = errors.New("the script is running")
+
+// Handles a request, returning the body of its response.
+func (s *Server) handle(req *request) (interface{}, error) {
+	switch req.Command {
+	case "initialize":
+		var args initializeArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.linesStartAt1 = args.LinesStartAt1 == nil || *args.LinesStartAt1
+		s.columnsStartAt1 = args.ColumnsStartAt1 == nil || *args.ColumnsStartAt1
+		s.mu.Unlock()
+		return capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsTerminateRequest:         true,
+		}, nil
+
+	case "launch":
+		var args launchArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		if err := s.launch(args); err != nil {
+			return nil, err
+		}
+		// The client sends its breakpoints once it is told the server is
+		// ready for them.
+		s.after = append(s.after, func() { s.send(&event{Type: "event", Event: "initialized"}) })
+		return nil, nil
+
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		lines := args.Lines
+		if args.Breakpoints != nil {
+			lines = make([]int, len(args.Breakpoints))
+			for i, b := range args.Breakpoints {
+				lines[i] = b.Line
+			}
+		}
+		return map[string]interface{}{"breakpoints": s.setBreakpoints(args.Source.Path, lines)}, nil
+
+	case "setExceptionBreakpoints":
+		// The script always stops when it fails.
+		return map[string]interface{}{}, nil
+
+	case "configurationDone":
+		return nil, s.configurationDone()
+
+	case "threads":
+		return map[string]interface{}{"threads": []thread{{ID: threadID, Name: "main"}}}, nil
+
+	case "stackTrace":
+		var args stackTraceArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		return s.stackTrace(args)
+
+	case "scopes":
+		var args scopesArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		return s.scopes(args.FrameID)
+
+	case "variables":
+		var args variablesArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		return s.variables(args.VariablesReference)
+
+	case "continue":
+		return map[string]interface{}{"allThreadsContinued": true}, s.resume(s.continueScript)
+	case "next":
+		return nil, s.resume(func() (string, error) { return s.step(stepOver) })
+	case "stepIn":
+		return nil, s.resume(func() (string, error) { return s.step(stepIn) })
+	case "stepOut":
+		return nil, s.resume(func() (string, error) { return s.step(stepOut) })
+	case "pause":
+		return nil, errors.New("pausing is not supported; set a breakpoint instead")
+
+	case "terminate":
+		s.stop()
+		s.after = append(s.after, func() { s.end(-1) })
+		return nil, nil
+	case "disconnect":
+		s.stop()
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported request %q", req.Command)
+	}
+}
+
+func decode(req *request, args interface{}) error {
+	if len(req.Arguments) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(req.Arguments, args); err != nil {
+		return fmt.Errorf("bad arguments for %s: %s", req.Command, err)
+	}
+	return nil
+}
+
+func (s *Server) launch(args launchArguments) error {
+	if args.Program == "" {
+		return errors.New("no program to debug")
+	}
+	program, err := load(args.Program)
+	if err != nil {
+		return err
+	}
+
+	machine := vm.New(program.bytecode)
+	machine.SetStdout(&output{s: s, category: "stdout"})
+	machine.SetStdin(strings.NewReader(""))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.program = program
+	s.machine = machine
+	s.noDebug = args.NoDebug
+	s.stopOnEntry = args.StopOnEntry && !args.NoDebug
+	return nil
+}
+
+// Replaces the breakpoints in the file at path with those at lines, as
+// client lines, returning them as set. Lines with no code can't have
+// breakpoints.
+func (s *Server) setBreakpoints(path string, lines []int) []breakpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	breakpoints := make([]breakpoint, len(lines))
+	var locations []location
+	for i, clientLine := range lines {
+		breakpoints[i] = breakpoint{Line: clientLine}
+		switch {
+		case s.program == nil:
+			breakpoints[i].Message = "the script hasn't been launched"
+		case s.noDebug:
+			breakpoints[i].Message = "the script is run without debugging"
+		case !s.program.includes(path):
+			breakpoints[i].Message = "the file isn't part of the script"
+		default:
+			found := s.program.locations(path, s.fromClientLine(clientLine))
+			if len(found) == 0 {
+				breakpoints[i].Message = "no code on this line"
+			}
+			breakpoints[i].Verified = len(found) > 0
+			locations = append(locations, found...)
+		}
+	}
+
+	if len(locations) == 0 {
+		delete(s.breakpoints, path)
+	} else {
+		s.breakpoints[path] = locations
+	}
+	s.stops = map[location]bool{}
+	for _, locations := range s.breakpoints {
+		for _, l := range locations {
+			s.stops[l] = true
+		}
+	}
+	s.pending = true
+	if !s.running {
+		s.updateBreakpoints()
+	}
+	return breakpoints
+}
+
+// Sets the VM's breakpoints to those the client has set.
+func (s *Server) updateBreakpoints() {
+	if !s.pending || s.machine == nil {
+		return
+	}
+	s.pending = false
+	for _, fn := range s.program.functions() {
+		for _, pos := range s.program.function(fn).SourceMap {
+			s.machine.ClearBreakpoint(fn, pos.Offset)
+		}
+	}
+	for l := range s.stops {
+		s.machine.SetBreakpoint(l.function, l.ip)
+	}
+}
+
+// Starts the script, or stops it at its first instruction if the client
+// asked for that when launching it.
+func (s *Server) configurationDone() error {
+	s.mu.Lock()
+	if s.machine == nil {
+		s.mu.Unlock()
+		return errors.New("the script hasn't been launched")
+	}
+	stopOnEntry := s.stopOnEntry
+	s.mu.Unlock()
+
+	if stopOnEntry {
+		s.after = append(s.after, func() { s.stopped("entry", "") })
+		return nil
+	}
+	return s.resume(s.continueScript)
+}
+
+// Continues the script in the background with run, once the response to
+// the request is sent. run returns why the script stopped, if it did, or
+// the error that ended it. The client is told when it stops or ends.
+func (s *Server) resume(run func() (string, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.machine == nil:
+		return errors.New("the script hasn't been launched")
+	case s.running:
+		return errRunning
+	case s.ended:
+		return errors.New("the script has ended")
+	}
+
+	// A script that failed ends once the client has seen where.
+	if s.failed != nil {
+		err := s.failed
+		s.after = append(s.after, func() {
+			s.output("stderr", s.describe(err)+"\n")
+			s.end(1)
+		})
+		return nil
+	}
+
+	s.running = true
+	s.frames = nil
+	s.references = nil
+	done := make(chan struct{})
+	s.done = done
+	s.after = append(s.after, func() { go s.run(run, done) })
+	return nil
+}
+
+// Runs the script with run, then tells the client why it stopped, or that
+// it ended, unless the client has disconnected.
+func (s *Server) run(run func() (string, error), done chan struct{}) {
+	defer close(done)
+	reason, err := run()
+
+	s.mu.Lock()
+	s.running = false
+	s.updateBreakpoints()
+	finished := s.machine.Finished()
+	s.mu.Unlock()
+
+	var exit *object.Exit
+	switch {
+	case s.ctx.Err() != nil:
+	case errors.As(err, &exit):
+		s.end(int(exit.Code))
+	case err != nil:
+		s.mu.Lock()
+		s.failed = err
+		s.mu.Unlock()
+		s.stopped("exception", err.Error())
+	case reason != "" && !finished:
+		s.stopped(reason, "")
+	default:
+		s.end(0)
+	}
+}
+
+// Stops the script, if it is running, and waits for it to stop.
+func (s *Server) stop() {
+	s.cancel()
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Runs the script until it reaches a breakpoint or ends.
+func (s *Server) continueScript() (string, error) {
+	if s.noDebug {
+		return "", s.machine.RunContext(s.ctx)
+	}
+
+	// Run would stop right away at a breakpoint the script has stopped at
+	// by stepping onto it.
+	if s.atStop() {
+		if err := s.machine.Step(); err != nil {
+			return "", err
+		}
+	}
+
+	var b *vm.Breakpoint
+	if err := s.machine.RunContext(s.ctx); !errors.As(err, &b) {
+		return "", err
+	}
+	return "breakpoint", nil
+}
+
+type stepKind int
+
+const (
+	stepOver stepKind = iota // to the next line of the call, or back to its caller
+	stepIn                   // as stepOver, or into a call it makes
+	stepOut                  // back to the caller
+)
+
+// Runs the script an instruction at a time until it reaches a line as kind
+// says, or a breakpoint, or ends. Lines are only reached at instructions
+// whose position in the source is known.
+func (s *Server) step(kind stepKind) (string, error) {
+	frames := s.machine.Frames()
+	depth := len(frames)
+	start := frames[depth-1]
+	last := start.IP
+
+	for {
+		if err := s.ctx.Err(); err != nil {
+			return "", err
+		}
+		if err := s.machine.Step(); err != nil {
+			return "", err
+		}
+		if s.machine.Finished() {
+			return "", nil
+		}
+		if s.atStop() {
+			return "breakpoint", nil
+		}
+
+		frames = s.machine.Frames()
+		top := frames[len(frames)-1]
+		if top.Line == 0 {
+			continue
+		}
+		switch {
+		case len(frames) < depth:
+			return "step", nil
+		case len(frames) > depth:
+			if kind == stepIn {
+				return "step", nil
+			}
+		case kind != stepOut:
+			// A loop on a single line reaches it again by jumping back.
+			if top.Line != start.Line || top.IP < last && s.program.startsPosition(top.Function, top.IP) {
+				return "step", nil
+			}
+			last = top.IP
+		}
+	}
+}
+
+// Reports whether the script is at one of the client's breakpoints.
+func (s *Server) atStop() bool {
+	frames := s.machine.Frames()
+	top := frames[len(frames)-1]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stops[location{function: top.Function, ip: top.IP}]
+}
+
+// Tells the client the script has stopped, and why.
+func (s *Server) stopped(reason, text string) {
+	s.mu.Lock()
+	s.frames = s.machine.Frames()
+	s.references = nil
+	s.mu.Unlock()
+
+	s.send(&event{Type: "event", Event: "stopped", Body: stoppedEvent{
+		Reason:            reason,
+		Text:              text,
+		ThreadID:          threadID,
+		AllThreadsStopped: true,
+	}})
+}
+
+// Tells the client the script has ended, with the exit code, if there is
+// one, which there isn't once the client has terminated it.
+func (s *Server) end(code int) {
+	s.mu.Lock()
+	ended := s.ended
+	s.ended = true
+	s.mu.Unlock()
+	if ended {
+		return
+	}
+
+	if code >= 0 {
+		s.send(&event{Type: "event", Event: "exited", Body: exitedEvent{ExitCode: code}})
+	}
+	s.send(&event{Type: "event", Event: "terminated"})
+}
+
+// Describes the error the script failed with as `monkey run` reports it,
+// with its position and the calls in progress.
+func (s *Server) describe(err error) string {
+	runtimeErr, ok := err.(*vm.RuntimeError)
+	if !ok {
+		return s.program.path + ": " + err.Error()
+	}
+	msg := (&object.Error{Message: runtimeErr.Message, Stack: runtimeErr.Stack}).Inspect()
+	if runtimeErr.Line == 0 {
+		return s.program.path + ": " + msg
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", s.program.path, runtimeErr.Line, runtimeErr.Column, msg)
+}
+
+// Returns the calls in progress where the script stopped, innermost first.
+// Frame IDs count from 1, for the main program.
+func (s *Server) stackTrace(args stackTraceArguments) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return nil, errRunning
+	}
+
+	frames := []stackFrame{}
+	for i := len(s.frames) - 1; i >= 0; i-- {
+		info := s.frames[i]
+		frame := stackFrame{
+			ID:     i + 1,
+			Name:   info.Name,
+			Line:   s.toClientLine(info.Line),
+			Column: s.toClientColumn(info.Column),
+		}
+		if path := s.program.sourcePath(info.Function); path != "" {
+			frame.Source = &source{Name: filepath.Base(path), Path: path}
+		} else {
+			frame.Source = &source{Name: s.program.function(info.Function).Module}
+		}
+		frames = append(frames, frame)
+	}
+
+	total := len(frames)
+	if args.StartFrame > 0 {
+		frames = frames[min(args.StartFrame, len(frames)):]
+	}
+	if args.Levels > 0 && args.Levels < len(frames) {
+		frames = frames[:args.Levels]
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": total}, nil
+}
+
+// Returns the scopes of the variables of the frame with ID id: the call's
+// locals and the variables its closure captured, if any, and the globals.
+func (s *Server) scopes(id int) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return nil, errRunning
+	}
+	if id < 1 || id > len(s.frames) {
+		return nil, fmt.Errorf("no frame %d", id)
+	}
+
+	info := s.frames[id-1]
+	fn := s.program.function(info.Function)
+	scopes := []scope{}
+	if id > 1 {
+		locals := s.reference(func() []variable { return s.named(fn.LocalNames, info.Locals) })
+		scopes = append(scopes, scope{Name: "Locals", PresentationHint: "locals", VariablesReference: locals})
+	}
+	if len(info.Free) > 0 {
+		free := s.reference(func() []variable { return s.named(fn.FreeNames, info.Free) })
+		scopes = append(scopes, scope{Name: "Closure", VariablesReference: free})
+	}
+	globals := s.reference(func() []variable { return s.named(s.program.globals, s.machine.Globals()) })
+	scopes = append(scopes, scope{Name: "Globals", VariablesReference: globals})
+	return map[string]interface{}{"scopes": scopes}, nil
+}
+
+// Returns the variables with reference ref.
+func (s *Server) variables(ref int) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return nil, errRunning
+	}
+	if ref < 1 || ref > len(s.references) {
+		return nil, fmt.Errorf("no variables with reference %d", ref)
+	}
+	return map[string]interface{}{"variables": s.references[ref-1]()}, nil
+}
+
+// Adds variables to those the client can ask for until the script
+// resumes, returning their reference.
+func (s *Server) reference(variables func() []variable) int {
+	s.references = append(s.references, variables)
+	return len(s.references)
+}
+
+// Returns the variables with the values at the indices of their names.
+// Those without a name, or a value yet, are left out.
+func (s *Server) named(names []string, values []object.Object) []variable {
+	variables := []variable{}
+	for i, name := range names {
+		if name == "" || i >= len(values) || values[i] == nil {
+			continue
+		}
+		value := values[i]
+		if cell, ok := value.(*object.Cell); ok {
+			// A global of a block that a closure captured.
+			value = cell.Value
+		}
+		variables = append(variables, s.variable(name, value))
+	}
+	return variables
+}
+
+// Returns a variable with the value obj. The elements of arrays and the
+// pairs of hashes are variables of their own, that the client can expand.
+func (s *Server) variable(name string, obj object.Object) variable {
+	v := variable{Name: name, Value: obj.Inspect(), Type: string(obj.Type())}
+	switch obj := obj.(type) {
+	case *object.Array:
+		if len(obj.Elements) > 0 {
+			v.VariablesReference = s.reference(func() []variable {
+				elements := make([]variable, len(obj.Elements))
+				for i, element := range obj.Elements {
+					elements[i] = s.variable(fmt.Sprintf("[%d]", i), element)
+				}
+				return elements
+			})
+		}
+	case *object.Hash:
+		if len(obj.Pairs) > 0 {
+			v.VariablesReference = s.reference(func() []variable {
+				pairs := obj.SortedPairs()
+				variables := make([]variable, len(pairs))
+				for i, pair := range pairs {
+					variables[i] = s.variable(pair.Key.Inspect(), pair.Value)
+				}
+				return variables
+			})
+		}
+	}
+	return v
+}
+
+func (s *Server) toClientLine(line int) int {
+	if !s.linesStartAt1 {
+		return line - 1
+	}
+	return line
+}
+
+func (s *Server) fromClientLine(line int) int {
+	if !s.linesStartAt1 {
+		return line + 1
+	}
+	return line
+}
+
+func (s *Server) toClientColumn(column int) int {
+	if !s.columnsStartAt1 {
+		return column - 1
+	}
+	return column
+}
+
+func (s *Server) respond(req *request, body interface{}, err error) {
+	resp := &response{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    err == nil,
+		Command:    req.Command,
+		Body:       body,
+	}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	s.send(resp)
+}
+
+// Sends a response or an event, numbering it.
+func (s *Server) send(msg interface{}) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.seq++
+	switch msg := msg.(type) {
+	case *response:
+		msg.Seq = s.seq
+	case *event:
+		msg.Seq = s.seq
+	}
+	// The client has gone if this fails, which Serve finds out.
+	writeMessage(s.out, msg)
+}
+
+func (s *Server) output(category, text string) {
+	s.send(&event{Type: "event", Event: "output", Body: outputEvent{Category: category, Output: text}})
+}
+
+// Sends what the script writes to the client as output events.
+type output struct {
+	s        *Server
+	category string
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.s.output(o.category, string(p))
+	return len(p), nil
+}
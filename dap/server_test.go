@@ -0,0 +1,425 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A client talking to a Server over pipes, as an editor would.
+type client struct {
+	t      *testing.T
+	w      io.WriteCloser
+	r      *bufio.Reader
+	seq    int
+	queue  []map[string]interface{} // events read while waiting for responses
+	served chan error
+}
+
+func newClient(t *testing.T) *client {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &client{t: t, w: inW, r: bufio.NewReader(outR), served: make(chan error, 1)}
+	go func() {
+		c.served <- NewServer(inR, outW).Serve()
+		outW.Close()
+	}()
+	t.Cleanup(func() {
+		inW.Close()
+		select {
+		case <-c.served:
+		case <-time.After(5 * time.Second):
+			t.Errorf("server didn't stop")
+		}
+	})
+	return c
+}
+
+func (c *client) read() map[string]interface{} {
+	c.t.Helper()
+
+	done := make(chan map[string]interface{}, 1)
+	go func() {
+		header, err := textproto.NewReader(c.r).ReadMIMEHeader()
+		if err != nil {
+			done <- nil
+			return
+		}
+		length, _ := strconv.Atoi(header.Get("Content-Length"))
+		content := make([]byte, length)
+		if _, err := io.ReadFull(c.r, content); err != nil {
+			done <- nil
+			return
+		}
+		var msg map[string]interface{}
+		json.Unmarshal(content, &msg)
+		done <- msg
+	}()
+
+	select {
+	case msg := <-done:
+		if msg == nil {
+			c.t.Fatalf("server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("no message from the server")
+		return nil
+	}
+}
+
+// Sends a request and returns its response.
+func (c *client) request(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+
+	c.seq++
+	if err := writeMessage(c.w, map[string]interface{}{
+		"seq": c.seq, "type": "request", "command": command, "arguments": args,
+	}); err != nil {
+		c.t.Fatalf("writing %s: %s", command, err)
+	}
+	for {
+		msg := c.read()
+		if msg["type"] == "response" && msg["request_seq"] == float64(c.seq) {
+			return msg
+		}
+		c.queue = append(c.queue, msg)
+	}
+}
+
+// Sends a request and returns the body of its response, which must succeed.
+func (c *client) call(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+
+	resp := c.request(command, args)
+	if resp["success"] != true {
+		c.t.Fatalf("%s failed: %v", command, resp["message"])
+	}
+	body, _ := resp["body"].(map[string]interface{})
+	return body
+}
+
+// Returns the body of the next event called name, skipping the output
+// events before it, whose output is appended to output.
+func (c *client) event(name string, output *strings.Builder) map[string]interface{} {
+	c.t.Helper()
+
+	for {
+		var msg map[string]interface{}
+		if len(c.queue) > 0 {
+			msg, c.queue = c.queue[0], c.queue[1:]
+		} else {
+			msg = c.read()
+		}
+		body, _ := msg["body"].(map[string]interface{})
+		if msg["event"] == name {
+			return body
+		}
+		if msg["event"] == "output" && output != nil {
+			output.WriteString(body["output"].(string))
+			continue
+		}
+		if msg["event"] != "output" {
+			c.t.Fatalf("got %v, want %s event", msg, name)
+		}
+	}
+}
+
+// Starts debugging a script with src, returning its path.
+func (c *client) launch(src string, args map[string]interface{}) string {
+	c.t.Helper()
+
+	path := filepath.Join(c.t.TempDir(), "script.monkey")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		c.t.Fatal(err)
+	}
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	args["program"] = path
+
+	c.call("initialize", map[string]interface{}{"adapterID": "monkey"})
+	c.call("launch", args)
+	c.event("initialized", nil)
+	return path
+}
+
+// Returns the name and line of each frame of the stopped script, innermost
+// first.
+func (c *client) stackTrace() []string {
+	c.t.Helper()
+
+	body := c.call("stackTrace", map[string]interface{}{"threadId": threadID})
+	var frames []string
+	for _, f := range body["stackFrames"].([]interface{}) {
+		frame := f.(map[string]interface{})
+		frames = append(frames, frame["name"].(string)+":"+strconv.Itoa(int(frame["line"].(float64))))
+	}
+	return frames
+}
+
+// Returns the variables of each scope of the frame with ID id, by scope,
+// as name=value.
+func (c *client) scopes(id int) map[string][]string {
+	c.t.Helper()
+
+	scopes := map[string][]string{}
+	body := c.call("scopes", map[string]interface{}{"frameId": id})
+	for _, s := range body["scopes"].([]interface{}) {
+		scope := s.(map[string]interface{})
+		scopes[scope["name"].(string)] = c.variables(int(scope["variablesReference"].(float64)))
+	}
+	return scopes
+}
+
+func (c *client) variables(ref int) []string {
+	c.t.Helper()
+
+	body := c.call("variables", map[string]interface{}{"variablesReference": ref})
+	variables := []string{}
+	for _, v := range body["variables"].([]interface{}) {
+		variable := v.(map[string]interface{})
+		variables = append(variables, variable["name"].(string)+"="+variable["value"].(string))
+	}
+	return variables
+}
+
+func expectStrings(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrong %s.\nwant=%q\ngot= %q", what, want, got)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	c := newClient(t)
+	path := c.launch(`let add = fn(a, b) {
+  let sum = a + b;
+  sum
+};
+
+let x = [1, 2];
+let y = add(x[0], 10);
+puts(y);
+`, nil)
+
+	body := c.call("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": path},
+		"breakpoints": []map[string]interface{}{{"line": 2}, {"line": 5}, {"line": 8}},
+	})
+	var verified []bool
+	for _, b := range body["breakpoints"].([]interface{}) {
+		verified = append(verified, b.(map[string]interface{})["verified"].(bool))
+	}
+	if len(verified) != 3 || !verified[0] || verified[1] || !verified[2] {
+		t.Errorf("wrong breakpoints verified: %v", verified)
+	}
+
+	c.call("configurationDone", nil)
+	if stopped := c.event("stopped", nil); stopped["reason"] != "breakpoint" {
+		t.Errorf("stopped for %v", stopped["reason"])
+	}
+	expectStrings(t, "stack", c.stackTrace(), []string{"add:2", "main:7"})
+
+	scopes := c.scopes(2)
+	expectStrings(t, "locals", scopes["Locals"], []string{"a=1", "b=10"})
+	expectStrings(t, "globals", scopes["Globals"], []string{"add=Closure[add, params=2, locals=3, free=0]", "x=[1, 2]"})
+	if _, ok := scopes["Closure"]; ok {
+		t.Errorf("add has no free variables")
+	}
+
+	// Arrays can be expanded.
+	globals := c.call("variables", map[string]interface{}{"variablesReference": 2})
+	x := globals["variables"].([]interface{})[1].(map[string]interface{})
+	expectStrings(t, "elements", c.variables(int(x["variablesReference"].(float64))), []string{"[0]=1", "[1]=2"})
+
+	c.call("continue", map[string]interface{}{"threadId": threadID})
+	var output strings.Builder
+	c.event("stopped", &output)
+	expectStrings(t, "stack", c.stackTrace(), []string{"main:8"})
+	expectStrings(t, "globals", c.scopes(1)["Globals"], []string{"add=Closure[add, params=2, locals=3, free=0]", "x=[1, 2]", "y=11"})
+
+	c.call("continue", map[string]interface{}{"threadId": threadID})
+	if exited := c.event("exited", &output); exited["exitCode"] != float64(0) {
+		t.Errorf("exited with %v", exited["exitCode"])
+	}
+	c.event("terminated", nil)
+	if output.String() != "11\n" {
+		t.Errorf("wrong output %q", output.String())
+	}
+	c.call("disconnect", nil)
+}
+
+func TestStepping(t *testing.T) {
+	c := newClient(t)
+	c.launch(`let double = fn(n) {
+  let m = n * 2;
+  m
+};
+let a = double(1);
+let b = double(a);
+let i = 0;
+while (i < 2) { i = i + 1 }
+`, map[string]interface{}{"stopOnEntry": true})
+	c.call("configurationDone", nil)
+	if stopped := c.event("stopped", nil); stopped["reason"] != "entry" {
+		t.Errorf("stopped for %v", stopped["reason"])
+	}
+
+	steps := []struct {
+		command  string
+		expected []string
+	}{
+		{"next", []string{"main:5"}},
+		{"next", []string{"main:6"}},
+		{"stepIn", []string{"double:2", "main:6"}},
+		{"next", []string{"double:3", "main:6"}},
+		{"stepOut", []string{"main:6"}},
+		{"next", []string{"main:7"}},
+		{"next", []string{"main:8"}},
+		// Each time around the loop.
+		{"next", []string{"main:8"}},
+		{"next", []string{"main:8"}},
+	}
+	for _, step := range steps {
+		c.call(step.command, map[string]interface{}{"threadId": threadID})
+		if stopped := c.event("stopped", nil); stopped["reason"] != "step" {
+			t.Fatalf("stopped for %v after %s", stopped["reason"], step.command)
+		}
+		expectStrings(t, "stack after "+step.command, c.stackTrace(), step.expected)
+	}
+	expectStrings(t, "locals", c.scopes(1)["Globals"], []string{"double=Closure[double, params=1, locals=2, free=0]", "a=2", "b=4", "i=2"})
+
+	c.call("continue", map[string]interface{}{"threadId": threadID})
+	c.event("exited", nil)
+	c.event("terminated", nil)
+}
+
+func TestClosures(t *testing.T) {
+	c := newClient(t)
+	path := c.launch(`let counter = fn(start) {
+  let count = start;
+  fn() {
+    count + 1
+  }
+};
+let next = counter(5);
+next();
+`, nil)
+	c.call("setBreakpoints", map[string]interface{}{
+		"source": map[string]interface{}{"path": path},
+		"lines":  []int{4},
+	})
+	c.call("configurationDone", nil)
+	c.event("stopped", nil)
+
+	expectStrings(t, "stack", c.stackTrace(), []string{"<anonymous>:4", "main:8"})
+	scopes := c.scopes(2)
+	expectStrings(t, "locals", scopes["Locals"], []string{})
+	expectStrings(t, "free variables", scopes["Closure"], []string{"count=5"})
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	c := newClient(t)
+	path := c.launch(`let f = fn(x) {
+  x + "a"
+};
+f(1);
+`, nil)
+	c.call("configurationDone", nil)
+
+	stopped := c.event("stopped", nil)
+	if stopped["reason"] != "exception" || stopped["text"] != "type mismatch: INTEGER + STRING" {
+		t.Errorf("wrong stop: %v", stopped)
+	}
+	expectStrings(t, "stack", c.stackTrace(), []string{"f:2", "main:4"})
+	expectStrings(t, "locals", c.scopes(2)["Locals"], []string{"x=1"})
+
+	// The script ends once it resumes, with the error reported as
+	// `monkey run` does.
+	c.call("next", map[string]interface{}{"threadId": threadID})
+	var output strings.Builder
+	if exited := c.event("exited", &output); exited["exitCode"] != float64(1) {
+		t.Errorf("exited with %v", exited["exitCode"])
+	}
+	c.event("terminated", nil)
+	if !strings.HasPrefix(output.String(), path+":2:5: Error: type mismatch: INTEGER + STRING") {
+		t.Errorf("wrong output %q", output.String())
+	}
+}
+
+func TestExit(t *testing.T) {
+	c := newClient(t)
+	path := c.launch(`puts("bye");
+exit(3);
+`, map[string]interface{}{"noDebug": true})
+
+	body := c.call("setBreakpoints", map[string]interface{}{
+		"source": map[string]interface{}{"path": path},
+		"lines":  []int{2},
+	})
+	if body["breakpoints"].([]interface{})[0].(map[string]interface{})["verified"] != false {
+		t.Errorf("breakpoint set without debugging")
+	}
+
+	c.call("configurationDone", nil)
+	var output strings.Builder
+	if exited := c.event("exited", &output); exited["exitCode"] != float64(3) {
+		t.Errorf("exited with %v", exited["exitCode"])
+	}
+	c.event("terminated", nil)
+	if output.String() != "bye\n" {
+		t.Errorf("wrong output %q", output.String())
+	}
+}
+
+func TestLaunchErrors(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"syntax.monkey":    "let x = ;",
+		"undefined.monkey": "let x = y;",
+		"types.monkey":     `let x: int = "a";`,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		program  string
+		expected string
+	}{
+		{"", "no program to debug"},
+		{"syntax.monkey", "syntax.monkey:1:9: no prefix parse function for ; found"},
+		{"undefined.monkey", "undefined.monkey:1:9: identifier not found: y"},
+		{"types.monkey", "types.monkey:1:14: cannot use str as int in declaration of x"},
+	}
+	for _, tt := range tests {
+		c := newClient(t)
+		c.call("initialize", nil)
+		program := tt.program
+		if program != "" {
+			program = filepath.Join(dir, program)
+		}
+		resp := c.request("launch", map[string]interface{}{"program": program})
+		if resp["success"] != false {
+			t.Errorf("launching %q succeeded", tt.program)
+			continue
+		}
+		expected := tt.expected
+		if tt.program != "" {
+			expected = filepath.Join(dir, expected)
+		}
+		if resp["message"] != expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.program, expected, resp["message"])
+		}
+	}
+}
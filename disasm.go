@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/compiler"
+	"os"
+	"path/filepath"
+)
+
+const disasmUsage = "usage: monkey disasm [-optimize=false] script.monkey|program.mbc"
+
+// Implements `monkey disasm`, which prints the bytecode of a script, or of a
+// bytecode file written by `monkey build`.
+func disasmCommand(args []string) int {
+	flags := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	optimize := flags.Bool("optimize", true, "optimize the bytecode of scripts")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), disasmUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	path := flags.Arg(0)
+
+	var bytecode *compiler.Bytecode
+	if filepath.Ext(path) == bytecodeExt {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "monkey: %s\n", err)
+			return 1
+		}
+
+		bytecode, err = compiler.Deserialize(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			return 1
+		}
+	} else {
+		program, ok := parseScript(path)
+		if !ok {
+			return 1
+		}
+
+		comp := compiler.New()
+		comp.SetImportDir(filepath.Dir(path))
+		comp.SetFolding(*optimize)
+		comp.SetPeephole(*optimize)
+		comp.SetSuperinstructions(*optimize)
+		if err := comp.Compile(program); err != nil {
+			reportCompileError(path, err)
+			return 1
+		}
+		bytecode = comp.Bytecode()
+	}
+
+	fmt.Print(bytecode.Disassemble())
+	return 0
+}
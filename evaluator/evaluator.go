@@ -1,38 +1,41 @@
 package evaluator
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"math"
 	"monkey/ast"
+	"monkey/module"
 	"monkey/object"
 )
 
+// How deeply calls may nest unless the environment sets otherwise, which is
+// as deeply as the VM allows by default.
+const MAX_CALL_DEPTH = 1023
+
 var (
-	NULL  = &object.NULL{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.Null
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
 func newError(format string, a ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
 
+// Reports whether obj stops evaluation, which an exit, an exceeded budget or
+// a thrown value does as well as an error.
 func isError(obj object.Object) bool {
 	if obj == nil {
 		return false
 	}
-	return obj.Type() == object.ERROR_OBJ
-}
-
-func isTruthy(obj object.Object) bool {
-	switch obj {
-	case NULL:
-		return false
-	case TRUE:
+	switch obj.Type() {
+	case object.ERROR_OBJ, object.EXIT_OBJ, object.BUDGET_EXCEEDED_OBJ, object.THROWN_OBJ:
 		return true
-	case FALSE:
-		return false
 	default:
-		return true
+		return false
 	}
 }
 
@@ -51,20 +54,111 @@ func unwrapReturnValue(obj object.Object) object.Object {
 	return obj
 }
 
+// Exposes the evaluator to builtins, so they can write output and call back
+// into Monkey functions.
+type runtime struct {
+	env *object.Environment
+	// The call of the builtin, where the calls it makes are made from, or
+	// nil for calls made by the host.
+	call *ast.CallExpression
+}
+
+func (rt runtime) Stdout() io.Writer { return rt.env.Stdout() }
+
+func (rt runtime) Stdin() *bufio.Reader { return rt.env.Stdin() }
+
+func (rt runtime) Allows(c object.Capability) bool { return rt.env.Allows(c) }
+
+func (rt runtime) Context() context.Context { return rt.env.Context() }
+
+func (rt runtime) Call(fn object.Object, args ...object.Object) object.Object {
+	return applyFunction(fn, args, rt.env, rt.call)
+}
+
+// Calls a function value as a call in env would, returning its result or an
+// *object.Error. This is how hosts call Monkey functions.
+func Apply(fn object.Object, args []object.Object, env *object.Environment) object.Object {
+	return guard(env, func() object.Object {
+		res := runtime{env: env}.Call(fn, args...)
+		if thrown, ok := res.(*object.Thrown); ok {
+			return uncaught(thrown)
+		}
+		return res
+	})
+}
+
+// Returns what eval does, turning a panic in the evaluator, which a bug in
+// it or in a builtin could cause, into an error, unless env is strict. It
+// guards the ways into the evaluator, which evaluating a program and Apply
+// are.
+func guard(env *object.Environment, eval func() object.Object) (res object.Object) {
+	if !env.Strict() {
+		defer func() {
+			if r := recover(); r != nil {
+				res = newError("internal error: %v", r)
+			}
+		}()
+	}
+	return eval()
+}
+
+// Evaluates node under ctx, stopping with an error once ctx is done. The
+// context is checked on every iteration of a loop and every function call,
+// since only loops and recursion can keep a program running indefinitely.
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment) object.Object {
+	outer := env.Context()
+	env.SetContext(ctx)
+	defer env.SetContext(outer)
+
+	return Eval(node, env)
+}
+
+// Counts a newly created object against the memory limit, returning it, or
+// the exceeded budget once the limit is exceeded.
+func allocate(obj object.Object, env *object.Environment) object.Object {
+	if !env.Allocate(obj) {
+		return &object.BudgetExceeded{Budget: object.MemoryBudget, Limit: env.MemoryLimit()}
+	}
+	return obj
+}
+
+// Returns an error if the context the program runs under is done.
+func checkContext(env *object.Environment) *object.Error {
+	ctx := env.Context()
+	select {
+	case <-ctx.Done():
+		return newError("%s", ctx.Err())
+	default:
+		return nil
+	}
+}
+
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	return eval(node, env, false)
+}
+
+// Evaluates node like Eval. If tail is set, node is in tail position, the
+// last thing evaluated by the function it is in, and a call in tail
+// position within it is returned as a *tailCall rather than made.
+func eval(node ast.Node, env *object.Environment, tail bool) object.Object {
+	if !env.Step() {
+		return &object.BudgetExceeded{Budget: object.StepBudget, Limit: env.StepLimit()}
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
-		return evalProgram(node.Statements, env)
+		return guard(env, func() object.Object { return evalProgram(node.Statements, env) })
 
 	case *ast.ExpressionStatement:
-		return Eval(node.Expression, env)
+		return eval(node.Expression, env, tail)
 
 	case *ast.BlockStatement:
-		return evalBlockStatement(node, env)
+		// The names a block defines are only visible within it.
+		return evalBlockStatement(node, object.NewEnclosedEnvironment(env), tail)
 
 	case *ast.ReturnStatement:
-		val := Eval(node.ReturnValue, env)
-		if isError(val) {
+		val := eval(node.ReturnValue, env, tail)
+		if _, ok := val.(*tailCall); ok || isError(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
@@ -74,23 +168,66 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(val) {
 			return val
 		}
-		env.Set(node.Name.Value, val)
+		if node.IsConst() {
+			env.SetConst(node.Name.Value, val)
+		} else {
+			env.Set(node.Name.Value, val)
+		}
 		return nil
 
+	case *ast.DestructuringLetStatement:
+		return evalDestructuringLet(node, env)
+
+	case *ast.ImportStatement:
+		return evalImportStatement(node, env)
+
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return &object.Thrown{Value: val}
+
+	case *ast.AssignExpression:
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return evalAssignment(node.Name, val, env)
+
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
 
 	case *ast.IfExpression:
-		return evalIfExpression(node, env)
+		return evalIfExpression(node, env, tail)
+
+	case *ast.ConditionalExpression:
+		return evalConditionalExpression(node, env, tail)
+
+	case *ast.WhileExpression:
+		return evalWhileExpression(node, env)
+
+	case *ast.TryExpression:
+		return evalTryExpression(node, env)
 
 	case *ast.FunctionLiteral:
 		return &object.Function{
 			Parameters: node.Parameters,
+			Defaults:   node.Defaults,
+			Rest:       node.Rest,
 			Env:        env,
 			Body:       node.Body,
+			Name:       node.Name,
 		}
 
+	case *ast.MacroLiteral:
+		return newError("macros can only be defined by let statements at the top level")
+
 	case *ast.CallExpression:
+		if isCallOf(node, "quote") {
+			return quote(node, env)
+		}
+
 		fn := Eval(node.Function, env)
 		if isError(fn) {
 			return fn
@@ -100,17 +237,29 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
+		if tail {
+			return &tailCall{fn: fn, args: args, call: node}
+		}
 
-		return applyFunction(fn, args)
+		return applyFunction(fn, args, env, node)
 
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
+		if env.CheckedArithmetic() {
+			if err := negationOverflow(node.Operator, right); err != nil {
+				return err
+			}
+		}
 		return evalPrefixExpression(node.Operator, right)
 
 	case *ast.InfixExpression:
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, env)
+		}
+
 		left := Eval(node.Left, env)
 		if isError(left) {
 			return left
@@ -119,7 +268,12 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(right) {
 			return right
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		if env.CheckedArithmetic() {
+			if err := integerOverflow(node.Operator, left, right); err != nil {
+				return err
+			}
+		}
+		return allocate(evalInfixExpression(node.Operator, left, right), env)
 
 	case *ast.IndexExpression:
 		left := Eval(node.Left, env)
@@ -132,8 +286,21 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		}
 		return evalIndexExpression(left, idx)
 
+	case *ast.MemberExpression:
+		left := Eval(node.Left, env)
+		if isError(left) {
+			return left
+		}
+		return evalIndexExpression(left, &object.String{Value: node.Member.Value})
+
+	case *ast.SliceExpression:
+		return allocate(evalSliceExpression(node, env), env)
+
 	case *ast.IntegerLiteral:
-		return &object.Integer{Value: node.Value}
+		return object.NewInteger(node.Value)
+
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
@@ -141,47 +308,169 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.Boolean:
 		return nativeBoolToBoolObj(node.Value)
 
+	case *ast.NullLiteral:
+		return NULL
+
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
-		return &object.Array{Elements: elements}
+		return allocate(&object.Array{Elements: elements}, env)
 
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		return allocate(evalHashLiteral(node, env), env)
 
 	default:
-		return nil
+		return newError("unknown node: %T", node)
 	}
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+// A call in tail position, the last thing the function making it does.
+// Rather than making the call, evaluating the function's body returns it,
+// and applyFunction makes it in place of the function, so that a chain of
+// tail calls, however long, runs in a loop rather than nesting. It never
+// escapes applyFunction.
+type tailCall struct {
+	fn   object.Object
+	args []object.Object
+	call *ast.CallExpression
+}
+
+func (tc *tailCall) Type() object.ObjectType { return "TAIL_CALL" }
+func (tc *tailCall) Inspect() string         { return "tail call" }
+
+// Calls fn, as made by call, then the tail calls it ends with, one after
+// another. If the result is an error, the calls are added to its stack
+// trace.
+func applyFunction(fn object.Object, args []object.Object, env *object.Environment, call *ast.CallExpression) object.Object {
+	// The calls made, for the stack traces of errors. A call that fails
+	// before its body starts, as one with the wrong number of arguments
+	// does, isn't in progress, so it is left out, as on the VM. A function
+	// calling itself again from the same place, as a loop written as tail
+	// recursion does, is recorded once.
+	var made []tailCall
+
+	res, started := callFunction(fn, args, env, call)
+	if started {
+		made = append(made, tailCall{fn: fn, call: call})
+	}
+	for {
+		tc, ok := res.(*tailCall)
+		if !ok {
+			break
+		}
+		res, started = callFunction(tc.fn, tc.args, env, tc.call)
+		if n := len(made); started && (n == 0 || made[n-1].fn != tc.fn || made[n-1].call != tc.call) {
+			made = append(made, tailCall{fn: tc.fn, call: tc.call})
+		}
+	}
+
+	if errObj, ok := res.(*object.Error); ok {
+		for i := len(made) - 1; i >= 0; i-- {
+			addStackFrame(errObj, made[i].fn, made[i].call)
+		}
+	}
+	return res
+}
+
+// Calls fn, as made by call, returning its result, or the tail call it ends
+// with, and whether the call got as far as binding its arguments.
+func callFunction(fn object.Object, args []object.Object, env *object.Environment, call *ast.CallExpression) (object.Object, bool) {
 	switch fn := fn.(type) {
 	case *object.Function:
-		extendedEnv := extendFunctionEnv(fn, args)
-		eval := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(eval)
+		if err := checkContext(env); err != nil {
+			return err, false
+		}
+		limit := env.MaxCallDepth()
+		if limit == 0 {
+			limit = MAX_CALL_DEPTH
+		}
+		defer env.LeaveCall()
+		if env.EnterCall() > limit {
+			return newError("stack overflow: more than %d nested calls", limit), false
+		}
+		required, most := len(fn.Parameters)-len(fn.Defaults), len(fn.Parameters)
+		if fn.Rest != nil {
+			most = -1
+		}
+		if len(args) < required || (most >= 0 && len(args) > most) {
+			return newError("wrong number of arguments: want=%s, got=%d",
+				object.DescribeArity(required, most), len(args)), false
+		}
+
+		extendedEnv, err := extendFunctionEnv(fn, args)
+		if err != nil {
+			return err, true
+		}
+		// The body shares the function's environment with the parameters.
+		res := evalBlockStatement(fn.Body, extendedEnv, true)
+		return unwrapReturnValue(res), true
 	case *object.Builtin:
-		if res := fn.Fn(args...); res != nil {
-			return res
+		if res := fn.Fn(runtime{env: env, call: call}, args...); res != nil {
+			return allocate(res, env), true
 		}
-		return NULL
+		return NULL, true
 	default:
-		return newError("not a function: %s", fn.Type())
+		return newError("not a function: %s", fn.Type()), false
 	}
 }
+
+// Records the call of a user defined function in the stack trace of an error
+// that is propagating out of it. `call` is nil for calls made by the host,
+// which have no position in the source. Calls made by builtins are recorded
+// at the call of the builtin.
+func addStackFrame(err *object.Error, fn object.Object, call *ast.CallExpression) {
+	function, ok := fn.(*object.Function)
+	if !ok {
+		return
+	}
+
+	frame := object.StackFrame{Function: object.FunctionName(function.Name)}
+	if call != nil {
+		frame.Line = call.Token.Line
+		frame.Column = call.Token.Column
+	}
+
+	err.Stack = append(err.Stack, frame)
+}
+
+// Binds the parameters of a function to the arguments it was called with.
+// Parameters left without an argument take their default values, which may
+// refer to the parameters before them, and the rest parameter takes an array
+// of the arguments left over.
 func extendFunctionEnv(
 	fn *object.Function,
 	args []object.Object,
-) *object.Environment {
+) (*object.Environment, object.Object) {
 	env := object.NewEnclosedEnvironment(fn.Env)
 
+	firstDefault := len(fn.Parameters) - len(fn.Defaults)
 	for i, p := range fn.Parameters {
-		env.Set(p.Value, args[i])
+		if i < len(args) {
+			env.Set(p.Value, args[i])
+			continue
+		}
+
+		val := Eval(fn.Defaults[i-firstDefault], env)
+		if isError(val) {
+			return nil, val
+		}
+		env.Set(p.Value, val)
 	}
 
-	return env
+	if fn.Rest != nil {
+		rest := &object.Array{Elements: []object.Object{}}
+		if len(args) > len(fn.Parameters) {
+			rest.Elements = append(rest.Elements, args[len(fn.Parameters):]...)
+		}
+		if res := allocate(rest, env); isError(res) {
+			return nil, res
+		}
+		env.Set(fn.Rest.Value, rest)
+	}
+
+	return env, nil
 }
 
 func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
@@ -193,7 +482,9 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 		switch res := res.(type) {
 		case *object.ReturnValue:
 			return res.Value
-		case *object.Error:
+		case *object.Thrown:
+			return uncaught(res)
+		case *object.Error, *object.Exit, *object.BudgetExceeded:
 			return res
 		}
 	}
@@ -201,20 +492,35 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 	return res
 }
 
-func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
+// Turns a thrown value that no try expression caught into the error it
+// fails the program with.
+func uncaught(thrown *object.Thrown) *object.Error {
+	return newError("%s", thrown.Error())
+}
+
+// Evaluates the statements of a block in env. If tail is set, the block is
+// in tail position, and so are its last statement and its return
+// statements.
+func evalBlockStatement(block *ast.BlockStatement, env *object.Environment, tail bool) object.Object {
 	var res object.Object
 
-	for _, stmt := range block.Statements {
-		res = Eval(stmt, env)
+	for i, stmt := range block.Statements {
+		_, isReturn := stmt.(*ast.ReturnStatement)
+		res = eval(stmt, env, tail && (isReturn || i == len(block.Statements)-1))
 
 		if res != nil {
 			rt := res.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			if _, ok := res.(*tailCall); ok || rt == object.RETURN_VALUE_OBJ || isError(res) {
 				return res
 			}
 		}
 	}
 
+	// Empty blocks, and blocks ending in a let statement, produce no value.
+	if res == nil {
+		return NULL
+	}
+
 	return res
 }
 
@@ -240,17 +546,135 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 		return val
 	}
 
-	if builtin, ok := builtins[node.Value]; ok {
+	// The evaluator shares its builtins with the compiler and VM.
+	if builtin := object.GetBuiltinByName(node.Value); builtin != nil {
 		return builtin
 	}
 
 	return newError("identifier not found: %s", node.Value)
 }
 
+func evalDestructuringLet(
+	node *ast.DestructuringLetStatement,
+	env *object.Environment,
+) object.Object {
+	val := Eval(node.Value, env)
+	if isError(val) {
+		return val
+	}
+
+	var (
+		values []object.Object
+		err    *object.Error
+	)
+	if node.Hash {
+		keys := evalExpressions(node.Keys, env)
+		if len(keys) == 1 && isError(keys[0]) {
+			return keys[0]
+		}
+		values, err = object.DestructureHash(val, keys)
+	} else {
+		values, err = object.DestructureArray(val, len(node.Names))
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, name := range node.Names {
+		if node.IsConst() {
+			env.SetConst(name.Value, values[i])
+		} else {
+			env.Set(name.Value, values[i])
+		}
+	}
+	return nil
+}
+
+// Binds the top-level bindings of a module, as a hash, evaluating the module
+// the first time it is imported.
+func evalImportStatement(node *ast.ImportStatement, env *object.Environment) object.Object {
+	key, err := module.Resolve(node.Path, env.ImportDir())
+	if err != nil {
+		return newError("%s", err)
+	}
+	if err := module.RequireCapability(key, env.Allows); err != nil {
+		return newError("%s", err)
+	}
+
+	exports, ok := env.Module(key)
+	if ok && exports == nil {
+		return newError("import cycle: %q imports itself", node.Path)
+	}
+	if !ok {
+		exports = evalModule(key, env)
+		if isError(exports) {
+			return exports
+		}
+	}
+
+	env.Set(node.Name.Value, exports)
+	return nil
+}
+
+func evalModule(key string, env *object.Environment) object.Object {
+	mod, err := module.Load(key)
+	if err != nil {
+		return newError("%s", err)
+	}
+
+	env.SetModule(key, nil)
+	moduleEnv := object.NewModuleEnvironment(env, mod.Dir)
+	for _, stmt := range mod.Program.Statements {
+		res := Eval(stmt, moduleEnv)
+		if _, ok := res.(*object.ReturnValue); ok {
+			res = newError("cannot return from the top level of a module")
+		}
+		if isError(res) {
+			env.DeleteModule(key)
+			return res
+		}
+	}
+
+	pairs := make(map[object.HashKey]object.HashPair)
+	for name, val := range moduleEnv.Bindings() {
+		str := &object.String{Value: name}
+		pairs[str.HashKey()] = object.HashPair{Key: str, Value: val}
+	}
+	exports := allocate(&object.Hash{Pairs: pairs}, env)
+	if isError(exports) {
+		env.DeleteModule(key)
+		return exports
+	}
+
+	env.SetModule(key, exports)
+	return exports
+}
+
+func evalAssignment(
+	name *ast.Identifier,
+	val object.Object,
+	env *object.Environment,
+) object.Object {
+	if env.IsConst(name.Value) {
+		return newError("cannot assign to constant: %s", name.Value)
+	}
+	if env.Assign(name.Value, val) {
+		return val
+	}
+
+	if object.GetBuiltinByName(name.Value) != nil {
+		return newError("cannot assign to builtin: %s", name.Value)
+	}
+
+	return newError("identifier not declared: %s", name.Value)
+}
+
 func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
 	default:
@@ -270,6 +694,79 @@ func evalArrayIndexExpression(a, index object.Object) object.Object {
 	return arrObj.Elements[idx]
 }
 
+func evalStringIndexExpression(s, index object.Object) object.Object {
+	idx := index.(*object.Integer).Value
+
+	ch, ok := s.(*object.String).At(idx)
+	if !ok {
+		return NULL
+	}
+
+	return &object.String{Value: ch}
+}
+
+func evalSliceExpression(se *ast.SliceExpression, env *object.Environment) object.Object {
+	left := Eval(se.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	var length int64
+	switch left := left.(type) {
+	case *object.Array:
+		length = int64(len(left.Elements))
+	case *object.String:
+		length = int64(left.Len())
+	default:
+		return newError("slice operator not supported: %s", left.Type())
+	}
+
+	start, err := evalSliceBound(se.Start, 0, length, env)
+	if err != nil {
+		return err
+	}
+	end, err := evalSliceBound(se.End, length, length, env)
+	if err != nil {
+		return err
+	}
+	if start > end {
+		start = end
+	}
+
+	switch left := left.(type) {
+	case *object.Array:
+		elems := make([]object.Object, end-start)
+		copy(elems, left.Elements[start:end])
+		return &object.Array{Elements: elems}
+	default:
+		return &object.String{Value: left.(*object.String).Slice(start, end)}
+	}
+}
+
+// Evaluates one bound of a slice expression, using def when the bound is
+// omitted or null and clamping the result to [0, length].
+func evalSliceBound(node ast.Expression, def, length int64, env *object.Environment) (int64, object.Object) {
+	if node == nil {
+		return def, nil
+	}
+
+	bound := Eval(node, env)
+	if isError(bound) {
+		return 0, bound
+	}
+
+	if bound == NULL {
+		return def, nil
+	}
+
+	integer, ok := bound.(*object.Integer)
+	if !ok {
+		return 0, newError("slice index must be INTEGER, got %s", bound.Type())
+	}
+
+	return min(max(integer.Value, 0), length), nil
+}
+
 func evalHashLiteral(hl *ast.HashLiteral, env *object.Environment) object.Object {
 	pairs := make(map[object.HashKey]object.HashPair)
 
@@ -312,21 +809,107 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 	return pair.Value
 }
 
-func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
+func evalIfExpression(ie *ast.IfExpression, env *object.Environment, tail bool) object.Object {
 	cond := Eval(ie.Condition, env)
 	if isError(cond) {
 		return cond
 	}
 
-	if isTruthy(cond) {
-		return Eval(ie.Consequence, env)
+	if object.IsTruthy(cond) {
+		return eval(ie.Consequence, env, tail)
 	} else if ie.Alternative != nil {
-		return Eval(ie.Alternative, env)
+		return eval(ie.Alternative, env, tail)
 	} else {
 		return NULL
 	}
 }
 
+func evalConditionalExpression(ce *ast.ConditionalExpression, env *object.Environment, tail bool) object.Object {
+	cond := Eval(ce.Condition, env)
+	if isError(cond) {
+		return cond
+	}
+
+	if object.IsTruthy(cond) {
+		return eval(ce.Consequence, env, tail)
+	}
+	return eval(ce.Alternative, env, tail)
+}
+
+func evalWhileExpression(we *ast.WhileExpression, env *object.Environment) object.Object {
+	for {
+		if err := checkContext(env); err != nil {
+			return err
+		}
+
+		cond := Eval(we.Condition, env)
+		if isError(cond) {
+			return cond
+		}
+
+		if !object.IsTruthy(cond) {
+			return NULL
+		}
+
+		res := Eval(we.Body, env)
+		if res != nil {
+			rt := res.Type()
+			if rt == object.RETURN_VALUE_OBJ || isError(res) {
+				return res
+			}
+		}
+	}
+}
+
+// Evaluates a try expression. The catch recovers thrown values and errors,
+// though not exits, exceeded budgets or the context being done, and its
+// parameter is bound to the value thrown or the error's message. The
+// finally is evaluated however the rest ends, unless it stops the program,
+// and its result is ignored unless it returns or fails itself.
+func evalTryExpression(te *ast.TryExpression, env *object.Environment) object.Object {
+	res := Eval(te.Body, env)
+
+	if caught, ok := caughtValue(res, env); ok && te.Catch != nil {
+		// The parameter is only visible within the catch, like the names
+		// the catch defines.
+		catchEnv := object.NewEnclosedEnvironment(env)
+		if te.Param != nil {
+			catchEnv.Set(te.Param.Value, caught)
+		}
+		res = evalBlockStatement(te.Catch, catchEnv, false)
+	}
+
+	// What can't be caught stops the program without running the finally.
+	if _, ok := caughtValue(res, env); isError(res) && !ok {
+		return res
+	}
+
+	if te.Finally != nil {
+		fin := Eval(te.Finally, env)
+		if fin != nil && (fin.Type() == object.RETURN_VALUE_OBJ || isError(fin)) {
+			return fin
+		}
+	}
+
+	return res
+}
+
+// Returns the value a catch is passed for res, if res is something a catch
+// recovers.
+func caughtValue(res object.Object, env *object.Environment) (object.Object, bool) {
+	switch res := res.(type) {
+	case *object.Thrown:
+		return res.Value, true
+	case *object.Error:
+		if env.Context().Err() != nil {
+			return nil, false
+		}
+		return &object.String{Value: res.Message}, true
+	default:
+		return nil, false
+	}
+}
+
 func evalPrefixExpression(op string, right object.Object) object.Object {
 	switch op {
 	case "!":
@@ -350,12 +933,37 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 	}
 }
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+	switch right := right.(type) {
+	case *object.Integer:
+		return object.NewInteger(-right.Value)
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
+}
+
+// Evaluates `&&` and `||`. The right operand is only evaluated if the left
+// operand does not already decide the result.
+func evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := Eval(node.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	if node.Operator == "&&" && !object.IsTruthy(left) {
+		return FALSE
+	}
+	if node.Operator == "||" && object.IsTruthy(left) {
+		return TRUE
+	}
 
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
+	right := Eval(node.Right, env)
+	if isError(right) {
+		return right
+	}
+
+	return nativeBoolToBoolObj(object.IsTruthy(right))
 }
 
 func evalInfixExpression(
@@ -365,12 +973,17 @@ func evalInfixExpression(
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(op, left, right)
+	case object.IsNumeric(left) && object.IsNumeric(right):
+		// At least one side is a float, so the integer side is promoted.
+		return evalFloatInfixExpression(op, left, right)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return evalStringInfixExpression(op, left, right)
+	case left.Type() == object.ARRAY_OBJ && right.Type() == object.ARRAY_OBJ && op == "+":
+		return evalArrayConcatenation(left, right)
 	case op == "==":
-		return nativeBoolToBoolObj(left == right)
+		return nativeBoolToBoolObj(object.Equals(left, right))
 	case op == "!=":
-		return nativeBoolToBoolObj(left != right)
+		return nativeBoolToBoolObj(!object.Equals(left, right))
 	case left.Type() != right.Type():
 		return newError("type mismatch: %s %s %s",
 			left.Type(), op, right.Type())
@@ -388,17 +1001,54 @@ func evalIntegerInfixExpression(
 
 	switch op {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		return object.NewInteger(leftVal + rightVal)
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		return object.NewInteger(leftVal - rightVal)
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		return object.NewInteger(leftVal * rightVal)
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return object.NewInteger(leftVal / rightVal)
+	case "%":
+		if rightVal == 0 {
+			return newError("modulo by zero")
+		}
+		return object.NewInteger(leftVal % rightVal)
+	case "**":
+		if rightVal < 0 {
+			return &object.Float{Value: math.Pow(float64(leftVal), float64(rightVal))}
+		}
+		res, ok := object.PowerInts(leftVal, rightVal)
+		if !ok {
+			return newError("integer overflow: %d ** %d", leftVal, rightVal)
+		}
+		return object.NewInteger(res)
+	case "&":
+		return object.NewInteger(leftVal & rightVal)
+	case "|":
+		return object.NewInteger(leftVal | rightVal)
+	case "^":
+		return object.NewInteger(leftVal ^ rightVal)
+	case "<<":
+		if rightVal < 0 {
+			return newError("negative shift count: %d", rightVal)
+		}
+		return object.NewInteger(leftVal << rightVal)
+	case ">>":
+		if rightVal < 0 {
+			return newError("negative shift count: %d", rightVal)
+		}
+		return object.NewInteger(leftVal >> rightVal)
 	case "<":
 		return nativeBoolToBoolObj(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBoolObj(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBoolObj(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBoolObj(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBoolObj(leftVal == rightVal)
 	case "!=":
@@ -407,16 +1057,102 @@ func evalIntegerInfixExpression(
 		return NULL
 	}
 }
-func evalStringInfixExpression(
+
+// For checked arithmetic: returns an error if op applied to two integers
+// overflows, or nil.
+func integerOverflow(op string, left, right object.Object) *object.Error {
+	l, leftIsInt := left.(*object.Integer)
+	r, rightIsInt := right.(*object.Integer)
+	if !leftIsInt || !rightIsInt || !object.IntegerOverflows(op, l.Value, r.Value) {
+		return nil
+	}
+	return newError("integer overflow: %d %s %d", l.Value, op, r.Value)
+}
+
+// Like integerOverflow, for prefix operators.
+func negationOverflow(op string, right object.Object) *object.Error {
+	i, ok := right.(*object.Integer)
+	if op != "-" || !ok || !object.NegationOverflows(i.Value) {
+		return nil
+	}
+	return newError("integer overflow: -(%d)", i.Value)
+}
+
+func evalFloatInfixExpression(
 	op string,
 	left, right object.Object,
 ) object.Object {
-	if op != "+" {
+	leftVal := object.ToFloat(left)
+	rightVal := object.ToFloat(right)
+
+	switch op {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newError("modulo by zero")
+		}
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "**":
+		return &object.Float{Value: math.Pow(leftVal, rightVal)}
+	case "<":
+		return nativeBoolToBoolObj(leftVal < rightVal)
+	case ">":
+		return nativeBoolToBoolObj(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBoolObj(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBoolObj(leftVal >= rightVal)
+	case "==":
+		return nativeBoolToBoolObj(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBoolObj(leftVal != rightVal)
+	default:
 		return newError("unknown operator: %s %s %s",
 			left.Type(), op, right.Type())
 	}
+}
+func evalArrayConcatenation(left, right object.Object) object.Object {
+	leftElems := left.(*object.Array).Elements
+	rightElems := right.(*object.Array).Elements
+
+	elems := make([]object.Object, 0, len(leftElems)+len(rightElems))
+	elems = append(elems, leftElems...)
+	elems = append(elems, rightElems...)
+	return &object.Array{Elements: elems}
+}
 
+func evalStringInfixExpression(
+	op string,
+	left, right object.Object,
+) object.Object {
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
-	return &object.String{Value: leftVal + rightVal}
+
+	// Interned strings are equal exactly when they are the same object.
+	switch op {
+	case "+":
+		return &object.String{Value: leftVal + rightVal}
+	case "==":
+		return nativeBoolToBoolObj(left == right || leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBoolObj(left != right && leftVal != rightVal)
+	case "<":
+		return nativeBoolToBoolObj(leftVal < rightVal)
+	case ">":
+		return nativeBoolToBoolObj(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBoolObj(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBoolObj(leftVal >= rightVal)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), op, right.Type())
+	}
 }
@@ -1,10 +1,18 @@
 package evaluator
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"monkey/ast"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func testEval(input string) object.Object {
@@ -73,6 +81,18 @@ func TestIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"6 % 3 + 2 * 5 % 4", 2},
+		{"12 & 10", 8},
+		{"12 | 10", 14},
+		{"12 ^ 10", 6},
+		{"1 << 10", 1024},
+		{"-16 >> 2", -4},
+		{"1 << 64", 0},
+		{"1 | 2 ^ 3 & 4", 3},
+		{"1 << 2 + 1", 8},
+		{"-1 ^ 5", -6},
 	}
 
 	for _, test := range tests {
@@ -81,6 +101,63 @@ func TestIntegerExpression(t *testing.T) {
 	}
 }
 
+func TestFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"1.5", 1.5},
+		{"-1.5", -1.5},
+		{"1.5 + 1.5", 3.0},
+		{"1 + 0.5", 1.5},
+		{"0.5 + 1", 1.5},
+		{"2.5 * 2", 5.0},
+		{"5 / 2.0", 2.5},
+		{"5 / 2", 2},
+		{"1.0 - 0.25", 0.75},
+		{"5.5 % 2", 1.5},
+		{"2 ** 10", 1024},
+		{"2 ** -1", 0.5},
+		{"2.0 ** 3", 8.0},
+		{"4 ** 0.5", 2.0},
+		{"-2 ** 2", -4},
+		{"(-2) ** 2", 4},
+		{"2 ** 3 ** 2", 512},
+		{"2 * 3 ** 2", 18},
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"1.0 == 1", true},
+		{"1.5 != 1.5", false},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		switch expected := test.expected.(type) {
+		case float64:
+			testFloatObject(t, eval, expected)
+		case int:
+			testIntegerObject(t, eval, int64(expected))
+		case bool:
+			testBooleanObject(t, eval, expected)
+		}
+	}
+}
+
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	res, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float. got=%T (%+v)", obj, obj)
+		return false
+	}
+	if res.Value != expected {
+		t.Errorf("object has wrong value. got=%f, want=%f",
+			res.Value, expected)
+		return false
+	}
+
+	return true
+}
+
 func TestStringExpression(t *testing.T) {
 	input := `"Hello World!"`
 
@@ -120,6 +197,14 @@ func TestBooleanExpression(t *testing.T) {
 		{"1 > 2", false},
 		{"1 < 1", false},
 		{"1 > 1", false},
+		{"1 <= 1", true},
+		{"1 >= 1", true},
+		{"1 <= 2", true},
+		{"1 >= 2", false},
+		{"2 <= 1", false},
+		{"2 >= 1", true},
+		{"1.5 <= 1.5", true},
+		{"1 >= 1.5", false},
 		{"1 == 1", true},
 		{"1 != 1", false},
 		{"1 == 2", false},
@@ -129,6 +214,17 @@ func TestBooleanExpression(t *testing.T) {
 		{"true == false", false},
 		{"true != false", true},
 		{"false != true", true},
+		{`"monkey" == "monkey"`, true},
+		{`"mon" + "key" == "monkey"`, true},
+		{`"monkey" != "banana"`, true},
+		{`"monkey" != "mon" + "key"`, false},
+		{`"apple" < "banana"`, true},
+		{`"apple" > "banana"`, false},
+		{`"apple" <= "apple"`, true},
+		{`"apple" >= "apples"`, false},
+		{`"Zebra" < "apple"`, true},
+		{`"" < "a"`, true},
+		{`let a = "b"; let b = "a"; a > b`, true},
 		{"(1 < 2) == true", true},
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
@@ -160,6 +256,34 @@ func TestArrayLiterals(t *testing.T) {
 	testIntegerObject(t, res.Elements[2], 6)
 }
 
+func TestArrayOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2] + [3]", "[1, 2, 3]"},
+		{"[] + []", "[]"},
+		{"let a = [1]; let b = a + [2]; a", "[1]"},
+		{"[1, 2] == [1, 2]", "true"},
+		{"[1, [2, 3]] == [1, [2, 3]]", "true"},
+		{"[1, 2] == [2, 1]", "false"},
+		{"[1, 2] != [1, 2, 3]", "true"},
+		{"[1, 2.0] == [1.0, 2]", "true"},
+		{`["a", true, [[]]] == ["a", true, [[]]]`, "true"},
+		{"let f = fn() {}; [f] == [f]", "true"},
+		{"[fn() {}] == [fn() {}]", "false"},
+		{"[1] == 1", "false"},
+		{"[1] - [1]", "Error: unknown operator: ARRAY - ARRAY"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %s. want=%s, got=%s", test.input, test.expected, eval.Inspect())
+		}
+	}
+}
+
 func TestArrayIndexExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -218,6 +342,65 @@ func TestArrayIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestStringIndexExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`"hello"[0]`, "h"},
+		{`"hello"[1]`, "e"},
+		{`let s = "hello"; s[len(s) - 1]`, "o"},
+		{`"hello"[5]`, nil},
+		{`"hello"[-1]`, nil},
+		{`""[0]`, nil},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		expected, ok := test.expected.(string)
+		if !ok {
+			testNullObject(t, eval)
+			continue
+		}
+
+		str, ok := eval.(*object.String)
+		if !ok {
+			t.Errorf("object is not String. got=%T (%+v)", eval, eval)
+			continue
+		}
+		if str.Value != expected {
+			t.Errorf("String has wrong value. got=%q, want=%q", str.Value, expected)
+		}
+	}
+}
+
+func TestSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"hello"[1:3]`, "el"},
+		{`"hello"[:2]`, "he"},
+		{`"hello"[3:]`, "lo"},
+		{`"hello"[:]`, "hello"},
+		{`"hello"[-5:99]`, "hello"},
+		{`"hello"[4:1]`, ""},
+		{"[1, 2, 3, 4][1:3]", "[2, 3]"},
+		{"[1, 2, 3][:1]", "[1]"},
+		{"[1, 2, 3][1 + 1:]", "[3]"},
+		{"[1, 2, 3][3:]", "[]"},
+		{"let a = [1, 2, 3]; let b = a[:]; b", "[1, 2, 3]"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong slice for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
 func TestHashLiterals(t *testing.T) {
 	input := `let two = "two";
 {
@@ -258,6 +441,27 @@ func TestHashLiterals(t *testing.T) {
 	}
 }
 
+func TestHashEquality(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{`{"a": 1} == {"a": 1}`, true},
+		{`{"a": 1, "b": 2} == {"b": 2, "a": 1}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`{"a": 1} != {"a": 1, "b": 2}`, true},
+		{`{} == {}`, true},
+		{`{"a": {"b": [1, {"c": 2}]}} == {"a": {"b": [1, {"c": 2.0}]}}`, true},
+		{`{"a": {"b": [1, {"c": 2}]}} == {"a": {"b": [1, {"c": 3}]}}`, false},
+		{`{1: "a"} == {"1": "a"}`, false},
+		{`{"a": 1} == ["a", 1]`, false},
+	}
+
+	for _, test := range tests {
+		testBooleanObject(t, testEval(test.input), test.expected)
+	}
+}
+
 func TestHashIndexExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -328,6 +532,97 @@ func TestBangOperator(t *testing.T) {
 	}
 }
 
+func TestNullLiteral(t *testing.T) {
+	testNullObject(t, testEval("null"))
+	testNullObject(t, testEval("let x = null; x"))
+
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"null == null", true},
+		{"null != null", false},
+		{"null == false", false},
+		{"null == 0", false},
+		{"!null", true},
+		{"let f = fn() {}; f() == null", true},
+		{"[1][5] == null", true},
+		{`{"a": 1}["b"] != null`, false},
+		{"if (null) { true } else { false }", false},
+	}
+
+	for _, test := range tests {
+		testBooleanObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"true || false", true},
+		{"false || false", false},
+		{"1 && 2", true},
+		{"0 || false", true},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		// The right operand is never evaluated, so the unknown identifier is fine.
+		{"false && unknown", false},
+		{"true || unknown", true},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		testBooleanObject(t, eval, test.expected)
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = 5; a = 10; a;", 10},
+		{"let a = 5; a = 10;", 10},
+		{"let a = 5; let b = 0; a = b = 3; a + b;", 6},
+		{"let a = 1; let f = fn() { a = a + 1; }; f(); f(); a;", 3},
+		{"let f = fn(x) { x = x * 2; x }; f(4);", 8},
+		{"let i = 0; while (i < 5) { i = i + 1; }; i;", 5},
+		{"b = 5;", "identifier not declared: b"},
+		{"len = 5;", "cannot assign to builtin: len"},
+		{"const a = 5; a + 1;", 6},
+		{"const a = 5; a = 10;", "cannot assign to constant: a"},
+		{"const a = 5; let f = fn() { a = 10; }; f();", "cannot assign to constant: a"},
+		{"const a = 5; let f = fn() { let a = 1; a = 10; a }; f();", 10},
+		{"const a = 5; let a = 6; a = 7; a;", 7},
+		{"const [a, b] = [1, 2]; b = 3;", "cannot assign to constant: b"},
+		{"let f = fn(x) { const y = x * 2; y }; f(4);", 8},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+
+		switch expected := test.expected.(type) {
+		case int:
+			testIntegerObject(t, eval, int64(expected))
+		case string:
+			errObj, ok := eval.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", eval, eval)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q",
+					expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestIfElseExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -340,6 +635,62 @@ func TestIfElseExpressions(t *testing.T) {
 		{"if (1 > 2) { 10 }", nil},
 		{"if (1 > 2) { 10 } else { 20 }", 20},
 		{"if (1 < 2) { 10 } else { 20 }", 10},
+		{"if (true) { }", nil},
+		{"if (true) { let x = 10; }", nil},
+		{"if (1 > 2) { 10 } else if (1 < 2) { 20 } else { 30 }", 20},
+		{"if (1 > 2) { 10 } else if (1 > 3) { 20 } else { 30 }", 30},
+		{"if (1 > 2) { 10 } else if (1 > 3) { 20 }", nil},
+		{"let x = 3; if (x == 1) { 1 } else if (x == 2) { 2 } else if (x == 3) { 3 } else { 4 }", 3},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		integer, ok := test.expected.(int)
+		if ok {
+			testIntegerObject(t, eval, int64(integer))
+		} else {
+			testNullObject(t, eval)
+		}
+	}
+}
+
+func TestConditionalExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"true ? 10 : 20", 10},
+		{"false ? 10 : 20", 20},
+		{"null ? 10 : 20", 20},
+		{"1 < 2 ? 10 : 20", 10},
+		{"let x = 3; x > 5 ? 1 : x > 2 ? 2 : 3", 2},
+		{"let f = fn(n) { n < 2 ? n : f(n - 1) + f(n - 2) }; f(10)", 55},
+		{"let x = 0; x = true ? 5 : 6; x", 5},
+		{"true ? null : 1", nil},
+		// Only the chosen branch runs.
+		{"true ? 1 : 1 / 0", 1},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		integer, ok := test.expected.(int)
+		if ok {
+			testIntegerObject(t, eval, int64(integer))
+		} else {
+			testNullObject(t, eval)
+		}
+	}
+}
+
+func TestWhileExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"while (false) { 10 }", nil},
+		{"let f = fn() { while (true) { return 10; } }; f();", 10},
+		{"let f = fn(x) { while (x > 5) { return x; } 0 }; f(10);", 10},
+		{"let f = fn(x) { while (x > 5) { return x; } 0 }; f(1);", 0},
 	}
 
 	for _, test := range tests {
@@ -353,6 +704,160 @@ func TestIfElseExpressions(t *testing.T) {
 	}
 }
 
+func TestBlockScopes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = 1; if (true) { let a = 2; }; a", 1},
+		{"let a = 1; if (true) { let a = 2; a }", 2},
+		{"let a = 1; if (true) { a = 2; }; a", 2},
+		{"let a = 1; if (true) { let a = a + 1; a }", 2},
+		{"let a = 1; if (false) { 0 } else { let a = 3; }; a", 1},
+		{"if (true) { let b = 1; }; b", "identifier not found: b"},
+		{"let i = 0; while (i < 3) { let j = i; i = j + 1; }; j", "identifier not found: j"},
+		{"let f = fn(x) { if (x) { let y = 5; } y }; f(true)", "identifier not found: y"},
+		{"let f = fn() { if (true) { let a = 5; fn() { a } } }; f()()", 5},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		switch expected := test.expected.(type) {
+		case int:
+			testIntegerObject(t, eval, int64(expected))
+		case string:
+			errObj, ok := eval.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned for %q. got=%T (%+v)", test.input, eval, eval)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string // What the result inspects as.
+	}{
+		{"try { 1 } catch (e) { 2 }", "1"},
+		{"try { throw 5; 1 } catch (e) { e + 1 }", "6"},
+		{"try { 1 + true } catch (e) { e }", "type mismatch: INTEGER + BOOLEAN"},
+		{"let f = fn(x) { if (x > 1) { throw x }; x }; try { f(1) + f(2) } catch (e) { e * 10 }", "20"},
+		{"try { throw 1 } catch { }", "null"},
+		{"try { throw 1 } catch { 2 }", "2"},
+		{"let e = 1; try { throw 2 } catch (e) { e }; e", "1"},
+		{"try { try { throw 1 } catch (e) { throw e + 1 } } catch (e) { e }", "2"},
+		{"try { map([1, 2], fn(x) { throw x * 3 }) } catch (e) { e }", "3"},
+		{"let a = [1, 2]; try { throw a } catch (e) { e }", "[1, 2]"},
+		{"let f = fn(a) { let b = 2; try { let c = 3; throw a + b + c } catch (e) { e + b } }; f(1)", "8"},
+		{"let f = fn() { try { return 1 } finally { 2 } }; f()", "1"},
+		{"let f = fn() { try { 1 } finally { return 2 } }; f()", "2"},
+		{"let f = fn() { try { throw 1 } finally { return 2 } }; f()", "2"},
+		{"try { try { throw 1 } finally { 5 } } catch (e) { e }", "1"},
+		{`let f = fn(n) { try { if (n == 0) { throw "bottom" }; f(n - 1) } finally { } }; try { f(3) } catch (e) { e }`, "bottom"},
+		{"let i = 0; let n = 0; while (i < 3) { n = n + try { if (i == 1) { throw 10 }; i } catch (e) { e }; i = i + 1; }; n", "12"},
+		{"try { throw 1 } catch (e) { let x = e; }; x", "Error: identifier not found: x"},
+	}
+
+	for _, test := range tests {
+		if got := testEval(test.input).Inspect(); got != test.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", test.input, test.expected, got)
+		}
+	}
+}
+
+func TestFinallyOutput(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`try { puts("try"); throw "x" } catch (e) { puts("catch " + e) } finally { puts("finally") }`,
+			"try\ncatch x\nfinally\n",
+		},
+		{`let f = fn() { try { return puts("return") } finally { puts("finally") } }; f()`, "return\nfinally\n"},
+		{`try { try { throw 1 } finally { puts("inner") } } catch { puts("outer") }`, "inner\nouter\n"},
+		{`try { puts("try") } finally { puts("finally") }`, "try\nfinally\n"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		env := object.NewEnvironment()
+		env.SetStdout(&out)
+		Eval(parser.New(lexer.New(test.input)).ParseProgram(), env)
+
+		if out.String() != test.expected {
+			t.Errorf("wrong output for %q. got=%q, want=%q",
+				test.input, out.String(), test.expected)
+		}
+	}
+}
+
+func TestUncaughtExceptions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`throw "oops"`, "uncaught exception: oops"},
+		{`throw [1, "a"]; 5`, "uncaught exception: [1, a]"},
+		{`let f = fn() { throw {"code": 1} }; f() + 1`, "uncaught exception: {code: 1}"},
+		{`try { throw 1 } finally { 2 }`, "uncaught exception: 1"},
+		{`try { 1 + true } finally { }`, "type mismatch: INTEGER + BOOLEAN"},
+		{`try { throw 1 } catch (e) { throw e + 1 }`, "uncaught exception: 2"},
+		{`try { 1 } finally { throw 3 }`, "uncaught exception: 3"},
+	}
+
+	for _, test := range tests {
+		evaluated := testEval(test.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned for %q. got=%T (%+v)", test.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != test.expected {
+			t.Errorf("wrong error message. expected=%q, got=%q", test.expected, errObj.Message)
+		}
+	}
+}
+
+func TestInternalErrors(t *testing.T) {
+	// A tree the parser never produces, with an if expression lacking its
+	// consequence.
+	program := &ast.Program{Statements: []ast.Statement{
+		&ast.ExpressionStatement{Expression: &ast.IfExpression{Condition: &ast.Boolean{Value: true}}},
+	}}
+	expected := "internal error: runtime error: invalid memory address or nil pointer dereference"
+
+	evaluated := Eval(program, object.NewEnvironment())
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T (%+v)", evaluated, evaluated)
+	}
+	if errObj.Message != expected {
+		t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+	}
+
+	env := object.NewEnvironment()
+	evaluated = Apply(&object.Function{Env: env}, nil, env)
+	if errObj, ok := evaluated.(*object.Error); !ok || errObj.Message != expected {
+		t.Errorf("wrong result for Apply. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	strict := object.NewEnvironment()
+	strict.SetStrict(true)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("strict evaluator didn't panic")
+		}
+	}()
+	Eval(program, strict)
+}
+
 func TestReturnStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -409,6 +914,26 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let [a, b, c] = [1, 2, 3]; a * 100 + b * 10 + c;", 123},
+		{"let arr = [4, 5]; let [x, y] = arr; x + y;", 9},
+		{`let {"x": x, "y": y} = {"x": 1, "y": 2, "z": 3}; x - y;`, -1},
+		{`let k = "b"; let {"a": a, k: b} = {"a": 1, "b": 2}; a + b;`, 3},
+		{"let {1: one, true: t} = {1: 10, true: 20}; one + t;", 30},
+		{"let f = fn(p) { let [a, b] = p; a * b }; f([6, 7]);", 42},
+		{"let [a, b] = [1, [2, 3]]; a + b[0] + b[1];", 6},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		testIntegerObject(t, eval, test.expected)
+	}
+}
+
 func TestFunctionObject(t *testing.T) {
 	input := "fn(x) { x + 2; };"
 	expectedBody := "(x + 2)"
@@ -444,6 +969,17 @@ func TestFunctionApplication(t *testing.T) {
 		{"let add = fn(x, y) { x + y; }; add(5, 5);", 10},
 		{"let add = fn(x, y) { x + y; }; add(5 + 5, add(5, 5));", 20},
 		{"fn(x) { x; }(5)", 5},
+		{"let add = fn(x, y = 10) { x + y; }; add(5);", 15},
+		{"let add = fn(x, y = 10) { x + y; }; add(5, 1);", 6},
+		{"let f = fn(a = 1, b = a * 2) { a * 10 + b }; f();", 12},
+		{"let f = fn(a = 1, b = a * 2) { a * 10 + b }; f(3);", 36},
+		{"let n = 1; let f = fn(x = n) { x }; n = 2; f();", 2},
+		{"let count = fn(...xs) { len(xs) }; count(1, 2, 3);", 3},
+		{"let count = fn(...xs) { len(xs) }; count();", 0},
+		{"let f = fn(a, ...rest) { a + len(rest) }; f(10);", 10},
+		{"let f = fn(a, ...rest) { a + rest[1] }; f(10, 20, 30);", 40},
+		{"let f = fn(a, b = 5, ...rest) { a + b + len(rest) }; f(1);", 6},
+		{"let f = fn(a, b = 5, ...rest) { a + b + len(rest) }; f(1, 2, 3, 4);", 5},
 	}
 
 	for _, test := range tests {
@@ -452,6 +988,18 @@ func TestFunctionApplication(t *testing.T) {
 	}
 }
 
+func TestFunctionsWithoutReturnValue(t *testing.T) {
+	tests := []string{
+		"let noReturn = fn() { }; noReturn();",
+		"let onlyLet = fn() { let x = 1; }; onlyLet();",
+		"let noReturnTwo = fn() { }; let noReturn = fn() { noReturnTwo(); }; noReturn();",
+	}
+
+	for _, input := range tests {
+		testNullObject(t, testEval(input))
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -460,6 +1008,7 @@ func TestBuiltinFunctions(t *testing.T) {
 		// len(str)
 		{`len("")`, 0},
 		{`len("four")`, 4},
+		{`len("héllo 世界")`, 8},
 		{`len("hello world")`, 11},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
@@ -526,16 +1075,850 @@ func TestBuiltinFunctions(t *testing.T) {
 	}
 }
 
-func TestErrorHandling(t *testing.T) {
+func TestStringBuiltins(t *testing.T) {
 	tests := []struct {
-		input           string
-		expectedMessage string
+		input    string
+		expected string
 	}{
-		{
-			"5 + true;",
-			"type mismatch: INTEGER + BOOLEAN",
-		},
-		{
+		{`split("a,b,c", ",")`, "[a, b, c]"},
+		{`split("abc", "")`, "[a, b, c]"},
+		{`split("abc", ",")`, "[abc]"},
+		{`split(1, ",")`, "Error: arguments to `split` must be STRING, got INTEGER and STRING"},
+		{`join(["a", "b", "c"], ", ")`, "a, b, c"},
+		{`join([], ",")`, ""},
+		{`join(split("a b", " "), "-")`, "a-b"},
+		{`join(["a", 1], ",")`, "Error: elements of array passed to `join` must be STRING, got INTEGER"},
+		{`join("a", ",")`, "Error: first argument to `join` must be ARRAY, got STRING"},
+		{`join(["a"], 1)`, "Error: second argument to `join` must be STRING, got INTEGER"},
+		{`replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`replace("abc", "x", "y")`, "abc"},
+		{`replace("abc", 1, "y")`, "Error: arguments to `replace` must be STRING, got INTEGER"},
+		{`replace("abc", "a")`, "Error: wrong number of arguments. got=2, want=3"},
+		{`trim("  hi there   ")`, "hi there"},
+		{`trim(1)`, "Error: argument to `trim` must be STRING, got INTEGER"},
+		{`upper("Hello")`, "HELLO"},
+		{`lower("Hello")`, "hello"},
+		{`upper([])`, "Error: argument to `upper` must be STRING, got ARRAY"},
+		{`lower()`, "Error: wrong number of arguments. got=0, want=1"},
+		{`contains("monkey", "key")`, "true"},
+		{`contains("monkey", "donkey")`, "false"},
+		{`contains("monkey", "key") == true`, "true"},
+		{`contains("monkey", 1)`, "Error: arguments to `contains` must be STRING, got STRING and INTEGER"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`map([1, 2, 3], fn(x) { x * 2 })`, "[2, 4, 6]"},
+		{`map([], fn(x) { x * 2 })`, "[]"},
+		{`map(["a", "b"], upper)`, "[A, B]"},
+		{`let n = 10; map([1, 2], fn(x) { x + n })`, "[11, 12]"},
+		{`map([[1], [2, 3]], fn(arr) { map(arr, fn(x) { -x }) })`, "[[-1], [-2, -3]]"},
+		{`filter([1, 2, 3, 4], fn(x) { x % 2 == 0 })`, "[2, 4]"},
+		{`filter([1, 0, 2], fn(x) { if (x > 0) { x } })`, "[1, 2]"},
+		{`reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })`, "10"},
+		{`reduce([], 5, fn(acc, x) { acc + x })`, "5"},
+		{`reduce(["a", "b"], "", fn(acc, s) { acc + s })`, "ab"},
+		{`map(1, fn(x) { x })`, "Error: first argument to `map` must be ARRAY, got INTEGER"},
+		{`filter([1], fn(x) { x }, 2)`, "Error: wrong number of arguments. got=3, want=2"},
+		{`reduce([1], fn(acc, x) { acc })`, "Error: wrong number of arguments. got=2, want=3"},
+		{`map([1], 5)`, "Error: not a function: INTEGER"},
+		{`map([1], fn() { 1 })`, "Error: wrong number of arguments: want=0, got=1"},
+		{`map([1, 2], fn(x) { x + true }); 5`, "Error: type mismatch: INTEGER + BOOLEAN\n\tat <anonymous> (1:4)"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestSortBuiltin(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`sort([3, 1, 2])`, "[1, 2, 3]"},
+		{`sort([2.5, 1, -3])`, "[-3, 1, 2.5]"},
+		{`sort(["pear", "apple", "fig"])`, "[apple, fig, pear]"},
+		{`sort([])`, "[]"},
+		{`let arr = [2, 1]; sort(arr); arr`, "[2, 1]"},
+		{`sort([3, 1, 2], fn(a, b) { a > b })`, "[3, 2, 1]"},
+		{`sort(["ccc", "a", "bb", "dd"], fn(a, b) { len(a) < len(b) })`, "[a, bb, dd, ccc]"},
+		{`sort([[2, "b"], [1, "a"], [2, "a"]], fn(a, b) { a[0] < b[0] })`, "[[1, a], [2, b], [2, a]]"},
+		{`sort([1, "a"])`, "Error: elements of array passed to `sort` must be comparable, got STRING and INTEGER"},
+		{`sort([true, false])`, "Error: elements of array passed to `sort` must be comparable, got BOOLEAN and BOOLEAN"},
+		{`sort(1)`, "Error: first argument to `sort` must be ARRAY, got INTEGER"},
+		{`sort()`, "Error: wrong number of arguments. got=0, want=1 or 2"},
+		{`sort([1, 2], fn(a, b) { a + true })`, "Error: type mismatch: INTEGER + BOOLEAN\n\tat <anonymous> (1:5)"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestHashBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`keys({"b": 1, "a": 2, 3: 3, true: 4})`, "[true, 3, a, b]"},
+		{`values({"b": 1, "a": 2, 3: 3, true: 4})`, "[4, 3, 2, 1]"},
+		{`keys({})`, "[]"},
+		{`hasKey({"a": 1}, "a")`, "true"},
+		{`hasKey({"a": 1}, "b")`, "false"},
+		{`hasKey({1: 1}, "1")`, "false"},
+		{`delete({"a": 1, "b": 2}, "a")`, "{b: 2}"},
+		{`delete({"a": 1}, "b")`, "{a: 1}"},
+		{`let h = {"a": 1}; delete(h, "a"); h`, "{a: 1}"},
+		{`merge({"a": 1, "b": 2}, {"b": 3, "c": 4})`, "{a: 1, b: 3, c: 4}"},
+		{`let h = {"a": 1}; merge(h, {"b": 2}); h`, "{a: 1}"},
+		{`keys([])`, "Error: argument to `keys` must be HASH, got ARRAY"},
+		{`values()`, "Error: wrong number of arguments. got=0, want=1"},
+		{`hasKey({}, [])`, "Error: unusable as hash key: ARRAY"},
+		{`delete(1, "a")`, "Error: first argument to `delete` must be HASH, got INTEGER"},
+		{`merge({}, 1)`, "Error: arguments to `merge` must be HASH, got HASH and INTEGER"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestTypeBuiltin(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`type(1)`, "INTEGER"},
+		{`type(1.5)`, "FLOAT"},
+		{`type("a")`, "STRING"},
+		{`type(true)`, "BOOLEAN"},
+		{`type([])`, "ARRAY"},
+		{`type({})`, "HASH"},
+		{`type(if (false) { 1 })`, "NULL"},
+		{`type(fn(x) { x })`, "FUNCTION"},
+		{`type(len)`, "BUILTIN"},
+		{`type(type(1))`, "STRING"},
+		{`type()`, "Error: wrong number of arguments. got=0, want=1"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestConversionBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`int(5)`, "5"},
+		{`int(3.99)`, "3"},
+		{`int(-3.99)`, "-3"},
+		{`int("42")`, "42"},
+		{`int(" -7 ")`, "-7"},
+		{`int(true) + int(false)`, "1"},
+		{`int("4" + "2") + 1`, "43"},
+		{`int("abc")`, `Error: could not parse "abc" as integer`},
+		{`int("1.5")`, `Error: could not parse "1.5" as integer`},
+		{`int("99999999999999999999")`, `Error: could not parse "99999999999999999999" as integer`},
+		{`int(1.0 / 0)`, "Error: float +Inf out of range for `int`"},
+		{`int([])`, "Error: argument to `int` not supported, got ARRAY"},
+		{`int()`, "Error: wrong number of arguments. got=0, want=1"},
+		{`str(5)`, "5"},
+		{`str(-2.5)`, "-2.5"},
+		{`str("a")`, "a"},
+		{`str(true)`, "true"},
+		{`str([1, "a"])`, "[1, a]"},
+		{`"count: " + str(1 + 2)`, "count: 3"},
+		{`str(1, 2)`, "Error: wrong number of arguments. got=2, want=1"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestMathBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`abs(-5)`, "5"},
+		{`abs(5)`, "5"},
+		{`abs(-2.5)`, "2.5"},
+		{`abs(-9223372036854775807 - 1)`, "Error: integer overflow in `abs`"},
+		{`abs("a")`, "Error: argument to `abs` must be INTEGER or FLOAT, got STRING"},
+		{`min(3, 1, 2)`, "1"},
+		{`min([3, -1.5, 2])`, "-1.5"},
+		{`min(4)`, "4"},
+		{`max(3, 1, 2)`, "3"},
+		{`max([1, 2.5])`, "2.5"},
+		{`max(1, 1.0)`, "1"},
+		{`max([])`, "Error: `max` needs at least one number"},
+		{`min()`, "Error: `min` needs at least one number"},
+		{`min(1, "a")`, "Error: arguments to `min` must be INTEGER or FLOAT, got STRING"},
+		{`pow(2, 10)`, "1024"},
+		{`pow(-2, 3)`, "-8"},
+		{`pow(-1, 3)`, "-1"},
+		{`pow(-1, 1000000000000)`, "1"},
+		{`pow(5, 0)`, "1"},
+		{`pow(0, 0)`, "1"},
+		{`pow(2, -1)`, "0.5"},
+		{`pow(2.0, 3)`, "8.0"},
+		{`pow(4, 0.5)`, "2.0"},
+		{`pow(2, 62)`, "4611686018427387904"},
+		{`pow(-2, 63)`, "-9223372036854775808"},
+		{`pow(2, 63)`, "Error: integer overflow in `pow`"},
+		{`pow(10, 19)`, "Error: integer overflow in `pow`"},
+		{`pow("2", 2)`, "Error: arguments to `pow` must be INTEGER or FLOAT, got STRING and INTEGER"},
+		{`sqrt(16)`, "4.0"},
+		{`sqrt(2.25)`, "1.5"},
+		{`sqrt(0)`, "0.0"},
+		{`sqrt(-4)`, "Error: cannot take square root of negative number -4"},
+		{`sqrt(true)`, "Error: argument to `sqrt` must be INTEGER or FLOAT, got BOOLEAN"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestRangeBuiltin(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`range(4)`, "[0, 1, 2, 3]"},
+		{`range(2, 5)`, "[2, 3, 4]"},
+		{`range(0, 10, 3)`, "[0, 3, 6, 9]"},
+		{`range(5, 0, -2)`, "[5, 3, 1]"},
+		{`range(5, 2)`, "[]"},
+		{`range(0, 5, -1)`, "[]"},
+		{`range(0)`, "[]"},
+		{`range(-3)`, "[]"},
+		{`range(-9223372036854775807 - 1, -9223372036854775807 + 1)`, "[-9223372036854775808, -9223372036854775807]"},
+		{`range(0, 9223372036854775807, 4611686018427387904)`, "[0, 4611686018427387904]"},
+		{`range(0, 1, 0)`, "Error: `range` step must not be 0"},
+		{`range(0, 1.5)`, "Error: arguments to `range` must be INTEGER, got FLOAT"},
+		{`range()`, "Error: wrong number of arguments. got=0, want=1 to 3"},
+		{`range(0, 2000000)`, "Error: `range` would produce 2000000 elements, more than the limit of 1000000"},
+		{`range(-9223372036854775807 - 1, 9223372036854775807)`, "Error: `range` would produce 18446744073709551615 elements, more than the limit of 1000000"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestRangeLimit(t *testing.T) {
+	defer func(limit int) { object.MaxRangeLength = limit }(object.MaxRangeLength)
+	object.MaxRangeLength = 3
+
+	if eval := testEval("range(3)"); eval.Inspect() != "[0, 1, 2]" {
+		t.Errorf("wrong result at the limit. got=%q", eval.Inspect())
+	}
+
+	expected := "Error: `range` would produce 4 elements, more than the limit of 3"
+	if eval := testEval("range(4)"); eval.Inspect() != expected {
+		t.Errorf("wrong result above the limit. got=%q, want=%q", eval.Inspect(), expected)
+	}
+}
+
+// Writes modules for the tests of imports to a temporary directory,
+// returning the directory.
+func writeModules(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"util.monkey": `import "./helper.monkey";
+let count = 0;
+let counter = fn() { count = count + 1; count };
+let double = fn(x) { helper.twice(x) };`,
+		"helper.monkey":  "let twice = fn(x) { x * 2 };",
+		"cycle.monkey":   `import "./cycle.monkey";`,
+		"returns.monkey": "let x = 1; if (true) { return x; }",
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestImports(t *testing.T) {
+	dir := writeModules(t)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{fmt.Sprintf(`import "%s/util.monkey"; util.double(21)`, dir), "42"},
+		{fmt.Sprintf(`import "%s/util.monkey"; import "%s/util.monkey" as again; util.counter(); again.counter()`,
+			dir, dir), "2"},
+		{fmt.Sprintf(`let f = fn() { import "%s/helper.monkey"; helper.twice(4) }; f() + f()`, dir), "16"},
+		{fmt.Sprintf(`import "%s/helper.monkey"; helper.missing`, dir), "null"},
+		{fmt.Sprintf(`import "%s/helper.monkey"; keys(helper)`, dir), "[twice]"},
+		{`import "std/strings"; strings.repeat("ab", 3)`, "ababab"},
+		{`import "std/strings" as s; [s.startsWith("monkey", "mon"), s.endsWith("monkey", "mon")]`, "[true, false]"},
+		{`import "std/strings" as s; [s.reverse("abc"), s.padLeft("7", 3, "0"), s.upper("x")]`, "[cba, 007, X]"},
+		{`let h = {"a": {"b": 2}}; h.a.b`, "2"},
+		{"5.a", "Error: index operator not supported: INTEGER"},
+		{fmt.Sprintf(`import "%s/cycle.monkey"`, dir), `Error: import cycle: "./cycle.monkey" imports itself`},
+		{fmt.Sprintf(`import "%s/returns.monkey"`, dir), "Error: cannot return from the top level of a module"},
+		{fmt.Sprintf(`import "%s/missing.monkey"`, dir),
+			fmt.Sprintf(`Error: cannot import "%s/missing.monkey": no such file or directory`, dir)},
+		{`import "strings"`,
+			`Error: cannot import "strings": the paths of files start with ./ or ../, and those of the standard library with std/`},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+
+	// Relative imports are found from the import directory.
+	env := object.NewEnvironment()
+	env.SetImportDir(dir)
+	program := parser.New(lexer.New(`import "./util.monkey"; util.double(5)`)).ParseProgram()
+	testIntegerObject(t, Eval(program, env), 10)
+}
+
+func TestFileBuiltins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.txt")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{fmt.Sprintf(`writeFile("%s", "hello")`, path), "null"},
+		{fmt.Sprintf(`readFile("%s")`, path), "hello"},
+		{fmt.Sprintf(`appendFile("%s", " world"); readFile("%s")`, path, path), "hello world"},
+		{fmt.Sprintf(`writeFile("%s", "new"); readFile("%s")`, path, path), "new"},
+		{fmt.Sprintf(`readFile("%s")`, path+".missing"),
+			fmt.Sprintf("Error: `readFile` failed: open %s.missing: no such file or directory", path)},
+		{fmt.Sprintf(`writeFile("%s", "x")`, filepath.Join(path, "nested")),
+			fmt.Sprintf("Error: `writeFile` failed: open %s/nested: not a directory", path)},
+		{`readFile(1)`, "Error: argument to `readFile` must be STRING, got INTEGER"},
+		{`appendFile("a", 1)`, "Error: arguments to `appendFile` must be STRING, got STRING and INTEGER"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestFileBuiltinsDenied(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denied.txt")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{fmt.Sprintf(`readFile("%s")`, path), "Error: `readFile` is not allowed: filesystem access is disabled"},
+		{fmt.Sprintf(`writeFile("%s", "x")`, path), "Error: `writeFile` is not allowed: filesystem access is disabled"},
+		{fmt.Sprintf(`let f = fn(path) { appendFile(path, "x") }; f("%s")`, path),
+			"Error: `appendFile` is not allowed: filesystem access is disabled\n\tat f (1:46)"},
+	}
+
+	for _, test := range tests {
+		env := object.NewEnvironment()
+		env.Deny(object.FileSystemCapability)
+
+		eval := Eval(parser.New(lexer.New(test.input)).ParseProgram(), env)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("denied builtins touched the file system. err=%v", err)
+	}
+}
+
+func TestDeniedCapabilities(t *testing.T) {
+	tests := []struct {
+		input    string
+		denied   object.Capability
+		expected string
+	}{
+		{`now()`, object.TimeCapability, "Error: `now` is not allowed: time access is disabled"},
+		{`sleep(0)`, object.TimeCapability, "Error: `sleep` is not allowed: time access is disabled"},
+		{`getEnv("HOME")`, object.EnvironmentCapability,
+			"Error: `getEnv` is not allowed: environment access is disabled"},
+		{`formatTime(0)`, object.TimeCapability, "1970-01-01T00:00:00Z"},
+		{`now() > 0`, object.EnvironmentCapability, "true"},
+	}
+
+	for _, test := range tests {
+		env := object.NewEnvironment()
+		env.Deny(test.denied)
+
+		eval := Eval(parser.New(lexer.New(test.input)).ParseProgram(), env)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestGetEnv(t *testing.T) {
+	t.Setenv("MONKEY_TEST_VAR", "banana")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`getEnv("MONKEY_TEST_VAR")`, "banana"},
+		{`getEnv("MONKEY_TEST_UNSET_VAR")`, "null"},
+		{`getEnv(1)`, "Error: argument to `getEnv` must be STRING, got INTEGER"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestBuiltinOutput(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`puts("hello", "world!")`, "hello\nworld!\n"},
+		{`puts([1, 2], 3.5)`, "[1, 2]\n3.5\n"},
+		{`print("a", 1); print("b")`, "a 1b"},
+		{`let greet = fn(name) { print("hi", name) }; greet("bob")`, "hi bob"},
+		{`print()`, ""},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		env := object.NewEnvironment()
+		env.SetStdout(&out)
+		testNullObject(t, Eval(parser.New(lexer.New(test.input)).ParseProgram(), env))
+
+		if out.String() != test.expected {
+			t.Errorf("wrong output for %q. got=%q, want=%q",
+				test.input, out.String(), test.expected)
+		}
+	}
+}
+
+func TestInputBuiltins(t *testing.T) {
+	tests := []struct {
+		input          string
+		stdin          string
+		expected       string
+		expectedOutput string
+	}{
+		{`readLine()`, "hello\nworld\n", "hello", ""},
+		{`[readLine(), readLine()]`, "hello\r\nworld", "[hello, world]", ""},
+		{`readLine()`, "", "null", ""},
+		{`[readLine(), readLine()]`, "one\n", "[one, null]", ""},
+		{`input("name? ")`, "bob\n", "bob", "name? "},
+		{`input()`, "bob\n", "bob", ""},
+		{`readLine(1)`, "", "Error: wrong number of arguments. got=1, want=0", ""},
+		{`input(1, 2)`, "", "Error: wrong number of arguments. got=2, want=0 or 1", ""},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		env := object.NewEnvironment()
+		env.SetStdout(&out)
+		env.SetStdin(strings.NewReader(test.stdin))
+		evaluated := Eval(parser.New(lexer.New(test.input)).ParseProgram(), env)
+
+		if evaluated.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, evaluated.Inspect(), test.expected)
+		}
+		if out.String() != test.expectedOutput {
+			t.Errorf("wrong output for %q. got=%q, want=%q",
+				test.input, out.String(), test.expectedOutput)
+		}
+	}
+}
+
+func TestJSONBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`jsonParse("[1, 2.5, true, null, []]")`, "[1, 2.5, true, null, []]"},
+		{`jsonParse(" 42 ")`, "42"},
+		{`jsonParse("1e3")`, "1000.0"},
+		{`jsonParse("99999999999999999999")`, "100000000000000000000.0"},
+		{`jsonParse("1e400")`, "Error: `jsonParse` failed: number 1e400 is out of range"},
+		{`jsonParse("[1, {\"a\": -1e400}]")`, "Error: `jsonParse` failed: number -1e400 is out of range"},
+		{`jsonParse(jsonStringify({"a": [1, {"b": false}]}))["a"][1]["b"]`, "false"},
+		{`type(jsonParse("null"))`, "NULL"},
+		{`if (jsonParse("null")) { 1 } else { 2 }`, "2"},
+		{`jsonParse("[1,")`, "Error: `jsonParse` failed: unexpected EOF"},
+		{`jsonParse("[1] 2")`, "Error: `jsonParse` failed: unexpected data after JSON value"},
+		{`jsonParse(1)`, "Error: argument to `jsonParse` must be STRING, got INTEGER"},
+		{`jsonStringify([1, 2.5, "a<b", true, rest([])])`, `[1,2.5,"a<b",true,null]`},
+		{`jsonStringify({"b": 1, "a": {}, 2: [], true: "x"})`, `{"true":"x","2":[],"a":{},"b":1}`},
+		{`let x = [1]; jsonStringify([x, x])`, "[[1],[1]]"},
+		{`jsonStringify("")`, `""`},
+		{`jsonStringify(fn(x) { x })`, "Error: `jsonStringify` cannot encode FUNCTION"},
+		{`jsonStringify([len])`, "Error: `jsonStringify` cannot encode BUILTIN"},
+		{`jsonStringify(1.0 / 0)`, "Error: `jsonStringify` cannot encode +Inf"},
+		{`jsonStringify()`, "Error: wrong number of arguments. got=0, want=1"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestTimeBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`type(now())`, "INTEGER"},
+		{`now() > 1600000000000`, "true"},
+		{`let start = now(); sleep(5); now() - start >= 5`, "true"},
+		{`sleep(0.5)`, "null"},
+		{`sleep(-1)`, "Error: cannot sleep for -1 milliseconds"},
+		{`sleep("1")`, "Error: argument to `sleep` must be INTEGER or FLOAT, got STRING"},
+		{`formatTime(0)`, "1970-01-01T00:00:00Z"},
+		{`formatTime(86400000 + 1500, "2006-01-02 15:04:05.000")`, "1970-01-02 00:00:01.500"},
+		{`formatTime(1.5)`, "Error: first argument to `formatTime` must be INTEGER, got FLOAT"},
+		{`formatTime(0, 1)`, "Error: second argument to `formatTime` must be STRING, got INTEGER"},
+		{`now(1)`, "Error: wrong number of arguments. got=1, want=0"},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+		if eval.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q",
+				test.input, eval.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	inputs := []string{
+		`while (true) { }`,
+		`let loop = fn(n) { if (n > 0) { loop(n - 1) } }; while (true) { loop(10) }`,
+		`map([1], fn(x) { while (true) { } })`,
+		`sleep(60000)`,
+	}
+
+	for _, input := range inputs {
+		program := parser.New(lexer.New(input)).ParseProgram()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		evaluated := EvalContext(ctx, program, object.NewEnvironment())
+		cancel()
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("object is not Error for %q. got=%T (%+v)", input, evaluated, evaluated)
+			continue
+		}
+		if !strings.HasSuffix(errObj.Message, "context deadline exceeded") {
+			t.Errorf("wrong error message for %q. got=%q", input, errObj.Message)
+		}
+	}
+
+	// The environment's context is restored afterwards.
+	env := object.NewEnvironment()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	EvalContext(ctx, parser.New(lexer.New(`let x = 1;`)).ParseProgram(), env)
+
+	evaluated := Eval(parser.New(lexer.New(`let i = 0; while (i < 3) { i = i + 1 }; i`)).ParseProgram(), env)
+	testIntegerObject(t, evaluated, 3)
+}
+
+func TestStepLimit(t *testing.T) {
+	tests := []struct {
+		input    string
+		limit    uint64
+		exceeded bool
+	}{
+		// The program, the statement, the infix expression and its operands.
+		{`1 + 2`, 5, false},
+		{`1 + 2`, 4, true},
+		{`let i = 0; while (true) { i = i + 1 }`, 1000, true},
+		{`map([1, 2, 3], fn(x) { while (true) { } })`, 1000, true},
+		{`let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(100)`, 100, true},
+	}
+
+	for _, test := range tests {
+		env := object.NewEnvironment()
+		env.SetStepLimit(test.limit)
+		evaluated := Eval(parser.New(lexer.New(test.input)).ParseProgram(), env)
+
+		budget, ok := evaluated.(*object.BudgetExceeded)
+		if ok != test.exceeded {
+			t.Errorf("wrong result for %q with limit %d. got=%s", test.input, test.limit, evaluated.Inspect())
+			continue
+		}
+		if ok && budget.Limit != test.limit {
+			t.Errorf("wrong limit. got=%d, want=%d", budget.Limit, test.limit)
+		}
+	}
+
+	evaluated := testEval(`let i = 0; while (i < 1000) { i = i + 1 }; i`)
+	testIntegerObject(t, evaluated, 1000)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{`let loop = fn(n, acc) { if (n == 0) { acc } else { loop(n - 1, acc + 1) } }; loop(100000, 0)`, 100000},
+		{`let loop = fn(n, acc) { if (n == 0) { return acc; } return loop(n - 1, acc + 1); }; loop(100000, 0)`, 100000},
+		{`let loop = fn(n) { n == 0 ? 7 : loop(n - 1) }; loop(100000)`, 7},
+		{`let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } };
+let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } };
+if (even(100001)) { 0 } else { 1 }`, 1},
+		{`let count = fn(n) { if (n == 0) { 0 } else { 1 + count(n - 1) } }; count(1000)`, 1000},
+		{`let f = fn(n) { len(rest([1, 2, 3])) + n }; let g = fn() { f(1) }; g()`, 3},
+	}
+
+	for _, test := range tests {
+		testIntegerObject(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	tests := []struct {
+		input    string
+		limit    int
+		expected string
+	}{
+		{`let count = fn(n) { if (n == 0) { 0 } else { 1 + count(n - 1) } }; count(100000)`, 0,
+			"stack overflow: more than 1023 nested calls"},
+		{`let count = fn(n) { if (n == 0) { 0 } else { 1 + count(n - 1) } }; count(10)`, 5,
+			"stack overflow: more than 5 nested calls"},
+		{`map([1], fn(x) { map([x], fn(y) { y })[0] })`, 1,
+			"stack overflow: more than 1 nested calls"},
+	}
+
+	for _, test := range tests {
+		env := object.NewEnvironment()
+		env.SetMaxCallDepth(test.limit)
+		evaluated := Eval(parser.New(lexer.New(test.input)).ParseProgram(), env)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned for %q. got=%T (%+v)", test.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != test.expected {
+			t.Errorf("wrong error message. expected=%q, got=%q", test.expected, errObj.Message)
+		}
+	}
+
+	// A stack overflow can be caught, and leaves the depth as it was.
+	env := object.NewEnvironment()
+	env.SetMaxCallDepth(5)
+	evaluated := Eval(parser.New(lexer.New(
+		`let f = fn(n) { try { f(n + 1) + 1 } catch { n } }; let g = fn(n) { if (n == 0) { 0 } else { g(n - 1) + 1 } }; f(0) * 10 + g(4)`,
+	)).ParseProgram(), env)
+	testIntegerObject(t, evaluated, 84)
+}
+
+func TestCheckedArithmetic(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"9223372036854775807 + 1", "integer overflow: 9223372036854775807 + 1"},
+		{"-9223372036854775807 - 2", "integer overflow: -9223372036854775807 - 2"},
+		{"4611686018427387904 * 2", "integer overflow: 4611686018427387904 * 2"},
+		{"let min = -9223372036854775807 - 1; min / -1", "integer overflow: -9223372036854775808 / -1"},
+		{"let min = -9223372036854775807 - 1; -min", "integer overflow: -(-9223372036854775808)"},
+		{"let f = fn(x) { x + x }; f(4611686018427387904)", "integer overflow: 4611686018427387904 + 4611686018427387904"},
+		{"9223372036854775806 + 1", 9223372036854775807},
+		{"9223372036854775807.0 + 1", nil},
+	}
+
+	for _, test := range tests {
+		env := object.NewEnvironment()
+		env.SetCheckedArithmetic(true)
+		evaluated := Eval(parser.New(lexer.New(test.input)).ParseProgram(), env)
+
+		switch expected := test.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error for %q. got=%s", test.input, evaluated.Inspect())
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		default:
+			if _, ok := evaluated.(*object.Float); !ok {
+				t.Errorf("object is not Float. got=%s", evaluated.Inspect())
+			}
+		}
+	}
+
+	// Without checking, overflow wraps around.
+	evaluated := testEval("9223372036854775807 + 1")
+	testIntegerObject(t, evaluated, -9223372036854775808)
+}
+
+func TestMemoryLimit(t *testing.T) {
+	tests := []struct {
+		input    string
+		exceeded bool
+	}{
+		{`let a = []; while (true) { a = push(a, a) }`, true},
+		{`let s = "a"; while (true) { s = s + s }`, true},
+		{`let h = {}; let i = 0; while (true) { h = merge(h, {i: i}); i = i + 1 }`, true},
+		{`let a = [1, 2, 3]; while (true) { a = a[0:] }`, true},
+		{`let a = []; let i = 0; while (i < 10) { a = push(a, i); i = i + 1 }; len(a)`, false},
+	}
+
+	for _, test := range tests {
+		env := object.NewEnvironment()
+		env.SetMemoryLimit(1 << 20)
+		evaluated := Eval(parser.New(lexer.New(test.input)).ParseProgram(), env)
+
+		budget, ok := evaluated.(*object.BudgetExceeded)
+		if ok != test.exceeded {
+			t.Errorf("wrong result for %q. got=%s", test.input, evaluated.Inspect())
+			continue
+		}
+		if ok && (budget.Budget != object.MemoryBudget || budget.Limit != 1<<20) {
+			t.Errorf("wrong budget for %q. got=%+v", test.input, budget)
+		}
+	}
+}
+
+func TestExitBuiltin(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedCode   int64
+		expectedOutput string
+	}{
+		{`exit()`, 0, ""},
+		{`exit(3); puts("unreachable")`, 3, ""},
+		{`puts("a"); let f = fn() { exit(255); 5 }; f() + 1`, 255, "a\n"},
+		{`let x = [1, if (true) { exit(4) }]; puts(x)`, 4, ""},
+		{`map([1, 2, 3], fn(x) { if (x == 2) { exit(x) } puts(x) })`, 2, "1\n"},
+		{`while (true) { exit(5) }`, 5, ""},
+		{`try { exit(6) } catch { puts("caught") } finally { puts("finally") }`, 6, ""},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+
+		env := object.NewEnvironment()
+		env.SetStdout(&out)
+		evaluated := Eval(parser.New(lexer.New(test.input)).ParseProgram(), env)
+
+		exit, ok := evaluated.(*object.Exit)
+		if !ok {
+			t.Errorf("object is not Exit for %q. got=%T (%+v)", test.input, evaluated, evaluated)
+			continue
+		}
+		if exit.Code != test.expectedCode {
+			t.Errorf("wrong exit code for %q. got=%d, want=%d", test.input, exit.Code, test.expectedCode)
+		}
+		if out.String() != test.expectedOutput {
+			t.Errorf("wrong output for %q. got=%q, want=%q",
+				test.input, out.String(), test.expectedOutput)
+		}
+	}
+
+	errors := []struct {
+		input    string
+		expected string
+	}{
+		{`exit("a")`, "Error: argument to `exit` must be INTEGER, got STRING"},
+		{`exit(300)`, "Error: exit code must be between 0 and 255, got 300"},
+		{`exit(-1)`, "Error: exit code must be between 0 and 255, got -1"},
+	}
+
+	for _, test := range errors {
+		evaluated := testEval(test.input)
+		if evaluated.Inspect() != test.expected {
+			t.Errorf("wrong result for %q. got=%q, want=%q", test.input, evaluated.Inspect(), test.expected)
+		}
+	}
+}
+
+func TestErrorHandling(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{
+			"5 + true;",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
 			"5 + true; 5;",
 			"type mismatch: INTEGER + BOOLEAN",
 		},
@@ -570,6 +1953,42 @@ if (10 > 1) {
 			"foobar",
 			"identifier not found: foobar",
 		},
+		{
+			"5 % 0",
+			"modulo by zero",
+		},
+		{
+			"5[1:2]",
+			"slice operator not supported: INTEGER",
+		},
+		{
+			`"hello"["a":]`,
+			"slice index must be INTEGER, got STRING",
+		},
+		{
+			"5.5 % 0",
+			"modulo by zero",
+		},
+		{
+			"5 / 0",
+			"division by zero",
+		},
+		{
+			"2 ** 64",
+			"integer overflow: 2 ** 64",
+		},
+		{
+			"1 << -1",
+			"negative shift count: -1",
+		},
+		{
+			"1.5 & 1",
+			"unknown operator: FLOAT & INTEGER",
+		},
+		{
+			"let f = fn(x) { 10 / x }; f(0)",
+			"division by zero",
+		},
 		{
 			`"Hello" - "World"`,
 			"unknown operator: STRING - STRING",
@@ -578,6 +1997,54 @@ if (10 > 1) {
 			`{"name": "Monkey"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			"fn() { 1; }(1);",
+			"wrong number of arguments: want=0, got=1",
+		},
+		{
+			"fn(a) { a; }();",
+			"wrong number of arguments: want=1, got=0",
+		},
+		{
+			"fn(a, b) { a + b; }(1);",
+			"wrong number of arguments: want=2, got=1",
+		},
+		{
+			"fn(a, b = 1) { a + b; }();",
+			"wrong number of arguments: want=1 or 2, got=0",
+		},
+		{
+			"fn(a = 1, b = 2, c = 3) { a; }(1, 2, 3, 4);",
+			"wrong number of arguments: want=0 to 3, got=4",
+		},
+		{
+			"fn(a = -true) { a; }();",
+			"unknown operator: -BOOLEAN",
+		},
+		{
+			"fn(a, b, ...rest) { a; }(1);",
+			"wrong number of arguments: want=at least 2, got=1",
+		},
+		{
+			"let [a, b] = [1, 2, 3];",
+			"wrong number of elements to destructure: want=2, got=3",
+		},
+		{
+			"let [a] = 1;",
+			"cannot destructure INTEGER as an array",
+		},
+		{
+			`let {"a": a} = [1];`,
+			"cannot destructure ARRAY as a hash",
+		},
+		{
+			`let {"a": a, "b": b} = {"a": 1};`,
+			`hash has no key "b" to destructure`,
+		},
+		{
+			`let {[]: a} = {"a": 1};`,
+			"unusable as hash key: ARRAY",
+		},
 	}
 
 	for _, test := range tests {
@@ -596,3 +2063,58 @@ if (10 > 1) {
 		}
 	}
 }
+
+func TestErrorStackTraces(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedStack []object.StackFrame
+	}{
+		{"5 + true;", nil},
+		{
+			`let f = fn() { 5 + true };
+f();`,
+			[]object.StackFrame{{Function: "f", Line: 2, Column: 2}},
+		},
+		{
+			`let inner = fn(x) { len(x) };
+let outer = fn() { inner(1) };
+fn() { outer() }();`,
+			[]object.StackFrame{
+				{Function: "inner", Line: 2, Column: 25},
+				{Function: "outer", Line: 3, Column: 13},
+				{Function: "<anonymous>", Line: 3, Column: 17},
+			},
+		},
+		{
+			`let loop = fn(n) { if (n == 0) { len(1) } else { loop(n - 1) } };
+loop(1000);`,
+			[]object.StackFrame{
+				{Function: "loop", Line: 1, Column: 54},
+				{Function: "loop", Line: 2, Column: 5},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		eval := testEval(test.input)
+
+		errObj, ok := eval.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. got=%T (%+v)", eval, eval)
+			continue
+		}
+
+		if len(errObj.Stack) != len(test.expectedStack) {
+			t.Errorf("wrong stack length. want=%d, got=%d (%+v)",
+				len(test.expectedStack), len(errObj.Stack), errObj.Stack)
+			continue
+		}
+
+		for i, frame := range test.expectedStack {
+			if errObj.Stack[i] != frame {
+				t.Errorf("wrong stack frame %d. want=%+v, got=%+v",
+					i, frame, errObj.Stack[i])
+			}
+		}
+	}
+}
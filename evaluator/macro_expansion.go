@@ -0,0 +1,120 @@
+package evaluator
+
+import (
+	"monkey/ast"
+	"monkey/object"
+)
+
+// Defines the macros bound at the top level of program, as in
+// `let unless = macro(cond, then) { ... };`, in env, removing their
+// definitions from program. Macros defined in env by earlier programs can
+// be expanded in later ones, as in the REPL.
+func DefineMacros(program *ast.Program, env *object.Environment) {
+	statements := program.Statements[:0]
+	for _, stmt := range program.Statements {
+		let, ok := stmt.(*ast.LetStatement)
+		if !ok {
+			statements = append(statements, stmt)
+			continue
+		}
+		lit, ok := let.Value.(*ast.MacroLiteral)
+		if !ok {
+			statements = append(statements, stmt)
+			continue
+		}
+
+		env.Set(let.Name.Value, &object.Macro{
+			Parameters: lit.Parameters,
+			Body:       lit.Body,
+			Env:        env,
+		})
+	}
+	program.Statements = statements
+}
+
+// Replaces the calls of the macros defined in env within program with the
+// code the macros return for them, which has to be quoted. A macro is passed
+// the expressions it is called with, quoted, rather than their values. It
+// returns the expanded program, or the error that expanding a call failed
+// with.
+func ExpandMacros(program ast.Node, env *object.Environment) (ast.Node, *object.Error) {
+	var failed *object.Error
+	expanded := ast.Modify(program, func(node ast.Node) ast.Node {
+		if failed != nil {
+			return node
+		}
+		call, ok := node.(*ast.CallExpression)
+		if !ok {
+			return node
+		}
+		ident, ok := call.Function.(*ast.Identifier)
+		if !ok {
+			return node
+		}
+		obj, ok := env.Get(ident.Value)
+		if !ok {
+			return node
+		}
+		macro, ok := obj.(*object.Macro)
+		if !ok {
+			return node
+		}
+
+		expr, err := expandMacro(ident.Value, macro, call, env)
+		if err != nil {
+			if err.Line == 0 {
+				err.Line, err.Column = call.Token.Line, call.Token.Column
+			}
+			failed = err
+			return node
+		}
+		return expr
+	})
+	if failed != nil {
+		return nil, failed
+	}
+
+	return expanded, nil
+}
+
+// Returns the expression a macro returns for a call of it.
+func expandMacro(
+	name string,
+	macro *object.Macro,
+	call *ast.CallExpression,
+	env *object.Environment,
+) (ast.Expression, *object.Error) {
+	if len(call.Arguments) != len(macro.Parameters) {
+		return nil, newError("wrong number of arguments to macro %s: want=%d, got=%d",
+			name, len(macro.Parameters), len(call.Arguments))
+	}
+
+	macroEnv := object.NewEnclosedEnvironment(macro.Env)
+	for i, param := range macro.Parameters {
+		macroEnv.Set(param.Value, &object.Quote{Node: call.Arguments[i]})
+	}
+
+	res := guard(env, func() object.Object {
+		return unwrapReturnValue(Eval(macro.Body, macroEnv))
+	})
+	switch res := res.(type) {
+	case *object.Quote:
+		if expr, ok := res.Node.(ast.Expression); ok {
+			return expr, nil
+		}
+	case *object.Error:
+		return nil, res
+	case *object.Thrown:
+		return nil, uncaught(res)
+	}
+	return nil, newError("macro %s returned %s, not a quoted expression", name, typeOf(res))
+}
+
+// Returns the type of obj, for messages, including for the nil that
+// statements evaluate to.
+func typeOf(obj object.Object) object.ObjectType {
+	if obj == nil {
+		return object.NULL_OBJ
+	}
+	return obj.Type()
+}
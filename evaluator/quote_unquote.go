@@ -0,0 +1,97 @@
+package evaluator
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/object"
+	"monkey/token"
+)
+
+// Reports whether node is a call of `name`, which is how `quote` and
+// `unquote` are written.
+func isCallOf(node ast.Node, name string) bool {
+	call, ok := node.(*ast.CallExpression)
+	if !ok {
+		return false
+	}
+	ident, ok := call.Function.(*ast.Identifier)
+	return ok && ident.Value == name
+}
+
+// Evaluates `quote(node)`, which returns node unevaluated, but with the
+// calls of `unquote` within it replaced by the values of their arguments.
+func quote(call *ast.CallExpression, env *object.Environment) object.Object {
+	if len(call.Arguments) != 1 {
+		return newError("wrong number of arguments to quote: want=1, got=%d", len(call.Arguments))
+	}
+
+	var failed object.Object
+	node := ast.Modify(call.Arguments[0], func(node ast.Node) ast.Node {
+		if failed != nil || !isCallOf(node, "unquote") {
+			return node
+		}
+
+		unquote := node.(*ast.CallExpression)
+		if len(unquote.Arguments) != 1 {
+			failed = newError("wrong number of arguments to unquote: want=1, got=%d", len(unquote.Arguments))
+			return node
+		}
+
+		val := Eval(unquote.Arguments[0], env)
+		if isError(val) {
+			failed = val
+			return node
+		}
+
+		expr, ok := objectToExpression(val, unquote.Token)
+		if !ok {
+			failed = newError("cannot unquote %s", val.Type())
+			return node
+		}
+		return expr
+	})
+	if failed != nil {
+		return failed
+	}
+
+	return &object.Quote{Node: node}
+}
+
+// Returns the expression that evaluates to obj, with tok's position, if obj
+// is a value that can be written as a literal, or a quote.
+func objectToExpression(obj object.Object, tok token.Token) (ast.Expression, bool) {
+	at := func(typ token.TokenType, literal string) token.Token {
+		return token.Token{Type: typ, Literal: literal, Line: tok.Line, Column: tok.Column}
+	}
+
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return &ast.IntegerLiteral{Token: at(token.INT, fmt.Sprintf("%d", obj.Value)), Value: obj.Value}, true
+	case *object.Float:
+		return &ast.FloatLiteral{Token: at(token.FLOAT, obj.Inspect()), Value: obj.Value}, true
+	case *object.String:
+		return &ast.StringLiteral{Token: at(token.STRING, obj.Value), Value: obj.Value}, true
+	case *object.Boolean:
+		if obj.Value {
+			return &ast.Boolean{Token: at(token.TRUE, "true"), Value: true}, true
+		}
+		return &ast.Boolean{Token: at(token.FALSE, "false"), Value: false}, true
+	case *object.NULL:
+		return &ast.NullLiteral{Token: at(token.NULL, "null")}, true
+	case *object.Array:
+		elements := make([]ast.Expression, len(obj.Elements))
+		for i, el := range obj.Elements {
+			expr, ok := objectToExpression(el, tok)
+			if !ok {
+				return nil, false
+			}
+			elements[i] = expr
+		}
+		return &ast.ArrayLiteral{Token: at(token.LBRACKET, "["), Elements: elements}, true
+	case *object.Quote:
+		expr, ok := obj.Node.(ast.Expression)
+		return expr, ok
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"monkey/lexer"
+	"monkey/parser"
+	"os"
+)
+
+const fmtUsage = "usage: monkey fmt [-l] [-w] script.monkey..."
+
+// Implements `monkey fmt`, which prints scripts in the canonical format, or
+// with -w rewrites them in it.
+func fmtCommand(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	list := flags.Bool("l", false, "list the scripts whose formatting differs, instead of printing them")
+	write := flags.Bool("w", false, "write the formatted scripts back to their files, instead of printing them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), fmtUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	code := 0
+	for _, path := range flags.Args() {
+		if !formatScript(path, *list, *write) {
+			code = 1
+		}
+	}
+	return code
+}
+
+// Formats the script at path, reporting any errors on stderr.
+func formatScript(path string, list, write bool) bool {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "monkey: %s\n", err)
+		return false
+	}
+
+	p := parser.New(lexer.New(string(src)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		for _, err := range p.Errors() {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", path, err.Diagnostic())
+		}
+		return false
+	}
+
+	formatted := []byte(program.Format())
+	changed := !bytes.Equal(formatted, src)
+
+	if list && changed {
+		fmt.Println(path)
+	}
+	if write && changed {
+		if err := os.WriteFile(path, formatted, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "monkey: %s\n", err)
+			return false
+		}
+	}
+	if !list && !write {
+		os.Stdout.Write(formatted)
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package interp
+
+import (
+	"fmt"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/token"
+	"reflect"
+)
+
+// Makes a Go function callable from Monkey as a builtin named name, in every
+// interpreter created afterwards and on both engines. Builtins have to be
+// registered before any interpreter is created, as registering isn't safe
+// while programs run, and in the same order wherever bytecode is compiled
+// and run. There can be at most object.MaxBuiltins, those of the language
+// included.
+//
+// fn returns the builtin's result, which may be an *object.Error. A nil
+// result is turned into null.
+func RegisterBuiltin(name string, fn func(args ...object.Object) object.Object) error {
+	if !isIdentifier(name) {
+		return fmt.Errorf("builtin name %q is not an identifier", name)
+	}
+
+	return object.RegisterBuiltin(name, func(rt object.Runtime, args ...object.Object) object.Object {
+		return fn(args...)
+	})
+}
+
+// Like RegisterBuiltin, but for any Go function whose parameters are
+// integers, floats, strings, booleans, object.Object values, or interface{}
+// values, which get arguments converted by object.ToGo. Arguments are
+// converted from Monkey values, and checked, before fn is called. fn may
+// return nothing, a value that object.FromGo converts, or such a value
+// followed by an error, which becomes a Monkey error.
+func RegisterFunc(name string, fn interface{}) error {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func {
+		return fmt.Errorf("builtin %s is not a function, got %T", name, fn)
+	}
+
+	ft := f.Type()
+	if ft.IsVariadic() {
+		return fmt.Errorf("builtin %s is variadic, which isn't supported", name)
+	}
+	for i := 0; i < ft.NumIn(); i++ {
+		if !isConvertible(ft.In(i)) {
+			return fmt.Errorf("builtin %s has parameter of unsupported type %s", name, ft.In(i))
+		}
+	}
+
+	returnsError := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+	numValues := ft.NumOut()
+	if returnsError {
+		numValues--
+	}
+	if numValues > 1 {
+		return fmt.Errorf("builtin %s must return at most one value, and an error", name)
+	}
+
+	return RegisterBuiltin(name, func(args ...object.Object) object.Object {
+		if len(args) != ft.NumIn() {
+			return &object.Error{Message: fmt.Sprintf(
+				"wrong number of arguments. got=%d, want=%d", len(args), ft.NumIn())}
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			v, ok := fromObject(arg, ft.In(i))
+			if ok {
+				in[i] = v
+				continue
+			}
+
+			want := objectTypeOf(ft.In(i))
+			if arg.Type() == want {
+				return &object.Error{Message: fmt.Sprintf(
+					"argument %d to `%s` is out of range for %s", i+1, name, ft.In(i))}
+			}
+			return &object.Error{Message: fmt.Sprintf(
+				"argument %d to `%s` must be %s, got %s", i+1, name, want, arg.Type())}
+		}
+
+		out := f.Call(in)
+		if returnsError {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return &object.Error{Message: err.Error()}
+			}
+		}
+		if numValues == 0 {
+			return object.Null
+		}
+
+		result, err := object.FromGo(out[0].Interface())
+		if err != nil {
+			return &object.Error{Message: fmt.Sprintf("result of `%s`: %s", name, err)}
+		}
+		return result
+	})
+}
+
+var (
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	objectType = reflect.TypeOf((*object.Object)(nil)).Elem()
+	anyType    = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+func isConvertible(t reflect.Type) bool {
+	return objectTypeOf(t) != ""
+}
+
+// Returns the type of the Monkey values a Go type is converted from, or ""
+// if it can't be converted.
+func objectTypeOf(t reflect.Type) object.ObjectType {
+	if t == objectType || t == anyType {
+		return "any value"
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object.INTEGER_OBJ
+	case reflect.Float32, reflect.Float64:
+		return object.FLOAT_OBJ
+	case reflect.String:
+		return object.STRING_OBJ
+	case reflect.Bool:
+		return object.BOOLEAN_OBJ
+	default:
+		return ""
+	}
+}
+
+// Converts a Monkey value to the Go type t. Integers are accepted for
+// floats, but not the other way around, and integers that don't fit t are
+// rejected.
+func fromObject(obj object.Object, t reflect.Type) (reflect.Value, bool) {
+	switch t {
+	case objectType:
+		return reflect.ValueOf(&obj).Elem(), true
+	case anyType:
+		v := object.ToGo(obj)
+		return reflect.ValueOf(&v).Elem(), true
+	}
+
+	v := reflect.New(t).Elem()
+	switch obj := obj.(type) {
+	case *object.Integer:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.OverflowInt(obj.Value) {
+				return v, false
+			}
+			v.SetInt(obj.Value)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if obj.Value < 0 || v.OverflowUint(uint64(obj.Value)) {
+				return v, false
+			}
+			v.SetUint(uint64(obj.Value))
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(float64(obj.Value))
+		default:
+			return v, false
+		}
+	case *object.Float:
+		if t.Kind() != reflect.Float32 && t.Kind() != reflect.Float64 {
+			return v, false
+		}
+		v.SetFloat(obj.Value)
+	case *object.String:
+		if t.Kind() != reflect.String {
+			return v, false
+		}
+		v.SetString(obj.Value)
+	case *object.Boolean:
+		if t.Kind() != reflect.Bool {
+			return v, false
+		}
+		v.SetBool(obj.Value)
+	default:
+		return v, false
+	}
+
+	return v, true
+}
+
+// Reports whether name is lexed as a single identifier, so that programs can
+// refer to a builtin by it.
+func isIdentifier(name string) bool {
+	l := lexer.New(name)
+	tok := l.NextToken()
+	return tok.Type == token.IDENT && tok.Literal == name && l.NextToken().Type == token.EOF
+}
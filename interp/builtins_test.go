@@ -0,0 +1,167 @@
+package interp
+
+import (
+	"errors"
+	"fmt"
+	"monkey/object"
+	"strings"
+	"testing"
+)
+
+// Builtins stay registered for the rest of the process, so they are
+// registered once for every test.
+func init() {
+	err := RegisterBuiltin("countArgs", func(args ...object.Object) object.Object {
+		return &object.Integer{Value: int64(len(args))}
+	})
+	if err == nil {
+		err = RegisterFunc("repeat", strings.Repeat)
+	}
+	if err == nil {
+		err = RegisterFunc("half", func(x float64) float64 { return x / 2 })
+	}
+	if err == nil {
+		err = RegisterFunc("checkPositive", func(n int8) (bool, error) {
+			if n <= 0 {
+				return false, errors.New("not positive")
+			}
+			return true, nil
+		})
+	}
+	if err == nil {
+		err = RegisterFunc("typeOf", func(obj object.Object) string { return string(obj.Type()) })
+	}
+	if err == nil {
+		err = RegisterFunc("nothing", func() {})
+	}
+	if err == nil {
+		err = RegisterFunc("fields", strings.Fields)
+	}
+	if err == nil {
+		err = RegisterFunc("describe", func(v interface{}) string { return fmt.Sprintf("%T", v) })
+	}
+	if err == nil {
+		err = RegisterFunc("badResult", func() chan int { return nil })
+	}
+	if err == nil {
+		err = RegisterFunc("crash", func() { panic("boom") })
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisteredBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`countArgs(1, "a", [])`, "3"},
+		{`countArgs()`, "0"},
+		{`repeat("ab", 3)`, "ababab"},
+		{`half(3)`, "1.5"},
+		{`half(1.0)`, "0.5"},
+		{`checkPositive(1)`, "true"},
+		{`let f = fn(g) { g("x", 2) }; f(repeat)`, "xx"},
+		{`map([1, 2], half)`, "[0.5, 1.0]"},
+		{`typeOf([1])`, "ARRAY"},
+		{`nothing()`, "null"},
+		{`fields(" a  b ")`, "[a, b]"},
+		{`describe([1, {"a": 2.5}])`, "[]interface {}"},
+		{`describe({})`, "map[interface {}]interface {}"},
+		{`describe(if (false) { 1 })`, "<nil>"},
+	}
+
+	for _, engine := range engines {
+		for _, test := range tests {
+			result, err := New(Options{Engine: engine}).Eval(test.input)
+			if err != nil {
+				t.Errorf("[%s] error for %q: %s", engine, test.input, err)
+				continue
+			}
+			if result.Inspect() != test.expected {
+				t.Errorf("[%s] wrong result for %q. got=%s, want=%s",
+					engine, test.input, result.Inspect(), test.expected)
+			}
+		}
+	}
+}
+
+func TestRegisteredBuiltinErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`repeat("a")`, "wrong number of arguments. got=1, want=2"},
+		{`repeat(1, 2)`, "argument 1 to `repeat` must be STRING, got INTEGER"},
+		{`half("a")`, "argument 1 to `half` must be FLOAT, got STRING"},
+		{`checkPositive(1000)`, "argument 1 to `checkPositive` is out of range for int8"},
+		{`checkPositive(-1)`, "not positive"},
+		{`badResult()`, "result of `badResult`: cannot convert chan int to an object"},
+	}
+
+	for _, engine := range engines {
+		for _, test := range tests {
+			_, err := New(Options{Engine: engine}).Eval(test.input)
+			if err == nil {
+				t.Errorf("[%s] no error for %q", engine, test.input)
+				continue
+			}
+			if err.Error() != test.expected {
+				t.Errorf("[%s] wrong error for %q. got=%q, want=%q",
+					engine, test.input, err.Error(), test.expected)
+			}
+		}
+	}
+}
+
+func TestPanickingBuiltin(t *testing.T) {
+	for _, engine := range engines {
+		_, err := New(Options{Engine: engine}).Eval(`let f = fn() { crash() }; try { f() } catch { 1 }`)
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("[%s] error is not *RuntimeError. got=%T (%v)", engine, err, err)
+		}
+		if runtimeErr.Message != "internal error: boom" {
+			t.Errorf("[%s] wrong error. got=%q", engine, runtimeErr.Message)
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); r != "boom" {
+					t.Errorf("[%s] wrong panic in strict mode. got=%v", engine, r)
+				}
+			}()
+			New(Options{Engine: engine, Strict: true}).Eval(`crash()`)
+		}()
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		fn       interface{}
+		expected string
+	}{
+		{"len", func() {}, "builtin len is already defined"},
+		{"countArgs", func() {}, "builtin countArgs is already defined"},
+		{"two words", func() {}, `builtin name "two words" is not an identifier`},
+		{"fn", func() {}, `builtin name "fn" is not an identifier`},
+		{"notFunc", 5, "builtin notFunc is not a function, got int"},
+		{"variadic", func(a ...int) {}, "builtin variadic is variadic, which isn't supported"},
+		{"badParam", func(a []int) {}, "builtin badParam has parameter of unsupported type []int"},
+		{"twoResults", func() (int, int) { return 0, 0 },
+			"builtin twoResults must return at most one value, and an error"},
+	}
+
+	for _, test := range tests {
+		err := RegisterFunc(test.name, test.fn)
+		if err == nil {
+			t.Errorf("no error registering %s", test.name)
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Errorf("wrong error registering %s. got=%q, want=%q", test.name, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+// Package interp embeds Monkey in Go programs. An Interpreter runs source
+// code on either engine, keeping the bindings each program defines for the
+// programs run after it:
+//
+//	in := interp.New(interp.Options{})
+//	in.Eval(`let add = fn(a, b) { a + b };`)
+//	result, err := in.Eval(`add(1, 2)`) // 3
+package interp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"os"
+	"strings"
+)
+
+// The engines an Interpreter can run code with.
+const (
+	EngineVM        = "vm"
+	EngineEvaluator = "eval"
+)
+
+type Options struct {
+	Engine string    // EngineVM if empty.
+	Stdout io.Writer // Where builtins like `puts` write; os.Stdout if nil.
+	Stdin  io.Reader // Where builtins like `readLine` read; os.Stdin if nil.
+
+	// How many steps each call to Eval or Call may take: instructions on
+	// the VM, or nodes evaluated by the evaluator. 0 for no limit.
+	StepLimit uint64
+	// How many bytes each call to Eval or Call may allocate for arrays,
+	// strings and hashes, as estimated by object.SizeOf. 0 for no limit.
+	MemoryLimit uint64
+	// How deeply function calls may nest before the program fails with a
+	// stack overflow. 0 for the engine's default, which is 1023 on both.
+	MaxCallDepth int
+
+	// Whether integer arithmetic fails with an error on overflow, rather
+	// than wrap around.
+	CheckedArithmetic bool
+
+	// Whether panics in the engine are let through, for debugging it,
+	// rather than turned into a *RuntimeError.
+	Strict bool
+
+	// Capabilities the builtins may not use, such as
+	// object.FileSystemCapability. Use object.Capabilities to deny all of
+	// them to untrusted scripts.
+	Deny []object.Capability
+}
+
+type Interpreter struct {
+	engine      string
+	stdout      io.Writer
+	stdin       io.Reader
+	stepLimit   uint64
+	memoryLimit uint64
+	maxDepth    int
+	checked     bool
+	strict      bool
+	denied      []object.Capability
+
+	// The macros defined so far, which are expanded on either engine.
+	macros *object.Environment
+
+	// The state of the evaluator.
+	env *object.Environment
+
+	// The state of the VM.
+	constants   []object.Object
+	globals     []object.Object
+	symbolTable *compiler.SymbolTable
+}
+
+// Returns an interpreter with nothing defined but the builtins. It panics
+// if opts names an unknown engine.
+func New(opts Options) *Interpreter {
+	in := &Interpreter{
+		engine:      opts.Engine,
+		stdout:      opts.Stdout,
+		stdin:       opts.Stdin,
+		stepLimit:   opts.StepLimit,
+		memoryLimit: opts.MemoryLimit,
+		maxDepth:    opts.MaxCallDepth,
+		checked:     opts.CheckedArithmetic,
+		strict:      opts.Strict,
+		denied:      opts.Deny,
+	}
+	if in.engine == "" {
+		in.engine = EngineVM
+	}
+	if in.stdout == nil {
+		in.stdout = os.Stdout
+	}
+	if in.stdin == nil {
+		in.stdin = os.Stdin
+	}
+
+	in.macros = object.NewEnvironment()
+	in.macros.SetStdout(in.stdout)
+	in.macros.SetStdin(in.stdin)
+
+	switch in.engine {
+	case EngineVM:
+		in.constants = []object.Object{}
+		in.globals = make([]object.Object, vm.GLOBALS_SIZE)
+		in.symbolTable = compiler.NewSymbolTable()
+		for i, b := range object.Builtins {
+			in.symbolTable.DefineBuiltin(i, b.Name)
+		}
+	case EngineEvaluator:
+		in.env = object.NewEnvironment()
+		in.env.SetStdout(in.stdout)
+		in.env.SetStdin(in.stdin)
+		in.env.SetMaxCallDepth(in.maxDepth)
+		in.env.SetCheckedArithmetic(in.checked)
+		in.env.SetStrict(in.strict)
+		for _, c := range in.denied {
+			in.env.Deny(c)
+		}
+	default:
+		panic("interp: unknown engine " + in.engine)
+	}
+
+	return in
+}
+
+// Runs src in a new interpreter, returning the value it ended with.
+func Eval(src string) (object.Object, error) {
+	return New(Options{}).Eval(src)
+}
+
+// Runs src, returning the value it ended with, or null if it ended with a
+// statement such as `let`. Bindings it defines are kept for later calls.
+//
+// The error is a *ParseError if src doesn't parse, a *CompileError if the VM
+// can't compile it, or a *RuntimeError if it fails while running. If the
+// program calls `exit`, the error is the *object.Exit it produced, and if it
+// exceeds the step or memory limit, the *object.BudgetExceeded.
+func (in *Interpreter) Eval(src string) (object.Object, error) {
+	return in.EvalContext(context.Background(), src)
+}
+
+// Like Eval, but stops the program once ctx is done, returning ctx.Err().
+func (in *Interpreter) EvalContext(ctx context.Context, src string) (object.Object, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, &ParseError{Errors: p.Errors()}
+	}
+
+	evaluator.DefineMacros(program, in.macros)
+	expanded, expandErr := evaluator.ExpandMacros(program, in.macros)
+	if expandErr != nil {
+		return nil, &RuntimeError{
+			Message: expandErr.Message,
+			Line:    expandErr.Line,
+			Column:  expandErr.Column,
+		}
+	}
+	program = expanded.(*ast.Program)
+
+	var result object.Object
+	var err error
+	if in.engine == EngineEvaluator {
+		result, err = in.evaluate(ctx, program)
+	} else {
+		result, err = in.runBytecode(ctx, program)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return result, err
+}
+
+func (in *Interpreter) evaluate(ctx context.Context, program *ast.Program) (object.Object, error) {
+	in.env.SetStepLimit(in.stepLimit)
+	in.env.SetMemoryLimit(in.memoryLimit)
+
+	switch result := evaluator.EvalContext(ctx, program, in.env).(type) {
+	case *object.Error:
+		return nil, &RuntimeError{Message: result.Message, Stack: result.Stack}
+	case *object.Exit:
+		return nil, result
+	case *object.BudgetExceeded:
+		return nil, result
+	case nil:
+		return object.Null, nil
+	default:
+		return result, nil
+	}
+}
+
+func (in *Interpreter) runBytecode(ctx context.Context, program *ast.Program) (object.Object, error) {
+	// The program is compiled against a copy of the symbol table, so that
+	// nothing it defines is kept if it doesn't compile, and what it defines
+	// but never gets to set is forgotten once it has run.
+	symbols := in.symbolTable.Copy()
+	comp := compiler.NewWithState(symbols, in.constants)
+	for _, c := range in.denied {
+		comp.Deny(c)
+	}
+	if err := comp.Compile(program); err != nil {
+		return nil, &CompileError{Message: err.Error()}
+	}
+
+	bytecode := comp.Bytecode()
+	in.constants = bytecode.Constants
+
+	machine := in.newVM(bytecode)
+	err := machine.RunContext(ctx)
+	symbols.Forget(in.symbolTable, func(symbol compiler.Symbol) bool {
+		return symbol.Scope != compiler.GlobalScope || in.globals[symbol.Index] != nil
+	})
+	in.symbolTable = symbols
+	switch err.(type) {
+	case *object.Exit, *object.BudgetExceeded:
+		return nil, err
+	}
+	if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+		return nil, &RuntimeError{
+			Message: runtimeErr.Message,
+			Stack:   runtimeErr.Stack,
+			Line:    runtimeErr.Line,
+			Column:  runtimeErr.Column,
+		}
+	}
+	if err != nil {
+		return nil, &RuntimeError{Message: err.Error()}
+	}
+
+	// Only an expression statement, or a return, leaves its value behind to
+	// be popped.
+	if !machine.Halted() && !endsWithExpression(program) {
+		return object.Null, nil
+	}
+
+	// An error the program ends with is reported as the evaluator reports
+	// it.
+	result := machine.LastPoppedStackElem()
+	if errObj, ok := result.(*object.Error); ok {
+		return nil, &RuntimeError{Message: errObj.Message, Stack: errObj.Stack}
+	}
+	return result, nil
+}
+
+// Calls the function bound to name, which may be a builtin, with arguments
+// converted by object.FromGo. Its result and errors are those of Eval.
+func (in *Interpreter) Call(name string, args ...interface{}) (object.Object, error) {
+	return in.CallContext(context.Background(), name, args...)
+}
+
+// Like Call, but stops the function once ctx is done, returning ctx.Err().
+func (in *Interpreter) CallContext(ctx context.Context, name string, args ...interface{}) (object.Object, error) {
+	fn, ok := in.lookup(name)
+	if !ok {
+		return nil, &RuntimeError{Message: "identifier not found: " + name}
+	}
+	return in.callFunction(ctx, fn, args)
+}
+
+// Calls a function value produced by this interpreter, such as one returned
+// by Eval, with arguments converted by object.FromGo.
+func (in *Interpreter) CallFunction(fn object.Object, args ...interface{}) (object.Object, error) {
+	return in.callFunction(context.Background(), fn, args)
+}
+
+func (in *Interpreter) callFunction(ctx context.Context, fn object.Object, args []interface{}) (object.Object, error) {
+	objects := make([]object.Object, len(args))
+	for i, arg := range args {
+		obj, err := object.FromGo(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		objects[i] = obj
+	}
+
+	var result object.Object
+	if in.engine == EngineEvaluator {
+		outer := in.env.Context()
+		in.env.SetContext(ctx)
+		in.env.SetStepLimit(in.stepLimit)
+		in.env.SetMemoryLimit(in.memoryLimit)
+		result = evaluator.Apply(fn, objects, in.env)
+		in.env.SetContext(outer)
+	} else {
+		machine := in.newVM(&compiler.Bytecode{Constants: in.constants})
+		machine.SetContext(ctx)
+		result = machine.Call(fn, objects...)
+	}
+
+	switch result := result.(type) {
+	case *object.Error:
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &RuntimeError{Message: result.Message, Stack: result.Stack}
+	case *object.Thrown:
+		return nil, &RuntimeError{Message: result.Error()}
+	case *object.Exit:
+		return nil, result
+	case *object.BudgetExceeded:
+		return nil, result
+	default:
+		return result, nil
+	}
+}
+
+// Returns the value bound to a global name or builtin.
+func (in *Interpreter) lookup(name string) (object.Object, bool) {
+	if in.engine == EngineEvaluator {
+		if val, ok := in.env.Get(name); ok {
+			return val, true
+		}
+		builtin := object.GetBuiltinByName(name)
+		return builtin, builtin != nil
+	}
+
+	symbol, ok := in.symbolTable.Resolve(name)
+	if !ok {
+		return nil, false
+	}
+	switch symbol.Scope {
+	case compiler.GlobalScope:
+		val := in.globals[symbol.Index]
+		return val, val != nil
+	case compiler.BuiltinScope:
+		return object.Builtins[symbol.Index].Builtin, true
+	default:
+		return nil, false
+	}
+}
+
+// Returns a VM for running bytecode against the interpreter's globals.
+func (in *Interpreter) newVM(bytecode *compiler.Bytecode) *vm.VM {
+	opts := vm.Options{Globals: in.globals}
+	if in.maxDepth > 0 {
+		// The frames include the one the program runs in.
+		opts.MaxFrames = in.maxDepth + 1
+	}
+	machine := vm.NewWithOptions(bytecode, opts)
+	machine.SetStdout(in.stdout)
+	machine.SetStdin(in.stdin)
+	machine.SetStepLimit(in.stepLimit)
+	machine.SetMemoryLimit(in.memoryLimit)
+	machine.SetCheckedArithmetic(in.checked)
+	machine.SetStrict(in.strict)
+	for _, c := range in.denied {
+		machine.Deny(c)
+	}
+	return machine
+}
+
+func endsWithExpression(program *ast.Program) bool {
+	if len(program.Statements) == 0 {
+		return false
+	}
+	_, ok := program.Statements[len(program.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
+
+// Returned by Eval when the source doesn't parse.
+type ParseError struct {
+	Errors []*parser.ParseError
+}
+
+func (e *ParseError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Returned by Eval when the VM's compiler rejects the program, e.g. because
+// it refers to a variable that isn't defined. The evaluator reports such
+// mistakes as a *RuntimeError instead, once it reaches them.
+type CompileError struct {
+	Message string
+}
+
+func (e *CompileError) Error() string {
+	return e.Message
+}
+
+// Returned by Eval when the program fails while running.
+type RuntimeError struct {
+	Message string
+	Stack   []object.StackFrame // Innermost call first, if known.
+
+	// Where in the source the program failed, if known: only the VM knows,
+	// apart from the call of a macro that failed to expand.
+	Line   int
+	Column int
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,489 @@
+package interp
+
+import (
+	"bytes"
+	"context"
+	"monkey/object"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var engines = []string{EngineVM, EngineEvaluator}
+
+func TestEvalKeepsBindings(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine})
+
+		inputs := []struct {
+			input    string
+			expected string
+		}{
+			{`let x = 5;`, "null"},
+			{`let add = fn(a, b) { a + b };`, "null"},
+			{`add(x, 2)`, "7"},
+			{`x = x * 2; let y = [x];`, "null"},
+			{`y`, "[10]"},
+			{``, "null"},
+			{`let twice = fn(f) { fn(v) { f(f(v)) } }; twice(fn(v) { add(v, x) })(1)`, "21"},
+		}
+
+		for _, test := range inputs {
+			result, err := in.Eval(test.input)
+			if err != nil {
+				t.Errorf("[%s] error for %q: %s", engine, test.input, err)
+				continue
+			}
+			if result.Inspect() != test.expected {
+				t.Errorf("[%s] wrong result for %q. got=%s, want=%s",
+					engine, test.input, result.Inspect(), test.expected)
+			}
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine})
+
+		_, err := in.Eval(`let x = ;`)
+		parseErr, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("[%s] error is not *ParseError. got=%T (%v)", engine, err, err)
+		}
+		if len(parseErr.Errors) != 1 || parseErr.Errors[0].Line != 1 {
+			t.Errorf("[%s] wrong parse errors. got=%v", engine, parseErr.Errors)
+		}
+
+		_, err = in.Eval(`let f = fn(x) { x + true }; f(1)`)
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("[%s] error is not *RuntimeError. got=%T (%v)", engine, err, err)
+		}
+		if !strings.Contains(runtimeErr.Message, "INTEGER + BOOLEAN") {
+			t.Errorf("[%s] wrong runtime error. got=%q", engine, runtimeErr.Message)
+		}
+		if len(runtimeErr.Stack) != 1 || runtimeErr.Stack[0].String() != "at f (1:30)" {
+			t.Errorf("[%s] wrong stack. got=%v", engine, runtimeErr.Stack)
+		}
+		if engine == EngineVM && (runtimeErr.Line != 1 || runtimeErr.Column != 19) {
+			t.Errorf("[%s] wrong position. got=%d:%d", engine, runtimeErr.Line, runtimeErr.Column)
+		}
+
+		// The interpreter is still usable after an error.
+		result, err := in.Eval(`1 + 1`)
+		if err != nil || result.Inspect() != "2" {
+			t.Errorf("[%s] wrong result after error. got=%v, %v", engine, result, err)
+		}
+
+		_, err = in.Eval(`exit(3)`)
+		exit, ok := err.(*object.Exit)
+		if !ok || exit.Code != 3 {
+			t.Errorf("[%s] wrong error for exit. got=%T (%v)", engine, err, err)
+		}
+	}
+
+	_, err := New(Options{Engine: EngineVM}).Eval(`undefined`)
+	if _, ok := err.(*CompileError); !ok {
+		t.Errorf("error is not *CompileError. got=%T (%v)", err, err)
+	}
+
+	_, err = New(Options{Engine: EngineEvaluator}).Eval(`undefined`)
+	if _, ok := err.(*RuntimeError); !ok {
+		t.Errorf("error is not *RuntimeError. got=%T (%v)", err, err)
+	}
+}
+
+// What a program defines before failing stays, and what it would have
+// defined after doesn't.
+func TestEvalFailureKeepsEarlierBindings(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine})
+
+		if _, err := in.Eval("let a = 1; let b = len(1); let c = 3;"); err == nil {
+			t.Fatalf("[%s] no error", engine)
+		}
+		if result, err := in.Eval("a"); err != nil || result.Inspect() != "1" {
+			t.Errorf("[%s] wrong a. got=%v, %v", engine, result, err)
+		}
+		for _, name := range []string{"b", "c"} {
+			if result, err := in.Eval(name); err == nil {
+				t.Errorf("[%s] %s defined after failing. got=%v", engine, name, result)
+			}
+			if result, err := in.Call(name); err == nil {
+				t.Errorf("[%s] %s callable after failing. got=%v", engine, name, result)
+			}
+		}
+	}
+
+	// The VM runs nothing of a program that doesn't compile, so nothing it
+	// defines is kept.
+	in := New(Options{Engine: EngineVM})
+	if _, err := in.Eval("let x = 1; let f = fn() { x }; let z = y;"); err == nil {
+		t.Fatal("no error")
+	}
+	for _, input := range []string{"x", "f()"} {
+		if _, err := in.Eval(input); err == nil {
+			t.Errorf("no error for %q", input)
+		} else if _, ok := err.(*CompileError); !ok {
+			t.Errorf("error for %q is not *CompileError. got=%T (%v)", input, err, err)
+		}
+	}
+	if _, err := in.Call("f"); err == nil || err.Error() != "identifier not found: f" {
+		t.Errorf("wrong error calling f. got=%v", err)
+	}
+}
+
+// A return at the top level ends the program with its value, on either
+// engine.
+func TestEvalReturn(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine})
+
+		for _, input := range []string{"return 5;", "let x = 5; if (true) { return x; } 6"} {
+			result, err := in.Eval(input)
+			if err != nil {
+				t.Errorf("[%s] error for %q: %s", engine, input, err)
+				continue
+			}
+			if result.Inspect() != "5" {
+				t.Errorf("[%s] wrong result for %q. got=%s", engine, input, result.Inspect())
+			}
+		}
+
+		// What comes after it doesn't run, but the bindings before it stay.
+		if _, err := in.Eval("let a = 1; return a; let b = 2;"); err != nil {
+			t.Fatalf("[%s] error: %s", engine, err)
+		}
+		if result, err := in.Eval("a"); err != nil || result.Inspect() != "1" {
+			t.Errorf("[%s] wrong a. got=%v, %v", engine, result, err)
+		}
+	}
+}
+
+func TestEvalIO(t *testing.T) {
+	for _, engine := range engines {
+		var out bytes.Buffer
+		in := New(Options{
+			Engine: engine,
+			Stdout: &out,
+			Stdin:  strings.NewReader("monkey\n"),
+		})
+
+		_, err := in.Eval(`puts("hello " + readLine())`)
+		if err != nil {
+			t.Fatalf("[%s] error: %s", engine, err)
+		}
+		if out.String() != "hello monkey\n" {
+			t.Errorf("[%s] wrong output. got=%q", engine, out.String())
+		}
+	}
+}
+
+func TestEvalDefaultsToVM(t *testing.T) {
+	result, err := Eval(`let f = fn(n) { if (n < 2) { n } else { f(n - 1) + f(n - 2) } }; f(10)`)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if result.Inspect() != "55" {
+		t.Errorf("wrong result. got=%s", result.Inspect())
+	}
+}
+
+func TestCall(t *testing.T) {
+	for _, engine := range engines {
+		var out bytes.Buffer
+		in := New(Options{Engine: engine, Stdout: &out})
+
+		_, err := in.Eval(`
+		let add = fn(a, b) { a + b };
+		let greet = fn(name) { puts("hello " + name) };
+		let sum = fn(xs) { reduce(xs, 0, fn(acc, x) { acc + x }) };
+		let fail = fn() { 1 + true };
+		let quit = fn(code) { exit(code) };
+		let raise = fn() { throw "oops" };
+		let n = 5;
+		`)
+		if err != nil {
+			t.Fatalf("[%s] error: %s", engine, err)
+		}
+
+		tests := []struct {
+			name     string
+			args     []interface{}
+			expected string
+		}{
+			{"add", []interface{}{1, 2}, "3"},
+			{"add", []interface{}{"a", "b"}, "ab"},
+			{"sum", []interface{}{[]int{1, 2, 3}}, "6"},
+			{"greet", []interface{}{"monkey"}, "null"},
+			{"len", []interface{}{"abc"}, "3"},
+		}
+
+		for _, test := range tests {
+			result, err := in.Call(test.name, test.args...)
+			if err != nil {
+				t.Errorf("[%s] error calling %s: %s", engine, test.name, err)
+				continue
+			}
+			if result.Inspect() != test.expected {
+				t.Errorf("[%s] wrong result calling %s. got=%s, want=%s",
+					engine, test.name, result.Inspect(), test.expected)
+			}
+		}
+
+		if out.String() != "hello monkey\n" {
+			t.Errorf("[%s] wrong output. got=%q", engine, out.String())
+		}
+
+		fn, err := in.Eval(`let k = 10; fn(x) { x * k }`)
+		if err != nil {
+			t.Fatalf("[%s] error: %s", engine, err)
+		}
+		result, err := in.CallFunction(fn, 4)
+		if err != nil || result.Inspect() != "40" {
+			t.Errorf("[%s] wrong result calling function value. got=%v, %v", engine, result, err)
+		}
+
+		errors := []struct {
+			name     string
+			args     []interface{}
+			expected string
+		}{
+			{"missing", nil, "identifier not found: missing"},
+			{"fail", nil, "type mismatch: INTEGER + BOOLEAN"},
+			{"raise", nil, "uncaught exception: oops"},
+			{"add", []interface{}{1}, "wrong number of arguments: want=2, got=1"},
+			{"n", nil, "not a function: INTEGER"},
+			{"len", []interface{}{1}, "argument to `len` not supported, got INTEGER"},
+			{"add", []interface{}{1, make(chan int)}, "argument 2: cannot convert chan int to an object"},
+		}
+
+		for _, test := range errors {
+			_, err := in.Call(test.name, test.args...)
+			if err == nil {
+				t.Errorf("[%s] no error calling %s", engine, test.name)
+				continue
+			}
+			if err.Error() != test.expected {
+				t.Errorf("[%s] wrong error calling %s. got=%q, want=%q",
+					engine, test.name, err, test.expected)
+			}
+		}
+
+		_, err = in.Call("quit", 7)
+		if exit, ok := err.(*object.Exit); !ok || exit.Code != 7 {
+			t.Errorf("[%s] wrong error for exit. got=%T (%v)", engine, err, err)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := in.EvalContext(ctx, `let spin = fn() { while (true) { } }; spin()`)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("[%s] wrong error. got=%v, want=%v", engine, err, context.DeadlineExceeded)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err = in.CallContext(ctx, "spin")
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("[%s] wrong error calling. got=%v, want=%v", engine, err, context.DeadlineExceeded)
+		}
+
+		// The interpreter is still usable once the context is done.
+		result, err := in.Eval(`let i = 0; while (i < 3) { i = i + 1 }; i`)
+		if err != nil || result.Inspect() != "3" {
+			t.Errorf("[%s] wrong result after timeout. got=%v, %v", engine, result, err)
+		}
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine, StepLimit: 10000})
+
+		_, err := in.Eval(`let spin = fn() { while (true) { } };`)
+		if err != nil {
+			t.Fatalf("[%s] error: %s", engine, err)
+		}
+
+		_, err = in.Eval(`spin()`)
+		if _, ok := err.(*object.BudgetExceeded); !ok {
+			t.Errorf("[%s] wrong error. got=%T (%v)", engine, err, err)
+		}
+
+		_, err = in.Call("spin")
+		if _, ok := err.(*object.BudgetExceeded); !ok {
+			t.Errorf("[%s] wrong error calling. got=%T (%v)", engine, err, err)
+		}
+
+		// Each call gets the whole budget.
+		for i := 0; i < 3; i++ {
+			result, err := in.Eval(`let i = 0; while (i < 100) { i = i + 1 }; i`)
+			if err != nil || result.Inspect() != "100" {
+				t.Errorf("[%s] wrong result within the limit. got=%v, %v", engine, result, err)
+			}
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine})
+
+		_, err := in.Eval(`let unless = macro(cond, then, otherwise) {
+	quote(if (!(unquote(cond))) { unquote(then) } else { unquote(otherwise) })
+};`)
+		if err != nil {
+			t.Fatalf("[%s] error: %s", engine, err)
+		}
+
+		// The macro is expanded in the programs run after it.
+		result, err := in.Eval(`unless(1 > 2, "yes", "no")`)
+		if err != nil || result.Inspect() != "yes" {
+			t.Errorf("[%s] wrong result. got=%v, %v", engine, result, err)
+		}
+
+		_, err = in.Eval(`1;
+unless(true)`)
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("[%s] error is not *RuntimeError. got=%T (%v)", engine, err, err)
+		}
+		if runtimeErr.Message != "wrong number of arguments to macro unless: want=3, got=1" ||
+			runtimeErr.Line != 2 || runtimeErr.Column != 7 {
+			t.Errorf("[%s] wrong error. got=%d:%d: %s", engine, runtimeErr.Line, runtimeErr.Column, runtimeErr.Message)
+		}
+	}
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	const count = `let count = fn(n) { if (n == 0) { 0 } else { 1 + count(n - 1) } };`
+	tests := []struct {
+		limit    int
+		input    string
+		expected string
+	}{
+		{5, count + `count(4)`, ""},
+		{5, count + `count(5)`, "stack overflow: more than 5 nested calls"},
+		{0, count + `count(1022)`, ""},
+		{0, count + `count(1023)`, "stack overflow: more than 1023 nested calls"},
+	}
+
+	for _, engine := range engines {
+		for _, test := range tests {
+			_, err := New(Options{Engine: engine, MaxCallDepth: test.limit}).Eval(test.input)
+			if test.expected == "" {
+				if err != nil {
+					t.Errorf("[%s] unexpected error for %q. got=%v", engine, test.input, err)
+				}
+				continue
+			}
+			runtimeErr, ok := err.(*RuntimeError)
+			if !ok || runtimeErr.Message != test.expected {
+				t.Errorf("[%s] wrong error for %q. got=%v", engine, test.input, err)
+			}
+		}
+	}
+}
+
+func TestCheckedArithmetic(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine, CheckedArithmetic: true})
+
+		_, err := in.Eval(`9223372036854775807 + 1`)
+		if err == nil || err.Error() != "integer overflow: 9223372036854775807 + 1" {
+			t.Errorf("[%s] wrong error. got=%v", engine, err)
+		}
+
+		result, err := New(Options{Engine: engine}).Eval(`9223372036854775807 + 1`)
+		if err != nil || result.Inspect() != "-9223372036854775808" {
+			t.Errorf("[%s] wrong result without checking. got=%v, %v", engine, result, err)
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine, MemoryLimit: 1 << 20})
+
+		_, err := in.Eval(`let a = []; while (true) { a = push(a, a) }`)
+		budget, ok := err.(*object.BudgetExceeded)
+		if !ok || budget.Budget != object.MemoryBudget {
+			t.Errorf("[%s] wrong error. got=%T (%v)", engine, err, err)
+		}
+
+		// Each call gets the whole budget.
+		for i := 0; i < 3; i++ {
+			result, err := in.Eval(`let s = ""; let i = 0; while (i < 100) { s = s + "abc"; i = i + 1 }; len(s)`)
+			if err != nil || result.Inspect() != "300" {
+				t.Errorf("[%s] wrong result within the limit. got=%v, %v", engine, result, err)
+			}
+		}
+	}
+}
+
+func TestDeny(t *testing.T) {
+	for _, engine := range engines {
+		in := New(Options{Engine: engine, Deny: object.Capabilities})
+
+		_, err := in.Eval(`now()`)
+		if err == nil || err.Error() != "`now` is not allowed: time access is disabled" {
+			t.Errorf("[%s] wrong error. got=%v", engine, err)
+		}
+
+		_, err = in.Eval(`let f = fn() { readFile("x") };`)
+		if err != nil {
+			t.Fatalf("[%s] error: %s", engine, err)
+		}
+		_, err = in.Call("f")
+		if err == nil || err.Error() != "`readFile` is not allowed: filesystem access is disabled" {
+			t.Errorf("[%s] wrong error calling. got=%v", engine, err)
+		}
+
+		result, err := in.Eval(`formatTime(0)`)
+		if err != nil || result.Inspect() != "1970-01-01T00:00:00Z" {
+			t.Errorf("[%s] wrong result for allowed builtin. got=%v, %v", engine, result, err)
+		}
+	}
+}
+
+func TestDenyImport(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"secret.monkey": `let secret = "hunter2";`,
+		"secret.txt":    "TOPSECRET",
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, engine := range engines {
+		in := New(Options{Engine: engine, Deny: []object.Capability{object.FileSystemCapability}})
+
+		for name := range files {
+			path := filepath.Join(dir, name)
+			_, err := in.Eval(`import "` + path + `" as s; s`)
+			want := `cannot import "` + path + `": filesystem access is disabled`
+			if err == nil || err.Error() != want {
+				t.Errorf("[%s] wrong error importing %s. got=%v, want=%q", engine, name, err, want)
+			}
+		}
+
+		// The standard library is built in, so it can still be imported.
+		result, err := in.Eval(`import "std/strings"; type(strings)`)
+		if err != nil || result.Inspect() != "HASH" {
+			t.Errorf("[%s] wrong result importing std. got=%v, %v", engine, result, err)
+		}
+	}
+}
@@ -1,51 +1,102 @@
 package lexer
 
-import "monkey/token"
+import (
+	"fmt"
+	"monkey/token"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
 type Lexer struct {
 	input        string
 	position     int
 	readPosition int
-	ch           byte
+	ch           rune
+	line         int // line of `ch`, starting at 1
+	column       int // column of `ch` in characters, starting at 1
+	blankLines   []int
+	comments     []token.Token
 }
 
-func isDigit(ch byte) bool {
+func isDigit(ch rune) bool {
 	return '0' <= ch && ch <= '9'
 }
 
-func isLetter(ch byte) bool {
-	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
+func isLetter(ch rune) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' ||
+		ch >= utf8.RuneSelf && unicode.IsLetter(ch)
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+	l.column++
+
+	l.position = l.readPosition
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
+		l.readPosition += 1
 	} else {
-		l.ch = l.input[l.readPosition]
+		var width int
+		l.ch, width = utf8.DecodeRuneInString(l.input[l.readPosition:])
+		l.readPosition += width
 	}
-	l.position = l.readPosition
-	l.readPosition += 1
 }
 
-func (l *Lexer) peekChar() byte {
+func (l *Lexer) peekChar() rune {
 	if l.readPosition >= len(l.input) {
 		return 0
 	} else {
-		return l.input[l.readPosition]
+		ch, _ := utf8.DecodeRuneInString(l.input[l.readPosition:])
+		return ch
 	}
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
 
-func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
+// Returns the given line of the input (starting at 1) without its line break.
+func (l *Lexer) SourceLine(line int) string {
+	lines := strings.Split(l.input, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[line-1], "\r")
+}
+
+// Returns the lines, starting at 1, that the input read so far has nothing
+// but whitespace on between two tokens, so that a formatter can keep them.
+func (l *Lexer) BlankLines() []int {
+	return l.blankLines
+}
 
+// Returns the comments in the input read so far, which NextToken skips
+// like whitespace.
+func (l *Lexer) Comments() []token.Token {
+	return l.comments
+}
+
+func (l *Lexer) NextToken() token.Token {
 	l.skipWhitespace()
 
+	line, column := l.line, l.column
+
+	tok := l.readToken()
+	tok.Line = line
+	tok.Column = column
+
+	return tok
+}
+
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
+
 	switch l.ch {
 	case '=':
 		if l.peekChar() == '=' {
@@ -58,7 +109,12 @@ func (l *Lexer) NextToken() token.Token {
 	case '+':
 		tok = newToken(token.PLUS, l.ch)
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		if l.peekChar() == '>' {
+			l.readChar()
+			tok = token.Token{Type: token.ARROW, Literal: "->"}
+		} else {
+			tok = newToken(token.MINUS, l.ch)
+		}
 	case '!':
 		if l.peekChar() == '=' {
 			ch := l.ch
@@ -67,17 +123,64 @@ func (l *Lexer) NextToken() token.Token {
 		} else {
 			tok = newToken(token.BANG, l.ch)
 		}
+	case '&':
+		if l.peekChar() == '&' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.AND, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.BIT_AND, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.OR, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.BIT_OR, l.ch)
+		}
+	case '^':
+		tok = newToken(token.BIT_XOR, l.ch)
 	case '/':
 		tok = newToken(token.SLASH, l.ch)
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '*' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.POWER, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.ASTERISK, l.ch)
+		}
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '=' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.LT_EQ, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == '<' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.SHIFT_LEFT, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '=' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.GT_EQ, Literal: string(ch) + string(l.ch)}
+		} else if l.peekChar() == '>' {
+			ch := l.ch
+			l.readChar()
+			tok = token.Token{Type: token.SHIFT_RIGHT, Literal: string(ch) + string(l.ch)}
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
 	case '"':
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok = l.readString()
+	case '`':
+		tok = l.readRawString()
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ',':
@@ -96,6 +199,16 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.RBRACKET, l.ch)
 	case ':':
 		tok = newToken(token.COLON, l.ch)
+	case '?':
+		tok = newToken(token.QUESTION, l.ch)
+	case '.':
+		if strings.HasPrefix(l.input[l.readPosition:], "..") {
+			l.readChar()
+			l.readChar()
+			tok = token.Token{Type: token.ELLIPSIS, Literal: "..."}
+		} else {
+			tok = newToken(token.DOT, l.ch)
+		}
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -105,9 +218,7 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Type = token.LookupIdent(tok.Literal)
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Type = token.INT
-			tok.Literal = l.readNumber()
-			return tok
+			return l.readNumber()
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
@@ -117,29 +228,216 @@ func (l *Lexer) NextToken() token.Token {
 	return tok
 }
 
+// Skips the whitespace and comments before the next token, recording the
+// comments, and the lines it finds with nothing on them.
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
+	newline := false
+	for {
+		switch {
+		case l.ch == '\n':
+			if newline {
+				l.blankLines = append(l.blankLines, l.line)
+			}
+			newline = true
+		case l.ch == ' ' || l.ch == '\t' || l.ch == '\r':
+		case l.ch == '/' && l.peekChar() == '/':
+			l.comments = append(l.comments, l.readComment())
+			newline = false
+			continue
+		default:
+			return
+		}
 		l.readChar()
 	}
 }
 
-func (l *Lexer) readNumber() string {
+// Reads a COMMENT, from `//` up to the end of the line.
+func (l *Lexer) readComment() token.Token {
+	tok := token.Token{Type: token.COMMENT, Line: l.line, Column: l.column}
 	start := l.position
-	for isDigit(l.ch) {
+	for l.ch != '\n' && l.ch != 0 {
 		l.readChar()
 	}
-	return l.input[start:l.position]
+	tok.Literal = strings.TrimRight(l.input[start:l.position], "\r")
+	return tok
 }
 
-func (l *Lexer) readString() string {
-	start := l.position + 1
+// Reads an INT, or a FLOAT if the digits are followed by a fractional part.
+// Underscores may separate the digits, and an INT may be written in
+// hexadecimal, octal or binary with a 0x, 0o or 0b prefix. A malformed
+// number is an ERROR.
+func (l *Lexer) readNumber() token.Token {
+	start := l.position
+	if l.ch == '0' {
+		if base, ok := basePrefixes[l.peekChar()]; ok {
+			return l.readPrefixedInteger(base)
+		}
+	}
+
+	for isDigit(l.ch) || l.ch == '_' {
+		l.readChar()
+	}
+
+	if l.ch != '.' || !isDigit(l.peekChar()) {
+		literal := l.input[start:l.position]
+		// Which would be read as octal in C, and is ambiguous.
+		if len(literal) > 1 && literal[0] == '0' {
+			return token.Token{Type: token.ERROR, Literal: "decimal literal can't start with 0; octal literals start with 0o"}
+		}
+		return numberToken(token.INT, literal, literal, 10)
+	}
+	integer := l.input[start:l.position]
+
+	l.readChar() // consume the '.'
+	fractionStart := l.position
+	for isDigit(l.ch) || l.ch == '_' {
+		l.readChar()
+	}
+	if err := checkDigits(integer, 10); err != "" {
+		return token.Token{Type: token.ERROR, Literal: err}
+	}
+	return numberToken(token.FLOAT, l.input[start:l.position], l.input[fractionStart:l.position], 10)
+}
+
+// The bases of integers by the letter following the 0 they begin with.
+var basePrefixes = map[rune]int{
+	'x': 16, 'X': 16,
+	'o': 8, 'O': 8,
+	'b': 2, 'B': 2,
+}
+
+var baseNames = map[int]string{16: "hexadecimal", 8: "octal", 2: "binary", 10: "decimal"}
+
+// Reads an INT written with a base prefix, such as 0xFF. Any letters and
+// digits following the prefix are taken as part of the number, so that e.g.
+// 0b102 is reported as having an invalid digit rather than read as 0b10
+// followed by 2.
+func (l *Lexer) readPrefixedInteger(base int) token.Token {
+	start := l.position
+	l.readChar() // consume the '0'
+	l.readChar() // consume the prefix
+	digitsStart := l.position
+	for isLetter(l.ch) || isDigit(l.ch) {
+		l.readChar()
+	}
+
+	digits := l.input[digitsStart:l.position]
+	if digits == "" {
+		return token.Token{Type: token.ERROR, Literal: baseNames[base] + " literal has no digits"}
+	}
+	return numberToken(token.INT, l.input[start:l.position], digits, base)
+}
+
+// Returns a token of the given type for a number, or an ERROR if its
+// digits, those that follow its prefix or its fractional part, are
+// malformed.
+func numberToken(tokType token.TokenType, literal string, digits string, base int) token.Token {
+	if err := checkDigits(digits, base); err != "" {
+		return token.Token{Type: token.ERROR, Literal: err}
+	}
+	return token.Token{Type: tokType, Literal: literal}
+}
+
+// Returns what's wrong with a run of digits in the given base, which may be
+// separated by underscores, or "" if nothing is.
+func checkDigits(digits string, base int) string {
+	var prev rune
+	for i, ch := range digits {
+		if ch == '_' {
+			if i == 0 || i == len(digits)-1 || prev == '_' {
+				return "'_' must separate successive digits"
+			}
+			prev = ch
+			continue
+		}
+		prev = ch
+		if digitValue(ch) >= base {
+			return fmt.Sprintf("invalid digit %q in %s literal", ch, baseNames[base])
+		}
+	}
+	return ""
+}
+
+// Returns the value of a digit in bases up to 16, or 16 if ch isn't one.
+func digitValue(ch rune) int {
+	switch {
+	case '0' <= ch && ch <= '9':
+		return int(ch - '0')
+	case 'a' <= ch && ch <= 'f':
+		return int(ch-'a') + 10
+	case 'A' <= ch && ch <= 'F':
+		return int(ch-'A') + 10
+	default:
+		return 16
+	}
+}
+
+// The characters escape sequences in strings stand for, by the character
+// following the backslash.
+var escapes = map[rune]rune{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'"':  '"',
+	'\\': '\\',
+}
+
+// Reads a STRING, whose literal is the string with its escape sequences
+// replaced by the characters they stand for. A string that isn't closed
+// before the end of the input, or that has an unknown escape sequence, is
+// an ERROR instead.
+func (l *Lexer) readString() token.Token {
+	var out strings.Builder
+	var err string
+
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+		switch l.ch {
+		case 0:
+			return token.Token{Type: token.ERROR, Literal: "unterminated string"}
+		case '"':
+			if err != "" {
+				return token.Token{Type: token.ERROR, Literal: err}
+			}
+			return token.Token{Type: token.STRING, Literal: out.String()}
+		case '\\':
+			l.readChar()
+			if ch, ok := escapes[l.ch]; ok {
+				out.WriteRune(ch)
+			} else if l.ch == 0 {
+				return token.Token{Type: token.ERROR, Literal: "unterminated string"}
+			} else if err == "" {
+				err = fmt.Sprintf("unknown escape sequence \\%c in string", l.ch)
+			}
+		default:
+			out.WriteString(l.input[l.position:l.readPosition])
+		}
+	}
+}
+
+// The literal of the ERROR token for a raw string that isn't closed before
+// the end of the input, which a REPL can take to mean that more input is to
+// come.
+const UnterminatedRawString = "unterminated raw string"
+
+// Reads a RAW_STRING in backticks, which may span lines and has no escape
+// sequences: everything up to the closing backtick is part of the string,
+// except for carriage returns, so that the string is the same whatever line
+// endings the source has.
+func (l *Lexer) readRawString() token.Token {
+	var out strings.Builder
+	for {
+		l.readChar()
+		switch l.ch {
+		case 0:
+			return token.Token{Type: token.ERROR, Literal: UnterminatedRawString}
+		case '`':
+			return token.Token{Type: token.RAW_STRING, Literal: out.String()}
+		case '\r':
+		default:
+			out.WriteString(l.input[l.position:l.readPosition])
 		}
 	}
-	return l.input[start:l.position]
 }
 
 func (l *Lexer) readIdent() string {
@@ -150,6 +448,6 @@ func (l *Lexer) readIdent() string {
 	return l.input[start:l.position]
 }
 
-func newToken(tokType token.TokenType, ch byte) token.Token {
+func newToken(tokType token.TokenType, ch rune) token.Token {
 	return token.Token{Type: tokType, Literal: string(ch)}
 }
@@ -2,6 +2,7 @@ package lexer
 
 import (
 	"monkey/token"
+	"reflect"
 	"testing"
 )
 
@@ -28,6 +29,21 @@ if (5 < 10) {
 "foo bar"
 [1, 2];
 {"foo": "bar"}
+while (true) { 1 }
+3.14 1.x
+true && false || true
+1 <= 2 >= 3
+7 % 2
+2 ** 3
+null
+a & b | c ^ d << 1 >> 2
+a ? b : c
+...rest ..
+import "std/strings" as s
+s.upper
+try { throw e } catch (e) { } finally { }
+macro(x) { }
+fn(x: int) -> str
 `
 
 	tests := []struct {
@@ -131,6 +147,104 @@ if (5 < 10) {
 		{token.STRING, "bar"},
 		{token.RBRACE, "}"},
 
+		{token.WHILE, "while"},
+		{token.LPAREN, "("},
+		{token.TRUE, "true"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.INT, "1"},
+		{token.RBRACE, "}"},
+
+		{token.FLOAT, "3.14"},
+		{token.INT, "1"},
+		{token.DOT, "."},
+		{token.IDENT, "x"},
+
+		{token.TRUE, "true"},
+		{token.AND, "&&"},
+		{token.FALSE, "false"},
+		{token.OR, "||"},
+		{token.TRUE, "true"},
+
+		{token.INT, "1"},
+		{token.LT_EQ, "<="},
+		{token.INT, "2"},
+		{token.GT_EQ, ">="},
+		{token.INT, "3"},
+
+		{token.INT, "7"},
+		{token.PERCENT, "%"},
+		{token.INT, "2"},
+
+		{token.INT, "2"},
+		{token.POWER, "**"},
+		{token.INT, "3"},
+
+		{token.NULL, "null"},
+
+		{token.IDENT, "a"},
+		{token.BIT_AND, "&"},
+		{token.IDENT, "b"},
+		{token.BIT_OR, "|"},
+		{token.IDENT, "c"},
+		{token.BIT_XOR, "^"},
+		{token.IDENT, "d"},
+		{token.SHIFT_LEFT, "<<"},
+		{token.INT, "1"},
+		{token.SHIFT_RIGHT, ">>"},
+		{token.INT, "2"},
+
+		{token.IDENT, "a"},
+		{token.QUESTION, "?"},
+		{token.IDENT, "b"},
+		{token.COLON, ":"},
+		{token.IDENT, "c"},
+
+		{token.ELLIPSIS, "..."},
+		{token.IDENT, "rest"},
+		{token.DOT, "."},
+		{token.DOT, "."},
+
+		{token.IMPORT, "import"},
+		{token.STRING, "std/strings"},
+		{token.IDENT, "as"},
+		{token.IDENT, "s"},
+
+		{token.IDENT, "s"},
+		{token.DOT, "."},
+		{token.IDENT, "upper"},
+
+		{token.TRY, "try"},
+		{token.LBRACE, "{"},
+		{token.THROW, "throw"},
+		{token.IDENT, "e"},
+		{token.RBRACE, "}"},
+		{token.CATCH, "catch"},
+		{token.LPAREN, "("},
+		{token.IDENT, "e"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.FINALLY, "finally"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+
+		{token.MACRO, "macro"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+
+		{token.FUNCTION, "fn"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.COLON, ":"},
+		{token.IDENT, "int"},
+		{token.RPAREN, ")"},
+		{token.ARROW, "->"},
+		{token.IDENT, "str"},
+
 		{token.EOF, ""},
 	}
 
@@ -147,3 +261,228 @@ if (5 < 10) {
 		}
 	}
 }
+
+func TestStrings(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{`"hello world"`, token.STRING, "hello world"},
+		{`""`, token.STRING, ""},
+		{`"a\nb\tc\rd"`, token.STRING, "a\nb\tc\rd"},
+		{`"say \"hi\""`, token.STRING, `say "hi"`},
+		{`"C:\\dir\\"`, token.STRING, `C:\dir\`},
+		{"\"two\nlines\"", token.STRING, "two\nlines"},
+		{`"abc`, token.ERROR, "unterminated string"},
+		{`"abc\"`, token.ERROR, "unterminated string"},
+		{`"abc\`, token.ERROR, "unterminated string"},
+		{`"a\qb"`, token.ERROR, `unknown escape sequence \q in string`},
+		{"`raw`", token.RAW_STRING, "raw"},
+		{"``", token.RAW_STRING, ""},
+		{"`say \"hi\" \\n`", token.RAW_STRING, `say "hi" \n`},
+		{"`two\nlines`", token.RAW_STRING, "two\nlines"},
+		{"`crlf\r\nlines`", token.RAW_STRING, "crlf\nlines"},
+		{"`abc", token.ERROR, UnterminatedRawString},
+	}
+
+	for _, test := range tests {
+		tok := New(test.input).NextToken()
+		if tok.Type != test.expectedType || tok.Literal != test.expectedLiteral {
+			t.Errorf("wrong token for %s. expected=%s %q, got=%s %q", test.input,
+				test.expectedType, test.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+
+	// Lexing goes on after the string.
+	l := New(`"a\qb" + 1`)
+	for _, expected := range []token.TokenType{token.ERROR, token.PLUS, token.INT, token.EOF} {
+		if tok := l.NextToken(); tok.Type != expected {
+			t.Errorf("wrong token. expected=%s, got=%s", expected, tok.Type)
+		}
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{"0xFF", token.INT, "0xFF"},
+		{"0XdeadBEEF", token.INT, "0XdeadBEEF"},
+		{"0o755", token.INT, "0o755"},
+		{"0b1010", token.INT, "0b1010"},
+		{"1_000_000", token.INT, "1_000_000"},
+		{"0x_FF", token.ERROR, "'_' must separate successive digits"},
+		{"1_000.000_1", token.FLOAT, "1_000.000_1"},
+		{"0", token.INT, "0"},
+		{"0.5", token.FLOAT, "0.5"},
+		{"00.5", token.FLOAT, "00.5"},
+		{"0777", token.ERROR, "decimal literal can't start with 0; octal literals start with 0o"},
+		{"08", token.ERROR, "decimal literal can't start with 0; octal literals start with 0o"},
+		{"0_1", token.ERROR, "decimal literal can't start with 0; octal literals start with 0o"},
+		{"0x", token.ERROR, "hexadecimal literal has no digits"},
+		{"0b", token.ERROR, "binary literal has no digits"},
+		{"0b102", token.ERROR, "invalid digit '2' in binary literal"},
+		{"0o8", token.ERROR, "invalid digit '8' in octal literal"},
+		{"0xFG", token.ERROR, "invalid digit 'G' in hexadecimal literal"},
+		{"1__0", token.ERROR, "'_' must separate successive digits"},
+		{"1_", token.ERROR, "'_' must separate successive digits"},
+		{"1_.5", token.ERROR, "'_' must separate successive digits"},
+		{"1.5_", token.ERROR, "'_' must separate successive digits"},
+	}
+
+	for _, test := range tests {
+		tok := New(test.input).NextToken()
+		if tok.Type != test.expectedType || tok.Literal != test.expectedLiteral {
+			t.Errorf("wrong token for %s. expected=%s %q, got=%s %q", test.input,
+				test.expectedType, test.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+
+	// Lexing goes on after a malformed number.
+	l := New("0b12 + 1")
+	for _, expected := range []token.TokenType{token.ERROR, token.PLUS, token.INT, token.EOF} {
+		if tok := l.NextToken(); tok.Type != expected {
+			t.Errorf("wrong token. expected=%s, got=%s", expected, tok.Type)
+		}
+	}
+}
+
+func TestUnicode(t *testing.T) {
+	l := New(`let größe = "日本語"; größe + π`)
+	for _, expected := range []token.Token{
+		{Type: token.LET, Literal: "let", Line: 1, Column: 1},
+		{Type: token.IDENT, Literal: "größe", Line: 1, Column: 5},
+		{Type: token.ASSIGN, Literal: "=", Line: 1, Column: 11},
+		{Type: token.STRING, Literal: "日本語", Line: 1, Column: 13},
+		{Type: token.SEMICOLON, Literal: ";", Line: 1, Column: 18},
+		{Type: token.IDENT, Literal: "größe", Line: 1, Column: 20},
+		{Type: token.PLUS, Literal: "+", Line: 1, Column: 26},
+		{Type: token.IDENT, Literal: "π", Line: 1, Column: 28},
+		{Type: token.EOF, Literal: "", Line: 1, Column: 29},
+	} {
+		if tok := l.NextToken(); tok != expected {
+			t.Errorf("wrong token. expected=%+v, got=%+v", expected, tok)
+		}
+	}
+
+	// Characters that aren't letters are still illegal.
+	if tok := New("€").NextToken(); tok.Type != token.ILLEGAL || tok.Literal != "€" {
+		t.Errorf("wrong token for €. got=%s %q", tok.Type, tok.Literal)
+	}
+}
+
+func TestRawStringPositions(t *testing.T) {
+	l := New("`a\nb` + x")
+	l.NextToken()
+	for _, expected := range []token.Token{
+		{Type: token.PLUS, Literal: "+", Line: 2, Column: 4},
+		{Type: token.IDENT, Literal: "x", Line: 2, Column: 6},
+	} {
+		if tok := l.NextToken(); tok != expected {
+			t.Errorf("wrong token. expected=%+v, got=%+v", expected, tok)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	l := New("// a\nlet x = 1; // b\r\n\n  //\nx / 2")
+	var types []token.TokenType
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		types = append(types, tok.Type)
+	}
+
+	expectedTypes := []token.TokenType{
+		token.LET, token.IDENT, token.ASSIGN, token.INT, token.SEMICOLON,
+		token.IDENT, token.SLASH, token.INT,
+	}
+	if !reflect.DeepEqual(types, expectedTypes) {
+		t.Errorf("wrong tokens. expected=%v, got=%v", expectedTypes, types)
+	}
+
+	expected := []token.Token{
+		{Type: token.COMMENT, Literal: "// a", Line: 1, Column: 1},
+		{Type: token.COMMENT, Literal: "// b", Line: 2, Column: 12},
+		{Type: token.COMMENT, Literal: "//", Line: 4, Column: 3},
+	}
+	if !reflect.DeepEqual(l.Comments(), expected) {
+		t.Errorf("wrong comments. expected=%+v, got=%+v", expected, l.Comments())
+	}
+	// A line with only a comment on it isn't blank.
+	if !reflect.DeepEqual(l.BlankLines(), []int{3}) {
+		t.Errorf("wrong blank lines. expected=%v, got=%v", []int{3}, l.BlankLines())
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+	input := `let x = 5;
+  x + 10;
+"a b" == y`
+
+	tests := []struct {
+		expectedType   token.TokenType
+		expectedLine   int
+		expectedColumn int
+	}{
+		{token.LET, 1, 1},
+		{token.IDENT, 1, 5},
+		{token.ASSIGN, 1, 7},
+		{token.INT, 1, 9},
+		{token.SEMICOLON, 1, 10},
+		{token.IDENT, 2, 3},
+		{token.PLUS, 2, 5},
+		{token.INT, 2, 7},
+		{token.SEMICOLON, 2, 9},
+		{token.STRING, 3, 1},
+		{token.EQ, 3, 7},
+		{token.IDENT, 3, 10},
+		{token.EOF, 3, 11},
+	}
+
+	l := New(input)
+
+	for i, test := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != test.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, test.expectedType, tok.Type)
+		}
+		if tok.Line != test.expectedLine || tok.Column != test.expectedColumn {
+			t.Fatalf("tests[%d] - position wrong. expected=%d:%d, got=%d:%d", i,
+				test.expectedLine, test.expectedColumn, tok.Line, tok.Column)
+		}
+	}
+}
+
+func TestSourceLine(t *testing.T) {
+	l := New("let a = 1;\r\nlet b = 2;\nb")
+
+	tests := map[int]string{
+		0: "",
+		1: "let a = 1;",
+		2: "let b = 2;",
+		3: "b",
+		4: "",
+	}
+
+	for line, expected := range tests {
+		if l.SourceLine(line) != expected {
+			t.Errorf("wrong source line %d. expected=%q, got=%q",
+				line, expected, l.SourceLine(line))
+		}
+	}
+}
+
+func TestBlankLines(t *testing.T) {
+	l := New("\nlet a = 1;\n\n  \r\nlet b = `\n\n`;\n\nb\n\n")
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+	}
+
+	// The lines in the raw string aren't between tokens.
+	expected := []int{3, 4, 8, 10}
+	if !reflect.DeepEqual(l.BlankLines(), expected) {
+		t.Errorf("wrong blank lines. expected=%v, got=%v", expected, l.BlankLines())
+	}
+}
@@ -0,0 +1,355 @@
+// Package lineedit reads lines from a terminal with readline-style editing:
+// moving around the line with the arrow keys and Emacs-style control keys,
+// and recalling earlier lines from a history that can be kept in a file.
+package lineedit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Returned by ReadLine when the user presses Ctrl-C.
+var ErrInterrupted = errors.New("interrupted")
+
+// The most lines the history keeps.
+const MaxHistory = 1000
+
+type Editor struct {
+	in  io.Reader
+	out io.Writer
+	fd  int // Of the terminal to put into raw mode while reading, or -1.
+
+	history     []string
+	historyFile *os.File
+}
+
+// Returns an editor reading from the terminal f, or nil if f isn't a
+// terminal that supports line editing.
+func New(f *os.File, out io.Writer) *Editor {
+	fd := int(f.Fd())
+	if !isTerminal(fd) {
+		return nil
+	}
+	return &Editor{in: f, out: out, fd: fd}
+}
+
+// Keys that don't insert a character, as read by readKey. They are negative
+// so that they can't be mistaken for characters.
+const (
+	keyUp rune = -1 - iota
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+	keyUnknown
+)
+
+// Control characters, which arrive as the letter's position in the alphabet.
+const (
+	ctrlA     = 1
+	ctrlB     = 2
+	ctrlC     = 3
+	ctrlD     = 4
+	ctrlE     = 5
+	ctrlF     = 6
+	ctrlH     = 8
+	tab       = 9
+	ctrlK     = 11
+	ctrlN     = 14
+	ctrlP     = 16
+	ctrlU     = 21
+	ctrlW     = 23
+	escape    = 27
+	backspace = 127
+)
+
+// The line being edited.
+type line struct {
+	prompt string
+	buf    []rune
+	pos    int // Of the cursor in buf.
+
+	historyIndex int    // Of the history entry shown, or len(history) for a new line.
+	draft        string // The new line, kept while browsing the history.
+}
+
+// Reads a line, showing prompt before it. Returns io.EOF if the user presses
+// Ctrl-D on an empty line, or ErrInterrupted if they press Ctrl-C.
+func (e *Editor) ReadLine(prompt string) (string, error) {
+	if e.fd >= 0 {
+		restore, err := makeRaw(e.fd)
+		if err != nil {
+			return "", err
+		}
+		defer restore()
+	}
+
+	l := &line{prompt: prompt, historyIndex: len(e.history)}
+	e.refresh(l)
+
+	for {
+		key, err := e.readKey()
+		if err != nil {
+			return "", err
+		}
+
+		switch key {
+		case '\r', '\n':
+			io.WriteString(e.out, "\r\n")
+			return string(l.buf), nil
+		case ctrlC:
+			io.WriteString(e.out, "^C\r\n")
+			return "", ErrInterrupted
+		case ctrlD:
+			if len(l.buf) == 0 {
+				io.WriteString(e.out, "\r\n")
+				return "", io.EOF
+			}
+			l.deleteAt(l.pos)
+		case ctrlA, keyHome:
+			l.pos = 0
+		case ctrlE, keyEnd:
+			l.pos = len(l.buf)
+		case ctrlB, keyLeft:
+			if l.pos > 0 {
+				l.pos--
+			}
+		case ctrlF, keyRight:
+			if l.pos < len(l.buf) {
+				l.pos++
+			}
+		case ctrlP, keyUp:
+			e.showHistory(l, l.historyIndex-1)
+		case ctrlN, keyDown:
+			e.showHistory(l, l.historyIndex+1)
+		case backspace, ctrlH:
+			if l.pos > 0 {
+				l.pos--
+				l.deleteAt(l.pos)
+			}
+		case keyDelete:
+			l.deleteAt(l.pos)
+		case ctrlK:
+			l.buf = l.buf[:l.pos]
+		case ctrlU:
+			l.buf = l.buf[l.pos:]
+			l.pos = 0
+		case ctrlW:
+			start := l.pos
+			for start > 0 && unicode.IsSpace(l.buf[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(l.buf[start-1]) {
+				start--
+			}
+			l.buf = append(l.buf[:start], l.buf[l.pos:]...)
+			l.pos = start
+		default:
+			if key == tab || unicode.IsPrint(key) {
+				l.buf = append(l.buf, 0)
+				copy(l.buf[l.pos+1:], l.buf[l.pos:])
+				l.buf[l.pos] = key
+				l.pos++
+			}
+		}
+
+		e.refresh(l)
+	}
+}
+
+func (l *line) deleteAt(pos int) {
+	if pos < len(l.buf) {
+		l.buf = append(l.buf[:pos], l.buf[pos+1:]...)
+	}
+}
+
+// Replaces the line with the history entry at index, or with the new line
+// being written if index is past the end of the history.
+func (e *Editor) showHistory(l *line, index int) {
+	if index < 0 || index > len(e.history) {
+		return
+	}
+
+	if l.historyIndex == len(e.history) {
+		l.draft = string(l.buf)
+	}
+	l.historyIndex = index
+
+	if index == len(e.history) {
+		l.buf = []rune(l.draft)
+	} else {
+		l.buf = []rune(e.history[index])
+	}
+	l.pos = len(l.buf)
+}
+
+// Redraws the line, leaving the cursor at its position in the line.
+func (e *Editor) refresh(l *line) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", l.prompt, string(l.buf))
+	if back := len(l.buf) - l.pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
+
+func (e *Editor) readByte() (byte, error) {
+	var b [1]byte
+	for {
+		n, err := e.in.Read(b[:])
+		if n == 1 {
+			return b[0], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Reads a key press: a character, or one of the keyUp, keyDown, ... keys for
+// the escape sequences that the terminal sends for special keys.
+func (e *Editor) readKey() (rune, error) {
+	b, err := e.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case b == escape:
+		return e.readEscapeSequence()
+	case b < utf8.RuneSelf:
+		return rune(b), nil
+	}
+
+	// Read the rest of a multi-byte UTF-8 character.
+	buf := []byte{b}
+	for !utf8.FullRune(buf) {
+		b, err := e.readByte()
+		if err != nil {
+			return 0, err
+		}
+		buf = append(buf, b)
+	}
+
+	r, _ := utf8.DecodeRune(buf)
+	return r, nil
+}
+
+// Reads the rest of a sequence starting with escape, such as "\x1b[A" for
+// the up arrow or "\x1b[3~" for delete.
+func (e *Editor) readEscapeSequence() (rune, error) {
+	kind, err := e.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if kind != '[' && kind != 'O' {
+		return keyUnknown, nil
+	}
+
+	// Parameters are digits and separators, ended by a final letter or ~.
+	var params strings.Builder
+	for {
+		b, err := e.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if b >= 0x40 && b <= 0x7e {
+			return escapeSequenceKey(params.String(), b), nil
+		}
+		params.WriteByte(b)
+	}
+}
+
+func escapeSequenceKey(params string, final byte) rune {
+	switch final {
+	case 'A':
+		return keyUp
+	case 'B':
+		return keyDown
+	case 'C':
+		return keyRight
+	case 'D':
+		return keyLeft
+	case 'H':
+		return keyHome
+	case 'F':
+		return keyEnd
+	case '~':
+		switch params {
+		case "1", "7":
+			return keyHome
+		case "4", "8":
+			return keyEnd
+		case "3":
+			return keyDelete
+		}
+	}
+
+	return keyUnknown
+}
+
+// Adds a line to the history, and to the history file if there is one.
+// Blank lines, and lines repeating the previous one, are skipped.
+func (e *Editor) AddHistory(entry string) {
+	if strings.TrimSpace(entry) == "" || strings.ContainsAny(entry, "\r\n") {
+		return
+	}
+	if len(e.history) > 0 && e.history[len(e.history)-1] == entry {
+		return
+	}
+
+	e.history = append(e.history, entry)
+	if len(e.history) > MaxHistory {
+		e.history = e.history[len(e.history)-MaxHistory:]
+	}
+
+	if e.historyFile != nil {
+		fmt.Fprintln(e.historyFile, entry)
+	}
+}
+
+// Loads the history from a file, which every line added to the history from
+// then on is appended to. The file is created if it doesn't exist.
+func (e *Editor) SetHistoryFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	var history []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		history = append(history, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	if len(history) > MaxHistory {
+		history = history[len(history)-MaxHistory:]
+	}
+
+	if e.historyFile != nil {
+		e.historyFile.Close()
+	}
+	e.history = history
+	e.historyFile = f
+	return nil
+}
+
+// Closes the history file, if there is one.
+func (e *Editor) Close() error {
+	if e.historyFile == nil {
+		return nil
+	}
+
+	err := e.historyFile.Close()
+	e.historyFile = nil
+	return err
+}
@@ -0,0 +1,140 @@
+package lineedit
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestEditor(input string, history ...string) *Editor {
+	return &Editor{in: strings.NewReader(input), out: &bytes.Buffer{}, fd: -1, history: history}
+}
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		history  []string
+		expected string
+	}{
+		{"typing", "let x = 5;\r", nil, "let x = 5;"},
+		{"newline", "abc\n", nil, "abc"},
+		{"backspace", "abcd\x7f\x7fx\r", nil, "abx"},
+		{"left and insert", "ac\x1b[Db\r", nil, "abc"},
+		{"right", "ac\x1b[D\x1b[Cb\r", nil, "acb"},
+		{"home and end", "bc\x01a\x05d\r", nil, "abcd"},
+		{"home and end keys", "bc\x1b[Ha\x1b[Fd\r", nil, "abcd"},
+		{"ctrl-b and ctrl-f", "ac\x02\x02\x06b\r", nil, "abc"},
+		{"delete key", "abc\x01\x1b[3~\r", nil, "bc"},
+		{"ctrl-d deletes under the cursor", "abc\x01\x04\r", nil, "bc"},
+		{"kill to end", "abcdef\x01\x06\x06\x0b\r", nil, "ab"},
+		{"kill to start", "abcdef\x02\x02\x15\r", nil, "ef"},
+		{"delete word", "let foo = bar\x17\x17baz\r", nil, "let foo baz"},
+		{"unicode", "héllo\x7f\x1b[Dé\r", nil, "hélél"},
+		{"unknown keys are ignored", "a\x1b[15~\x1bxb\r", nil, "ab"},
+		{"history", "\x1b[A\x1b[A\r", []string{"one", "two"}, "one"},
+		{"history past the start", "\x1b[A\x1b[A\x1b[A\r", []string{"one", "two"}, "one"},
+		{"history and back", "new\x1b[A\x1b[B\r", []string{"one"}, "new"},
+		{"ctrl-p and ctrl-n", "\x10\x10\x0e!\r", []string{"one", "two"}, "two!"},
+	}
+
+	for _, test := range tests {
+		e := newTestEditor(test.input, test.history...)
+		got, err := e.ReadLine(">> ")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%s: wrong line. got=%q, want=%q", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestReadLineEnds(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected error
+	}{
+		{"\x04", io.EOF},
+		{"abc\x03", ErrInterrupted},
+		{"abc", io.EOF},
+	}
+
+	for _, test := range tests {
+		e := newTestEditor(test.input)
+		_, err := e.ReadLine(">> ")
+		if err != test.expected {
+			t.Errorf("wrong error for %q. got=%v, want=%v", test.input, err, test.expected)
+		}
+	}
+}
+
+func TestReadLineRendering(t *testing.T) {
+	var out bytes.Buffer
+	e := &Editor{in: strings.NewReader("ab\x1b[D\r"), out: &out, fd: -1}
+
+	if _, err := e.ReadLine(">> "); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := "\r>> \x1b[K" +
+		"\r>> a\x1b[K" +
+		"\r>> ab\x1b[K" +
+		"\r>> ab\x1b[K\x1b[1D" +
+		"\r\n"
+	if out.String() != expected {
+		t.Errorf("wrong output.\ngot= %q\nwant=%q", out.String(), expected)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := newTestEditor("")
+	if err := e.SetHistoryFile(path); err != nil {
+		t.Fatalf("SetHistoryFile failed: %s", err)
+	}
+
+	e.AddHistory("three")
+	e.AddHistory("three")
+	e.AddHistory("  ")
+	e.AddHistory("a\nb")
+	e.AddHistory("four")
+	if err := e.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+
+	expected := []string{"one", "two", "three", "four"}
+	if strings.Join(e.history, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong history. got=%q, want=%q", e.history, expected)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "one\ntwo\nthree\nfour\n" {
+		t.Errorf("wrong history file. got=%q", content)
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	e := newTestEditor("")
+	for i := 0; i < MaxHistory+10; i++ {
+		e.AddHistory(strings.Repeat("x", i+1))
+	}
+
+	if len(e.history) != MaxHistory {
+		t.Fatalf("wrong history length. got=%d, want=%d", len(e.history), MaxHistory)
+	}
+	if e.history[0] != strings.Repeat("x", 11) {
+		t.Errorf("oldest entries weren't dropped. got=%d chars", len(e.history[0]))
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package lineedit
+
+import "errors"
+
+// Line editing is only supported on Linux. Elsewhere, the editor reads
+// lines as the terminal delivers them.
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errors.New("raw mode is not supported on this platform")
+}
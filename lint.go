@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/analysis"
+	"os"
+	"strings"
+)
+
+const lintUsage = "usage: monkey lint [-checks=name,...] script.monkey..."
+
+// Implements `monkey lint`, which reports likely mistakes in scripts, each
+// with its position, without running them.
+func lintCommand(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	names := flags.String("checks", "", "the checks to run, separated by commas, instead of all of them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), lintUsage)
+		flags.PrintDefaults()
+		fmt.Fprintln(flags.Output(), "checks:")
+		for _, check := range analysis.Checks {
+			fmt.Fprintf(flags.Output(), "  %-12s %s\n", check.Name, check.Doc)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var checks []*analysis.Check
+	if *names != "" {
+		for _, name := range strings.Split(*names, ",") {
+			check := analysis.LookupCheck(strings.TrimSpace(name))
+			if check == nil {
+				fmt.Fprintf(os.Stderr, "monkey: unknown check %q\n", name)
+				flags.Usage()
+				return 2
+			}
+			checks = append(checks, check)
+		}
+	}
+
+	code := 0
+	for _, path := range flags.Args() {
+		// The script is checked as written, before its macros are expanded.
+		program, ok := readProgram(path)
+		if !ok {
+			code = 1
+			continue
+		}
+		for _, finding := range analysis.Lint(program, checks...) {
+			fmt.Printf("%s:%s\n", path, finding)
+			code = 1
+		}
+	}
+	return code
+}
@@ -1,18 +1,74 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"monkey/repl"
 	"os"
 	"os/user"
 )
 
+const usage = `usage:
+  monkey [-engine=vm|eval]                    start the REPL
+  monkey [-engine=vm|eval] run [-checked] [-trace] [-profile] script.monkey
+                                              run a script file
+  monkey bench [script.monkey]                compare the engines on a script
+  monkey build [-o out.mbc] script.monkey     compile a script to a bytecode file
+  monkey exec [-checked] [-trace] [-profile] program.mbc
+                                              run a bytecode file
+  monkey disasm [-optimize=false] script.monkey|program.mbc
+                                              print the bytecode of a script
+  monkey ast [-expand=false] script.monkey    print the syntax tree of a script as JSON
+  monkey fmt [-l] [-w] script.monkey...       format scripts
+  monkey lint [-checks=name,...] script.monkey...
+                                              report likely mistakes in scripts
+  monkey dap                                  serve the Debug Adapter Protocol on stdin and stdout`
+
 func main() {
+	engine := flag.String("engine", repl.EngineVM, "the engine to run code with, vm or eval")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *engine != repl.EngineVM && *engine != repl.EngineEvaluator {
+		fmt.Fprintf(os.Stderr, "monkey: unknown engine %q\n", *engine)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "run":
+		os.Exit(runCommand(flag.Args()[1:], *engine))
+	case "bench":
+		os.Exit(benchCommand(flag.Args()[1:]))
+	case "build":
+		os.Exit(buildCommand(flag.Args()[1:]))
+	case "exec":
+		os.Exit(execCommand(flag.Args()[1:]))
+	case "disasm":
+		os.Exit(disasmCommand(flag.Args()[1:]))
+	case "ast":
+		os.Exit(astCommand(flag.Args()[1:]))
+	case "fmt":
+		os.Exit(fmtCommand(flag.Args()[1:]))
+	case "lint":
+		os.Exit(lintCommand(flag.Args()[1:]))
+	case "dap":
+		os.Exit(dapCommand(flag.Args()[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "monkey: unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	user, err := user.Current()
 	if err != nil {
 		panic(err)
 	}
 	fmt.Printf("Hello %s! This is the Monkey programming language!\n", user.Username)
 	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
+	repl.Start(os.Stdin, os.Stdout, *engine)
 }
@@ -0,0 +1,100 @@
+// Package module finds and parses the modules Monkey programs import: files,
+// named by paths relative to the file importing them, and the modules of the
+// standard library, which are built into the interpreter.
+package module
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed std/*.monkey
+var std embed.FS
+
+// The paths of standard library modules start with this, as in
+// `import "std/strings"`.
+const stdPrefix = "std/"
+
+type Module struct {
+	// Identifies the module however it was imported: the absolute path of
+	// a file, or the path of a standard library module.
+	Key string
+	// The directory the files the module imports are relative to. Empty for
+	// the standard library.
+	Dir     string
+	Program *ast.Program
+}
+
+// Returns the key of the module that `import "path"` refers to in code whose
+// imports are relative to dir, which is the working directory if empty.
+// Modules are identified by their keys, so that each is only loaded once.
+func Resolve(path, dir string) (string, error) {
+	switch {
+	case strings.HasPrefix(path, stdPrefix):
+		return path, nil
+	case strings.HasPrefix(path, "./"), strings.HasPrefix(path, "../"), filepath.IsAbs(path):
+		file := path
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return "", fmt.Errorf("cannot import %q: %w", path, err)
+		}
+		return abs, nil
+	default:
+		return "", fmt.Errorf("cannot import %q: the paths of files start with ./ or ../, and those of the standard library with %s",
+			path, stdPrefix)
+	}
+}
+
+// Returns an error if loading the module with a key returned by Resolve
+// needs a capability that allows doesn't grant. Files need the filesystem;
+// the standard library is built in, so it needs nothing.
+func RequireCapability(key string, allows func(object.Capability) bool) error {
+	if strings.HasPrefix(key, stdPrefix) || allows(object.FileSystemCapability) {
+		return nil
+	}
+	return fmt.Errorf("cannot import %q: %s access is disabled", key, object.FileSystemCapability)
+}
+
+// Reads and parses the module with a key returned by Resolve.
+func Load(key string) (*Module, error) {
+	if strings.HasPrefix(key, stdPrefix) {
+		src, err := std.ReadFile(key + ".monkey")
+		if err != nil {
+			return nil, fmt.Errorf("cannot import %q: no such module in the standard library", key)
+		}
+		return parse(key, "", string(src))
+	}
+
+	src, err := os.ReadFile(key)
+	if err != nil {
+		// The path is already in the message.
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return nil, fmt.Errorf("cannot import %q: %w", key, err)
+	}
+	return parse(key, filepath.Dir(key), string(src))
+}
+
+func parse(key, dir, src string) (*Module, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) != 0 {
+		return nil, fmt.Errorf("%s:%s", key, errs[0])
+	}
+
+	return &Module{Key: key, Dir: dir, Program: program}, nil
+}
@@ -0,0 +1,104 @@
+package module
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		path     string
+		dir      string
+		expected string
+	}{
+		{"std/strings", dir, "std/strings"},
+		{"./util.monkey", dir, filepath.Join(dir, "util.monkey")},
+		{"./lib/../util.monkey", dir, filepath.Join(dir, "util.monkey")},
+		{"../util.monkey", filepath.Join(dir, "lib"), filepath.Join(dir, "util.monkey")},
+		{filepath.Join(dir, "util.monkey"), "", filepath.Join(dir, "util.monkey")},
+	}
+
+	for _, test := range tests {
+		key, err := Resolve(test.path, test.dir)
+		if err != nil {
+			t.Errorf("Resolve(%q) failed: %s", test.path, err)
+			continue
+		}
+		if key != test.expected {
+			t.Errorf("Resolve(%q) wrong. want=%q, got=%q", test.path, test.expected, key)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := Resolve("./util.monkey", ""); key != filepath.Join(wd, "util.monkey") {
+		t.Errorf("relative import not resolved from the working directory. got=%q", key)
+	}
+
+	_, err = Resolve("util", dir)
+	if err == nil || !strings.Contains(err.Error(), "start with ./ or ../") {
+		t.Errorf("wrong error for a bare path. got=%v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "util.monkey")
+	if err := os.WriteFile(path, []byte("let x = 1;\nlet y = 2;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	if mod.Key != path || mod.Dir != dir {
+		t.Errorf("wrong key or dir. got=%q, %q", mod.Key, mod.Dir)
+	}
+	if len(mod.Program.Statements) != 2 {
+		t.Errorf("wrong number of statements. got=%d", len(mod.Program.Statements))
+	}
+
+	bad := filepath.Join(dir, "bad.monkey")
+	if err := os.WriteFile(bad, []byte("let = 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	errorTests := []struct {
+		key      string
+		expected string
+	}{
+		{bad, bad + ":1:5: expected next token to be IDENT, got = instead"},
+		{filepath.Join(dir, "missing.monkey"),
+			`cannot import "` + filepath.Join(dir, "missing.monkey") + `": no such file or directory`},
+		{"std/missing", `cannot import "std/missing": no such module in the standard library`},
+	}
+
+	for _, test := range errorTests {
+		_, err := Load(test.key)
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("wrong error loading %q. want=%q, got=%v", test.key, test.expected, err)
+		}
+	}
+}
+
+// The modules of the standard library have to parse.
+func TestStandardLibrary(t *testing.T) {
+	entries, err := std.ReadDir("std")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		key := "std/" + strings.TrimSuffix(entry.Name(), ".monkey")
+		if _, err := Load(key); err != nil {
+			t.Errorf("Load(%q) failed: %s", key, err)
+		}
+	}
+}
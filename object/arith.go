@@ -0,0 +1,75 @@
+package object
+
+import "math"
+
+// Reports whether applying op, one of the operators + - * and /, to two
+// integers gives a result that doesn't fit in an int64, which the engines
+// wrap around unless checked arithmetic is on. Other operators never
+// overflow.
+func IntegerOverflows(op string, left, right int64) bool {
+	switch op {
+	case "+":
+		return (right > 0 && left > math.MaxInt64-right) ||
+			(right < 0 && left < math.MinInt64-right)
+	case "-":
+		return (right < 0 && left > math.MaxInt64+right) ||
+			(right > 0 && left < math.MinInt64+right)
+	case "*":
+		_, ok := multiplyInts(left, right)
+		return !ok
+	case "/":
+		return left == math.MinInt64 && right == -1
+	default:
+		return false
+	}
+}
+
+// Raises base to the power exp, which mustn't be negative, reporting false
+// if the result doesn't fit in an int64.
+func PowerInts(base, exp int64) (int64, bool) {
+	// Exponentiation by squaring. Squares are only taken while higher bits
+	// of the exponent remain, so an overflowing square means the result
+	// overflows too.
+	res := int64(1)
+	for exp > 0 {
+		var ok bool
+		if exp&1 == 1 {
+			if res, ok = multiplyInts(res, base); !ok {
+				return 0, false
+			}
+		}
+
+		exp >>= 1
+		if exp > 0 {
+			if base, ok = multiplyInts(base, base); !ok {
+				return 0, false
+			}
+		}
+	}
+	return res, true
+}
+
+// Reports whether negating an integer overflows, as negating the smallest
+// int64 does.
+func NegationOverflows(operand int64) bool {
+	return operand == math.MinInt64
+}
+
+// Reports whether obj is an Integer or a Float.
+func IsNumeric(obj Object) bool {
+	t := obj.Type()
+	return t == INTEGER_OBJ || t == FLOAT_OBJ
+}
+
+// Converts an Integer or Float to a float64. Callers must check IsNumeric
+// first.
+func ToFloat(obj Object) float64 {
+	switch obj := obj.(type) {
+	case *Integer:
+		return float64(obj.Value)
+	case *Float:
+		return obj.Value
+	default:
+		return 0
+	}
+}
@@ -1,15 +1,27 @@
 package object
 
-import "fmt"
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
 var Builtins = []struct {
 	Name    string
 	Builtin *Builtin
 }{
-	// Returns the number of characters in a string or array.
+	// Returns the number of characters in a string, or elements in an array.
 	{
 		"len",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got=%d, want=1",
 					len(args))
@@ -17,9 +29,9 @@ var Builtins = []struct {
 
 			switch arg := args[0].(type) {
 			case *Array:
-				return &Integer{Value: int64(len(arg.Elements))}
+				return NewInteger(int64(len(arg.Elements)))
 			case *String:
-				return &Integer{Value: int64(len(arg.Value))}
+				return NewInteger(int64(arg.Len()))
 			default:
 				return newError("argument to `len` not supported, got %s",
 					args[0].Type())
@@ -27,12 +39,12 @@ var Builtins = []struct {
 		},
 		},
 	},
-	// print given arguments to STDOUT
+	// Prints each argument on its own line to the runtime's output
 	{
 		"puts",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Arity: &Arity{0, -1}, Fn: func(rt Runtime, args ...Object) Object {
 			for _, arg := range args {
-				fmt.Println(arg.Inspect())
+				fmt.Fprintln(rt.Stdout(), arg.Inspect())
 			}
 			return nil
 		},
@@ -41,7 +53,7 @@ var Builtins = []struct {
 	// Returns the first element of an array.
 	{
 		"first",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got=%d, want=1",
 					len(args))
@@ -63,7 +75,7 @@ var Builtins = []struct {
 	// Returns the last element of an array.
 	{
 		"last",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got=%d, want=1",
 					len(args))
@@ -86,7 +98,7 @@ var Builtins = []struct {
 	// Returns an array without its first element
 	{
 		"rest",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got=%d, want=1",
 					len(args))
@@ -111,7 +123,7 @@ var Builtins = []struct {
 	// Creates a new array by adding an element to the end of an existing array
 	{
 		"push",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
 			if len(args) != 2 {
 				return newError("wrong number of arguments. got=%d, want=2",
 					len(args))
@@ -132,17 +144,1245 @@ var Builtins = []struct {
 		},
 		},
 	},
+	// Prints the arguments separated by spaces, without a trailing newline
+	{
+		"print",
+		&Builtin{Arity: &Arity{0, -1}, Fn: func(rt Runtime, args ...Object) Object {
+			strs := make([]string, len(args))
+			for i, arg := range args {
+				strs[i] = arg.Inspect()
+			}
+
+			fmt.Fprint(rt.Stdout(), strings.Join(strs, " "))
+			return nil
+		},
+		},
+	},
+	// Splits a string into an array of the substrings between each separator
+	{
+		"split",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2",
+					len(args))
+			}
+			if args[0].Type() != STRING_OBJ || args[1].Type() != STRING_OBJ {
+				return newError("arguments to `split` must be STRING, got %s and %s",
+					args[0].Type(), args[1].Type())
+			}
+
+			parts := strings.Split(args[0].(*String).Value, args[1].(*String).Value)
+			elements := make([]Object, len(parts))
+			for i, part := range parts {
+				elements[i] = &String{Value: part}
+			}
+
+			return &Array{Elements: elements}
+		},
+		},
+	},
+	// Concatenates an array of strings, placing a separator between them
+	{
+		"join",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2",
+					len(args))
+			}
+			if args[0].Type() != ARRAY_OBJ {
+				return newError("first argument to `join` must be ARRAY, got %s",
+					args[0].Type())
+			}
+			if args[1].Type() != STRING_OBJ {
+				return newError("second argument to `join` must be STRING, got %s",
+					args[1].Type())
+			}
+
+			arr := args[0].(*Array)
+			strs := make([]string, len(arr.Elements))
+			for i, el := range arr.Elements {
+				str, ok := el.(*String)
+				if !ok {
+					return newError("elements of array passed to `join` must be STRING, got %s",
+						el.Type())
+				}
+				strs[i] = str.Value
+			}
+
+			return &String{Value: strings.Join(strs, args[1].(*String).Value)}
+		},
+		},
+	},
+	// Replaces every occurrence of a substring
+	{
+		"replace",
+		&Builtin{Arity: &Arity{3, 3}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 3 {
+				return newError("wrong number of arguments. got=%d, want=3",
+					len(args))
+			}
+			for _, arg := range args {
+				if arg.Type() != STRING_OBJ {
+					return newError("arguments to `replace` must be STRING, got %s",
+						arg.Type())
+				}
+			}
+
+			return &String{Value: strings.ReplaceAll(
+				args[0].(*String).Value,
+				args[1].(*String).Value,
+				args[2].(*String).Value,
+			)}
+		},
+		},
+	},
+	// Removes leading and trailing whitespace from a string
+	{
+		"trim",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if args[0].Type() != STRING_OBJ {
+				return newError("argument to `trim` must be STRING, got %s",
+					args[0].Type())
+			}
+
+			return &String{Value: strings.TrimSpace(args[0].(*String).Value)}
+		},
+		},
+	},
+	// Returns a string with all letters mapped to upper case
+	{
+		"upper",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if args[0].Type() != STRING_OBJ {
+				return newError("argument to `upper` must be STRING, got %s",
+					args[0].Type())
+			}
+
+			return &String{Value: strings.ToUpper(args[0].(*String).Value)}
+		},
+		},
+	},
+	// Returns a string with all letters mapped to lower case
+	{
+		"lower",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if args[0].Type() != STRING_OBJ {
+				return newError("argument to `lower` must be STRING, got %s",
+					args[0].Type())
+			}
+
+			return &String{Value: strings.ToLower(args[0].(*String).Value)}
+		},
+		},
+	},
+	// Reports whether a string contains a substring
+	{
+		"contains",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2",
+					len(args))
+			}
+			if args[0].Type() != STRING_OBJ || args[1].Type() != STRING_OBJ {
+				return newError("arguments to `contains` must be STRING, got %s and %s",
+					args[0].Type(), args[1].Type())
+			}
+
+			return nativeBoolToBoolean(
+				strings.Contains(args[0].(*String).Value, args[1].(*String).Value))
+		},
+		},
+	},
+	// Returns a new array holding the results of calling a function on each
+	// element of an array
+	{
+		"map",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2",
+					len(args))
+			}
+			if args[0].Type() != ARRAY_OBJ {
+				return newError("first argument to `map` must be ARRAY, got %s",
+					args[0].Type())
+			}
+
+			arr := args[0].(*Array)
+			mapped := make([]Object, len(arr.Elements))
+			for i, el := range arr.Elements {
+				res := rt.Call(args[1], el)
+				if isError(res) {
+					return res
+				}
+				mapped[i] = res
+			}
+
+			return &Array{Elements: mapped}
+		},
+		},
+	},
+	// Returns a new array holding the elements of an array for which a
+	// function returns a truthy value
+	{
+		"filter",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2",
+					len(args))
+			}
+			if args[0].Type() != ARRAY_OBJ {
+				return newError("first argument to `filter` must be ARRAY, got %s",
+					args[0].Type())
+			}
+
+			arr := args[0].(*Array)
+			filtered := []Object{}
+			for _, el := range arr.Elements {
+				res := rt.Call(args[1], el)
+				if isError(res) {
+					return res
+				}
+				if IsTruthy(res) {
+					filtered = append(filtered, el)
+				}
+			}
+
+			return &Array{Elements: filtered}
+		},
+		},
+	},
+	// Combines the elements of an array into a single value, by calling a
+	// function with the value so far and each element in turn
+	{
+		"reduce",
+		&Builtin{Arity: &Arity{3, 3}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 3 {
+				return newError("wrong number of arguments. got=%d, want=3",
+					len(args))
+			}
+			if args[0].Type() != ARRAY_OBJ {
+				return newError("first argument to `reduce` must be ARRAY, got %s",
+					args[0].Type())
+			}
+
+			acc := args[1]
+			for _, el := range args[0].(*Array).Elements {
+				acc = rt.Call(args[2], acc, el)
+				if isError(acc) {
+					return acc
+				}
+			}
+
+			return acc
+		},
+		},
+	},
+	// Returns a sorted copy of an array. Numbers and strings are sorted in
+	// ascending order, unless a function is given that reports whether its
+	// first argument should come before its second. The sort is stable.
+	{
+		"sort",
+		&Builtin{Arity: &Arity{1, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 && len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=1 or 2",
+					len(args))
+			}
+			if args[0].Type() != ARRAY_OBJ {
+				return newError("first argument to `sort` must be ARRAY, got %s",
+					args[0].Type())
+			}
+
+			arr := args[0].(*Array)
+			sorted := make([]Object, len(arr.Elements))
+			copy(sorted, arr.Elements)
+
+			// The first error stops any further comparisons from being made.
+			var err Object
+			less := func(a, b Object) bool {
+				if err != nil {
+					return false
+				}
+
+				if len(args) == 1 {
+					isLess, cmpErr := lessForSort(a, b)
+					if cmpErr != nil {
+						err = cmpErr
+					}
+					return isLess
+				}
+
+				res := rt.Call(args[1], a, b)
+				if isError(res) {
+					err = res
+					return false
+				}
+				return IsTruthy(res)
+			}
+
+			sort.SliceStable(sorted, func(i, j int) bool {
+				return less(sorted[i], sorted[j])
+			})
+			if err != nil {
+				return err
+			}
+
+			return &Array{Elements: sorted}
+		},
+		},
+	},
+	// Returns the keys of a hash as an array
+	{
+		"keys",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if args[0].Type() != HASH_OBJ {
+				return newError("argument to `keys` must be HASH, got %s",
+					args[0].Type())
+			}
+
+			pairs := args[0].(*Hash).SortedPairs()
+			keys := make([]Object, len(pairs))
+			for i, pair := range pairs {
+				keys[i] = pair.Key
+			}
+
+			return &Array{Elements: keys}
+		},
+		},
+	},
+	// Returns the values of a hash as an array
+	{
+		"values",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if args[0].Type() != HASH_OBJ {
+				return newError("argument to `values` must be HASH, got %s",
+					args[0].Type())
+			}
+
+			pairs := args[0].(*Hash).SortedPairs()
+			values := make([]Object, len(pairs))
+			for i, pair := range pairs {
+				values[i] = pair.Value
+			}
+
+			return &Array{Elements: values}
+		},
+		},
+	},
+	// Reports whether a hash has an entry for a key
+	{
+		"hasKey",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2",
+					len(args))
+			}
+			if args[0].Type() != HASH_OBJ {
+				return newError("first argument to `hasKey` must be HASH, got %s",
+					args[0].Type())
+			}
+			key, ok := args[1].(Hashable)
+			if !ok {
+				return newError("unusable as hash key: %s", args[1].Type())
+			}
+
+			_, ok = args[0].(*Hash).Pairs[key.HashKey()]
+			return nativeBoolToBoolean(ok)
+		},
+		},
+	},
+	// Returns a copy of a hash without the entry for a key
+	{
+		"delete",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2",
+					len(args))
+			}
+			if args[0].Type() != HASH_OBJ {
+				return newError("first argument to `delete` must be HASH, got %s",
+					args[0].Type())
+			}
+			key, ok := args[1].(Hashable)
+			if !ok {
+				return newError("unusable as hash key: %s", args[1].Type())
+			}
+
+			pairs := make(map[HashKey]HashPair, len(args[0].(*Hash).Pairs))
+			for k, pair := range args[0].(*Hash).Pairs {
+				pairs[k] = pair
+			}
+			delete(pairs, key.HashKey())
+
+			return &Hash{Pairs: pairs}
+		},
+		},
+	},
+	// Returns a new hash with the entries of both hashes. Entries of the
+	// second hash win over those of the first.
+	{
+		"merge",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2",
+					len(args))
+			}
+			if args[0].Type() != HASH_OBJ || args[1].Type() != HASH_OBJ {
+				return newError("arguments to `merge` must be HASH, got %s and %s",
+					args[0].Type(), args[1].Type())
+			}
+
+			first := args[0].(*Hash)
+			second := args[1].(*Hash)
+
+			pairs := make(map[HashKey]HashPair, len(first.Pairs)+len(second.Pairs))
+			for k, pair := range first.Pairs {
+				pairs[k] = pair
+			}
+			for k, pair := range second.Pairs {
+				pairs[k] = pair
+			}
+
+			return &Hash{Pairs: pairs}
+		},
+		},
+	},
+	// Returns the type of a value as a string, e.g. "INTEGER". Functions are
+	// "FUNCTION" in both engines, even though the VM represents them as
+	// closures.
+	{
+		"type",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+
+			return &String{Value: string(typeName(args[0]))}
+		},
+		},
+	},
+	// Converts a number, numeric string or boolean to an integer. Floats are
+	// truncated towards zero.
+	{
+		"int",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+
+			switch arg := args[0].(type) {
+			case *Integer:
+				return arg
+			case *Float:
+				if math.IsNaN(arg.Value) || arg.Value < math.MinInt64 || arg.Value >= math.MaxInt64 {
+					return newError("float %s out of range for `int`", arg.Inspect())
+				}
+				return NewInteger(int64(arg.Value))
+			case *String:
+				val, err := strconv.ParseInt(strings.TrimSpace(arg.Value), 10, 64)
+				if err != nil {
+					return newError("could not parse %q as integer", arg.Value)
+				}
+				return NewInteger(val)
+			case *Boolean:
+				if arg.Value {
+					return NewInteger(1)
+				}
+				return NewInteger(0)
+			default:
+				return newError("argument to `int` not supported, got %s",
+					args[0].Type())
+			}
+		},
+		},
+	},
+	// Converts any value to its string representation
+	{
+		"str",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+
+			if str, ok := args[0].(*String); ok {
+				return str
+			}
+			return &String{Value: args[0].Inspect()}
+		},
+		},
+	},
+	// Returns the absolute value of a number
+	{
+		"abs",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+
+			switch arg := args[0].(type) {
+			case *Integer:
+				if arg.Value == math.MinInt64 {
+					return newError("integer overflow in `abs`")
+				}
+				if arg.Value < 0 {
+					return NewInteger(-arg.Value)
+				}
+				return arg
+			case *Float:
+				return &Float{Value: math.Abs(arg.Value)}
+			default:
+				return newError("argument to `abs` must be INTEGER or FLOAT, got %s",
+					args[0].Type())
+			}
+		},
+		},
+	},
+	// Returns the smallest of its arguments, or of the elements of an array
+	{
+		"min",
+		&Builtin{Fn: func(rt Runtime, args ...Object) Object {
+			return extremum("min", args, func(a, b float64) bool { return a < b })
+		},
+		},
+	},
+	// Returns the largest of its arguments, or of the elements of an array
+	{
+		"max",
+		&Builtin{Fn: func(rt Runtime, args ...Object) Object {
+			return extremum("max", args, func(a, b float64) bool { return a > b })
+		},
+		},
+	},
+	// Raises a number to a power. The result is an integer if both arguments
+	// are integers and the exponent isn't negative.
+	{
+		"pow",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=2",
+					len(args))
+			}
+			if !IsNumeric(args[0]) || !IsNumeric(args[1]) {
+				return newError("arguments to `pow` must be INTEGER or FLOAT, got %s and %s",
+					args[0].Type(), args[1].Type())
+			}
+
+			base, baseIsInt := args[0].(*Integer)
+			exp, expIsInt := args[1].(*Integer)
+			if !baseIsInt || !expIsInt || exp.Value < 0 {
+				return &Float{Value: math.Pow(ToFloat(args[0]), ToFloat(args[1]))}
+			}
+
+			res, ok := PowerInts(base.Value, exp.Value)
+			if !ok {
+				return newError("integer overflow in `pow`")
+			}
+			return NewInteger(res)
+		},
+		},
+	},
+	// Returns the square root of a non-negative number as a float
+	{
+		"sqrt",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if !IsNumeric(args[0]) {
+				return newError("argument to `sqrt` must be INTEGER or FLOAT, got %s",
+					args[0].Type())
+			}
+
+			val := ToFloat(args[0])
+			if val < 0 {
+				return newError("cannot take square root of negative number %s",
+					args[0].Inspect())
+			}
+
+			return &Float{Value: math.Sqrt(val)}
+		},
+		},
+	},
+	// Returns an array of the integers from start up to, but not including,
+	// end: range(end), range(start, end) or range(start, end, step). A
+	// negative step counts down.
+	{
+		"range",
+		&Builtin{Arity: &Arity{1, 3}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) < 1 || len(args) > 3 {
+				return newError("wrong number of arguments. got=%d, want=1 to 3",
+					len(args))
+			}
+
+			ints := make([]int64, len(args))
+			for i, arg := range args {
+				integer, ok := arg.(*Integer)
+				if !ok {
+					return newError("arguments to `range` must be INTEGER, got %s",
+						arg.Type())
+				}
+				ints[i] = integer.Value
+			}
+
+			start, end, step := int64(0), ints[0], int64(1)
+			if len(ints) > 1 {
+				start, end = ints[0], ints[1]
+			}
+			if len(ints) > 2 {
+				step = ints[2]
+			}
+			if step == 0 {
+				return newError("`range` step must not be 0")
+			}
+
+			// Counted in uint64, since the distance between two int64s can
+			// overflow an int64.
+			var count uint64
+			switch {
+			case step > 0 && start < end:
+				count = (uint64(end)-uint64(start)-1)/uint64(step) + 1
+			case step < 0 && start > end:
+				count = (uint64(start)-uint64(end)-1)/(-uint64(step)) + 1
+			}
+			if count > uint64(MaxRangeLength) {
+				return newError("`range` would produce %d elements, more than the limit of %d",
+					count, MaxRangeLength)
+			}
+
+			elements := make([]Object, count)
+			for i := range elements {
+				elements[i] = NewInteger(start + int64(i)*step)
+			}
+
+			return &Array{Elements: elements}
+		},
+		},
+	},
+	// Returns the contents of a file as a string
+	{
+		"readFile",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if err := requireCapability(rt, FileSystemCapability, "readFile"); err != nil {
+				return err
+			}
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if args[0].Type() != STRING_OBJ {
+				return newError("argument to `readFile` must be STRING, got %s",
+					args[0].Type())
+			}
+
+			content, err := os.ReadFile(args[0].(*String).Value)
+			if err != nil {
+				return newError("`readFile` failed: %s", err)
+			}
+
+			return &String{Value: string(content)}
+		},
+		},
+	},
+	// Replaces the contents of a file with a string, creating the file if
+	// it doesn't exist
+	{
+		"writeFile",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			return writeToFile(rt, "writeFile", os.O_TRUNC, args)
+		},
+		},
+	},
+	// Adds a string to the end of a file, creating the file if it doesn't
+	// exist
+	{
+		"appendFile",
+		&Builtin{Arity: &Arity{2, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			return writeToFile(rt, "appendFile", os.O_APPEND, args)
+		},
+		},
+	},
+	// Reads a line from the runtime's input, returning null at the end of it
+	{
+		"readLine",
+		&Builtin{Arity: &Arity{0, 0}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 0 {
+				return newError("wrong number of arguments. got=%d, want=0",
+					len(args))
+			}
+
+			return readLine(rt)
+		},
+		},
+	},
+	// Prints a prompt, then reads a line from the runtime's input
+	{
+		"input",
+		&Builtin{Arity: &Arity{0, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) > 1 {
+				return newError("wrong number of arguments. got=%d, want=0 or 1",
+					len(args))
+			}
+			if len(args) == 1 {
+				fmt.Fprint(rt.Stdout(), args[0].Inspect())
+			}
+
+			return readLine(rt)
+		},
+		},
+	},
+	// Parses a JSON document into hashes, arrays, strings, numbers, booleans
+	// and null
+	{
+		"jsonParse",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if args[0].Type() != STRING_OBJ {
+				return newError("argument to `jsonParse` must be STRING, got %s",
+					args[0].Type())
+			}
+
+			dec := json.NewDecoder(strings.NewReader(args[0].(*String).Value))
+			dec.UseNumber()
+
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				return newError("`jsonParse` failed: %s", err)
+			}
+			if _, err := dec.Token(); err != io.EOF {
+				return newError("`jsonParse` failed: unexpected data after JSON value")
+			}
+
+			obj, err := fromJSON(v)
+			if err != nil {
+				return err
+			}
+			return obj
+		},
+		},
+	},
+	// Encodes a value as a JSON string. Hash keys that aren't strings are
+	// converted to strings, and hashes are encoded with their keys sorted.
+	{
+		"jsonStringify",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+
+			var out strings.Builder
+			if err := toJSON(&out, args[0], map[Object]bool{}); err != nil {
+				return err
+			}
+
+			return &String{Value: out.String()}
+		},
+		},
+	},
+	// Returns the current time in milliseconds since the Unix epoch
+	{
+		"now",
+		&Builtin{Arity: &Arity{0, 0}, Fn: func(rt Runtime, args ...Object) Object {
+			if err := requireCapability(rt, TimeCapability, "now"); err != nil {
+				return err
+			}
+			if len(args) != 0 {
+				return newError("wrong number of arguments. got=%d, want=0",
+					len(args))
+			}
+
+			return NewInteger(time.Now().UnixMilli())
+		},
+		},
+	},
+	// Pauses the program for a number of milliseconds, or until the
+	// runtime's context is done
+	{
+		"sleep",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if err := requireCapability(rt, TimeCapability, "sleep"); err != nil {
+				return err
+			}
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if !IsNumeric(args[0]) {
+				return newError("argument to `sleep` must be INTEGER or FLOAT, got %s",
+					args[0].Type())
+			}
+
+			ms := ToFloat(args[0])
+			if ms < 0 || math.IsNaN(ms) || ms > math.MaxInt64/float64(time.Millisecond) {
+				return newError("cannot sleep for %s milliseconds", args[0].Inspect())
+			}
+
+			timer := time.NewTimer(time.Duration(ms * float64(time.Millisecond)))
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+				return nil
+			case <-rt.Context().Done():
+				return newError("`sleep` interrupted: %s", rt.Context().Err())
+			}
+		},
+		},
+	},
+	// Formats a time in milliseconds since the Unix epoch as UTC, using a Go
+	// layout such as "2006-01-02 15:04:05". Defaults to RFC 3339.
+	{
+		"formatTime",
+		&Builtin{Arity: &Arity{1, 2}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) != 1 && len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=1 or 2",
+					len(args))
+			}
+			if args[0].Type() != INTEGER_OBJ {
+				return newError("first argument to `formatTime` must be INTEGER, got %s",
+					args[0].Type())
+			}
+
+			layout := time.RFC3339
+			if len(args) == 2 {
+				if args[1].Type() != STRING_OBJ {
+					return newError("second argument to `formatTime` must be STRING, got %s",
+						args[1].Type())
+				}
+				layout = args[1].(*String).Value
+			}
+
+			t := time.UnixMilli(args[0].(*Integer).Value).UTC()
+			return &String{Value: t.Format(layout)}
+		},
+		},
+	},
+	// Stops the program with an exit code, which defaults to 0
+	{
+		"exit",
+		&Builtin{Arity: &Arity{0, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if len(args) > 1 {
+				return newError("wrong number of arguments. got=%d, want=0 or 1",
+					len(args))
+			}
+			if len(args) == 0 {
+				return &Exit{Code: 0}
+			}
+			if args[0].Type() != INTEGER_OBJ {
+				return newError("argument to `exit` must be INTEGER, got %s",
+					args[0].Type())
+			}
+
+			code := args[0].(*Integer).Value
+			if code < 0 || code > 255 {
+				return newError("exit code must be between 0 and 255, got %d", code)
+			}
+
+			return &Exit{Code: code}
+		},
+		},
+	},
+	// Returns the value of an environment variable, or null if it isn't set
+	{
+		"getEnv",
+		&Builtin{Arity: &Arity{1, 1}, Fn: func(rt Runtime, args ...Object) Object {
+			if err := requireCapability(rt, EnvironmentCapability, "getEnv"); err != nil {
+				return err
+			}
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1",
+					len(args))
+			}
+			if args[0].Type() != STRING_OBJ {
+				return newError("argument to `getEnv` must be STRING, got %s",
+					args[0].Type())
+			}
+
+			val, ok := os.LookupEnv(args[0].(*String).Value)
+			if !ok {
+				return Null
+			}
+			return &String{Value: val}
+		},
+		},
+	},
+}
+
+// Implements `writeFile` and `appendFile`, which differ only in the flag
+// used to open the file.
+func writeToFile(rt Runtime, name string, flag int, args []Object) Object {
+	if err := requireCapability(rt, FileSystemCapability, name); err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2",
+			len(args))
+	}
+	if args[0].Type() != STRING_OBJ || args[1].Type() != STRING_OBJ {
+		return newError("arguments to `%s` must be STRING, got %s and %s",
+			name, args[0].Type(), args[1].Type())
+	}
+
+	f, err := os.OpenFile(args[0].(*String).Value, os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return newError("`%s` failed: %s", name, err)
+	}
+
+	_, err = io.WriteString(f, args[1].(*String).Value)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return newError("`%s` failed: %s", name, err)
+	}
+
+	return nil
+}
+
+// Shared by every engine reading from os.Stdin, so input buffered by one
+// engine isn't lost to another.
+var stdin = bufio.NewReader(os.Stdin)
+
+// Wraps a reader for use as the input of an engine. Readers that are already
+// buffered are used as is, so the host can keep reading from them too.
+func NewInput(r io.Reader) *bufio.Reader {
+	if r == os.Stdin {
+		return stdin
+	}
+	if br, ok := r.(*bufio.Reader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// Reads a line from the runtime's input, without its line ending. Returns
+// null once the input is exhausted.
+func readLine(rt Runtime) Object {
+	line, err := rt.Stdin().ReadString('\n')
+	if err == io.EOF && line == "" {
+		return nil
+	}
+	if err != nil && err != io.EOF {
+		return newError("could not read input: %s", err)
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return &String{Value: line}
+}
+
+// Converts a value decoded by encoding/json, with numbers decoded as
+// json.Number, into an object. Numbers that fit in an int64 become integers,
+// and numbers too large for a float64 are reported, as encoding/json does.
+func fromJSON(v interface{}) (Object, *Error) {
+	switch v := v.(type) {
+	case nil:
+		return Null, nil
+	case bool:
+		return nativeBoolToBoolean(v), nil
+	case string:
+		return &String{Value: v}, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return NewInteger(i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, newError("`jsonParse` failed: number %s is out of range", v)
+		}
+		return &Float{Value: f}, nil
+	case []interface{}:
+		elements := make([]Object, len(v))
+		for i, el := range v {
+			obj, err := fromJSON(el)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = obj
+		}
+		return &Array{Elements: elements}, nil
+	case map[string]interface{}:
+		pairs := make(map[HashKey]HashPair, len(v))
+		for k, el := range v {
+			obj, err := fromJSON(el)
+			if err != nil {
+				return nil, err
+			}
+			key := &String{Value: k}
+			pairs[key.HashKey()] = HashPair{Key: key, Value: obj}
+		}
+		return &Hash{Pairs: pairs}, nil
+	default:
+		return nil, newError("`jsonParse` failed: unexpected value %v", v)
+	}
+}
+
+// Writes obj to out as JSON. Arrays and hashes currently being encoded are
+// tracked in active, so that cyclic structures are reported rather than
+// recursing forever.
+func toJSON(out *strings.Builder, obj Object, active map[Object]bool) *Error {
+	switch obj := obj.(type) {
+	case nil, *NULL:
+		out.WriteString("null")
+	case *Boolean:
+		out.WriteString(strconv.FormatBool(obj.Value))
+	case *Integer:
+		out.WriteString(strconv.FormatInt(obj.Value, 10))
+	case *Float:
+		b, err := json.Marshal(obj.Value)
+		if err != nil {
+			return newError("`jsonStringify` cannot encode %s", obj.Inspect())
+		}
+		out.Write(b)
+	case *String:
+		writeJSONString(out, obj.Value)
+	case *Array:
+		if active[obj] {
+			return newError("`jsonStringify` cannot encode a cyclic structure")
+		}
+		active[obj] = true
+		defer delete(active, obj)
+
+		out.WriteByte('[')
+		for i, el := range obj.Elements {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := toJSON(out, el, active); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case *Hash:
+		if active[obj] {
+			return newError("`jsonStringify` cannot encode a cyclic structure")
+		}
+		active[obj] = true
+		defer delete(active, obj)
+
+		out.WriteByte('{')
+		for i, pair := range obj.SortedPairs() {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			switch key := pair.Key.(type) {
+			case *String:
+				writeJSONString(out, key.Value)
+			default:
+				writeJSONString(out, key.Inspect())
+			}
+			out.WriteByte(':')
+			if err := toJSON(out, pair.Value, active); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	default:
+		return newError("`jsonStringify` cannot encode %s", typeName(obj))
+	}
+
+	return nil
+}
+
+// Writes s as a quoted JSON string. Unlike json.Marshal, characters such as
+// < and & are left as is.
+func writeJSONString(out *strings.Builder, s string) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	out.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// Names the type of an object as scripts see it. Compiled functions and
+// closures are reported as functions, like in the evaluator.
+func typeName(obj Object) ObjectType {
+	switch t := obj.Type(); t {
+	case CLOSURE_OBJ, COMPILED_FUNCTION_OBJ:
+		return FUNCTION_OBJ
+	default:
+		return t
+	}
+}
+
+// Returns an error if the host has denied the capability a builtin needs.
+func requireCapability(rt Runtime, c Capability, name string) *Error {
+	if !rt.Allows(c) {
+		return newError("`%s` is not allowed: %s access is disabled", name, c)
+	}
+	return nil
+}
+
+// The largest array `range` may produce, guarding against scripts that
+// exhaust memory by accident. Embedders may change it.
+var MaxRangeLength = 1_000_000
+
+// Implements `min` and `max`, which take either numbers or a single array of
+// numbers and return the number for which `better` holds against all others.
+func extremum(name string, args []Object, better func(a, b float64) bool) Object {
+	if len(args) == 1 {
+		if arr, ok := args[0].(*Array); ok {
+			args = arr.Elements
+		}
+	}
+	if len(args) == 0 {
+		return newError("`%s` needs at least one number", name)
+	}
+
+	var best Object
+	for _, arg := range args {
+		if !IsNumeric(arg) {
+			return newError("arguments to `%s` must be INTEGER or FLOAT, got %s",
+				name, arg.Type())
+		}
+		if best == nil || better(ToFloat(arg), ToFloat(best)) {
+			best = arg
+		}
+	}
+
+	return best
+}
+
+// Multiplies two integers, reporting false if the product overflows.
+func multiplyInts(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+
+	c := a * b
+	if c/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+
+	return c, true
+}
+
+// The default ordering of `sort`, which only knows how to compare numbers
+// with numbers and strings with strings.
+func lessForSort(a, b Object) (bool, *Error) {
+	switch a := a.(type) {
+	case *Integer:
+		switch b := b.(type) {
+		case *Integer:
+			return a.Value < b.Value, nil
+		case *Float:
+			return float64(a.Value) < b.Value, nil
+		}
+	case *Float:
+		switch b := b.(type) {
+		case *Integer:
+			return a.Value < float64(b.Value), nil
+		case *Float:
+			return a.Value < b.Value, nil
+		}
+	case *String:
+		if b, ok := b.(*String); ok {
+			return a.Value < b.Value, nil
+		}
+	}
+
+	return false, newError("elements of array passed to `sort` must be comparable, got %s and %s",
+		a.Type(), b.Type())
+}
+
+// The only Boolean and Null objects, so that they can be compared by identity.
+var (
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+	Null  = &NULL{}
+)
+
+// Reports whether obj stops the program, which an exit, an exceeded budget
+// or a thrown value does as well as an error.
+func isError(obj Object) bool {
+	if obj == nil {
+		return false
+	}
+	switch obj.Type() {
+	case ERROR_OBJ, EXIT_OBJ, BUDGET_EXCEEDED_OBJ, THROWN_OBJ:
+		return true
+	default:
+		return false
+	}
+}
+
+func nativeBoolToBoolean(b bool) *Boolean {
+	if b {
+		return TRUE
+	}
+	return FALSE
 }
 
 func newError(format string, a ...interface{}) *Error {
 	return &Error{Message: fmt.Sprintf(format, a...)}
 }
 
-func GetBuiltinByName(name string) *Builtin {
+// Indexes Builtins by name.
+var builtinsByName = map[string]*Builtin{}
+
+func init() {
 	for _, def := range Builtins {
-		if def.Name == name {
-			return def.Builtin
-		}
+		builtinsByName[def.Name] = def.Builtin
+	}
+}
+
+func GetBuiltinByName(name string) *Builtin {
+	return builtinsByName[name]
+}
+
+// How many builtins there can be, those of the language included, as
+// compiled programs refer to them by a one-byte index.
+const MaxBuiltins = 256
+
+// Adds a builtin defined by the host program after those of the language.
+// Compiled programs refer to builtins by their position in Builtins, so
+// builtins have to be registered in the same order wherever bytecode is
+// compiled and run.
+//
+// Builtins must be registered before any program is compiled or evaluated,
+// as from an init function: Builtins and the index of builtins by name
+// aren't locked, so registering while programs run is a data race.
+func RegisterBuiltin(name string, fn BuiltinFunction) error {
+	if _, ok := builtinsByName[name]; ok {
+		return fmt.Errorf("builtin %s is already defined", name)
+	}
+	if len(Builtins) >= MaxBuiltins {
+		return fmt.Errorf("cannot register builtin %s: there can be at most %d builtins", name, MaxBuiltins)
 	}
+
+	builtin := &Builtin{Fn: fn}
+	Builtins = append(Builtins, struct {
+		Name    string
+		Builtin *Builtin
+	}{name, builtin})
+	builtinsByName[name] = builtin
+
 	return nil
 }
@@ -0,0 +1,195 @@
+package object
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Converts a Go value to an object: nil to null, booleans, integers, floats
+// and strings to the corresponding objects, and slices, arrays and maps to
+// arrays and hashes of their converted elements. Map keys have to convert to
+// integers, strings or booleans. Pointers convert to what they point to.
+// Objects are returned as they are.
+//
+// A slice, map or pointer that appears more than once in v converts to the
+// same object every time, so cyclic values convert to cyclic structures. A
+// pointer that leads back to itself without passing through a slice or map
+// can't be converted.
+func FromGo(v interface{}) (Object, error) {
+	if v == nil {
+		return Null, nil
+	}
+	if obj, ok := v.(Object); ok {
+		return obj, nil
+	}
+	c := &fromGoConverter{converted: map[goRef]Object{}, active: map[goRef]bool{}}
+	return c.convert(reflect.ValueOf(v))
+}
+
+// Identifies a slice, map or pointer by the memory it refers to. Slices
+// sharing their first element but of different lengths are told apart.
+type goRef struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+type fromGoConverter struct {
+	converted map[goRef]Object
+	active    map[goRef]bool // pointers whose targets are being converted
+}
+
+func (c *fromGoConverter) convert(v reflect.Value) (Object, error) {
+	if v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return Null, nil
+		}
+		if obj, ok := v.Interface().(Object); ok {
+			return obj, nil
+		}
+		if v.Kind() == reflect.Interface {
+			return c.convert(v.Elem())
+		}
+
+		ref := goRef{typ: v.Type(), ptr: v.Pointer()}
+		if obj, ok := c.converted[ref]; ok {
+			return obj, nil
+		}
+		if c.active[ref] {
+			return nil, fmt.Errorf("cannot convert %s, it points to itself", v.Type())
+		}
+		c.active[ref] = true
+		obj, err := c.convert(v.Elem())
+		delete(c.active, ref)
+		if err != nil {
+			return nil, err
+		}
+		c.converted[ref] = obj
+		return obj, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return nativeBoolToBoolean(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewInteger(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("cannot convert %d to an integer, it is too large", v.Uint())
+		}
+		return NewInteger(int64(v.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return &Float{Value: v.Float()}, nil
+	case reflect.String:
+		return &String{Value: v.String()}, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return Null, nil
+		}
+
+		var ref goRef
+		if v.Kind() == reflect.Slice && v.Len() > 0 {
+			ref = goRef{typ: v.Type(), ptr: v.Pointer(), len: v.Len()}
+			if obj, ok := c.converted[ref]; ok {
+				return obj, nil
+			}
+		}
+
+		arr := &Array{Elements: make([]Object, v.Len())}
+		if ref.typ != nil {
+			c.converted[ref] = arr
+		}
+		for i := range arr.Elements {
+			el, err := c.convert(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			arr.Elements[i] = el
+		}
+		return arr, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return Null, nil
+		}
+
+		ref := goRef{typ: v.Type(), ptr: v.Pointer()}
+		if obj, ok := c.converted[ref]; ok {
+			return obj, nil
+		}
+
+		hash := &Hash{Pairs: make(map[HashKey]HashPair, v.Len())}
+		c.converted[ref] = hash
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := c.convert(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			hashable, ok := key.(Hashable)
+			if !ok {
+				return nil, fmt.Errorf("cannot convert %s to a hash, its keys are %s",
+					v.Type(), key.Type())
+			}
+
+			val, err := c.convert(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			hash.Pairs[hashable.HashKey()] = HashPair{Key: key, Value: val}
+		}
+		return hash, nil
+	default:
+		return nil, fmt.Errorf("cannot convert %s to an object", v.Type())
+	}
+}
+
+// Converts an object to a Go value: null to nil, integers to int64, floats
+// to float64, strings and booleans to string and bool, arrays to
+// []interface{}, and hashes to map[interface{}]interface{} keyed by int64,
+// string or bool. Anything else, such as a function, is returned as it is.
+//
+// An array or hash that appears more than once in obj converts to the same
+// Go value every time, so cyclic structures convert to cyclic values.
+func ToGo(obj Object) interface{} {
+	return toGo(obj, map[Object]interface{}{})
+}
+
+func toGo(obj Object, converted map[Object]interface{}) interface{} {
+	switch obj := obj.(type) {
+	case nil, *NULL:
+		return nil
+	case *Integer:
+		return obj.Value
+	case *Float:
+		return obj.Value
+	case *String:
+		return obj.Value
+	case *Boolean:
+		return obj.Value
+	case *Array:
+		if v, ok := converted[obj]; ok {
+			return v
+		}
+
+		elements := make([]interface{}, len(obj.Elements))
+		converted[obj] = elements
+		for i, el := range obj.Elements {
+			elements[i] = toGo(el, converted)
+		}
+		return elements
+	case *Hash:
+		if v, ok := converted[obj]; ok {
+			return v
+		}
+
+		pairs := make(map[interface{}]interface{}, len(obj.Pairs))
+		converted[obj] = pairs
+		for _, pair := range obj.Pairs {
+			pairs[toGo(pair.Key, converted)] = toGo(pair.Value, converted)
+		}
+		return pairs
+	default:
+		return obj
+	}
+}
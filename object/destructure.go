@@ -0,0 +1,43 @@
+package object
+
+// Returns the elements bound by `let [a, b, ...] = value;` with n names,
+// which value must be an array of exactly n elements for.
+func DestructureArray(value Object, n int) ([]Object, *Error) {
+	arr, ok := value.(*Array)
+	if !ok {
+		return nil, newError("cannot destructure %s as an array", value.Type())
+	}
+	if len(arr.Elements) != n {
+		return nil, newError("wrong number of elements to destructure: want=%d, got=%d",
+			n, len(arr.Elements))
+	}
+	return arr.Elements, nil
+}
+
+// Returns the values bound by `let {key: a, ...} = value;`, one for each of
+// keys, all of which value must be a hash containing. Other keys the hash
+// has are ignored.
+func DestructureHash(value Object, keys []Object) ([]Object, *Error) {
+	hash, ok := value.(*Hash)
+	if !ok {
+		return nil, newError("cannot destructure %s as a hash", value.Type())
+	}
+
+	values := make([]Object, len(keys))
+	for i, key := range keys {
+		hashKey, ok := key.(Hashable)
+		if !ok {
+			return nil, newError("unusable as hash key: %s", key.Type())
+		}
+
+		pair, ok := hash.Pairs[hashKey.HashKey()]
+		if !ok {
+			if str, ok := key.(*String); ok {
+				return nil, newError("hash has no key %q to destructure", str.Value)
+			}
+			return nil, newError("hash has no key %s to destructure", key.Inspect())
+		}
+		values[i] = pair.Value
+	}
+	return values, nil
+}
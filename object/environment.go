@@ -1,19 +1,74 @@
 package object
 
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+)
+
 func NewEnclosedEnvironment(outer *Environment) *Environment {
-	env := NewEnvironment()
-	env.outer = outer
-	return env
+	s := make(map[string]Object)
+	return &Environment{store: s, outer: outer, usage: outer.usage}
 }
 
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
-	return &Environment{store: s, outer: nil}
+	return &Environment{store: s, outer: nil, usage: &usage{}}
+}
+
+// Returns an environment for the top level of a module imported by code
+// evaluated in importer, with the module's imports relative to dir. It
+// shares the settings and budgets of importer, but none of its bindings.
+func NewModuleEnvironment(importer *Environment, dir string) *Environment {
+	env := NewEnvironment()
+	env.usage = importer.usage
+	env.stdout = importer.Stdout()
+	env.stdin = importer.Stdin()
+	env.ctx = importer.Context()
+	env.dir = dir
+	for e := importer; e != nil; e = e.outer {
+		for c := range e.denied {
+			env.Deny(c)
+		}
+	}
+	return env
 }
 
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	store  map[string]Object
+	consts map[string]bool // Names in store bound by `const`; nil if there are none.
+	outer  *Environment
+	stdout io.Writer
+	stdin  *bufio.Reader
+	denied map[Capability]bool
+	ctx    context.Context
+	dir    string // Where imported files are found; see SetImportDir.
+
+	// Shared with every environment enclosed by this one, so that counting
+	// a step doesn't have to walk up to the outermost environment.
+	usage *usage
+}
+
+// What the code evaluated in a tree of environments has used of its
+// budgets, how it does arithmetic, and the modules it has imported. Limits
+// of 0 mean there is no limit.
+type usage struct {
+	steps     uint64
+	stepLimit uint64
+
+	allocated   uint64
+	memoryLimit uint64
+
+	callDepth    int
+	maxCallDepth int
+
+	checkedArithmetic bool
+	strict            bool
+
+	// The top-level bindings of each module imported, by key. A module is
+	// mapped to nil while it is being loaded.
+	modules map[string]Object
 }
 
 func (e *Environment) Get(name string) (Object, bool) {
@@ -26,5 +81,252 @@ func (e *Environment) Get(name string) (Object, bool) {
 
 func (e *Environment) Set(name string, val Object) Object {
 	e.store[name] = val
+	delete(e.consts, name)
+	return val
+}
+
+// Binds name like Set, but as a constant, which Assign refuses to rebind.
+func (e *Environment) SetConst(name string, val Object) Object {
+	e.store[name] = val
+	if e.consts == nil {
+		e.consts = make(map[string]bool)
+	}
+	e.consts[name] = true
 	return val
 }
+
+// Reports whether the closest environment that defines name bound it as a
+// constant.
+func (e *Environment) IsConst(name string) bool {
+	if _, ok := e.store[name]; ok {
+		return e.consts[name]
+	}
+	if e.outer != nil {
+		return e.outer.IsConst(name)
+	}
+	return false
+}
+
+// Returns a copy of the bindings made in this environment, without those of
+// the environments enclosing it.
+func (e *Environment) Bindings() map[string]Object {
+	bindings := make(map[string]Object, len(e.store))
+	for name, val := range e.store {
+		bindings[name] = val
+	}
+	return bindings
+}
+
+// Rebinds `name` in the closest environment that defines it.
+// Returns false if `name` has not been defined. Constants are rebound too,
+// so callers that respect them check IsConst first.
+func (e *Environment) Assign(name string, val Object) bool {
+	if _, ok := e.store[name]; ok {
+		e.store[name] = val
+		return true
+	}
+	if e.outer != nil {
+		return e.outer.Assign(name, val)
+	}
+	return false
+}
+
+// Sets where builtins like `puts` write their output, for this environment
+// and every environment enclosed by it.
+func (e *Environment) SetStdout(w io.Writer) {
+	e.stdout = w
+}
+
+// Returns the output of the closest environment that has one set,
+// defaulting to os.Stdout.
+func (e *Environment) Stdout() io.Writer {
+	if e.stdout != nil {
+		return e.stdout
+	}
+	if e.outer != nil {
+		return e.outer.Stdout()
+	}
+	return os.Stdout
+}
+
+// Sets where builtins like `readLine` read their input from, for this
+// environment and every environment enclosed by it.
+func (e *Environment) SetStdin(r io.Reader) {
+	e.stdin = NewInput(r)
+}
+
+// Returns the input of the closest environment that has one set,
+// defaulting to os.Stdin.
+func (e *Environment) Stdin() *bufio.Reader {
+	if e.stdin != nil {
+		return e.stdin
+	}
+	if e.outer != nil {
+		return e.outer.Stdin()
+	}
+	return stdin
+}
+
+// Sets the context that code evaluated in this environment, and in every
+// environment enclosed by it, runs under. Evaluation stops once it is done.
+func (e *Environment) SetContext(ctx context.Context) {
+	e.ctx = ctx
+}
+
+// Returns the context of the closest environment that has one set,
+// defaulting to context.Background().
+func (e *Environment) Context() context.Context {
+	if e.ctx != nil {
+		return e.ctx
+	}
+	if e.outer != nil {
+		return e.outer.Context()
+	}
+	return context.Background()
+}
+
+// Sets the directory that files imported by code evaluated in this
+// environment, and in every environment enclosed by it, are relative to.
+func (e *Environment) SetImportDir(dir string) {
+	e.dir = dir
+}
+
+// Returns the import directory of the closest environment that has one set,
+// defaulting to the working directory, which is "".
+func (e *Environment) ImportDir() string {
+	if e.dir != "" {
+		return e.dir
+	}
+	if e.outer != nil {
+		return e.outer.ImportDir()
+	}
+	return ""
+}
+
+// Returns what the module with the key has been recorded as by SetModule,
+// and whether it has been. Like the budgets, modules are shared with the
+// environments enclosing this one and enclosed by it, as well as with the
+// environments of the modules they import.
+func (e *Environment) Module(key string) (Object, bool) {
+	module, ok := e.usage.modules[key]
+	return module, ok
+}
+
+func (e *Environment) SetModule(key string, module Object) {
+	if e.usage.modules == nil {
+		e.usage.modules = make(map[string]Object)
+	}
+	e.usage.modules[key] = module
+}
+
+func (e *Environment) DeleteModule(key string) {
+	delete(e.usage.modules, key)
+}
+
+// Limits the number of steps code evaluated in this environment may take
+// from now on, counting from zero. The limit is shared with the environments
+// enclosing this one and enclosed by it. A limit of 0 removes it.
+func (e *Environment) SetStepLimit(limit uint64) {
+	e.usage.steps = 0
+	e.usage.stepLimit = limit
+}
+
+func (e *Environment) StepLimit() uint64 {
+	return e.usage.stepLimit
+}
+
+// Counts a step taken by the code being evaluated. Reports false once the
+// step limit has been exceeded.
+func (e *Environment) Step() bool {
+	e.usage.steps++
+	return e.usage.stepLimit == 0 || e.usage.steps <= e.usage.stepLimit
+}
+
+// Limits the number of bytes code evaluated in this environment may
+// allocate from now on, as estimated by SizeOf. Like the step limit, it is
+// shared with the environments enclosing this one and enclosed by it. A
+// limit of 0 removes it.
+func (e *Environment) SetMemoryLimit(limit uint64) {
+	e.usage.allocated = 0
+	e.usage.memoryLimit = limit
+}
+
+func (e *Environment) MemoryLimit() uint64 {
+	return e.usage.memoryLimit
+}
+
+// Counts a newly created object against the memory limit. Reports false
+// once the limit has been exceeded.
+func (e *Environment) Allocate(obj Object) bool {
+	if e.usage.memoryLimit == 0 {
+		return true
+	}
+	e.usage.allocated += SizeOf(obj)
+	return e.usage.allocated <= e.usage.memoryLimit
+}
+
+// Limits how deeply the calls made by code evaluated in this environment
+// may nest, which bounds how much of the Go stack the evaluator uses. Like
+// the step limit, it is shared with the environments enclosing this one and
+// enclosed by it. A limit of 0 leaves the evaluator's default.
+func (e *Environment) SetMaxCallDepth(depth int) {
+	e.usage.maxCallDepth = depth
+}
+
+func (e *Environment) MaxCallDepth() int {
+	return e.usage.maxCallDepth
+}
+
+// Counts a call entered by the code being evaluated, returning how deeply
+// it is nested. Every call entered has to be left with LeaveCall.
+func (e *Environment) EnterCall() int {
+	e.usage.callDepth++
+	return e.usage.callDepth
+}
+
+func (e *Environment) LeaveCall() {
+	e.usage.callDepth--
+}
+
+// Makes integer arithmetic in code evaluated in this environment fail with
+// an error when its result overflows an int64, rather than wrap around. Like
+// the limits, the setting is shared with the environments enclosing this one
+// and enclosed by it. It is off by default.
+func (e *Environment) SetCheckedArithmetic(enabled bool) {
+	e.usage.checkedArithmetic = enabled
+}
+
+func (e *Environment) CheckedArithmetic() bool {
+	return e.usage.checkedArithmetic
+}
+
+// Makes the evaluator let panics through, rather than turn them into
+// errors, so that they can be debugged with the Go stack where they
+// happened. The setting is shared like SetCheckedArithmetic's. It is off by
+// default.
+func (e *Environment) SetStrict(enabled bool) {
+	e.usage.strict = enabled
+}
+
+func (e *Environment) Strict() bool {
+	return e.usage.strict
+}
+
+// Denies a capability to builtins called in this environment and every
+// environment enclosed by it.
+func (e *Environment) Deny(c Capability) {
+	if e.denied == nil {
+		e.denied = make(map[Capability]bool)
+	}
+	e.denied[c] = true
+}
+
+func (e *Environment) Allows(c Capability) bool {
+	if e.denied[c] {
+		return false
+	}
+	if e.outer != nil {
+		return e.outer.Allows(c)
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package object
+
+// Reports whether two values are equal as `==` sees them: numbers by value,
+// whatever their type, strings by their contents, arrays element by element,
+// hashes by their keys and the values they map them to, and anything else
+// only if it is the same object.
+func Equals(a, b Object) bool {
+	return equals(a, b, nil)
+}
+
+// Arrays and hashes built in Go may contain themselves. Pairs of them
+// already being compared further up are taken to be equal, so that comparing
+// them ends.
+func equals(a, b Object, comparing map[[2]Object]bool) bool {
+	switch a := a.(type) {
+	case *Integer:
+		switch b := b.(type) {
+		case *Integer:
+			return a.Value == b.Value
+		case *Float:
+			return float64(a.Value) == b.Value
+		}
+	case *Float:
+		switch b := b.(type) {
+		case *Integer:
+			return a.Value == float64(b.Value)
+		case *Float:
+			return a.Value == b.Value
+		}
+	case *String:
+		if b, ok := b.(*String); ok {
+			return a.Value == b.Value
+		}
+	case *Boolean:
+		if b, ok := b.(*Boolean); ok {
+			return a.Value == b.Value
+		}
+	case *Array:
+		if b, ok := b.(*Array); ok {
+			return arraysEqual(a, b, comparing)
+		}
+	case *Hash:
+		if b, ok := b.(*Hash); ok {
+			return hashesEqual(a, b, comparing)
+		}
+	default:
+		return a == b
+	}
+	return false
+}
+
+func arraysEqual(a, b *Array, comparing map[[2]Object]bool) bool {
+	if len(a.Elements) != len(b.Elements) {
+		return false
+	}
+	if a == b {
+		return true
+	}
+
+	pair := [2]Object{a, b}
+	if comparing == nil {
+		comparing = map[[2]Object]bool{}
+	}
+	if comparing[pair] {
+		return true
+	}
+	comparing[pair] = true
+	defer delete(comparing, pair)
+
+	for i := range a.Elements {
+		if !equals(a.Elements[i], b.Elements[i], comparing) {
+			return false
+		}
+	}
+	return true
+}
+
+func hashesEqual(a, b *Hash, comparing map[[2]Object]bool) bool {
+	if len(a.Pairs) != len(b.Pairs) {
+		return false
+	}
+	if a == b {
+		return true
+	}
+
+	pair := [2]Object{a, b}
+	if comparing == nil {
+		comparing = map[[2]Object]bool{}
+	}
+	if comparing[pair] {
+		return true
+	}
+	comparing[pair] = true
+	defer delete(comparing, pair)
+
+	for key, aPair := range a.Pairs {
+		bPair, ok := b.Pairs[key]
+		if !ok || !equals(aPair.Value, bPair.Value, comparing) {
+			return false
+		}
+	}
+	return true
+}
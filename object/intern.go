@@ -0,0 +1,42 @@
+package object
+
+// Hands out a single String for each distinct value, so that equal interned
+// strings are the same object and share their storage. Interned strings
+// also carry their hash, which makes them cheap to use as hash keys.
+type InternTable struct {
+	strings map[string]*String
+}
+
+func NewInternTable() *InternTable {
+	return &InternTable{strings: map[string]*String{}}
+}
+
+// Returns the interned String holding value, creating it on first use.
+func (t *InternTable) Intern(value string) *String {
+	if s, ok := t.strings[value]; ok {
+		return s
+	}
+
+	s := &String{Value: value, interned: true, hash: hashString(value)}
+	t.strings[value] = s
+	return s
+}
+
+// Like Intern, but if no string with the value of s has been interned yet
+// and s was interned by another table, s itself becomes the interned one.
+func (t *InternTable) Add(s *String) *String {
+	if !s.interned {
+		return t.Intern(s.Value)
+	}
+	if interned, ok := t.strings[s.Value]; ok {
+		return interned
+	}
+
+	t.strings[s.Value] = s
+	return s
+}
+
+// Returns the number of distinct strings interned.
+func (t *InternTable) Len() int {
+	return len(t.strings)
+}
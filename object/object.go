@@ -1,18 +1,26 @@
 package object
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
-	"hash/fnv"
+	"hash/maphash"
+	"io"
+	"math"
 	"monkey/ast"
 	"monkey/code"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type ObjectType string
 
 const (
 	INTEGER_OBJ           = "INTEGER"
+	FLOAT_OBJ             = "FLOAT"
 	STRING_OBJ            = "STRING"
 	BOOLEAN_OBJ           = "BOOLEAN"
 	ARRAY_OBJ             = "ARRAY"
@@ -24,6 +32,12 @@ const (
 	ERROR_OBJ             = "ERROR"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
 	CLOSURE_OBJ           = "CLOSURE"
+	CELL_OBJ              = "CELL"
+	EXIT_OBJ              = "EXIT"
+	BUDGET_EXCEEDED_OBJ   = "BUDGET_EXCEEDED"
+	THROWN_OBJ            = "THROWN"
+	QUOTE_OBJ             = "QUOTE"
+	MACRO_OBJ             = "MACRO"
 )
 
 type Object interface {
@@ -35,9 +49,13 @@ type Hashable interface {
 	HashKey() HashKey
 }
 
+// Two HashKeys are only equal if the objects they were created from are equal.
+// Strings keep their original value alongside the hash, so strings with
+// colliding hashes still map to different entries in a Hash.
 type HashKey struct {
 	Type  ObjectType
 	Value uint64
+	str   string
 }
 
 func (b *Boolean) HashKey() HashKey {
@@ -57,9 +75,18 @@ func (i *Integer) HashKey() HashKey {
 }
 
 func (s *String) HashKey() HashKey {
-	h := fnv.New64a()
-	h.Write([]byte(s.Value))
-	return HashKey{Type: s.Type(), Value: h.Sum64()}
+	if s.interned {
+		return HashKey{Type: s.Type(), Value: s.hash, str: s.Value}
+	}
+	return HashKey{Type: s.Type(), Value: hashString(s.Value), str: s.Value}
+}
+
+// Seed for string hashes. Hash keys are never persisted, so it only has to
+// stay the same for the lifetime of the process.
+var hashSeed = maphash.MakeSeed()
+
+func hashString(s string) uint64 {
+	return maphash.String(hashSeed, s)
 }
 
 type HashPair struct {
@@ -67,16 +94,50 @@ type HashPair struct {
 	Value Object
 }
 
+// Orders keys by type, then by value, so that hashes can be enumerated
+// deterministically.
+func (k HashKey) less(other HashKey) bool {
+	if k.Type != other.Type {
+		return k.Type < other.Type
+	}
+
+	switch k.Type {
+	case INTEGER_OBJ:
+		return int64(k.Value) < int64(other.Value)
+	case STRING_OBJ:
+		return k.str < other.str
+	default:
+		return k.Value < other.Value
+	}
+}
+
 type Hash struct {
 	Pairs map[HashKey]HashPair
 }
 
+// Returns the pairs of the hash ordered by key: booleans first, then
+// integers, then strings.
+func (h *Hash) SortedPairs() []HashPair {
+	keys := make([]HashKey, 0, len(h.Pairs))
+	for key := range h.Pairs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+
+	pairs := make([]HashPair, len(keys))
+	for i, key := range keys {
+		pairs[i] = h.Pairs[key]
+	}
+
+	return pairs
+}
+
 func (h *Hash) Type() ObjectType { return HASH_OBJ }
 func (h *Hash) Inspect() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for _, pair := range h.Pairs {
+	for _, pair := range h.SortedPairs() {
 		pairs = append(
 			pairs,
 			fmt.Sprintf("%s: %s", pair.Key.Inspect(), pair.Value.Inspect()),
@@ -97,13 +158,94 @@ type Integer struct {
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 
+// Integers in this range are allocated once and shared, like TRUE and FALSE,
+// since arithmetic produces them far more often than others.
+const (
+	smallIntMin = -128
+	smallIntMax = 255
+)
+
+var smallInts = func() []Integer {
+	ints := make([]Integer, smallIntMax-smallIntMin+1)
+	for i := range ints {
+		ints[i].Value = int64(i + smallIntMin)
+	}
+	return ints
+}()
+
+// Returns an Integer holding value, which is shared with other callers if
+// value is small. Integers must therefore never be modified.
+func NewInteger(value int64) *Integer {
+	if value >= smallIntMin && value <= smallIntMax {
+		return &smallInts[value-smallIntMin]
+	}
+	return &Integer{Value: value}
+}
+
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+func (f *Float) Inspect() string {
+	str := strconv.FormatFloat(f.Value, 'f', -1, 64)
+	if math.IsInf(f.Value, 0) || math.IsNaN(f.Value) || strings.Contains(str, ".") {
+		return str
+	}
+	// Keep a trailing ".0" so whole floats can be told apart from integers.
+	return str + ".0"
+}
+
 type String struct {
 	Value string
+
+	// Set for strings handed out by an InternTable, which hashes them once.
+	interned bool
+	hash     uint64
 }
 
 func (s *String) Type() ObjectType { return STRING_OBJ }
 func (s *String) Inspect() string  { return s.Value }
 
+// Returns the number of characters in the string. Strings are indexed,
+// sliced and measured by character, i.e. Unicode code point, rather than by
+// byte, so that e.g. "é" has length 1.
+func (s *String) Len() int {
+	return utf8.RuneCountInString(s.Value)
+}
+
+// Returns the character at index i, or false if there is none.
+func (s *String) At(i int64) (string, bool) {
+	if i < 0 {
+		return "", false
+	}
+	for _, ch := range s.Value {
+		if i == 0 {
+			return string(ch), true
+		}
+		i--
+	}
+	return "", false
+}
+
+// Returns the characters from index from up to, but not including, index
+// to, where 0 <= from <= to <= s.Len().
+func (s *String) Slice(from, to int64) string {
+	start, end := len(s.Value), len(s.Value)
+	var i int64
+	for offset := range s.Value {
+		if i == from {
+			start = offset
+		}
+		if i == to {
+			end = offset
+			break
+		}
+		i++
+	}
+	return s.Value[start:end]
+}
+
 type Boolean struct {
 	Value bool
 }
@@ -136,6 +278,20 @@ type NULL struct{}
 func (n *NULL) Type() ObjectType { return NULL_OBJ }
 func (n *NULL) Inspect() string  { return "null" }
 
+// Reports whether obj counts as true in a condition: everything but false
+// and null does. A nil obj, like a global that hasn't been set yet, counts
+// as null.
+func IsTruthy(obj Object) bool {
+	switch obj := obj.(type) {
+	case *Boolean:
+		return obj.Value
+	case *NULL, nil:
+		return false
+	default:
+		return true
+	}
+}
+
 type ReturnValue struct {
 	Value Object
 }
@@ -145,8 +301,11 @@ func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
 type Function struct {
 	Parameters []*ast.Identifier
+	Defaults   []ast.Expression // Default values of the last len(Defaults) parameters.
+	Rest       *ast.Identifier  // Collects the arguments after the parameters, if set.
 	Body       *ast.BlockStatement
 	Env        *Environment
+	Name       string // Name of the binding the function was defined with, if any.
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
@@ -154,8 +313,16 @@ func (f *Function) Inspect() string {
 	var out bytes.Buffer
 
 	params := []string{}
-	for _, p := range f.Parameters {
-		params = append(params, p.String())
+	firstDefault := len(f.Parameters) - len(f.Defaults)
+	for i, p := range f.Parameters {
+		if i >= firstDefault {
+			params = append(params, p.String()+" = "+f.Defaults[i-firstDefault].String())
+		} else {
+			params = append(params, p.String())
+		}
+	}
+	if f.Rest != nil {
+		params = append(params, "..."+f.Rest.String())
 	}
 
 	out.WriteString("fn")
@@ -168,38 +335,302 @@ func (f *Function) Inspect() string {
 	return out.String()
 }
 
-type BuiltinFunction func(args ...Object) Object
+// A piece of code as data, made by `quote`. Macros return them, to be
+// expanded in place of their calls.
+type Quote struct {
+	Node ast.Node
+}
+
+func (q *Quote) Type() ObjectType { return QUOTE_OBJ }
+func (q *Quote) Inspect() string  { return "QUOTE(" + q.Node.String() + ")" }
+
+type Macro struct {
+	Parameters []*ast.Identifier
+	Body       *ast.BlockStatement
+	Env        *Environment
+}
+
+func (m *Macro) Type() ObjectType { return MACRO_OBJ }
+func (m *Macro) Inspect() string {
+	var out bytes.Buffer
+
+	params := []string{}
+	for _, p := range m.Parameters {
+		params = append(params, p.String())
+	}
+
+	out.WriteString("macro")
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") {\n")
+	out.WriteString(m.Body.String())
+	out.WriteString("\n}")
+
+	return out.String()
+}
+
+// The engine a builtin is called from, giving the builtin access to the
+// engine's I/O and a way to call back into Monkey functions.
+type Runtime interface {
+	Stdout() io.Writer
+	Stdin() *bufio.Reader
+	// Calls a function value, returning its result or an *Error.
+	Call(fn Object, args ...Object) Object
+	// Reports whether the host lets builtins use a capability.
+	Allows(c Capability) bool
+	// The context of the running program. Builtins that block, like
+	// `sleep`, give up once it is done.
+	Context() context.Context
+}
+
+// A group of builtins that reach outside of the interpreter. Hosts can deny
+// capabilities to the scripts they run; all of them are allowed by default.
+type Capability string
+
+const (
+	FileSystemCapability  Capability = "filesystem"
+	TimeCapability        Capability = "time"
+	EnvironmentCapability Capability = "environment"
+	// No builtin of the language uses the network, but builtins registered
+	// by hosts can require it.
+	NetworkCapability Capability = "network"
+)
+
+// Every capability, for hosts that deny them all.
+var Capabilities = []Capability{
+	FileSystemCapability,
+	TimeCapability,
+	EnvironmentCapability,
+	NetworkCapability,
+}
+
+type BuiltinFunction func(rt Runtime, args ...Object) Object
 type Builtin struct {
 	Fn BuiltinFunction
+	// How many arguments it takes, which the compiler checks calls of it
+	// against, or nil if that isn't known, as for the builtins registered
+	// by host programs.
+	Arity *Arity
 }
 
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
 func (b *Builtin) Inspect() string  { return "builtin function" }
 
+// A function call that was active when an error was produced.
+type StackFrame struct {
+	Function string // "<anonymous>" if the function has no name
+	Line     int    // position of the call; 0 if unknown
+	Column   int
+}
+
+func (sf StackFrame) String() string {
+	if sf.Line == 0 {
+		return "at " + sf.Function
+	}
+	return fmt.Sprintf("at %s (%d:%d)", sf.Function, sf.Line, sf.Column)
+}
+
 type Error struct {
 	Message string
+	Stack   []StackFrame // innermost call first
+	Line    int          // where the error happened; 0 if unknown
+	Column  int
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
-func (e *Error) Inspect() string  { return "Error: " + e.Message }
+func (e *Error) Inspect() string {
+	var out bytes.Buffer
+
+	out.WriteString("Error: " + e.Message)
+	// A call made again and again from the same place, as by deep
+	// recursion, is shown once, with how many more times it was made.
+	for i := 0; i < len(e.Stack); {
+		frame := e.Stack[i]
+		out.WriteString("\n\t" + frame.String())
+
+		repeats := 0
+		for i++; i < len(e.Stack) && e.Stack[i] == frame; i++ {
+			repeats++
+		}
+		switch {
+		case repeats == 1:
+			out.WriteString("\n\t" + frame.String())
+		case repeats > 1:
+			fmt.Fprintf(&out, "\n\t... %d more frames of %s", repeats, frame.Function)
+		}
+	}
+
+	return out.String()
+}
+
+// Produced by the `exit` builtin. Like an error, it stops the program, but it
+// is handed back to the host instead of being reported. The VM returns it
+// from Run as an error.
+type Exit struct {
+	Code int64
+}
+
+func (e *Exit) Type() ObjectType { return EXIT_OBJ }
+func (e *Exit) Inspect() string  { return fmt.Sprintf("exit(%d)", e.Code) }
+func (e *Exit) Error() string    { return fmt.Sprintf("exit status %d", e.Code) }
+
+// A value thrown by `throw`, on its way to the try expression that catches
+// it. Like an error, it stops everything it passes through, and one that
+// isn't caught fails the program. The VM carries it as an error.
+type Thrown struct {
+	Value Object
+}
+
+func (t *Thrown) Type() ObjectType { return THROWN_OBJ }
+func (t *Thrown) Inspect() string  { return "Error: " + t.Error() }
+func (t *Thrown) Error() string    { return "uncaught exception: " + t.Value.Inspect() }
+
+// A limit the host puts on the resources a program may use.
+type Budget string
+
+const (
+	// Steps taken: instructions on the VM, or nodes evaluated by the
+	// evaluator.
+	StepBudget Budget = "steps"
+	// Bytes allocated for arrays, strings and hashes, as estimated by
+	// SizeOf. Memory the garbage collector reclaims still counts.
+	MemoryBudget Budget = "memory"
+)
+
+// Produced when a program uses more of a resource than the host allows. Like
+// an exit, it stops the program and is handed back to the host. The VM
+// returns it from Run as an error.
+type BudgetExceeded struct {
+	Budget Budget
+	Limit  uint64
+}
+
+func (b *BudgetExceeded) Type() ObjectType { return BUDGET_EXCEEDED_OBJ }
+func (b *BudgetExceeded) Inspect() string  { return "Error: " + b.Error() }
+func (b *BudgetExceeded) Error() string {
+	if b.Budget == MemoryBudget {
+		return fmt.Sprintf("memory budget of %d bytes exceeded", b.Limit)
+	}
+	return fmt.Sprintf("execution budget of %d steps exceeded", b.Limit)
+}
+
+// Rough sizes, in bytes, of an element of an array and a pair of a hash.
+const (
+	arrayElementSize = 16
+	hashPairSize     = 80
+)
+
+// Estimates how many bytes an array, string or hash takes, not counting the
+// objects it holds. Other objects are small, and are counted as taking none.
+func SizeOf(obj Object) uint64 {
+	switch obj := obj.(type) {
+	case *String:
+		return uint64(len(obj.Value))
+	case *Array:
+		return arrayElementSize * uint64(len(obj.Elements))
+	case *Hash:
+		return hashPairSize * uint64(len(obj.Pairs))
+	default:
+		return 0
+	}
+}
+
+// How many arguments a function takes: from Min to Max, or any number from
+// Min if Max is negative, as for a function with a rest parameter.
+type Arity struct {
+	Min int
+	Max int
+}
+
+// Reports whether a function with the arity can be called with n arguments.
+func (a Arity) Allows(n int) bool {
+	return n >= a.Min && (a.Max < 0 || n <= a.Max)
+}
+
+func (a Arity) String() string {
+	return DescribeArity(a.Min, a.Max)
+}
+
+// Describes how many arguments a function wants, given the fewest and the
+// most it takes, for errors about calls with the wrong number. A function
+// with a rest parameter has no most, which max is negative for.
+func DescribeArity(min, max int) string {
+	if max < 0 {
+		return fmt.Sprintf("at least %d", min)
+	}
+
+	switch max - min {
+	case 0:
+		return fmt.Sprintf("%d", min)
+	case 1:
+		return fmt.Sprintf("%d or %d", min, max)
+	default:
+		return fmt.Sprintf("%d to %d", min, max)
+	}
+}
+
+// Returns `name`, or "<anonymous>" if it is empty.
+func FunctionName(name string) string {
+	if name == "" {
+		return "<anonymous>"
+	}
+	return name
+}
 
 type CompiledFunction struct {
 	Instructions  code.Instructions
+	SourceMap     code.SourceMap // Where in the source the instructions come from.
 	NumParameters int
-	NumLocals     int // How many local bindings the function will create.
+	NumDefaults   int    // How many of the last parameters have default values.
+	Variadic      bool   // Whether a local after the parameters collects the other arguments.
+	NumLocals     int    // How many local bindings the function will create.
+	Name          string // Name of the binding the function was defined with, if any.
+
+	// The function's source, when compiled from an AST rather than
+	// deserialized.
+	Literal *ast.FunctionLiteral
+	// Also only known when compiled from an AST: the names of the locals
+	// and of the free variables, by index, for debuggers, and the key of
+	// the module the function was compiled in, or "" for the program.
+	LocalNames []string
+	FreeNames  []string
+	Module     string
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
 func (cf *CompiledFunction) Inspect() string {
-	return fmt.Sprintf("CompiledFunction[%p]", cf)
+	return fmt.Sprintf("CompiledFunction[%s]", cf.describe())
+}
+
+// Returns the function's Inspect() header followed by its disassembled instructions.
+func (cf *CompiledFunction) Disassemble() string {
+	return cf.Inspect() + "\n" + cf.Instructions.String()
+}
+
+func (cf *CompiledFunction) describe() string {
+	return fmt.Sprintf("%s, params=%d, locals=%d",
+		FunctionName(cf.Name), cf.NumParameters, cf.NumLocals)
 }
 
 type Closure struct {
-	Fn   *CompiledFunction
+	Fn *CompiledFunction
+	// The variables the function captured: a *Cell for each variable, and
+	// the closure itself where the function refers to its own name.
 	Free []Object
 }
 
 func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
 func (c *Closure) Inspect() string {
-	return fmt.Sprintf("Closure[%p]", c)
+	return fmt.Sprintf("Closure[%s, free=%d]", c.Fn.describe(), len(c.Free))
 }
+
+// A local variable captured by a closure, which the closure shares with the
+// function that defined it and with any other closure that captured it, so
+// that each sees what the others assign to it. It takes the variable's place
+// among the locals once it is captured, and is never a value of the program.
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string  { return c.Value.Inspect() }
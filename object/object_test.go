@@ -1,6 +1,11 @@
 package object
 
 import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"monkey/code"
+	"reflect"
 	"testing"
 )
 
@@ -26,6 +31,126 @@ func TestStringHashKey(t *testing.T) {
 	}
 }
 
+func TestStringHashKeyCollisions(t *testing.T) {
+	// Simulate two strings whose hashes collide.
+	a := HashKey{Type: STRING_OBJ, Value: 42, str: "a"}
+	b := HashKey{Type: STRING_OBJ, Value: 42, str: "b"}
+
+	if a == b {
+		t.Fatalf("strings with colliding hashes have the same hash key: %#v", a)
+	}
+
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	hash.Pairs[a] = HashPair{Key: &String{Value: "a"}, Value: &Integer{Value: 1}}
+	hash.Pairs[b] = HashPair{Key: &String{Value: "b"}, Value: &Integer{Value: 2}}
+
+	if len(hash.Pairs) != 2 {
+		t.Fatalf("colliding keys overwrote each other. got=%d pairs", len(hash.Pairs))
+	}
+
+	if hash.Pairs[a].Value.(*Integer).Value != 1 {
+		t.Errorf("wrong value for key a. got=%s", hash.Pairs[a].Value.Inspect())
+	}
+	if hash.Pairs[b].Value.(*Integer).Value != 2 {
+		t.Errorf("wrong value for key b. got=%s", hash.Pairs[b].Value.Inspect())
+	}
+}
+
+func TestStringCharacters(t *testing.T) {
+	s := &String{Value: "héllo, 世界"}
+
+	if s.Len() != 9 {
+		t.Errorf("wrong length. want=9, got=%d", s.Len())
+	}
+
+	for i, want := range []string{"h", "é", "l", "l", "o", ",", " ", "世", "界"} {
+		if got, ok := s.At(int64(i)); !ok || got != want {
+			t.Errorf("wrong character at %d. want=%q, got=%q (%t)", i, want, got, ok)
+		}
+	}
+	for _, i := range []int64{-1, 9} {
+		if got, ok := s.At(i); ok {
+			t.Errorf("expected no character at %d, got %q", i, got)
+		}
+	}
+
+	tests := []struct {
+		from, to int64
+		want     string
+	}{
+		{0, 9, "héllo, 世界"},
+		{1, 2, "é"},
+		{7, 9, "世界"},
+		{3, 3, ""},
+		{9, 9, ""},
+	}
+	for _, tt := range tests {
+		if got := s.Slice(tt.from, tt.to); got != tt.want {
+			t.Errorf("wrong slice [%d:%d]. want=%q, got=%q", tt.from, tt.to, tt.want, got)
+		}
+	}
+}
+
+func TestEquals(t *testing.T) {
+	one := &Integer{Value: 1}
+	fn := &Builtin{}
+
+	tests := []struct {
+		a, b     Object
+		expected bool
+	}{
+		{one, &Integer{Value: 1}, true},
+		{one, &Float{Value: 1}, true},
+		{&Float{Value: 1.5}, one, false},
+		{&String{Value: "a"}, &String{Value: "a"}, true},
+		{&String{Value: "a"}, &String{Value: "b"}, false},
+		{TRUE, &Boolean{Value: true}, true},
+		{Null, Null, true},
+		{Null, FALSE, false},
+		{fn, fn, true},
+		{fn, &Builtin{}, false},
+		{&Array{Elements: []Object{one, &String{Value: "a"}}}, &Array{Elements: []Object{&Float{Value: 1}, &String{Value: "a"}}}, true},
+		{&Array{Elements: []Object{one}}, &Array{Elements: []Object{one, one}}, false},
+		{&Array{Elements: []Object{&Array{}}}, &Array{Elements: []Object{&Array{Elements: []Object{one}}}}, false},
+		{&Array{Elements: []Object{one}}, one, false},
+		{hashOf("a", one), hashOf("a", &Float{Value: 1}), true},
+		{hashOf("a", one), hashOf("b", one), false},
+		{hashOf("a", one), hashOf("a", TRUE), false},
+		{hashOf("a", one), &Hash{Pairs: map[HashKey]HashPair{}}, false},
+		{hashOf("a", &Array{Elements: []Object{hashOf("b", one)}}), hashOf("a", &Array{Elements: []Object{hashOf("b", one)}}), true},
+		{hashOf("a", one), &Array{}, false},
+	}
+
+	for _, tt := range tests {
+		if got := Equals(tt.a, tt.b); got != tt.expected {
+			t.Errorf("Equals(%s, %s) = %t, want %t", tt.a.Inspect(), tt.b.Inspect(), got, tt.expected)
+		}
+	}
+
+	// Comparing arrays that contain themselves ends.
+	a := &Array{}
+	a.Elements = []Object{one, a}
+	b := &Array{}
+	b.Elements = []Object{one, b}
+	if !Equals(a, b) {
+		t.Errorf("expected self-containing arrays to be equal")
+	}
+
+	h := hashOf("self", nil)
+	h.Pairs[(&String{Value: "self"}).HashKey()] = HashPair{Key: &String{Value: "self"}, Value: h}
+	g := hashOf("self", nil)
+	g.Pairs[(&String{Value: "self"}).HashKey()] = HashPair{Key: &String{Value: "self"}, Value: g}
+	if !Equals(h, g) {
+		t.Errorf("expected self-containing hashes to be equal")
+	}
+}
+
+// Returns a hash with a single string key.
+func hashOf(key string, value Object) *Hash {
+	k := &String{Value: key}
+	return &Hash{Pairs: map[HashKey]HashPair{k.HashKey(): {Key: k, Value: value}}}
+}
+
 func TestBooleanHashKey(t *testing.T) {
 	true1 := &Boolean{Value: true}
 	true2 := &Boolean{Value: true}
@@ -69,3 +194,468 @@ func TestIntegerHashKey(t *testing.T) {
 			one1.HashKey(), two1.HashKey())
 	}
 }
+
+func TestNewInteger(t *testing.T) {
+	for _, v := range []int64{-129, -128, 0, 1, 255, 256, 1 << 40} {
+		i := NewInteger(v)
+		if i.Value != v {
+			t.Errorf("wrong value. got=%d, want=%d", i.Value, v)
+		}
+
+		shared := v >= smallIntMin && v <= smallIntMax
+		if (NewInteger(v) == i) != shared {
+			t.Errorf("integer %d shared=%t, want=%t", v, !shared, shared)
+		}
+	}
+}
+
+func TestInternTable(t *testing.T) {
+	table := NewInternTable()
+
+	a := table.Intern("monkey")
+	if table.Intern("monkey") != a {
+		t.Errorf("interning the same value twice gave different strings")
+	}
+	if table.Intern("banana") == a {
+		t.Errorf("interning different values gave the same string")
+	}
+	if a.HashKey() != (&String{Value: "monkey"}).HashKey() {
+		t.Errorf("interned string has a different hash key")
+	}
+
+	other := NewInternTable()
+	if other.Add(a) != a {
+		t.Errorf("adding an interned string didn't keep it")
+	}
+	if other.Add(&String{Value: "monkey"}) != a {
+		t.Errorf("adding an equal string didn't return the interned one")
+	}
+	if table.Len() != 2 || other.Len() != 1 {
+		t.Errorf("wrong lengths. got=%d, %d", table.Len(), other.Len())
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{1.5, "1.5"},
+		{2, "2.0"},
+		{-0.25, "-0.25"},
+		{1e21, "1000000000000000000000.0"},
+	}
+
+	for _, test := range tests {
+		f := &Float{Value: test.value}
+		if f.Inspect() != test.expected {
+			t.Errorf("wrong Inspect(). want=%q, got=%q", test.expected, f.Inspect())
+		}
+	}
+}
+
+func TestCompiledFunctionInspect(t *testing.T) {
+	tests := []struct {
+		obj      Object
+		expected string
+	}{
+		{
+			&CompiledFunction{Name: "add", NumParameters: 2, NumLocals: 3},
+			"CompiledFunction[add, params=2, locals=3]",
+		},
+		{
+			&CompiledFunction{},
+			"CompiledFunction[<anonymous>, params=0, locals=0]",
+		},
+		{
+			&Closure{
+				Fn:   &CompiledFunction{Name: "counter", NumLocals: 1},
+				Free: []Object{&Integer{Value: 1}},
+			},
+			"Closure[counter, params=0, locals=1, free=1]",
+		},
+	}
+
+	for _, test := range tests {
+		if test.obj.Inspect() != test.expected {
+			t.Errorf("wrong Inspect(). want=%q, got=%q",
+				test.expected, test.obj.Inspect())
+		}
+	}
+}
+
+func TestCompiledFunctionDisassemble(t *testing.T) {
+	fn := &CompiledFunction{
+		Name:          "identity",
+		NumParameters: 1,
+		NumLocals:     1,
+		Instructions: append(
+			code.Make(code.OpGetLocal, 0),
+			code.Make(code.OpReturnValue)...,
+		),
+	}
+
+	expected := `CompiledFunction[identity, params=1, locals=1]
+0000 OpGetLocal 0
+0002 OpReturnValue
+`
+
+	if fn.Disassemble() != expected {
+		t.Errorf("wrong Disassemble().\nwant=%q\ngot=%q", expected, fn.Disassemble())
+	}
+}
+
+func BenchmarkStringHashKey(b *testing.B) {
+	str := &String{Value: "the quick brown fox jumps over the lazy dog"}
+	for i := 0; i < b.N; i++ {
+		str.HashKey()
+	}
+}
+
+// Baseline for BenchmarkStringHashKey: the previous hash/fnv based implementation.
+func BenchmarkStringHashKeyHashFNV(b *testing.B) {
+	str := &String{Value: "the quick brown fox jumps over the lazy dog"}
+	for i := 0; i < b.N; i++ {
+		h := fnv.New64a()
+		h.Write([]byte(str.Value))
+		_ = HashKey{Type: str.Type(), Value: h.Sum64()}
+	}
+}
+
+func BenchmarkHashLookup(b *testing.B) {
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	for _, k := range []string{"one", "two", "three", "four", "five"} {
+		key := &String{Value: k}
+		hash.Pairs[key.HashKey()] = HashPair{Key: key, Value: key}
+	}
+	lookup := &String{Value: "three"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = hash.Pairs[lookup.HashKey()]
+	}
+}
+
+func TestErrorInspect(t *testing.T) {
+	tests := []struct {
+		err      *Error
+		expected string
+	}{
+		{&Error{Message: "boom"}, "Error: boom"},
+		{
+			&Error{
+				Message: "boom",
+				Stack: []StackFrame{
+					{Function: "inner", Line: 2, Column: 10},
+					{Function: "<anonymous>", Line: 5, Column: 1},
+					{Function: "outer"},
+				},
+			},
+			"Error: boom\n\tat inner (2:10)\n\tat <anonymous> (5:1)\n\tat outer",
+		},
+		{
+			&Error{
+				Message: "stack overflow",
+				// A call repeated once is shown again, and more often is
+				// counted.
+				Stack: []StackFrame{
+					{Function: "f", Line: 1, Column: 20},
+					{Function: "f", Line: 1, Column: 20},
+					{Function: "g", Line: 2, Column: 5},
+					{Function: "g", Line: 2, Column: 5},
+					{Function: "g", Line: 2, Column: 5},
+					{Function: "g", Line: 2, Column: 5},
+					{Function: "f", Line: 3, Column: 1},
+				},
+			},
+			"Error: stack overflow\n\tat f (1:20)\n\tat f (1:20)\n\tat g (2:5)\n\t... 3 more frames of g\n\tat f (3:1)",
+		},
+	}
+
+	for _, test := range tests {
+		if test.err.Inspect() != test.expected {
+			t.Errorf("wrong Inspect(). want=%q, got=%q", test.expected, test.err.Inspect())
+		}
+	}
+}
+
+func TestHashSortedPairs(t *testing.T) {
+	pairs := map[HashKey]HashPair{}
+	for _, key := range []Hashable{
+		&String{Value: "b"},
+		&Integer{Value: 10},
+		&Boolean{Value: true},
+		&String{Value: "a"},
+		&Integer{Value: -3},
+		&Boolean{Value: false},
+	} {
+		pairs[key.HashKey()] = HashPair{Key: key.(Object), Value: &Integer{Value: 1}}
+	}
+
+	hash := &Hash{Pairs: pairs}
+
+	expected := []string{"false", "true", "-3", "10", "a", "b"}
+	sorted := hash.SortedPairs()
+	if len(sorted) != len(expected) {
+		t.Fatalf("wrong number of pairs. got=%d, want=%d", len(sorted), len(expected))
+	}
+	for i, pair := range sorted {
+		if pair.Key.Inspect() != expected[i] {
+			t.Errorf("pair %d has wrong key. got=%s, want=%s", i, pair.Key.Inspect(), expected[i])
+		}
+	}
+
+	if hash.Inspect() != "{false: 1, true: 1, -3: 1, 10: 1, a: 1, b: 1}" {
+		t.Errorf("hash.Inspect() wrong. got=%q", hash.Inspect())
+	}
+}
+
+func TestJSONStringifyCycle(t *testing.T) {
+	arr := &Array{}
+	key := &String{Value: "self"}
+	hash := &Hash{Pairs: map[HashKey]HashPair{
+		key.HashKey(): {Key: key, Value: arr},
+	}}
+	arr.Elements = []Object{&Integer{Value: 1}, hash}
+
+	stringify := GetBuiltinByName("jsonStringify")
+	result := stringify.Fn(nil, arr)
+
+	err, ok := result.(*Error)
+	if !ok {
+		t.Fatalf("result is not Error. got=%T (%+v)", result, result)
+	}
+	if err.Message != "`jsonStringify` cannot encode a cyclic structure" {
+		t.Errorf("wrong error message. got=%q", err.Message)
+	}
+}
+
+func TestFromGo(t *testing.T) {
+	fn := &Builtin{}
+	n := 5
+	shared := []int{1}
+
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int8(-3), "-3"},
+		{uint16(7), "7"},
+		{2.5, "2.5"},
+		{"monkey", "monkey"},
+		{[]int{1, 2}, "[1, 2]"},
+		{[2]string{"a", "b"}, "[a, b]"},
+		{[]interface{}{1, "a", nil, []bool{true}}, "[1, a, null, [true]]"},
+		{map[string]int{"b": 2, "a": 1}, "{a: 1, b: 2}"},
+		{map[interface{}]interface{}{1: "one", true: []int{}}, "{true: [], 1: one}"},
+		{[]Object{&Integer{Value: 1}, fn}, "[1, builtin function]"},
+		{fn, "builtin function"},
+		{[]int(nil), "null"},
+		{(*int)(nil), "null"},
+		{&n, "5"},
+		{[]*int{&n, &n}, "[5, 5]"},
+		{[][]int{shared, shared}, "[[1], [1]]"},
+	}
+
+	for _, test := range tests {
+		obj, err := FromGo(test.input)
+		if err != nil {
+			t.Errorf("error converting %#v: %s", test.input, err)
+			continue
+		}
+		if obj.Inspect() != test.expected {
+			t.Errorf("wrong object for %#v. got=%s, want=%s", test.input, obj.Inspect(), test.expected)
+		}
+	}
+
+	errors := []struct {
+		input    interface{}
+		expected string
+	}{
+		{uint64(math.MaxUint64), "cannot convert 18446744073709551615 to an integer, it is too large"},
+		{map[float64]int{1.5: 1}, "cannot convert map[float64]int to a hash, its keys are FLOAT"},
+		{[]interface{}{1, struct{}{}}, "cannot convert struct {} to an object"},
+		{make(chan int), "cannot convert chan int to an object"},
+		{selfPointer(), "cannot convert *interface {}, it points to itself"},
+	}
+
+	for _, test := range errors {
+		_, err := FromGo(test.input)
+		if err == nil {
+			t.Errorf("no error converting %#v", test.input)
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Errorf("wrong error for %#v. got=%q, want=%q", test.input, err, test.expected)
+		}
+	}
+}
+
+func selfPointer() interface{} {
+	var v interface{}
+	v = &v
+	return v
+}
+
+func TestFromGoCycle(t *testing.T) {
+	s := []interface{}{"x", nil}
+	s[1] = s
+	m := map[string]interface{}{}
+	m["self"] = m
+
+	obj, err := FromGo(s)
+	if err != nil {
+		t.Fatalf("error converting slice: %s", err)
+	}
+	arr := obj.(*Array)
+	if arr.Elements[1] != arr {
+		t.Errorf("slice cycle was not preserved. got=%#v", arr.Elements[1])
+	}
+
+	obj, err = FromGo(m)
+	if err != nil {
+		t.Fatalf("error converting map: %s", err)
+	}
+	hash := obj.(*Hash)
+	key := &String{Value: "self"}
+	if hash.Pairs[key.HashKey()].Value != hash {
+		t.Errorf("map cycle was not preserved")
+	}
+}
+
+func TestToGo(t *testing.T) {
+	fn := &Builtin{}
+	key := &String{Value: "a"}
+
+	tests := []struct {
+		input    Object
+		expected interface{}
+	}{
+		{Null, nil},
+		{&Integer{Value: 5}, int64(5)},
+		{&Float{Value: 0.5}, 0.5},
+		{&String{Value: "monkey"}, "monkey"},
+		{TRUE, true},
+		{&Array{Elements: []Object{&Integer{Value: 1}, &Array{}}}, []interface{}{int64(1), []interface{}{}}},
+		{
+			&Hash{Pairs: map[HashKey]HashPair{key.HashKey(): {Key: key, Value: FALSE}}},
+			map[interface{}]interface{}{"a": false},
+		},
+		{fn, fn},
+	}
+
+	for _, test := range tests {
+		got := ToGo(test.input)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("wrong value for %s. got=%#v, want=%#v", test.input.Inspect(), got, test.expected)
+		}
+
+		back, err := FromGo(got)
+		if err != nil {
+			t.Errorf("error converting %#v back: %s", got, err)
+			continue
+		}
+		if back.Inspect() != test.input.Inspect() {
+			t.Errorf("wrong round trip for %s. got=%s", test.input.Inspect(), back.Inspect())
+		}
+	}
+}
+
+func TestToGoCycle(t *testing.T) {
+	arr := &Array{}
+	arr.Elements = []Object{&String{Value: "x"}, arr}
+
+	got := ToGo(arr).([]interface{})
+	inner, ok := got[1].([]interface{})
+	if !ok || inner[0] != "x" {
+		t.Fatalf("wrong value. got=%#v", got[1])
+	}
+	if &inner[0] != &got[0] {
+		t.Errorf("cycle was not preserved")
+	}
+}
+
+func TestIntegerOverflows(t *testing.T) {
+	tests := []struct {
+		op          string
+		left, right int64
+		expected    bool
+	}{
+		{"+", math.MaxInt64, 1, true},
+		{"+", math.MaxInt64, 0, false},
+		{"+", math.MinInt64, -1, true},
+		{"+", math.MinInt64, math.MaxInt64, false},
+		{"-", math.MinInt64, 1, true},
+		{"-", 0, math.MinInt64, true},
+		{"-", -1, math.MinInt64, false},
+		{"*", math.MaxInt64/2 + 1, 2, true},
+		{"*", math.MinInt64, -1, true},
+		{"*", -1, math.MinInt64, true},
+		{"*", math.MinInt64, 1, false},
+		{"/", math.MinInt64, -1, true},
+		{"/", math.MinInt64, 1, false},
+		{"%", math.MinInt64, -1, false},
+		{"<", math.MaxInt64, math.MinInt64, false},
+	}
+
+	for _, test := range tests {
+		if got := IntegerOverflows(test.op, test.left, test.right); got != test.expected {
+			t.Errorf("IntegerOverflows(%q, %d, %d) = %t, want %t",
+				test.op, test.left, test.right, got, test.expected)
+		}
+	}
+
+	if !NegationOverflows(math.MinInt64) || NegationOverflows(math.MinInt64+1) {
+		t.Errorf("wrong NegationOverflows")
+	}
+}
+
+func TestIsTruthy(t *testing.T) {
+	tests := []struct {
+		obj      Object
+		expected bool
+	}{
+		{TRUE, true},
+		{FALSE, false},
+		{&Boolean{Value: false}, false},
+		{Null, false},
+		{nil, false},
+		{NewInteger(0), true},
+		{&String{Value: ""}, true},
+		{&Array{}, true},
+	}
+
+	for _, test := range tests {
+		if got := IsTruthy(test.obj); got != test.expected {
+			t.Errorf("IsTruthy(%v) wrong. want=%t, got=%t", test.obj, test.expected, got)
+		}
+	}
+}
+
+func TestRegisterBuiltinLimit(t *testing.T) {
+	builtins := Builtins
+	defer func() {
+		for _, def := range Builtins[len(builtins):] {
+			delete(builtinsByName, def.Name)
+		}
+		Builtins = builtins
+	}()
+
+	fn := func(rt Runtime, args ...Object) Object { return Null }
+	for i := len(Builtins); i < MaxBuiltins; i++ {
+		if err := RegisterBuiltin(fmt.Sprintf("host%d", i), fn); err != nil {
+			t.Fatalf("error registering builtin %d: %s", i, err)
+		}
+	}
+
+	err := RegisterBuiltin("oneTooMany", fn)
+	expected := "cannot register builtin oneTooMany: there can be at most 256 builtins"
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%v", expected, err)
+	}
+	if GetBuiltinByName("oneTooMany") != nil {
+		t.Errorf("builtin was registered")
+	}
+}
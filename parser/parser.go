@@ -1,48 +1,83 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"monkey/ast"
 	"monkey/lexer"
 	"monkey/token"
+	"path"
 	"strconv"
+	"strings"
 )
 
 const TRACE_MODE = false
 
+// How deeply expressions may nest unless SetMaxDepth says otherwise. Deeper
+// input is almost certainly generated or malicious, and would only exhaust
+// the stack of the parser, or of the engine running the program.
+const DefaultMaxDepth = 1000
+
 const (
 	_ int = iota
 	LOWEST
+	ASSIGN      // =
+	CONDITIONAL // X ? Y : Z
+	LOGICAL_OR  // ||
+	LOGICAL_AND // &&
 	EQUALS      // ==
-	LESSGREATER // > or <
+	LESSGREATER // >, <, >= or <=
+	BIT_OR      // |
+	BIT_XOR     // ^
+	BIT_AND     // &
+	SHIFT       // << or >>
 	SUM         // +
-	PRODUCT     // *
+	PRODUCT     // *, / or %
 	PREFIX      // -X or !X
+	POWER       // **, which binds tighter than a prefix operator on its left
 	CALL        // myFunction(X)
 	INDEX       // array[index]
 )
 
 type Parser struct {
 	l         *lexer.Lexer
-	errors    []string
+	errors    []*ParseError
 	curToken  token.Token
 	peekToken token.Token
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
+
+	depth    int // Of the expression being parsed.
+	maxDepth int // 0 if there is no limit.
+	tooDeep  bool
 }
 
 var precedences = map[token.TokenType]int{
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LPAREN:   CALL,
-	token.LBRACKET: INDEX,
+	token.ASSIGN:      ASSIGN,
+	token.QUESTION:    CONDITIONAL,
+	token.OR:          LOGICAL_OR,
+	token.AND:         LOGICAL_AND,
+	token.EQ:          EQUALS,
+	token.NOT_EQ:      EQUALS,
+	token.LT:          LESSGREATER,
+	token.GT:          LESSGREATER,
+	token.LT_EQ:       LESSGREATER,
+	token.GT_EQ:       LESSGREATER,
+	token.BIT_OR:      BIT_OR,
+	token.BIT_XOR:     BIT_XOR,
+	token.BIT_AND:     BIT_AND,
+	token.SHIFT_LEFT:  SHIFT,
+	token.SHIFT_RIGHT: SHIFT,
+	token.PLUS:        SUM,
+	token.MINUS:       SUM,
+	token.SLASH:       PRODUCT,
+	token.ASTERISK:    PRODUCT,
+	token.PERCENT:     PRODUCT,
+	token.POWER:       POWER,
+	token.LPAREN:      CALL,
+	token.LBRACKET:    INDEX,
+	token.DOT:         INDEX,
 }
 
 func (p *Parser) curPrecedence() int {
@@ -102,8 +137,9 @@ func (p *Parser) expectPeek(t token.TokenType) bool {
 
 func New(l *lexer.Lexer) *Parser {
 	p := &Parser{
-		l:      l,
-		errors: []string{},
+		l:        l,
+		errors:   []*ParseError{},
+		maxDepth: DefaultMaxDepth,
 	}
 
 	// Read two tokens, so curToken and peekToken are both set
@@ -113,45 +149,87 @@ func New(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefixFn(token.IDENT, p.parseIdentifier)
 	p.registerPrefixFn(token.INT, p.parseIntegerLiteral)
+	p.registerPrefixFn(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefixFn(token.STRING, p.parseStringLiteral)
+	p.registerPrefixFn(token.RAW_STRING, p.parseStringLiteral)
 	p.registerPrefixFn(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefixFn(token.LBRACE, p.parseHashLiteral)
 	p.registerPrefixFn(token.BANG, p.parsePrefixExpression)
 	p.registerPrefixFn(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefixFn(token.TRUE, p.parseBoolean)
 	p.registerPrefixFn(token.FALSE, p.parseBoolean)
+	p.registerPrefixFn(token.NULL, p.parseNull)
 	p.registerPrefixFn(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefixFn(token.IF, p.parseIfExpression)
+	p.registerPrefixFn(token.WHILE, p.parseWhileExpression)
+	p.registerPrefixFn(token.TRY, p.parseTryExpression)
 	p.registerPrefixFn(token.FUNCTION, p.parseFunctionLiteral)
+	p.registerPrefixFn(token.MACRO, p.parseMacroLiteral)
+	p.registerPrefixFn(token.ERROR, p.parseErrorToken)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfixFn(token.PLUS, p.parseInfixExpression)
 	p.registerInfixFn(token.MINUS, p.parseInfixExpression)
 	p.registerInfixFn(token.SLASH, p.parseInfixExpression)
 	p.registerInfixFn(token.ASTERISK, p.parseInfixExpression)
+	p.registerInfixFn(token.PERCENT, p.parseInfixExpression)
+	p.registerInfixFn(token.POWER, p.parseInfixExpression)
+	p.registerInfixFn(token.QUESTION, p.parseConditionalExpression)
+	p.registerInfixFn(token.BIT_AND, p.parseInfixExpression)
+	p.registerInfixFn(token.BIT_OR, p.parseInfixExpression)
+	p.registerInfixFn(token.BIT_XOR, p.parseInfixExpression)
+	p.registerInfixFn(token.SHIFT_LEFT, p.parseInfixExpression)
+	p.registerInfixFn(token.SHIFT_RIGHT, p.parseInfixExpression)
 	p.registerInfixFn(token.EQ, p.parseInfixExpression)
 	p.registerInfixFn(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfixFn(token.LT, p.parseInfixExpression)
 	p.registerInfixFn(token.GT, p.parseInfixExpression)
+	p.registerInfixFn(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfixFn(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfixFn(token.AND, p.parseInfixExpression)
+	p.registerInfixFn(token.OR, p.parseInfixExpression)
+	p.registerInfixFn(token.ASSIGN, p.parseAssignExpression)
 	p.registerInfixFn(token.LPAREN, p.parseCallExpression)
 	p.registerInfixFn(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfixFn(token.DOT, p.parseMemberExpression)
 
 	return p
 }
 
-func (p *Parser) Errors() []string {
+// Limits how deeply expressions may nest, counting every expression within
+// another, such as the operand of a prefix operator, a parenthesized
+// expression or an expression in a function body. Deeper input is a parse
+// error. A limit of 0 removes it.
+func (p *Parser) SetMaxDepth(depth int) {
+	p.maxDepth = depth
+}
+
+func (p *Parser) Errors() []*ParseError {
 	return p.errors
 }
 
+// Adds a parser error located at the given token. Once the input has been
+// found to nest too deeply, the rest of it is skipped, and the errors that
+// causes aren't reported.
+func (p *Parser) addError(tok token.Token, format string, a ...interface{}) {
+	if p.tooDeep {
+		return
+	}
+	p.errors = append(p.errors, &ParseError{
+		Line:    tok.Line,
+		Column:  tok.Column,
+		Message: fmt.Sprintf(format, a...),
+		Source:  p.l.SourceLine(tok.Line),
+	})
+}
+
 func (p *Parser) addPeekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead",
+	p.addError(p.peekToken, "expected next token to be %s, got %s instead",
 		t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
 }
 
 func (p *Parser) addNoPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	p.addError(p.curToken, "no prefix parse function for %s found", t)
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
@@ -166,16 +244,27 @@ func (p *Parser) ParseProgram() *ast.Program {
 		}
 		p.nextToken()
 	}
+	program.BlankLines = p.l.BlankLines()
+	for _, tok := range p.l.Comments() {
+		program.Comments = append(program.Comments, &ast.Comment{Token: tok})
+	}
 
 	return program
 }
 
 func (p *Parser) parseStatement() ast.Statement {
 	switch p.curToken.Type {
-	case token.LET:
+	case token.LET, token.CONST:
+		if p.peekTokenIs(token.LBRACKET) || p.peekTokenIs(token.LBRACE) {
+			return p.parseDestructuringLetStatement()
+		}
 		return p.parseLetStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.IMPORT:
+		return p.parseImportStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
@@ -190,6 +279,71 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 
 	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		if stmt.Annotation = p.parseTypeAnnotation(); stmt.Annotation == nil {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(token.ASSIGN) {
+		return nil
+	}
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		fl.Name = stmt.Name.Value
+	}
+
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseDestructuringLetStatement() *ast.DestructuringLetStatement {
+	stmt := &ast.DestructuringLetStatement{Token: p.curToken}
+
+	p.nextToken()
+	var closing token.TokenType = token.RBRACKET
+	if p.curTokenIs(token.LBRACE) {
+		stmt.Hash = true
+		closing = token.RBRACE
+	}
+
+	seen := map[string]bool{}
+	for !p.peekTokenIs(closing) {
+		if stmt.Hash {
+			p.nextToken()
+			stmt.Keys = append(stmt.Keys, p.parseExpression(LOWEST))
+
+			if !p.expectPeek(token.COLON) {
+				return nil
+			}
+		}
+
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+
+		name := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		if seen[name.Value] {
+			p.addError(p.curToken, "%s is bound more than once", name.Value)
+			return nil
+		}
+		seen[name.Value] = true
+		stmt.Names = append(stmt.Names, name)
+
+		if !p.peekTokenIs(closing) && !p.expectPeek(token.COMMA) {
+			return nil
+		}
+	}
+	p.nextToken()
+
 	if !p.expectPeek(token.ASSIGN) {
 		return nil
 	}
@@ -205,6 +359,42 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	return stmt
 }
 
+func (p *Parser) parseImportStatement() *ast.ImportStatement {
+	stmt := &ast.ImportStatement{Token: p.curToken}
+
+	if p.peekTokenIs(token.RAW_STRING) {
+		p.nextToken()
+	} else if !p.expectPeek(token.STRING) {
+		return nil
+	}
+	stmt.Path = p.curToken.Literal
+
+	// `as` is only special here, so it isn't a keyword.
+	if p.peekTokenIs(token.IDENT) && p.peekToken.Literal == "as" {
+		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	} else {
+		name := strings.TrimSuffix(path.Base(stmt.Path), ".monkey")
+		if tok := lexer.New(name).NextToken(); tok.Type != token.IDENT || tok.Literal != name {
+			p.addError(p.curToken, "%q doesn't end in a name for the module; give it one with `as`", stmt.Path)
+			return nil
+		}
+
+		tok := p.curToken
+		tok.Type, tok.Literal = token.IDENT, name
+		stmt.Name = &ast.Identifier{Token: tok, Value: name}
+	}
+
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	stmt := &ast.ReturnStatement{Token: p.curToken}
 
@@ -219,15 +409,27 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+
+	p.nextToken()
+
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	if TRACE_MODE {
 		defer untrace(trace("parseExpressionStatement"))
 	}
 
-	stmt := &ast.ExpressionStatement{
-		Token:      p.curToken,
-		Expression: p.parseExpression(LOWEST),
-	}
+	stmt := &ast.ExpressionStatement{Token: p.curToken}
+	stmt.Expression = p.parseExpression(LOWEST)
 
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
@@ -241,6 +443,17 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 		defer untrace(trace("parseExpression"))
 	}
 
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.maxDepth != 0 && p.depth > p.maxDepth {
+		p.addError(p.curToken, "expressions nested too deeply: more than %d levels", p.maxDepth)
+		p.tooDeep = true
+		for !p.curTokenIs(token.EOF) {
+			p.nextToken()
+		}
+		return nil
+	}
+
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
 		p.addNoPrefixParseFnError(p.curToken.Type)
@@ -274,12 +487,53 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	}
 
 	precedence := p.curPrecedence()
+	if expr.Token.Type == token.POWER {
+		// Right-associative: 2 ** 3 ** 2 is 2 ** (3 ** 2).
+		precedence--
+	}
 	p.nextToken()
 	expr.Right = p.parseExpression(precedence)
 
 	return expr
 }
 
+func (p *Parser) parseConditionalExpression(condition ast.Expression) ast.Expression {
+	expr := &ast.ConditionalExpression{Token: p.curToken, Condition: condition}
+
+	p.nextToken()
+	expr.Consequence = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.COLON) {
+		return nil
+	}
+
+	// Right-associative: a ? b : c ? d : e is a ? b : (c ? d : e).
+	p.nextToken()
+	expr.Alternative = p.parseExpression(CONDITIONAL - 1)
+
+	return expr
+}
+
+func (p *Parser) parseAssignExpression(left ast.Expression) ast.Expression {
+	name, ok := left.(*ast.Identifier)
+	if !ok {
+		// A left side that failed to parse has been reported already.
+		if left != nil {
+			p.addError(p.curToken, "cannot assign to %s", left.String())
+		}
+		return nil
+	}
+
+	expr := &ast.AssignExpression{Token: p.curToken, Name: name}
+
+	p.nextToken()
+	// Parse with a lower precedence than ASSIGN so that `a = b = c` is
+	// right-associative, i.e. `a = (b = c)`.
+	expr.Value = p.parseExpression(ASSIGN - 1)
+
+	return expr
+}
+
 func (p *Parser) parsePrefixExpression() ast.Expression {
 	if TRACE_MODE {
 		defer untrace(trace("parsePrefixExpression"))
@@ -308,9 +562,12 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		p.addError(p.curToken, "integer %s is too large", p.curToken.Literal)
+		return nil
+	}
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.addError(p.curToken, "could not parse %q as integer", p.curToken.Literal)
 		return nil
 	}
 
@@ -318,6 +575,25 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
+	if err != nil {
+		p.addError(p.curToken, "could not parse %q as float", p.curToken.Literal)
+		return nil
+	}
+
+	lit.Value = value
+	return lit
+}
+
+// Reports the malformed input the lexer found.
+func (p *Parser) parseErrorToken() ast.Expression {
+	p.addError(p.curToken, "%s", p.curToken.Literal)
+	return nil
+}
+
 func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
@@ -326,6 +602,10 @@ func (p *Parser) parseBoolean() ast.Expression {
 	return &ast.Boolean{Token: p.curToken, Value: p.curTokenIs(token.TRUE)}
 }
 
+func (p *Parser) parseNull() ast.Expression {
+	return &ast.NullLiteral{Token: p.curToken}
+}
+
 func (p *Parser) parseHashLiteral() ast.Expression {
 	hash := &ast.HashLiteral{Token: p.curToken}
 	hash.Pairs = make(map[ast.Expression]ast.Expression)
@@ -364,11 +644,48 @@ func (p *Parser) parseArrayLiteral() ast.Expression {
 }
 
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
-	expr := &ast.IndexExpression{Token: p.curToken, Left: left}
+	tok := p.curToken
 
 	p.nextToken()
 
-	expr.Index = p.parseExpression(LOWEST)
+	var index ast.Expression
+	if !p.curTokenIs(token.COLON) {
+		index = p.parseExpression(LOWEST)
+
+		if !p.peekTokenIs(token.COLON) {
+			if !p.expectPeek(token.RBRACKET) {
+				return nil
+			}
+			return &ast.IndexExpression{Token: tok, Left: left, Index: index}
+		}
+		p.nextToken()
+	}
+
+	return p.parseSliceExpression(tok, left, index)
+}
+
+func (p *Parser) parseMemberExpression(left ast.Expression) ast.Expression {
+	expr := &ast.MemberExpression{Token: p.curToken, Left: left}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	expr.Member = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	return expr
+}
+
+// Parses the remainder of a slice expression, starting at the ':' token.
+func (p *Parser) parseSliceExpression(tok token.Token, left, start ast.Expression) ast.Expression {
+	expr := &ast.SliceExpression{Token: tok, Left: left, Start: start}
+
+	if p.peekTokenIs(token.RBRACKET) {
+		p.nextToken()
+		return expr
+	}
+
+	p.nextToken()
+	expr.End = p.parseExpression(LOWEST)
 
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
@@ -403,6 +720,9 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 		}
 		p.nextToken()
 	}
+	if p.curTokenIs(token.RBRACE) {
+		block.Close = p.curToken
+	}
 
 	return block
 }
@@ -428,6 +748,16 @@ func (p *Parser) parseIfExpression() ast.Expression {
 
 	if p.peekTokenIs(token.ELSE) {
 		p.nextToken()
+
+		if p.peekTokenIs(token.IF) {
+			p.nextToken()
+			expr.Alternative = p.parseElseIf()
+			if expr.Alternative == nil {
+				return nil
+			}
+			return expr
+		}
+
 		if !p.expectPeek(token.LBRACE) {
 			return nil
 		}
@@ -438,6 +768,91 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expr
 }
 
+// Parses the if expression following an `else`, as a block holding just
+// that expression, so that `else if (b) { ... }` means the same as
+// `else { if (b) { ... } }`.
+func (p *Parser) parseElseIf() *ast.BlockStatement {
+	tok := p.curToken
+
+	ifExpr := p.parseIfExpression()
+	if ifExpr == nil {
+		return nil
+	}
+
+	return &ast.BlockStatement{
+		Token:      tok,
+		Statements: []ast.Statement{&ast.ExpressionStatement{Token: tok, Expression: ifExpr}},
+	}
+}
+
+func (p *Parser) parseWhileExpression() ast.Expression {
+	expr := &ast.WhileExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	p.nextToken()
+	expr.Condition = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	expr.Body = p.parseBlockStatement()
+
+	return expr
+}
+
+// Parses `try { ... }` followed by `catch (e) { ... }`, whose parameter may
+// be left out as in `catch { ... }`, by `finally { ... }`, or by both.
+func (p *Parser) parseTryExpression() ast.Expression {
+	expr := &ast.TryExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	expr.Body = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+
+		if p.peekTokenIs(token.LPAREN) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			expr.Param = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			if !p.expectPeek(token.RPAREN) {
+				return nil
+			}
+		}
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expr.Catch = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expr.Finally = p.parseBlockStatement()
+	}
+
+	if expr.Catch == nil && expr.Finally == nil {
+		p.addError(expr.Token, "try needs a catch or a finally")
+		return nil
+	}
+
+	return expr
+}
+
 func (p *Parser) parseFunctionLiteral() ast.Expression {
 	lit := &ast.FunctionLiteral{Token: p.curToken}
 
@@ -445,7 +860,14 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
-	lit.Parameters = p.parseFunctionParameters()
+	lit.Parameters, lit.ParameterTypes, lit.Defaults, lit.Rest = p.parseFunctionParameters()
+
+	if p.peekTokenIs(token.ARROW) {
+		p.nextToken()
+		if lit.ReturnType = p.parseTypeAnnotation(); lit.ReturnType == nil {
+			return nil
+		}
+	}
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
@@ -455,31 +877,116 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 
 	return lit
 }
-func (p *Parser) parseFunctionParameters() []*ast.Identifier {
-	idents := []*ast.Identifier{}
 
-	if p.peekTokenIs(token.RPAREN) {
-		p.nextToken()
-		return idents
+// Parses a macro literal, whose parameters are plain names: since a macro
+// is passed the expressions it is called with, rather than their values,
+// it has no use for types, default values or a rest parameter.
+func (p *Parser) parseMacroLiteral() ast.Expression {
+	lit := &ast.MacroLiteral{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
 	}
 
-	p.nextToken()
+	params, types, defaults, rest := p.parseFunctionParameters()
+	if types != nil {
+		p.addError(lit.Token, "macro parameters can't have types")
+	}
+	if len(defaults) > 0 || rest != nil {
+		p.addError(lit.Token, "macro parameters can't have default values or be rest parameters")
+	}
+	lit.Parameters = params
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	lit.Body = p.parseBlockStatement()
 
-	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-	idents = append(idents, ident)
+	return lit
+}
 
-	for p.peekTokenIs(token.COMMA) {
+// Parses the parameters of a function literal, the types of those declared
+// with one, or nil if none are, the default values of those that have one,
+// which have to come after those that don't, and the rest parameter, which
+// has to come last.
+func (p *Parser) parseFunctionParameters() ([]*ast.Identifier, []*ast.TypeAnnotation, []ast.Expression, *ast.Identifier) {
+	idents := []*ast.Identifier{}
+	var types []*ast.TypeAnnotation
+	var defaults []ast.Expression
+	typed := false
+	typesIfAny := func() []*ast.TypeAnnotation {
+		if !typed {
+			return nil
+		}
+		return types
+	}
+
+	if p.peekTokenIs(token.RPAREN) {
 		p.nextToken()
+		return idents, nil, defaults, nil
+	}
+
+	for {
 		p.nextToken()
+		if p.curTokenIs(token.ELLIPSIS) {
+			if !p.expectPeek(token.IDENT) {
+				return nil, nil, nil, nil
+			}
+			rest := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+			if !p.expectPeek(token.RPAREN) {
+				return nil, nil, nil, nil
+			}
+			return idents, typesIfAny(), defaults, rest
+		}
+
 		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 		idents = append(idents, ident)
+
+		var annotation *ast.TypeAnnotation
+		if p.peekTokenIs(token.COLON) {
+			p.nextToken()
+			if annotation = p.parseTypeAnnotation(); annotation == nil {
+				return nil, nil, nil, nil
+			}
+			typed = true
+		}
+		types = append(types, annotation)
+
+		if p.peekTokenIs(token.ASSIGN) {
+			p.nextToken()
+			p.nextToken()
+			defaults = append(defaults, p.parseExpression(LOWEST))
+		} else if len(defaults) > 0 {
+			p.addError(ident.Token, "parameter %s has no default value, but one before it has", ident.Value)
+		}
+
+		if !p.peekTokenIs(token.COMMA) {
+			break
+		}
+		p.nextToken()
 	}
 
 	if !p.expectPeek(token.RPAREN) {
-		return nil
+		return nil, nil, nil, nil
 	}
 
-	return idents
+	return idents, typesIfAny(), defaults, nil
+}
+
+// Parses the name of a type after a colon or an arrow, which can be `fn` or
+// `null` as well as an identifier. The names aren't checked until the types
+// are.
+func (p *Parser) parseTypeAnnotation() *ast.TypeAnnotation {
+	switch p.peekToken.Type {
+	case token.IDENT, token.FUNCTION, token.NULL:
+		p.nextToken()
+		return &ast.TypeAnnotation{Token: p.curToken, Name: p.curToken.Literal}
+	default:
+		p.addError(p.peekToken, "expected a type after %s, got %s instead", p.curToken.Literal, p.peekToken.Type)
+		return nil
+	}
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
@@ -0,0 +1,49 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A syntax error at a position in the source code.
+type ParseError struct {
+	Line    int
+	Column  int
+	Message string
+	Source  string // the source line the error occurred on
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// Renders the error, followed by the offending source line and a caret
+// pointing at the column the error occurred at. E.g.
+//
+//	1:11: expected next token to be ), got ; instead
+//	let x = (5;
+//	          ^
+func (e *ParseError) Diagnostic() string {
+	var out strings.Builder
+
+	out.WriteString(e.Error())
+	if e.Source == "" {
+		return out.String()
+	}
+
+	out.WriteString("\n")
+	out.WriteString(e.Source)
+	out.WriteString("\n")
+
+	// Keep tabs so that the caret lines up with the source line above it.
+	for i := 0; i < e.Column-1 && i < len(e.Source); i++ {
+		if e.Source[i] == '\t' {
+			out.WriteByte('\t')
+		} else {
+			out.WriteByte(' ')
+		}
+	}
+	out.WriteString("^")
+
+	return out.String()
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/lexer"
+	"strings"
 	"testing"
 )
 
@@ -63,6 +64,37 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestConstStatements(t *testing.T) {
+	program := parseProgram(t, "const x = 5; let y = x; const [a, b] = y;")
+	testNumProgramStatements(t, program, 3)
+
+	tests := []struct {
+		expectedConst  bool
+		expectedString string
+	}{
+		{true, "const x = 5;"},
+		{false, "let y = x;"},
+		{true, "const [a, b] = y;"},
+	}
+
+	for i, test := range tests {
+		stmt, ok := program.Statements[i].(interface {
+			ast.Statement
+			IsConst() bool
+		})
+		if !ok {
+			t.Fatalf("program.Statements[%d] has no IsConst. got=%T", i, program.Statements[i])
+		}
+		if stmt.IsConst() != test.expectedConst {
+			t.Errorf("program.Statements[%d].IsConst() not %t", i, test.expectedConst)
+		}
+		if stmt.String() != test.expectedString {
+			t.Errorf("program.Statements[%d].String() wrong. want=%q, got=%q",
+				i, test.expectedString, stmt.String())
+		}
+	}
+}
+
 func testLetStatement(t *testing.T, s ast.Statement, expectedName string) bool {
 	if s.TokenLiteral() != "let" {
 		t.Errorf("s.TokenLiteral not 'let'. got=%q", s.TokenLiteral())
@@ -83,6 +115,50 @@ func testLetStatement(t *testing.T, s ast.Statement, expectedName string) bool {
 	return true
 }
 
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedHash  bool
+		expectedNames []string
+		expected      string
+	}{
+		{"let [a, b, c] = arr;", false, []string{"a", "b", "c"}, "let [a, b, c] = arr;"},
+		{"let [x] = [1 + 2]", false, []string{"x"}, "let [x] = [(1 + 2)];"},
+		{"let [] = [];", false, nil, "let [] = [];"},
+		{`let {"x": x, "y": y} = point;`, true, []string{"x", "y"}, "let {x:x, y:y} = point;"},
+		{`let {1 + 1: two} = h;`, true, []string{"two"}, "let {(1 + 1):two} = h;"},
+	}
+
+	for _, test := range tests {
+		program := parseProgram(t, test.input)
+		testNumProgramStatements(t, program, 1)
+
+		stmt, ok := program.Statements[0].(*ast.DestructuringLetStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not *ast.DestructuringLetStatement. got=%T",
+				program.Statements[0])
+		}
+
+		if stmt.Hash != test.expectedHash {
+			t.Errorf("stmt.Hash not %t. got=%t", test.expectedHash, stmt.Hash)
+		}
+		if len(stmt.Names) != len(test.expectedNames) {
+			t.Fatalf("wrong number of names. want=%d, got=%d",
+				len(test.expectedNames), len(stmt.Names))
+		}
+		for i, name := range test.expectedNames {
+			testIdentifier(t, stmt.Names[i], name)
+		}
+		if stmt.Hash && len(stmt.Keys) != len(stmt.Names) {
+			t.Errorf("wrong number of keys. want=%d, got=%d", len(stmt.Names), len(stmt.Keys))
+		}
+
+		if stmt.String() != test.expected {
+			t.Errorf("stmt.String() wrong. want=%q, got=%q", test.expected, stmt.String())
+		}
+	}
+}
+
 func TestReturnStatements(t *testing.T) {
 	tests := []struct {
 		input         string
@@ -159,6 +235,59 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestIntegerLiteralBases(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"0xFF", 255},
+		{"0Xff", 255},
+		{"0o755", 493},
+		{"0b1010", 10},
+		{"1_000_000", 1000000},
+		{"0xFFFF_FFFF", 4294967295},
+		{"0b1000_0000", 128},
+	}
+
+	for _, tt := range tests {
+		program := parseProgram(t, tt.input)
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		literal, ok := stmt.Expression.(*ast.IntegerLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.IntegerLiteral. got=%T", stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("wrong value for %s. expected=%d, got=%d", tt.input, tt.expected, literal.Value)
+		}
+		if literal.TokenLiteral() != tt.input {
+			t.Errorf("literal.TokenLiteral not %s. got=%s", tt.input, literal.TokenLiteral())
+		}
+	}
+}
+
+func TestFloatLiteralExpression(t *testing.T) {
+	input := "3.14;"
+	program := parseProgram(t, input)
+	testNumProgramStatements(t, program, 1)
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	literal, ok := stmt.Expression.(*ast.FloatLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+	}
+	if literal.Value != 3.14 {
+		t.Errorf("literal.Value not %f. got=%f", 3.14, literal.Value)
+	}
+	if literal.TokenLiteral() != "3.14" {
+		t.Errorf("literal.TokenLiteral not %s. got=%s", "3.14", literal.TokenLiteral())
+	}
+}
+
 func TestStringLiteralExpression(t *testing.T) {
 	input := `"hello world";`
 	program := parseProgram(t, input)
@@ -204,6 +333,22 @@ func TestBooleanExpressions(t *testing.T) {
 	}
 }
 
+func TestNullLiteral(t *testing.T) {
+	program := parseProgram(t, "null;")
+	testNumProgramStatements(t, program, 1)
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not *ast.ExpressionStatement, got=%T", program.Statements[0])
+	}
+	if _, ok := stmt.Expression.(*ast.NullLiteral); !ok {
+		t.Fatalf("exp not *ast.NullLiteral. got=%T", stmt.Expression)
+	}
+	if stmt.String() != "null" {
+		t.Errorf("stmt.String() not %q. got=%q", "null", stmt.String())
+	}
+}
+
 func TestPrefixExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -276,6 +421,171 @@ func TestInfixExpressions(t *testing.T) {
 	}
 }
 
+func TestAssignExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5;", "(x = 5)"},
+		{"x = y + 1;", "(x = (y + 1))"},
+		{"x = y = 5;", "(x = (y = 5))"},
+		{"x = a || b;", "(x = (a || b))"},
+	}
+
+	for _, test := range tests {
+		program := parseProgram(t, test.input)
+		testNumProgramStatements(t, program, 1)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		if _, ok := stmt.Expression.(*ast.AssignExpression); !ok {
+			t.Fatalf("stmt.Expression is not *ast.AssignExpression. got=%T",
+				stmt.Expression)
+		}
+
+		if program.String() != test.expected {
+			t.Errorf("expected=%q, got=%q", test.expected, program.String())
+		}
+	}
+}
+
+func TestAssignExpressionInvalidTarget(t *testing.T) {
+	l := lexer.New("5 = 3;")
+	p := New(l)
+	p.ParseProgram()
+
+	errors := p.Errors()
+	if len(errors) == 0 {
+		t.Fatalf("expected parser errors, got none")
+	}
+	if errors[0].Message != "cannot assign to 5" {
+		t.Errorf("wrong parser error. got=%q", errors[0].Message)
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedLine    int
+		expectedColumn  int
+		expectedMessage string
+	}{
+		{"let = 5;", 1, 5, "expected next token to be IDENT, got = instead"},
+		{"let x = 5;\nlet y 6;", 2, 7, "expected next token to be =, got INT instead"},
+		{"5 + ;", 1, 5, "no prefix parse function for ; found"},
+		{"let f = fn(x {\n}", 1, 14, "expected next token to be ), got { instead"},
+		{"let s = \"abc;", 1, 9, "unterminated string"},
+		{"puts(1);\n\"a\\qb\"", 2, 1, `unknown escape sequence \q in string`},
+		{"1 + 0b102", 1, 5, "invalid digit '2' in binary literal"},
+		{"0x", 1, 1, "hexadecimal literal has no digits"},
+		{"1__000", 1, 1, "'_' must separate successive digits"},
+		{"let x = 0777;", 1, 9, "decimal literal can't start with 0; octal literals start with 0o"},
+		{"08", 1, 1, "decimal literal can't start with 0; octal literals start with 0o"},
+		{"0x1_0000_0000_0000_0000", 1, 1, "integer 0x1_0000_0000_0000_0000 is too large"},
+		{"let [a, 1] = b;", 1, 9, "expected next token to be IDENT, got INT instead"},
+		{"let [a b] = c;", 1, 8, "expected next token to be ,, got IDENT instead"},
+		{`let {"a" a} = b;`, 1, 10, "expected next token to be :, got IDENT instead"},
+		{"let [a, a] = b;", 1, 9, "a is bound more than once"},
+		{"fn(a = 1, b) {}", 1, 11, "parameter b has no default value, but one before it has"},
+		{"fn(...rest, a) {}", 1, 11, "expected next token to be ), got , instead"},
+		{"fn(...rest = []) {}", 1, 12, "expected next token to be ), got = instead"},
+		{"macro(x, ...rest) { x }", 1, 1, "macro parameters can't have default values or be rest parameters"},
+		{"macro(x: int) { x }", 1, 1, "macro parameters can't have types"},
+		{"let x: = 5;", 1, 8, "expected a type after :, got = instead"},
+		{"fn(a: 1) {}", 1, 7, "expected a type after :, got INT instead"},
+		{"fn(a) -> { a }", 1, 10, "expected a type after ->, got { instead"},
+		{"fn(...rest: array) {}", 1, 11, "expected next token to be ), got : instead"},
+		{"import util;", 1, 8, "expected next token to be STRING, got IDENT instead"},
+		{`import "./my-util.monkey";`, 1, 8, `"./my-util.monkey" doesn't end in a name for the module; give it one with ` + "`as`"},
+		{`import "std/strings" as;`, 1, 24, "expected next token to be IDENT, got ; instead"},
+		{"a.1", 1, 3, "expected next token to be IDENT, got INT instead"},
+		{"try { 1 }", 1, 1, "try needs a catch or a finally"},
+		{"try { 1 } catch (1) { 2 }", 1, 18, "expected next token to be IDENT, got INT instead"},
+		{"try 1 catch { 2 }", 1, 5, "expected next token to be {, got INT instead"},
+	}
+
+	for _, test := range tests {
+		l := lexer.New(test.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q, got none", test.input)
+		}
+
+		err := errors[0]
+		if err.Line != test.expectedLine || err.Column != test.expectedColumn {
+			t.Errorf("wrong error position for %q. want=%d:%d, got=%d:%d", test.input,
+				test.expectedLine, test.expectedColumn, err.Line, err.Column)
+		}
+		if err.Message != test.expectedMessage {
+			t.Errorf("wrong error message. want=%q, got=%q",
+				test.expectedMessage, err.Message)
+		}
+	}
+}
+
+func TestParseErrorDiagnostic(t *testing.T) {
+	input := "let a = 1;\n\tlet x = (5;"
+
+	l := lexer.New(input)
+	p := New(l)
+	p.ParseProgram()
+
+	errors := p.Errors()
+	if len(errors) == 0 {
+		t.Fatalf("expected parser errors, got none")
+	}
+
+	expected := "2:12: expected next token to be ), got ; instead\n" +
+		"\tlet x = (5;\n" +
+		"\t          ^"
+
+	if errors[0].Diagnostic() != expected {
+		t.Errorf("wrong diagnostic.\nwant=%q\ngot=%q", expected, errors[0].Diagnostic())
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	tests := []struct {
+		input    string
+		maxDepth int
+		tooDeep  bool
+	}{
+		{strings.Repeat("(", 10000) + "1" + strings.Repeat(")", 10000), DefaultMaxDepth, true},
+		{strings.Repeat("-", 10000) + "1", DefaultMaxDepth, true},
+		{"let f = " + strings.Repeat("fn() { ", 10000) + strings.Repeat("}", 10000), DefaultMaxDepth, true},
+		{strings.Repeat("(", 500) + "1" + strings.Repeat(")", 500), DefaultMaxDepth, false},
+		// The statement's expression and the four in parentheses.
+		{"((((1))))", 5, false},
+		{"((((1))))", 4, true},
+		{"a = b = c = d", 4, false},
+		{"a = b = c = d", 3, true},
+		{strings.Repeat("(", 10000) + "1" + strings.Repeat(")", 10000), 0, false},
+	}
+
+	for _, test := range tests {
+		p := New(lexer.New(test.input))
+		p.SetMaxDepth(test.maxDepth)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if !test.tooDeep {
+			checkParserErrors(t, p)
+			continue
+		}
+
+		// Only the first error is reported, not those of the input skipped.
+		if len(errors) != 1 {
+			t.Fatalf("wrong number of errors. want=1, got=%d (%v)", len(errors), errors)
+		}
+		expected := fmt.Sprintf("expressions nested too deeply: more than %d levels", test.maxDepth)
+		if errors[0].Message != expected {
+			t.Errorf("wrong error message. want=%q, got=%q", expected, errors[0].Message)
+		}
+	}
+}
+
 func TestIfExpression(t *testing.T) {
 	input := `if (x < y) { x }`
 	program := parseProgram(t, input)
@@ -359,6 +669,237 @@ func TestIfElseExpression(t *testing.T) {
 	}
 }
 
+func TestElseIfExpression(t *testing.T) {
+	input := `if (x < y) { x } else if (x > y) { y } else { 0 }`
+	program := parseProgram(t, input)
+	testNumProgramStatements(t, program, 1)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp, ok := stmt.Expression.(*ast.IfExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not *ast.IfExpression, got %T", stmt.Expression)
+	}
+
+	if len(exp.Alternative.Statements) != 1 {
+		t.Fatalf("alternative is not 1 statement, got %d", len(exp.Alternative.Statements))
+	}
+	alternative, ok := exp.Alternative.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Alternative.Statements[0] is not *ast.ExpressionStatement, got %T", exp.Alternative.Statements[0])
+	}
+	elseIf, ok := alternative.Expression.(*ast.IfExpression)
+	if !ok {
+		t.Fatalf("alternative is not *ast.IfExpression, got %T", alternative.Expression)
+	}
+	if !testInfixExpression(t, elseIf.Condition, "x", ">", "y") {
+		return
+	}
+	if elseIf.Alternative == nil || len(elseIf.Alternative.Statements) != 1 {
+		t.Fatalf("else if has no final alternative")
+	}
+
+	if got := exp.String(); got != "if(x < y) xelse if(x > y) yelse 0" {
+		t.Errorf("wrong String(). got=%q", got)
+	}
+
+	errorTests := []string{
+		"if (a) { 1 } else if { 2 }",
+		"if (a) { 1 } else if (b) 2",
+	}
+	for _, input := range errorTests {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q, got none", input)
+		}
+	}
+}
+
+func TestImportStatements(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedPath string
+		expectedName string
+	}{
+		{`import "std/strings";`, "std/strings", "strings"},
+		{`import "./lib/util.monkey"`, "./lib/util.monkey", "util"},
+		{`import "../util.monkey" as u;`, "../util.monkey", "u"},
+	}
+
+	for _, test := range tests {
+		program := parseProgram(t, test.input)
+		testNumProgramStatements(t, program, 1)
+
+		stmt, ok := program.Statements[0].(*ast.ImportStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not *ast.ImportStatement. got=%T", program.Statements[0])
+		}
+		if stmt.Path != test.expectedPath {
+			t.Errorf("stmt.Path not %q. got=%q", test.expectedPath, stmt.Path)
+		}
+		if !testIdentifier(t, stmt.Name, test.expectedName) {
+			return
+		}
+	}
+}
+
+func TestMemberExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a.b", "(a.b)"},
+		{"a.b.c", "((a.b).c)"},
+		{"a.b(1)", "(a.b)(1)"},
+		{"a.b[0]", "((a.b)[0])"},
+		{"-a.b * 2", "((-(a.b)) * 2)"},
+		{`{"x": 1}.x`, "({x:1}.x)"},
+	}
+
+	for _, test := range tests {
+		program := parseProgram(t, test.input)
+		if got := program.String(); got != test.expected {
+			t.Errorf("wrong String() for %q. want=%q, got=%q", test.input, test.expected, got)
+		}
+	}
+
+	program := parseProgram(t, "strings.upper")
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	member, ok := stmt.Expression.(*ast.MemberExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not *ast.MemberExpression. got=%T", stmt.Expression)
+	}
+	if !testIdentifier(t, member.Left, "strings") {
+		return
+	}
+	testIdentifier(t, member.Member, "upper")
+}
+
+func TestWhileExpression(t *testing.T) {
+	input := `while (x < y) { x }`
+	program := parseProgram(t, input)
+	testNumProgramStatements(t, program, 1)
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not *ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+
+	expr, ok := stmt.Expression.(*ast.WhileExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not *ast.WhileExpression. got=%T",
+			stmt.Expression)
+	}
+
+	if !testInfixExpression(t, expr.Condition, "x", "<", "y") {
+		return
+	}
+
+	if len(expr.Body.Statements) != 1 {
+		t.Fatalf("body is not 1 statement. got=%d\n", len(expr.Body.Statements))
+	}
+
+	body, ok := expr.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Body.Statements[0] is not *ast.ExpressionStatement. got=%T",
+			expr.Body.Statements[0])
+	}
+
+	testIdentifier(t, body.Expression, "x")
+}
+
+func TestThrowStatements(t *testing.T) {
+	program := parseProgram(t, `throw oops; throw {"code": 1}`)
+	testNumProgramStatements(t, program, 2)
+
+	stmt, ok := program.Statements[0].(*ast.ThrowStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not *ast.ThrowStatement. got=%T", program.Statements[0])
+	}
+	testLiteralExpression(t, stmt.Value, "oops")
+
+	if got := program.Statements[1].String(); got != "throw {code:1};" {
+		t.Errorf("wrong String(). got=%q", got)
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedParam string // "" if there is none
+		hasCatch      bool
+		hasFinally    bool
+		expected      string
+	}{
+		{"try { x } catch (e) { e }", "e", true, false, "try xcatch(e) e"},
+		{"try { x } catch { 1 }", "", true, false, "try xcatch 1"},
+		{"try { x } finally { y }", "", false, true, "try xfinally y"},
+		{"try { x } catch (e) { e } finally { y }", "e", true, true, "try xcatch(e) efinally y"},
+	}
+
+	for _, test := range tests {
+		program := parseProgram(t, test.input)
+		testNumProgramStatements(t, program, 1)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		expr, ok := stmt.Expression.(*ast.TryExpression)
+		if !ok {
+			t.Fatalf("stmt.Expression is not *ast.TryExpression. got=%T", stmt.Expression)
+		}
+
+		if test.expectedParam == "" {
+			if expr.Param != nil {
+				t.Errorf("expr.Param is not nil. got=%s", expr.Param)
+			}
+		} else if !testIdentifier(t, expr.Param, test.expectedParam) {
+			return
+		}
+		if (expr.Catch != nil) != test.hasCatch {
+			t.Errorf("expr.Catch wrong. want a catch: %t, got=%v", test.hasCatch, expr.Catch)
+		}
+		if (expr.Finally != nil) != test.hasFinally {
+			t.Errorf("expr.Finally wrong. want a finally: %t, got=%v", test.hasFinally, expr.Finally)
+		}
+		if got := program.String(); got != test.expected {
+			t.Errorf("wrong String(). want=%q, got=%q", test.expected, got)
+		}
+	}
+}
+
+func TestMacroLiteralParsing(t *testing.T) {
+	program := parseProgram(t, `macro(x, y) { x + y; }`)
+	testNumProgramStatements(t, program, 1)
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not *ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+	macro, ok := stmt.Expression.(*ast.MacroLiteral)
+	if !ok {
+		t.Fatalf("stmt.Expression is not *ast.MacroLiteral. got=%T", stmt.Expression)
+	}
+
+	if len(macro.Parameters) != 2 {
+		t.Fatalf("macro literal parameters wrong. want 2, got=%d", len(macro.Parameters))
+	}
+	testLiteralExpression(t, macro.Parameters[0], "x")
+	testLiteralExpression(t, macro.Parameters[1], "y")
+
+	if len(macro.Body.Statements) != 1 {
+		t.Fatalf("macro.Body.Statements has not 1 statements. got=%d", len(macro.Body.Statements))
+	}
+	body, ok := macro.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("macro body stmt is not *ast.ExpressionStatement. got=%T", macro.Body.Statements[0])
+	}
+	testInfixExpression(t, body.Expression, "x", "+", "y")
+
+	if got := program.String(); got != "macro(x, y) (x + y)" {
+		t.Errorf("wrong String(). got=%q", got)
+	}
+}
+
 func TestOperatorPrecedence(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -476,6 +1017,82 @@ func TestOperatorPrecedence(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
+		{
+			"a * b ** c ** d",
+			"(a * (b ** (c ** d)))",
+		},
+		{
+			"-a ** b",
+			"(-(a ** b))",
+		},
+		{
+			"a ** -b",
+			"(a ** (-b))",
+		},
+		{
+			"a ** b[1]",
+			"(a ** (b[1]))",
+		},
+		{
+			"a | b ^ c & d << e + f",
+			"(a | (b ^ (c & (d << (e + f)))))",
+		},
+		{
+			"a & b == c | d",
+			"((a & b) == (c | d))",
+		},
+		{
+			"a << b >> c",
+			"((a << b) >> c)",
+		},
+		{
+			"a & b && c | d",
+			"((a & b) && (c | d))",
+		},
+		{
+			"a || b ? c + d : e",
+			"((a || b) ? (c + d) : e)",
+		},
+		{
+			"a ? b : c ? d : e",
+			"(a ? b : (c ? d : e))",
+		},
+		{
+			"a ? b ? c : d : e",
+			"(a ? (b ? c : d) : e)",
+		},
+		{
+			"x = a ? b : c",
+			"(x = (a ? b : c))",
+		},
+		{
+			"5 >= 4 == 3 <= 4",
+			"((5 >= 4) == (3 <= 4))",
+		},
+		{
+			"a + b <= c * d",
+			"((a + b) <= (c * d))",
+		},
+		{
+			"a || b && c",
+			"(a || (b && c))",
+		},
+		{
+			"a && b || c",
+			"((a && b) || c)",
+		},
+		{
+			"a == b && c < d",
+			"((a == b) && (c < d))",
+		},
+		{
+			"!a || b",
+			"((!a) || b)",
+		},
 	}
 
 	for _, test := range tests {
@@ -537,6 +1154,46 @@ func TestParsingIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestParsingSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"myArray[1:2]", "(myArray[1:2])"},
+		{"myArray[:2]", "(myArray[:2])"},
+		{"myArray[1:]", "(myArray[1:])"},
+		{"myArray[:]", "(myArray[:])"},
+		{"myArray[1 + 1:len(myArray)][0]", "((myArray[(1 + 1):len(myArray)])[0])"},
+		{`{"a": "hello"[1:]}`, "{a:(hello[1:])}"},
+	}
+
+	for _, test := range tests {
+		program := parseProgram(t, test.input)
+		testNumProgramStatements(t, program, 1)
+
+		if program.String() != test.expected {
+			t.Errorf("expected=%q, got=%q", test.expected, program.String())
+		}
+	}
+
+	program := parseProgram(t, "myArray[1:2]")
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	slice, ok := stmt.Expression.(*ast.SliceExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression not *ast.SliceExpression. got=%T", stmt.Expression)
+	}
+
+	if !testIdentifier(t, slice.Left, "myArray") {
+		return
+	}
+	if !testIntegerLiteral(t, slice.Start, 1) {
+		return
+	}
+	if !testIntegerLiteral(t, slice.End, 2) {
+		return
+	}
+}
+
 func TestFunctionLiteral(t *testing.T) {
 	input := `fn(x, y) { x + y; }`
 	program := parseProgram(t, input)
@@ -573,6 +1230,27 @@ func TestFunctionLiteral(t *testing.T) {
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
 
+func TestFunctionLiteralWithName(t *testing.T) {
+	input := `let myFunction = fn() { };`
+	program := parseProgram(t, input)
+	testNumProgramStatements(t, program, 1)
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not *ast.LetStatement. got=%T",
+			program.Statements[0])
+	}
+
+	fl, ok := stmt.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("stmt.Value is not *ast.FunctionLiteral. got=%T", stmt.Value)
+	}
+
+	if fl.Name != "myFunction" {
+		t.Fatalf("function literal name wrong. want 'myFunction', got=%q", fl.Name)
+	}
+}
+
 func TestFunctionParameters(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -600,6 +1278,130 @@ func TestFunctionParameters(t *testing.T) {
 	}
 }
 
+func TestFunctionRestParameter(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedParams []string
+		expectedRest   string
+		expected       string
+	}{
+		{"fn(...args) {}", []string{}, "args", "fn(...args) "},
+		{"fn(a, ...rest) { rest }", []string{"a"}, "rest", "fn(a, ...rest) rest"},
+		{"fn(a, b = 1, ...rest) {}", []string{"a", "b"}, "rest", "fn(a, b = 1, ...rest) "},
+		{"fn(a) {}", []string{"a"}, "", "fn(a) "},
+	}
+
+	for _, test := range tests {
+		program := parseProgram(t, test.input)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		function := stmt.Expression.(*ast.FunctionLiteral)
+
+		if len(function.Parameters) != len(test.expectedParams) {
+			t.Fatalf("length parameters wrong. want %d, got=%d",
+				len(test.expectedParams), len(function.Parameters))
+		}
+		for i, ident := range test.expectedParams {
+			testIdentifier(t, function.Parameters[i], ident)
+		}
+
+		if test.expectedRest == "" {
+			if function.Rest != nil {
+				t.Errorf("function.Rest is not nil. got=%s", function.Rest)
+			}
+		} else if function.Rest == nil {
+			t.Errorf("function.Rest is nil, want %s", test.expectedRest)
+		} else {
+			testIdentifier(t, function.Rest, test.expectedRest)
+		}
+
+		if function.String() != test.expected {
+			t.Errorf("function.String() wrong. want=%q, got=%q", test.expected, function.String())
+		}
+	}
+}
+
+func TestFunctionParameterDefaults(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedParams   []string
+		expectedDefaults []string
+		expected         string
+	}{
+		{"fn(x, y = 10) {}", []string{"x", "y"}, []string{"10"}, "fn(x, y = 10) "},
+		{"fn(a = 1, b = a * 2) {}", []string{"a", "b"}, []string{"1", "(a * 2)"}, "fn(a = 1, b = (a * 2)) "},
+		{"fn(s = \"x\") { s }", []string{"s"}, []string{"x"}, "fn(s = x) s"},
+	}
+
+	for _, test := range tests {
+		program := parseProgram(t, test.input)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		function := stmt.Expression.(*ast.FunctionLiteral)
+
+		if len(function.Parameters) != len(test.expectedParams) {
+			t.Fatalf("length parameters wrong. want %d, got=%d",
+				len(test.expectedParams), len(function.Parameters))
+		}
+		for i, ident := range test.expectedParams {
+			testIdentifier(t, function.Parameters[i], ident)
+		}
+
+		if len(function.Defaults) != len(test.expectedDefaults) {
+			t.Fatalf("length defaults wrong. want %d, got=%d",
+				len(test.expectedDefaults), len(function.Defaults))
+		}
+		for i, def := range test.expectedDefaults {
+			if function.Defaults[i].String() != def {
+				t.Errorf("default %d wrong. want=%q, got=%q", i, def, function.Defaults[i].String())
+			}
+		}
+
+		if function.String() != test.expected {
+			t.Errorf("function.String() wrong. want=%q, got=%q", test.expected, function.String())
+		}
+	}
+}
+
+func TestTypeAnnotations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x: int = 5;", "let x: int = 5;"},
+		{"const s: str = \"a\";", "const s: str = a;"},
+		{"let f: fn = fn() { 1 };", "let f: fn = fn() 1;"},
+		{"fn(a: int, b: str) -> str { b }", "fn(a: int, b: str) -> str b"},
+		{"fn(a, b: float = 1.5, ...c) -> null {}", "fn(a, b: float = 1.5, ...c) -> null "},
+		{"fn(a: array) {}", "fn(a: array) "},
+		{"fn(x) -> bool { true }", "fn(x) -> bool true"},
+	}
+
+	for _, test := range tests {
+		program := parseProgram(t, test.input)
+		if program.String() != test.expected {
+			t.Errorf("wrong program for %q. want=%q, got=%q", test.input, test.expected, program.String())
+		}
+	}
+
+	program := parseProgram(t, "fn(a, b: int, c) {}")
+	function := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral)
+	if len(function.ParameterTypes) != 3 || function.ParameterType(0) != nil ||
+		function.ParameterType(1).Name != "int" || function.ParameterType(2) != nil {
+		t.Errorf("wrong parameter types. got=%v", function.ParameterTypes)
+	}
+	if typ := function.ParameterType(1).Token; typ.Line != 1 || typ.Column != 10 {
+		t.Errorf("wrong position of the type. got=%d:%d", typ.Line, typ.Column)
+	}
+
+	// Unannotated functions have no types at all.
+	program = parseProgram(t, "fn(a, b) {}")
+	function = program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral)
+	if function.ParameterTypes != nil || function.ReturnType != nil {
+		t.Errorf("unexpected types. got=%v, %v", function.ParameterTypes, function.ReturnType)
+	}
+}
+
 func TestCallExpression(t *testing.T) {
 	input := "add(1, 2 * 3, 4 + 5);"
 	program := parseProgram(t, input)
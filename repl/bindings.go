@@ -0,0 +1,218 @@
+package repl
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/object"
+	"monkey/vm"
+	"sort"
+)
+
+// A global binding carried over from one engine's session to another's.
+// Both engines share the same objects for values, except for functions,
+// which are carried over as their source and defined again.
+type binding struct {
+	name     string
+	value    object.Object        // Nil for functions.
+	fn       *ast.FunctionLiteral // The source of a function.
+	constant bool                 // Declared with `const`.
+}
+
+// Replaces the session with one on another engine, carrying over the global
+// bindings of the current session.
+func switchEngine(r *replState, engine string) {
+	if engine == r.engine {
+		fmt.Fprintf(r.out, "already running on %s\n", engine)
+		return
+	}
+
+	bindings, skipped := r.session.bindings()
+
+	next := newSession(engine, r.input, r.out)
+	skipped = append(skipped, next.define(bindings)...)
+
+	r.engine = engine
+	r.session = next
+
+	fmt.Fprintf(r.out, "switched to %s\n", engine)
+	for _, msg := range skipped {
+		fmt.Fprintf(r.out, " %s\n", msg)
+	}
+}
+
+// Reports whether obj holds a function that only one engine can call, which
+// would have to be defined again to be carried over.
+func containsFunction(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Function, *object.Closure:
+		return true
+	case *object.Array:
+		for _, el := range obj.Elements {
+			if containsFunction(el) {
+				return true
+			}
+		}
+	case *object.Hash:
+		for _, pair := range obj.Pairs {
+			if containsFunction(pair.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func cannotCarryOver(name, reason string) string {
+	return fmt.Sprintf("could not carry over %s: %s", name, reason)
+}
+
+// Functions defined at the top level are carried over as their source.
+// Those defined inside other functions may refer to the local variables of
+// those functions, which have no equivalent in a new session.
+func (s *evaluatorSession) bindings() ([]binding, []string) {
+	env := s.env.Bindings()
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var bindings []binding
+	var skipped []string
+	for _, name := range names {
+		switch val := env[name].(type) {
+		case *object.Function:
+			if val.Env != s.env {
+				skipped = append(skipped, cannotCarryOver(name, "it is a closure over local variables"))
+				continue
+			}
+			bindings = append(bindings, binding{name: name, fn: &ast.FunctionLiteral{
+				Parameters: val.Parameters,
+				Defaults:   val.Defaults,
+				Rest:       val.Rest,
+				Body:       val.Body,
+				Name:       val.Name,
+			}, constant: s.env.IsConst(name)})
+		default:
+			if containsFunction(val) {
+				skipped = append(skipped, cannotCarryOver(name, "it holds functions"))
+				continue
+			}
+			bindings = append(bindings, binding{name: name, value: val, constant: s.env.IsConst(name)})
+		}
+	}
+
+	return bindings, skipped
+}
+
+func (s *evaluatorSession) define(bindings []binding) []string {
+	for _, b := range bindings {
+		val := b.value
+		if b.fn != nil {
+			val = &object.Function{
+				Parameters: b.fn.Parameters,
+				Defaults:   b.fn.Defaults,
+				Rest:       b.fn.Rest,
+				Body:       b.fn.Body,
+				Env:        s.env,
+				Name:       b.fn.Name,
+			}
+		}
+
+		if b.constant {
+			s.env.SetConst(b.name, val)
+		} else {
+			s.env.Set(b.name, val)
+		}
+	}
+
+	return nil
+}
+
+// Globals are found through the symbol table. Closures are carried over as
+// the source of their function, unless they captured free variables.
+func (s *vmSession) bindings() ([]binding, []string) {
+	var bindings []binding
+	var skipped []string
+	for _, symbol := range s.symbolTable.Symbols() {
+		if symbol.Scope != compiler.GlobalScope {
+			continue
+		}
+
+		switch val := s.globals[symbol.Index].(type) {
+		case *object.Closure:
+			if len(val.Free) > 0 {
+				skipped = append(skipped, cannotCarryOver(symbol.Name, "it is a closure over local variables"))
+				continue
+			}
+			if val.Fn.Literal == nil {
+				skipped = append(skipped, cannotCarryOver(symbol.Name, "its source is unknown"))
+				continue
+			}
+			bindings = append(bindings, binding{name: symbol.Name, fn: val.Fn.Literal, constant: symbol.Const})
+		default:
+			if containsFunction(val) {
+				skipped = append(skipped, cannotCarryOver(symbol.Name, "it holds functions"))
+				continue
+			}
+			bindings = append(bindings, binding{name: symbol.Name, value: val, constant: symbol.Const})
+		}
+	}
+
+	return bindings, skipped
+}
+
+// Every name is defined before any function is compiled, so that functions
+// can refer to each other.
+func (s *vmSession) define(bindings []binding) []string {
+	symbols := make([]compiler.Symbol, len(bindings))
+	for i, b := range bindings {
+		if b.constant {
+			symbols[i] = s.symbolTable.DefineConst(b.name)
+		} else {
+			symbols[i] = s.symbolTable.Define(b.name)
+		}
+	}
+
+	var skipped []string
+	for i, b := range bindings {
+		if b.fn == nil {
+			s.globals[symbols[i].Index] = b.value
+			continue
+		}
+
+		closure, err := s.compileFunction(b.fn)
+		if err != nil {
+			skipped = append(skipped, cannotCarryOver(b.name, err.Error()))
+			continue
+		}
+		s.globals[symbols[i].Index] = closure
+	}
+
+	return skipped
+}
+
+// Compiles a function literal against the session's globals, and runs it to
+// create a closure.
+func (s *vmSession) compileFunction(fn *ast.FunctionLiteral) (object.Object, error) {
+	program := &ast.Program{Statements: []ast.Statement{
+		&ast.ExpressionStatement{Token: fn.Token, Expression: fn},
+	}}
+
+	comp := compiler.NewWithState(s.symbolTable, s.constants)
+	if err := comp.Compile(program); err != nil {
+		return nil, err
+	}
+
+	bytecode := comp.Bytecode()
+	s.constants = bytecode.Constants
+
+	machine := vm.NewWithGlobalsStore(bytecode, s.globals)
+	if err := machine.Run(); err != nil {
+		return nil, err
+	}
+
+	return machine.LastPoppedStackElem(), nil
+}
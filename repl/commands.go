@@ -0,0 +1,350 @@
+package repl
+
+import (
+	"fmt"
+	"io"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/token"
+	"os"
+	"sort"
+	"strings"
+)
+
+const metaCommandHelp = `:tokens [input]    show the tokens the lexer produces
+:ast [input]       show the syntax tree the parser produces
+:bytecode [input]  show the bytecode the compiler produces
+:save file         save the input run without errors so far to a file
+:load file         run a file, keeping what it defines
+:engine [vm|eval]  show or switch the engine, keeping global bindings
+:help              show this message
+:tokens, :ast and :bytecode show the input following them, or the last input
+if there is none, without running it.
+`
+
+// Handles a line starting with ":". Reports whether a file run by the
+// command called `exit`, which ends the session.
+func runMetaCommand(r *replState, line string) (exited bool) {
+	out := r.out
+
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	input := arg
+	if input == "" {
+		input = r.last
+	}
+
+	switch name {
+	case ":tokens":
+		printTokens(out, input)
+	case ":ast":
+		if program, ok := parse(out, input); ok {
+			printAST(out, program)
+		}
+	case ":bytecode":
+		program, ok := parse(out, input)
+		if !ok {
+			return
+		}
+		program, ok = r.expandMacros(program, false)
+		if !ok {
+			return
+		}
+
+		bytecode, err := r.session.compile(program)
+		if err != nil {
+			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
+			return
+		}
+		io.WriteString(out, bytecode.Disassemble())
+	case ":save":
+		if arg == "" {
+			io.WriteString(out, "usage: :save file\n")
+			return false
+		}
+
+		err := os.WriteFile(arg, []byte(strings.Join(r.run, "\n")+"\n"), 0644)
+		if err != nil {
+			fmt.Fprintf(out, "Woops! Could not save the session:\n %s\n", err)
+			return false
+		}
+		fmt.Fprintf(out, "saved %d inputs to %s\n", len(r.run), arg)
+	case ":load":
+		if arg == "" {
+			io.WriteString(out, "usage: :load file\n")
+			return false
+		}
+
+		src, err := os.ReadFile(arg)
+		if err != nil {
+			fmt.Fprintf(out, "Woops! Could not load the file:\n %s\n", err)
+			return false
+		}
+
+		program, ok := parse(out, string(src))
+		if !ok {
+			return false
+		}
+		program, ok = r.expandMacros(program, true)
+		if !ok {
+			return false
+		}
+
+		// Saving the session again should define what the file did.
+		ok, exited := r.session.run(program)
+		if ok {
+			r.run = append(r.run, strings.TrimRight(string(src), "\n"))
+		}
+		return exited
+	case ":engine":
+		switch arg {
+		case "":
+			fmt.Fprintf(out, "running on %s\n", r.engine)
+		case EngineVM, EngineEvaluator:
+			switchEngine(r, arg)
+		default:
+			fmt.Fprintf(out, "unknown engine %s, want %s or %s\n", arg, EngineVM, EngineEvaluator)
+		}
+	case ":help":
+		io.WriteString(out, metaCommandHelp)
+	default:
+		fmt.Fprintf(out, "unknown command %s, try :help\n", name)
+	}
+
+	return false
+}
+
+func printTokens(out io.Writer, input string) {
+	l := lexer.New(input)
+	for {
+		tok := l.NextToken()
+		fmt.Fprintf(out, "%d:%d\t%-8s %q\n", tok.Line, tok.Column, tok.Type, tok.Literal)
+		if tok.Type == token.EOF {
+			return
+		}
+	}
+}
+
+// Prints the tree of nodes under node, one per line, with each child
+// indented under its parent and labelled with the field it is held in.
+func printAST(out io.Writer, node ast.Node) {
+	p := &astPrinter{out: out}
+	p.print("", node)
+}
+
+type astPrinter struct {
+	out   io.Writer
+	depth int
+}
+
+func (p *astPrinter) line(label, format string, a ...interface{}) {
+	io.WriteString(p.out, strings.Repeat("  ", p.depth))
+	if label != "" {
+		io.WriteString(p.out, label+": ")
+	}
+	fmt.Fprintf(p.out, format+"\n", a...)
+}
+
+func (p *astPrinter) children(print func()) {
+	p.depth++
+	print()
+	p.depth--
+}
+
+func (p *astPrinter) print(label string, node ast.Node) {
+	switch node := node.(type) {
+	case *ast.Program:
+		p.line(label, "Program")
+		p.children(func() {
+			for _, stmt := range node.Statements {
+				p.print("", stmt)
+			}
+		})
+	case *ast.LetStatement:
+		if node.IsConst() {
+			p.line(label, "LetStatement %s (const)", node.Name.Value)
+		} else {
+			p.line(label, "LetStatement %s", node.Name.Value)
+		}
+		p.children(func() { p.print("Value", node.Value) })
+	case *ast.DestructuringLetStatement:
+		if node.IsConst() {
+			p.line(label, "DestructuringLetStatement (const)")
+		} else {
+			p.line(label, "DestructuringLetStatement")
+		}
+		p.children(func() {
+			for i, name := range node.Names {
+				if node.Hash {
+					p.print("Key", node.Keys[i])
+				}
+				p.print("Name", name)
+			}
+			p.print("Value", node.Value)
+		})
+	case *ast.ImportStatement:
+		p.line(label, "ImportStatement %q", node.Path)
+		p.children(func() {
+			p.print("Name", node.Name)
+		})
+	case *ast.ReturnStatement:
+		p.line(label, "ReturnStatement")
+		p.children(func() { p.print("ReturnValue", node.ReturnValue) })
+	case *ast.ThrowStatement:
+		p.line(label, "ThrowStatement")
+		p.children(func() { p.print("Value", node.Value) })
+	case *ast.ExpressionStatement:
+		p.line(label, "ExpressionStatement")
+		p.children(func() { p.print("", node.Expression) })
+	case *ast.BlockStatement:
+		p.line(label, "BlockStatement")
+		p.children(func() {
+			for _, stmt := range node.Statements {
+				p.print("", stmt)
+			}
+		})
+	case *ast.AssignExpression:
+		p.line(label, "AssignExpression %s", node.Name.Value)
+		p.children(func() { p.print("Value", node.Value) })
+	case *ast.IfExpression:
+		p.line(label, "IfExpression")
+		p.children(func() {
+			p.print("Condition", node.Condition)
+			p.print("Consequence", node.Consequence)
+			if node.Alternative != nil {
+				p.print("Alternative", node.Alternative)
+			}
+		})
+	case *ast.ConditionalExpression:
+		p.line(label, "ConditionalExpression")
+		p.children(func() {
+			p.print("Condition", node.Condition)
+			p.print("Consequence", node.Consequence)
+			p.print("Alternative", node.Alternative)
+		})
+	case *ast.WhileExpression:
+		p.line(label, "WhileExpression")
+		p.children(func() {
+			p.print("Condition", node.Condition)
+			p.print("Body", node.Body)
+		})
+	case *ast.TryExpression:
+		p.line(label, "TryExpression")
+		p.children(func() {
+			p.print("Body", node.Body)
+			if node.Param != nil {
+				p.print("Param", node.Param)
+			}
+			if node.Catch != nil {
+				p.print("Catch", node.Catch)
+			}
+			if node.Finally != nil {
+				p.print("Finally", node.Finally)
+			}
+		})
+	case *ast.InfixExpression:
+		p.line(label, "InfixExpression %s", node.Operator)
+		p.children(func() {
+			p.print("Left", node.Left)
+			p.print("Right", node.Right)
+		})
+	case *ast.PrefixExpression:
+		p.line(label, "PrefixExpression %s", node.Operator)
+		p.children(func() { p.print("Right", node.Right) })
+	case *ast.Identifier:
+		p.line(label, "Identifier %s", node.Value)
+	case *ast.IntegerLiteral:
+		p.line(label, "IntegerLiteral %d", node.Value)
+	case *ast.FloatLiteral:
+		p.line(label, "FloatLiteral %s", node.Token.Literal)
+	case *ast.StringLiteral:
+		p.line(label, "StringLiteral %q", node.Value)
+	case *ast.Boolean:
+		p.line(label, "Boolean %t", node.Value)
+	case *ast.NullLiteral:
+		p.line(label, "NullLiteral")
+	case *ast.ArrayLiteral:
+		p.line(label, "ArrayLiteral")
+		p.children(func() {
+			for _, el := range node.Elements {
+				p.print("", el)
+			}
+		})
+	case *ast.HashLiteral:
+		p.line(label, "HashLiteral")
+
+		// Pairs are kept in a map, so sort them to print them consistently.
+		keys := make([]ast.Expression, 0, len(node.Pairs))
+		for key := range node.Pairs {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		p.children(func() {
+			for _, key := range keys {
+				p.print("Key", key)
+				p.print("Value", node.Pairs[key])
+			}
+		})
+	case *ast.IndexExpression:
+		p.line(label, "IndexExpression")
+		p.children(func() {
+			p.print("Left", node.Left)
+			p.print("Index", node.Index)
+		})
+	case *ast.MemberExpression:
+		p.line(label, "MemberExpression %s", node.Member.Value)
+		p.children(func() {
+			p.print("Left", node.Left)
+		})
+	case *ast.SliceExpression:
+		p.line(label, "SliceExpression")
+		p.children(func() {
+			p.print("Left", node.Left)
+			if node.Start != nil {
+				p.print("Start", node.Start)
+			}
+			if node.End != nil {
+				p.print("End", node.End)
+			}
+		})
+	case *ast.FunctionLiteral:
+		params := make([]string, len(node.Parameters))
+		for i, param := range node.Parameters {
+			params[i] = param.Value
+		}
+		if node.Rest != nil {
+			params = append(params, "..."+node.Rest.Value)
+		}
+		p.line(label, "FunctionLiteral %s(%s)", node.Name, strings.Join(params, ", "))
+		p.children(func() {
+			firstDefault := len(node.Parameters) - len(node.Defaults)
+			for i, def := range node.Defaults {
+				p.print("Default "+node.Parameters[firstDefault+i].Value, def)
+			}
+			p.print("Body", node.Body)
+		})
+	case *ast.MacroLiteral:
+		params := make([]string, len(node.Parameters))
+		for i, param := range node.Parameters {
+			params[i] = param.Value
+		}
+		p.line(label, "MacroLiteral (%s)", strings.Join(params, ", "))
+		p.children(func() { p.print("Body", node.Body) })
+	case *ast.CallExpression:
+		p.line(label, "CallExpression")
+		p.children(func() {
+			p.print("Function", node.Function)
+			for _, arg := range node.Arguments {
+				p.print("Argument", arg)
+			}
+		})
+	case nil:
+		p.line(label, "<nil>")
+	default:
+		p.line(label, "%T", node)
+	}
+}
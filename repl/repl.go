@@ -4,76 +4,394 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"monkey/ast"
 	"monkey/compiler"
+	"monkey/evaluator"
 	"monkey/lexer"
+	"monkey/lineedit"
 	"monkey/object"
 	"monkey/parser"
+	"monkey/token"
 	"monkey/vm"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 const PROMPT = ">> "
 
-func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
-	// env := object.NewEnvironment()
+// Shown while reading the rest of an input that spans several lines.
+const CONTINUATION_PROMPT = "... "
 
-	constants := []object.Object{}
-	globals := make([]object.Object, vm.GLOBALS_SIZE)
+// The engines the REPL can run code with.
+const (
+	EngineVM        = "vm"
+	EngineEvaluator = "eval"
+)
 
-	symbolTable := compiler.NewSymbolTable()
-	for i, b := range object.Builtins {
-		symbolTable.DefineBuiltin(i, b.Name)
+// The state of a REPL session in one of the engines.
+type session interface {
+	// Runs a parsed line of input, printing its result or its error. Reports
+	// whether the line ran without an error, and whether it called `exit`,
+	// which ends the session.
+	run(program *ast.Program) (ok, exited bool)
+	// Compiles a line of input the way it would be compiled if it were run
+	// next, without running it.
+	compile(program *ast.Program) (*compiler.Bytecode, error)
+	// Returns the session's global bindings, for another session to define.
+	// Bindings that can't be carried over are reported, one message each.
+	bindings() (bindings []binding, skipped []string)
+	// Defines global bindings taken from another session, reporting those
+	// that couldn't be defined.
+	define(bindings []binding) (skipped []string)
+}
+
+func newSession(engine string, input *bufio.Reader, out io.Writer) session {
+	switch engine {
+	case EngineEvaluator:
+		return newEvaluatorSession(input, out)
+	default:
+		return newVMSession(input, out)
+	}
+}
+
+// The state of the REPL between inputs.
+type replState struct {
+	input *bufio.Reader
+	out   io.Writer
+
+	engine  string
+	session session
+	transcript
+
+	// The macros defined so far, which are expanded on either engine.
+	macros *object.Environment
+}
+
+func Start(in io.Reader, out io.Writer, engine string) {
+	// Scripts read their input from the same reader as the REPL, so that
+	// lines read by `readLine` aren't swallowed by the REPL's buffering.
+	input := object.NewInput(in)
+
+	macros := object.NewEnvironment()
+	macros.SetStdout(out)
+	macros.SetStdin(input)
+
+	r := &replState{
+		input:   input,
+		out:     out,
+		engine:  engine,
+		session: newSession(engine, input, out),
+		macros:  macros,
+	}
+
+	// Lines typed on a terminal can be edited, and are kept in a history.
+	var lines lineReader = &bufferedLineReader{in: input, out: out}
+	if f, ok := in.(*os.File); ok {
+		if editor := lineedit.New(f, out); editor != nil {
+			defer editor.Close()
+			if path, err := historyPath(); err == nil {
+				editor.SetHistoryFile(path)
+			}
+			lines = editor
+		}
 	}
 
 	for {
-		fmt.Fprint(out, PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
+		line, ok := readInput(lines)
+		if !ok {
 			return
 		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
 
-		line := scanner.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
+		if strings.HasPrefix(strings.TrimSpace(line), ":") {
+			if runMetaCommand(r, strings.TrimSpace(line)) {
+				return
+			}
+			continue
+		}
+		r.last = line
 
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+		program, ok := parse(out, line)
+		if !ok {
+			continue
+		}
+		program, ok = r.expandMacros(program, true)
+		if !ok {
 			continue
 		}
 
-		// eval := evaluator.Eval(program, env)
-		// if eval != nil {
-		// 	io.WriteString(out, eval.Inspect())
-		// 	io.WriteString(out, "\n")
-		// }
+		ok, exited := r.session.run(program)
+		if ok {
+			r.run = append(r.run, line)
+		}
+		if exited {
+			return
+		}
+	}
+}
+
+// The input of a session, which meta-commands show and save.
+type transcript struct {
+	last string   // The last input, whether or not it parsed.
+	run  []string // The inputs that ran without an error, in order.
+}
+
+// Reads lines of input for the REPL.
+type lineReader interface {
+	// Shows prompt, then reads a line without its line ending.
+	ReadLine(prompt string) (string, error)
+	// Records a line that was read, for the user to recall later.
+	AddHistory(line string)
+}
+
+// Reads lines from input that isn't a terminal, so can't be edited.
+type bufferedLineReader struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (r *bufferedLineReader) ReadLine(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
 
-		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
+	line, err := r.in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (r *bufferedLineReader) AddHistory(line string) {}
+
+// Where the history of lines typed into the REPL is kept.
+func historyPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".monkey_history"), nil
+}
+
+// Reads a line of input. While the brackets in the input are unbalanced, it
+// keeps reading lines, so that e.g. a function can be defined over several
+// lines. Reports false once the input is exhausted.
+func readInput(r lineReader) (string, bool) {
+	prompt := PROMPT
+
+	var lines []string
+	for {
+		line, err := r.ReadLine(prompt)
+		if err == lineedit.ErrInterrupted {
+			// Ctrl-C abandons the input, but not the session.
+			return "", true
+		}
 		if err != nil {
-			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
-			continue
+			// Whatever was read of an incomplete input is still parsed, so
+			// that its errors are reported.
+			return strings.Join(lines, "\n"), len(lines) > 0
 		}
+		r.AddHistory(line)
 
-		bytecode := comp.Bytecode()
-		constants = bytecode.Constants
+		lines = append(lines, line)
+		src := strings.Join(lines, "\n")
+		if strings.HasPrefix(strings.TrimSpace(src), ":") || !hasUnclosedBrackets(src) {
+			return src, true
+		}
 
-		machine := vm.NewWithGlobalsStore(bytecode, globals)
-		err = machine.Run()
-		if err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
-			continue
+		prompt = CONTINUATION_PROMPT
+	}
+}
+
+// Reports whether src opens more parentheses, braces or brackets than it
+// closes, or opens a raw string that it doesn't close. Closing too many
+// brackets is left for the parser to report.
+func hasUnclosedBrackets(src string) bool {
+	depth := 0
+
+	l := lexer.New(src)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.ERROR:
+			if tok.Literal == lexer.UnterminatedRawString {
+				return true
+			}
+		case token.LPAREN, token.LBRACE, token.LBRACKET:
+			depth++
+		case token.RPAREN, token.RBRACE, token.RBRACKET:
+			depth--
+			if depth < 0 {
+				return false
+			}
 		}
+	}
+
+	return depth > 0
+}
+
+// Parses a line of input, printing any errors.
+func parse(out io.Writer, line string) (*ast.Program, bool) {
+	p := parser.New(lexer.New(line))
+
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(out, p.Errors())
+		return nil, false
+	}
+
+	return program, true
+}
+
+// Expands the calls of macros in a line of input, printing any error. The
+// macros the line defines are kept for the lines after it if keep is set.
+func (r *replState) expandMacros(program *ast.Program, keep bool) (*ast.Program, bool) {
+	env := r.macros
+	if !keep {
+		env = object.NewEnclosedEnvironment(env)
+	}
+
+	evaluator.DefineMacros(program, env)
+	expanded, err := evaluator.ExpandMacros(program, env)
+	if err != nil {
+		fmt.Fprintf(r.out, "Woops! Expanding macros failed:\n %s\n", err.Message)
+		return nil, false
+	}
+	return expanded.(*ast.Program), true
+}
+
+type evaluatorSession struct {
+	env *object.Environment
+	out io.Writer
+}
+
+func newEvaluatorSession(input *bufio.Reader, out io.Writer) *evaluatorSession {
+	env := object.NewEnvironment()
+	env.SetStdout(out)
+	env.SetStdin(input)
+
+	return &evaluatorSession{env: env, out: out}
+}
+
+func (s *evaluatorSession) run(program *ast.Program) (bool, bool) {
+	eval := evaluator.Eval(program, s.env)
+	if _, ok := eval.(*object.Exit); ok {
+		return true, true
+	}
+	if eval != nil {
+		io.WriteString(s.out, eval.Inspect())
+		io.WriteString(s.out, "\n")
+	}
+	_, failed := eval.(*object.Error)
+	return !failed, false
+}
+
+// The evaluator keeps no symbol table, so the line is compiled against one
+// with a global for each binding of the session, numbered by name.
+func (s *evaluatorSession) compile(program *ast.Program) (*compiler.Bytecode, error) {
+	symbolTable := compiler.NewSymbolTable()
+	for i, b := range object.Builtins {
+		symbolTable.DefineBuiltin(i, b.Name)
+	}
+	bindings := s.env.Bindings()
+	names := make([]string, 0, len(bindings))
+	for name := range bindings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if s.env.IsConst(name) {
+			symbolTable.DefineConst(name)
+		} else {
+			symbolTable.Define(name)
+		}
+	}
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+	if err := comp.Compile(program); err != nil {
+		return nil, err
+	}
+	return comp.Bytecode(), nil
+}
+
+type vmSession struct {
+	input *bufio.Reader
+	out   io.Writer
+
+	constants   []object.Object
+	globals     []object.Object
+	symbolTable *compiler.SymbolTable
+}
+
+func newVMSession(input *bufio.Reader, out io.Writer) *vmSession {
+	symbolTable := compiler.NewSymbolTable()
+	for i, b := range object.Builtins {
+		symbolTable.DefineBuiltin(i, b.Name)
+	}
+
+	return &vmSession{
+		input:       input,
+		out:         out,
+		constants:   []object.Object{},
+		globals:     make([]object.Object, vm.GLOBALS_SIZE),
+		symbolTable: symbolTable,
+	}
+}
+
+func (s *vmSession) run(program *ast.Program) (bool, bool) {
+	// Nothing a line defines is kept if it doesn't compile, or if it fails
+	// or ends before setting it.
+	symbols := s.symbolTable.Copy()
+	comp := compiler.NewWithState(symbols, s.constants)
+	err := comp.Compile(program)
+	if err != nil {
+		fmt.Fprintf(s.out, "Woops! Compilation failed:\n %s\n", err)
+		return false, false
+	}
+
+	bytecode := comp.Bytecode()
+	s.constants = bytecode.Constants
+
+	machine := vm.NewWithGlobalsStore(bytecode, s.globals)
+	machine.SetStdout(s.out)
+	machine.SetStdin(s.input)
+	err = machine.Run()
+	symbols.Forget(s.symbolTable, func(symbol compiler.Symbol) bool {
+		return symbol.Scope != compiler.GlobalScope || s.globals[symbol.Index] != nil
+	})
+	s.symbolTable = symbols
+	if _, ok := err.(*object.Exit); ok {
+		return true, true
+	}
+	if err != nil {
+		fmt.Fprintf(s.out, "Woops! Executing bytecode failed:\n %s\n", err)
+		return false, false
+	}
+
+	// Nothing is left of a line that only defines macros.
+	if lastPopped := machine.LastPoppedStackElem(); lastPopped != nil {
+		fmt.Fprintf(s.out, "%s\n", lastPopped.Inspect())
+	}
+	return true, false
+}
+
+// Compiles against copies of the session's symbol table and constants, so
+// that globals defined by earlier lines resolve but nothing is defined.
+func (s *vmSession) compile(program *ast.Program) (*compiler.Bytecode, error) {
+	constants := s.constants[:len(s.constants):len(s.constants)]
 
-		lastPopped := machine.LastPoppedStackElem()
-		fmt.Fprintf(out, "%s\n", lastPopped.Inspect())
+	comp := compiler.NewWithState(s.symbolTable.Copy(), constants)
+	if err := comp.Compile(program); err != nil {
+		return nil, err
 	}
+	return comp.Bytecode(), nil
 }
 
-func printParserErrors(out io.Writer, errors []string) {
+func printParserErrors(out io.Writer, errors []*parser.ParseError) {
 	io.WriteString(out, "woops! We ran into some monkey business here!\n")
 	io.WriteString(out, " parser errors:\n")
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+	for _, err := range errors {
+		io.WriteString(out, err.Diagnostic()+"\n")
 	}
 }
@@ -0,0 +1,188 @@
+package repl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var engines = []string{EngineVM, EngineEvaluator}
+
+// Runs a session on engine with the lines of input, returning what it wrote.
+func runSession(engine string, lines ...string) string {
+	var out bytes.Buffer
+	Start(strings.NewReader(strings.Join(lines, "\n")+"\n"), &out, engine)
+	return out.String()
+}
+
+func assertContains(t *testing.T, engine, out string, expected ...string) {
+	t.Helper()
+	for _, s := range expected {
+		if !strings.Contains(out, s) {
+			t.Errorf("[%s] output doesn't contain %q. got=%q", engine, s, out)
+		}
+	}
+}
+
+func TestSwitchEngine(t *testing.T) {
+	for _, engine := range engines {
+		other := EngineEvaluator
+		if engine == EngineEvaluator {
+			other = EngineVM
+		}
+
+		out := runSession(engine,
+			"let x = 5;",
+			"const k = 1;",
+			"let add = fn(a, b) { a + b };",
+			"let mk = fn() { let n = 1; fn() { n } };",
+			"let c = mk();",
+			"let fs = [add];",
+			":engine "+other,
+			":engine",
+			"add(x, k)",
+			"mk()()",
+			":engine "+other,
+		)
+
+		assertContains(t, engine, out,
+			"switched to "+other+"\n",
+			" could not carry over c: it is a closure over local variables\n",
+			" could not carry over fs: it holds functions\n",
+			"running on "+other+"\n",
+			">> 6\n",
+			">> 1\n",
+			"already running on "+other+"\n",
+		)
+	}
+
+	// Functions defined on the engine switched to can be carried back.
+	out := runSession(EngineVM,
+		":engine eval",
+		"let double = fn(x) { x * 2 };",
+		":engine vm",
+		"double(4)",
+	)
+	assertContains(t, EngineVM, out, ">> 8\n")
+}
+
+func TestHasUnclosedBrackets(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1 + 2", false},
+		{"let f = fn(x) {", true},
+		{"let f = fn(x) {\n  x\n};", false},
+		{"[1, 2", true},
+		{"puts(", true},
+		{"{\"a\": [1, (2", true},
+		{"1)", false},
+		{"})", false},
+		{`"{"`, false},
+		{"// {", false},
+		{"`multi", true},
+		{"`multi\nline`", false},
+	}
+
+	for _, test := range tests {
+		if got := hasUnclosedBrackets(test.input); got != test.expected {
+			t.Errorf("hasUnclosedBrackets(%q) wrong. want=%t, got=%t", test.input, test.expected, got)
+		}
+	}
+}
+
+func TestMultilineInput(t *testing.T) {
+	for _, engine := range engines {
+		out := runSession(engine,
+			"let f = fn(x) {",
+			"  x * 2",
+			"};",
+			"f(4)",
+			"[1,",
+			"2]",
+		)
+
+		assertContains(t, engine, out,
+			PROMPT+CONTINUATION_PROMPT+CONTINUATION_PROMPT,
+			">> 8\n",
+			PROMPT+CONTINUATION_PROMPT+"[1, 2]\n",
+		)
+	}
+
+	// An input left incomplete at the end is still parsed, so its errors are
+	// reported.
+	out := runSession(EngineVM, "let x = [1,")
+	assertContains(t, EngineVM, out, "parser errors:")
+}
+
+func TestMetaCommands(t *testing.T) {
+	for _, engine := range engines {
+		out := runSession(engine,
+			":tokens 1 + 2",
+			":ast 1 + 2",
+			":bytecode 1 + 2",
+			"let x = 3;",
+			":tokens",
+			":help",
+			":nope",
+			":save",
+		)
+
+		assertContains(t, engine, out,
+			"1:1\tINT      \"1\"\n1:3\t+        \"+\"\n1:5\tINT      \"2\"\n1:6\tEOF      \"\"\n",
+			"Program\n  ExpressionStatement\n    InfixExpression +\n      Left: IntegerLiteral 1\n      Right: IntegerLiteral 2\n",
+			"OpConstant 0",
+			"1:1\tLET      \"let\"\n",
+			metaCommandHelp,
+			"unknown command :nope, try :help\n",
+			"usage: :save file\n",
+		)
+	}
+
+	// :bytecode sees the globals defined so far, without defining any.
+	for _, engine := range engines {
+		out := runSession(engine, "let x = 3;", ":bytecode let y = x;", "y")
+		assertContains(t, engine, out, "OpGetGlobal 0", "identifier not found: y")
+	}
+	out := runSession(EngineEvaluator, "let x = 1;", "const k = 2;", ":bytecode x + k", ":bytecode k = 3")
+	assertContains(t, EngineEvaluator, out, "OpGetGlobal 1\n", "OpGetGlobal 0\n", "cannot assign to constant: k")
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	for _, engine := range engines {
+		path := filepath.Join(t.TempDir(), "session.monkey")
+
+		out := runSession(engine,
+			"let a = 1;",
+			"let b = len(1);",
+			"let c = undefined;",
+			"let f = fn(x) {",
+			"  x + a",
+			"};",
+			":save "+path,
+		)
+		assertContains(t, engine, out, "saved 2 inputs to "+path+"\n")
+
+		// Only the inputs that ran without errors are saved, so that the
+		// file loads.
+		saved, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "let a = 1;\nlet f = fn(x) {\n  x + a\n};\n"
+		if string(saved) != want {
+			t.Errorf("[%s] wrong file saved. want=%q, got=%q", engine, want, saved)
+		}
+
+		for _, other := range engines {
+			out = runSession(other, ":load "+path, "f(2)", ":save "+path)
+			assertContains(t, other, out, ">> 3\n", "saved 2 inputs to "+path+"\n")
+		}
+
+		out = runSession(engine, ":load "+filepath.Join(t.TempDir(), "missing.monkey"))
+		assertContains(t, engine, out, "Woops! Could not load the file:")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/repl"
+	"monkey/types"
+	"monkey/vm"
+	"os"
+	"path/filepath"
+)
+
+const runUsage = "usage: monkey run [-engine=vm|eval] [-checked] [-trace] [-profile] script.monkey"
+
+// Implements `monkey run`, which executes a script file and returns the exit
+// code of the process: the code passed to `exit`, 1 if the script failed, or
+// 2 if it was invoked incorrectly. The engine defaults to the one chosen
+// before the command name.
+func runCommand(args []string, defaultEngine string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	engine := flags.String("engine", defaultEngine, "the engine to run the script with, vm or eval")
+	checked := flags.Bool("checked", false, checkedUsage)
+	var observe vmFlags
+	observe.register(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), runUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	if observe.set() && *engine != repl.EngineVM {
+		fmt.Fprintln(os.Stderr, "monkey: -trace and -profile need the vm engine")
+		return 2
+	}
+
+	path := flags.Arg(0)
+	program, ok := parseScript(path)
+	if !ok {
+		return 1
+	}
+
+	var result object.Object
+	switch *engine {
+	case repl.EngineVM:
+		comp := compiler.New()
+		comp.SetImportDir(filepath.Dir(path))
+		if err := comp.Compile(program); err != nil {
+			reportCompileError(path, err)
+			return 1
+		}
+		result = runCompiled(comp.Bytecode(), *checked, observe)
+	case repl.EngineEvaluator:
+		env := object.NewEnvironment()
+		env.SetImportDir(filepath.Dir(path))
+		env.SetCheckedArithmetic(*checked)
+		result = evaluator.Eval(program, env)
+	default:
+		fmt.Fprintf(os.Stderr, "monkey: unknown engine %q\n", *engine)
+		flags.Usage()
+		return 2
+	}
+
+	return exitCode(path, result)
+}
+
+// Turns the value a script ended with into the exit code of the process,
+// reporting errors on stderr.
+func exitCode(path string, result object.Object) int {
+	switch result := result.(type) {
+	case *object.Exit:
+		return int(result.Code)
+	case *object.Error:
+		if result.Line != 0 {
+			fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", path, result.Line, result.Column, result.Inspect())
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, result.Inspect())
+		}
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Reads and parses a script file, expands its macros and checks its type
+// annotations, reporting any errors on stderr.
+func parseScript(path string) (*ast.Program, bool) {
+	program, ok := readProgram(path)
+	if !ok {
+		return nil, false
+	}
+
+	env := object.NewEnvironment()
+	env.SetImportDir(filepath.Dir(path))
+	evaluator.DefineMacros(program, env)
+	expanded, expandErr := evaluator.ExpandMacros(program, env)
+	if expandErr != nil {
+		exitCode(path, expandErr)
+		return nil, false
+	}
+
+	// Values that don't match their type annotations are reported before
+	// the script runs, as parse errors are.
+	if errs := types.Check(expanded.(*ast.Program)); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", path, err)
+		}
+		return nil, false
+	}
+
+	return expanded.(*ast.Program), true
+}
+
+// Reads and parses a script file, reporting any errors on stderr. A file
+// with a .json extension holds a program written by `monkey ast`, or by
+// another tool, rather than source code.
+func readProgram(path string) (*ast.Program, bool) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "monkey: %s\n", err)
+		return nil, false
+	}
+
+	if filepath.Ext(path) == astExt {
+		node, err := ast.UnmarshalJSON(src)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			return nil, false
+		}
+		program, ok := node.(*ast.Program)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: not a program\n", path)
+			return nil, false
+		}
+		return program, true
+	}
+
+	p := parser.New(lexer.New(string(src)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		for _, err := range p.Errors() {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", path, err.Diagnostic())
+		}
+		return nil, false
+	}
+
+	return program, true
+}
+
+// Reports an error compiling the script at path on stderr, with a line for
+// each identifier that isn't defined. Errors in imported modules are already
+// prefixed with the module they are in.
+func reportCompileError(path string, err error) {
+	if arity, ok := err.(*compiler.ArityError); ok {
+		if arity.Module != "" {
+			fmt.Fprintln(os.Stderr, arity)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", path, arity)
+		}
+		return
+	}
+	undefined, ok := err.(*compiler.UndefinedError)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return
+	}
+	for _, ident := range undefined.Identifiers {
+		if ident.Module != "" {
+			fmt.Fprintln(os.Stderr, ident)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", path, ident)
+		}
+	}
+}
+
+// Runs compiled bytecode on the VM, returning the value it ended with.
+// Runtime errors are returned as *object.Error.
+func runCompiled(bytecode *compiler.Bytecode, checked bool, observe vmFlags) object.Object {
+	machine := vm.New(bytecode)
+	machine.SetCheckedArithmetic(checked)
+	if observe.trace {
+		machine.EnableTrace(os.Stderr)
+	}
+	if observe.profile {
+		machine.EnableProfiling()
+		defer func() { fmt.Fprint(os.Stderr, machine.Profile()) }()
+	}
+	err := machine.Run()
+	if exit, ok := err.(*object.Exit); ok {
+		return exit
+	}
+	if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+		return &object.Error{
+			Message: runtimeErr.Message,
+			Stack:   runtimeErr.Stack,
+			Line:    runtimeErr.Line,
+			Column:  runtimeErr.Column,
+		}
+	}
+	if err != nil {
+		return &object.Error{Message: err.Error()}
+	}
+
+	return machine.LastPoppedStackElem()
+}
+
+const checkedUsage = "fail on integer overflow instead of wrapping around"
+
+// Flags for watching the VM as it runs a program.
+type vmFlags struct {
+	trace   bool
+	profile bool
+}
+
+func (f *vmFlags) register(flags *flag.FlagSet) {
+	flags.BoolVar(&f.trace, "trace", false, "print every instruction the VM executes to stderr")
+	flags.BoolVar(&f.profile, "profile", false, "print where the VM spent its time to stderr")
+}
+
+func (f vmFlags) set() bool {
+	return f.trace || f.profile
+}
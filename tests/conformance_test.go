@@ -0,0 +1,376 @@
+// Package tests runs Monkey programs through both the tree-walking evaluator
+// and the compiler + VM, asserting that the two engines agree on the result
+// of every program.
+package tests
+
+import (
+	"bytes"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Runs a program and renders its result as a string that can be compared
+// across engines, or, if it failed, its error as failure, so that an error
+// can't pass for a value that reads the same. Anything the program prints is
+// returned as its output.
+type engine func(input string) (result, failure, output string)
+
+// Parses a program and expands its macros, which happens the same way for
+// both engines, returning the error expanding them failed with, if any.
+func parse(input string) (*ast.Program, *object.Error) {
+	program := parser.New(lexer.New(input)).ParseProgram()
+
+	env := object.NewEnvironment()
+	evaluator.DefineMacros(program, env)
+	expanded, err := evaluator.ExpandMacros(program, env)
+	if err != nil {
+		return nil, err
+	}
+	return expanded.(*ast.Program), nil
+}
+
+func runEvaluator(input string) (string, string, string) {
+	program, err := parse(input)
+	if err != nil {
+		return "", err.Message, ""
+	}
+
+	var out bytes.Buffer
+	env := object.NewEnvironment()
+	env.SetStdout(&out)
+
+	result := evaluator.Eval(program, env)
+	if err, ok := result.(*object.Error); ok {
+		return "", err.Message, out.String()
+	}
+	return render(result), "", out.String()
+}
+
+func runVM(input string) (string, string, string) {
+	program, expandErr := parse(input)
+	if expandErr != nil {
+		return "", expandErr.Message, ""
+	}
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if undefined, ok := err.(*compiler.UndefinedError); ok {
+		// The evaluator reports the first identifier it runs into, without
+		// its position.
+		return "", undefined.Identifiers[0].Message(), ""
+	}
+	if arity, ok := err.(*compiler.ArityError); ok {
+		return "", arity.Message(), ""
+	}
+	if err != nil {
+		return "", err.Error(), ""
+	}
+
+	var out bytes.Buffer
+	machine := vm.New(comp.Bytecode())
+	machine.SetStdout(&out)
+
+	err = machine.Run()
+	if exit, ok := err.(*object.Exit); ok {
+		return render(exit), "", out.String()
+	}
+	// Errors are compared by message only here, since only the VM knows
+	// where they happened; TestConformanceStackTraces compares the traces.
+	if err != nil {
+		return "", err.Error(), out.String()
+	}
+
+	if err, ok := machine.LastPoppedStackElem().(*object.Error); ok {
+		return "", err.Message, out.String()
+	}
+	return render(machine.LastPoppedStackElem()), "", out.String()
+}
+
+func render(obj object.Object) string {
+	if obj == nil {
+		return "<nil>"
+	}
+	return string(obj.Type()) + ": " + obj.Inspect()
+}
+
+func assertConformance(t *testing.T, input string) {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		for _, err := range p.Errors() {
+			t.Errorf("parser error: %s", err)
+		}
+		return
+	}
+
+	evaluated, evaluatedErr, evaluatedOut := runEvaluator(input)
+	executed, executedErr, executedOut := runVM(input)
+	if evaluated != executed {
+		t.Errorf("engines disagree.\nevaluator=%s\nvm=%s", evaluated, executed)
+	}
+	if evaluatedErr != executedErr {
+		t.Errorf("engines failed differently.\nevaluator=%q\nvm=%q",
+			evaluatedErr, executedErr)
+	}
+	if evaluatedOut != executedOut {
+		t.Errorf("engines printed different output.\nevaluator=%q\nvm=%q",
+			evaluatedOut, executedOut)
+	}
+}
+
+// Each program in testdata must end in an expression statement, so that
+// both engines produce its value as the result.
+func TestConformancePrograms(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.monkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no conformance programs found in testdata")
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertConformance(t, string(input))
+		})
+	}
+}
+
+func TestConformanceErrors(t *testing.T) {
+	tests := []string{
+		"5 + true;",
+		"5 + true; 5;",
+		"-true",
+		"-\"a\"",
+		"true + false;",
+		"1.5 + true",
+		"\"a\" + 1",
+		"\"Hello\" - \"World\"",
+		"foobar",
+		"5(1)",
+		"[1, 2][true]",
+		"5[1:2]",
+		"\"hello\"[\"a\":]",
+		"5 % 0",
+		"5.5 % 0",
+		"5 / 0",
+		"let f = fn(x) { 10 / x }; f(0)",
+		"fn() { 1; }(1);",
+		"fn(a) { a; }();",
+		"len(1)",
+		"len(\"one\", \"two\")",
+		"first(1)",
+		"last(1)",
+		"rest(1)",
+		"push(1, 1)",
+		"int(\"nope\")",
+		"int(1.0 / 0)",
+		"pow(3, 40)",
+		"sqrt(-1)",
+		"exit(300)",
+		"try { exit(-1) } catch (e) { e }",
+		"min()",
+		"range(1, 2, 0)",
+		"range(5000000)",
+		"let f = fn() { len(1) }; f();",
+
+		"let f = fn(x) { x + true }; f(1);",
+		"if (10 > 1) { if (10 > 1) { return true + false; } return 1; }",
+		"map([1], 5)",
+		"map(1, fn(x) { x })",
+		"map([1], fn() { 1 })",
+		"map([1, 2], fn(x) { x + true }); 5",
+		"filter([1], fn(x) { map([x], fn(y) { -true }) })",
+		"reduce([1, 2], 0, fn(acc, x) { len(x) })",
+		"sort([1, \"a\"])",
+		"sort([1, 2], fn(a, b) { a + true })",
+		"x = 5",
+		"len = 5",
+		"exit(3); 5",
+		"puts(1); exit(); puts(2)",
+		"let f = fn() { if (true) { exit(2) } 1 }; f() + 1",
+		"map([1, 2], fn(x) { puts(x); exit(x) }); 5",
+		"let i = 0; while (true) { i = i + 1; if (i > 2) { exit(i) } }",
+		"exit(\"a\")",
+
+		// Errors from builtins stop the program wherever they happen, and a
+		// try can catch them.
+		"len(1); puts(\"after\")",
+		"let f = fn() { int(\"abc\"); 1 }; puts(f()); 2",
+		"sleep(-5); 1",
+		"readFile(\"/nonexistent/file\"); 1",
+		"try { len(1); 5 } catch (e) { \"caught\" }",
+		"try { int(\"abc\") } catch (e) { e }",
+		"try { sleep(-5) } catch (e) { e }",
+		"try { readFile(\"/nonexistent/file\") } catch (e) { e }",
+		"try { len(1) } finally { puts(\"finally\") }; 1",
+		"map([1, \"a\"], fn(x) { try { len(x) } catch (e) { -1 } })",
+
+		// Returning from the top level ends the program with the value.
+		"return 5; 10",
+		"puts(1); return 2; puts(3)",
+		"let f = fn() { 1 }; if (f() == 1) { return \"early\" }; puts(\"late\"); 2",
+		"let i = 0; while (true) { i = i + 1; if (i > 2) { return i } }",
+		"try { return 1 } finally { puts(\"finally\") }",
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			assertConformance(t, input)
+		})
+	}
+}
+
+// Each time a block runs, the variables it defines are new ones, at the top
+// level as within functions, so closures made in a loop don't share them.
+func TestConformanceBlockScoping(t *testing.T) {
+	tests := []string{
+		"let fs = []; let i = 0; while (i < 3) { let j = i; fs = push(fs, fn() { j }); i = i + 1 }; map(fs, fn(f) { f() })",
+		"let fs = []; let i = 0; while (i < 2) { let n = i; fs = push(fs, fn() { n = n + 10; n }); n = n + 1; i = i + 1 }; [map(fs, fn(f) { f() }), map(fs, fn(f) { f() })]",
+		"let fs = []; let i = 0; while (i < 2) { let n = i; fs = push(fs, fn() { fn() { n } }); i = i + 1 }; map(fs, fn(f) { f()() })",
+		"if (true) { let a = 1; let inc = fn() { a = a + 1 }; inc(); inc(); a }",
+		"let f = if (true) { let a = 1; fn() { a } }; f()",
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			assertConformance(t, input)
+		})
+	}
+}
+
+// Renders the error a program fails with on the evaluator, stack trace and
+// all, or "" if it doesn't fail.
+func evaluatorTrace(input string) string {
+	program, err := parse(input)
+	if err != nil {
+		return err.Inspect()
+	}
+
+	env := object.NewEnvironment()
+	env.SetStdout(&bytes.Buffer{})
+	if err, ok := evaluator.Eval(program, env).(*object.Error); ok {
+		return err.Inspect()
+	}
+	return ""
+}
+
+// Renders the error a program fails with on the VM as the evaluator renders
+// its errors, or "" if it doesn't fail.
+func vmTrace(input string) string {
+	program, expandErr := parse(input)
+	if expandErr != nil {
+		return expandErr.Inspect()
+	}
+
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		return "compile error: " + err.Error()
+	}
+	machine := vm.New(comp.Bytecode())
+	machine.SetStdout(&bytes.Buffer{})
+	if err, ok := machine.Run().(*vm.RuntimeError); ok {
+		return (&object.Error{Message: err.Message, Stack: err.Stack}).Inspect()
+	}
+	return ""
+}
+
+// Both engines list the same calls in the stack traces of errors, collapsed
+// the same way when a call repeats.
+func TestConformanceStackTraces(t *testing.T) {
+	tests := []string{
+		"let f = fn(n) { 1 + f(n + 1) }; f(0)",
+		"let f = fn(n) { if (n == 0) { len(1) } else { 1 + f(n - 1) } }; f(5)",
+		"let f = fn(n) { if (n == 0) { len(1) } else { f(n - 1) } }; f(5)",
+		"let a = fn() { len(1) }; let b = fn() { a() }; b()",
+		"let h = fn(a) { a }; let g = fn() { let x = [h][0]; x() }; g()",
+		"let g = fn() { let x = [fn(a) { a }][0]; x() }; g()",
+		"map([1], fn(x) { x + true })",
+		"map([1], fn() { 1 })",
+		"let f = fn(a, b = len(1)) { a }; f(1)",
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			evaluated, executed := evaluatorTrace(input), vmTrace(input)
+			if evaluated == "" {
+				t.Fatalf("program didn't fail")
+			}
+			if evaluated != executed {
+				t.Errorf("engines disagree.\nevaluator=%q\nvm=%q", evaluated, executed)
+			}
+		})
+	}
+}
+
+func TestEnginesUnderTest(t *testing.T) {
+	engines := map[string]engine{
+		"evaluator": runEvaluator,
+		"vm":        runVM,
+	}
+
+	for name, run := range engines {
+		if got, _, _ := run("1 + 2"); got != "INTEGER: 3" {
+			t.Errorf("%s: wrong result. got=%q, want=%q", name, got, "INTEGER: 3")
+		}
+		if got, failure, _ := run("1 + true"); got != "" || failure != "type mismatch: INTEGER + BOOLEAN" {
+			t.Errorf("%s: wrong error. got=%q %q", name, got, failure)
+		}
+		if got, failure, _ := run(`"type mismatch: INTEGER + BOOLEAN"`); failure != "" {
+			t.Errorf("%s: value reported as an error. got=%q %q", name, got, failure)
+		}
+		if _, _, out := run(`puts("a", 1); print("b", 2)`); out != "a\n1\nb 2" {
+			t.Errorf("%s: wrong output. got=%q", name, out)
+		}
+	}
+}
+
+// The programs in testdata are encoded as JSON and decoded again without
+// changing them, so tools can rewrite them through the JSON form.
+func TestASTJSONRoundTrip(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.monkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			program := parser.New(lexer.New(string(input))).ParseProgram()
+
+			data, err := ast.MarshalJSON(program)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := ast.UnmarshalJSON(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := ast.MarshalJSON(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Errorf("program changed by decoding it.\nwant=%s\ngot= %s", data, again)
+			}
+		})
+	}
+}
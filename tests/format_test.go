@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"monkey/lexer"
+	"monkey/parser"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func format(t *testing.T, input string) string {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program.Format()
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let   x=1+2*3", "let x = 1 + 2 * 3;\n"},
+		{"const x = (1 + 2) * 3;;", "const x = (1 + 2) * 3;\n"},
+		{"puts(1)\nputs(2)", "puts(1);\nputs(2)\n"},
+		{"let a = 1;\n\n\n\nlet b = 2;\nlet c = 3;", "let a = 1;\n\nlet b = 2;\nlet c = 3;\n"},
+		{"let f = fn(x) { x * 2 };", "let f = fn(x) { x * 2 };\n"},
+		{"let f = fn(x) { let y = x; y * 2 };", "let f = fn(x) { let y = x; y * 2 };\n"},
+		{
+			"let f = fn(x) {\nx * 2\n};",
+			"let f = fn(x) {\n  x * 2\n};\n",
+		},
+		{
+			"if (a) { b } else { if (c) { d } else { e } }",
+			"if (a) { b } else if (c) { d } else { e }\n",
+		},
+		{
+			"while (i < 3) {\ni = i + 1;\n}\nlet x = 1;",
+			"while (i < 3) {\n  i = i + 1\n}\nlet x = 1;\n",
+		},
+		{
+			// A parenthesis after the loop would be read as calling it.
+			"while (false) { 1 };\n(a + b) * 2",
+			"while (false) { 1 };\n(a + b) * 2\n",
+		},
+		{
+			"while (false) { 1 };\n-2",
+			"while (false) { 1 };\n-2\n",
+		},
+		{
+			"try {\nf()\n} catch {\ng()\n} finally { h() }",
+			"try {\n  f()\n} catch {\n  g()\n} finally { h() }\n",
+		},
+		{"try { f() } catch (e) { throw e; }", "try { f() } catch (e) { throw e; }\n"},
+		{"let [a,b] = [1,2]; let {\"x\":x} = h;", "let [a, b] = [1, 2];\nlet {\"x\": x} = h;\n"},
+		{`{"b": 1, "a": 2, 3: [1,2]}`, "{\"b\": 1, \"a\": 2, 3: [1, 2]}\n"},
+		{"[\n1, 2,\n3]", "[\n  1,\n  2,\n  3\n]\n"},
+		{"f(\na, fn() {\nb\n})", "f(\n  a,\n  fn() {\n    b\n  }\n)\n"},
+		{"map(xs, fn(x) {\nx\n})", "map(xs, fn(x) {\n  x\n})\n"},
+		{`import "std/strings"; import "./util.monkey" as u; import "lib/util.monkey" as util;`,
+			"import \"std/strings\";\nimport \"./util.monkey\" as u;\nimport \"lib/util.monkey\";\n"},
+		{"0xFF + 1_000 + 2.50", "0xFF + 1_000 + 2.50\n"},
+		{"\"a\\tb\" + `c\\d`", "\"a\\tb\" + `c\\d`\n"},
+		{"fn(a, b = 1, ...c) { }", "fn(a, b = 1, ...c) {}\n"},
+		{"let x:int=5; fn(a:int,b:str=\"\")->str { b }", "let x: int = 5;\nfn(a: int, b: str = \"\") -> str { b }\n"},
+		{"let m = macro(a) { quote(unquote(a)) };", "let m = macro(a) { quote(unquote(a)) };\n"},
+		{"a ? b : c ? d : e", "a ? b : c ? d : e\n"},
+		{"(a ? b : c) ? d : e", "(a ? b : c) ? d : e\n"},
+		{"x = y = 1", "x = y = 1\n"},
+		{"-(-a) + !(!b) - 2 ** -1", "--a + !!b - 2 ** -1\n"},
+		{"(a.b)[1:](c)[:2][0]", "a.b[1:](c)[:2][0]\n"},
+		{"", ""},
+		{"// a\n\n// b\nlet x = 1;  // c\n// d", "// a\n\n// b\nlet x = 1; // c\n// d\n"},
+		{
+			"let f = fn() { // a\n// b\n\nx // c\n// d\n} // e",
+			"let f = fn() { // a\n  // b\n\n  x // c\n  // d\n}; // e\n",
+		},
+		{"fn() {\n// a\n}", "fn() {\n  // a\n}\n"},
+		{"[\n// a\n1, // b\n2 // c\n]", "[\n  // a\n  1, // b\n  2 // c\n]\n"},
+		{"let x = 1 + // a\n2;", "let x = 1 + 2;\n// a\n"},
+	}
+
+	for _, tt := range tests {
+		formatted := format(t, tt.input)
+		if formatted != tt.expected {
+			t.Errorf("wrong format of %q.\nwant=%q\ngot= %q", tt.input, tt.expected, formatted)
+		}
+		if again := format(t, formatted); again != formatted {
+			t.Errorf("formatting %q again changed it.\nwant=%q\ngot= %q", tt.input, formatted, again)
+		}
+	}
+}
+
+// Formatting the programs in testdata leaves them meaning the same, and
+// formatting them again doesn't change them.
+func TestFormatPrograms(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.monkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			input, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			formatted := format(t, string(input))
+			if again := format(t, formatted); again != formatted {
+				t.Errorf("formatting again changed the program.\nwant=%s\ngot= %s", formatted, again)
+			}
+
+			for name, run := range map[string]engine{"evaluator": runEvaluator, "vm": runVM} {
+				want, wantErr, wantOut := run(string(input))
+				got, gotErr, gotOut := run(formatted)
+				if got != want || gotErr != wantErr || gotOut != wantOut {
+					t.Errorf("%s: formatted program behaves differently.\nwant=%q %q %q\ngot= %q %q %q",
+						name, want, wantErr, wantOut, got, gotErr, gotOut)
+				}
+			}
+		})
+	}
+}
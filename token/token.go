@@ -5,16 +5,22 @@ type TokenType string
 type Token struct {
 	Type    TokenType
 	Literal string
+	Line    int // line of the token's first character, starting at 1
+	Column  int // column of the token's first character, starting at 1
 }
 
 const (
 	ILLEGAL = "ILLEGAL"
 	EOF     = "EOF"
+	ERROR   = "ERROR"   // Malformed input, such as an unterminated string; the literal says what is wrong.
+	COMMENT = "COMMENT" // From // to the end of the line; the lexer skips these, but keeps them for tools.
 
 	// Identifiers + literals
-	IDENT  = "IDENT" // add, foobar, x, y, ...
-	INT    = "INT"
-	STRING = "STRING"
+	IDENT      = "IDENT" // add, foobar, x, y, ...
+	INT        = "INT"
+	FLOAT      = "FLOAT"
+	STRING     = "STRING"
+	RAW_STRING = "RAW_STRING" // `...`, which is read like a STRING
 
 	// Operators
 	ASSIGN   = "="
@@ -22,11 +28,23 @@ const (
 	MINUS    = "-"
 	BANG     = "!"
 	ASTERISK = "*"
+	POWER    = "**"
 	SLASH    = "/"
+	PERCENT  = "%"
 	LT       = "<"
 	GT       = ">"
+	LT_EQ    = "<="
+	GT_EQ    = ">="
 	EQ       = "=="
 	NOT_EQ   = "!="
+	AND      = "&&"
+	OR       = "||"
+
+	BIT_AND     = "&"
+	BIT_OR      = "|"
+	BIT_XOR     = "^"
+	SHIFT_LEFT  = "<<"
+	SHIFT_RIGHT = ">>"
 
 	// Delimiters
 	COMMA     = ","
@@ -39,25 +57,47 @@ const (
 	LBRACKET = "["
 	RBRACKET = "]"
 	COLON    = ":"
+	QUESTION = "?"
+	DOT      = "."
+	ELLIPSIS = "..."
+	ARROW    = "->"
 
 	// Keywords
 	FUNCTION = "FUNCTION"
 	LET      = "LET"
+	CONST    = "CONST"
 	TRUE     = "TRUE"
 	FALSE    = "FALSE"
+	NULL     = "NULL"
 	IF       = "IF"
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
+	WHILE    = "WHILE"
+	IMPORT   = "IMPORT"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	FINALLY  = "FINALLY"
+	THROW    = "THROW"
+	MACRO    = "MACRO"
 )
 
 var keywords = map[string]TokenType{
-	"fn":     FUNCTION,
-	"let":    LET,
-	"true":   TRUE,
-	"false":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
+	"fn":      FUNCTION,
+	"let":     LET,
+	"const":   CONST,
+	"true":    TRUE,
+	"false":   FALSE,
+	"null":    NULL,
+	"if":      IF,
+	"else":    ELSE,
+	"return":  RETURN,
+	"while":   WHILE,
+	"import":  IMPORT,
+	"try":     TRY,
+	"catch":   CATCH,
+	"finally": FINALLY,
+	"throw":   THROW,
+	"macro":   MACRO,
 }
 
 func LookupIdent(ident string) TokenType {
@@ -0,0 +1,420 @@
+package types
+
+import (
+	"fmt"
+	"monkey/ast"
+)
+
+// A variable, with the type it is declared as or was inferred to have.
+type variable struct {
+	typ      typ
+	declared bool // its type is annotated, so values assigned to it are checked
+}
+
+// A function, block or program, with the same scoping as the compiler: a
+// function's parameters and body share a scope, and every other block has
+// one of its own.
+type scope struct {
+	outer *scope
+	names map[string]*variable
+}
+
+func (s *scope) lookup(name string) *variable {
+	for ; s != nil; s = s.outer {
+		if v, ok := s.names[name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// The function whose body is being checked, which its returns are checked
+// against.
+type context struct {
+	name   string // "" for a function that isn't bound to a name
+	result typ    // nil unless annotated
+}
+
+type checker struct {
+	scope *scope
+	fn    *context
+	// The names assigned to anywhere in the program, whose variables can
+	// hold values of other types than they started with, unless declared.
+	assigned map[string]bool
+	errors   []Error
+}
+
+func (c *checker) errorf(node ast.Node, format string, args ...interface{}) {
+	tok := ast.StartOf(node)
+	c.errors = append(c.errors, Error{
+		Line:    tok.Line,
+		Column:  tok.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Reports an error if value, of type t, doesn't match declared, in the
+// context described by where, as in "declaration of x".
+func (c *checker) match(value ast.Node, t, declared typ, where string) {
+	if !assignable(t, declared) {
+		c.errorf(value, "cannot use %s as %s in %s", t, declared, where)
+	}
+}
+
+// Returns the type annotation names, reporting it if there is no such type,
+// or nil if there is no annotation.
+func (c *checker) annotation(annotation *ast.TypeAnnotation) typ {
+	if annotation == nil {
+		return nil
+	}
+	b, ok := basics[annotation.Name]
+	if !ok {
+		c.errorf(annotation, "unknown type: %s", annotation.Name)
+		return anyType
+	}
+	return b
+}
+
+// Declares name in the innermost scope, as declared if it is, or else
+// inferred to have type t, unless it is assigned to somewhere.
+func (c *checker) declare(name *ast.Identifier, t typ, declared bool) {
+	if name == nil {
+		return
+	}
+	if !declared && c.assigned[name.Value] {
+		t = anyType
+	}
+	c.scope.names[name.Value] = &variable{typ: t, declared: declared}
+}
+
+func (c *checker) open() {
+	c.scope = &scope{outer: c.scope, names: map[string]*variable{}}
+}
+
+func (c *checker) close() {
+	c.scope = c.scope.outer
+}
+
+func (c *checker) statements(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		c.statement(stmt)
+	}
+}
+
+func (c *checker) statement(stmt ast.Statement) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		// The value can't refer to the name, unless it is a function, which
+		// binds its own name within itself.
+		t := c.expression(stmt.Value)
+		if declared := c.annotation(stmt.Annotation); declared != nil {
+			c.match(stmt.Value, t, declared, "declaration of "+stmt.Name.Value)
+			// A function that is only ever bound to the name keeps the
+			// types of its parameters, so that calls of it are checked.
+			if _, ok := t.(*function); ok && declared == fnType && !c.assigned[stmt.Name.Value] {
+				declared = t
+			}
+			c.declare(stmt.Name, declared, true)
+		} else {
+			c.declare(stmt.Name, t, false)
+		}
+
+	case *ast.DestructuringLetStatement:
+		c.expressions(stmt.Keys)
+		c.expression(stmt.Value)
+		for _, name := range stmt.Names {
+			c.declare(name, anyType, false)
+		}
+
+	case *ast.ImportStatement:
+		c.declare(stmt.Name, hashType, false)
+
+	case *ast.ReturnStatement:
+		t := c.expression(stmt.ReturnValue)
+		if c.fn != nil && c.fn.result != nil {
+			c.match(stmt.ReturnValue, t, c.fn.result, c.fn.returnFrom())
+		}
+
+	case *ast.ThrowStatement:
+		c.expression(stmt.Value)
+
+	case *ast.ExpressionStatement:
+		c.expression(stmt.Expression)
+	}
+}
+
+// Describes a return from the function, as in "return from f".
+func (fn *context) returnFrom() string {
+	if fn.name == "" {
+		return "return"
+	}
+	return "return from " + fn.name
+}
+
+// Checks the statements of block in a scope of their own, returning the
+// type of the value the block ends with.
+func (c *checker) block(block *ast.BlockStatement) typ {
+	if block == nil {
+		return nullType
+	}
+	c.open()
+	defer c.close()
+	return c.body(block.Statements)
+}
+
+// Checks stmts, returning the type of the value they end with, if the last
+// is an expression, or else any. No statements end with null.
+func (c *checker) body(stmts []ast.Statement) typ {
+	var t typ = nullType
+	for _, stmt := range stmts {
+		if expr, ok := stmt.(*ast.ExpressionStatement); ok {
+			t = c.expression(expr.Expression)
+			continue
+		}
+		c.statement(stmt)
+		t = anyType
+	}
+	return t
+}
+
+func (c *checker) expressions(exprs []ast.Expression) []typ {
+	types := make([]typ, len(exprs))
+	for i, expr := range exprs {
+		types[i] = c.expression(expr)
+	}
+	return types
+}
+
+// Checks expr, returning its type.
+func (c *checker) expression(expr ast.Expression) typ {
+	switch expr := expr.(type) {
+	case nil:
+		return nullType
+	case *ast.IntegerLiteral:
+		return intType
+	case *ast.FloatLiteral:
+		return floatType
+	case *ast.StringLiteral:
+		return strType
+	case *ast.Boolean:
+		return boolType
+	case *ast.NullLiteral:
+		return nullType
+
+	case *ast.ArrayLiteral:
+		c.expressions(expr.Elements)
+		return arrayType
+
+	case *ast.HashLiteral:
+		for _, key := range ast.SortedKeys(expr) {
+			c.expression(key)
+			c.expression(expr.Pairs[key])
+		}
+		return hashType
+
+	case *ast.Identifier:
+		if v := c.scope.lookup(expr.Value); v != nil {
+			return v.typ
+		}
+		if t := builtin(expr.Value); t != nil {
+			return t
+		}
+		return anyType
+
+	case *ast.AssignExpression:
+		t := c.expression(expr.Value)
+		if v := c.scope.lookup(expr.Name.Value); v != nil && v.declared {
+			c.match(expr.Value, t, v.typ, "assignment to "+expr.Name.Value)
+		}
+		return t
+
+	case *ast.PrefixExpression:
+		return prefixType(expr.Operator, c.expression(expr.Right))
+
+	case *ast.InfixExpression:
+		left := c.expression(expr.Left)
+		right := c.expression(expr.Right)
+		return infixType(expr.Operator, left, right)
+
+	case *ast.IfExpression:
+		c.expression(expr.Condition)
+		consequence := c.block(expr.Consequence)
+		alternative := c.block(expr.Alternative)
+		return join(consequence, alternative)
+
+	case *ast.ConditionalExpression:
+		c.expression(expr.Condition)
+		consequence := c.expression(expr.Consequence)
+		alternative := c.expression(expr.Alternative)
+		return join(consequence, alternative)
+
+	case *ast.WhileExpression:
+		c.expression(expr.Condition)
+		c.block(expr.Body)
+		return anyType
+
+	case *ast.TryExpression:
+		c.block(expr.Body)
+		if expr.Catch != nil {
+			// The parameter is only visible within the catch.
+			c.open()
+			c.declare(expr.Param, anyType, false)
+			c.body(expr.Catch.Statements)
+			c.close()
+		}
+		c.block(expr.Finally)
+		return anyType
+
+	case *ast.IndexExpression:
+		c.expression(expr.Left)
+		c.expression(expr.Index)
+		return anyType
+
+	case *ast.SliceExpression:
+		left := c.expression(expr.Left)
+		c.expression(expr.Start)
+		c.expression(expr.End)
+		if left == strType || left == arrayType {
+			return left
+		}
+		return anyType
+
+	case *ast.MemberExpression:
+		c.expression(expr.Left)
+		return anyType
+
+	case *ast.FunctionLiteral:
+		return c.function(expr)
+
+	case *ast.CallExpression:
+		return c.call(expr)
+
+	default:
+		// Macros, which are expanded before programs are checked.
+		return anyType
+	}
+}
+
+// Checks a function literal, returning its type. Its parameters are
+// declared as annotated, and its returns, and the value its body ends with,
+// are checked against its result.
+func (c *checker) function(fn *ast.FunctionLiteral) typ {
+	t := &function{result: c.annotation(fn.ReturnType)}
+	for i := range fn.Parameters {
+		param := c.annotation(fn.ParameterType(i))
+		if param == nil {
+			param = anyType
+		}
+		t.params = append(t.params, param)
+	}
+
+	c.open()
+	defer c.close()
+
+	result := t.result
+	if result == nil {
+		t.result = anyType
+	}
+	if fn.Name != "" {
+		c.declare(&ast.Identifier{Value: fn.Name}, t, false)
+	}
+
+	// Each default value can refer to the parameters before it.
+	firstDefault := len(fn.Parameters) - len(fn.Defaults)
+	for i, param := range fn.Parameters {
+		if i >= firstDefault {
+			value := fn.Defaults[i-firstDefault]
+			c.match(value, c.expression(value), t.params[i], "default value of "+param.Value)
+		}
+		c.declare(param, t.params[i], fn.ParameterType(i) != nil)
+	}
+	c.declare(fn.Rest, arrayType, false)
+
+	outer := c.fn
+	c.fn = &context{name: fn.Name, result: result}
+	defer func() { c.fn = outer }()
+
+	if fn.Body != nil {
+		end := c.body(fn.Body.Statements)
+		if result != nil && len(fn.Body.Statements) > 0 {
+			last := fn.Body.Statements[len(fn.Body.Statements)-1]
+			if stmt, ok := last.(*ast.ExpressionStatement); ok {
+				c.match(stmt.Expression, end, result, c.fn.returnFrom())
+			}
+		}
+	}
+	return t
+}
+
+// Checks a call, returning the type of its result. The arguments to a
+// function with annotated parameters are checked against them.
+func (c *checker) call(call *ast.CallExpression) typ {
+	callee := c.expression(call.Function)
+	args := c.expressions(call.Arguments)
+
+	fn, ok := callee.(*function)
+	if !ok {
+		return anyType
+	}
+	name := "function"
+	if ident, ok := call.Function.(*ast.Identifier); ok {
+		name = ident.Value
+	}
+	for i, arg := range args {
+		if i < len(fn.params) {
+			c.match(call.Arguments[i], arg, fn.params[i], fmt.Sprintf("argument %d to %s", i+1, name))
+		}
+	}
+	return fn.result
+}
+
+// Returns the type of the result of a prefix operator applied to a value
+// of type right.
+func prefixType(op string, right typ) typ {
+	switch {
+	case op == "!":
+		return boolType
+	case op == "-" && (right == intType || right == floatType):
+		return right
+	case op == "~" && right == intType:
+		return intType
+	default:
+		return anyType
+	}
+}
+
+// Returns the type of the result of an infix operator applied to values of
+// types left and right, or any if it isn't known.
+func infixType(op string, left, right typ) typ {
+	switch op {
+	case "==", "!=", "<", ">", "<=", ">=", "&&", "||":
+		return boolType
+	}
+
+	numeric := func(t typ) bool { return t == intType || t == floatType }
+	switch {
+	case left == intType && right == intType && op != "**":
+		// Negative powers of integers are floats.
+		return intType
+	case numeric(left) && numeric(right) && (left == floatType || right == floatType):
+		return floatType
+	case left == strType && right == strType && op == "+":
+		return strType
+	case left == arrayType && right == arrayType && op == "+":
+		return arrayType
+	default:
+		return anyType
+	}
+}
+
+// Returns the names program assigns to anywhere within it.
+func assignedNames(program *ast.Program) map[string]bool {
+	names := map[string]bool{}
+	ast.Inspect(program, func(node ast.Node) bool {
+		if assign, ok := node.(*ast.AssignExpression); ok && assign.Name != nil {
+			names[assign.Name.Value] = true
+		}
+		return true
+	})
+	return names
+}
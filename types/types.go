@@ -0,0 +1,153 @@
+// Package types checks the type annotations of Monkey programs, as in
+// `let x: int = 5;` or `fn(a: int, b: str) -> str { ... }`, reporting the
+// values that don't match them before the program runs.
+//
+// Annotations are optional, and code without them isn't checked: a value
+// whose type can't be known without running the program, such as the
+// result of indexing an array, matches any annotation.
+package types
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/object"
+	"sort"
+	"strings"
+)
+
+// A value that doesn't match the annotation it is checked against, or an
+// annotation naming a type that doesn't exist.
+type Error struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// Checks the values of program against its annotations, returning every
+// mismatch in the order it appears in the source. A program without
+// annotations has none.
+func Check(program *ast.Program) []Error {
+	c := &checker{
+		scope:    &scope{names: map[string]*variable{}},
+		assigned: assignedNames(program),
+	}
+	c.statements(program.Statements)
+
+	sort.SliceStable(c.errors, func(i, j int) bool {
+		a, b := c.errors[i], c.errors[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return c.errors
+}
+
+// The type of a value, as far as it can be known without running the
+// program.
+type typ interface {
+	String() string
+}
+
+// A type that is named in annotations, like int.
+type basic string
+
+func (b basic) String() string { return string(b) }
+
+const (
+	anyType   basic = "any" // whatever the value is, which isn't checked
+	intType   basic = "int"
+	floatType basic = "float"
+	strType   basic = "str"
+	boolType  basic = "bool"
+	nullType  basic = "null"
+	arrayType basic = "array"
+	hashType  basic = "hash"
+	fnType    basic = "fn" // any function or builtin
+)
+
+// The types annotations can name, by name.
+var basics = map[string]basic{}
+
+func init() {
+	for _, b := range []basic{anyType, intType, floatType, strType, boolType, nullType, arrayType, hashType, fnType} {
+		basics[string(b)] = b
+	}
+}
+
+// The type of a function literal, from its annotations, or of a builtin.
+type function struct {
+	params []typ // nil for a builtin, whose arguments aren't checked
+	result typ
+}
+
+func (f *function) String() string {
+	params := make([]string, len(f.params))
+	for i, param := range f.params {
+		params[i] = param.String()
+	}
+	return fmt.Sprintf("fn(%s) -> %s", strings.Join(params, ", "), f.result)
+}
+
+// Reports whether a value of type value matches the annotated type
+// declared. A value of an unknown type matches any annotation.
+func assignable(value, declared typ) bool {
+	if value == anyType || declared == anyType || value == declared {
+		return true
+	}
+	if declared == fnType {
+		_, ok := value.(*function)
+		return ok
+	}
+	return false
+}
+
+// Returns the type values of both a and b have, or any if they differ.
+func join(a, b typ) typ {
+	if a == b {
+		return a
+	}
+	return anyType
+}
+
+// The results of the builtins that always return the same type, unless
+// they fail.
+var builtinResults = map[string]typ{
+	"len":      intType,
+	"puts":     nullType,
+	"print":    nullType,
+	"push":     arrayType,
+	"split":    arrayType,
+	"join":     strType,
+	"replace":  strType,
+	"trim":     strType,
+	"upper":    strType,
+	"lower":    strType,
+	"contains": boolType,
+	"map":      arrayType,
+	"filter":   arrayType,
+	"sort":     arrayType,
+	"keys":     arrayType,
+	"values":   arrayType,
+	"hasKey":   boolType,
+	"delete":   hashType,
+	"merge":    hashType,
+	"type":     strType,
+	"int":      intType,
+	"str":      strType,
+	"sqrt":     floatType,
+	"range":    arrayType,
+}
+
+// Returns the type of the builtin called name, or nil if there is none.
+func builtin(name string) typ {
+	if object.GetBuiltinByName(name) == nil {
+		return nil
+	}
+	result, ok := builtinResults[name]
+	if !ok {
+		result = anyType
+	}
+	return &function{result: result}
+}
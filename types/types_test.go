@@ -0,0 +1,121 @@
+package types
+
+import (
+	"monkey/lexer"
+	"monkey/parser"
+	"reflect"
+	"testing"
+)
+
+func check(t *testing.T, input string) []string {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	errors := []string{}
+	for _, err := range Check(program) {
+		errors = append(errors, err.Error())
+	}
+	return errors
+}
+
+func testCheck(t *testing.T, tests []struct {
+	input    string
+	expected []string
+}) {
+	t.Helper()
+
+	for _, tt := range tests {
+		errors := check(t, tt.input)
+		if !reflect.DeepEqual(errors, tt.expected) {
+			t.Errorf("wrong errors for %q.\nwant=%q\ngot= %q", tt.input, tt.expected, errors)
+		}
+	}
+}
+
+func TestDeclarations(t *testing.T) {
+	testCheck(t, []struct {
+		input    string
+		expected []string
+	}{
+		{"let x: int = 5;", []string{}},
+		{`let x: int = "5";`, []string{"1:14: cannot use str as int in declaration of x"}},
+		{"const x: float = 1;", []string{"1:18: cannot use int as float in declaration of x"}},
+		{"let x: float = 1.0 * 2;", []string{}},
+		{"let x: str = \"a\" + \"b\";", []string{}},
+		{"let x: bool = 1 < 2;", []string{}},
+		{"let x: null = null; let y: array = [1]; let z: hash = {};", []string{}},
+		{"let f: fn = fn() { 1 }; let g: fn = len;", []string{}},
+		{"let f: fn = 1;", []string{"1:13: cannot use int as fn in declaration of f"}},
+		{"let x: any = 1; x = \"a\";", []string{}},
+		{"let x: num = 1;", []string{"1:8: unknown type: num"}},
+		// Values whose types can't be known match any annotation.
+		{"let x: int = [1][0];", []string{}},
+		{"let x: int = if (a) { 1 };", []string{}},
+		{"let x: int = if (a) { 1 } else { 2 };", []string{}},
+		{"let x: int = a ? 1 : \"b\";", []string{}},
+		{"let x: int = a ? \"a\" : \"b\";", []string{"1:14: cannot use str as int in declaration of x"}},
+		{"let x: int = len(\"abc\"); let y: int = first([1]);", []string{}},
+		{"let x: int = upper(\"a\");", []string{"1:14: cannot use str as int in declaration of x"}},
+	})
+}
+
+func TestVariables(t *testing.T) {
+	testCheck(t, []struct {
+		input    string
+		expected []string
+	}{
+		{"let x: int = 1; x = 2;", []string{}},
+		{"let x: int = 1; x = \"a\";", []string{"1:21: cannot use str as int in assignment to x"}},
+		// The types of variables without annotations are inferred.
+		{"let a = \"a\"; let x: int = a;", []string{"1:27: cannot use str as int in declaration of x"}},
+		{"let a = 1; let x: int = a + 1;", []string{}},
+		// Unless they are assigned to, when they could hold anything.
+		{"let a = \"a\"; a = 1; let x: int = a;", []string{}},
+		{"let a = \"a\"; let f = fn() { a = 1 }; let x: int = a;", []string{}},
+		{"let x = 1; if (true) { let x = \"a\"; let y: str = x; }", []string{}},
+		{"let x = 1; fn(x) { let y: str = x; }", []string{}},
+		{"let x = \"a\"; let len = fn() { x }; let y: int = len();", []string{}},
+	})
+}
+
+func TestFunctions(t *testing.T) {
+	testCheck(t, []struct {
+		input    string
+		expected []string
+	}{
+		{"let f = fn(a: int) { a }; f(1);", []string{}},
+		{"let f = fn(a: int) { a }; f(\"1\");", []string{"1:29: cannot use str as int in argument 1 to f"}},
+		{"fn(a, b: str) { a }(1, 2)", []string{"1:24: cannot use int as str in argument 2 to function"}},
+		{"let f: fn = fn(a: int) { a }; f(true);", []string{"1:33: cannot use bool as int in argument 1 to f"}},
+		{"let f = fn(a: int, ...r) { a }; f(1, \"x\", \"y\");", []string{}},
+		{"let f = fn(a: int) { a }; f = len; f(\"a\");", []string{}},
+		{"fn(a: int = \"a\") { a }", []string{"1:13: cannot use str as int in default value of a"}},
+		{"fn(a: int) { a = \"a\" }", []string{"1:18: cannot use str as int in assignment to a"}},
+		{"fn(a: int) { let b: str = a; }", []string{"1:27: cannot use int as str in declaration of b"}},
+		{"fn(a: pair) { a }", []string{"1:7: unknown type: pair"}},
+		// Within itself, by its name.
+		{"let f = fn(n: int) { f(\"n\") };", []string{"1:24: cannot use str as int in argument 1 to f"}},
+	})
+}
+
+func TestResults(t *testing.T) {
+	testCheck(t, []struct {
+		input    string
+		expected []string
+	}{
+		{"fn() -> int { 1 }", []string{}},
+		{"fn() -> int { \"a\" }", []string{"1:15: cannot use str as int in return"}},
+		{"let f = fn() -> str { return 1; };", []string{"1:30: cannot use int as str in return from f"}},
+		{"let f = fn(x) -> str { if (x) { return \"a\"; } 1 };", []string{"1:47: cannot use int as str in return from f"}},
+		{"fn() -> str { fn() { 1 } }", []string{"1:15: cannot use fn() -> any as str in return"}},
+		{"fn() -> str { let f = fn() { return 1; }; \"a\" }", []string{}},
+		{"fn() -> int { while (true) { return 1; } }", []string{}},
+		{"let f = fn() -> int { 1 }; let x: str = f();", []string{"1:41: cannot use int as str in declaration of x"}},
+		{"let f = fn() { 1 }; let x: str = f();", []string{}},
+	})
+}
@@ -0,0 +1,224 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"monkey/code"
+	"monkey/object"
+)
+
+// Stands for the main program where a function's index in the constant pool
+// is expected.
+const MainFunction = -1
+
+// Returned by Run when it reaches a breakpoint, before the instruction at
+// the breakpoint is executed. Run or Step continue from there.
+type Breakpoint struct {
+	Function int // Index of the function in the constant pool, or MainFunction.
+	IP       int // Offset of the instruction in the function.
+}
+
+func (b *Breakpoint) Error() string {
+	if b.Function == MainFunction {
+		return fmt.Sprintf("breakpoint at main %04d", b.IP)
+	}
+	return fmt.Sprintf("breakpoint at constant %d %04d", b.Function, b.IP)
+}
+
+// Returned from run once Step has executed its instruction.
+var errStepped = errors.New("stepped")
+
+// Executes the next instruction and stops, ignoring breakpoints. Stepping
+// over a call enters the function called, so that the next Step executes
+// its first instruction, but Monkey functions called back from builtins
+// like `map` run to completion within the step that calls the builtin.
+// Step does nothing once the program has finished.
+func (vm *VM) Step() error {
+	if vm.Finished() {
+		return nil
+	}
+
+	vm.stepping = true
+	vm.stepped = false
+	err := vm.run(0)
+	vm.stepping = false
+
+	if err == errStepped {
+		return nil
+	}
+	return vm.runtimeError(err)
+}
+
+// Reports whether the main program has run to its end.
+func (vm *VM) Finished() bool {
+	main := &vm.frames[0]
+	return vm.framesIndex == 1 && main.ip >= len(main.Instructions())-1
+}
+
+// Makes Run stop before executing the instruction at offset ip of the
+// function at index fn in the constant pool, or of the main program if fn
+// is MainFunction. Functions called back from builtins don't stop at
+// breakpoints, nor do those run with Call.
+func (vm *VM) SetBreakpoint(fn, ip int) error {
+	compiled, err := vm.function(fn)
+	if err != nil {
+		return err
+	}
+	if !isInstructionStart(compiled.Instructions, ip) {
+		return fmt.Errorf("no instruction at offset %d", ip)
+	}
+
+	if vm.breakpoints == nil {
+		vm.breakpoints = map[*object.CompiledFunction]map[int]bool{}
+	}
+	if vm.breakpoints[compiled] == nil {
+		vm.breakpoints[compiled] = map[int]bool{}
+	}
+	vm.breakpoints[compiled][ip] = true
+	return nil
+}
+
+// Removes a breakpoint set with SetBreakpoint.
+func (vm *VM) ClearBreakpoint(fn, ip int) error {
+	compiled, err := vm.function(fn)
+	if err != nil {
+		return err
+	}
+
+	delete(vm.breakpoints[compiled], ip)
+	if len(vm.breakpoints[compiled]) == 0 {
+		delete(vm.breakpoints, compiled)
+	}
+	if len(vm.breakpoints) == 0 {
+		vm.breakpoints = nil
+	}
+	return nil
+}
+
+// Decides, before the instruction after the current one is executed,
+// whether Run or Step has to stop first.
+func (vm *VM) pause() error {
+	if vm.stepping {
+		if vm.stepped {
+			return errStepped
+		}
+		vm.stepped = true
+		vm.resuming = false
+		return nil
+	}
+
+	// Run was stopped at this breakpoint, and now continues past it.
+	if vm.resuming {
+		vm.resuming = false
+		return nil
+	}
+
+	frame := vm.currentFrame()
+	ip := frame.ip + 1
+	if vm.breakpoints[frame.cl.Fn][ip] {
+		vm.resuming = true
+		return &Breakpoint{Function: vm.functionIndex(frame.cl.Fn), IP: ip}
+	}
+	return nil
+}
+
+// Returns the main program for MainFunction, or the function at index fn in
+// the constant pool.
+func (vm *VM) function(fn int) (*object.CompiledFunction, error) {
+	if fn == MainFunction {
+		return vm.frames[0].cl.Fn, nil
+	}
+	if fn < 0 || fn >= len(vm.constants) {
+		return nil, fmt.Errorf("constant %d out of range, have %d", fn, len(vm.constants))
+	}
+
+	compiled, ok := vm.constants[fn].(*object.CompiledFunction)
+	if !ok {
+		return nil, fmt.Errorf("constant %d is not a function", fn)
+	}
+	return compiled, nil
+}
+
+// The opposite of function.
+func (vm *VM) functionIndex(fn *object.CompiledFunction) int {
+	for i, constant := range vm.constants {
+		if constant == fn {
+			return i
+		}
+	}
+	return MainFunction
+}
+
+func isInstructionStart(ins code.Instructions, ip int) bool {
+	offset := 0
+	for offset < len(ins) && offset < ip {
+		def, err := code.Lookup(ins[offset])
+		if err != nil {
+			return false
+		}
+		_, read := code.ReadOperands(def, ins[offset+1:])
+		offset += 1 + read
+	}
+	return offset == ip && ip < len(ins)
+}
+
+// The state of a function call, as a debugger shows it.
+type FrameInfo struct {
+	Function int // Index of the function in the constant pool, or MainFunction.
+	Name     string
+	IP       int // Offset of the next instruction the call executes.
+
+	// Where in the source the next instruction comes from; 0 if unknown.
+	Line   int
+	Column int
+
+	// The parameters come first among the locals.
+	Locals []object.Object
+	Free   []object.Object
+}
+
+// Returns the calls in progress, the main program first and the innermost
+// call last.
+func (vm *VM) Frames() []FrameInfo {
+	frames := make([]FrameInfo, vm.framesIndex)
+	for i := range frames {
+		frame := &vm.frames[i]
+		fn := frame.cl.Fn
+
+		info := FrameInfo{
+			Function: vm.functionIndex(fn),
+			Name:     "main",
+			IP:       frame.ip + 1,
+			Free:     make([]object.Object, len(frame.cl.Free)),
+		}
+		for j, free := range frame.cl.Free {
+			info.Free[j] = variable(free)
+		}
+		info.Line, info.Column = fn.SourceMap.Lookup(info.IP)
+		if i > 0 {
+			info.Name = object.FunctionName(fn.Name)
+			info.Locals = make([]object.Object, fn.NumLocals)
+			for j := range info.Locals {
+				info.Locals[j] = variable(vm.stack[frame.basePointer+j].Object())
+			}
+		}
+		frames[i] = info
+	}
+	return frames
+}
+
+// Returns the values on the stack, the topmost last.
+func (vm *VM) Stack() []object.Object {
+	stack := make([]object.Object, vm.sp)
+	for i := range stack {
+		stack[i] = vm.stack[i].Object()
+	}
+	return stack
+}
+
+// Returns the VM's store of globals, indexed as the compiler's symbol table
+// numbers them. Globals that haven't been set are nil, and those of blocks
+// that closures captured are held in an *object.Cell.
+func (vm *VM) Globals() []object.Object {
+	return vm.globals
+}
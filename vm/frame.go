@@ -9,6 +9,24 @@ type Frame struct {
 	cl          *object.Closure
 	ip          int
 	basePointer int
+	numArgs     int // Passed to the call, which may be fewer than there are parameters.
+
+	// The handlers OpTry has installed and OpEndTry hasn't removed yet,
+	// innermost last.
+	handlers []handler
+
+	// The tail calls the frame was reused for, first first, for stack
+	// traces. Each has the function that made the call and where it made
+	// it. A function calling itself again from the same place, as a loop
+	// written as tail recursion does, is recorded once.
+	tailCalls []object.StackFrame
+}
+
+// Where a frame continues when an instruction within a try fails.
+type handler struct {
+	ip      int  // Of the handler's first instruction.
+	sp      int  // The stack pointer at OpTry, which the stack is unwound to.
+	catches bool // Catches the exception, rather than running a finally and rethrowing it.
 }
 
 func NewFrame(cl *object.Closure, basePointer int) *Frame {
@@ -22,3 +40,9 @@ func NewFrame(cl *object.Closure, basePointer int) *Frame {
 func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
+
+// Returns where in the source the instruction the frame is at comes from,
+// or 0, 0 if that isn't known.
+func (f *Frame) position() (line, column int) {
+	return f.cl.Fn.SourceMap.Lookup(f.ip)
+}
@@ -0,0 +1,208 @@
+package vm
+
+import (
+	"fmt"
+	"monkey/code"
+	"monkey/object"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// What the profiler found out about a function, or about the main program.
+type FunctionProfile struct {
+	Function     int // Index of the function in the constant pool, or MainFunction.
+	Name         string
+	Calls        uint64 // For the main program, how often it was run.
+	Instructions uint64 // Executed in the function itself, not in the functions it calls.
+
+	// Spent in the function, including the functions and builtins it calls.
+	// A recursive call's time is only counted once, in the outermost call.
+	Time time.Duration
+}
+
+type OpcodeProfile struct {
+	Opcode code.Opcode
+	Name   string
+	Count  uint64
+}
+
+// Where a program spends its time, as recorded by the profiler.
+type Profile struct {
+	Functions []FunctionProfile // The most time first.
+	Opcodes   []OpcodeProfile   // The most executed first.
+}
+
+// Formats the profile as a table of functions followed by one of opcodes.
+func (p *Profile) String() string {
+	var out strings.Builder
+
+	w := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "function\tcalls\tinstructions\ttime")
+	for _, fn := range p.Functions {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", fn.Name, fn.Calls, fn.Instructions, fn.Time)
+	}
+	w.Flush()
+
+	out.WriteString("\n")
+
+	w = tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "opcode\tcount")
+	for _, op := range p.Opcodes {
+		fmt.Fprintf(w, "%s\t%d\n", op.Name, op.Count)
+	}
+	w.Flush()
+
+	return out.String()
+}
+
+// Counts every instruction the VM executes from then on, by opcode and by
+// function, and times every function call, until profiling is disabled.
+// Profile returns what was recorded. Profiling slows the VM down.
+func (vm *VM) EnableProfiling() {
+	if vm.profiler == nil {
+		vm.profiler = &profiler{
+			main:      &functionStats{},
+			functions: map[*object.CompiledFunction]*functionStats{},
+		}
+	}
+}
+
+// Stops profiling, and forgets what was recorded.
+func (vm *VM) DisableProfiling() {
+	vm.profiler = nil
+}
+
+// Returns what the profiler has recorded so far, or nil if profiling isn't
+// enabled.
+func (vm *VM) Profile() *Profile {
+	p := vm.profiler
+	if p == nil {
+		return nil
+	}
+
+	profile := &Profile{}
+
+	profile.Functions = append(profile.Functions, FunctionProfile{
+		Function:     MainFunction,
+		Name:         "main",
+		Calls:        p.main.calls,
+		Instructions: p.main.instructions,
+		Time:         p.main.time,
+	})
+	for fn, stats := range p.functions {
+		profile.Functions = append(profile.Functions, FunctionProfile{
+			Function:     vm.functionIndex(fn),
+			Name:         object.FunctionName(fn.Name),
+			Calls:        stats.calls,
+			Instructions: stats.instructions,
+			Time:         stats.time,
+		})
+	}
+	sort.Slice(profile.Functions, func(i, j int) bool {
+		a, b := profile.Functions[i], profile.Functions[j]
+		if a.Time != b.Time {
+			return a.Time > b.Time
+		}
+		return a.Function < b.Function
+	})
+
+	for op, count := range p.opcodes {
+		if count == 0 {
+			continue
+		}
+		def, err := code.Lookup(byte(op))
+		if err != nil {
+			continue
+		}
+		profile.Opcodes = append(profile.Opcodes, OpcodeProfile{
+			Opcode: code.Opcode(op),
+			Name:   def.Name,
+			Count:  count,
+		})
+	}
+	sort.SliceStable(profile.Opcodes, func(i, j int) bool {
+		return profile.Opcodes[i].Count > profile.Opcodes[j].Count
+	})
+
+	return profile
+}
+
+type profiler struct {
+	opcodes   [256]uint64
+	main      *functionStats
+	functions map[*object.CompiledFunction]*functionStats
+
+	// The function calls in progress, innermost last.
+	calls []profiledCall
+}
+
+type functionStats struct {
+	calls        uint64
+	instructions uint64
+	time         time.Duration
+
+	active int // Calls in progress.
+}
+
+type profiledCall struct {
+	stats     *functionStats
+	start     time.Time
+	outermost bool // Whether the call's time is counted.
+}
+
+// Counts an instruction about to be executed.
+func (p *profiler) count(op code.Opcode) {
+	p.opcodes[op]++
+	if len(p.calls) == 0 {
+		p.main.instructions++
+	} else {
+		p.calls[len(p.calls)-1].stats.instructions++
+	}
+}
+
+// Records a call to fn, with depth calls in progress counting this one.
+func (p *profiler) enter(fn *object.CompiledFunction, depth int) {
+	// Calls abandoned because of an error never return, and are over now.
+	for len(p.calls) >= depth {
+		p.exit()
+	}
+
+	stats, ok := p.functions[fn]
+	if !ok {
+		stats = &functionStats{}
+		p.functions[fn] = stats
+	}
+	stats.calls++
+
+	call := profiledCall{stats: stats}
+	if stats.active == 0 {
+		call.start = time.Now()
+		call.outermost = true
+	}
+	stats.active++
+	p.calls = append(p.calls, call)
+}
+
+// Records the return from the innermost call.
+func (p *profiler) exit() {
+	// Profiling may have started within the call.
+	if len(p.calls) == 0 {
+		return
+	}
+
+	call := p.calls[len(p.calls)-1]
+	p.calls = p.calls[:len(p.calls)-1]
+
+	call.stats.active--
+	if call.outermost {
+		call.stats.time += time.Since(call.start)
+	}
+}
+
+// Records a run of the main program that started at start.
+func (p *profiler) run(start time.Time) {
+	p.main.calls++
+	p.main.time += time.Since(start)
+}
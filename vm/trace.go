@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"monkey/code"
+	"monkey/object"
+	"strconv"
+	"strings"
+)
+
+// How many values from the top of the stack a trace shows, and how much of
+// each.
+const (
+	traceStackValues = 4
+	traceValueLength = 24
+)
+
+// Writes every instruction the VM executes to w from then on, for debugging
+// the compiler. Each line has the function the instruction is in, its
+// offset, the instruction and its operands, and the values on top of the
+// stack before it runs. Tracing can be turned on and off at any time, even
+// from a builtin while the VM runs.
+func (vm *VM) EnableTrace(w io.Writer) {
+	vm.trace = w
+}
+
+// Stops writing the instructions the VM executes.
+func (vm *VM) DisableTrace() {
+	vm.trace = nil
+}
+
+func (vm *VM) traceInstruction(ip int, ins code.Instructions) {
+	name := "main"
+	if vm.framesIndex > 1 {
+		name = object.FunctionName(vm.currentFrame().cl.Fn.Name)
+	}
+
+	var instruction string
+	def, err := code.Lookup(ins[ip])
+	if err != nil {
+		instruction = err.Error()
+	} else {
+		operands, _ := code.ReadOperands(def, ins[ip+1:])
+		instruction = code.FormatInstruction(def, operands)
+	}
+
+	fmt.Fprintf(vm.trace, "%-12s %04d %-24s %s\n", name, ip, instruction, vm.traceStack())
+}
+
+// Describes the values on top of the stack, the topmost last.
+func (vm *VM) traceStack() string {
+	var out strings.Builder
+
+	start := vm.sp - traceStackValues
+	if start > 0 {
+		out.WriteString("... ")
+	} else {
+		start = 0
+	}
+
+	out.WriteString("[")
+	for i := start; i < vm.sp; i++ {
+		if i > start {
+			out.WriteString(", ")
+		}
+		out.WriteString(traceValue(vm.stack[i].Object()))
+	}
+	out.WriteString("]")
+
+	return out.String()
+}
+
+func traceValue(obj object.Object) string {
+	var s string
+	switch obj := obj.(type) {
+	case *object.String:
+		s = strconv.Quote(obj.Value)
+	case *object.Closure:
+		s = "fn " + object.FunctionName(obj.Fn.Name)
+	case *object.Builtin:
+		s = "builtin"
+	default:
+		s = obj.Inspect()
+	}
+
+	if runes := []rune(s); len(runes) > traceValueLength {
+		s = string(runes[:traceValueLength-3]) + "..."
+	}
+	return s
+}
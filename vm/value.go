@@ -0,0 +1,43 @@
+package vm
+
+import "monkey/object"
+
+// A value on the VM's stack. Integers produced by arithmetic are held
+// unboxed in i, so that the common integer operations don't allocate, and
+// are only turned into *object.Integer when they leave the stack for the
+// globals, a closure, a data structure, a builtin or the host.
+type value struct {
+	obj object.Object // unboxedInt if the value is the integer in i.
+	i   int64
+}
+
+// Marks a value as an unboxed integer. It is an *object.Integer, so that
+// errors can report its type without boxing the value.
+var unboxedInt object.Object = &object.Integer{}
+
+func intValue(i int64) value {
+	return value{obj: unboxedInt, i: i}
+}
+
+func objectValue(obj object.Object) value {
+	return value{obj: obj}
+}
+
+// Returns the integer v holds, whether boxed or not.
+func (v value) int() (int64, bool) {
+	if v.obj == unboxedInt {
+		return v.i, true
+	}
+	if integer, ok := v.obj.(*object.Integer); ok {
+		return integer.Value, true
+	}
+	return 0, false
+}
+
+// Returns v as an object, boxing it if it is an unboxed integer.
+func (v value) Object() object.Object {
+	if v.obj == unboxedInt {
+		return object.NewInteger(v.i)
+	}
+	return v.obj
+}
@@ -1,19 +1,28 @@
 package vm
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"math"
 	"monkey/code"
 	"monkey/compiler"
 	"monkey/object"
+	"os"
+	"time"
 )
 
+// The stack starts out with room for STACK_SIZE values, and grows as needed
+// up to the VM's maximum stack size, MAX_STACK_SIZE unless set otherwise.
 const STACK_SIZE = 2048
+const MAX_STACK_SIZE = 1 << 20
 const GLOBALS_SIZE = 65536
 const MAX_FRAMES = 1024
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.NULL{}
+var True = object.TRUE
+var False = object.FALSE
+var Null = object.Null
 
 func nativeBoolToBoolObj(input bool) *object.Boolean {
 	if input {
@@ -23,124 +32,501 @@ func nativeBoolToBoolObj(input bool) *object.Boolean {
 	}
 }
 
-func isTruthy(obj object.Object) bool {
-	switch obj := obj.(type) {
-	case *object.Boolean:
-		return obj.Value
-	case *object.NULL:
-		return false
-	default:
-		return true
-	}
-}
-
 type VM struct {
 	constants []object.Object
 
-	stack []object.Object
-	sp    int // Always points to the next free value. Top of stack is stack[stackPtr-1]
+	stack        []value
+	sp           int // Always points to the next free value. Top of stack is stack[stackPtr-1]
+	maxStackSize int
 
 	globals []object.Object
 
-	frames      []*Frame
+	frames      []Frame
 	framesIndex int
+
+	instructions uint64 // Executed so far, across every call to Run.
+	stepLimit    uint64 // On instructions, or 0 if there is no limit.
+
+	allocated   uint64 // Bytes, as estimated by object.SizeOf.
+	memoryLimit uint64 // 0 if there is no limit.
+
+	checkedArithmetic bool // Integer overflow is an error, rather than wrapping around.
+	strict            bool // Panics are let through, rather than turned into errors.
+
+	stdout io.Writer
+	stdin  *bufio.Reader
+	denied map[object.Capability]bool
+	ctx    context.Context
+
+	trace    io.Writer // Where executed instructions are written, if anywhere.
+	profiler *profiler // nil unless profiling is enabled.
+
+	// Set by the debugger, see debug.go.
+	breakpoints map[*object.CompiledFunction]map[int]bool // nil if there are none.
+	stepping    bool                                      // Within Step.
+	stepped     bool                                      // Step has executed its instruction.
+	resuming    bool                                      // Run stopped at the next instruction's breakpoint.
+
+	// The main program ended with a return.
+	halted bool
+
+	// The error that aborted a function called back from a builtin, which
+	// has to abort the builtin's caller as well.
+	callErr error
+}
+
+// Sizes of the VM's storage, for tuning its memory use to small devices or
+// large programs. Fields left at 0 get the default sizes.
+type Options struct {
+	StackSize    int // Values the stack starts with room for; STACK_SIZE by default.
+	MaxStackSize int // Values the stack may grow to hold; MAX_STACK_SIZE by default.
+	MaxFrames    int // Nested function calls; MAX_FRAMES by default.
+	GlobalsSize  int // Global bindings; GLOBALS_SIZE by default.
+
+	// A globals store shared with other VMs, as for NewWithGlobalsStore.
+	// GlobalsSize is ignored if it is set.
+	Globals []object.Object
 }
 
 func New(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+	return NewWithOptions(bytecode, Options{})
+}
+
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, globals []object.Object) *VM {
+	return NewWithOptions(bytecode, Options{Globals: globals})
+}
+
+func NewWithOptions(bytecode *compiler.Bytecode, opts Options) *VM {
+	if opts.StackSize == 0 {
+		opts.StackSize = STACK_SIZE
+	}
+	if opts.MaxStackSize == 0 {
+		opts.MaxStackSize = MAX_STACK_SIZE
+	}
+	if opts.MaxFrames == 0 {
+		opts.MaxFrames = MAX_FRAMES
+	}
+	if opts.Globals == nil {
+		if opts.GlobalsSize == 0 {
+			opts.GlobalsSize = GLOBALS_SIZE
+		}
+		opts.Globals = make([]object.Object, opts.GlobalsSize)
+	}
+
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		SourceMap:    bytecode.SourceMap,
+	}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
 
-	frames := make([]*Frame, MAX_FRAMES)
-	frames[0] = mainFrame
+	// Frames are stored by value and reused, so that calls don't allocate.
+	frames := make([]Frame, opts.MaxFrames)
+	frames[0] = *mainFrame
 
 	return &VM{
 		constants: bytecode.Constants,
 
-		stack: make([]object.Object, STACK_SIZE),
-		sp:    0,
+		stack:        make([]value, opts.StackSize),
+		sp:           0,
+		maxStackSize: opts.MaxStackSize,
 
-		globals: make([]object.Object, GLOBALS_SIZE),
+		globals: opts.Globals,
 
 		frames:      frames,
 		framesIndex: 1,
+
+		stdout: os.Stdout,
+		stdin:  object.NewInput(os.Stdin),
+		ctx:    context.Background(),
 	}
 }
 
-func NewWithGlobalsStore(bytecode *compiler.Bytecode, globals []object.Object) *VM {
-	vm := New(bytecode)
-	vm.globals = globals
-	return vm
+// Sets where builtins like `puts` write their output.
+func (vm *VM) SetStdout(w io.Writer) {
+	vm.stdout = w
+}
+
+func (vm *VM) Stdout() io.Writer {
+	return vm.stdout
+}
+
+// Sets where builtins like `readLine` read their input from.
+func (vm *VM) SetStdin(r io.Reader) {
+	vm.stdin = object.NewInput(r)
+}
+
+func (vm *VM) Stdin() *bufio.Reader {
+	return vm.stdin
+}
+
+// Denies a capability to the builtins the program calls.
+func (vm *VM) Deny(c object.Capability) {
+	if vm.denied == nil {
+		vm.denied = make(map[object.Capability]bool)
+	}
+	vm.denied[c] = true
+}
+
+func (vm *VM) Allows(c object.Capability) bool {
+	return !vm.denied[c]
+}
+
+// Sets the context the program runs under. The VM stops with the context's
+// error once it is done.
+func (vm *VM) SetContext(ctx context.Context) {
+	vm.ctx = ctx
+}
+
+func (vm *VM) Context() context.Context {
+	return vm.ctx
+}
+
+// Calls a function value and runs it to completion. This is how builtins
+// like `map` call back into Monkey functions, and how hosts call Monkey
+// functions. If the function calls `exit` or exceeds the step limit, the
+// *object.Exit or *object.BudgetExceeded is returned, and if it throws a
+// value it doesn't catch, the *object.Thrown. Panics are returned as errors
+// unless the VM is strict.
+func (vm *VM) Call(fn object.Object, args ...object.Object) (result object.Object) {
+	defer func() {
+		if vm.strict {
+			return
+		}
+		if r := recover(); r != nil {
+			err := vm.internalError(r)
+			vm.callErr = err
+			result = &object.Error{Message: err.Error()}
+		}
+	}()
+
+	returnDepth := vm.framesIndex
+
+	err := vm.push(fn)
+	for _, arg := range args {
+		if err != nil {
+			break
+		}
+		err = vm.push(arg)
+	}
+
+	if err == nil {
+		err = vm.executeCall(len(args))
+	}
+	if err == nil {
+		err = vm.run(returnDepth)
+	}
+	if err != nil {
+		vm.callErr = err
+		// Exits, exceeded budgets and thrown values are objects as well
+		// as errors.
+		if obj, ok := err.(object.Object); ok {
+			return obj
+		}
+		return &object.Error{Message: err.Error()}
+	}
+
+	return vm.pop()
 }
 
 // FOR TESTS ONLY
 func (vm *VM) LastPoppedStackElem() object.Object {
-	return vm.stack[vm.sp]
+	return vm.stack[vm.sp].Object()
+}
+
+// Reports whether the main program ended by returning, rather than by
+// running to its end. LastPoppedStackElem is the value it returned.
+func (vm *VM) Halted() bool {
+	return vm.halted
 }
 
 func (vm *VM) StackTop() object.Object {
 	if vm.sp == 0 {
 		return nil
 	}
-	return vm.stack[vm.sp-1]
+	return vm.stack[vm.sp-1].Object()
 }
 
 // pushes an object onto the stack and increments the stack pointer
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= STACK_SIZE {
-		return fmt.Errorf("stack overflow")
+	return vm.pushValue(objectValue(o))
+}
+
+func (vm *VM) pushAll(objs []object.Object) error {
+	for _, o := range objs {
+		if err := vm.push(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *VM) pushInt(i int64) error {
+	return vm.pushValue(intValue(i))
+}
+
+func (vm *VM) pushValue(v value) error {
+	if vm.sp >= len(vm.stack) {
+		if err := vm.growStack(vm.sp + 1); err != nil {
+			return err
+		}
 	}
 
-	vm.stack[vm.sp] = o
+	vm.stack[vm.sp] = v
 	vm.sp++
 
 	return nil
 }
 
+// Makes room on the stack for at least size values, doubling it so that
+// growing stays rare.
+func (vm *VM) growStack(size int) error {
+	if size > vm.maxStackSize {
+		return fmt.Errorf("stack overflow")
+	}
+
+	newSize := 2 * len(vm.stack)
+	if newSize < size {
+		newSize = size
+	}
+	if newSize > vm.maxStackSize {
+		newSize = vm.maxStackSize
+	}
+
+	stack := make([]value, newSize)
+	copy(stack, vm.stack)
+	vm.stack = stack
+	return nil
+}
+
+// Sets how many values the stack may grow to hold. Pushing beyond it fails
+// with a stack overflow.
+func (vm *VM) SetMaxStackSize(size int) {
+	vm.maxStackSize = size
+}
+
 // pops an object off the stack and decrements the stack pointer
 func (vm *VM) pop() object.Object {
-	o := vm.stack[vm.sp-1]
+	return vm.popValue().Object()
+}
+
+func (vm *VM) popValue() value {
+	v := vm.stack[vm.sp-1]
 	vm.sp--
-	return o
+	return v
 }
 
 func (vm *VM) currentFrame() *Frame {
-	return vm.frames[vm.framesIndex-1]
+	return &vm.frames[vm.framesIndex-1]
+}
+
+// Returns the value of the current frame's local at index.
+func (vm *VM) local(index int) value {
+	v := vm.stack[vm.currentFrame().basePointer+index]
+	if cell, ok := v.obj.(*object.Cell); ok {
+		return objectValue(cell.Value)
+	}
+	return v
 }
 
-func (vm *VM) pushFrame(f *Frame) {
-	vm.frames[vm.framesIndex] = f
+// Returns the value of a variable, which is held in a cell once a closure
+// has captured it.
+func variable(obj object.Object) object.Object {
+	if cell, ok := obj.(*object.Cell); ok {
+		return cell.Value
+	}
+	return obj
+}
+
+// Sets up the next frame for a call to cl. Callers must check that there is
+// room for it.
+func (vm *VM) pushFrame(cl *object.Closure, basePointer, numArgs int) {
+	frame := &vm.frames[vm.framesIndex]
+	frame.cl = cl
+	frame.ip = -1
+	frame.basePointer = basePointer
+	frame.numArgs = numArgs
+	frame.handlers = frame.handlers[:0]
+	frame.tailCalls = frame.tailCalls[:0]
 	vm.framesIndex++
+
+	if vm.profiler != nil {
+		vm.profiler.enter(cl.Fn, vm.framesIndex-1)
+	}
 }
 
+// The returned frame is only valid until the next call to pushFrame.
 func (vm *VM) popFrame() *Frame {
+	if vm.profiler != nil {
+		vm.profiler.exit()
+	}
+
 	vm.framesIndex--
-	return vm.frames[vm.framesIndex]
+	return &vm.frames[vm.framesIndex]
 }
 
-func (vm *VM) pushClosure(constIdx int) error {
+// Wraps the function at `constIdx` in a closure that captures the top
+// `numFree` values of the stack as its free variables.
+func (vm *VM) pushClosure(constIdx int, numFree int) error {
 	constant := vm.constants[constIdx]
 	fn, ok := constant.(*object.CompiledFunction)
 	if !ok {
 		return fmt.Errorf("not a function: %+v", constant)
 	}
 
-	closure := &object.Closure{Fn: fn}
+	free := make([]object.Object, numFree)
+	for i := 0; i < numFree; i++ {
+		free[i] = vm.stack[vm.sp-numFree+i].Object()
+	}
+	vm.sp = vm.sp - numFree
+
+	closure := &object.Closure{Fn: fn, Free: free}
 	return vm.push(closure)
 }
 
+// Runs the program. When it fails, the error is a *RuntimeError, which says
+// where in the source it failed.
 func (vm *VM) Run() error {
+	if vm.profiler != nil {
+		defer vm.profiler.run(time.Now())
+	}
+	return vm.runtimeError(vm.run(0))
+}
+
+// Runs the program under ctx, stopping with ctx.Err() once it is done.
+func (vm *VM) RunContext(ctx context.Context) error {
+	vm.SetContext(ctx)
+	return vm.Run()
+}
+
+// How many instructions the VM executes between checks of its context.
+const contextCheckInterval = 1024
+
+// Limits the number of instructions the VM may execute, counting those it
+// has executed already. Run returns an *object.BudgetExceeded once the limit
+// is exceeded. A limit of 0 removes it.
+func (vm *VM) SetStepLimit(limit uint64) {
+	vm.stepLimit = limit
+}
+
+// Limits the number of bytes the program may allocate for arrays, strings
+// and hashes from now on, as estimated by object.SizeOf. Run returns an
+// *object.BudgetExceeded once the limit is exceeded. A limit of 0 removes it.
+func (vm *VM) SetMemoryLimit(limit uint64) {
+	vm.allocated = 0
+	vm.memoryLimit = limit
+}
+
+// Counts a newly created object against the memory limit.
+func (vm *VM) allocate(obj object.Object) error {
+	if vm.memoryLimit == 0 {
+		return nil
+	}
+
+	vm.allocated += object.SizeOf(obj)
+	if vm.allocated > vm.memoryLimit {
+		return &object.BudgetExceeded{Budget: object.MemoryBudget, Limit: vm.memoryLimit}
+	}
+	return nil
+}
+
+// Makes integer arithmetic fail with an error when its result overflows an
+// int64, rather than wrap around. It is off by default.
+func (vm *VM) SetCheckedArithmetic(enabled bool) {
+	vm.checkedArithmetic = enabled
+}
+
+// Makes the VM let panics through, rather than turn them into errors, so
+// that they can be debugged with the Go stack where they happened. It is
+// off by default.
+func (vm *VM) SetStrict(enabled bool) {
+	vm.strict = enabled
+}
+
+// Turns a panic in the VM, which a bug in it or in a builtin could cause,
+// as could bytecode that fails verification, into a *RuntimeError, unless
+// the VM is strict. It is deferred by the outermost run.
+func (vm *VM) recoverPanic(err *error) {
+	if vm.strict {
+		return
+	}
+	if r := recover(); r != nil {
+		*err = vm.internalError(r)
+	}
+}
+
+// Returns the error for a recovered panic. It is a *RuntimeError already,
+// so that no try expression catches it.
+func (vm *VM) internalError(r interface{}) error {
+	return vm.runtimeError(fmt.Errorf("internal error: %v", r))
+}
+
+// Returns the number of instructions the VM has executed.
+func (vm *VM) InstructionsExecuted() uint64 {
+	return vm.instructions
+}
+
+// Executes instructions until the frame at `returnDepth` is returned to, or
+// the main function has no instructions left. Errors are handled by the
+// innermost handler that the frames run here have installed, if any.
+func (vm *VM) run(returnDepth int) (err error) {
+	if returnDepth == 0 {
+		defer vm.recoverPanic(&err)
+	}
+
+	for {
+		err = vm.execute(returnDepth)
+		if err == nil {
+			return nil
+		}
+		if err = vm.handle(err, returnDepth); err != nil {
+			return err
+		}
+	}
+}
+
+// Executes instructions as run does, stopping at the first error.
+func (vm *VM) execute(returnDepth int) error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
-	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+	for vm.framesIndex > returnDepth &&
+		vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		// Only the outermost run can stop, as a builtin that called back
+		// into the VM is still waiting for its result.
+		if returnDepth == 0 && (vm.stepping || vm.breakpoints != nil) {
+			if err := vm.pause(); err != nil {
+				return err
+			}
+		}
+
 		vm.currentFrame().ip++
+		vm.instructions++
+
+		if vm.stepLimit != 0 && vm.instructions > vm.stepLimit {
+			return &object.BudgetExceeded{Budget: object.StepBudget, Limit: vm.stepLimit}
+		}
+
+		if vm.instructions%contextCheckInterval == 0 {
+			select {
+			case <-vm.ctx.Done():
+				return vm.ctx.Err()
+			default:
+			}
+		}
 
 		ip = vm.currentFrame().ip
 		ins = vm.currentFrame().Instructions()
 		op = code.Opcode(ins[ip])
 
+		if vm.trace != nil {
+			vm.traceInstruction(ip, ins)
+		}
+		if vm.profiler != nil {
+			vm.profiler.count(op)
+		}
+
 		switch op {
 		case code.OpConstant:
 			constIdx := code.ReadUint16(ins[ip+1:])
@@ -181,13 +567,14 @@ func (vm *VM) Run() error {
 				return err
 			}
 
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow,
+			code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
 			}
 
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual:
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
@@ -197,12 +584,22 @@ func (vm *VM) Run() error {
 			jumpPos := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip = jumpPos - 1
 
+		case code.OpJumpArgPassed:
+			param := int(code.ReadUint8(ins[ip+1:]))
+			jumpPos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			if param < vm.currentFrame().numArgs {
+				vm.currentFrame().ip = jumpPos - 1
+			}
+
 		case code.OpJumpNotTruthy:
 			jumpPos := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
 
-			condition := vm.pop()
-			if !isTruthy(condition) {
+			// An unboxed integer is truthy like any other.
+			condition := vm.popValue()
+			if !object.IsTruthy(condition.obj) {
 				vm.currentFrame().ip = jumpPos - 1
 			}
 
@@ -210,13 +607,50 @@ func (vm *VM) Run() error {
 			globalIdx := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
 
+			if int(globalIdx) >= len(vm.globals) {
+				return fmt.Errorf("too many globals: the VM has room for %d", len(vm.globals))
+			}
 			vm.globals[globalIdx] = vm.pop()
 
 		case code.OpGetGlobal:
 			globalIdx := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
 
-			err := vm.push(vm.globals[globalIdx])
+			if int(globalIdx) >= len(vm.globals) {
+				return fmt.Errorf("too many globals: the VM has room for %d", len(vm.globals))
+			}
+			err := vm.push(variable(vm.globals[globalIdx]))
+			if err != nil {
+				return err
+			}
+
+		case code.OpAssignGlobal:
+			globalIdx := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			if int(globalIdx) >= len(vm.globals) {
+				return fmt.Errorf("too many globals: the VM has room for %d", len(vm.globals))
+			}
+			if cell, ok := vm.globals[globalIdx].(*object.Cell); ok {
+				cell.Value = vm.pop()
+			} else {
+				vm.globals[globalIdx] = vm.pop()
+			}
+
+		case code.OpCaptureGlobal:
+			globalIdx := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			if int(globalIdx) >= len(vm.globals) {
+				return fmt.Errorf("too many globals: the VM has room for %d", len(vm.globals))
+			}
+			cell, ok := vm.globals[globalIdx].(*object.Cell)
+			if !ok {
+				cell = &object.Cell{Value: vm.globals[globalIdx]}
+				vm.globals[globalIdx] = cell
+			}
+
+			err := vm.push(cell)
 			if err != nil {
 				return err
 			}
@@ -228,6 +662,9 @@ func (vm *VM) Run() error {
 			arr := vm.buildArray(vm.sp-numElems, vm.sp)
 			vm.sp = vm.sp - numElems
 
+			if err := vm.allocate(arr); err != nil {
+				return err
+			}
 			err := vm.push(arr)
 			if err != nil {
 				return err
@@ -243,13 +680,17 @@ func (vm *VM) Run() error {
 			}
 			vm.sp = vm.sp - numElems
 
+			if err := vm.allocate(hash); err != nil {
+				return err
+			}
+
 			err = vm.push(hash)
 			if err != nil {
 				return err
 			}
 
 		case code.OpIndex:
-			idx := vm.pop()
+			idx := vm.popValue()
 			left := vm.pop()
 
 			err := vm.executeIndexExpression(left, idx)
@@ -257,26 +698,82 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpSlice:
+			end := vm.pop()
+			start := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeSliceExpression(left, start, end)
+			if err != nil {
+				return err
+			}
+
+		case code.OpDestructureArray:
+			numElems := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			elems, errObj := object.DestructureArray(vm.pop(), numElems)
+			if errObj != nil {
+				return fmt.Errorf("%s", errObj.Message)
+			}
+
+			err := vm.pushAll(elems)
+			if err != nil {
+				return err
+			}
+
+		case code.OpDestructureHash:
+			numKeys := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			keys := make([]object.Object, numKeys)
+			for i := range keys {
+				keys[i] = vm.stack[vm.sp-numKeys+i].Object()
+			}
+			vm.sp -= numKeys
+
+			values, errObj := object.DestructureHash(vm.pop(), keys)
+			if errObj != nil {
+				return fmt.Errorf("%s", errObj.Message)
+			}
+
+			err := vm.pushAll(values)
+			if err != nil {
+				return err
+			}
+
 		case code.OpCall:
 			numArgs := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
 
-			err := vm.executeCall(int(numArgs))
+			var err error
+			if vm.inTailPosition(int(numArgs)) {
+				err = vm.tailCall(int(numArgs))
+			} else {
+				err = vm.executeCall(int(numArgs))
+			}
 			if err != nil {
 				return err
 			}
 
 		case code.OpReturnValue:
-			returnVal := vm.pop()
+			returnVal := vm.popValue()
 
 			frame := vm.popFrame()
 			vm.sp = frame.basePointer - 1
 
-			err := vm.push(returnVal)
+			err := vm.pushValue(returnVal)
 			if err != nil {
 				return err
 			}
 
+		case code.OpHalt:
+			// The value is left where LastPoppedStackElem finds it.
+			vm.popValue()
+			vm.halted = true
+			main := &vm.frames[0]
+			main.ip = len(main.Instructions()) - 1
+
 		case code.OpReturn:
 			frame := vm.popFrame()
 			vm.sp = frame.basePointer - 1
@@ -292,19 +789,94 @@ func (vm *VM) Run() error {
 
 			frame := vm.currentFrame()
 
-			vm.stack[frame.basePointer+int(localIdx)] = vm.pop()
+			// Defining the variable again, as each time round a loop, makes
+			// a new one, so a cell a closure captured is replaced.
+			vm.stack[frame.basePointer+int(localIdx)] = vm.popValue()
+
+		case code.OpAssignLocal:
+			localIdx := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			slot := &vm.stack[vm.currentFrame().basePointer+int(localIdx)]
+			if cell, ok := slot.obj.(*object.Cell); ok {
+				cell.Value = vm.pop()
+			} else {
+				*slot = vm.popValue()
+			}
 
 		case code.OpGetLocal:
 			localIdx := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
 
-			frame := vm.currentFrame()
+			err := vm.pushValue(vm.local(int(localIdx)))
+			if err != nil {
+				return err
+			}
+
+		case code.OpCaptureLocal:
+			localIdx := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			slot := &vm.stack[vm.currentFrame().basePointer+int(localIdx)]
+			cell, ok := slot.obj.(*object.Cell)
+			if !ok {
+				cell = &object.Cell{Value: slot.Object()}
+				*slot = objectValue(cell)
+			}
+
+			err := vm.push(cell)
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetLocalAdd:
+			localIdx := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			right := vm.local(int(localIdx))
+			err := vm.executeBinaryValues(code.OpAdd, vm.popValue(), right)
+			if err != nil {
+				return err
+			}
+
+		case code.OpConstantAdd, code.OpConstantSub:
+			constIdx := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
 
-			err := vm.push(vm.stack[frame.basePointer+int(localIdx)])
+			binaryOp := code.OpAdd
+			if op == code.OpConstantSub {
+				binaryOp = code.OpSub
+			}
+			right := objectValue(vm.constants[constIdx])
+			err := vm.executeBinaryValues(binaryOp, vm.popValue(), right)
 			if err != nil {
 				return err
 			}
 
+		case code.OpCompareJump:
+			comparison := code.Opcode(code.ReadUint8(ins[ip+1:]))
+			jumpPos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			right := vm.popValue()
+			left := vm.popValue()
+
+			var condition bool
+			l, leftIsInt := left.int()
+			r, rightIsInt := right.int()
+			if leftIsInt && rightIsInt {
+				condition = compareIntegers(comparison, l, r)
+			} else {
+				err := vm.executeComparisonValues(comparison, left, right)
+				if err != nil {
+					return err
+				}
+				condition = object.IsTruthy(vm.popValue().obj)
+			}
+			if !condition {
+				vm.currentFrame().ip = jumpPos - 1
+			}
+
 		case code.OpGetBuiltin:
 			builtinIdx := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
@@ -318,16 +890,72 @@ func (vm *VM) Run() error {
 
 		case code.OpClosure:
 			constIdx := code.ReadUint16(ins[ip+1:])
-			_ = code.ReadUint8(ins[ip+3:])
+			numFree := code.ReadUint8(ins[ip+3:])
 			vm.currentFrame().ip += 3
 
-			err := vm.pushClosure(int(constIdx))
+			err := vm.pushClosure(int(constIdx), int(numFree))
+			if err != nil {
+				return err
+			}
+
+		case code.OpGetFree:
+			freeIdx := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.push(variable(vm.currentFrame().cl.Free[freeIdx]))
+			if err != nil {
+				return err
+			}
+
+		case code.OpCaptureFree:
+			freeIdx := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.push(vm.currentFrame().cl.Free[freeIdx])
+			if err != nil {
+				return err
+			}
+
+		case code.OpSetFree:
+			freeIdx := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			cell, ok := vm.currentFrame().cl.Free[freeIdx].(*object.Cell)
+			if !ok {
+				return fmt.Errorf("free variable %d is not a variable", freeIdx)
+			}
+			cell.Value = vm.pop()
+
+		case code.OpCurrentClosure:
+			currentClosure := vm.currentFrame().cl
+
+			err := vm.push(currentClosure)
 			if err != nil {
 				return err
 			}
 
+		case code.OpTry:
+			handlerPos := int(code.ReadUint16(ins[ip+1:]))
+			catches := code.ReadUint8(ins[ip+3:]) == 1
+			vm.currentFrame().ip += 3
+
+			frame := vm.currentFrame()
+			frame.handlers = append(frame.handlers, handler{ip: handlerPos, sp: vm.sp, catches: catches})
+
+		case code.OpEndTry:
+			frame := vm.currentFrame()
+			frame.handlers = frame.handlers[:len(frame.handlers)-1]
+
+		case code.OpThrow:
+			// A finally rethrows the errors it ran for as errors.
+			exception := vm.pop()
+			if errObj, ok := exception.(*object.Error); ok {
+				return fmt.Errorf("%s", errObj.Message)
+			}
+			return &object.Thrown{Value: exception}
+
 		case code.OpPop:
-			vm.pop()
+			vm.sp--
 		}
 	}
 
@@ -335,18 +963,26 @@ func (vm *VM) Run() error {
 }
 
 func (vm *VM) executeMinusOperator() error {
+	if i, ok := vm.stack[vm.sp-1].int(); ok {
+		if vm.checkedArithmetic && object.NegationOverflows(i) {
+			return fmt.Errorf("integer overflow: -(%d)", i)
+		}
+		vm.sp--
+		return vm.pushInt(-i)
+	}
+
 	operand := vm.pop()
 
-	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	switch operand := operand.(type) {
+	case *object.Float:
+		return vm.push(&object.Float{Value: -operand.Value})
+	default:
+		return fmt.Errorf("unknown operator: -%s", operand.Type())
 	}
-
-	val := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -val})
 }
 
 func (vm *VM) executeBangOperator() error {
-	operand := vm.pop()
+	operand := vm.popValue().obj
 
 	switch operand {
 	case True:
@@ -361,30 +997,74 @@ func (vm *VM) executeBangOperator() error {
 }
 
 func (vm *VM) executeBinaryOperation(op code.Opcode) error {
-	right := vm.pop()
-	left := vm.pop()
+	rightVal := vm.popValue()
+	leftVal := vm.popValue()
+	return vm.executeBinaryValues(op, leftVal, rightVal)
+}
+
+func (vm *VM) executeBinaryValues(op code.Opcode, leftVal, rightVal value) error {
+	if l, ok := leftVal.int(); ok {
+		if r, ok := rightVal.int(); ok {
+			return vm.executeBinaryIntegerOperation(op, l, r)
+		}
+	}
+
+	right := rightVal.Object()
+	left := leftVal.Object()
 
 	leftType := left.Type()
 	rightType := right.Type()
 
 	switch {
-	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
-		return vm.executeBinaryIntegerOperation(op, left, right)
+	case object.IsNumeric(left) && object.IsNumeric(right):
+		// At least one side is a float, so the integer side is promoted.
+		return vm.executeBinaryFloatOperation(op, left, right)
 	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left, right)
+	case leftType == object.ARRAY_OBJ && rightType == object.ARRAY_OBJ && op == code.OpAdd:
+		return vm.executeArrayConcatenation(left, right)
 	default:
-		return fmt.Errorf("unsupported types for binary operation: %s %s",
-			leftType, rightType)
+		return binaryOperationError(op, left, right)
+	}
+}
 
+// The source operators of the binary opcodes, used to report errors in the
+// same terms as the evaluator.
+var binaryOperators = map[code.Opcode]string{
+	code.OpAdd:                "+",
+	code.OpSub:                "-",
+	code.OpMul:                "*",
+	code.OpDiv:                "/",
+	code.OpMod:                "%",
+	code.OpPow:                "**",
+	code.OpBitAnd:             "&",
+	code.OpBitOr:              "|",
+	code.OpBitXor:             "^",
+	code.OpShiftLeft:          "<<",
+	code.OpShiftRight:         ">>",
+	code.OpEqual:              "==",
+	code.OpNotEqual:           "!=",
+	code.OpGreaterThan:        ">",
+	code.OpGreaterThanOrEqual: ">=",
+}
+
+func binaryOperationError(op code.Opcode, left, right object.Object) error {
+	if left.Type() != right.Type() {
+		return fmt.Errorf("type mismatch: %s %s %s",
+			left.Type(), binaryOperators[op], right.Type())
 	}
+
+	return fmt.Errorf("unknown operator: %s %s %s",
+		left.Type(), binaryOperators[op], right.Type())
 }
 
 func (vm *VM) executeBinaryIntegerOperation(
 	op code.Opcode,
-	left, right object.Object,
+	leftVal, rightVal int64,
 ) error {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
+	if vm.checkedArithmetic && object.IntegerOverflows(binaryOperators[op], leftVal, rightVal) {
+		return fmt.Errorf("integer overflow: %d %s %d", leftVal, binaryOperators[op], rightVal)
+	}
 
 	var res int64
 
@@ -396,12 +1076,77 @@ func (vm *VM) executeBinaryIntegerOperation(
 	case code.OpMul:
 		res = leftVal * rightVal
 	case code.OpDiv:
+		if rightVal == 0 {
+			return fmt.Errorf("division by zero")
+		}
 		res = leftVal / rightVal
+	case code.OpMod:
+		if rightVal == 0 {
+			return fmt.Errorf("modulo by zero")
+		}
+		res = leftVal % rightVal
+	case code.OpPow:
+		if rightVal < 0 {
+			return vm.push(&object.Float{Value: math.Pow(float64(leftVal), float64(rightVal))})
+		}
+		var ok bool
+		if res, ok = object.PowerInts(leftVal, rightVal); !ok {
+			return fmt.Errorf("integer overflow: %d ** %d", leftVal, rightVal)
+		}
+	case code.OpBitAnd:
+		res = leftVal & rightVal
+	case code.OpBitOr:
+		res = leftVal | rightVal
+	case code.OpBitXor:
+		res = leftVal ^ rightVal
+	case code.OpShiftLeft:
+		if rightVal < 0 {
+			return fmt.Errorf("negative shift count: %d", rightVal)
+		}
+		res = leftVal << rightVal
+	case code.OpShiftRight:
+		if rightVal < 0 {
+			return fmt.Errorf("negative shift count: %d", rightVal)
+		}
+		res = leftVal >> rightVal
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
 
-	return vm.push(&object.Integer{Value: res})
+	return vm.pushInt(res)
+}
+
+func (vm *VM) executeBinaryFloatOperation(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	leftVal := object.ToFloat(left)
+	rightVal := object.ToFloat(right)
+
+	var res float64
+
+	switch op {
+	case code.OpAdd:
+		res = leftVal + rightVal
+	case code.OpSub:
+		res = leftVal - rightVal
+	case code.OpMul:
+		res = leftVal * rightVal
+	case code.OpDiv:
+		res = leftVal / rightVal
+	case code.OpMod:
+		if rightVal == 0 {
+			return fmt.Errorf("modulo by zero")
+		}
+		res = math.Mod(leftVal, rightVal)
+	case code.OpPow:
+		res = math.Pow(leftVal, rightVal)
+	default:
+		return fmt.Errorf("unknown operator: %s %s %s",
+			left.Type(), binaryOperators[op], right.Type())
+	}
+
+	return vm.push(&object.Float{Value: res})
 }
 
 func (vm *VM) executeBinaryStringOperation(
@@ -409,39 +1154,105 @@ func (vm *VM) executeBinaryStringOperation(
 	left, right object.Object,
 ) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operator: %d", op)
+		return binaryOperationError(op, left, right)
 	}
 
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
-	return vm.push(&object.String{Value: leftVal + rightVal})
+
+	str := &object.String{Value: leftVal + rightVal}
+	if err := vm.allocate(str); err != nil {
+		return err
+	}
+	return vm.push(str)
+}
+
+func (vm *VM) executeArrayConcatenation(left, right object.Object) error {
+	leftElems := left.(*object.Array).Elements
+	rightElems := right.(*object.Array).Elements
+
+	elems := make([]object.Object, 0, len(leftElems)+len(rightElems))
+	elems = append(elems, leftElems...)
+	elems = append(elems, rightElems...)
+
+	arr := &object.Array{Elements: elems}
+	if err := vm.allocate(arr); err != nil {
+		return err
+	}
+	return vm.push(arr)
 }
 
 func (vm *VM) executeComparison(op code.Opcode) error {
-	right := vm.pop()
-	left := vm.pop()
+	rightVal := vm.popValue()
+	leftVal := vm.popValue()
+	return vm.executeComparisonValues(op, leftVal, rightVal)
+}
+
+func (vm *VM) executeComparisonValues(op code.Opcode, leftVal, rightVal value) error {
+	if l, ok := leftVal.int(); ok {
+		if r, ok := rightVal.int(); ok {
+			return vm.executeIntegerComparison(op, l, r)
+		}
+	}
 
-	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
-		return vm.executeIntegerComparison(op, left, right)
+	right := rightVal.Object()
+	left := leftVal.Object()
+	if object.IsNumeric(left) && object.IsNumeric(right) {
+		return vm.executeFloatComparison(op, left, right)
+	}
+	if left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ {
+		return vm.executeStringComparison(op, left, right)
 	}
 
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBoolObj(left == right))
+		return vm.push(nativeBoolToBoolObj(object.Equals(left, right)))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBoolObj(left != right))
+		return vm.push(nativeBoolToBoolObj(!object.Equals(left, right)))
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)",
-			op, left.Type(), right.Type())
+		return binaryOperationError(op, left, right)
 	}
 }
 
 func (vm *VM) executeIntegerComparison(
+	op code.Opcode,
+	leftVal, rightVal int64,
+) error {
+	if !comparisonOpcodes[op] {
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+	return vm.push(nativeBoolToBoolObj(compareIntegers(op, leftVal, rightVal)))
+}
+
+var comparisonOpcodes = map[code.Opcode]bool{
+	code.OpEqual:              true,
+	code.OpNotEqual:           true,
+	code.OpGreaterThan:        true,
+	code.OpGreaterThanOrEqual: true,
+}
+
+// Reports whether the comparison op holds, false if op isn't one.
+func compareIntegers(op code.Opcode, leftVal, rightVal int64) bool {
+	switch op {
+	case code.OpEqual:
+		return leftVal == rightVal
+	case code.OpNotEqual:
+		return leftVal != rightVal
+	case code.OpGreaterThan:
+		return leftVal > rightVal
+	case code.OpGreaterThanOrEqual:
+		return leftVal >= rightVal
+	default:
+		return false
+	}
+}
+
+func (vm *VM) executeFloatComparison(
 	op code.Opcode,
 	left, right object.Object,
 ) error {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
+	leftVal := object.ToFloat(left)
+	rightVal := object.ToFloat(right)
 
 	switch op {
 	case code.OpEqual:
@@ -450,25 +1261,52 @@ func (vm *VM) executeIntegerComparison(
 		return vm.push(nativeBoolToBoolObj(leftVal != rightVal))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBoolObj(leftVal > rightVal))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBoolObj(leftVal >= rightVal))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
 }
 
-func (vm *VM) executeIndexExpression(left, index object.Object) error {
+func (vm *VM) executeStringComparison(
+	op code.Opcode,
+	left, right object.Object,
+) error {
+	leftVal := left.(*object.String).Value
+	rightVal := right.(*object.String).Value
+
+	// Interned strings are equal exactly when they are the same object.
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBoolObj(left == right || leftVal == rightVal))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBoolObj(left != right && leftVal != rightVal))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBoolObj(leftVal > rightVal))
+	case code.OpGreaterThanOrEqual:
+		return vm.push(nativeBoolToBoolObj(leftVal >= rightVal))
+	default:
+		return binaryOperationError(op, left, right)
+	}
+}
+
+func (vm *VM) executeIndexExpression(left object.Object, index value) error {
+	i, isInt := index.int()
+
 	switch {
-	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
-		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.ARRAY_OBJ && isInt:
+		return vm.executeArrayIndex(left, i)
+	case left.Type() == object.STRING_OBJ && isInt:
+		return vm.executeStringIndex(left, i)
 	case left.Type() == object.HASH_OBJ:
-		return vm.executeHashIndex(left, index)
+		return vm.executeHashIndex(left, index.Object())
 	default:
 		return fmt.Errorf("index operator not supported: %s", left.Type())
 	}
 }
 
-func (vm *VM) executeArrayIndex(array, index object.Object) error {
+func (vm *VM) executeArrayIndex(array object.Object, i int64) error {
 	arrObj := array.(*object.Array)
-	i := index.(*object.Integer).Value
 
 	max := int64(len(arrObj.Elements) - 1)
 	if i < 0 || i > max {
@@ -478,6 +1316,69 @@ func (vm *VM) executeArrayIndex(array, index object.Object) error {
 	return vm.push(arrObj.Elements[i])
 }
 
+func (vm *VM) executeStringIndex(str object.Object, i int64) error {
+	ch, ok := str.(*object.String).At(i)
+	if !ok {
+		return vm.push(Null)
+	}
+
+	return vm.push(&object.String{Value: ch})
+}
+
+func (vm *VM) executeSliceExpression(left, start, end object.Object) error {
+	var length int64
+	switch left := left.(type) {
+	case *object.Array:
+		length = int64(len(left.Elements))
+	case *object.String:
+		length = int64(left.Len())
+	default:
+		return fmt.Errorf("slice operator not supported: %s", left.Type())
+	}
+
+	from, err := sliceBound(start, 0, length)
+	if err != nil {
+		return err
+	}
+	to, err := sliceBound(end, length, length)
+	if err != nil {
+		return err
+	}
+	if from > to {
+		from = to
+	}
+
+	var slice object.Object
+	switch left := left.(type) {
+	case *object.Array:
+		elems := make([]object.Object, to-from)
+		copy(elems, left.Elements[from:to])
+		slice = &object.Array{Elements: elems}
+	default:
+		slice = &object.String{Value: left.(*object.String).Slice(from, to)}
+	}
+
+	if err := vm.allocate(slice); err != nil {
+		return err
+	}
+	return vm.push(slice)
+}
+
+// Resolves one bound of a slice, using def when the bound was omitted (Null)
+// and clamping the result to [0, length].
+func sliceBound(bound object.Object, def, length int64) (int64, error) {
+	if bound == Null {
+		return def, nil
+	}
+
+	integer, ok := bound.(*object.Integer)
+	if !ok {
+		return 0, fmt.Errorf("slice index must be INTEGER, got %s", bound.Type())
+	}
+
+	return min(max(integer.Value, 0), length), nil
+}
+
 func (vm *VM) executeHashIndex(hash, index object.Object) error {
 	hashObj := hash.(*object.Hash)
 
@@ -498,7 +1399,7 @@ func (vm *VM) buildArray(startIdx, endIdx int) object.Object {
 	elems := make([]object.Object, endIdx-startIdx)
 
 	for i := startIdx; i < endIdx; i++ {
-		elems[i-startIdx] = vm.stack[i]
+		elems[i-startIdx] = vm.stack[i].Object()
 	}
 
 	return &object.Array{Elements: elems}
@@ -508,8 +1409,8 @@ func (vm *VM) buildHash(startIdx, endIdx int) (object.Object, error) {
 	hashedPairs := make(map[object.HashKey]object.HashPair)
 
 	for i := startIdx; i < endIdx; i += 2 {
-		key := vm.stack[i]
-		value := vm.stack[i+1]
+		key := vm.stack[i].Object()
+		value := vm.stack[i+1].Object()
 
 		pair := object.HashPair{Key: key, Value: value}
 
@@ -525,42 +1426,280 @@ func (vm *VM) buildHash(startIdx, endIdx int) (object.Object, error) {
 }
 
 func (vm *VM) executeCall(numArgs int) error {
-	callee := vm.stack[vm.sp-1-numArgs]
+	callee := vm.stack[vm.sp-1-numArgs].obj
 	switch callee := callee.(type) {
 	case *object.Closure:
 		return vm.callClosure(callee, numArgs)
 	case *object.Builtin:
 		return vm.callBuiltin(callee, numArgs)
 	default:
-		return fmt.Errorf("calling non-function and non-builtin")
+		return fmt.Errorf("not a function: %s", callee.Type())
+	}
+}
+
+// Reports whether the call the current frame is at is the last thing its
+// function does, so that the function can return whatever the call returns
+// without its frame: the call is followed by a return, or by jumps to one,
+// isn't within a try, and is of a closure, which would need a frame of its
+// own.
+func (vm *VM) inTailPosition(numArgs int) bool {
+	frame := vm.currentFrame()
+	if vm.framesIndex == 1 || len(frame.handlers) > 0 {
+		return false
 	}
+	if _, ok := vm.stack[vm.sp-1-numArgs].obj.(*object.Closure); !ok {
+		return false
+	}
+
+	ins := frame.Instructions()
+	ip := frame.ip + 1
+	for range ins {
+		if ip >= len(ins) {
+			return false
+		}
+		switch code.Opcode(ins[ip]) {
+		case code.OpReturnValue:
+			return true
+		case code.OpJump:
+			ip = int(code.ReadUint16(ins[ip+1:]))
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// Calls the closure below the arguments on top of the stack in place of the
+// current frame's function, reusing its frame, so that recursion in tail
+// position runs in constant space, as it does on the evaluator.
+func (vm *VM) tailCall(numArgs int) error {
+	frame := vm.currentFrame()
+	cl := vm.stack[vm.sp-1-numArgs].obj.(*object.Closure)
+	if err := checkArguments(cl.Fn, numArgs); err != nil {
+		return err
+	}
+
+	line, column := frame.position()
+	call := object.StackFrame{Function: object.FunctionName(frame.cl.Fn.Name), Line: line, Column: column}
+	tailCalls := frame.tailCalls
+	if n := len(tailCalls); n == 0 || tailCalls[n-1] != call {
+		tailCalls = append(tailCalls, call)
+	}
+
+	// The closure and its arguments take the place of the frame's.
+	start := frame.basePointer - 1
+	copy(vm.stack[start:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = start + 1 + numArgs
+	vm.popFrame()
+
+	if err := vm.callClosure(cl, numArgs); err != nil {
+		return err
+	}
+	vm.currentFrame().tailCalls = tailCalls
+	return nil
+}
+
+// Checks that a function can be called with numArgs arguments.
+func checkArguments(fn *object.CompiledFunction, numArgs int) error {
+	required, most := fn.NumParameters-fn.NumDefaults, fn.NumParameters
+	if fn.Variadic {
+		most = -1
+	}
+	if numArgs < required || (most >= 0 && numArgs > most) {
+		return fmt.Errorf("wrong number of arguments: want=%s, got=%d",
+			object.DescribeArity(required, most), numArgs)
+	}
+	return nil
 }
 
 func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
-	if numArgs != cl.Fn.NumParameters {
-		return fmt.Errorf("wrong number of arguments: want=%d, got=%d",
-			cl.Fn.NumParameters, numArgs)
+	if err := checkArguments(cl.Fn, numArgs); err != nil {
+		return err
+	}
+
+	if vm.framesIndex >= len(vm.frames) {
+		return fmt.Errorf("stack overflow: more than %d nested calls", len(vm.frames)-1)
+	}
+
+	// The arguments left over after the parameters are taken off the stack
+	// and collected into an array for the rest parameter, which is the local
+	// after the parameters.
+	var rest *object.Array
+	if cl.Fn.Variadic {
+		extra := max(numArgs-cl.Fn.NumParameters, 0)
+		rest = &object.Array{Elements: make([]object.Object, extra)}
+		for i := range rest.Elements {
+			rest.Elements[i] = vm.stack[vm.sp-extra+i].Object()
+		}
+		vm.sp -= extra
+		numArgs -= extra
+
+		if err := vm.allocate(rest); err != nil {
+			return err
+		}
 	}
 
-	frame := NewFrame(cl, vm.sp-numArgs)
-	vm.pushFrame(frame)
+	basePointer := vm.sp - numArgs
+	sp := basePointer + cl.Fn.NumLocals
+	if sp >= len(vm.stack) {
+		if err := vm.growStack(sp + 1); err != nil {
+			return err
+		}
+	}
 
-	vm.sp = frame.basePointer + cl.Fn.NumLocals
+	vm.pushFrame(cl, basePointer, numArgs)
+	vm.sp = sp
+	if rest != nil {
+		vm.stack[basePointer+cl.Fn.NumParameters] = objectValue(rest)
+	}
 
 	return nil
 }
 
+// Unwinds the frames and the stack to the innermost handler installed by a
+// frame at returnDepth or deeper, and continues there with the exception
+// pushed. The error is returned if it can't be handled: if there is no such
+// handler, or if it is an exit, an exceeded budget, a stop in the debugger
+// or the context being done, which can't be caught.
+func (vm *VM) handle(err error, returnDepth int) error {
+	switch err.(type) {
+	case *object.Exit, *object.BudgetExceeded, *Breakpoint, *RuntimeError:
+		return err
+	}
+	if err == errStepped || err == vm.ctx.Err() {
+		return err
+	}
+
+	i := vm.framesIndex - 1
+	for i >= returnDepth && len(vm.frames[i].handlers) == 0 {
+		i--
+	}
+	if i < returnDepth {
+		return err
+	}
+
+	for vm.framesIndex-1 > i {
+		vm.popFrame()
+	}
+
+	frame := vm.currentFrame()
+	h := frame.handlers[len(frame.handlers)-1]
+	frame.handlers = frame.handlers[:len(frame.handlers)-1]
+	frame.ip = h.ip - 1
+	vm.sp = h.sp
+
+	// A catch is passed the value thrown, or the error's message. A finally
+	// is passed what it throws again once it has run.
+	var exception object.Object
+	switch thrown := err.(type) {
+	case *object.Thrown:
+		exception = thrown.Value
+	default:
+		if h.catches {
+			exception = &object.String{Value: err.Error()}
+		} else {
+			exception = &object.Error{Message: err.Error()}
+		}
+	}
+	return vm.push(exception)
+}
+
+// Returns the currently active function calls, innermost first, with where
+// each was called from. The main frame is not a function call, so it is
+// left out.
+func (vm *VM) stackTrace() []object.StackFrame {
+	var stack []object.StackFrame
+
+	for i := vm.framesIndex - 1; i > 0; i-- {
+		frame := &vm.frames[i]
+		// Each tail call the frame was reused for was made by the function
+		// before it, and the first function was called by the caller's
+		// frame, which is still at the call.
+		name := object.FunctionName(frame.cl.Fn.Name)
+		for j := len(frame.tailCalls) - 1; j >= 0; j-- {
+			call := frame.tailCalls[j]
+			stack = append(stack, object.StackFrame{Function: name, Line: call.Line, Column: call.Column})
+			name = call.Function
+		}
+		line, column := vm.frames[i-1].position()
+		stack = append(stack, object.StackFrame{
+			Function: name,
+			Line:     line,
+			Column:   column,
+		})
+	}
+
+	return stack
+}
+
+// Returned by Run when the program fails, e.g. on a type mismatch.
+type RuntimeError struct {
+	Message string
+	Line    int // Where in the source the failing instruction comes from; 0 if unknown.
+	Column  int
+	Stack   []object.StackFrame // Innermost call first.
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Message
+}
+
+// Turns an error that stopped the program into a *RuntimeError. Exits,
+// exceeded budgets, breakpoints and the context being done aren't failures
+// of the program, and are returned as they are.
+func (vm *VM) runtimeError(err error) error {
+	switch err.(type) {
+	case nil, *object.Exit, *object.BudgetExceeded, *Breakpoint, *RuntimeError:
+		return err
+	}
+	if err == vm.ctx.Err() {
+		return err
+	}
+
+	// The frames are left as they were when the error happened. There are
+	// none if bytecode that fails verification returned from main.
+	var line, column int
+	if vm.framesIndex > 0 {
+		line, column = vm.currentFrame().position()
+	}
+	return &RuntimeError{
+		Message: err.Error(),
+		Line:    line,
+		Column:  column,
+		Stack:   vm.stackTrace(),
+	}
+}
+
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
-	args := vm.stack[vm.sp-numArgs : vm.sp]
+	args := make([]object.Object, numArgs)
+	for i, arg := range vm.stack[vm.sp-numArgs : vm.sp] {
+		args[i] = arg.Object()
+	}
 
-	res := builtin.Fn(args...)
+	res := builtin.Fn(vm, args...)
 	vm.sp = vm.sp - numArgs - 1
 
-	if res != nil {
-		vm.push(res)
-	} else {
-		vm.push(Null)
+	if vm.callErr != nil {
+		err := vm.callErr
+		vm.callErr = nil
+		return err
 	}
 
-	return nil
+	if exit, ok := res.(*object.Exit); ok {
+		return exit
+	}
+	// Errors are thrown, as they are on the evaluator, so that a try can
+	// catch them, and they stop the program if nothing does.
+	if errObj, ok := res.(*object.Error); ok {
+		return fmt.Errorf("%s", errObj.Message)
+	}
+
+	if res == nil {
+		res = Null
+	}
+	if err := vm.allocate(res); err != nil {
+		return err
+	}
+
+	return vm.push(res)
 }
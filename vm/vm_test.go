@@ -1,13 +1,20 @@
 package vm
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"monkey/ast"
+	"monkey/code"
 	"monkey/compiler"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func parse(input string) *ast.Program {
@@ -33,15 +40,36 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 			t.Fatalf("compiler error: %s", err)
 		}
 
-		vm := New(comp.Bytecode())
-		err = vm.Run()
-		if err != nil {
-			t.Fatalf("vm error: %s", err)
+		// Whatever the compiler produces has to pass the verifier.
+		bytecode := comp.Bytecode()
+		if err := bytecode.Verify(); err != nil {
+			t.Fatalf("verifier error for %q: %s", test.input, err)
 		}
 
-		stackElem := vm.LastPoppedStackElem()
-		testExpectedObject(t, test.expected, stackElem)
+		vm := New(bytecode)
+		testVmResult(t, test.input, vm, vm.Run(), test.expected)
+	}
+}
+
+// Checks what a program run on vm ended with: the error it failed with, if
+// an error is expected, or else the value it ended with.
+func testVmResult(t *testing.T, input string, vm *VM, err error, expected interface{}) {
+	t.Helper()
+
+	if _, ok := expected.(*object.Error); ok {
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Errorf("no error for %q. got=%v (%v)", input, vm.LastPoppedStackElem(), err)
+			return
+		}
+		testExpectedObject(t, expected, &object.Error{Message: runtimeErr.Message})
+		return
 	}
+	if err != nil {
+		t.Fatalf("vm error for %q: %s", input, err)
+	}
+
+	testExpectedObject(t, expected, vm.LastPoppedStackElem())
 }
 
 func testExpectedObject(
@@ -57,6 +85,11 @@ func testExpectedObject(
 		if err != nil {
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
+	case float64:
+		err := testFloatObject(expected, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
 	case bool:
 		err := testBooleanObject(bool(expected), actual)
 		if err != nil {
@@ -142,6 +175,20 @@ func testIntegerObject(expected int64, actual object.Object) error {
 
 	return nil
 }
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)",
+			actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%f, want=%f",
+			result.Value, expected)
+	}
+
+	return nil
+}
 func testBooleanObject(expected bool, actual object.Object) error {
 	res, ok := actual.(*object.Boolean)
 	if !ok {
@@ -189,6 +236,89 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"-10", -10},
 		{"-50 + 100 + -50", 0},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"6 % 3 + 2 * 5 % 4", 2},
+		{"12 & 10", 8},
+		{"12 | 10", 14},
+		{"12 ^ 10", 6},
+		{"1 << 10", 1024},
+		{"-16 >> 2", -4},
+		{"1 << 64", 0},
+		{"1 | 2 ^ 3 & 4", 3},
+		{"1 << 2 + 1", 8},
+		{"-1 ^ 5", -6},
+	}
+
+	runVmTests(t, tests)
+}
+
+// Integers computed by the VM are kept unboxed on the stack, and have to be
+// boxed wherever they leave it.
+func TestUnboxedIntegers(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(x) { let y = x * 1000; y + 1 }; f(3)", 3001},
+		{"let x = 1000 + 1; x", 1001},
+		{"[1000 + 1, 2000 + 2]", []int{1001, 2002}},
+		{"{1000 + 1: 2000 + 2}[1001]", 2002},
+		{"[1, 2, 3][1 + 1]", 3},
+		{"len([1000 + 1])", 1},
+		{"let f = fn(x) { fn() { x } }; f(1000 + 1)()", 1001},
+		{"-(1000 + 1)", -1001},
+		{"!(1000 + 1)", false},
+		{"if (1000 + 1) { 1 } else { 2 }", 1},
+		{"1000 + 1 == 1001", true},
+		{"1000 + 1 == 1001.0", true},
+		{"(1000 + 1) * 0.5", 500.5},
+	}
+
+	runVmTests(t, tests)
+}
+
+// Superinstructions only take a shortcut for integers, and otherwise do what
+// the instructions they fuse do.
+func TestSuperinstructions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(a, b) { a + b }; f(1000, 1)", 1001},
+		{`let f = fn(a, b) { a + b }; f("a", "b")`, "ab"},
+		{"let f = fn(a) { a + 1 - 2 }; f(1000)", 999},
+		{"let f = fn(a) { a + 1 }; f(0.5)", 1.5},
+		{"let f = fn(a) { a - 1 }; f(0.5)", -0.5},
+		{"let f = fn(a) { if (a > 1) { 1 } else { 2 } }; f(1000)", 1},
+		{"let f = fn(a) { if (a > 1) { 1 } else { 2 } }; f(1.5)", 1},
+		{"let f = fn(a) { if (a >= 1) { 1 } else { 2 } }; f(0)", 2},
+		{`let f = fn(a) { if (a == "x") { 1 } else { 2 } }; f("x")`, 1},
+		{"let f = fn(a) { if (a != true) { 1 } else { 2 } }; f(true)", 2},
+		{"let f = fn(n) { let i = 0; while (i < n) { i = i + 1 }; i }; f(300)", 300},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"1.5", 1.5},
+		{"-1.5", -1.5},
+		{"1.5 + 1.5", 3.0},
+		{"1 + 0.5", 1.5},
+		{"0.5 + 1", 1.5},
+		{"2.5 * 2", 5.0},
+		{"5 / 2.0", 2.5},
+		{"5 / 2", 2},
+		{"1.0 - 0.25", 0.75},
+		{"5.5 % 2", 1.5},
+		{"2 ** 10", 1024},
+		{"2 ** -1", 0.5},
+		{"2.0 ** 3", 8.0},
+		{"4 ** 0.5", 2.0},
+		{"-2 ** 2", -4},
+		{"(-2) ** 2", 4},
+		{"2 ** 3 ** 2", 512},
+		{"2 * 3 ** 2", 18},
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"1.0 == 1", true},
+		{"1.5 != 1.5", false},
 	}
 
 	runVmTests(t, tests)
@@ -202,6 +332,14 @@ func TestBooleanExpressions(t *testing.T) {
 		{"1 > 2", false},
 		{"1 < 1", false},
 		{"1 > 1", false},
+		{"1 <= 1", true},
+		{"1 >= 1", true},
+		{"1 <= 2", true},
+		{"1 >= 2", false},
+		{"2 <= 1", false},
+		{"2 >= 1", true},
+		{"1.5 <= 1.5", true},
+		{"1 >= 1.5", false},
 		{"1 == 1", true},
 		{"1 != 1", false},
 		{"1 == 2", false},
@@ -227,6 +365,45 @@ func TestBooleanExpressions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestNullLiteral(t *testing.T) {
+	tests := []vmTestCase{
+		{"null", Null},
+		{"let x = null; x", Null},
+		{"null == null", true},
+		{"null != null", false},
+		{"null == false", false},
+		{"null == 0", false},
+		{"!null", true},
+		{"let f = fn() {}; f() == null", true},
+		{"[1][5] == null", true},
+		{`{"a": 1}["b"] != null`, false},
+		{"if (null) { true } else { false }", false},
+		{"let x = null; if (x == null) { 1 } else { 2 }", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"true || false", true},
+		{"false || false", false},
+		{"1 && 2", true},
+		{"0 || false", true},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		{"let x = 5; x > 1 && x < 10", true},
+		// The call on the right is skipped, otherwise the VM would fail.
+		{"false && fn(a) { a }()", false},
+		{"true || fn(a) { a }()", true},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []vmTestCase{
 		{"if (true) { 10 }", 10},
@@ -239,11 +416,171 @@ func TestConditionals(t *testing.T) {
 		{"if (1 > 2) { 10 }", Null},
 		{"if (false) { 10 }", Null},
 		{"if ((if (false) { 10 })) { 10 } else { 20 }", 20},
+		{"if (true) { }", Null},
+		{"if (false) { 10 } else { let x = 1; }", Null},
+		{"if (1 > 2) { 10 } else if (1 < 2) { 20 } else { 30 }", 20},
+		{"if (1 > 2) { 10 } else if (1 > 3) { 20 } else { 30 }", 30},
+		{"if (1 > 2) { 10 } else if (1 > 3) { 20 }", Null},
+		{"let x = 3; if (x == 1) { 1 } else if (x == 2) { 2 } else if (x == 3) { 3 } else { 4 }", 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestConditionalExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"true ? 10 : 20", 10},
+		{"false ? 10 : 20", 20},
+		{"null ? 10 : 20", 20},
+		{"1 < 2 ? 10 : 20", 10},
+		{"let x = 3; x > 5 ? 1 : x > 2 ? 2 : 3", 2},
+		{"let f = fn(n) { n < 2 ? n : f(n - 1) + f(n - 2) }; f(10)", 55},
+		{"let x = 0; x = true ? 5 : 6; x", 5},
+		{"true ? null : 1", Null},
+		{"let x = 1; x ? 1 : 1 / 0", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestWhileExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"while (false) { 10 }", Null},
+		{"let f = fn() { while (true) { return 10; } }; f();", 10},
+		{"let f = fn(x) { while (x > 5) { return x; } 0 }; f(10);", 10},
+		{"let f = fn(x) { while (x > 5) { return x; } 0 }; f(1);", 0},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBlockScopes(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = 1; if (true) { let a = 2; }; a", 1},
+		{"let a = 1; if (true) { let a = 2; a }", 2},
+		{"let a = 1; if (true) { a = 2; }; a", 2},
+		{"let a = 1; if (true) { let a = a + 1; a }", 2},
+		{"let f = fn(a) { if (true) { let a = 2; }; a }; f(1)", 1},
+		{"let f = fn(a) { if (a) { let b = 2; b } else { let b = 3; b } }; f(false)", 3},
+		{"let f = fn() { if (true) { let a = 5; fn() { a } } }; f()()", 5},
+		{`
+		let sum = 0;
+		let i = 0;
+		while (i < 3) {
+			let sq = i * i;
+			sum = sum + sq;
+			i = i + 1;
+		}
+		sum
+		`, 5},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"try { 1 } catch (e) { 2 }", 1},
+		{"try { throw 5; 1 } catch (e) { e + 1 }", 6},
+		{"try { 1 + true } catch (e) { e }", "type mismatch: INTEGER + BOOLEAN"},
+		{"try { len(1); 5 } catch (e) { e }", "argument to `len` not supported, got INTEGER"},
+		{`try { int("abc") } catch { -1 }`, -1},
+		{`len(1); "after"`, &object.Error{Message: "argument to `len` not supported, got INTEGER"}},
+		{"let f = fn(x) { if (x > 1) { throw x }; x }; try { f(1) + f(2) } catch (e) { e * 10 }", 20},
+		{"try { throw 1 } catch { }", Null},
+		{"try { throw 1 } catch { 2 }", 2},
+		{"let e = 1; try { throw 2 } catch (e) { e }; e", 1},
+		{"try { try { throw 1 } catch (e) { throw e + 1 } } catch (e) { e }", 2},
+		{"try { map([1, 2], fn(x) { throw x * 3 }) } catch (e) { e }", 3},
+		{"let a = [1, 2]; try { throw a } catch (e) { e }", []int{1, 2}},
+		{"let f = fn(a) { let b = 2; try { let c = 3; throw a + b + c } catch (e) { e + b } }; f(1)", 8},
+		{"let f = fn() { try { return 1 } finally { 2 } }; f()", 1},
+		{"let f = fn() { try { 1 } finally { return 2 } }; f()", 2},
+		{"let f = fn() { try { throw 1 } finally { return 2 } }; f()", 2},
+		{"try { try { throw 1 } finally { 5 } } catch (e) { e }", 1},
+		{`let f = fn(n) { try { if (n == 0) { throw "bottom" }; f(n - 1) } finally { } }; try { f(3) } catch (e) { e }`, "bottom"},
+		{"let i = 0; let n = 0; while (i < 3) { n = n + try { if (i == 1) { throw 10 }; i } catch (e) { e }; i = i + 1; }; n", 12},
+		{"let f = fn() { try { try { return 1 } finally { 2 } } catch { 3 } }; f()", 1},
+		{"let f = fn() { try { throw 1 } catch (e) { return e + 1 } finally { 9 } }; f()", 2},
 	}
 
 	runVmTests(t, tests)
 }
 
+func TestFinallyOutput(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`try { puts("try"); throw "x" } catch (e) { puts("catch " + e) } finally { puts("finally") }`,
+			"try\ncatch x\nfinally\n",
+		},
+		{`let f = fn() { try { return puts("return") } finally { puts("finally") } }; f()`, "return\nfinally\n"},
+		{`try { try { throw 1 } finally { puts("inner") } } catch { puts("outer") }`, "inner\nouter\n"},
+		{`try { puts("try") } finally { puts("finally") }`, "try\nfinally\n"},
+		{
+			// Each finally runs once, the inner one before the outer.
+			`let f = fn() { try { try { return 1 } finally { puts("a") } } finally { puts("b") } }; f()`,
+			"a\nb\n",
+		},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+
+		vm := New(comp.Bytecode())
+		vm.SetStdout(&out)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if out.String() != test.expected {
+			t.Errorf("wrong output for %q. got=%q, want=%q",
+				test.input, out.String(), test.expected)
+		}
+	}
+}
+
+func TestUncaughtExceptions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`throw "oops"`, "uncaught exception: oops"},
+		{`throw [1, "a"]; 5`, "uncaught exception: [1, a]"},
+		{`let f = fn() { throw {"code": 1} }; f() + 1`, "uncaught exception: {code: 1}"},
+		{`try { throw 1 } finally { 2 }`, "uncaught exception: 1"},
+		{`try { 1 + true } finally { }`, "type mismatch: INTEGER + BOOLEAN"},
+		{`try { throw 1 } catch (e) { throw e + 1 }`, "uncaught exception: 2"},
+		{`try { 1 } finally { throw 3 }`, "uncaught exception: 3"},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != test.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", test.expected, err)
+		}
+	}
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []vmTestCase{
 		{"let one = 1; one", 1},
@@ -253,11 +590,64 @@ func TestGlobalLetStatements(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestDestructuringLetStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"let [a, b, c] = [1, 2, 3]; a * 100 + b * 10 + c;", 123},
+		{"let arr = [4, 5]; let [x, y] = arr; x + y;", 9},
+		{`let {"x": x, "y": y} = {"x": 1, "y": 2, "z": 3}; x - y;`, -1},
+		{`let k = "b"; let {"a": a, k: b} = {"a": 1, "b": 2}; a + b;`, 3},
+		{"let {1: one, true: t} = {1: 10, true: 20}; one + t;", 30},
+		{"let f = fn(p) { let [a, b] = p; a * b }; f([6, 7]);", 42},
+		{"let [a, b] = [1, [2, 3]]; a + b[0] + b[1];", 6},
+		{"let [] = []; 1;", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestConstStatements(t *testing.T) {
+	tests := []vmTestCase{
+		{"const a = 5; a + 1;", 6},
+		{"const a = 5; let f = fn() { let a = 1; a = 10; a }; f();", 10},
+		{"const a = 5; let a = 6; a = 7; a;", 7},
+		{"let f = fn(x) { const y = x * 2; y }; f(4);", 8},
+		{"const {\"a\": a} = {\"a\": 1}; a;", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = 5; a = 10; a;", 10},
+		{"let a = 5; a = 10;", 10},
+		{"let a = 5; let b = 0; a = b = 3; a + b;", 6},
+		{"let a = 1; let f = fn() { a = a + 1; }; f(); f(); a;", 3},
+		{"let f = fn(x) { x = x * 2; x }; f(4);", 8},
+		{"let f = fn() { let x = 1; x = x + 1; x }; f();", 2},
+		{"let i = 0; while (i < 5) { i = i + 1; }; i;", 5},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestStringExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{`"monkey"`, "monkey"},
 		{`"mon" + "key"`, "monkey"},
 		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"monkey" == "monkey"`, true},
+		{`"mon" + "key" == "monkey"`, true},
+		{`"monkey" != "banana"`, true},
+		{`"monkey" != "mon" + "key"`, false},
+		{`"apple" < "banana"`, true},
+		{`"apple" > "banana"`, false},
+		{`"apple" <= "apple"`, true},
+		{`"apple" >= "apples"`, false},
+		{`"Zebra" < "apple"`, true},
+		{`"" < "a"`, true},
+		{`let a = "b"; let b = "a"; a > b`, true},
+		{`let a = "b"; if (a <= "c") { 1 } else { 2 }`, 1},
 	}
 
 	runVmTests(t, tests)
@@ -273,6 +663,43 @@ func TestArrayLiterals(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestArrayOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2] + [3]", []int{1, 2, 3}},
+		{"[] + []", []int{}},
+		{"let a = [1]; let b = a + [2]; a", []int{1}},
+		{"[1, 2] == [1, 2]", true},
+		{"[1, [2, 3]] == [1, [2, 3]]", true},
+		{"[1, 2] == [2, 1]", false},
+		{"[1, 2] != [1, 2, 3]", true},
+		{"[1, 2.0] == [1.0, 2]", true},
+		{`["a", true, [[]]] == ["a", true, [[]]]`, true},
+		{"let f = fn() {}; [f] == [f]", true},
+		{"[fn() {}] == [fn() {}]", false},
+		{"[1] == 1", false},
+		{"let a = [1000 + 1]; if (a == [1001]) { 1 } else { 2 }", 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHashEquality(t *testing.T) {
+	tests := []vmTestCase{
+		{`{"a": 1} == {"a": 1}`, true},
+		{`{"a": 1, "b": 2} == {"b": 2, "a": 1}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`{"a": 1} != {"a": 1, "b": 2}`, true},
+		{`{} == {}`, true},
+		{`{"a": {"b": [1, {"c": 2}]}} == {"a": {"b": [1, {"c": 2.0}]}}`, true},
+		{`{"a": {"b": [1, {"c": 2}]}} == {"a": {"b": [1, {"c": 3}]}}`, false},
+		{`{1: "a"} == {"1": "a"}`, false},
+		{`{"a": 1} == ["a", 1]`, false},
+		{`let h = {"n": 1000 + 1}; if (h == {"n": 1001}) { 1 } else { 2 }`, 1},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestHashLiterals(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -309,6 +736,27 @@ func TestIndexExpressions(t *testing.T) {
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
 		{"{}[0]", Null},
+		{`"hello"[1]`, "e"},
+		{`"hello"[5]`, Null},
+		{`"hello"[-1]`, Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSliceExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`"hello"[1:3]`, "el"},
+		{`"hello"[:2]`, "he"},
+		{`"hello"[3:]`, "lo"},
+		{`"hello"[:]`, "hello"},
+		{`"hello"[-5:99]`, "hello"},
+		{`"hello"[4:1]`, ""},
+		{"[1, 2, 3, 4][1:3]", []int{2, 3}},
+		{"[1, 2, 3][:1]", []int{1}},
+		{"[1, 2, 3][1 + 1:]", []int{3}},
+		{"[1, 2, 3][3:]", []int{}},
+		{"let a = [1, 2, 3]; let b = a[:]; b", []int{1, 2, 3}},
 	}
 
 	runVmTests(t, tests)
@@ -361,6 +809,12 @@ func TestFunctionsWithReturnStatement(t *testing.T) {
 		`,
 			expected: 99,
 		},
+		// Returning from the main program ends it with the value.
+		{input: "return 5; 6", expected: 5},
+		{input: "let x = 1; if (x > 0) { return x * 2; } 3", expected: 2},
+		{input: "let i = 0; while (true) { i = i + 1; if (i == 3) { return i; } }", expected: 3},
+		{input: "try { return 7; } finally { 8 }", expected: 7},
+		{input: "let f = fn() { 1 }; return f() + 1;", expected: 2},
 	}
 
 	runVmTests(t, tests)
@@ -533,6 +987,38 @@ func TestCallingFunctionsWithArgumentsAndBindings(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestCallingFunctionsWithDefaults(t *testing.T) {
+	tests := []vmTestCase{
+		{"let add = fn(x, y = 10) { x + y; }; add(5);", 15},
+		{"let add = fn(x, y = 10) { x + y; }; add(5, 1);", 6},
+		{"let f = fn(a = 1, b = a * 2) { a * 10 + b }; f();", 12},
+		{"let f = fn(a = 1, b = a * 2) { a * 10 + b }; f(3);", 36},
+		{"let n = 1; let f = fn(x = n) { x }; n = 2; f();", 2},
+		{"let f = fn(x) { fn(y = x) { y } }; f(7)();", 7},
+		{"let f = fn(x = [1]) { x }; f() == f();", true},
+		{"map([1, 2], fn(x, y = 3) { x * y });", []int{3, 6}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallingVariadicFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let count = fn(...xs) { len(xs) }; count(1, 2, 3);", 3},
+		{"let count = fn(...xs) { len(xs) }; count();", 0},
+		{"let all = fn(...xs) { xs }; all(1, 2, 3);", []int{1, 2, 3}},
+		{"let f = fn(a, ...rest) { rest }; f(10);", []int{}},
+		{"let f = fn(a, ...rest) { a + rest[1] }; f(10, 20, 30);", 40},
+		{"let f = fn(a, b = 5, ...rest) { a + b + len(rest) }; f(1);", 6},
+		{"let f = fn(a, b = 5, ...rest) { a + b + len(rest) }; f(1, 2, 3, 4);", 5},
+		{"let f = fn(a, ...rest) { let x = a * 2; x + len(rest) }; f(1, 2, 3) + f(4);", 12},
+		{`let sum = fn(...xs) { reduce(xs, 0, fn(acc, x) { acc + x }) }; sum(1, 2, 3, 4);`, 10},
+		{"let f = fn(n, ...acc) { if (n == 0) { len(acc) } else { f(n - 1, n, n) } }; f(3);", 2},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -547,6 +1033,18 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 			input:    `fn(a, b) { a + b; }(1);`,
 			expected: `wrong number of arguments: want=2, got=1`,
 		},
+		{
+			input:    `fn(a, b = 1) { a + b; }();`,
+			expected: `wrong number of arguments: want=1 or 2, got=0`,
+		},
+		{
+			input:    `fn(a = 1, b = 2, c = 3) { a; }(1, 2, 3, 4);`,
+			expected: `wrong number of arguments: want=0 to 3, got=4`,
+		},
+		{
+			input:    `fn(a, b, ...rest) { a; }(1);`,
+			expected: `wrong number of arguments: want=at least 2, got=1`,
+		},
 	}
 
 	for _, test := range tests {
@@ -570,10 +1068,61 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	}
 }
 
+func TestArithmeticErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"5 % 0", "modulo by zero"},
+		{"5.5 % 0", "modulo by zero"},
+		{"5 / 0", "division by zero"},
+		{"2 ** 64", "integer overflow: 2 ** 64"},
+		{"[1] - [1]", "unknown operator: ARRAY - ARRAY"},
+		{"1 << -1", "negative shift count: -1"},
+		{"1.5 & 1", "unknown operator: FLOAT & INTEGER"},
+		{"let f = fn(x) { 10 / x }; f(0)", "division by zero"},
+		{"5 + true", "type mismatch: INTEGER + BOOLEAN"},
+		{"true * false", "unknown operator: BOOLEAN * BOOLEAN"},
+		{`"a" - "b"`, "unknown operator: STRING - STRING"},
+		{"-true", "unknown operator: -BOOLEAN"},
+		{"5[1:2]", "slice operator not supported: INTEGER"},
+		{`"hello"["a":]`, "slice index must be INTEGER, got STRING"},
+		{"let [a, b] = [1, 2, 3];", "wrong number of elements to destructure: want=2, got=3"},
+		{"let [a] = 1;", "cannot destructure INTEGER as an array"},
+		{`let {"a": a} = [1];`, "cannot destructure ARRAY as a hash"},
+		{`let {"a": a, "b": b} = {"a": 1};`, `hash has no key "b" to destructure`},
+		{`let {[]: a} = {"a": 1};`, "unusable as hash key: ARRAY"},
+		{"fn(a) { a + 1 }(true)", "type mismatch: BOOLEAN + INTEGER"},
+		{"fn(a, b) { a + b }(1, true)", "type mismatch: INTEGER + BOOLEAN"},
+		{`fn(a) { if (a > 1) { 1 } }("x")`, "type mismatch: STRING > INTEGER"},
+	}
+
+	for _, test := range tests {
+		program := parse(test.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != test.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", test.expected, err)
+		}
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []vmTestCase{
 		{`len("")`, 0},
 		{`len("four")`, 4},
+		{`len("héllo 世界")`, 8},
 		{`len("hello world")`, 11},
 		{
 			`len(1)`,
@@ -581,7 +1130,8 @@ func TestBuiltinFunctions(t *testing.T) {
 				Message: "argument to `len` not supported, got INTEGER",
 			},
 		},
-		{`len("one", "two")`,
+		// Calls by a builtin's own name are checked by the compiler instead.
+		{`let f = len; f("one", "two")`,
 			&object.Error{
 				Message: "wrong number of arguments. got=2, want=1",
 			},
@@ -611,7 +1161,1436 @@ func TestBuiltinFunctions(t *testing.T) {
 				Message: "argument to `push` must be ARRAY, got INTEGER",
 			},
 		},
+		{`let apply = fn(f, x) { f(x) }; apply(len, "four")`, 4},
+		{`let outer = fn(arr) { fn() { first(arr) } }; outer([7, 8])()`, 7},
+		{`let len = fn(x) { 99 }; len("four")`, 99},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestStringBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`len(split("a,b,c", ","))`, 3},
+		{`split("a,b,c", ",")[1]`, "b"},
+		{`split(1, ",")`, &object.Error{
+			Message: "arguments to `split` must be STRING, got INTEGER and STRING",
+		}},
+		{`join(["a", "b", "c"], ", ")`, "a, b, c"},
+		{`join([], ",")`, ""},
+		{`join(["a", 1], ",")`, &object.Error{
+			Message: "elements of array passed to `join` must be STRING, got INTEGER",
+		}},
+		{`replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`let f = replace; f("abc", "a")`, &object.Error{
+			Message: "wrong number of arguments. got=2, want=3",
+		}},
+		{`trim("  hi there   ")`, "hi there"},
+		{`upper("Hello")`, "HELLO"},
+		{`lower("Hello")`, "hello"},
+		{`lower(1)`, &object.Error{
+			Message: "argument to `lower` must be STRING, got INTEGER",
+		}},
+		{`contains("monkey", "key")`, true},
+		{`contains("monkey", "donkey")`, false},
+		{`contains("monkey", "key") == true`, true},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHigherOrderBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`map([1, 2, 3], fn(x) { x * 2 })`, []int{2, 4, 6}},
+		{`map([], fn(x) { x * 2 })`, []int{}},
+		{`map([1, -2], fn(x) { if (x < 0) { -x } else { x } })`, []int{1, 2}},
+		{`let n = 10; map([1, 2], fn(x) { x + n })`, []int{11, 12}},
+		{`let f = fn(n) { map([1, 2], fn(x) { x + n }) }; f(5)`, []int{6, 7}},
+		{`map([[1], [2, 3]], fn(arr) { len(map(arr, fn(x) { -x })) })`, []int{1, 2}},
+		{`map(["a", "b"], upper)[1]`, "B"},
+		{`filter([1, 2, 3, 4], fn(x) { x % 2 == 0 })`, []int{2, 4}},
+		{`filter([1, 0, 2], fn(x) { if (x > 0) { x } })`, []int{1, 2}},
+		{`reduce([1, 2, 3, 4], 0, fn(acc, x) { acc + x })`, 10},
+		{`reduce([], 5, fn(acc, x) { acc + x })`, 5},
+		{`let sum = fn(arr) { reduce(arr, 0, fn(a, b) { a + b }) }; sum([1, 2]) + sum([3])`, 6},
+		{`map(1, fn(x) { x })`, &object.Error{
+			Message: "first argument to `map` must be ARRAY, got INTEGER",
+		}},
+		{`let f = reduce; f([1], fn(acc, x) { acc })`, &object.Error{
+			Message: "wrong number of arguments. got=2, want=3",
+		}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSortBuiltin(t *testing.T) {
+	tests := []vmTestCase{
+		{`sort([3, 1, 2])`, []int{1, 2, 3}},
+		{`sort([])`, []int{}},
+		{`join(sort(["pear", "apple", "fig"]), ",")`, "apple,fig,pear"},
+		{`let arr = [2, 1]; sort(arr); arr`, []int{2, 1}},
+		{`sort([3, 1, 2], fn(a, b) { a > b })`, []int{3, 2, 1}},
+		{`let key = fn(pair) { pair[0] }; map(sort([[2, 1], [1, 2], [2, 3]], fn(a, b) { key(a) < key(b) }), last)`,
+			[]int{2, 1, 3}},
+		{`sort([1, "a"])`, &object.Error{
+			Message: "elements of array passed to `sort` must be comparable, got STRING and INTEGER",
+		}},
+		{`let f = sort; f()`, &object.Error{
+			Message: "wrong number of arguments. got=0, want=1 or 2",
+		}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHashBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`values({"b": 1, "a": 2, 3: 3, true: 4})`, []int{4, 3, 2, 1}},
+		{`keys({1: "a", -5: "b"})`, []int{-5, 1}},
+		{`hasKey({"a": 1}, "a")`, true},
+		{`hasKey({"a": 1}, "b")`, false},
+		{`delete({1: 1, 2: 2}, 1)`, map[object.HashKey]int64{
+			(&object.Integer{Value: 2}).HashKey(): 2,
+		}},
+		{`merge({1: 1, 2: 2}, {2: 3})`, map[object.HashKey]int64{
+			(&object.Integer{Value: 1}).HashKey(): 1,
+			(&object.Integer{Value: 2}).HashKey(): 3,
+		}},
+		{`hasKey({}, [])`, &object.Error{
+			Message: "unusable as hash key: ARRAY",
+		}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTypeBuiltin(t *testing.T) {
+	tests := []vmTestCase{
+		{`type(1)`, "INTEGER"},
+		{`type(1.5)`, "FLOAT"},
+		{`type("a")`, "STRING"},
+		{`type(true)`, "BOOLEAN"},
+		{`type([])`, "ARRAY"},
+		{`type({})`, "HASH"},
+		{`type(if (false) { 1 })`, "NULL"},
+		{`type(fn(x) { x })`, "FUNCTION"},
+		{`let a = 1; type(fn() { a })`, "FUNCTION"},
+		{`type(len)`, "BUILTIN"},
+		{`let f = type; f(1, 2)`, &object.Error{
+			Message: "wrong number of arguments. got=2, want=1",
+		}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestConversionBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`int(5)`, 5},
+		{`int(3.99)`, 3},
+		{`int(-3.99)`, -3},
+		{`int(" 42 ")`, 42},
+		{`int(true) + int(false)`, 1},
+		{`int("abc")`, &object.Error{
+			Message: `could not parse "abc" as integer`,
+		}},
+		{`int([])`, &object.Error{
+			Message: "argument to `int` not supported, got ARRAY",
+		}},
+		{`str(5)`, "5"},
+		{`str(-2.5)`, "-2.5"},
+		{`str([1, "a"])`, "[1, a]"},
+		{`"count: " + str(1 + 2)`, "count: 3"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMathBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`abs(-5)`, 5},
+		{`abs(-2.5)`, 2.5},
+		{`min(3, 1, 2)`, 1},
+		{`min([3, -1.5, 2])`, -1.5},
+		{`max(3, 1, 2)`, 3},
+		{`max([1, 2.5])`, 2.5},
+		{`pow(2, 10)`, 1024},
+		{`pow(2, -1)`, 0.5},
+		{`sqrt(16)`, 4.0},
+		{`pow(2, 63)`, &object.Error{
+			Message: "integer overflow in `pow`",
+		}},
+		{`sqrt(-4)`, &object.Error{
+			Message: "cannot take square root of negative number -4",
+		}},
+		{`max([])`, &object.Error{
+			Message: "`max` needs at least one number",
+		}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRangeBuiltin(t *testing.T) {
+	tests := []vmTestCase{
+		{`range(4)`, []int{0, 1, 2, 3}},
+		{`range(2, 5)`, []int{2, 3, 4}},
+		{`range(0, 10, 3)`, []int{0, 3, 6, 9}},
+		{`range(5, 0, -2)`, []int{5, 3, 1}},
+		{`range(5, 2)`, []int{}},
+		{`reduce(range(1, 101), 0, fn(acc, x) { acc + x })`, 5050},
+		{`range(0, 1, 0)`, &object.Error{
+			Message: "`range` step must not be 0",
+		}},
 	}
 
 	runVmTests(t, tests)
 }
+
+// Writes modules for the tests of imports to a temporary directory,
+// returning the directory.
+func writeModules(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"util.monkey": `import "./helper.monkey";
+let count = 0;
+let counter = fn() { count = count + 1; count };
+let double = fn(x) { helper.twice(x) };`,
+		"helper.monkey":  "let twice = fn(x) { x * 2 };",
+		"cycle.monkey":   `import "./cycle.monkey";`,
+		"returns.monkey": "let x = 1; if (true) { return x; }",
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestImports(t *testing.T) {
+	dir := writeModules(t)
+
+	tests := []vmTestCase{
+		{fmt.Sprintf(`import "%s/util.monkey"; util.double(21)`, dir), 42},
+		{fmt.Sprintf(`import "%s/util.monkey"; import "%s/util.monkey" as again; util.counter(); again.counter()`,
+			dir, dir), 2},
+		{fmt.Sprintf(`let f = fn() { import "%s/helper.monkey"; helper.twice(4) }; f() + f()`, dir), 16},
+		{fmt.Sprintf(`import "%s/helper.monkey"; helper.missing`, dir), Null},
+		{`import "std/strings"; strings.repeat("ab", 3)`, "ababab"},
+		{`import "std/strings" as s; s.startsWith("monkey", "mon")`, true},
+		{`import "std/strings" as s; s.padLeft("7", 3, "0")`, "007"},
+		{`let h = {"a": {"b": 2}}; h.a.b`, 2},
+	}
+
+	runVmTests(t, tests)
+
+	// Relative imports are found from the import directory.
+	comp := compiler.New()
+	comp.SetImportDir(dir)
+	if err := comp.Compile(parse(`import "./util.monkey"; util.double(5)`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, 10, vm.LastPoppedStackElem())
+}
+
+func TestFileBuiltins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.txt")
+
+	tests := []vmTestCase{
+		{fmt.Sprintf(`writeFile("%s", "hello")`, path), Null},
+		{fmt.Sprintf(`readFile("%s")`, path), "hello"},
+		{fmt.Sprintf(`appendFile("%s", " world"); readFile("%s")`, path, path), "hello world"},
+		{fmt.Sprintf(`readFile("%s")`, path+".missing"), &object.Error{
+			Message: fmt.Sprintf("`readFile` failed: open %s.missing: no such file or directory", path),
+		}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFileBuiltinsDenied(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denied.txt")
+
+	tests := []vmTestCase{
+		{fmt.Sprintf(`readFile("%s")`, path), &object.Error{
+			Message: "`readFile` is not allowed: filesystem access is disabled",
+		}},
+		{fmt.Sprintf(`writeFile("%s", "x")`, path), &object.Error{
+			Message: "`writeFile` is not allowed: filesystem access is disabled",
+		}},
+		{fmt.Sprintf(`appendFile("%s", "x")`, path), &object.Error{
+			Message: "`appendFile` is not allowed: filesystem access is disabled",
+		}},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.Deny(object.FileSystemCapability)
+		testVmResult(t, test.input, vm, vm.Run(), test.expected)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("denied builtins touched the file system. err=%v", err)
+	}
+}
+
+func TestDeniedCapabilities(t *testing.T) {
+	tests := []struct {
+		input    string
+		denied   object.Capability
+		expected interface{}
+	}{
+		{`now()`, object.TimeCapability, &object.Error{
+			Message: "`now` is not allowed: time access is disabled",
+		}},
+		{`sleep(0)`, object.TimeCapability, &object.Error{
+			Message: "`sleep` is not allowed: time access is disabled",
+		}},
+		{`getEnv("HOME")`, object.EnvironmentCapability, &object.Error{
+			Message: "`getEnv` is not allowed: environment access is disabled",
+		}},
+		{`formatTime(0)`, object.TimeCapability, "1970-01-01T00:00:00Z"},
+		{`now() > 0`, object.EnvironmentCapability, true},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.Deny(test.denied)
+		testVmResult(t, test.input, vm, vm.Run(), test.expected)
+	}
+}
+
+func TestGetEnv(t *testing.T) {
+	t.Setenv("MONKEY_TEST_VAR", "banana")
+
+	tests := []vmTestCase{
+		{`getEnv("MONKEY_TEST_VAR")`, "banana"},
+		{`getEnv("MONKEY_TEST_UNSET_VAR")`, Null},
+		{`getEnv(1)`, &object.Error{Message: "argument to `getEnv` must be STRING, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestHigherOrderBuiltinErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`map([1], 5)`, "not a function: INTEGER"},
+		{`map([1], fn() { 1 })`, "wrong number of arguments: want=0, got=1"},
+		{`map([1, 2], fn(x) { x + true }); 5`, "type mismatch: INTEGER + BOOLEAN"},
+		{`map([1], fn(x) { filter([x], fn(y) { -true }) })`, "unknown operator: -BOOLEAN"},
+		{`sort([1, 2], fn(a, b) { a + true })`, "type mismatch: INTEGER + BOOLEAN"},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != test.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", test.expected, err)
+		}
+	}
+}
+
+func TestBuiltinOutput(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`puts("hello", "world!")`, "hello\nworld!\n"},
+		{`puts([1, 2], 3.5)`, "[1, 2]\n3.5\n"},
+		{`print("a", 1); print("b")`, "a 1b"},
+		{`let greet = fn(name) { print("hi", name) }; greet("bob")`, "hi bob"},
+		{`print()`, ""},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+
+		vm := New(comp.Bytecode())
+		vm.SetStdout(&out)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, Null, vm.LastPoppedStackElem())
+		if out.String() != test.expected {
+			t.Errorf("wrong output for %q. got=%q, want=%q",
+				test.input, out.String(), test.expected)
+		}
+	}
+}
+
+func TestInputBuiltins(t *testing.T) {
+	tests := []struct {
+		input          string
+		stdin          string
+		expected       interface{}
+		expectedOutput string
+	}{
+		{`readLine()`, "hello\nworld\n", "hello", ""},
+		{`readLine(); readLine()`, "hello\r\nworld", "world", ""},
+		{`readLine()`, "", Null, ""},
+		{`input("name? ")`, "bob\n", "bob", "name? "},
+		{`input()`, "bob\n", "bob", ""},
+		{
+			`let f = readLine; f(1)`, "",
+			&object.Error{Message: "wrong number of arguments. got=1, want=0"}, "",
+		},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+
+		vm := New(comp.Bytecode())
+		vm.SetStdout(&out)
+		vm.SetStdin(strings.NewReader(test.stdin))
+		testVmResult(t, test.input, vm, vm.Run(), test.expected)
+		if out.String() != test.expectedOutput {
+			t.Errorf("wrong output for %q. got=%q, want=%q",
+				test.input, out.String(), test.expectedOutput)
+		}
+	}
+}
+
+func TestJSONBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`jsonParse("[1, 2, 3]")`, []int{1, 2, 3}},
+		{`jsonParse("2.5")`, 2.5},
+		{`jsonParse("null")`, Null},
+		{`if (jsonParse("null")) { 1 } else { 2 }`, 2},
+		{`jsonParse(jsonStringify({"a": [1, {"b": false}]}))["a"][1]["b"]`, false},
+		{`jsonParse("[1,")`, &object.Error{
+			Message: "`jsonParse` failed: unexpected EOF",
+		}},
+		{`jsonStringify({"b": 1, "a": [true, 2.5]})`, `{"a":[true,2.5],"b":1}`},
+		{`jsonStringify(fn(x) { x })`, &object.Error{
+			Message: "`jsonStringify` cannot encode FUNCTION",
+		}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTimeBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`now() > 1600000000000`, true},
+		{`let start = now(); sleep(5); now() - start >= 5`, true},
+		{`sleep(-1)`, &object.Error{
+			Message: "cannot sleep for -1 milliseconds",
+		}},
+		{`formatTime(86400000, "2006-01-02")`, "1970-01-02"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestExitBuiltin(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedCode   int64
+		expectedOutput string
+	}{
+		{`exit()`, 0, ""},
+		{`exit(3); puts("unreachable")`, 3, ""},
+		{`puts("a"); let f = fn() { exit(255); 5 }; f() + 1`, 255, "a\n"},
+		{`map([1, 2, 3], fn(x) { if (x == 2) { exit(x) } puts(x) })`, 2, "1\n"},
+		{`while (true) { exit(5) }`, 5, ""},
+		{`try { exit(6) } catch { puts("caught") } finally { puts("finally") }`, 6, ""},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		var out bytes.Buffer
+
+		vm := New(comp.Bytecode())
+		vm.SetStdout(&out)
+		err = vm.Run()
+
+		exit, ok := err.(*object.Exit)
+		if !ok {
+			t.Errorf("error is not Exit for %q. got=%T (%+v)", test.input, err, err)
+			continue
+		}
+		if exit.Code != test.expectedCode {
+			t.Errorf("wrong exit code for %q. got=%d, want=%d", test.input, exit.Code, test.expectedCode)
+		}
+		if out.String() != test.expectedOutput {
+			t.Errorf("wrong output for %q. got=%q, want=%q",
+				test.input, out.String(), test.expectedOutput)
+		}
+	}
+}
+
+func TestSleepInterrupted(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`sleep(60000)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	vm := New(comp.Bytecode())
+	vm.SetContext(ctx)
+	testVmResult(t, "sleep(60000)", vm, vm.Run(), &object.Error{
+		Message: "`sleep` interrupted: context canceled",
+	})
+}
+
+func TestTrace(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(x) { "n" + x }; f("a")`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(comp.Bytecode())
+	vm.EnableTrace(&out)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	expected := `main         0000 OpClosure 1 0            []
+main         0004 OpSetGlobal 0            [fn f]
+main         0007 OpGetGlobal 0            []
+main         0010 OpConstant 2             [fn f]
+main         0013 OpCall 1                 [fn f, "a"]
+f            0000 OpConstant 0             [fn f, "a"]
+f            0003 OpGetLocalAdd 0          [fn f, "a", "n"]
+f            0005 OpReturnValue            [fn f, "a", "na"]
+main         0015 OpPop                    ["na"]
+`
+	if out.String() != expected {
+		t.Errorf("wrong trace.\nwant=\n%s\ngot=\n%s", expected, out.String())
+	}
+
+	// Once tracing is off, nothing more is written.
+	out.Reset()
+	vm.DisableTrace()
+	vm.Call(vm.globals[0], &object.String{Value: "b"})
+	if out.Len() != 0 {
+		t.Errorf("trace written after it was disabled. got=%q", out.String())
+	}
+}
+
+func TestTraceStack(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`[1, 2, 3, 4, "a long string that is cut short"]`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(comp.Bytecode())
+	vm.EnableTrace(&out)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	expected := `OpArray 5                ... [2, 3, 4, "a long string that i...]`
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("trace doesn't contain %q. got=\n%s", expected, out.String())
+	}
+}
+
+func TestStep(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(x) { x + 1 }; f(2)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+
+	// OpClosure, OpSetGlobal, OpGetGlobal, OpConstant and OpCall, which
+	// enters f.
+	for i := 0; i < 5; i++ {
+		if err := vm.Step(); err != nil {
+			t.Fatalf("step %d: vm error: %s", i, err)
+		}
+	}
+
+	frames := vm.Frames()
+	if len(frames) != 2 {
+		t.Fatalf("wrong number of frames. got=%d", len(frames))
+	}
+	if frames[0].Name != "main" || frames[0].Function != MainFunction || frames[0].IP != 15 {
+		t.Errorf("wrong main frame. got=%+v", frames[0])
+	}
+	if frames[1].Name != "f" || frames[1].Function != 1 || frames[1].IP != 0 {
+		t.Errorf("wrong frame for f. got=%+v", frames[1])
+	}
+	if frames[1].Line != 1 || frames[1].Column != 17 {
+		t.Errorf("wrong position for f. got=%d:%d", frames[1].Line, frames[1].Column)
+	}
+	if len(frames[1].Locals) != 1 || frames[1].Locals[0].Inspect() != "2" {
+		t.Errorf("wrong locals for f. got=%v", frames[1].Locals)
+	}
+	if f, ok := vm.Globals()[0].(*object.Closure); !ok || f.Fn.Name != "f" {
+		t.Errorf("wrong global 0. got=%v", vm.Globals()[0])
+	}
+
+	for steps := 0; !vm.Finished(); steps++ {
+		if steps > 10 {
+			t.Fatalf("program not finished after %d more steps", steps)
+		}
+		if err := vm.Step(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+	}
+	if err := testIntegerObject(3, vm.LastPoppedStackElem()); err != nil {
+		t.Errorf("wrong result: %s", err)
+	}
+
+	if err := vm.Step(); err != nil {
+		t.Errorf("error stepping a finished program: %s", err)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`
+	let f = fn(x) { x * 2 };
+	let total = f(1) + f(2);
+	map([3], f);
+	total
+	`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.Bytecode())
+
+	if err := vm.SetBreakpoint(0, 0); err == nil {
+		t.Errorf("no error for a breakpoint in a constant that isn't a function")
+	}
+	if err := vm.SetBreakpoint(1, 1); err == nil {
+		t.Errorf("no error for a breakpoint within an instruction")
+	}
+	if err := vm.SetBreakpoint(1, 0); err != nil {
+		t.Fatalf("error setting breakpoint: %s", err)
+	}
+
+	// f stops as it is called from main, but not as `map` calls it.
+	for _, arg := range []string{"1", "2"} {
+		err := vm.Run()
+		bp, ok := err.(*Breakpoint)
+		if !ok || bp.Function != 1 || bp.IP != 0 {
+			t.Fatalf("wrong error. want breakpoint, got=%T (%v)", err, err)
+		}
+		frames := vm.Frames()
+		if locals := frames[len(frames)-1].Locals; locals[0].Inspect() != arg {
+			t.Errorf("wrong argument at breakpoint. want=%s, got=%s", arg, locals[0].Inspect())
+		}
+		if stack := vm.Stack(); len(stack) == 0 || stack[len(stack)-1].Inspect() != arg {
+			t.Errorf("wrong stack at breakpoint. got=%v", stack)
+		}
+	}
+
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if err := testIntegerObject(6, vm.LastPoppedStackElem()); err != nil {
+		t.Errorf("wrong result: %s", err)
+	}
+
+	if err := vm.ClearBreakpoint(1, 0); err != nil {
+		t.Errorf("error clearing breakpoint: %s", err)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`
+	let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+	let double = fn(x) { x * 2 };
+	fib(10) + reduce(map([1, 2], double), 0, fn(a, b) { a + b })
+	`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if vm.Profile() != nil {
+		t.Errorf("profile before profiling was enabled")
+	}
+	vm.EnableProfiling()
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	profile := vm.Profile()
+
+	calls := map[string]uint64{}
+	var instructions uint64
+	for _, fn := range profile.Functions {
+		calls[fn.Name] = fn.Calls
+		instructions += fn.Instructions
+	}
+	expected := map[string]uint64{"main": 1, "fib": 177, "double": 2, "<anonymous>": 2}
+	for name, want := range expected {
+		if calls[name] != want {
+			t.Errorf("wrong number of calls to %s. want=%d, got=%d", name, want, calls[name])
+		}
+	}
+	if instructions != vm.InstructionsExecuted() {
+		t.Errorf("wrong number of instructions for the functions. want=%d, got=%d",
+			vm.InstructionsExecuted(), instructions)
+	}
+
+	var counted uint64
+	for _, op := range profile.Opcodes {
+		counted += op.Count
+	}
+	if counted != vm.InstructionsExecuted() {
+		t.Errorf("wrong number of instructions for the opcodes. want=%d, got=%d",
+			vm.InstructionsExecuted(), counted)
+	}
+
+	// Main includes everything, and fib takes the most time of the rest.
+	if profile.Functions[0].Name != "main" || profile.Functions[1].Name != "fib" {
+		t.Errorf("functions not ordered by time. got=%+v", profile.Functions)
+	}
+	if !strings.HasPrefix(profile.String(), "function  ") {
+		t.Errorf("wrong table. got=\n%s", profile)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	inputs := []string{
+		`while (true) { }`,
+		`let i = 0; while (i >= 0) { i = i + 1 }`,
+		`map([1], fn(x) { while (true) { } })`,
+	}
+
+	for _, input := range inputs {
+		comp := compiler.New()
+		err := comp.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err = New(comp.Bytecode()).RunContext(ctx)
+		cancel()
+
+		if err != context.DeadlineExceeded {
+			t.Errorf("wrong error for %q. got=%v, want=%v", input, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+		let newClosure = fn(a) {
+			fn() { a; };
+		};
+		let closure = newClosure(99);
+		closure();
+		`,
+			expected: 99,
+		},
+		{
+			input: `
+		let newAdder = fn(a, b) {
+			fn(c) { a + b + c };
+		};
+		let adder = newAdder(1, 2);
+		adder(8);
+		`,
+			expected: 11,
+		},
+		{
+			input: `
+		let newAdder = fn(a, b) {
+			let c = a + b;
+			fn(d) { c + d };
+		};
+		let adder = newAdder(1, 2);
+		adder(8);
+		`,
+			expected: 11,
+		},
+		{
+			input: `
+		let newAdderOuter = fn(a, b) {
+			let c = a + b;
+			fn(d) {
+				let e = d + c;
+				fn(f) { e + f; };
+			};
+		};
+		let newAdderInner = newAdderOuter(1, 2)
+		let adder = newAdderInner(3);
+		adder(8);
+		`,
+			expected: 14,
+		},
+		{
+			input: `
+		let a = 1;
+		let newAdderOuter = fn(b) {
+			fn(c) {
+				fn(d) { a + b + c + d };
+			};
+		};
+		let newAdderInner = newAdderOuter(2)
+		let adder = newAdderInner(3);
+		adder(8);
+		`,
+			expected: 14,
+		},
+		{
+			input: `
+		let newClosure = fn(a, b) {
+			let one = fn() { a; };
+			let two = fn() { b; };
+			fn() { one() + two(); };
+		};
+		let closure = newClosure(9, 90);
+		closure();
+		`,
+			expected: 99,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+// Closures share the variables they capture with the function that defined
+// them, and with each other.
+func TestClosuresShareVariables(t *testing.T) {
+	tests := []vmTestCase{
+		{"let mk = fn() { let n = 0; fn() { n = n + 1; n } }; let c = mk(); c(); c(); c()", 3},
+		{"let mk = fn() { let n = 0; fn() { n = n + 1; n } }; let c = mk(); c(); mk()()", 1},
+		{"let f = fn() { let x = 1; let g = fn() { x }; x = 2; g() }; f()", 2},
+		{"let f = fn(x) { let g = fn() { x }; x = x * 2; g() }; f(21)", 42},
+		{"let f = fn() { let a = 1; let inc = fn() { fn() { a = a + 10 } }; inc()(); inc()(); a }; f()", 21},
+		{`let f = fn() {
+			let n = 0;
+			let get = fn() { n };
+			let set = fn(v) { n = v };
+			set(5);
+			[get(), n]
+		}; f()`, []int{5, 5}},
+		{`let f = fn() {
+			let n = 1;
+			let g = fn() { n + 1 };
+			n = n + g();
+			n
+		}; f()`, 3},
+		// Each time round a loop defines a new variable.
+		{`let f = fn() {
+			let fs = [];
+			let i = 0;
+			while (i < 3) { let j = i; fs = push(fs, fn() { j }); i = i + 1 };
+			map(fs, fn(g) { g() })
+		}; f()`, []int{0, 1, 2}},
+		// Blocks at the top level define new variables each time too.
+		{`let fs = [];
+		let i = 0;
+		while (i < 3) { let j = i; fs = push(fs, fn() { j }); i = i + 1 };
+		map(fs, fn(g) { g() })`, []int{0, 1, 2}},
+		{"if (true) { let a = 1; let inc = fn() { a = a + 1 }; inc(); a = a * 10; inc(); a }", 21},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+		let countDown = fn(x) {
+			if (x == 0) {
+				return 0;
+			} else {
+				countDown(x - 1);
+			}
+		};
+		countDown(1);
+		`,
+			expected: 0,
+		},
+		{
+			input: `
+		let countDown = fn(x) {
+			if (x == 0) {
+				return 0;
+			} else {
+				countDown(x - 1);
+			}
+		};
+		let wrapper = fn() {
+			countDown(1);
+		};
+		wrapper();
+		`,
+			expected: 0,
+		},
+		{
+			input: `
+		let wrapper = fn() {
+			let countDown = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					countDown(x - 1);
+				}
+			};
+			countDown(1);
+		};
+		wrapper();
+		`,
+			expected: 0,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRecursiveFibonacci(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+		let fibonacci = fn(x) {
+			if (x == 0) {
+				return 0;
+			} else {
+				if (x == 1) {
+					return 1;
+				} else {
+					fibonacci(x - 1) + fibonacci(x - 2);
+				}
+			}
+		};
+		fibonacci(15);
+		`,
+			expected: 610,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+// A call a function ends with reuses its frame, so that recursion in tail
+// position isn't limited by the number of frames.
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{"let f = fn(n, acc) { if (n == 0) { acc } else { f(n - 1, acc + n) } }; f(100000, 0)", 5000050000},
+		{"let f = fn(n) { if (n > 0) { return f(n - 1) } 7 }; f(100000)", 7},
+		{"let f = fn(n) { n > 0 ? f(n - 1) : 7 }; f(100000)", 7},
+		{"let f = fn(n, ...rest) { if (n == 0) { len(rest) } else { f(n - 1, n, n) } }; f(100000)", 2},
+		{"let f = fn(n) { if (n == 0) { 7 } else { f(n - 1) } }; map([100000], f)", []int{7}},
+		// A builtin isn't called in place of the function.
+		{"let f = fn(x) { len(x) }; f([1, 2])", 2},
+		// Nor is a call within a try, whose handler must still catch what the
+		// call throws.
+		{"let g = fn() { throw 1 }; let f = fn() { try { return g() } catch (e) { e + 1 } }; f()", 2},
+		{`let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(100000)`,
+			&object.Error{Message: "stack overflow: more than 1023 nested calls"}},
+		{"let f = fn(g) { g(1, 2) }; f(fn(a) { a })",
+			&object.Error{Message: "wrong number of arguments: want=1, got=2"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBuiltinErrorStackTraces(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedStack []object.StackFrame
+	}{
+		{"len(1)", nil},
+		{
+			`
+		let inner = fn(x) { len(x) };
+		let outer = fn() { inner(1) };
+		fn() { outer() }();
+		`,
+			[]object.StackFrame{
+				{Function: "inner", Line: 3, Column: 27},
+				{Function: "outer", Line: 4, Column: 15},
+				{Function: "<anonymous>", Line: 4, Column: 19},
+			},
+		},
+		{
+			// Tail calls are listed as they were made, with a function
+			// calling itself recorded once.
+			`
+		let inner = fn(n) { if (n == 0) { len(1) } else { inner(n - 1) } };
+		let outer = fn() { inner(3) };
+		outer();
+		`,
+			[]object.StackFrame{
+				{Function: "inner", Line: 2, Column: 58},
+				{Function: "inner", Line: 3, Column: 27},
+				{Function: "outer", Line: 4, Column: 8},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		program := parse(test.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		errObj, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("error is not *RuntimeError: %T (%+v)", err, err)
+		}
+
+		if len(errObj.Stack) != len(test.expectedStack) {
+			t.Fatalf("wrong stack length. want=%d, got=%d (%+v)",
+				len(test.expectedStack), len(errObj.Stack), errObj.Stack)
+		}
+
+		for i, frame := range test.expectedStack {
+			if errObj.Stack[i] != frame {
+				t.Errorf("wrong stack frame %d. want=%+v, got=%+v",
+					i, frame, errObj.Stack[i])
+			}
+		}
+	}
+}
+
+func TestRuntimeErrorPositions(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedLine   int
+		expectedColumn int
+		expectedStack  []object.StackFrame
+	}{
+		{"1;\n-true", 2, 1, nil},
+		{"let x = 1;\n  x + \"a\"", 2, 5, nil},
+		{
+			// OpGetLocal and OpConstantSub are fused, and fail at the `-`.
+			"let f = fn(x) {\n  x - 1\n};\nf(\"a\")",
+			2, 5,
+			[]object.StackFrame{{Function: "f", Line: 4, Column: 2}},
+		},
+		{
+			"let f = fn() {\n  throw 1\n};\nf()",
+			2, 3,
+			[]object.StackFrame{{Function: "f", Line: 4, Column: 2}},
+		},
+		{
+			"let f = fn() { 1 < [] };\nlet g = fn() { f() };\ng()",
+			1, 18,
+			[]object.StackFrame{
+				{Function: "f", Line: 2, Column: 17},
+				{Function: "g", Line: 3, Column: 2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("error is not *RuntimeError. got=%T (%v)", err, err)
+		}
+
+		if runtimeErr.Line != test.expectedLine || runtimeErr.Column != test.expectedColumn {
+			t.Errorf("wrong position for %q. want=%d:%d, got=%d:%d", runtimeErr.Message,
+				test.expectedLine, test.expectedColumn, runtimeErr.Line, runtimeErr.Column)
+		}
+		if len(runtimeErr.Stack) != len(test.expectedStack) {
+			t.Fatalf("wrong stack length. want=%d, got=%d (%+v)",
+				len(test.expectedStack), len(runtimeErr.Stack), runtimeErr.Stack)
+		}
+		for i, frame := range test.expectedStack {
+			if runtimeErr.Stack[i] != frame {
+				t.Errorf("wrong stack frame %d. want=%+v, got=%+v",
+					i, frame, runtimeErr.Stack[i])
+			}
+		}
+	}
+}
+
+func TestInternalErrors(t *testing.T) {
+	// Bytecode the verifier rejects, with a constant that isn't there.
+	bad := append(code.Make(code.OpConstant, 5), code.Make(code.OpPop)...)
+	expected := "internal error: runtime error: index out of range [5] with length 0"
+
+	vm := New(&compiler.Bytecode{Instructions: bad})
+	err := vm.Run()
+	runtimeErr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("error is not *RuntimeError. got=%T (%v)", err, err)
+	}
+	if runtimeErr.Message != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, runtimeErr.Message)
+	}
+
+	fn := &object.Closure{Fn: &object.CompiledFunction{Instructions: bad}}
+	result := New(&compiler.Bytecode{}).Call(fn)
+	errObj, ok := result.(*object.Error)
+	if !ok {
+		t.Fatalf("result is not *object.Error. got=%T (%+v)", result, result)
+	}
+	if errObj.Message != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, errObj.Message)
+	}
+
+	// Internal errors can't be caught.
+	comp := compiler.New()
+	if err := comp.Compile(parse(`let f = fn(g) { try { g() } catch { 1 } }`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm = New(comp.Bytecode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	f := vm.globals[0]
+	result = vm.Call(f, fn)
+	if errObj, ok := result.(*object.Error); !ok || !strings.HasPrefix(errObj.Message, "internal error: ") {
+		t.Errorf("wrong result calling f. got=%T (%+v)", result, result)
+	}
+
+	// Nor does returning from main, which pops its frame, crash the VM.
+	returns := append(code.Make(code.OpConstant, 0), code.Make(code.OpReturnValue)...)
+	vm = New(&compiler.Bytecode{Instructions: returns, Constants: []object.Object{&object.Integer{Value: 5}}})
+	if _, ok := vm.Run().(*RuntimeError); !ok {
+		t.Errorf("returning from main didn't fail")
+	}
+
+	strict := New(&compiler.Bytecode{Instructions: bad})
+	strict.SetStrict(true)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("strict VM didn't panic")
+		}
+	}()
+	strict.Run()
+}
+
+func TestInstructionsExecuted(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(x) { x * 2 }; f(1) + f(2)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	// Main: 2 to define f, 3 per call, 1 to add and 1 to pop.
+	// Each call of f: 4 to multiply and return.
+	if got := vm.InstructionsExecuted(); got != 18 {
+		t.Errorf("wrong number of instructions executed. got=%d, want=%d", got, 18)
+	}
+}
+
+func TestCheckedArithmetic(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"9223372036854775807 + 1", "integer overflow: 9223372036854775807 + 1"},
+		{"-9223372036854775807 - 2", "integer overflow: -9223372036854775807 - 2"},
+		{"4611686018427387904 * 2", "integer overflow: 4611686018427387904 * 2"},
+		{"let min = -9223372036854775807 - 1; min / -1", "integer overflow: -9223372036854775808 / -1"},
+		{"let min = -9223372036854775807 - 1; -min", "integer overflow: -(-9223372036854775808)"},
+		// Superinstructions: OpGetLocalAdd, OpConstantAdd and OpConstantSub.
+		{"let f = fn(x) { x + x }; f(4611686018427387904)", "integer overflow: 4611686018427387904 + 4611686018427387904"},
+		{"let f = fn(x) { x + 1 }; f(9223372036854775807)", "integer overflow: 9223372036854775807 + 1"},
+		{"let f = fn(x) { x - 1 }; f(-9223372036854775807 - 1)", "integer overflow: -9223372036854775808 - 1"},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetCheckedArithmetic(true)
+		err = vm.Run()
+		if err == nil {
+			t.Errorf("no error for %q. got=%s", test.input, vm.LastPoppedStackElem().Inspect())
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Errorf("wrong error message. expected=%q, got=%q", test.expected, err)
+		}
+	}
+
+	// Without checking, overflow wraps around.
+	runVmTests(t, []vmTestCase{
+		{"9223372036854775807 + 1", -9223372036854775808},
+		{"let f = fn(x) { x + 1 }; f(9223372036854775807)", -9223372036854775808},
+	})
+}
+
+func TestStepLimit(t *testing.T) {
+	tests := []struct {
+		input    string
+		limit    uint64
+		exceeded bool
+	}{
+		{`let f = fn(x) { x * 2 }; f(1) + f(2)`, 18, false},
+		{`let f = fn(x) { x * 2 }; f(1) + f(2)`, 17, true},
+		{`while (true) { }`, 1000, true},
+		{`map([1, 2, 3], fn(x) { while (true) { } })`, 1000, true},
+		{`while (true) { }`, 0, true},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetStepLimit(test.limit)
+
+		// Without a limit, the loop has to be stopped some other way.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err = vm.RunContext(ctx)
+		cancel()
+
+		if test.limit == 0 {
+			if err != context.DeadlineExceeded {
+				t.Errorf("wrong error without a limit. got=%v", err)
+			}
+			continue
+		}
+
+		budget, ok := err.(*object.BudgetExceeded)
+		if ok != test.exceeded {
+			t.Errorf("wrong error for %q with limit %d. got=%v", test.input, test.limit, err)
+			continue
+		}
+		if ok && budget.Limit != test.limit {
+			t.Errorf("wrong limit. got=%d, want=%d", budget.Limit, test.limit)
+		}
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	tests := []struct {
+		input    string
+		exceeded bool
+	}{
+		{`let a = []; while (true) { a = push(a, a) }`, true},
+		{`let s = "a"; while (true) { s = s + s }`, true},
+		{`let h = {}; let i = 0; while (true) { h = merge(h, {i: i}); i = i + 1 }`, true},
+		{`let a = [1, 2, 3]; while (true) { a = a[0:] }`, true},
+		{`let a = []; let i = 0; while (i < 10) { a = push(a, i); i = i + 1 }; len(a)`, false},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		vm.SetMemoryLimit(1 << 20)
+		err = vm.Run()
+
+		budget, ok := err.(*object.BudgetExceeded)
+		if ok != test.exceeded {
+			t.Errorf("wrong error for %q. got=%v", test.input, err)
+			continue
+		}
+		if ok && (budget.Budget != object.MemoryBudget || budget.Limit != 1<<20) {
+			t.Errorf("wrong budget for %q. got=%+v", test.input, budget)
+		}
+	}
+}
+
+func TestStackGrowth(t *testing.T) {
+	elements := make([]string, 3*STACK_SIZE)
+	for i := range elements {
+		elements[i] = fmt.Sprint(i)
+	}
+	input := "let f = fn(a) { len(a) }; f([" + strings.Join(elements, ", ") + "])"
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, len(elements), vm.LastPoppedStackElem())
+
+	vm = New(comp.Bytecode())
+	vm.SetMaxStackSize(STACK_SIZE + 10)
+	err = vm.Run()
+	if err == nil || err.Error() != "stack overflow" {
+		t.Errorf("wrong error beyond the maximum stack size. got=%v", err)
+	}
+}
+
+func runBenchmark(b *testing.B, input string) {
+	b.Run("fused", func(b *testing.B) { runBenchmarkWith(b, input, true) })
+	b.Run("unfused", func(b *testing.B) { runBenchmarkWith(b, input, false) })
+}
+
+// Runs the benchmark with or without superinstructions, to show what they
+// save.
+func runBenchmarkWith(b *testing.B, input string, superinstructions bool) {
+	comp := compiler.New()
+	comp.SetSuperinstructions(superinstructions)
+	err := comp.Compile(parse(input))
+	if err != nil {
+		b.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vm := New(bytecode)
+		if err := vm.Run(); err != nil {
+			b.Fatalf("vm error: %s", err)
+		}
+	}
+}
+
+// Stays within the initial stack, like most programs.
+func BenchmarkFibonacci(b *testing.B) {
+	runBenchmark(b, `
+	let fibonacci = fn(x) {
+		if (x < 2) { x } else { fibonacci(x - 1) + fibonacci(x - 2) }
+	};
+	fibonacci(20);
+	`)
+}
+
+// Works on integers too large to be shared, in local variables.
+func BenchmarkIntegerLoop(b *testing.B) {
+	runBenchmark(b, `
+	let sum = fn(n) {
+		let i = 0;
+		let total = 0;
+		while (i < n) { total = total + i * i; i = i + 1 };
+		total
+	};
+	sum(10000);
+	`)
+}
+
+// Grows the stack to hold every element before building the array.
+func BenchmarkLargeArrayLiteral(b *testing.B) {
+	elements := make([]string, 4*STACK_SIZE)
+	for i := range elements {
+		elements[i] = fmt.Sprint(i)
+	}
+	runBenchmark(b, "["+strings.Join(elements, ", ")+"]")
+}
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		input    string
+		opts     Options
+		expected interface{}
+	}{
+		{`let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(100)`, Options{StackSize: 1}, 100},
+		{`let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(100)`,
+			Options{MaxFrames: 100}, "stack overflow: more than 99 nested calls"},
+		{`let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(2000)`, Options{MaxFrames: 4096}, 2000},
+		{`[1, 2, 3, 4]`, Options{StackSize: 2, MaxStackSize: 3}, "stack overflow"},
+		{`let a = 1; let b = 2; a + b`, Options{GlobalsSize: 2}, 3},
+		{`let a = 1; let b = 2; let c = 3;`, Options{GlobalsSize: 2}, "too many globals: the VM has room for 2"},
+	}
+
+	for _, test := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewWithOptions(comp.Bytecode(), test.opts)
+		err = vm.Run()
+
+		if message, ok := test.expected.(string); ok {
+			if err == nil || err.Error() != message {
+				t.Errorf("wrong error for %q with %+v. got=%v, want=%q", test.input, test.opts, err, message)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("vm error for %q with %+v: %s", test.input, test.opts, err)
+			continue
+		}
+		testExpectedObject(t, test.expected, vm.LastPoppedStackElem())
+	}
+}